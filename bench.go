@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/ycvk/rightcode-reserve/reserve"
+)
+
+// runBench is `rc-proxy bench`: it drives concurrent load at a target (the
+// proxy, or the upstream directly for comparison) with a corpus of bodies
+// or synthetic ones and reports latency percentiles, throughput and, when
+// the target serves /_reserve/stats, the server's allocations and rewrite
+// path split over the run.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("rc-proxy bench", flag.ContinueOnError)
+	target := fs.String("target", "", "base URL to load, e.g. http://127.0.0.1:18080 (required)")
+	path := fs.String("path", "/v1/responses", "request path")
+	auth := fs.String("auth", "Bearer rc-bench", "Authorization header sent with every request")
+	bodies := fs.String("bodies", "", "directory of request bodies: raw files and/or -record .jsonl files (empty = synthetic)")
+	sizes := fs.String("sizes", "1k,16k,128k", "comma-separated sizes of synthetic bodies, cycled through")
+	model := fs.String("model", "gpt-5", "model named in synthetic bodies")
+	instructions := fs.Bool("instructions", false, "give synthetic bodies top-level instructions, exercising the AST path")
+	stream := fs.Bool("stream", false, `send synthetic bodies with "stream": true`)
+	conc := fs.Int("concurrency", 16, "requests in flight at once")
+	duration := fs.Duration("duration", 10*time.Second, "how long to keep sending")
+	maxReqs := fs.Int("requests", 0, "stop after this many requests (0 = until -duration)")
+	timeout := fs.Duration("timeout", time.Minute, "per-request timeout")
+	stats := fs.Bool("stats", true, "diff the target's /_reserve/stats over the run, when it serves them")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *target == "" {
+		fmt.Fprintln(os.Stderr, "bench: -target is required")
+		fs.Usage()
+		return 2
+	}
+	base := strings.TrimRight(*target, "/")
+
+	var corpus [][]byte
+	var err error
+	if *bodies != "" {
+		corpus, err = loadBenchCorpus(*bodies)
+	} else {
+		corpus, err = syntheticBodies(*sizes, *model, *instructions, *stream)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bench:", err)
+		return 2
+	}
+	if len(corpus) == 0 {
+		fmt.Fprintln(os.Stderr, "bench: no request bodies in", *bodies)
+		return 1
+	}
+
+	client := &http.Client{
+		Timeout:   *timeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: max(*conc, 1), ForceAttemptHTTP2: true},
+	}
+	var before map[string]any
+	if *stats {
+		before = fetchBenchStats(client, base)
+	}
+
+	var (
+		next    atomic.Int64
+		mu      sync.Mutex
+		samples []benchSample
+		wg      sync.WaitGroup
+	)
+	start := time.Now()
+	deadline := start.Add(*duration)
+	for range max(*conc, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local []benchSample
+			for time.Now().Before(deadline) {
+				n := next.Add(1)
+				if *maxReqs > 0 && n > int64(*maxReqs) {
+					break
+				}
+				local = append(local, benchOne(client, base+*path, *auth, corpus[int(n-1)%len(corpus)]))
+			}
+			mu.Lock()
+			samples = append(samples, local...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var after map[string]any
+	if before != nil {
+		after = fetchBenchStats(client, base)
+	}
+	return printBench(samples, elapsed, before, after)
+}
+
+// benchSample is the outcome of one request. ttfe is the time to the first
+// SSE line, zero for non-streamed responses.
+type benchSample struct {
+	status  int
+	err     error
+	sent    int
+	latency time.Duration
+	ttfe    time.Duration
+}
+
+func benchOne(client *http.Client, url, auth string, body []byte) benchSample {
+	s := benchSample{sent: len(body)}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		s.err = err
+		return s
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("User-Agent", "rc-proxy-bench/"+reserve.Build().Version)
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		s.err = err
+		return s
+	}
+	defer resp.Body.Close()
+	s.status = resp.StatusCode
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		br := bufio.NewReader(resp.Body)
+		for {
+			line, err := br.ReadSlice('\n')
+			if bytes.HasPrefix(line, []byte("event:")) || bytes.HasPrefix(line, []byte("data:")) {
+				s.ttfe = time.Since(start)
+				break
+			}
+			if err != nil && err != bufio.ErrBufferFull {
+				break
+			}
+		}
+		_, err = io.Copy(io.Discard, br)
+	} else {
+		_, err = io.Copy(io.Discard, resp.Body)
+	}
+	s.latency = time.Since(start)
+	if err != nil {
+		s.err = fmt.Errorf("read response: %w", err)
+	}
+	return s
+}
+
+// loadBenchCorpus reads every file in dir as a request body, except .jsonl
+// files, which are read as -record files and contribute their bodies.
+func loadBenchCorpus(dir string) ([][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out [][]byte
+	for _, e := range entries {
+		if !e.Type().IsRegular() || filepath.Ext(e.Name()) == ".jsonl" {
+			continue
+		}
+		bs, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, bs)
+	}
+	recs, err := reserve.ReadRecords(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range recs {
+		out = append(out, []byte(r.Body))
+	}
+	return out, nil
+}
+
+// syntheticBodies builds one body per entry of sizes ("512", "16k", "1m"),
+// padded with input text to roughly that many bytes.
+func syntheticBodies(sizes, model string, instructions, stream bool) ([][]byte, error) {
+	var out [][]byte
+	for _, f := range strings.Split(sizes, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		n, err := parseSize(f)
+		if err != nil {
+			return nil, fmt.Errorf("bad -sizes entry %q: %v", f, err)
+		}
+		head := `{"model":` + strconv.Quote(model)
+		if instructions {
+			head += `,"instructions":"You are a helpful assistant."`
+		}
+		if stream {
+			head += `,"stream":true`
+		}
+		head += `,"input":"`
+		pad := max(n-len(head)-2, 1)
+		out = append(out, []byte(head+strings.Repeat("x", pad)+`"}`))
+	}
+	return out, nil
+}
+
+func parseSize(s string) (int, error) {
+	mult := 1
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		mult, s = 1<<10, s[:len(s)-1]
+	case "m":
+		mult, s = 1<<20, s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("not a positive size")
+	}
+	return n * mult, nil
+}
+
+// fetchBenchStats returns the target's stats, or nil when it serves none
+// (an upstream hit directly).
+func fetchBenchStats(client *http.Client, base string) map[string]any {
+	resp, err := client.Get(base + "/_reserve/stats")
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	var m map[string]any
+	if sonic.Unmarshal(bs, &m) != nil {
+		return nil
+	}
+	return m
+}
+
+// statDelta is after-before of the number at section.key, 0 when missing.
+func statDelta(before, after map[string]any, section, key string) float64 {
+	get := func(m map[string]any) float64 {
+		sec, _ := m[section].(map[string]any)
+		v, _ := sec[key].(float64)
+		return v
+	}
+	return get(after) - get(before)
+}
+
+func printBench(samples []benchSample, elapsed time.Duration, before, after map[string]any) int {
+	var (
+		failed int
+		sent   int64
+		lat    []float64
+		ttfe   []float64
+	)
+	codes := map[int]int{}
+	for _, s := range samples {
+		if s.err != nil {
+			if failed++; failed <= 5 {
+				fmt.Fprintln(os.Stderr, "bench:", s.err)
+			}
+			continue
+		}
+		codes[s.status]++
+		sent += int64(s.sent)
+		lat = append(lat, float64(s.latency.Microseconds())/1000)
+		if s.ttfe > 0 {
+			ttfe = append(ttfe, float64(s.ttfe.Microseconds())/1000)
+		}
+	}
+	secs := elapsed.Seconds()
+	fmt.Printf("%d requests in %s, %d failed\n", len(samples), elapsed.Round(time.Millisecond), failed)
+	var byCode []string
+	for c, n := range codes {
+		byCode = append(byCode, fmt.Sprintf("%d×%d", c, n))
+	}
+	sort.Strings(byCode)
+	fmt.Printf("status       %s\n", strings.Join(byCode, " "))
+	fmt.Printf("throughput   %.1f req/s, %.2f MB/s sent\n", float64(len(lat))/secs, float64(sent)/secs/(1<<20))
+	if len(lat) > 0 {
+		fmt.Printf("latency ms   p50 %.2f p90 %.2f p99 %.2f max %.2f\n",
+			percentile(lat, 50), percentile(lat, 90), percentile(lat, 99), percentile(lat, 100))
+	}
+	if len(ttfe) > 0 {
+		fmt.Printf("ttfe ms      p50 %.2f p90 %.2f p99 %.2f max %.2f\n",
+			percentile(ttfe, 50), percentile(ttfe, 90), percentile(ttfe, 99), percentile(ttfe, 100))
+	}
+	if before != nil && after != nil && len(samples) > 0 {
+		n := float64(len(samples))
+		fmt.Printf("server       %.0f allocs/req, %.1f KB/req, %.0f GCs\n",
+			statDelta(before, after, "memory", "mallocs")/n,
+			statDelta(before, after, "memory", "total_alloc_bytes")/n/1024,
+			statDelta(before, after, "memory", "num_gc"))
+		fmt.Printf("rewrite      %.0f fast path, %.0f AST path\n",
+			statDelta(before, after, "rewrite", "path_fast"),
+			statDelta(before, after, "rewrite", "path_ast"))
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bytedance/sonic"
+	"github.com/ycvk/rightcode-reserve/reserve"
+)
+
+// runCaptures is `rc-proxy captures`: it prints the entries of the capture
+// files given, kept with -capture-dir, one JSON line each, unsealing them
+// with -key when they were sealed. It exits 1 when a file can't be read.
+func runCaptures(args []string) int {
+	fs := flag.NewFlagSet("rc-proxy captures", flag.ContinueOnError)
+	var key reserve.Secret
+	fs.Var(&key, "key", "the -capture-key the files were sealed with, ${ENV} or file:path")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "captures: no capture files given")
+		fs.Usage()
+		return 2
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for _, path := range fs.Args() {
+		entries, err := reserve.ReadCaptures(path, key)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "captures:", err)
+			return 1
+		}
+		for _, e := range entries {
+			bs, err := sonic.Marshal(e)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "captures:", err)
+				return 1
+			}
+			w.Write(bs)
+			w.WriteByte('\n')
+		}
+	}
+	return 0
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ycvk/rightcode-reserve/reserve"
+)
+
+// config is the process-wide configuration, filled from flags in main.
+// The proxy's own settings live in the embedded reserve.Options.
+type config struct {
+	reserve.Options
+
+	Listen string
+	// TSDir and TSHTTPS configure the tailnet node of a ts:// Listen.
+	TSDir   string
+	TSHTTPS bool
+	// Listeners > 1 opens that many SO_REUSEPORT listeners on Listen.
+	Listeners int
+	// Mounts is a comma-separated list of path prefixes the route table is
+	// matched under ("" is the root); it fills Options.Mounts.
+	Mounts string
+	// Upstreams is a comma-separated list of url or url=weight entries
+	// filling Options.Upstreams.
+	Upstreams string
+	// NDJSONPaths is a comma-separated list filling Options.NDJSONPaths.
+	NDJSONPaths string
+	// TrustedProxies is a comma-separated list of CIDRs or addresses
+	// filling Options.TrustedProxies.
+	TrustedProxies string
+	// FlushTypes is a comma-separated list filling Options.FlushTypes.
+	FlushTypes string
+	// URLHeaders and URLBodyFields are comma-separated lists filling the
+	// Options fields of the same name.
+	URLHeaders    string
+	URLBodyFields string
+	// ShutdownTimeout bounds the graceful drain on SIGINT/SIGTERM and after
+	// a SIGUSR2 upgrade.
+	ShutdownTimeout time.Duration
+	// UpgradeTimeout bounds how long a SIGUSR2 upgrade waits for the new
+	// process to be ready before giving up and carrying on.
+	UpgradeTimeout time.Duration
+
+	// AdminListen is the admin API address, "" disables it. AdminTokens is
+	// a comma-separated list of name:token pairs; the name identifies the
+	// caller in the log.
+	AdminListen string
+	AdminTokens reserve.Secret
+	// AdminAllowExternal lets AdminListen be other than a loopback address.
+	AdminAllowExternal bool
+	// LogLevel is the initial log level, adjustable through the admin API.
+	LogLevel string
+	// LogOutput is "stderr" or "syslog"; the syslog is the local daemon or
+	// SyslogAddr, with SyslogFacility and SyslogTag as the APP-NAME.
+	LogOutput      string
+	SyslogAddr     string
+	SyslogFacility string
+	SyslogTag      string
+
+	// Record, when set, is the directory a RecordSample fraction of rewritten
+	// requests is recorded into, for `rc-proxy replay`. Bodies over
+	// RecordMaxBody are skipped and recording stops at RecordMaxBytes.
+	Record         string
+	RecordSample   float64
+	RecordMaxBody  int
+	RecordMaxBytes int64
+
+	// WideLog, when set, is the file (- for stderr) one JSON record per
+	// request is appended to, see reserve.Options.WideLog. WideRedact is a
+	// comma-separated list filling Options.WideRedact.
+	WideLog    string
+	WideRedact string
+
+	// UsageExportFields is a comma-separated list filling
+	// Options.UsageExportFields.
+	UsageExportFields string
+	// GetCacheRoutes is a comma-separated list filling
+	// Options.GetCacheRoutes.
+	GetCacheRoutes string
+	// ValidateRoutes is a comma-separated list filling
+	// Options.ValidateRoutes.
+	ValidateRoutes string
+	// RequireAuth is a comma-separated list filling Options.RequireAuth.
+	RequireAuth string
+	// DropHeaders is a comma-separated list filling Options.DropHeaders.
+	DropHeaders string
+	// ModelFallbacks is a comma-separated list of model=fallback pairs
+	// filling Options.ModelFallbacks.
+	ModelFallbacks string
+	// MaxResponseBytes is a comma-separated list of route=bytes pairs
+	// filling Options.MaxResponseBytes.
+	MaxResponseBytes string
+	// RouteTimeouts is a comma-separated list of route:phase=duration
+	// entries filling Options.RouteTimeouts.
+	RouteTimeouts string
+
+	// Policy, when set, is the JSON request policy file (see
+	// reserve.RequestPolicy) loaded into Options.Policy.
+	Policy string
+
+	// Store, when set, is the bbolt file usage aggregates and background
+	// response owners are kept in across restarts.
+	Store string
+
+	// Prices, when set, is the JSON price table file (see
+	// reserve.PriceTable) loaded into Options.Prices.
+	Prices string
+	// Quotas, when set, is the JSON quota table file (see
+	// reserve.QuotaTable) loaded into Options.Quotas.
+	Quotas string
+	// ResponseHeaders, when set, is the JSON response header policy file
+	// (see reserve.ResponseHeaderPolicy) loaded into
+	// Options.ResponseHeaders.
+	ResponseHeaders string
+
+	// NotifyTemplateFile, when set, is the text/template file loaded into
+	// Options.NotifyTemplate.
+	NotifyTemplateFile string
+
+	// PoolMaxKeepBuf and PoolMaxKeepCopy are the largest body and copy
+	// buffers the pools keep (0 = default), see reserve.SetPoolMaxKeep.
+	PoolMaxKeepBuf  int
+	PoolMaxKeepCopy int
+
+	// Warmup exercises the rewrite paths and opens WarmupConns upstream
+	// connections before listening.
+	Warmup      bool
+	WarmupConns int
+
+	// Profile names the bundle of flag defaults applied, see profile.go.
+	Profile string
+
+	// PrintVersion prints the build info and exits.
+	PrintVersion bool
+	// PrintConfig prints the admin config endpoint's output and exits.
+	PrintConfig bool
+}
+
+// serverFlags is the flag set parseFlags filled cfg from, kept for the
+// config dump.
+var serverFlags *flag.FlagSet
+
+var cfg = config{
+	Options: reserve.DefaultOptions(),
+	Listen:  LocalPort,
+
+	Mounts:          ",/codex",
+	URLHeaders:      "Location,Content-Location",
+	DropHeaders:     "Cookie",
+	GetCacheRoutes:  "models",
+	Listeners:       1,
+	ShutdownTimeout: 30 * time.Second,
+	UpgradeTimeout:  time.Minute,
+
+	LogLevel:       "info",
+	LogOutput:      "stderr",
+	SyslogFacility: "daemon",
+	SyslogTag:      "rc-proxy",
+
+	RecordSample:   1,
+	RecordMaxBody:  1 << 20,
+	RecordMaxBytes: 1 << 30,
+
+	Warmup:      true,
+	WarmupConns: 4,
+}
+
+func parseFlags(args []string) error {
+	fs := flag.NewFlagSet("rc-proxy", flag.ContinueOnError)
+	fs.StringVar(&cfg.Target, "target", cfg.Target, "upstream base URL")
+	fs.StringVar(&cfg.Upstreams, "upstreams", cfg.Upstreams, "comma-separated further upstream base URLs, each url or url=weight, requests are balanced over along with -target (empty = -target only)")
+	fs.StringVar(&cfg.Options.Balance, "balance", cfg.Options.Balance, "how -upstreams are picked: weighted-rr, least-latency (lowest moving average of the time to first byte) or least-inflight; 5% of the requests go to one at random")
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "local listen address, or ts://<hostname>[:port] for a tailnet node (build tag tsnet)")
+	fs.StringVar(&cfg.TSDir, "ts-dir", cfg.TSDir, "state directory of the tailnet node of -listen ts://<hostname> (empty = tsnet's default)")
+	fs.BoolVar(&cfg.TSHTTPS, "ts-https", cfg.TSHTTPS, "serve -listen ts://<hostname> over HTTPS with the tailnet's certificate")
+	fs.StringVar(&cfg.Mounts, "mounts", cfg.Mounts, "comma-separated path prefixes under which /v1/... routes are matched (empty entry = root)")
+	fs.StringVar(&cfg.NDJSONPaths, "ndjson-paths", cfg.NDJSONPaths, "comma-separated POST paths (under each mount) whose bodies are NDJSON Responses requests, rewritten line by line")
+	fs.StringVar(&cfg.TrustedProxies, "trusted-proxies", cfg.TrustedProxies, "comma-separated CIDRs or addresses of reverse proxies in front, whose X-Forwarded-For / X-Real-IP names the client")
+	fs.IntVar(&cfg.IdentityIPv4Prefix, "identity-ipv4-prefix", cfg.IdentityIPv4Prefix, "prefix length an IPv4 client address is masked to for the identity of clients without credentials (0 = whole address)")
+	fs.IntVar(&cfg.IdentityIPv6Prefix, "identity-ipv6-prefix", cfg.IdentityIPv6Prefix, "prefix length an IPv6 client address is masked to for the identity of clients without credentials, e.g. 64 (0 = whole address)")
+	fs.IntVar(&cfg.Listeners, "listeners", cfg.Listeners, "number of SO_REUSEPORT listeners (falls back to 1 where unsupported)")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "graceful shutdown drain timeout")
+	fs.DurationVar(&cfg.UpgradeTimeout, "upgrade-timeout", cfg.UpgradeTimeout, "max wait for the new process of a SIGUSR2 upgrade to become ready")
+	fs.Int64Var(&cfg.BodyBudget, "body-budget", cfg.BodyBudget, "max bytes of request bodies buffered concurrently (0 = unlimited)")
+	fs.DurationVar(&cfg.BodyBudgetWait, "body-budget-wait", cfg.BodyBudgetWait, "max wait for body budget before replying 503 (0 = fail fast)")
+	fs.DurationVar(&cfg.RequestTimeout, "request-timeout", cfg.RequestTimeout, "overall cap for non-streaming requests (0 = none)")
+	fs.DurationVar(&cfg.StreamIdleTimeout, "stream-idle-timeout", cfg.StreamIdleTimeout, "cut SSE streams after this long without upstream bytes (0 = none)")
+	fs.DurationVar(&cfg.DialTimeout, "dial-timeout", cfg.DialTimeout, "max time to connect to the upstream, a 502 upstream_connect_timeout when over (negative = none)")
+	fs.DurationVar(&cfg.TLSHandshakeTimeout, "tls-handshake-timeout", cfg.TLSHandshakeTimeout, "max time of the TLS handshake with the upstream, a 502 upstream_tls_timeout when over (negative = none)")
+	fs.DurationVar(&cfg.ResponseHeaderTimeout, "response-header-timeout", cfg.ResponseHeaderTimeout, "max wait for the upstream's response headers once the request is sent, a 504 when over (negative = none)")
+	fs.StringVar(&cfg.RouteTimeouts, "route-timeouts", cfg.RouteTimeouts, "comma-separated route:phase=duration entries, phase dial, tls, header or idle, overriding the timeout of that phase for the route (negative = none)")
+	fs.DurationVar(&cfg.StreamSniffWait, "stream-sniff-wait", cfg.StreamSniffWait, "max wait for the first event of a 200 stream, checked for an upstream error (0 = no check)")
+	fs.Int64Var(&cfg.UpstreamGzip, "upstream-gzip", cfg.UpstreamGzip, "gzip request bodies of at least this many bytes toward the upstream (0 = off, for upstreams refusing compressed bodies)")
+	fs.IntVar(&cfg.UpstreamGzipLevel, "upstream-gzip-level", cfg.UpstreamGzipLevel, "gzip level of -upstream-gzip, 1 (fastest) to 9 (smallest), -1 = default")
+	fs.IntVar(&cfg.H2Retries, "h2-retries", cfg.H2Retries, "times a request failing with an HTTP/2 GOAWAY, REFUSED_STREAM or INTERNAL_ERROR before any response is retried (0 = never)")
+	fs.BoolVar(&cfg.H2RetryFreshConn, "h2-retry-fresh-conn", cfg.H2RetryFreshConn, "close the idle upstream connections before each -h2-retries retry")
+	fs.IntVar(&cfg.KeepWarmConns, "keep-warm-conns", cfg.KeepWarmConns, "upstream connections kept from idling out, with a periodic cheap request on each; over HTTP/2 the requests share one (0 = off)")
+	fs.StringVar(&cfg.KeepWarmMethod, "keep-warm-method", cfg.KeepWarmMethod, "method of the -keep-warm-conns requests: HEAD, OPTIONS or GET")
+	fs.StringVar(&cfg.KeepWarmPath, "keep-warm-path", cfg.KeepWarmPath, "path of the -keep-warm-conns requests, relative to -target (empty = -target itself)")
+	fs.DurationVar(&cfg.KeepWarmInterval, "keep-warm-interval", cfg.KeepWarmInterval, "time between -keep-warm-conns rounds, jittered by 10% (0 = 3/4 of the upstream idle timeout, 90s)")
+	fs.BoolVar(&cfg.UpstreamAcceptGzip, "upstream-accept-gzip", cfg.UpstreamAcceptGzip, "always ask the upstream for gzip responses, decompressing them for clients that did not ask")
+	fs.DurationVar(&cfg.FlushInterval, "flush-interval", cfg.FlushInterval, "flush responses other than event streams and -flush-types at most this often (0 = at the end, negative = every write)")
+	fs.StringVar(&cfg.FlushTypes, "flush-types", cfg.FlushTypes, "comma-separated media types flushed on every write like text/event-stream, e.g. application/x-ndjson")
+	fs.StringVar(&cfg.PublicURL, "public-url", cfg.PublicURL, "the proxy's public base URL, onto which upstream URLs in responses are rewritten (empty = off)")
+	fs.StringVar(&cfg.URLHeaders, "url-headers", cfg.URLHeaders, "comma-separated response headers whose upstream URLs are rewritten to -public-url")
+	fs.StringVar(&cfg.URLBodyFields, "url-body-fields", cfg.URLBodyFields, "comma-separated dotted paths of JSON response fields whose upstream URLs are rewritten to -public-url")
+	fs.BoolVar(&cfg.Dedup, "dedup", cfg.Dedup, "serve identical concurrent non-streaming requests of a client from one upstream request")
+	fs.DurationVar(&cfg.DedupWait, "dedup-wait", cfg.DedupWait, "how long a duplicate waits for the shared request before going upstream on its own (0 = until it completes)")
+	fs.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", cfg.IdempotencyTTL, "replay the response of a request with an Idempotency-Key to retries for this long (0 = off)")
+	fs.Int64Var(&cfg.IdempotencyMaxBytes, "idempotency-max-bytes", cfg.IdempotencyMaxBytes, "max response body bytes kept for Idempotency-Key replay (0 = unlimited)")
+	fs.DurationVar(&cfg.GetCacheTTL, "get-cache-ttl", cfg.GetCacheTTL, "serve GET responses of -get-cache-routes from a per-client cache this long (0 = off)")
+	fs.DurationVar(&cfg.GetCacheStale, "get-cache-stale", cfg.GetCacheStale, "past -get-cache-ttl, serve the cached copy for this long more while refreshing it in the background")
+	fs.DurationVar(&cfg.GetCacheStaleIfError, "get-cache-stale-if-error", cfg.GetCacheStaleIfError, "past -get-cache-ttl, serve the cached copy for this long more when the upstream fails")
+	fs.StringVar(&cfg.GetCacheRoutes, "get-cache-routes", cfg.GetCacheRoutes, "comma-separated route names whose GET responses -get-cache-ttl caches")
+	fs.Int64Var(&cfg.GetCacheMaxBytes, "get-cache-max-bytes", cfg.GetCacheMaxBytes, "max response body bytes the GET cache keeps (0 = unlimited)")
+	fs.IntVar(&cfg.UpstreamConcurrency, "upstream-concurrency", cfg.UpstreamConcurrency, "max rewritten requests with the upstream at once, the rest queue (0 = unlimited)")
+	fs.IntVar(&cfg.UpstreamClientConcurrency, "upstream-client-concurrency", cfg.UpstreamClientConcurrency, "max rewritten requests of one client with the upstream at once (0 = unlimited)")
+	fs.IntVar(&cfg.UpstreamQueue, "upstream-queue", cfg.UpstreamQueue, "max requests waiting for an upstream slot before 429s (0 = no queueing)")
+	fs.DurationVar(&cfg.UpstreamQueueWait, "upstream-queue-wait", cfg.UpstreamQueueWait, "max wait for an upstream slot before a 429 (0 = as long as the request lasts)")
+	fs.Float64Var(&cfg.RateLimit, "rate-limit", cfg.RateLimit, "max rewritten requests starting per second across all clients (0 = unlimited)")
+	fs.IntVar(&cfg.RateBurst, "rate-burst", cfg.RateBurst, "requests -rate-limit lets through at once (0 = one second's worth)")
+	fs.DurationVar(&cfg.RateQueueWait, "rate-queue-wait", cfg.RateQueueWait, "max wait for a -rate-limit turn before a 429 (0 = shed at once)")
+	fs.StringVar(&cfg.RateLimitHeaders, "ratelimit-headers", cfg.RateLimitHeaders, "how -rate-limit and -quotas show in x-ratelimit-* response headers: merged (the upstream's stay where tighter), proxy (replace them) or off")
+	fs.StringVar(&cfg.RequireAuth, "require-auth", cfg.RequireAuth, "comma-separated route names (* = all) answering requests without credentials with 401 (empty = off)")
+	fs.IntVar(&cfg.MaxHeaderValueBytes, "max-header-value-bytes", cfg.MaxHeaderValueBytes, "max bytes of a single request header value before a 431 (0 = unlimited)")
+	fs.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes", cfg.MaxHeaderBytes, "max bytes of all request headers before a 431 (0 = unlimited)")
+	fs.IntVar(&cfg.MaxHeaderCount, "max-header-count", cfg.MaxHeaderCount, "max number of request header values before a 431 (0 = unlimited)")
+	fs.DurationVar(&cfg.BodyReadTimeout, "body-read-timeout", cfg.BodyReadTimeout, "max time a buffered request body may go without sending a byte before a 408 (0 = unlimited)")
+	fs.IntVar(&cfg.MaxConns, "max-conns", cfg.MaxConns, "max open client connections, requests on further ones get 503 (0 = unlimited)")
+	fs.IntVar(&cfg.MaxConnsPerIP, "max-conns-per-ip", cfg.MaxConnsPerIP, "max open client connections per peer address, requests on further ones get 429 (0 = unlimited)")
+	fs.StringVar(&cfg.DropHeaders, "drop-headers", cfg.DropHeaders, "comma-separated request headers never forwarded upstream")
+	fs.StringVar(&cfg.ModelFallbacks, "model-fallback", cfg.ModelFallbacks, "comma-separated model=fallback pairs: retry once with the fallback on model_not_found or a capacity 503")
+	fs.StringVar(&cfg.MaxResponseBytes, "max-response-bytes", cfg.MaxResponseBytes, "comma-separated route=bytes pairs (* = every other route) capping non-streaming responses: 502 when announced larger, else truncated with an X-Reserve-Truncated trailer (empty = no cap)")
+	fs.Int64Var(&cfg.MaxStreamBytes, "max-stream-bytes", cfg.MaxStreamBytes, "max bytes of an event stream, ended with an error event past it (0 = unlimited)")
+	fs.DurationVar(&cfg.BackgroundWait, "background-wait", cfg.BackgroundWait, "poll background responses for the client and hold the creation request until done, at most this long (0 = off)")
+	fs.StringVar(&cfg.Prices, "prices", cfg.Prices, "JSON price table (USD per million tokens by model) for cost estimation (empty = off)")
+	fs.BoolVar(&cfg.CostHeader, "cost-header", cfg.CostHeader, "add X-Reserve-Estimated-Cost to priced non-streaming responses")
+	fs.Float64Var(&cfg.ClientBudget, "client-budget", cfg.ClientBudget, "monthly budget in USD of each client, warned about when spent (0 = none)")
+	fs.StringVar(&cfg.Quotas, "quotas", cfg.Quotas, "JSON quota table: per-client request and token caps per day, week or month, 429 past them (empty = off)")
+	fs.StringVar(&cfg.ResponseHeaders, "response-headers", cfg.ResponseHeaders, "JSON response header policy: the upstream response headers allowed or denied, per route, replaceable through the admin API (empty = all pass)")
+	fs.BoolVar(&cfg.BudgetReject, "budget-reject", cfg.BudgetReject, "reject requests of clients over their monthly budget with 402 instead of only warning")
+	fs.StringVar(&cfg.WideLog, "wide-log", cfg.WideLog, "file (- = stderr) getting one JSON record per request with everything known about it (empty = off)")
+	fs.Float64Var(&cfg.WideSample, "wide-sample", cfg.WideSample, "fraction of successful requests written to -wide-log, 0..1 (failed ones always are)")
+	fs.StringVar(&cfg.WideRedact, "wide-redact", cfg.WideRedact, "comma-separated -wide-log fields (dotted paths, e.g. client.id,remote) logged as a hash")
+	fs.StringVar(&cfg.UsageExport, "usage-export", cfg.UsageExport, "file every usage record (tokens, cost, duration) is appended to (empty = off)")
+	fs.StringVar(&cfg.UsageExportFormat, "usage-export-format", cfg.UsageExportFormat, "format of -usage-export: jsonl or csv")
+	fs.StringVar(&cfg.UsageExportFields, "usage-export-fields", cfg.UsageExportFields, "comma-separated fields of -usage-export, in order (empty = all)")
+	fs.Int64Var(&cfg.UsageExportMaxBytes, "usage-export-max-bytes", cfg.UsageExportMaxBytes, "rotate -usage-export past this many bytes (0 = no cap)")
+	fs.BoolVar(&cfg.UsageExportDaily, "usage-export-daily", cfg.UsageExportDaily, "rotate -usage-export when the UTC day changes")
+	fs.BoolVar(&cfg.UsageExportGzip, "usage-export-gzip", cfg.UsageExportGzip, "gzip rotated -usage-export files")
+	fs.StringVar(&cfg.Store, "store", cfg.Store, "bbolt file keeping usage counters and background response owners across restarts (empty = memory only)")
+	fs.DurationVar(&cfg.StoreFlush, "store-flush", cfg.StoreFlush, "how often usage counters are saved to -store and expired entries swept")
+	fs.Var(&cfg.NotifyURL, "notify-url", "webhook URL (Slack or generic JSON) for upstream error rate notifications (empty = off)")
+	fs.StringVar(&cfg.NotifyTemplateFile, "notify-template", cfg.NotifyTemplateFile, "text/template file rendering the webhook payload (empty = JSON with a Slack-compatible text)")
+	fs.Float64Var(&cfg.NotifyErrorRate, "notify-error-rate", cfg.NotifyErrorRate, "notify when this fraction of upstream requests fails over -notify-window, 0..1 (0 = off)")
+	fs.DurationVar(&cfg.NotifyWindow, "notify-window", cfg.NotifyWindow, "sliding window of the upstream error rate")
+	fs.IntVar(&cfg.NotifyMinRequests, "notify-min-requests", cfg.NotifyMinRequests, "min upstream requests in the window before the error rate can notify")
+	fs.DurationVar(&cfg.NotifyCooldown, "notify-cooldown", cfg.NotifyCooldown, "min time between two notifications of the same event")
+	fs.IntVar(&cfg.NotifyRetries, "notify-retries", cfg.NotifyRetries, "retries of a failed webhook delivery, with backoff from 1s")
+	fs.StringVar(&cfg.NotifyDeadLetter, "notify-dead-letter", cfg.NotifyDeadLetter, "file undeliverable notifications are appended to as JSON lines (empty = the log)")
+	fs.StringVar(&cfg.AdminListen, "admin-listen", cfg.AdminListen, "admin API listen address (empty = disabled)")
+	fs.Var(&cfg.AdminTokens, "admin-tokens", "comma-separated name:token pairs accepted by the admin API")
+	fs.BoolVar(&cfg.FaultInjection, "enable-fault-injection", cfg.FaultInjection, "let the admin API's /_reserve/faults inject failures into requests, for testing clients (never in production)")
+	fs.BoolVar(&cfg.AdminAllowExternal, "admin-allow-external", cfg.AdminAllowExternal, "let -admin-listen bind an address other than loopback (needs -admin-tokens)")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "log level: debug, info, warn or error")
+	fs.StringVar(&cfg.LogOutput, "log-output", cfg.LogOutput, "where the log goes: stderr or syslog (RFC 5424)")
+	fs.StringVar(&cfg.SyslogAddr, "syslog-addr", cfg.SyslogAddr, "remote syslog of -log-output syslog: udp://host:port or tcp://host:port (empty = the local /dev/log)")
+	fs.StringVar(&cfg.SyslogFacility, "syslog-facility", cfg.SyslogFacility, "syslog facility: user, daemon or local0..local7")
+	fs.StringVar(&cfg.SyslogTag, "syslog-tag", cfg.SyslogTag, "APP-NAME of the syslog messages")
+	fs.StringVar(&cfg.Record, "record", cfg.Record, "record rewritten requests into this directory for replay (empty = off)")
+	fs.Float64Var(&cfg.RecordSample, "record-sample", cfg.RecordSample, "fraction of requests to record, 0..1")
+	fs.IntVar(&cfg.RecordMaxBody, "record-max-body", cfg.RecordMaxBody, "skip recording bodies larger than this (0 = no cap)")
+	fs.Int64Var(&cfg.RecordMaxBytes, "record-max-bytes", cfg.RecordMaxBytes, "stop recording once the directory holds this many bytes (0 = no cap)")
+	fs.StringVar(&cfg.CaptureDir, "capture-dir", cfg.CaptureDir, "directory the exchanges of the clients the -policy's client_capture names are kept in, one directory per client (empty = off)")
+	fs.Int64Var(&cfg.CaptureMaxBytes, "capture-max-bytes", cfg.CaptureMaxBytes, "rotate a client's capture file at this many bytes (0 = never)")
+	fs.DurationVar(&cfg.CaptureMaxAge, "capture-max-age", cfg.CaptureMaxAge, "delete capture files not written to for this long (0 = keep)")
+	fs.Var(&cfg.CaptureKey, "capture-key", "hex-encoded AES key (16, 24 or 32 bytes) capture lines are sealed with, ${ENV} or file:path (empty = plain JSON)")
+	fs.IntVar(&cfg.PoolMaxKeepBuf, "pool-max-keep-buf", cfg.PoolMaxKeepBuf, "largest request body buffer kept for reuse, in bytes (0 = 8MB)")
+	fs.IntVar(&cfg.PoolMaxKeepCopy, "pool-max-keep-copy", cfg.PoolMaxKeepCopy, "largest response copy buffer kept for reuse, in bytes (0 = 1MB)")
+	fs.StringVar(&cfg.ProfileDir, "profile-dir", cfg.ProfileDir, "directory heap and goroutine profiles are written to, by the watchdog and the admin API (empty = off)")
+	fs.Int64Var(&cfg.WatchHeap, "watch-heap", cfg.WatchHeap, "capture profiles when the heap in use reaches this many bytes (0 = off)")
+	fs.IntVar(&cfg.WatchGoroutines, "watch-goroutines", cfg.WatchGoroutines, "capture profiles when this many goroutines are running (0 = off)")
+	fs.IntVar(&cfg.WatchGrowth, "watch-growth", cfg.WatchGrowth, "capture profiles when the heap in use has grown this many samples in a row (0 = off)")
+	fs.DurationVar(&cfg.WatchInterval, "watch-interval", cfg.WatchInterval, "how often the watchdog samples the heap and goroutines")
+	fs.DurationVar(&cfg.ProfileCooldown, "profile-cooldown", cfg.ProfileCooldown, "min time between two automatic profile captures")
+	fs.Int64Var(&cfg.ProfileMaxBytes, "profile-max-bytes", cfg.ProfileMaxBytes, "remove the oldest profiles once -profile-dir holds more than this many bytes of them (0 = never)")
+	fs.BoolVar(&cfg.Warmup, "warmup", cfg.Warmup, "warm up sonic and upstream connections before listening")
+	fs.IntVar(&cfg.WarmupConns, "warmup-conns", cfg.WarmupConns, "upstream connections to pre-establish during warmup")
+	fs.Var(&cfg.TraceSecret, "trace-secret", "shared secret which, sent as X-Reserve-Trace, logs every stage of that request (empty = off)")
+	fs.StringVar(&cfg.RequestIDHeader, "request-id-header", cfg.RequestIDHeader, "header the request id (the client's X-Request-Id, or a new UUIDv7) is forwarded upstream in (empty = not forwarded)")
+	fs.BoolVar(&cfg.TraceEchoID, "trace-echo-id", cfg.TraceEchoID, "return the trace id of a traced request in X-Reserve-Trace-Id")
+	fs.BoolVar(&cfg.VersionHeader, "version-header", cfg.VersionHeader, "add X-Reserve-Version to every response")
+	fs.BoolVar(&cfg.ConnTraceHeader, "conn-trace-header", cfg.ConnTraceHeader, "add X-Reserve-Conn (upstream connection reuse and timings) to proxied responses")
+	fs.BoolVar(&cfg.ErrorFingerprints, "error-fingerprints", cfg.ErrorFingerprints, "hash request bodies before and after the rewrite, for the warning logged on upstream errors to rewritten requests")
+	fs.StringVar(&cfg.Profile, "profile", cfg.Profile, "preset flag defaults for a kind of client: "+strings.Join(profileNames(), ", ")+"; flags given still win (empty = none)")
+	fs.BoolVar(&cfg.PrintVersion, "version", false, "print version and build info, then exit")
+	fs.BoolVar(&cfg.PrintConfig, "print-config", false, "print the effective configuration (secrets fingerprinted), then exit")
+	rewriteFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := applyProfile(fs, cfg.Profile); err != nil {
+		return err
+	}
+	if err := checkRewriteFlags(fs); err != nil {
+		return err
+	}
+	cfg.Options.Mounts = strings.Split(cfg.Mounts, ",")
+	tps, err := parsePrefixes(cfg.TrustedProxies)
+	if err != nil {
+		err = fmt.Errorf("invalid value %q for flag -trusted-proxies: %w", cfg.TrustedProxies, err)
+		fmt.Fprintln(fs.Output(), err)
+		return err
+	}
+	cfg.Options.TrustedProxies = tps
+	for _, f := range []struct {
+		name      string
+		bits, max int
+	}{{"identity-ipv4-prefix", cfg.IdentityIPv4Prefix, 32}, {"identity-ipv6-prefix", cfg.IdentityIPv6Prefix, 128}} {
+		if f.bits < 0 || f.bits > f.max {
+			err := fmt.Errorf("invalid value %d for flag -%s: want 0 to %d", f.bits, f.name, f.max)
+			fmt.Fprintln(fs.Output(), err)
+			return err
+		}
+	}
+	fbs, err := parseFallbacks(cfg.ModelFallbacks)
+	if err != nil {
+		err = fmt.Errorf("invalid value %q for flag -model-fallback: %w", cfg.ModelFallbacks, err)
+		fmt.Fprintln(fs.Output(), err)
+		return err
+	}
+	cfg.Options.ModelFallbacks = fbs
+	caps, err := parseRouteBytes(cfg.MaxResponseBytes)
+	if err != nil {
+		err = fmt.Errorf("invalid value %q for flag -max-response-bytes: %w", cfg.MaxResponseBytes, err)
+		fmt.Fprintln(fs.Output(), err)
+		return err
+	}
+	cfg.Options.MaxResponseBytes = caps
+	rts, err := parseRouteTimeouts(cfg.RouteTimeouts)
+	if err != nil {
+		err = fmt.Errorf("invalid value %q for flag -route-timeouts: %w", cfg.RouteTimeouts, err)
+		fmt.Fprintln(fs.Output(), err)
+		return err
+	}
+	cfg.Options.RouteTimeouts = rts
+	cfg.Options.Upstreams = strings.Split(cfg.Upstreams, ",")
+	cfg.Options.NDJSONPaths = strings.Split(cfg.NDJSONPaths, ",")
+	cfg.Options.RequireAuth = strings.Split(cfg.RequireAuth, ",")
+	cfg.Options.GetCacheRoutes = strings.Split(cfg.GetCacheRoutes, ",")
+	cfg.Options.ValidateRoutes = strings.Split(cfg.ValidateRoutes, ",")
+	cfg.Options.DropHeaders = strings.Split(cfg.DropHeaders, ",")
+	cfg.Options.FlushTypes = strings.Split(cfg.FlushTypes, ",")
+	cfg.Options.URLHeaders = strings.Split(cfg.URLHeaders, ",")
+	cfg.Options.URLBodyFields = strings.Split(cfg.URLBodyFields, ",")
+	cfg.Options.WideRedact = strings.Split(cfg.WideRedact, ",")
+	cfg.Options.UsageExportFields = strings.Split(cfg.UsageExportFields, ",")
+	serverFlags = fs
+	return nil
+}
+
+// flagsView is the "flags" config section: every server flag's effective
+// value and whether it came from the command line, the -profile or the
+// default. Secret flags print their fingerprint.
+func flagsView() any {
+	set := map[string]bool{}
+	serverFlags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	out := map[string]any{}
+	serverFlags.VisitAll(func(f *flag.Flag) {
+		src := "default"
+		switch {
+		case fromProfile[f.Name]:
+			src = "profile"
+		case set[f.Name]:
+			src = "flag"
+		}
+		out[f.Name] = map[string]string{"value": f.Value.String(), "source": src}
+	})
+	return out
+}
+
+// rewriteFlags registers the flags that change how bodies are rewritten,
+// shared by the server and the transform subcommand.
+func rewriteFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&cfg.MinimalDiff, "minimal-diff", cfg.MinimalDiff, "rewrite bodies with byte splices, keeping client key order and formatting")
+	fs.BoolVar(&cfg.CanonicalJSON, "canonical-json", cfg.CanonicalJSON, "re-encode rewritten bodies with sorted keys and normalized numbers (excludes -minimal-diff)")
+	fs.Int64Var(&cfg.CanonicalMaxBytes, "canonical-max-bytes", cfg.CanonicalMaxBytes, "leave bodies over this many bytes out of -canonical-json (0 = no cap)")
+	fs.IntVar(&cfg.MaxJSONDepth, "max-json-depth", cfg.MaxJSONDepth, "max JSON nesting depth to rewrite (0 = unlimited)")
+	fs.IntVar(&cfg.MaxJSONKeys, "max-json-keys", cfg.MaxJSONKeys, "max top-level JSON keys to rewrite (0 = unlimited)")
+	fs.DurationVar(&cfg.ParseBudget, "parse-budget", cfg.ParseBudget, "max time for the AST parse before forwarding the body untouched (0 = unlimited)")
+	fs.BoolVar(&cfg.JSONLimitReject, "json-limit-reject", cfg.JSONLimitReject, "reject bodies over the JSON limits with 400 instead of forwarding them untouched")
+	fs.StringVar(&cfg.ValidateRoutes, "validate-routes", cfg.ValidateRoutes, "comma-separated route names whose bodies are checked against the embedded Responses schema, 400 on a mismatch (e.g. responses)")
+	fs.Int64Var(&cfg.MaxBody, "max-body", cfg.MaxBody, "max request body bytes after decompression, larger bodies get 413 (0 = unlimited)")
+	fs.Int64Var(&cfg.SpillThreshold, "spill-threshold", cfg.SpillThreshold, "keep only this many bytes of larger request bodies in memory, the rest in a temp file (0 = off)")
+	fs.StringVar(&cfg.SpillDir, "spill-dir", cfg.SpillDir, "directory for -spill-threshold temp files (empty = system temp dir)")
+	fs.IntVar(&cfg.ClientCacheSize, "client-cache-size", cfg.ClientCacheSize, "max cached client identities (0 = no cache)")
+	fs.DurationVar(&cfg.ClientCacheTTL, "client-cache-ttl", cfg.ClientCacheTTL, "client identity cache TTL (0 = no expiry)")
+	fs.BoolVar(&cfg.InstructionsRewrite, "instructions-rewrite", cfg.InstructionsRewrite, "move top-level instructions into input as a developer message")
+	fs.BoolVar(&cfg.StripReasoning, "strip-reasoning", cfg.StripReasoning, "drop input reasoning items without encrypted_content, unless the request sets previous_response_id")
+	fs.IntVar(&cfg.InputTokenBudget, "input-token-budget", cfg.InputTokenBudget, "drop the oldest input items of requests estimated over this many tokens (0 = off)")
+	fs.IntVar(&cfg.InputKeepTurns, "input-keep-turns", cfg.InputKeepTurns, "last user turns -input-token-budget never drops")
+	fs.StringVar(&cfg.TokenizerVocab, "tokenizer-vocab", cfg.TokenizerVocab, "tiktoken vocabulary file (e.g. o200k_base.tiktoken) to count tokens with instead of the byte heuristic (empty = heuristic)")
+	fs.BoolVar(&cfg.EstimateInputTokens, "estimate-input-tokens", cfg.EstimateInputTokens, "estimate the input tokens of rewritten requests for the wide log and compare them with the reported usage in the stats")
+	fs.BoolVar(&cfg.TokenEstimateHeader, "token-estimate-header", cfg.TokenEstimateHeader, "add X-Reserve-Estimated-Input-Tokens to responses of rewritten requests (implies -estimate-input-tokens)")
+	fs.StringVar(&cfg.Policy, "policy", cfg.Policy, "JSON request policy file: the seed, per-client service_tier and per-route or per-client tool_choice and text.format set on requests, and the upstream request headers (empty = off)")
+	fs.BoolVar(&cfg.TolerantJSON, "tolerant-json", cfg.TolerantJSON, "strip // and /* */ comments and trailing commas from request bodies that are not valid JSON otherwise")
+	fs.BoolVar(&cfg.UnwrapBodies, "unwrap-bodies", cfg.UnwrapBodies, `unwrap request bodies sent as a JSON string ("{\"model\":...}") or a one-element array`)
+	fs.BoolVar(&cfg.SystemToDeveloper, "system-to-developer", cfg.SystemToDeveloper, "turn system messages in input into developer messages, dropping duplicates of a developer message")
+	fs.BoolVar(&cfg.ReasoningInclude, "reasoning-include", cfg.ReasoningInclude, `add "reasoning.encrypted_content" to include on store:false requests, warn when it does not come back`)
+}
+
+// checkRewriteFlags rejects rewrite flags that exclude each other and
+// loads -policy, after fs (registered with rewriteFlags) is parsed.
+func checkRewriteFlags(fs *flag.FlagSet) error {
+	if cfg.CanonicalJSON && cfg.MinimalDiff {
+		err := errors.New("flags -canonical-json and -minimal-diff are mutually exclusive")
+		fmt.Fprintln(fs.Output(), err)
+		return err
+	}
+	if cfg.Policy != "" {
+		p, err := reserve.LoadRequestPolicy(cfg.Policy)
+		if err != nil {
+			err = fmt.Errorf("invalid -policy %s: %w", cfg.Policy, err)
+			fmt.Fprintln(fs.Output(), err)
+			return err
+		}
+		cfg.Options.Policy = p
+	}
+	return nil
+}
+
+// parseFallbacks parses a comma-separated list of model=fallback pairs.
+func parseFallbacks(s string) (map[string]string, error) {
+	fbs := map[string]string{}
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(e, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("%q is not model=fallback", e)
+		}
+		if from == to {
+			return nil, fmt.Errorf("model %q falls back to itself", from)
+		}
+		if _, dup := fbs[from]; dup {
+			return nil, fmt.Errorf("model %q has two fallbacks", from)
+		}
+		fbs[from] = to
+	}
+	return fbs, nil
+}
+
+// parseRouteBytes parses a comma-separated list of route=bytes pairs.
+func parseRouteBytes(s string) (map[string]int64, error) {
+	caps := map[string]int64{}
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		name, v, ok := strings.Cut(e, "=")
+		name = strings.TrimSpace(name)
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if !ok || name == "" || err != nil || n < 0 {
+			return nil, fmt.Errorf("%q is not route=bytes", e)
+		}
+		if _, dup := caps[name]; dup {
+			return nil, fmt.Errorf("route %q has two caps", name)
+		}
+		caps[name] = n
+	}
+	return caps, nil
+}
+
+// parseRouteTimeouts parses a comma-separated list of route:phase=duration
+// entries.
+func parseRouteTimeouts(s string) (map[string]reserve.PhaseTimeouts, error) {
+	rts := map[string]reserve.PhaseTimeouts{}
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		name, rest, ok := strings.Cut(e, ":")
+		phase, v, ok2 := strings.Cut(rest, "=")
+		name, phase = strings.TrimSpace(name), strings.TrimSpace(phase)
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if !ok || !ok2 || name == "" || err != nil || d == 0 {
+			return nil, fmt.Errorf("%q is not route:phase=duration", e)
+		}
+		rt := rts[name]
+		var f *time.Duration
+		switch phase {
+		case "dial":
+			f = &rt.Dial
+		case "tls":
+			f = &rt.TLSHandshake
+		case "header":
+			f = &rt.ResponseHeader
+		case "idle":
+			f = &rt.StreamIdle
+		default:
+			return nil, fmt.Errorf("%q: phase %q: want dial, tls, header or idle", e, phase)
+		}
+		if *f != 0 {
+			return nil, fmt.Errorf("route %q has two %s timeouts", name, phase)
+		}
+		*f = d
+		rts[name] = rt
+	}
+	return rts, nil
+}
+
+// parsePrefixes parses a comma-separated list of CIDRs; a bare address is
+// a prefix of its own.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var ps []netip.Prefix
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !strings.Contains(e, "/") {
+			a, err := netip.ParseAddr(e)
+			if err != nil {
+				return nil, err
+			}
+			a = a.Unmap()
+			ps = append(ps, netip.PrefixFrom(a, a.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(e)
+		if err != nil {
+			return nil, err
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		ps = append(ps, p.Masked())
+	}
+	return ps, nil
+}
+
+// adminAddr is the address the admin API listens on: AdminListen, on
+// 127.0.0.1 when it names no host. Any other host than a literal loopback
+// address, localhost included, needs AdminAllowExternal, so that a widened -listen or a copied unit
+// file can't put the admin API in the proxy clients' reach.
+func (c *config) adminAddr() (string, error) {
+	addr := c.AdminListen
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr // a bare port
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	if c.AdminAllowExternal {
+		return addr, nil
+	}
+	// only literal addresses: a name may resolve to anything
+	if ip, err := netip.ParseAddr(host); err != nil || !ip.IsLoopback() {
+		return "", fmt.Errorf("%s is not a loopback address (127.0.0.0/8 or ::1); set -admin-allow-external to serve the admin API on it", host)
+	}
+	return addr, nil
+}
+
+// adminTokens parses AdminTokens; an entry without a name is named by its
+// position.
+func (c *config) adminTokens() ([]reserve.AdminToken, error) {
+	var ts []reserve.AdminToken
+	for i, e := range strings.Split(string(c.AdminTokens), ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		name, tok, ok := strings.Cut(e, ":")
+		if !ok {
+			name, tok = "token"+strconv.Itoa(i), e
+		}
+		if tok == "" {
+			return nil, fmt.Errorf("admin token %q is empty", name)
+		}
+		ts = append(ts, reserve.AdminToken{Name: name, Token: reserve.Secret(tok)})
+	}
+	return ts, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestAdminAddr(t *testing.T) {
+	for _, tc := range []struct {
+		listen string
+		allow  bool
+		want   string // "" for refused
+	}{
+		{"18103", false, "127.0.0.1:18103"},
+		{":18103", false, "127.0.0.1:18103"},
+		{"127.0.0.1:18103", false, "127.0.0.1:18103"},
+		{"127.8.9.10:18103", false, "127.8.9.10:18103"},
+		{"[::1]:18103", false, "[::1]:18103"},
+		{"localhost:18103", false, ""},
+		{"localhost:18103", true, "localhost:18103"},
+		{"0.0.0.0:18103", false, ""},
+		{"[::]:18103", false, ""},
+		{"10.1.2.3:18103", false, ""},
+		{"admin.internal:18103", false, ""},
+		{"0.0.0.0:18103", true, "0.0.0.0:18103"},
+		{"10.1.2.3:18103", true, "10.1.2.3:18103"},
+		{":18103", true, "127.0.0.1:18103"},
+		{"1:2:3", false, ""},
+	} {
+		c := config{AdminListen: tc.listen, AdminAllowExternal: tc.allow}
+		got, err := c.adminAddr()
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("adminAddr(%q, allow %v) = %q, want it refused", tc.listen, tc.allow, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("adminAddr(%q, allow %v) = %q, %v, want %q", tc.listen, tc.allow, got, err, tc.want)
+		}
+	}
+}
+
+func TestAdminListenRefused(t *testing.T) {
+	// refused at startup with a config error, before anything is bound
+	for _, tc := range []struct {
+		name string
+		args []string
+		log  string
+	}{
+		{"external without -admin-allow-external",
+			[]string{"-admin-listen", "0.0.0.0:0", "-admin-tokens", "ops:adm-1"}, "not a loopback address"},
+		{"-admin-allow-external without tokens",
+			[]string{"-admin-listen", "0.0.0.0:0", "-admin-allow-external"}, "-admin-listen needs -admin-tokens"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args := append([]string{"-listen", "127.0.0.1:0", "-target", "http://127.0.0.1:1", "-warmup=false"}, tc.args...)
+			cmd := exec.Command(os.Args[0], args...)
+			cmd.Env = append(os.Environ(), envTestMain+"=1")
+			out, err := cmd.CombinedOutput()
+			var ee *exec.ExitError
+			if !errors.As(err, &ee) || ee.ExitCode() != exitConfig {
+				t.Fatalf("exited with %v, want %d\n%s", err, exitConfig, out)
+			}
+			if !strings.Contains(string(out), tc.log) {
+				t.Errorf("log %s, want %q", out, tc.log)
+			}
+		})
+	}
+}
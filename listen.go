@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// countingListener counts accepted connections per listener so the stats
+// endpoint can show how the kernel spreads accepts across SO_REUSEPORT shards.
+type countingListener struct {
+	net.Listener
+	accepts atomic.Int64
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.accepts.Add(1)
+	}
+	return c, err
+}
+
+// Close closes the listener once; handOver closes it before Shutdown does.
+func (l *countingListener) Close() error {
+	l.closeOnce.Do(func() { l.closeErr = l.Listener.Close() })
+	return l.closeErr
+}
+
+var listeners []*countingListener
+
+// inherited are the listeners handed over by the old process of a binary
+// upgrade (see upgradeBinary); both are empty on a normal start.
+type inherited struct {
+	proxy []net.Listener
+	admin net.Listener
+}
+
+// countingListeners wraps lns for the stats endpoint.
+func countingListeners(lns []net.Listener) []*countingListener {
+	out := make([]*countingListener, len(lns))
+	for i, ln := range lns {
+		out[i] = &countingListener{Listener: ln}
+	}
+	return out
+}
+
+// openListeners opens n listeners on addr sharing the port via SO_REUSEPORT.
+// Without SO_REUSEPORT support (or n <= 1) a single listener is opened. The
+// shards after the first bind to the port it got, so an addr with port 0
+// still yields one port.
+func openListeners(addr string, n int) ([]*countingListener, error) {
+	if n <= 1 || reusePortControl == nil {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return countingListeners([]net.Listener{ln}), nil
+	}
+
+	lc := net.ListenConfig{Control: reusePortControl}
+	lns := make([]*countingListener, 0, n)
+	for range n {
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range lns {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, &countingListener{Listener: ln})
+		if len(lns) == 1 {
+			// addr has already parsed if Listen accepted it
+			host, _, _ := net.SplitHostPort(addr)
+			_, port, _ := net.SplitHostPort(ln.Addr().String())
+			addr = net.JoinHostPort(host, port)
+		}
+	}
+	return lns, nil
+}
+
+func listenerStats() any {
+	accepts := make(map[string]int64, len(listeners))
+	for i, l := range listeners {
+		accepts[strconv.Itoa(i)] = l.accepts.Load()
+	}
+	return map[string]any{
+		"count":     len(listeners),
+		"reuseport": len(listeners) > 1,
+		"accepts":   accepts,
+	}
+}
+
+// freshConns tracks the connections that have not sent a byte yet
+// (http.StateNew), for handOver.
+type freshConns struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// track is the http.Server ConnState hook.
+func (f *freshConns) track(c net.Conn, s http.ConnState) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s == http.StateNew {
+		if f.conns == nil {
+			f.conns = map[net.Conn]struct{}{}
+		}
+		f.conns[c] = struct{}{}
+		return
+	}
+	delete(f.conns, c)
+}
+
+func (f *freshConns) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.conns)
+}
+
+// handOverGrace is how long handOver waits for the requests of the
+// connections this process accepted last.
+const handOverGrace = time.Second
+
+// handOver stops accepting on lns, which stay open in the new process of
+// an upgrade, and waits up to handOverGrace for the connections accepted
+// but not yet read from to send their requests. http.Server drops a
+// request it reads once Shutdown has begun, so without the wait the last
+// connections accepted before an upgrade could be closed unanswered.
+func handOver(lns []*countingListener, fresh *freshConns) {
+	for _, ln := range lns {
+		_ = ln.Close()
+	}
+	for deadline := time.Now().Add(handOverGrace); fresh.len() > 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestOpenListenersEphemeralPort(t *testing.T) {
+	if reusePortControl == nil {
+		t.Skip("no SO_REUSEPORT on this platform")
+	}
+	lns, err := openListeners("127.0.0.1:0", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeListeners(lns)
+	if len(lns) != 4 {
+		t.Fatalf("got %d listeners, want 4", len(lns))
+	}
+	want := lns[0].Addr().String()
+	for i, ln := range lns[1:] {
+		if got := ln.Addr().String(); got != want {
+			t.Errorf("shard %d listens on %s, want %s", i+1, got, want)
+		}
+	}
+}
+
+func TestOpenListenersSingle(t *testing.T) {
+	lns, err := openListeners("127.0.0.1:0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeListeners(lns)
+	if len(lns) != 1 {
+		t.Fatalf("got %d listeners, want 1", len(lns))
+	}
+}
+
+func closeListeners(lns []*countingListener) {
+	for _, ln := range lns {
+		_ = ln.Close()
+	}
+}
+
+// BenchmarkConnectionSetup measures connection setup throughput: parallel
+// clients dial, get accepted and close, against 1 listener and against
+// SO_REUSEPORT shards. Compare with
+//
+//	go test -run - -bench ConnectionSetup -cpu 8
+func BenchmarkConnectionSetup(b *testing.B) {
+	for _, n := range []int{1, 4, 8} {
+		b.Run("listeners="+strconv.Itoa(n), func(b *testing.B) {
+			if n > 1 && reusePortControl == nil {
+				b.Skip("no SO_REUSEPORT on this platform")
+			}
+			lns, err := openListeners("127.0.0.1:0", n)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var wg sync.WaitGroup
+			for _, ln := range lns {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						c, err := ln.Accept()
+						if err != nil {
+							return
+						}
+						_ = c.Close()
+					}
+				}()
+			}
+			addr := lns[0].Addr().String()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					_ = c.Close()
+				}
+			})
+			b.StopTimer()
+			closeListeners(lns)
+			wg.Wait()
+		})
+	}
+}
@@ -1,403 +1,309 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
-	"crypto/sha256"
-	"encoding/hex"
-	"io"
+	"context"
+	"encoding/json"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
-	"strconv"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
-	"unsafe"
 
-	"github.com/bytedance/sonic"
-	"github.com/bytedance/sonic/ast"
+	"github.com/ycvk/rightcode-reserve/reserve"
 )
 
-const (
-	TargetHost = "https://right.codes"
-	LocalPort  = ":18080"
-
-	preGrow        = 32 << 10
-	maxKeepBufCap  = 1 << 20 // 1MB
-	copyBufSize    = 32 << 10
-	maxKeepCopyCap = 1 << 20
-)
-
-var (
-	bufPool  = sync.Pool{New: func() any { b := new(bytes.Buffer); b.Grow(preGrow); return b }}
-	copyPool = sync.Pool{New: func() any { return make([]byte, copyBufSize) }}
-
-	gzipPool = sync.Pool{New: func() any { return (*gzip.Reader)(nil) }}
-
-	// fast-path keys (need to confirm ':' after optional whitespace)
-	kInstrKey       = []byte(`"instructions"`)
-	kPromptCacheKey = []byte(`"prompt_cache_key"`)
-	kPrevRespIDKey  = []byte(`"previous_response_id"`)
-
-	// sonic encoder: avoid trailing '\n'
-	sonicAPI = sonic.Config{NoEncoderNewline: true}.Froze()
-)
-
-type pooledBody struct {
-	r *bytes.Reader
-	b *bytes.Buffer
+// default for -listen; the -target default is reserve.DefaultOptions().Target
+const LocalPort = ":18080"
+
+// subcommands are dispatched on the first argument; anything else starts
+// the server.
+var subcommands = map[string]func(args []string) int{
+	"transform": runTransform,
+	"replay":    runReplay,
+	"captures":  runCaptures,
+	"mock":      runMock,
+	"selftest":  runSelftest,
+	"bench":     runBench,
 }
 
-func (p *pooledBody) Read(x []byte) (int, error) { return p.r.Read(x) }
-func (p *pooledBody) Close() error               { putBuf(p.b); return nil }
-
-func putBuf(b *bytes.Buffer) {
-	if b.Cap() > maxKeepBufCap {
-		return
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
 	}
-	b.Reset()
-	bufPool.Put(b)
-}
-
-func setBody(req *http.Request, b *bytes.Buffer) {
-	bs := b.Bytes()
-	req.Body = &pooledBody{r: bytes.NewReader(bs), b: b}
-	req.ContentLength = int64(len(bs))
-	req.Header.Set("Content-Length", strconv.Itoa(len(bs)))
-	req.Header.Del("Transfer-Encoding")
-	req.TransferEncoding = nil
-}
-
-type proxyBufPool struct{}
-
-func (proxyBufPool) Get() []byte { return copyPool.Get().([]byte) }
-func (proxyBufPool) Put(p []byte) {
-	if cap(p) > maxKeepCopyCap || cap(p) < copyBufSize {
-		return
+	if err := parseFlags(os.Args[1:]); err != nil {
+		os.Exit(exitConfig)
 	}
-	copyPool.Put(p[:copyBufSize])
-}
-
-func isWS(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' }
-
-// fast-path: find `"key"` and ensure next non-ws char is ':'
-func hasJSONKey(bs []byte, key []byte) bool {
-	for off := 0; ; {
-		idx := bytes.Index(bs[off:], key)
-		if idx < 0 {
-			return false
-		}
-		pos := off + idx + len(key)
-		for pos < len(bs) && isWS(bs[pos]) {
-			pos++
-		}
-		if pos < len(bs) && bs[pos] == ':' {
-			return true
-		}
-		off = off + idx + 1
+	if cfg.PrintVersion {
+		fmt.Println(reserve.Build())
+		return
 	}
-}
-
-func bytesToString(b []byte) string {
-	return *(*string)(unsafe.Pointer(&b))
-}
-
-func isResponsesPath(p string) bool {
-	const suf = "/v1/responses"
-	if len(p) < len(suf) {
-		return false
+	startService()
+	level := new(slog.LevelVar)
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		slog.Error("invalid -log-level", "error", err)
+		os.Exit(exitConfig)
 	}
-	return p[len(p)-len(suf):] == suf
-}
-
-func getGzipReader(r io.Reader) (*gzip.Reader, error) {
-	if v := gzipPool.Get(); v != nil {
-		zr := v.(*gzip.Reader)
-		if zr != nil {
-			if err := zr.Reset(r); err == nil {
-				return zr, nil
-			}
+	var logHandler slog.Handler
+	var sys *syslogWriter
+	switch cfg.LogOutput {
+	case "stderr":
+		logHandler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	case "syslog":
+		w, err := newSyslogWriter(cfg.SyslogAddr, cfg.SyslogFacility, cfg.SyslogTag)
+		if err != nil {
+			slog.Error("invalid -log-output syslog", "error", err)
+			os.Exit(exitConfig)
 		}
+		sys = w
+		defer sys.flush(2 * time.Second)
+		logHandler = &syslogHandler{w: sys, level: level}
+	default:
+		slog.Error("invalid -log-output: want stderr or syslog", "log_output", cfg.LogOutput)
+		os.Exit(exitConfig)
 	}
-	return gzip.NewReader(r)
-}
+	slog.SetDefault(slog.New(serviceLogHandler(logHandler)))
+	cfg.Options.LogLevel = level
 
-func putGzipReader(zr *gzip.Reader) {
-	_ = zr.Close()
-	gzipPool.Put(zr)
-}
-
-// Derive a stable prompt_cache_key without leaking the raw API key.
-// Priority: Authorization > x-api-key > api-key > (RemoteAddr + UA)
-func derivePromptCacheKey(req *http.Request) string {
-	var s string
-	if v := req.Header.Get("Authorization"); v != "" {
-		s = v
-	} else if v := req.Header.Get("x-api-key"); v != "" {
-		s = v
-	} else if v := req.Header.Get("api-key"); v != "" {
-		s = v
-	} else {
-		s = req.RemoteAddr + "|" + req.Header.Get("User-Agent")
-	}
-	sum := sha256.Sum256([]byte(s))
-	// 16 bytes -> 32 hex chars
-	return hex.EncodeToString(sum[:16])
-}
-
-// Pure byte insertion for prompt_cache_key at the start of a JSON object.
-// Requires: prompt_cache_key missing AND we don't need to rewrite instructions.
-func injectPromptCacheKeyFast(bs []byte, key string) (*bytes.Buffer, bool) {
-	// skip leading whitespace
-	i := 0
-	for i < len(bs) && isWS(bs[i]) {
-		i++
+	tokens, err := cfg.adminTokens()
+	if err != nil {
+		slog.Error("invalid -admin-tokens", "error", err)
+		os.Exit(exitConfig)
 	}
-	if i >= len(bs) || bs[i] != '{' {
-		return nil, false
+	if cfg.AdminListen != "" && len(tokens) == 0 {
+		slog.Error("-admin-listen needs -admin-tokens")
+		os.Exit(exitConfig)
 	}
-
-	out := bufPool.Get().(*bytes.Buffer)
-	out.Reset()
-	out.Grow(len(bs) + len(key) + 32)
-
-	// write up to and including '{'
-	out.Write(bs[:i+1])
-
-	// write `"prompt_cache_key":"<key>"`
-	out.WriteString(`"prompt_cache_key":"`)
-	out.WriteString(key)
-	out.WriteByte('"')
-
-	// detect empty object: next non-ws after '{' is '}'
-	j := i + 1
-	for j < len(bs) && isWS(bs[j]) {
-		j++
+	if cfg.FaultInjection {
+		slog.Warn("fault injection enabled: the admin API can fail requests on purpose")
 	}
-	if j < len(bs) && bs[j] == '}' {
-		out.Write(bs[j:])
-		return out, true
+	if cfg.CaptureDir != "" {
+		slog.Warn("capturing the exchanges of consenting clients", "dir", cfg.CaptureDir,
+			"encrypted", cfg.CaptureKey != "")
 	}
-
-	// non-empty object
-	out.WriteByte(',')
-	out.Write(bs[i+1:])
-	return out, true
-}
-
-func main() {
-	tu, err := url.Parse(TargetHost)
-	if err != nil {
-		slog.Error("failed to parse target host", "error", err)
-		os.Exit(1)
+	if cfg.AdminListen != "" {
+		if cfg.AdminListen, err = cfg.adminAddr(); err != nil {
+			slog.Error("invalid -admin-listen", "error", err)
+			os.Exit(exitConfig)
+		}
 	}
 
-	rp := httputil.NewSingleHostReverseProxy(tu)
-	rp.BufferPool = proxyBufPool{}
-	rp.FlushInterval = -1 // 立即刷新，SSE/流式响应必需
-
-	rp.Transport = &http.Transport{
-		Proxy:                 http.ProxyFromEnvironment,
-		MaxIdleConns:          4096,
-		MaxIdleConnsPerHost:   4096,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ResponseHeaderTimeout: 60 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		ForceAttemptHTTP2:     true,
+	// bind ahead of everything else: a taken port is the likeliest reason
+	// not to start, and should not wait on the store or the warmup
+	var (
+		inh inherited
+		lns []*countingListener
+		tn  *tailnet
+		aln net.Listener
+	)
+	if !cfg.PrintConfig {
+		inh, lns, tn, aln = bindListeners()
 	}
 
-	// 自定义错误处理：客户端主动断开是正常行为，不记录为错误
-	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		if r.Context().Err() != nil {
-			// context canceled 或 deadline exceeded - 客户端已断开，静默处理
-			return
+	var rec *reserve.Recorder
+	if cfg.Record != "" {
+		rec, err = reserve.NewRecorder(cfg.Record, cfg.RecordSample, cfg.RecordMaxBody, cfg.RecordMaxBytes)
+		if err != nil {
+			slog.Error("record dir error", "dir", cfg.Record, "error", err)
+			os.Exit(exitConfig)
 		}
-		slog.Error("proxy error", "error", err)
-		w.WriteHeader(http.StatusBadGateway)
+		cfg.Hooks = append(reserve.DefaultHooks(), rec.Hook())
 	}
 
-	od := rp.Director
-	rp.Director = func(r *http.Request) {
-		od(r)
-		r.Host = tu.Host
-
-		if r.Method == http.MethodPost && isResponsesPath(r.URL.Path) {
-			tweakBodySonic(r)
+	if cfg.Prices != "" {
+		cfg.Options.Prices, err = reserve.LoadPriceTable(cfg.Prices)
+		if err != nil {
+			slog.Error("invalid -prices", "file", cfg.Prices, "error", err)
+			os.Exit(exitConfig)
 		}
 	}
-
-	slog.Info("proxy server starting", "local", LocalPort, "target", TargetHost)
-	s := &http.Server{
-		Addr:              LocalPort,
-		Handler:           rp,
-		ReadHeaderTimeout: 5 * time.Second,
-		IdleTimeout:       120 * time.Second,
-	}
-	if err := s.ListenAndServe(); err != nil {
-		slog.Error("server error", "error", err)
-		os.Exit(1)
+	if cfg.Quotas != "" {
+		cfg.Options.Quotas, err = reserve.LoadQuotaTable(cfg.Quotas)
+		if err != nil {
+			slog.Error("invalid -quotas", "file", cfg.Quotas, "error", err)
+			os.Exit(exitConfig)
+		}
 	}
-}
 
-func tweakBodySonic(req *http.Request) {
-	if req.Body == nil {
-		return
+	if cfg.ResponseHeaders != "" {
+		cfg.Options.ResponseHeaders, err = reserve.LoadResponseHeaderPolicy(cfg.ResponseHeaders)
+		if err != nil {
+			slog.Error("invalid -response-headers", "file", cfg.ResponseHeaders, "error", err)
+			os.Exit(exitConfig)
+		}
 	}
 
-	b := bufPool.Get().(*bytes.Buffer)
-	b.Reset()
-
-	// pre-grow based on Content-Length if available
-	if req.ContentLength > 0 && req.ContentLength < maxKeepBufCap {
-		b.Grow(int(req.ContentLength))
+	if err := reserve.SetPoolMaxKeep(cfg.PoolMaxKeepBuf, cfg.PoolMaxKeepCopy); err != nil {
+		slog.Error("invalid -pool-max-keep-buf / -pool-max-keep-copy", "error", err)
+		os.Exit(exitConfig)
 	}
 
-	// read body (support gzip)
-	if req.Header.Get("Content-Encoding") == "gzip" {
-		zr, err := getGzipReader(req.Body)
-		if err != nil {
-			req.Body.Close()
-			putBuf(b)
-			return
-		}
-		_, err = b.ReadFrom(zr)
-		putGzipReader(zr)
-		req.Body.Close()
-		if err != nil {
-			putBuf(b)
-			return
-		}
-		req.Header.Del("Content-Encoding")
-	} else {
-		_, err := b.ReadFrom(req.Body)
-		req.Body.Close()
-		if err != nil {
-			putBuf(b)
-			return
+	if cfg.WideLog != "" {
+		w := os.Stderr
+		if cfg.WideLog != "-" {
+			w, err = os.OpenFile(cfg.WideLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+			if err != nil {
+				slog.Error("invalid -wide-log", "file", cfg.WideLog, "error", err)
+				os.Exit(exitConfig)
+			}
+			defer w.Close()
 		}
+		cfg.Options.WideLog = slog.New(slog.NewJSONHandler(w, nil))
 	}
 
-	bs := b.Bytes()
-
-	// 打印 model 和 reasoning.effort
-	if model, _ := sonic.Get(bs, "model"); model.Valid() {
-		modelStr, _ := model.String()
-		if re, _ := sonic.Get(bs, "reasoning", "effort"); re.Valid() {
-			effort, _ := re.String()
-			slog.Info("request info", "model", modelStr, "reasoning.effort", effort)
-		} else {
-			slog.Info("request info", "model", modelStr)
+	if cfg.NotifyTemplateFile != "" {
+		bs, err := os.ReadFile(cfg.NotifyTemplateFile)
+		if err != nil {
+			slog.Error("invalid -notify-template", "file", cfg.NotifyTemplateFile, "error", err)
+			os.Exit(exitConfig)
 		}
+		cfg.Options.NotifyTemplate = string(bs)
 	}
 
-	needInstr := hasJSONKey(bs, kInstrKey)
-	hasPrompt := hasJSONKey(bs, kPromptCacheKey)
-	hasPrev := hasJSONKey(bs, kPrevRespIDKey)
-
-	// auto补 prompt_cache_key（缺失才补）
-	// instructions 迁移：当 previous_response_id 存在时不做（避免多轮重复注入膨胀）
-	shouldRewriteInstr := needInstr && !hasPrev
-
-	// Fast path: only need to inject prompt_cache_key; no instructions rewrite.
-	if !shouldRewriteInstr && !hasPrompt {
-		key := derivePromptCacheKey(req)
-		if out, ok := injectPromptCacheKeyFast(bs, key); ok {
-			putBuf(b)
-			setBody(req, out)
-			return
+	p, err := reserve.NewProxy(cfg.Options)
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(exitConfig)
+	}
+	p.RegisterStats("listeners", listenerStats)
+	if sys != nil {
+		p.RegisterStats("syslog", sys.stats)
+	}
+	if rec != nil {
+		p.RegisterStats("record", rec.Stats)
+	}
+	p.RegisterConfig("flags", flagsView)
+	if cfg.PrintConfig {
+		bs, err := json.MarshalIndent(p.Config(), "", "  ")
+		if err != nil {
+			slog.Error("print config", "error", err)
+			os.Exit(exitRuntime)
 		}
-		// fall through to AST if not a plain object
+		fmt.Println(string(bs))
+		return
 	}
 
-	// If no changes needed at all, keep original body
-	if !shouldRewriteInstr && hasPrompt {
-		setBody(req, b)
-		return
+	if cfg.Store != "" {
+		attachStore(p)
+	}
+	if cfg.Warmup {
+		p.Warmup(cfg.WarmupConns)
 	}
 
-	// AST path (sonic)
-	src := bytesToString(bs)
+	var handler http.Handler = p
+	if tn != nil {
+		defer tn.close()
+		handler = tn.wrap(p)
+	}
+	logBanner(lns, len(inh.proxy) > 0)
+	var fresh freshConns
+	s := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		ConnContext:       p.ConnContext,
+		ConnState: func(c net.Conn, st http.ConnState) {
+			fresh.track(c, st)
+			p.ConnState(c, st)
+		},
+	}
 
-	p := ast.NewParserObj(src)
-	root, perr := p.Parse()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	upgrade := make(chan os.Signal, 1)
+	notifyUpgrade(upgrade)
 
-	// perr == 0 表示成功
-	if perr != 0 {
-		slog.Error("ast parse error", "perr", perr)
-		setBody(req, b)
-		return
+	errc := make(chan error, len(lns)+1)
+	for _, ln := range lns {
+		go func() { errc <- s.Serve(ln) }()
 	}
 
-	// ensure prompt_cache_key
-	if !hasPrompt {
-		key := derivePromptCacheKey(req)
-		pk := root.Get("prompt_cache_key")
-		if pk == nil || !pk.Exists() || pk.TypeSafe() == ast.V_NULL {
-			_, _ = root.Set("prompt_cache_key", ast.NewString(key))
+	var admin *http.Server
+	if aln != nil {
+		slog.Info("admin api listening", "addr", cfg.AdminListen)
+		admin = &http.Server{
+			Addr:              cfg.AdminListen,
+			Handler:           p.AdminHandler(tokens),
+			ReadHeaderTimeout: 5 * time.Second,
 		}
+		go func() { errc <- admin.Serve(aln) }()
 	}
-
-	if shouldRewriteInstr {
-		ins := root.Get("instructions")
-		if ins != nil && ins.Exists() && ins.TypeSafe() == ast.V_STRING {
-			content := *ins
-			_, _ = root.Unset("instructions")
-
-			// dev = {"role":"developer","content":<ins>}
-			dev := ast.NewObject([]ast.Pair{
-				ast.NewPair("role", ast.NewString("developer")),
-				ast.NewPair("content", content),
-			})
-
-			in := root.Get("input")
-
-			// missing / null
-			if in == nil || !in.Exists() || in.TypeSafe() == ast.V_NULL {
-				_, _ = root.Set("input", ast.NewArray([]ast.Node{dev}))
-				goto ENCODE
-			}
-
-			switch in.TypeSafe() {
-			case ast.V_STRING:
-				user := ast.NewObject([]ast.Pair{
-					ast.NewPair("role", ast.NewString("user")),
-					ast.NewPair("content", *in),
-				})
-				_, _ = root.Set("input", ast.NewArray([]ast.Node{dev, user}))
-
-			case ast.V_ARRAY:
-				// in-place prepend: Add at end then Move to 0
-				if err := in.Add(dev); err == nil {
-					if n, err := in.Len(); err == nil && n > 1 {
-						_ = in.Move(0, n-1)
-					}
-				} else {
-					_, _ = root.Set("input", ast.NewArray([]ast.Node{dev}))
+	signalReady()
+	serviceRunning()
+
+wait:
+	for {
+		select {
+		case err := <-errc:
+			slog.Error("server error", "error", err)
+			os.Exit(exitRuntime)
+		case <-ctx.Done():
+			break wait
+		case <-serviceStop:
+			break wait
+		case <-upgrade:
+			// the new process shares our sockets, so nothing is refused
+			// while we hand over and drain
+			slog.Info("upgrade requested, starting new process")
+			// the store file is locked; the new process takes it over
+			detachStore(p)
+			if err := upgradeBinary(lns, aln, cfg.UpgradeTimeout); err != nil {
+				slog.Error("upgrade failed, still serving", "error", err)
+				if cfg.Store != "" {
+					attachStore(p)
 				}
-
-			default:
-				_, _ = root.Set("input", ast.NewArray([]ast.Node{dev}))
+				continue
 			}
+			slog.Info("new process ready, handing over")
+			handOver(lns, &fresh)
+			break wait
 		}
 	}
 
-ENCODE:
-	out := bufPool.Get().(*bytes.Buffer)
-	out.Reset()
-	out.Grow(len(bs) + 64)
+	// stop accepting on every listener, give in-flight requests (including
+	// long SSE streams) ShutdownTimeout to finish. After an upgrade the
+	// sockets stay open in the new process.
+	slog.Info("shutting down", "timeout", cfg.ShutdownTimeout)
+	sctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	for _, srv := range []*http.Server{admin, s} {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Shutdown(sctx); err != nil {
+			slog.Warn("shutdown incomplete", "addr", srv.Addr, "error", err)
+			_ = srv.Close()
+		}
+	}
+	p.Close()
+	detachStore(p)
+	p.CloseUsageExport()
+	p.CloseCapture()
+	serviceStopped()
+}
 
-	enc := sonicAPI.NewEncoder(out)
-	if err := enc.Encode(&root); err != nil {
-		slog.Error("ast encode error", "error", err)
-		putBuf(out)
-		setBody(req, b)
-		return
+// attachStore opens -store and attaches it to p; failing that, the proxy
+// runs on with its state in memory only.
+func attachStore(p *reserve.Proxy) {
+	st, err := reserve.OpenBoltStore(cfg.Store)
+	if err == nil {
+		if err = p.AttachStore(st); err != nil {
+			st.Close()
+		}
+	}
+	if err != nil {
+		slog.Error("store not attached, state is kept in memory only", "path", cfg.Store, "error", err)
 	}
+}
 
-	// Only now safe to return b (AST may reference src backed by b)
-	putBuf(b)
-	setBody(req, out)
+// detachStore saves p's state to its store, if any, and releases it.
+func detachStore(p *reserve.Proxy) {
+	if err := p.DetachStore(); err != nil {
+		slog.Warn("store close failed", "path", cfg.Store, "error", err)
+	}
 }
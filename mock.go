@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ycvk/rightcode-reserve/reserve"
+)
+
+// runMock is `rc-proxy mock`: a local fake right.codes for offline demos
+// and end-to-end tests; point the proxy at it with -target.
+func runMock(args []string) int {
+	opts := reserve.DefaultMockOptions()
+	fs := flag.NewFlagSet("rc-proxy mock", flag.ContinueOnError)
+	listen := fs.String("listen", "127.0.0.1:18090", "address to listen on")
+	fs.StringVar(&opts.Text, "text", opts.Text, "reply text, a Go template over .Model, .Input and .PromptCacheKey")
+	fs.IntVar(&opts.Deltas, "deltas", opts.Deltas, "output_text.delta events per streamed reply")
+	fs.DurationVar(&opts.Delay, "delay", opts.Delay, "delay before each delta event")
+	fs.StringVar(&opts.Fail, "fail", "", "failure injected into every request: 429, 500, disconnect, slow_headers or stream_error")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	h, err := reserve.NewMockUpstream(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mock: bad -text:", err)
+		return 2
+	}
+	slog.Info("mock upstream listening", "addr", *listen)
+	s := &http.Server{Addr: *listen, Handler: h, ReadHeaderTimeout: 5 * time.Second}
+	if err := s.ListenAndServe(); err != nil {
+		slog.Error("mock server error", "error", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,65 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// portOwner finds the process listening on TCP port, through the socket
+// tables in /proc/net and the fds of the processes this one may inspect.
+// pid is 0 when it can't be told.
+func portOwner(port string) (pid int, name string) {
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, ""
+	}
+	suffix := fmt.Sprintf(":%04X", n)
+	inodes := map[string]bool{}
+	for _, f := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		listeningInodes(f, suffix, inodes)
+	}
+	if len(inodes) == 0 {
+		return 0, ""
+	}
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+		if !inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] {
+			continue
+		}
+		dir := filepath.Dir(filepath.Dir(fd))
+		pid, _ = strconv.Atoi(filepath.Base(dir))
+		comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+		return pid, strings.TrimSpace(string(comm))
+	}
+	return 0, ""
+}
+
+// listeningInodes adds the inodes of the sockets listening on a local
+// address ending in suffix (":PORT" in hex) in the /proc/net table file.
+func listeningInodes(file, suffix string, inodes map[string]bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Scan() // header
+	for sc.Scan() {
+		// sl local_address rem_address st tx:rx tr:when retrnsmt uid timeout inode
+		fs := strings.Fields(sc.Text())
+		if len(fs) < 10 || fs[3] != "0A" || !strings.HasSuffix(fs[1], suffix) {
+			continue
+		}
+		inodes[fs[9]] = true
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// A -profile presets a bundle of flags that make sense together for one
+// kind of client. The values are defaults: a flag given on the command
+// line wins, and the config dump tells the two apart ("source" profile).
+
+type profile struct {
+	desc  string
+	flags map[string]string // flag name -> value, as on the command line
+}
+
+var profiles = map[string]profile{
+	"codex": {
+		desc: "Codex CLI: Responses requests under / and /codex with the full rewrite, store:false with encrypted reasoning carried over",
+		flags: map[string]string{
+			"mounts":               ",/codex",
+			"instructions-rewrite": "true",
+			"system-to-developer":  "true",
+			"reasoning-include":    "true",
+			"strip-reasoning":      "true",
+			"stream-sniff-wait":    "200ms",
+			"upstream-accept-gzip": "true",
+		},
+	},
+	"chat-passthrough": {
+		desc: "SDKs and frameworks (LangChain and the like) that send their own well-formed bodies: routes at the root only, bodies changed as little as possible",
+		flags: map[string]string{
+			"mounts":               "",
+			"instructions-rewrite": "false",
+			"system-to-developer":  "false",
+			"reasoning-include":    "false",
+			"strip-reasoning":      "false",
+			"minimal-diff":         "true",
+			"flush-types":          "application/x-ndjson",
+		},
+	},
+	"strict-privacy": {
+		desc: "nothing identifying leaves or stays behind: credentials required, client headers stripped, coarse client addresses, redacted logs",
+		flags: map[string]string{
+			"require-auth":         "*",
+			"drop-headers":         "Cookie,Referer,Origin,X-Forwarded-For,X-Real-IP,Forwarded",
+			"identity-ipv4-prefix": "24",
+			"identity-ipv6-prefix": "48",
+			"reasoning-include":    "true",
+			"wide-redact":          "client.id,remote",
+			"error-fingerprints":   "false",
+			"conn-trace-header":    "false",
+			"version-header":       "false",
+			"trace-echo-id":        "false",
+		},
+	},
+}
+
+// fromProfile are the flags set by the selected -profile, for flagsView.
+var fromProfile = map[string]bool{}
+
+// profileNames lists the profiles, sorted.
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// applyProfile sets the flags of profile name that weren't given on the
+// command line, after fs is parsed.
+func applyProfile(fs *flag.FlagSet, name string) error {
+	if name == "" {
+		return nil
+	}
+	pr, ok := profiles[name]
+	if !ok {
+		err := fmt.Errorf("unknown -profile %q, want one of: %s", name, strings.Join(profileNames(), ", "))
+		fmt.Fprintln(fs.Output(), err)
+		for _, n := range profileNames() {
+			fmt.Fprintf(fs.Output(), "  %-18s %s\n", n, profiles[n].desc)
+		}
+		return err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for flagName, v := range pr.flags {
+		if set[flagName] {
+			continue
+		}
+		if err := fs.Set(flagName, v); err != nil {
+			return fmt.Errorf("profile %s: flag -%s: %w", name, flagName, err)
+		}
+		fromProfile[flagName] = true
+	}
+	return nil
+}
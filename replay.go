@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ycvk/rightcode-reserve/reserve"
+)
+
+// runReplay is `rc-proxy replay`: it resends the requests recorded with
+// -record to a target and compares status and latency with the recording.
+// It exits 1 when any status differs or a request fails.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("rc-proxy replay", flag.ContinueOnError)
+	dir := fs.String("dir", "", "record directory (required)")
+	target := fs.String("target", "", "base URL to replay against, e.g. http://127.0.0.1:18080 (required)")
+	auth := fs.String("auth", "", "Authorization header to send; credentials are never recorded")
+	conc := fs.Int("concurrency", 1, "requests in flight at once")
+	rate := fs.Float64("rate", 1, "max requests per second (0 = unlimited)")
+	timeout := fs.Duration("timeout", 5*time.Minute, "per-request timeout")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *dir == "" || *target == "" {
+		fmt.Fprintln(os.Stderr, "replay: -dir and -target are required")
+		fs.Usage()
+		return 2
+	}
+	base := strings.TrimRight(*target, "/")
+
+	entries, err := reserve.ReadRecords(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 1
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(os.Stderr, "replay: no records in", *dir)
+		return 1
+	}
+
+	type result struct {
+		e       *reserve.RecordEntry
+		status  int
+		latency time.Duration
+		err     error
+	}
+	results := make([]result, len(entries))
+
+	var tick <-chan time.Time
+	if *rate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer t.Stop()
+		tick = t.C
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for range max(*conc, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				e := &entries[i]
+				res := &results[i]
+				res.e = e
+				req, err := http.NewRequestWithContext(context.Background(), e.Method, base+e.Path, strings.NewReader(e.Body))
+				if err != nil {
+					res.err = err
+					continue
+				}
+				for k, vs := range e.Header {
+					req.Header[k] = slices.Clone(vs)
+				}
+				if *auth != "" {
+					req.Header.Set("Authorization", *auth)
+				}
+				start := time.Now()
+				resp, err := client.Do(req)
+				if err != nil {
+					res.err = err
+					continue
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				res.status, res.latency = resp.StatusCode, time.Since(start)
+			}
+		}()
+	}
+	for i := range entries {
+		if tick != nil {
+			<-tick
+		}
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	var (
+		failed, mismatched int
+		was, now           []float64
+	)
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			failed++
+			fmt.Fprintf(os.Stderr, "%s %s %s: %v\n", r.e.ID, r.e.Method, r.e.Path, r.err)
+			continue
+		case r.status != r.e.Status:
+			mismatched++
+			fmt.Fprintf(os.Stderr, "%s %s %s: status %d, recorded %d\n", r.e.ID, r.e.Method, r.e.Path, r.status, r.e.Status)
+		}
+		was = append(was, r.e.Latency)
+		now = append(now, float64(r.latency.Microseconds())/1000)
+	}
+	fmt.Printf("replayed %d requests: %d status matches, %d mismatches, %d failed\n",
+		len(results), len(results)-mismatched-failed, mismatched, failed)
+	if len(now) > 0 {
+		fmt.Printf("latency ms   recorded p50 %.1f p95 %.1f   replay p50 %.1f p95 %.1f\n",
+			percentile(was, 50), percentile(was, 95), percentile(now, 50), percentile(now, 95))
+	}
+	if failed > 0 || mismatched > 0 {
+		return 1
+	}
+	return 0
+}
+
+func percentile(xs []float64, p int) float64 {
+	s := slices.Clone(xs)
+	slices.Sort(s)
+	return s[(len(s)-1)*p/100]
+}
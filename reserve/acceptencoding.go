@@ -0,0 +1,94 @@
+package reserve
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// A client sending Accept-Encoding: identity gets the upstream's replies
+// uncompressed, and the egress is paid for at 5-10x. With
+// Options.UpstreamAcceptGzip every request goes upstream with
+// Accept-Encoding: gzip, whatever the client sent (a route's policy
+// accept_encoding still wins). A gzip response is passed through as it
+// came to a client that takes gzip, Content-Length and all, and
+// decompressed for one that does not; event streams are always sent
+// decompressed, so the stream watchers and flushes see plain events.
+// Either way the response gets Vary: Accept-Encoding. Only gzip is
+// advertised: no br or zstd decoder is built in.
+
+type acceptEncodingCounts struct {
+	advertised   atomic.Int64 // requests sent out with gzip the client did not ask for
+	passed       atomic.Int64 // gzip responses passed through compressed
+	decompressed atomic.Int64 // gzip responses decompressed for the client
+	streams      atomic.Int64 // of which event streams
+}
+
+func (p *Proxy) acceptEncodingStats() any {
+	c := &p.acceptEncoding
+	return map[string]any{
+		"enabled":      p.opts.UpstreamAcceptGzip,
+		"advertised":   c.advertised.Load(),
+		"passed":       c.passed.Load(),
+		"decompressed": c.decompressed.Load(),
+		"streams":      c.streams.Load(),
+	}
+}
+
+// advertiseGzip asks the upstream for gzip on behalf of the outgoing
+// request r; run from the Director, after normalizeHeaders.
+func (p *Proxy) advertiseGzip(r *http.Request) {
+	st := stateOf(r.Context())
+	if !p.opts.UpstreamAcceptGzip || st == nil || st.askedGzip {
+		return
+	}
+	if st.route != nil && p.opts.Policy != nil {
+		if hp, _ := p.opts.Policy.headersFor(st.route.name); hp.AcceptEncoding != "" {
+			return // the policy's choice
+		}
+	}
+	ae := r.Header.Get("Accept-Encoding")
+	st.askedGzip = true
+	st.gunzip = !acceptsGzip(ae)
+	if st.gunzip {
+		p.acceptEncoding.advertised.Add(1)
+	}
+	if ae != "gzip" {
+		r.Header.Set("Accept-Encoding", "gzip")
+		st.trace.log("accept_encoding", "client", ae, "gunzip", st.gunzip)
+	}
+}
+
+// decodeResponse settles the encoding of resp for the client when the
+// proxy asked for gzip (see advertiseGzip and normalizeHeaders).
+func (p *Proxy) decodeResponse(resp *http.Response, st *reqState) error {
+	if !st.askedGzip || resp.Header.Get("Content-Encoding") != "gzip" {
+		return nil
+	}
+	addVary(resp.Header, "Accept-Encoding")
+	stream := isEventStream(resp)
+	if !st.gunzip && !stream {
+		p.acceptEncoding.passed.Add(1)
+		return nil
+	}
+	if err := gunzipResponse(resp); err != nil {
+		return err
+	}
+	p.acceptEncoding.decompressed.Add(1)
+	if stream {
+		p.acceptEncoding.streams.Add(1)
+	}
+	return nil
+}
+
+// addVary adds the header name k to the Vary of h unless listed already.
+func addVary(h http.Header, k string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f == "*" || strings.EqualFold(f, k) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", k)
+}
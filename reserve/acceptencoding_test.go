@@ -0,0 +1,137 @@
+package reserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	gzipJSON = `{"id":"resp_1","object":"response","output_text":"` + "compressible compressible compressible" + `"}`
+	gzipSSE  = "event: response.created\ndata: {\"type\":\"response.created\"}\n\n" +
+		"event: response.completed\ndata: {\"type\":\"response.completed\"}\n\n"
+)
+
+// gzipUpstream answers with gzipJSON, or gzipSSE for a request with
+// "stream":true, gzip compressed when the request accepts gzip.
+func gzipUpstream(t *testing.T) *testUpstream {
+	return newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		out, ct := gzipJSON, "application/json"
+		if bytes.Contains(body, []byte(`"stream":true`)) {
+			out, ct = gzipSSE, "text/event-stream"
+		}
+		w.Header().Set("Content-Type", ct)
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			io.WriteString(w, out)
+			return
+		}
+		zbs := gzipped(t, out)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(len(zbs)))
+		w.Write(zbs)
+	})
+}
+
+func gzipped(t *testing.T, s string) []byte {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	io.WriteString(zw, s)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestUpstreamAcceptGzip(t *testing.T) {
+	for _, ae := range []string{"", "identity", "gzip", "GZIP", "br", "gzip;q=0", "deflate, gzip;q=0.5", "*"} {
+		for _, stream := range []bool{false, true} {
+			name := "accept=" + ae
+			if stream {
+				name += "/stream"
+			}
+			t.Run(name, func(t *testing.T) {
+				u := gzipUpstream(t)
+				opts := DefaultOptions()
+				opts.UpstreamAcceptGzip = true
+				p := newTestProxy(t, opts, u)
+				hdr := http.Header{}
+				if ae != "" {
+					hdr.Set("Accept-Encoding", ae)
+				}
+				body, want := `{"input":"hi"}`, gzipJSON
+				if stream {
+					body, want = `{"input":"hi","stream":true}`, gzipSSE
+				}
+				w := send(p, "POST", "/v1/responses", hdr, body)
+				if w.Code != http.StatusOK {
+					t.Fatalf("answered %d %s", w.Code, w.Body)
+				}
+				if got := u.requests()[0].header.Get("Accept-Encoding"); got != "gzip" {
+					t.Errorf("upstream Accept-Encoding = %q, want gzip", got)
+				}
+				if !strings.Contains(strings.Join(w.Header().Values("Vary"), ","), "Accept-Encoding") {
+					t.Errorf("Vary = %q, want Accept-Encoding", w.Header().Values("Vary"))
+				}
+
+				got := w.Body.Bytes()
+				if acceptsGzip(ae) && !stream {
+					// passed through as the upstream sent it
+					if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+						t.Fatalf("Content-Encoding = %q, want gzip", ce)
+					}
+					if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(len(got)) {
+						t.Errorf("Content-Length = %q for %d bytes", cl, len(got))
+					}
+					zr, err := gzip.NewReader(bytes.NewReader(got))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got, err = io.ReadAll(zr); err != nil {
+						t.Fatal(err)
+					}
+				} else {
+					if ce := w.Header().Get("Content-Encoding"); ce != "" {
+						t.Errorf("Content-Encoding = %q, want none", ce)
+					}
+					if cl := w.Header().Get("Content-Length"); cl != "" && cl != strconv.Itoa(len(got)) {
+						t.Errorf("Content-Length = %q for %d bytes", cl, len(got))
+					}
+				}
+				if string(got) != want {
+					t.Errorf("client got %q, want %q", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestUpstreamAcceptGzipStats(t *testing.T) {
+	u := gzipUpstream(t)
+	opts := DefaultOptions()
+	opts.UpstreamAcceptGzip = true
+	p := newTestProxy(t, opts, u)
+	send(p, "POST", "/v1/responses", http.Header{"Accept-Encoding": {"gzip"}}, `{"input":"hi"}`)
+	send(p, "POST", "/v1/responses", http.Header{"Accept-Encoding": {"identity"}}, `{"input":"hi"}`)
+	send(p, "POST", "/v1/responses", http.Header{"Accept-Encoding": {"gzip"}}, `{"input":"hi","stream":true}`)
+	st := p.acceptEncodingStats().(map[string]any)
+	if st["advertised"] != int64(1) || st["passed"] != int64(1) || st["decompressed"] != int64(2) || st["streams"] != int64(1) {
+		t.Errorf("accept_encoding stats = %v", st)
+	}
+}
+
+func TestUpstreamAcceptGzipOff(t *testing.T) {
+	u := gzipUpstream(t)
+	p := newTestProxy(t, DefaultOptions(), u)
+	w := send(p, "POST", "/v1/responses", http.Header{"Accept-Encoding": {"identity"}}, `{"input":"hi"}`)
+	if got := u.requests()[0].header.Get("Accept-Encoding"); got != "identity" {
+		t.Errorf("upstream Accept-Encoding = %q, want the client's identity", got)
+	}
+	if w.Body.String() != gzipJSON || w.Header().Get("Vary") != "" {
+		t.Errorf("client got %q with Vary %q", w.Body, w.Header().Get("Vary"))
+	}
+}
@@ -0,0 +1,204 @@
+package reserve
+
+import (
+	"crypto/subtle"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	configPath  = reservePrefix + "config"
+	runtimePath = reservePrefix + "runtime"
+	flushPath   = reservePrefix + "flush"
+	versionPath = reservePrefix + "version"
+)
+
+// AdminToken is one admin API credential; Name identifies the caller in
+// the log of every change.
+type AdminToken struct {
+	Name  string
+	Token Secret
+}
+
+var (
+	errAdminAuth = &httpError{
+		status: http.StatusUnauthorized,
+		code:   "admin_unauthorized",
+		msg:    "missing or invalid admin token",
+	}
+	errAdminBody = &httpError{
+		status: http.StatusBadRequest,
+		code:   "invalid_admin_request",
+		msg:    "admin request body is not valid JSON",
+	}
+	errNotFound = &httpError{
+		status: http.StatusNotFound,
+		code:   "not_found",
+		msg:    "no such endpoint",
+	}
+	errMethod = &httpError{
+		status: http.StatusMethodNotAllowed,
+		code:   "method_not_allowed",
+		msg:    "method not allowed",
+	}
+)
+
+// AdminHandler returns p's admin API, meant for a separate listener. Every
+// request needs "Authorization: Bearer <token>" with one of tokens; with no
+// tokens every request is refused.
+//
+//	GET    /_reserve/config       effective configuration, secrets fingerprinted
+//	GET    /_reserve/runtime      runtime settings
+//	PATCH  /_reserve/runtime      change runtime settings (RuntimePatch JSON)
+//	POST   /_reserve/flush        drop cached state (client identities, GET cache)
+//	GET    /_reserve/version      build info
+//	POST   /_reserve/notify/test  send a test notification to the webhook
+//	POST   /_reserve/profile      write heap and goroutine profiles now
+//	GET    /_reserve/quotas       current quota use (?client= for one)
+//	DELETE /_reserve/quotas       reset quota use (?client=, * = all; ?period=)
+//	GET    /_reserve/upstream/tls the upstream's latest verified and rejected certificate chains
+//	GET    /_reserve/faults       fault injection rules (Options.FaultInjection only)
+//	PUT    /_reserve/faults       replace them ({"rules": [FaultRule...]})
+//	DELETE /_reserve/faults       clear them
+//	GET    /_reserve/stats        same as on the proxy listener
+func (p *Proxy) AdminHandler(tokens []AdminToken) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := adminCaller(r, tokens)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rc-proxy admin"`)
+			writeHTTPError(w, errAdminAuth)
+			return
+		}
+
+		switch r.URL.Path {
+		case statsPath:
+			p.stats.ServeHTTP(w, r)
+		case configPath:
+			if r.Method != http.MethodGet {
+				writeHTTPError(w, errMethod)
+				return
+			}
+			writeJSON(w, http.StatusOK, p.config.snapshot())
+		case runtimePath:
+			switch r.Method {
+			case http.MethodGet:
+				writeJSON(w, http.StatusOK, p.rewriter.Runtime())
+			case http.MethodPatch:
+				p.patchRuntime(w, r, caller)
+			default:
+				writeHTTPError(w, errMethod)
+			}
+		case flushPath:
+			if r.Method != http.MethodPost {
+				writeHTTPError(w, errMethod)
+				return
+			}
+			n, g := 0, 0
+			if c := p.rewriter.clients; c != nil {
+				n = c.flush()
+			}
+			if p.getCache != nil {
+				g = p.getCache.flush()
+			}
+			slog.Info("admin flush", "caller", caller, "remote", r.RemoteAddr, "client_cache", n, "get_cache", g)
+			writeJSON(w, http.StatusOK, map[string]any{"client_cache": n, "get_cache": g})
+		case notifyTestPath:
+			p.serveNotifyTest(w, r, caller)
+		case profilePath:
+			p.serveProfile(w, r, caller)
+		case quotaPath:
+			p.serveQuotas(w, r, caller)
+		case upstreamTLSPath:
+			p.serveUpstreamTLS(w, r)
+		case faultsPath:
+			p.serveFaults(w, r, caller)
+		case versionPath:
+			if r.Method != http.MethodGet {
+				writeHTTPError(w, errMethod)
+				return
+			}
+			writeJSON(w, http.StatusOK, Build())
+		default:
+			writeHTTPError(w, errNotFound)
+		}
+	})
+}
+
+func (p *Proxy) patchRuntime(w http.ResponseWriter, r *http.Request, caller string) {
+	bs, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		writeHTTPError(w, errAdminBody)
+		return
+	}
+	var patch RuntimePatch
+	if err := sonicAPI.Unmarshal(bs, &patch); err != nil {
+		writeHTTPError(w, errAdminBody)
+		return
+	}
+	old := p.rewriter.Runtime()
+	rt, err := p.rewriter.UpdateRuntime(patch)
+	if err != nil {
+		if !WriteError(w, err) {
+			writeHTTPError(w, &httpError{status: http.StatusBadRequest, code: "invalid_admin_request", msg: err.Error()})
+		}
+		return
+	}
+	slog.Info("admin runtime change", "caller", caller, "remote", r.RemoteAddr, "old", old, "new", rt)
+	writeJSON(w, http.StatusOK, rt)
+}
+
+// adminCaller returns the name of the token r authenticates with.
+func adminCaller(r *http.Request, tokens []AdminToken) (string, bool) {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || tok == "" {
+		return "", false
+	}
+	for _, t := range tokens {
+		if t.Token != "" && subtle.ConstantTimeCompare([]byte(tok), []byte(t.Token)) == 1 {
+			return t.Name, true
+		}
+	}
+	return "", false
+}
+
+// optionsView renders the scalar Options fields for the config endpoint,
+// durations as strings and Secrets as fingerprints. Fields that aren't
+// plain values (transport, hooks, the log level var) are left out.
+func optionsView(o Options) map[string]any {
+	out := map[string]any{}
+	v := reflect.ValueOf(o)
+	t := v.Type()
+	for i := range t.NumField() {
+		f := v.Field(i)
+		switch x := f.Interface().(type) {
+		case time.Duration:
+			out[t.Field(i).Name] = x.String()
+		case Secret, string, bool, int, int64, float64, []string, map[string]int64:
+			out[t.Field(i).Name] = x
+		case *PriceTable:
+			if x != nil {
+				out[t.Field(i).Name] = x
+			}
+		case *QuotaTable:
+			if x != nil {
+				out[t.Field(i).Name] = x
+			}
+		}
+	}
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	bs, err := statsAPI.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bs)
+}
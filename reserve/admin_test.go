@@ -0,0 +1,163 @@
+package reserve
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testAdminTokens = []AdminToken{{Name: "ops", Token: "adm-1"}}
+
+// admin serves one admin API request with the ops token.
+func admin(p *Proxy, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer adm-1")
+	w := httptest.NewRecorder()
+	p.AdminHandler(testAdminTokens).ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	p := newTestProxy(t, DefaultOptions(), newTestUpstream(t, nil))
+	for _, tc := range []struct {
+		tokens []AdminToken
+		auth   string
+	}{
+		{nil, "Bearer adm-1"},
+		{testAdminTokens, ""},
+		{testAdminTokens, "Bearer "},
+		{testAdminTokens, "Bearer adm-2"},
+		{testAdminTokens, "adm-1"},
+		{[]AdminToken{{Name: "empty"}}, "Bearer "},
+	} {
+		req := httptest.NewRequest("GET", runtimePath, nil)
+		req.Header.Set("Authorization", tc.auth)
+		w := httptest.NewRecorder()
+		p.AdminHandler(tc.tokens).ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%d tokens, Authorization %q: answered %d, want 401", len(tc.tokens), tc.auth, w.Code)
+		}
+	}
+	if w := admin(p, "GET", runtimePath, ""); w.Code != http.StatusOK {
+		t.Errorf("with the token: answered %d %s", w.Code, w.Body)
+	}
+}
+
+func TestAdminToggleMidTraffic(t *testing.T) {
+	release := make(chan struct{})
+	u := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "event: response.created\ndata: {}\n\n")
+		w.(http.Flusher).Flush()
+		if r.URL.Query().Has("hold") {
+			<-release
+		}
+		io.WriteString(w, "event: response.completed\ndata: {}\n\n")
+	})
+	p := newTestProxy(t, DefaultOptions(), u)
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	const body = `{"instructions":"be brief","input":"hi","stream":true}`
+
+	// a stream in flight under the defaults
+	resp, err := http.Post(srv.URL+"/v1/responses?hold", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	if line, _ := br.ReadString('\n'); line != "event: response.created\n" {
+		t.Fatalf("first line %q", line)
+	}
+
+	if w := admin(p, "PATCH", runtimePath, `{"maintenance":true,"instructions_rewrite":false}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH answered %d %s", w.Code, w.Body)
+	}
+	if w := send(p, "POST", "/v1/responses", nil, body); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("new request in maintenance answered %d, want 503", w.Code)
+	}
+
+	// the stream in flight finishes as it started
+	close(release)
+	rest, err := io.ReadAll(br)
+	if err != nil || !strings.Contains(string(rest), "response.completed") {
+		t.Errorf("stream in flight ended with %q, %v", rest, err)
+	}
+	if m := decodeBody(t, u.requests()[0].body); m["instructions"] != nil {
+		t.Errorf("in-flight request forwarded with instructions, want them migrated: %v", m)
+	}
+
+	if w := admin(p, "PATCH", runtimePath, `{"maintenance":false}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH answered %d %s", w.Code, w.Body)
+	}
+	if w := send(p, "POST", "/v1/responses", nil, body); w.Code != http.StatusOK {
+		t.Fatalf("after maintenance answered %d", w.Code)
+	}
+	got := u.requests()
+	if len(got) != 2 {
+		t.Fatalf("upstream got %d requests, want 2", len(got))
+	}
+	if m := decodeBody(t, got[1].body); m["instructions"] != "be brief" {
+		t.Errorf("request after the toggle forwarded as %v, want instructions kept", m)
+	}
+}
+
+func TestAdminPatchInvalid(t *testing.T) {
+	p := newTestProxy(t, DefaultOptions(), newTestUpstream(t, nil))
+	before := p.rewriter.Runtime()
+	for _, body := range []string{`not json`, `{"log_level":"loud"}`, `{"maintenance":"yes"}`} {
+		if w := admin(p, "PATCH", runtimePath, body); w.Code != http.StatusBadRequest {
+			t.Errorf("PATCH %s answered %d, want 400", body, w.Code)
+		}
+	}
+	if after := p.rewriter.Runtime(); after != before {
+		t.Errorf("runtime changed to %+v by refused patches", after)
+	}
+	if w := admin(p, "DELETE", runtimePath, ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE answered %d, want 405", w.Code)
+	}
+	if w := admin(p, "GET", reservePrefix+"nope", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown path answered %d, want 404", w.Code)
+	}
+}
+
+func TestProxyHidesAdminPaths(t *testing.T) {
+	u := newTestUpstream(t, nil)
+	opts := DefaultOptions()
+	opts.FaultInjection = true
+	p := newTestProxy(t, opts, u)
+	hdr := http.Header{"Authorization": {"Bearer adm-1"}}
+	for _, path := range []string{
+		configPath, runtimePath, flushPath, versionPath, notifyTestPath, profilePath,
+		quotaPath, upstreamTLSPath, faultsPath, reservePrefix + "nope", reservePrefix,
+		configPath + "/", runtimePath + "?x=1",
+	} {
+		for _, method := range []string{"GET", "POST", "PATCH", "PUT", "DELETE"} {
+			// with the admin token, which the proxy listener doesn't know
+			if w := send(p, method, path, hdr, `{}`); w.Code != http.StatusNotFound {
+				t.Errorf("%s %s on the proxy answered %d, want 404", method, path, w.Code)
+			}
+		}
+	}
+	if n := len(u.requests()); n != 0 {
+		t.Errorf("upstream got %d admin requests, want none", n)
+	}
+	// the same paths are the admin API's
+	if w := admin(p, "GET", versionPath, ""); w.Code != http.StatusOK {
+		t.Errorf("version on the admin handler answered %d", w.Code)
+	}
+	// stats stays on both
+	if w := send(p, "GET", statsPath, nil, ""); w.Code != http.StatusOK {
+		t.Errorf("stats on the proxy answered %d, want 200", w.Code)
+	}
+	// paths merely like /_reserve/ are forwarded
+	send(p, "GET", "/_reservex/config", nil, "")
+	send(p, "GET", "/v1/_reserve/config", nil, "")
+	if n := len(u.requests()); n != 2 {
+		t.Errorf("upstream got %d requests, want the 2 outside /_reserve/", n)
+	}
+}
@@ -0,0 +1,122 @@
+package reserve
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// A request without credentials is forwarded like any other, filed under
+// its address, and refused by the upstream a round trip later. With
+// Options.RequireAuth the routes it names (or every route, "*") answer
+// such a request with a 401 right away, before reading its body. A
+// request has credentials when it sends one of the headers
+// resolveClient takes an identity from, or its listener vouched for it
+// (WithClientID). Unmatched paths, the stats endpoint and the admin
+// listener are never affected. Rejections are counted by source address,
+// the one the identity fallback would use, for the first authMaxIPs
+// addresses.
+
+const authMaxIPs = 1024
+
+var errUnauthenticated = &httpError{
+	status:       http.StatusUnauthorized,
+	code:         "missing_api_key",
+	msg:          "no API key provided: send it in the Authorization header (Bearer) or x-api-key",
+	authenticate: `Bearer realm="rc-proxy"`,
+}
+
+// credentialHeaders are the headers resolveClient identifies a client by.
+var credentialHeaders = []string{"Authorization", "X-Api-Key", "Api-Key"}
+
+type authGate struct {
+	all    bool
+	routes map[string]bool
+
+	rejected atomic.Int64
+	mu       sync.Mutex
+	byIP     map[string]int64
+	otherIPs int64 // rejections past authMaxIPs addresses
+}
+
+func newAuthGate(opts Options) (*authGate, error) {
+	g := &authGate{routes: map[string]bool{}, byIP: map[string]int64{}}
+	for _, name := range opts.RequireAuth {
+		switch {
+		case name == "":
+		case name == "*":
+			g.all = true
+		case name == ndjsonRoute.name || slices.ContainsFunc(routes, func(rt route) bool { return rt.name == name }):
+			g.routes[name] = true
+		default:
+			return nil, fmt.Errorf("reserve: RequireAuth: no route %q", name)
+		}
+	}
+	if !g.all && len(g.routes) == 0 {
+		return nil, nil
+	}
+	return g, nil
+}
+
+// check returns errUnauthenticated when rt requires credentials and r has
+// none.
+func (g *authGate) check(rr *Rewriter, rt *route, r *http.Request) error {
+	if g == nil || !g.all && !g.routes[rt.name] || hasCredentials(r) {
+		return nil
+	}
+	g.rejected.Add(1)
+	addr, _ := rr.remoteAddr(r)
+	ip := addr
+	if a, ok := parseHop(addr); ok {
+		ip = a.String()
+	}
+	g.mu.Lock()
+	if _, ok := g.byIP[ip]; ok || len(g.byIP) < authMaxIPs {
+		g.byIP[ip]++
+	} else {
+		g.otherIPs++
+	}
+	g.mu.Unlock()
+	logOf(r.Context()).Debug("auth: request without credentials refused", "route", rt.name, "remote", ip)
+	return errUnauthenticated
+}
+
+func hasCredentials(r *http.Request) bool {
+	if _, ok := r.Context().Value(clientIDKey{}).(listenerID); ok {
+		return true
+	}
+	for _, h := range credentialHeaders {
+		if r.Header.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *authGate) stats() any {
+	if g == nil {
+		return map[string]any{"enabled": false}
+	}
+	routes := make([]string, 0, len(g.routes))
+	for name := range g.routes {
+		routes = append(routes, name)
+	}
+	slices.Sort(routes)
+	g.mu.Lock()
+	byIP := make(map[string]int64, len(g.byIP))
+	for ip, n := range g.byIP {
+		byIP[ip] = n
+	}
+	other := g.otherIPs
+	g.mu.Unlock()
+	return map[string]any{
+		"enabled":   true,
+		"all":       g.all,
+		"routes":    routes,
+		"rejected":  g.rejected.Load(),
+		"by_ip":     byIP,
+		"other_ips": other,
+	}
+}
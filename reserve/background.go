@@ -0,0 +1,288 @@
+package reserve
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// Background responses (background: true) are created with a 200 that
+// carries only the response id and a queued status; the client then polls
+// GET /v1/responses/{id} until the status is terminal. The proxy remembers
+// which client created each background response, so the usage of the
+// terminal poll (or cancel) is logged against that client rather than
+// whoever polled. There is a single upstream target, so polls reach the
+// same backend as the creation without any affinity bookkeeping.
+//
+// With Options.BackgroundWait the proxy polls on the client's behalf and
+// holds the creation request until the response is terminal.
+
+const (
+	backgroundOwnersSize = 4096
+	backgroundOwnersTTL  = 24 * time.Hour
+
+	// polling starts fast and backs off, like the SDKs' own helpers
+	backgroundPollMin = 500 * time.Millisecond
+	backgroundPollMax = 5 * time.Second
+)
+
+var kBackground = []byte(`"background"`)
+
+type backgroundTracker struct {
+	owners *clientCache // response id -> creating client
+
+	created    atomic.Int64
+	polls      atomic.Int64
+	attributed atomic.Int64
+	waits      atomic.Int64
+	waitPolls  atomic.Int64
+	waitsTimed atomic.Int64 // gave up at BackgroundWait
+	tokens     atomic.Int64
+}
+
+func newBackgroundTracker() *backgroundTracker {
+	return &backgroundTracker{owners: newClientCache(backgroundOwnersSize, backgroundOwnersTTL)}
+}
+
+func (p *Proxy) backgroundStats() any {
+	b := p.background
+	b.owners.mu.Lock()
+	n := b.owners.ll.Len()
+	b.owners.mu.Unlock()
+	return map[string]any{
+		"wait":               p.opts.BackgroundWait.String(),
+		"created":            b.created.Load(),
+		"tracked":            n,
+		"polls":              b.polls.Load(),
+		"attributed":         b.attributed.Load(),
+		"usage_total_tokens": b.tokens.Load(),
+		"waits":              b.waits.Load(),
+		"wait_polls":         b.waitPolls.Load(),
+		"wait_timeouts":      b.waitsTimed.Load(),
+	}
+}
+
+// isBackground reports whether the request body bs sets background: true.
+func isBackground(bs []byte) bool {
+	if !hasJSONKey(bs, kBackground) {
+		return false
+	}
+	n, err := sonic.Get(bs, "background")
+	if err != nil {
+		return false
+	}
+	b, _ := n.Bool()
+	return b
+}
+
+func isTerminalStatus(s string) bool {
+	switch s {
+	case "completed", "failed", "cancelled", "incomplete":
+		return true
+	}
+	return false
+}
+
+// backgroundCreated handles the response to a background creation: it
+// records the owner of the new response id and, with BackgroundWait,
+// polls until the response is terminal and answers with that instead.
+func (p *Proxy) backgroundCreated(resp *http.Response, st *reqState) {
+	if resp.StatusCode != http.StatusOK || isEventStream(resp) {
+		return
+	}
+	r := &Response{HTTP: resp, Route: st.route.name, State: &st.vars, maxBody: p.opts.MaxBody}
+	bs, err := r.Body()
+	if err != nil {
+		st.log.Warn("background: response not buffered", "error", err)
+		return
+	}
+	id, status := responseStatus(bs)
+	if id == "" {
+		return
+	}
+	b := p.background
+	b.created.Add(1)
+	if isTerminalStatus(status) {
+		p.attributeUsage(st.client, id, bs)
+		return
+	}
+	if st.client != nil {
+		p.ownBackground(id, st.client)
+	}
+	if p.opts.BackgroundWait <= 0 {
+		return
+	}
+
+	b.waits.Add(1)
+	// the wait has its own deadline instead of the request cap
+	if st.hardCap != nil {
+		st.hardCap.Stop()
+	}
+	final, done := p.waitBackground(resp.Request, id)
+	if final == nil {
+		return
+	}
+	r.SetBody(final)
+	if !done {
+		b.waitsTimed.Add(1)
+		resp.Header.Set("X-Reserve-Background", "timeout")
+		return
+	}
+	resp.Header.Set("X-Reserve-Background", "done")
+	p.disownBackground(id)
+	p.attributeUsage(st.client, id, final)
+}
+
+// waitBackground polls the upstream for response id with out's
+// credentials until it is terminal or BackgroundWait runs out. It returns
+// the last body it got and whether that one is terminal.
+func (p *Proxy) waitBackground(out *http.Request, id string) (last []byte, done bool) {
+	ctx, cancel := context.WithTimeout(out.Context(), p.opts.BackgroundWait)
+	defer cancel()
+	u := *out.URL
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + id
+	u.RawPath, u.RawQuery = "", ""
+	h := out.Header.Clone()
+	for _, k := range []string{"Content-Length", "Content-Type", "Content-Encoding", "Accept-Encoding", "Expect"} {
+		h.Del(k)
+	}
+	client := &http.Client{Transport: p.transport}
+
+	delay := backgroundPollMin
+	for {
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return last, false
+		case <-t.C:
+		}
+		delay = min(delay*2, backgroundPollMax)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return last, false
+		}
+		req.Header = h
+		p.background.waitPolls.Add(1)
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				logOf(out.Context()).Warn("background: poll failed", "id", id, "error", err)
+			}
+			continue
+		}
+		var bs []byte
+		if resp.StatusCode == http.StatusOK {
+			limit := p.opts.MaxBody
+			if limit <= 0 {
+				limit = defaultLineCap
+			}
+			bs, err = io.ReadAll(io.LimitReader(resp.Body, limit))
+		} else {
+			err = io.EOF
+			logOf(out.Context()).Warn("background: poll got an error status", "id", id, "status", resp.StatusCode)
+		}
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		last = bs
+		if _, status := responseStatus(bs); isTerminalStatus(status) {
+			return last, true
+		}
+	}
+}
+
+// backgroundPolled handles the response to a poll or cancel of a
+// background response: once it is terminal, its usage is logged against
+// the client that created it. Only ids the proxy tracks are buffered.
+func (p *Proxy) backgroundPolled(resp *http.Response, st *reqState) {
+	id := backgroundItemID(resp.Request.Method, st.path)
+	if id == "" || resp.StatusCode != http.StatusOK || isEventStream(resp) {
+		return
+	}
+	b := p.background
+	owner := b.owners.get(id, time.Now())
+	if owner == nil {
+		return
+	}
+	b.polls.Add(1)
+	r := &Response{HTTP: resp, Route: st.route.name, State: &st.vars, maxBody: p.opts.MaxBody}
+	bs, err := r.Body()
+	if err != nil {
+		return
+	}
+	if _, status := responseStatus(bs); !isTerminalStatus(status) {
+		return
+	}
+	p.disownBackground(id)
+	p.attributeUsage(owner, id, bs)
+}
+
+// ownBackground records client as the creator of response id, in memory
+// and in the attached store.
+func (p *Proxy) ownBackground(id string, client *clientIdentity) {
+	now := time.Now()
+	p.background.owners.add(id, client, now)
+	p.persist(StoreOp{
+		Bucket:  storeBackgroundOwners,
+		Key:     id,
+		Value:   []byte(client.Source + "\x00" + client.CacheKey),
+		Expires: now.Add(backgroundOwnersTTL),
+	})
+}
+
+func (p *Proxy) disownBackground(id string) {
+	p.background.owners.remove(id)
+	p.persist(StoreOp{Bucket: storeBackgroundOwners, Key: id, Delete: true})
+}
+
+// backgroundItemID returns the response id of a retrieve (GET
+// .../responses/{id}) or cancel (POST .../responses/{id}/cancel) path.
+func backgroundItemID(method, path string) string {
+	_, rest, ok := strings.Cut(path, "/v1/responses/")
+	if !ok {
+		return ""
+	}
+	switch id, sub, _ := strings.Cut(rest, "/"); {
+	case method == http.MethodGet && sub == "" && id != "":
+		return id
+	case method == http.MethodPost && sub == "cancel" && id != "":
+		return id
+	}
+	return ""
+}
+
+// responseStatus returns the id and status of a response object.
+func responseStatus(bs []byte) (id, status string) {
+	if n, err := sonic.Get(bs, "id"); err == nil {
+		id, _ = n.String()
+	}
+	if n, err := sonic.Get(bs, "status"); err == nil {
+		status, _ = n.String()
+	}
+	return id, status
+}
+
+// attributeUsage logs the usage of terminal background response id
+// against owner, the client that created it.
+func (p *Proxy) attributeUsage(owner *clientIdentity, id string, bs []byte) {
+	u, err := sonic.Get(bs, "usage")
+	if err != nil {
+		return
+	}
+	p.background.attributed.Add(1)
+	if n, err := u.Get("total_tokens").Int64(); err == nil {
+		p.background.tokens.Add(n)
+	}
+	model, _ := sonic.Get(bs, "model")
+	modelStr, _ := model.String()
+	_, status := responseStatus(bs)
+	p.recordUsage("responses", owner, nil, modelStr, status, &u, "background", id)
+}
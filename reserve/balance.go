@@ -0,0 +1,208 @@
+package reserve
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With Options.Upstreams, requests are balanced over Target and the
+// upstreams listed, each "url" or "url=weight" (Target weighs 1). Options.
+// Balance picks one per request: "weighted-rr" (the default) in turn by
+// weight, "least-latency" the one with the lowest moving average of the
+// wait for its first response byte (see conntrace.go; one never measured
+// goes first), "least-inflight" the one with the fewest requests under
+// way. An upstream failing balanceMaxFails requests in a row (a transport
+// error or a 5xx) is passed over until one gets through again. Whatever
+// the strategy, a share balanceExplore of the requests goes to an upstream
+// picked at random, so one that was slow or failing gets measured again.
+//
+// The pick is made once, before the ReverseProxy: a model fallback or an
+// HTTP/2 retry goes to the same upstream. Keep-warm, warmup, the GET cache
+// key and the public URL rewriting stay on Target.
+
+const (
+	balanceWeightedRR    = "weighted-rr"
+	balanceLeastLatency  = "least-latency"
+	balanceLeastInflight = "least-inflight"
+
+	balanceExplore  = 0.05
+	balanceMaxFails = 3
+)
+
+type balancer struct {
+	strategy string
+	ups      []*upstream
+	explore  float64 // balanceExplore, but for the tests
+
+	mu       sync.Mutex    // the weighted round-robin's
+	next     atomic.Uint64 // where the least-* scans start, spreading ties
+	explored atomic.Int64
+}
+
+// upstream is one of a balancer's upstreams.
+type upstream struct {
+	url     *url.URL
+	weight  int
+	current int // smooth weighted round-robin, under balancer.mu
+
+	ttfb                         ewma
+	inflight, requests, failures atomic.Int64
+	fails                        atomic.Int64 // in a row
+}
+
+func newBalancer(opts Options, target *url.URL) (*balancer, error) {
+	switch opts.Balance {
+	case "", balanceWeightedRR, balanceLeastLatency, balanceLeastInflight:
+	default:
+		return nil, fmt.Errorf("reserve: Balance: want weighted-rr, least-latency or least-inflight, not %q", opts.Balance)
+	}
+	b := &balancer{strategy: opts.Balance, explore: balanceExplore}
+	if b.strategy == "" {
+		b.strategy = balanceWeightedRR
+	}
+	b.ups = append(b.ups, &upstream{url: target, weight: 1})
+	for _, s := range opts.Upstreams {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		raw, weight := s, 1
+		if i := strings.LastIndexByte(s, '='); i >= 0 {
+			if n, err := strconv.Atoi(s[i+1:]); err == nil {
+				if n < 1 {
+					return nil, fmt.Errorf("reserve: upstream %q: weight must be at least 1", s)
+				}
+				raw, weight = s[:i], n
+			}
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("reserve: upstream %q must be an absolute URL", s)
+		}
+		b.ups = append(b.ups, &upstream{url: u, weight: weight})
+	}
+	if len(b.ups) == 1 {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// pick returns the upstream for the next request.
+func (b *balancer) pick() *upstream {
+	if b.explore > 0 && rand.Float64() < b.explore {
+		b.explored.Add(1)
+		return b.ups[rand.IntN(len(b.ups))]
+	}
+	switch b.strategy {
+	case balanceLeastLatency:
+		return b.least(func(u *upstream) int64 { return int64(u.ttfb.load()) })
+	case balanceLeastInflight:
+		return b.least(func(u *upstream) int64 { return u.inflight.Load() })
+	}
+	return b.roundRobin()
+}
+
+// least returns the healthy upstream with the lowest key, or any with none
+// healthy.
+func (b *balancer) least(key func(*upstream) int64) *upstream {
+	n := len(b.ups)
+	start := int(b.next.Add(1) % uint64(n))
+	var best *upstream
+	var bestKey int64
+	for i := range n {
+		u := b.ups[(start+i)%n]
+		if !u.healthy() {
+			continue
+		}
+		if k := key(u); best == nil || k < bestKey {
+			best, bestKey = u, k
+		}
+	}
+	if best == nil {
+		return b.ups[start]
+	}
+	return best
+}
+
+// roundRobin is nginx's smooth weighted round-robin over the healthy
+// upstreams: a weight 3 and a weight 1 go a, a, b, a rather than a, a, a, b.
+func (b *balancer) roundRobin() *upstream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var best *upstream
+	total := 0
+	for _, u := range b.ups {
+		if !u.healthy() {
+			continue
+		}
+		u.current += u.weight
+		total += u.weight
+		if best == nil || u.current > best.current {
+			best = u
+		}
+	}
+	if best == nil {
+		return b.ups[b.next.Add(1)%uint64(len(b.ups))]
+	}
+	best.current -= total
+	return best
+}
+
+func (u *upstream) healthy() bool { return u.fails.Load() < balanceMaxFails }
+
+// result notes the outcome of one of u's requests.
+func (u *upstream) result(err bool) {
+	if !err {
+		u.fails.Store(0)
+		return
+	}
+	u.failures.Add(1)
+	u.fails.Add(1)
+}
+
+// targetOf is the upstream st's request goes to.
+func (p *Proxy) targetOf(st *reqState) *url.URL {
+	if st != nil && st.upstream != nil {
+		return st.upstream.url
+	}
+	return p.target
+}
+
+// ttfbEWMA is the moving average of the wait for the first response byte:
+// that of st's upstream when balancing, else of every upstream request.
+func (p *Proxy) ttfbEWMA(st *reqState) time.Duration {
+	if st != nil && st.upstream != nil {
+		return st.upstream.ttfb.load()
+	}
+	return p.conns.serverEWMA.load()
+}
+
+func (p *Proxy) balanceStats() any {
+	b := p.balance
+	if b == nil {
+		return map[string]any{"enabled": false}
+	}
+	ups := make([]any, 0, len(b.ups))
+	for _, u := range b.ups {
+		ups = append(ups, map[string]any{
+			"target":       u.url.Host,
+			"weight":       u.weight,
+			"requests":     u.requests.Load(),
+			"inflight":     u.inflight.Load(),
+			"failures":     u.failures.Load(),
+			"healthy":      u.healthy(),
+			"ttfb_ewma_ms": float64(u.ttfb.load()) / 1e6,
+		})
+	}
+	return map[string]any{
+		"enabled":   true,
+		"strategy":  b.strategy,
+		"explored":  b.explored.Load(),
+		"upstreams": ups,
+	}
+}
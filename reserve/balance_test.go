@@ -0,0 +1,177 @@
+package reserve
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// balanced builds a Proxy balancing over a and the upstreams in more, by
+// strategy, without exploration unless explore says so.
+func balanced(t *testing.T, strategy string, explore float64, a *testUpstream, more ...string) *Proxy {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.Upstreams = more
+	opts.Balance = strategy
+	p := newTestProxy(t, opts, a)
+	p.balance.explore = explore
+	return p
+}
+
+// slowUpstream answers after its delay.
+func slowUpstream(t *testing.T, delay *atomic.Int64) *testUpstream {
+	return newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(delay.Load()))
+		w.Write([]byte(`{"object":"list"}`))
+	})
+}
+
+func TestBalanceLeastLatency(t *testing.T) {
+	var da, db atomic.Int64
+	db.Store(int64(20 * time.Millisecond))
+	a, b := slowUpstream(t, &da), slowUpstream(t, &db)
+	p := balanced(t, "least-latency", 0, a, b.URL)
+
+	// both measured once, then the faster gets everything
+	for range 20 {
+		if w := send(p, http.MethodGet, "/v1/models", nil, ""); w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+	}
+	if na, nb := len(a.requests()), len(b.requests()); na != 19 || nb != 1 {
+		t.Fatalf("a got %d, b %d; want 19 and 1", na, nb)
+	}
+
+	// a turns slower than b was: its average climbs past b's, and b,
+	// measured anew, keeps the traffic
+	da.Store(int64(40 * time.Millisecond))
+	db.Store(0)
+	for range 20 {
+		send(p, http.MethodGet, "/v1/models", nil, "")
+	}
+	if na := len(a.requests()) - 19; na > 6 {
+		t.Errorf("a got %d of the last 20, want the traffic gone to b", na)
+	}
+	if nb := len(b.requests()) - 1; nb < 14 {
+		t.Errorf("b got %d of the last 20", nb)
+	}
+}
+
+func TestBalanceExploration(t *testing.T) {
+	var da, db atomic.Int64
+	db.Store(int64(5 * time.Millisecond))
+	a, b := slowUpstream(t, &da), slowUpstream(t, &db)
+	p := balanced(t, "least-latency", 1, a, b.URL)
+	for range 40 {
+		send(p, http.MethodGet, "/v1/models", nil, "")
+	}
+	// all of them explore: the slower gets its share anyway
+	if nb := len(b.requests()); nb < 5 {
+		t.Errorf("b got %d of 40 exploring requests", nb)
+	}
+	if got := p.balance.explored.Load(); got != 40 {
+		t.Errorf("explored = %d, want 40", got)
+	}
+}
+
+func TestBalanceWeightedRoundRobin(t *testing.T) {
+	var d atomic.Int64
+	a, b := slowUpstream(t, &d), slowUpstream(t, &d)
+	p := balanced(t, "", 0, a, b.URL+"=3")
+	for range 8 {
+		send(p, http.MethodGet, "/v1/models", nil, "")
+	}
+	if na, nb := len(a.requests()), len(b.requests()); na != 2 || nb != 6 {
+		t.Fatalf("a got %d, b %d; want 2 and 6", na, nb)
+	}
+}
+
+func TestBalanceLeastInflight(t *testing.T) {
+	release := make(chan struct{})
+	held := make(chan struct{}, 1)
+	a := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/held" {
+			held <- struct{}{}
+			<-release
+		}
+		w.Write([]byte(`{}`))
+	})
+	b := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/held" {
+			held <- struct{}{}
+			<-release
+		}
+		w.Write([]byte(`{}`))
+	})
+	p := balanced(t, "least-inflight", 0, a, b.URL)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		send(p, http.MethodGet, "/v1/held", nil, "")
+	}()
+	<-held
+	for range 5 {
+		send(p, http.MethodGet, "/v1/models", nil, "")
+	}
+	close(release)
+	<-done
+
+	// the upstream holding a request gets none of the others
+	busy, idle := a, b
+	if len(b.requests()) == 1 {
+		busy, idle = b, a
+	}
+	if n := len(busy.requests()); n != 1 {
+		t.Errorf("the busy upstream got %d requests, want only the held one", n)
+	}
+	if n := len(idle.requests()); n != 5 {
+		t.Errorf("the idle upstream got %d, want 5", n)
+	}
+}
+
+func TestBalancePassesOverFailingUpstream(t *testing.T) {
+	a := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	b := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	})
+	p := balanced(t, "", 0, a, b.URL)
+	for range 20 {
+		send(p, http.MethodGet, "/v1/models", nil, "")
+	}
+	if na := len(a.requests()); na != balanceMaxFails {
+		t.Errorf("failing upstream got %d requests, want %d", na, balanceMaxFails)
+	}
+
+	bs := p.balanceStats().(map[string]any)
+	ups := bs["upstreams"].([]any)
+	first := ups[0].(map[string]any)
+	if first["healthy"] != false || first["failures"] != int64(balanceMaxFails) {
+		t.Errorf("stats of the failing upstream: %v", first)
+	}
+	if bs["strategy"] != "weighted-rr" {
+		t.Errorf("strategy = %v", bs["strategy"])
+	}
+}
+
+func TestBalanceOptionErrors(t *testing.T) {
+	for _, tc := range []struct {
+		strategy  string
+		upstreams []string
+		want      string
+	}{
+		{"fastest", []string{"http://b.example"}, "Balance"},
+		{"fastest", nil, "Balance"},
+		{"", []string{"b.example"}, "absolute URL"},
+		{"", []string{"http://b.example=0"}, "weight"},
+	} {
+		opts := DefaultOptions()
+		opts.Balance, opts.Upstreams = tc.strategy, tc.upstreams
+		if _, err := NewProxy(opts); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q %q: err = %v, want one about %s", tc.strategy, tc.upstreams, err, tc.want)
+		}
+	}
+}
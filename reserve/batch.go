@@ -0,0 +1,205 @@
+package reserve
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/ast"
+)
+
+// Batch input files are JSONL, one request per line:
+//
+//	{"custom_id":"1","method":"POST","url":"/v1/responses","body":{...}}
+//
+// An upload of one (multipart POST /v1/files) is re-encoded on the fly: the
+// body of every Responses line goes through the same request hooks as a
+// direct request, and everything else is copied byte for byte. Only one
+// line is held in memory at a time.
+
+type batchCounts struct {
+	uploads atomic.Int64
+	lineCounts
+}
+
+func (rr *Rewriter) batchStats() any {
+	s := rr.batch.stats()
+	s["uploads"] = rr.batch.uploads.Load()
+	return s
+}
+
+// rewriteBatchUpload replaces req's multipart body with a stream that
+// re-encodes it, rewriting the JSONL file part when it is batch input. It
+// reports whether it did; bodies that are not multipart are left alone.
+// The parts keep their boundary and headers, but the total length
+// changes, so the body goes out chunked.
+func (rr *Rewriter) rewriteBatchUpload(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mt, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/form-data" || params["boundary"] == "" {
+		return false
+	}
+	rr.batch.uploads.Add(1)
+
+	src := req.Body
+	pr, pw := io.Pipe()
+	go func() {
+		err := rr.copyBatchMultipart(req, src, pw, params["boundary"])
+		src.Close()
+		pw.CloseWithError(err)
+	}()
+	// the transport closes pr when done, which stops the copy
+	req.Body = pr
+	req.ContentLength = -1
+	req.Header.Del("Content-Length")
+	return true
+}
+
+func (rr *Rewriter) copyBatchMultipart(req *http.Request, src io.Reader, dst io.Writer, boundary string) error {
+	mr := multipart.NewReader(src, boundary)
+	mw := multipart.NewWriter(dst)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+	purpose := ""
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			return mw.Close()
+		}
+		if err != nil {
+			return err
+		}
+		h := part.Header
+		h.Del("Content-Length")
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		switch {
+		case part.FormName() == "purpose":
+			// a form value, tiny; kept to decide on the file part
+			var b bytes.Buffer
+			if _, err := io.Copy(&b, io.LimitReader(part, 256)); err != nil {
+				return err
+			}
+			purpose = strings.TrimSpace(b.String())
+			_, err = w.Write(b.Bytes())
+			if err == nil {
+				_, err = io.Copy(w, part)
+			}
+		case part.FormName() == "file" && isBatchFile(purpose, part.FileName()):
+			err = rr.rewriteLines(logOf(req.Context()), part, w, "batch", &rr.batch.lineCounts, func(line []byte, n int) []byte {
+				return rr.rewriteBatchLine(req, line, n)
+			})
+		default:
+			_, err = io.Copy(w, part)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// isBatchFile: purpose=batch, or a .jsonl file ahead of the purpose field
+// (some SDKs send the file part first).
+func isBatchFile(purpose, filename string) bool {
+	if purpose != "" {
+		return purpose == "batch"
+	}
+	return strings.HasSuffix(strings.ToLower(filename), ".jsonl")
+}
+
+// rewriteBatchLine returns line with its body rewritten when it is a
+// Responses request, else line itself.
+func (rr *Rewriter) rewriteBatchLine(req *http.Request, line []byte, n int) []byte {
+	text := bytes.TrimRight(line, "\r\n")
+	if len(bytes.TrimSpace(text)) == 0 {
+		return line
+	}
+	rr.batch.lines.Add(1)
+	root, err := sonic.Get(text)
+	if err == nil {
+		err = root.Check()
+	}
+	if err != nil {
+		rr.batch.failed.Add(1)
+		logOf(req.Context()).Warn("batch line is not JSON, passed through", "line", n, "error", err)
+		return line
+	}
+	// the url is relative to the API root, without any mount prefix
+	if m, _ := root.Get("method").String(); m != http.MethodPost {
+		return line
+	}
+	if u, _ := root.Get("url").String(); u != responsesPath {
+		return line
+	}
+	raw, err := root.Get("body").Raw()
+	if err != nil {
+		rr.batch.failed.Add(1)
+		logOf(req.Context()).Warn("batch line has no body object, passed through", "line", n, "error", err)
+		return line
+	}
+
+	body, ok := rr.rewriteEmbedded(req, raw)
+	if !ok {
+		rr.batch.failed.Add(1)
+		logOf(req.Context()).Warn("batch line body not rewritten, passed through", "line", n)
+		return line
+	}
+	if body == nil {
+		return line
+	}
+	if _, err := root.Set("body", ast.NewRaw(string(body))); err != nil {
+		rr.batch.failed.Add(1)
+		return line
+	}
+	out, err := root.MarshalJSON()
+	if err != nil {
+		rr.batch.failed.Add(1)
+		logOf(req.Context()).Warn("batch line not re-encoded, passed through", "line", n, "error", err)
+		return line
+	}
+	rr.batch.rewritten.Add(1)
+	return append(out, line[len(text):]...)
+}
+
+// rewriteEmbedded runs the responses rewrite over a request body embedded
+// in req (a batch line), as if the same client had sent it directly. It
+// returns the rewritten body, nil when nothing changed; ok is false when
+// the rewrite refused the body.
+func (rr *Rewriter) rewriteEmbedded(req *http.Request, body string) (out []byte, ok bool) {
+	h := req.Header.Clone()
+	h.Del("Content-Encoding")
+	h.Set("Content-Type", "application/json")
+	// not part of the upload's proxy state: the upload's hooks state and
+	// response are its own
+	ctx := context.WithValue(req.Context(), reqStateKey{}, (*reqState)(nil))
+	lr := (&http.Request{
+		Method:        http.MethodPost,
+		URL:           &url.URL{Path: responsesPath},
+		Header:        h,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		RemoteAddr:    req.RemoteAddr,
+	}).WithContext(ctx)
+	rw, err := rr.tweakBodySonic(lr, routeNamed("responses"))
+	if err != nil {
+		return nil, false
+	}
+	defer lr.Body.Close()
+	if !rw.rewritten {
+		return nil, true
+	}
+	out, err = io.ReadAll(lr.Body)
+	return out, err == nil
+}
@@ -0,0 +1,179 @@
+package reserve
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const batchBoundary = "batch-test-boundary"
+
+// batchLine is line i of a test batch file: mostly Responses requests,
+// with a chat completions line, a malformed one and a blank one mixed in.
+func batchLine(i int) string {
+	switch i % 50 {
+	case 7:
+		return fmt.Sprintf(`{"custom_id":"%d","method":"POST","url":"/v1/chat/completions","body":{"messages":[]}}`+"\n", i)
+	case 13:
+		return fmt.Sprintf(`{"custom_id":"%d","method":"POST","url":`+"\n", i)
+	case 29:
+		return "\r\n"
+	}
+	return fmt.Sprintf(`{"custom_id":"%d","method":"POST","url":"/v1/responses","body":{"model":"gpt-5","input":"%s"}}`+"\r\n",
+		i, strings.Repeat("x", 100+i%200))
+}
+
+// batchUpload writes a multipart upload of a batch file of n lines to w,
+// purpose first.
+func batchUpload(w io.Writer, n int) error {
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(batchBoundary)
+	if err := mw.WriteField("purpose", "batch"); err != nil {
+		return err
+	}
+	fw, err := mw.CreateFormFile("file", "input.jsonl")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(fw)
+	for i := range n {
+		if _, err := bw.WriteString(batchLine(i)); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+func TestBatchUploadMultiMB(t *testing.T) {
+	const n = 40000 // about 10MB
+	var body bytes.Buffer
+	if err := batchUpload(&body, n); err != nil {
+		t.Fatal(err)
+	}
+	if body.Len() < 8<<20 {
+		t.Fatalf("upload is only %d bytes", body.Len())
+	}
+
+	rr := NewRewriter(DefaultOptions())
+	req := httptest.NewRequest("POST", "/v1/files", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+batchBoundary)
+	req.Header.Set("Authorization", "Bearer sk-a")
+	res, err := rr.RewriteRequest(req)
+	if err != nil || !res.Rewritten || res.Route != "files_upload" {
+		t.Fatalf("RewriteRequest = %+v, %v", res, err)
+	}
+	if req.ContentLength != -1 {
+		t.Errorf("ContentLength = %d, want the body chunked", req.ContentLength)
+	}
+
+	mr := multipart.NewReader(req.Body, batchBoundary)
+	part, err := mr.NextPart()
+	if err != nil || part.FormName() != "purpose" {
+		t.Fatalf("first part %v, %v", part, err)
+	}
+	if v, _ := io.ReadAll(part); string(v) != "batch" {
+		t.Errorf("purpose = %q", v)
+	}
+	part, err = mr.NextPart()
+	if err != nil || part.FormName() != "file" || part.FileName() != "input.jsonl" {
+		t.Fatalf("second part %v, %v", part, err)
+	}
+	key := `"prompt_cache_key":"` + cacheKey("Bearer sk-a") + `"`
+	br := bufio.NewReader(part)
+	rewritten := 0
+	for i := 0; ; i++ {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			if i != n {
+				t.Errorf("file part has %d lines, want %d", i, n)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := batchLine(i)
+		if !strings.Contains(in, `"/v1/responses"`) {
+			if line != in {
+				t.Fatalf("line %d = %q, want it untouched: %q", i, line, in)
+			}
+			continue
+		}
+		if !strings.Contains(line, key) || !strings.HasSuffix(line, "\r\n") ||
+			!strings.Contains(line, fmt.Sprintf(`"custom_id":"%d"`, i)) {
+			t.Fatalf("line %d = %q, want the key added and the rest kept", i, line)
+		}
+		rewritten++
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("after the file part: %v, want the end", err)
+	}
+	req.Body.Close()
+
+	st := rr.batchStats().(map[string]any)
+	if st["lines_modified"] != int64(rewritten) || st["lines_failed"] != int64(n/50) {
+		t.Errorf("stats %v, want %d rewritten and %d failed", st, rewritten, n/50)
+	}
+}
+
+// TestBatchUploadMemory streams a 32MB upload through the rewrite and
+// checks the heap never holds more than a small part of it.
+func TestBatchUploadMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams 32MB")
+	}
+	const n = 128000
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(batchUpload(pw, n)) }()
+
+	rr := NewRewriter(DefaultOptions())
+	req := httptest.NewRequest("POST", "/v1/files", pr)
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+batchBoundary)
+	if _, err := rr.RewriteRequest(req); err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	base := ms.HeapAlloc
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			if ms.HeapAlloc > peak.Load() {
+				peak.Store(ms.HeapAlloc)
+			}
+		}
+	}()
+	m, err := io.Copy(io.Discard, req.Body)
+	close(done)
+	req.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m < 30<<20 {
+		t.Fatalf("rewritten upload is %d bytes", m)
+	}
+	if grew := int64(peak.Load()) - int64(base); grew > 24<<20 {
+		t.Errorf("heap grew by %dMB streaming a %dMB upload", grew>>20, m>>20)
+	}
+}
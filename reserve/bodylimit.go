@@ -0,0 +1,68 @@
+package reserve
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+)
+
+var (
+	errBodyTooLarge = &httpError{
+		status: http.StatusRequestEntityTooLarge,
+		code:   "request_body_too_large",
+		msg:    "request body exceeds the proxy's size limit",
+	}
+)
+
+// ctxReader stops reading once ctx is done, so a client that disconnects
+// mid-upload (or mid-decompression of a large gzip body) doesn't keep the
+// buffering loop busy.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// readBody reads r into b, enforcing MaxBody on the bytes actually read
+// (the decompressed size for gzip, the real size for chunked bodies). The
+// limit reader stops one byte past the cap so an exactly-max body passes.
+func (rr *Rewriter) readBody(ctx context.Context, b *bytes.Buffer, r io.Reader) error {
+	r = ctxReader{ctx: ctx, r: r}
+	max := rr.opts.MaxBody
+	if max <= 0 {
+		_, err := b.ReadFrom(r)
+		return err
+	}
+	n, err := b.ReadFrom(io.LimitReader(r, max+1))
+	if err != nil {
+		return err
+	}
+	if n > max {
+		rr.bodyTooLarge.Add(1)
+		return errBodyTooLarge
+	}
+	return nil
+}
+
+// dropBuf returns b to its pool unless it holds an oversized body, which
+// is left to the GC instead of pinning that much memory in a pool.
+func dropBuf(b *bytes.Buffer, err error) {
+	if err == errBodyTooLarge {
+		return
+	}
+	putBuf(b)
+}
+
+func (rr *Rewriter) bodyLimitStats() any {
+	return map[string]any{
+		"max_body":  rr.opts.MaxBody,
+		"too_large": rr.bodyTooLarge.Load(),
+	}
+}
@@ -0,0 +1,115 @@
+package reserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func limitedRewriter(max int64) *Rewriter {
+	opts := DefaultOptions()
+	opts.MaxBody = max
+	return NewRewriter(opts)
+}
+
+// gzipBomb is n zero bytes inside a JSON string, gzipped: about 1000:1.
+func gzipBomb(t *testing.T, n int) []byte {
+	t.Helper()
+	var zb bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&zb, gzip.BestCompression)
+	io.WriteString(zw, `{"input":"`)
+	zeros := make([]byte, 1<<20)
+	for i := range zeros {
+		zeros[i] = '0'
+	}
+	for w := 0; w < n; w += len(zeros) {
+		zw.Write(zeros[:min(len(zeros), n-w)])
+	}
+	io.WriteString(zw, `"}`)
+	zw.Close()
+	return zb.Bytes()
+}
+
+func TestMaxBodyGzipBomb(t *testing.T) {
+	rr := limitedRewriter(1 << 20)
+	bomb := gzipBomb(t, 64<<20)
+	if len(bomb) > 1<<20 {
+		t.Fatalf("bomb is %d bytes compressed, want it under the limit", len(bomb))
+	}
+	puts := gzipCounts.puts.Load()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	req := httptest.NewRequest("POST", "/v1/responses", bytes.NewReader(bomb))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	_, err := rr.RewriteRequest(req)
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, errBodyTooLarge) {
+		t.Fatalf("RewriteRequest error = %v, want request_body_too_large", err)
+	}
+	if got := after.TotalAlloc - before.TotalAlloc; got > 16<<20 {
+		t.Errorf("decompressing the bomb allocated %d bytes, want it cut off near the 1MB limit", got)
+	}
+	if gzipCounts.puts.Load() != puts+1 {
+		t.Error("the gzip reader was not returned to its pool")
+	}
+	if rr.bodyTooLarge.Load() != 1 {
+		t.Errorf("too_large = %d, want 1", rr.bodyTooLarge.Load())
+	}
+}
+
+func TestMaxBodyBoundary(t *testing.T) {
+	const max = 100
+	for _, tc := range []struct {
+		name    string
+		size    int
+		chunked bool
+		gzip    bool
+		ok      bool
+	}{
+		{"at limit", max, false, false, true},
+		{"over limit", max + 1, false, false, false},
+		{"chunked at limit", max, true, false, true},
+		{"chunked over limit", max + 1, true, false, false},
+		{"gzip at limit", max, false, true, true},
+		{"gzip over limit", max + 1, false, true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body := `{"input":"` + strings.Repeat("x", tc.size-len(`{"input":""}`)) + `"}`
+			var r io.Reader = strings.NewReader(body)
+			if tc.gzip {
+				var zb bytes.Buffer
+				zw := gzip.NewWriter(&zb)
+				io.WriteString(zw, body)
+				zw.Close()
+				r = &zb
+			}
+			if tc.chunked {
+				r = io.MultiReader(r) // hides the length from httptest
+			}
+			req := httptest.NewRequest("POST", "/v1/responses", r)
+			req.Header.Set("Content-Type", "application/json")
+			if tc.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			if tc.chunked && req.ContentLength != -1 {
+				t.Fatalf("ContentLength = %d, want -1", req.ContentLength)
+			}
+			_, err := limitedRewriter(max).RewriteRequest(req)
+			if tc.ok && err != nil {
+				t.Errorf("a %d byte body was refused: %v", tc.size, err)
+			}
+			if !tc.ok && !errors.Is(err, errBodyTooLarge) {
+				t.Errorf("a %d byte body got %v, want request_body_too_large", tc.size, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package reserve
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errBudgetExhausted = &httpError{
+	status:     http.StatusServiceUnavailable,
+	code:       "body_budget_exhausted",
+	msg:        "proxy is buffering too many request bodies, retry later",
+	retryAfter: 1,
+}
+
+// byteBudget is a byte-counting semaphore bounding the memory held by
+// buffered request bodies. A nil budget admits everything.
+type byteBudget struct {
+	limit int64
+	wait  time.Duration
+
+	mu     sync.Mutex
+	used   int64
+	waitCh chan struct{} // closed on release to wake waiters
+
+	waits    atomic.Int64
+	rejected atomic.Int64
+}
+
+func newByteBudget(limit int64, wait time.Duration) *byteBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &byteBudget{limit: limit, wait: wait}
+}
+
+// budgetLease is the share of the budget held by one request body.
+// The zero value holds nothing, so all methods are safe to call on it.
+type budgetLease struct {
+	b *byteBudget
+	n int64
+}
+
+// acquire reserves min(n, limit) bytes, n <= 0 (unknown length) reserves the
+// expected body size. It waits up to b.wait for other bodies to be released.
+func (b *byteBudget) acquire(ctx context.Context, n int64) (budgetLease, error) {
+	if b == nil {
+		return budgetLease{}, nil
+	}
+	if n <= 0 {
+		n = int64(sizeHist.preGrow())
+	}
+	n = min(n, b.limit)
+
+	var timer *time.Timer
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			if timer != nil {
+				timer.Stop()
+			}
+			return budgetLease{b: b, n: n}, nil
+		}
+		if b.wait <= 0 {
+			b.mu.Unlock()
+			b.rejected.Add(1)
+			return budgetLease{}, errBudgetExhausted
+		}
+		if b.waitCh == nil {
+			b.waitCh = make(chan struct{})
+		}
+		ch := b.waitCh
+		b.mu.Unlock()
+
+		if timer == nil {
+			b.waits.Add(1)
+			timer = time.NewTimer(b.wait)
+		}
+		select {
+		case <-ch:
+		case <-timer.C:
+			b.rejected.Add(1)
+			return budgetLease{}, errBudgetExhausted
+		case <-ctx.Done():
+			timer.Stop()
+			return budgetLease{}, ctx.Err()
+		}
+	}
+}
+
+func (b *byteBudget) add(delta int64) {
+	b.mu.Lock()
+	b.used += delta
+	if delta < 0 && b.waitCh != nil {
+		close(b.waitCh)
+		b.waitCh = nil
+	}
+	b.mu.Unlock()
+}
+
+// resize sets the lease to n bytes once the real (decompressed/rewritten)
+// size is known. Growth is never refused: the memory is already allocated,
+// so the overshoot is accounted and later acquires wait for it instead.
+func (l *budgetLease) resize(n int) {
+	if l.b == nil || int64(n) == l.n {
+		return
+	}
+	l.b.add(int64(n) - l.n)
+	l.n = int64(n)
+}
+
+func (l *budgetLease) release() {
+	if l.b == nil {
+		return
+	}
+	l.b.add(-l.n)
+	*l = budgetLease{}
+}
+
+// detach hands the lease over to a new owner (the pooled body), leaving
+// the original empty so a deferred release is a no-op.
+func (l *budgetLease) detach() budgetLease {
+	d := *l
+	*l = budgetLease{}
+	return d
+}
+
+func (rr *Rewriter) bodyBudgetStats() any {
+	b := rr.budget
+	if b == nil {
+		return map[string]any{"enabled": false}
+	}
+	b.mu.Lock()
+	used := b.used
+	b.mu.Unlock()
+	return map[string]any{
+		"enabled":  true,
+		"limit":    b.limit,
+		"used":     used,
+		"wait":     b.wait.String(),
+		"waits":    b.waits.Load(),
+		"rejected": b.rejected.Load(),
+	}
+}
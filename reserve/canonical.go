@@ -0,0 +1,132 @@
+package reserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bytedance/sonic"
+)
+
+// An upstream gateway caching on exact body prefixes misses whenever two
+// clients order the same keys differently. With Options.CanonicalJSON
+// every rewritten body is re-encoded, after the hooks, with its object
+// keys sorted, numbers in one shortest form and strings escaped alike, so
+// identical logical requests are identical bytes. Canonicalizing twice
+// gives the same bytes. It is the one mode that deliberately drops the
+// client's formatting, and so excludes MinimalDiff. Bodies over
+// CanonicalMaxBytes, or over the JSON limits, are left as they are.
+
+var canonicalAPI = sonic.Config{SortMapKeys: true, UseNumber: true, NoEncoderNewline: true}.Froze()
+
+var errCanonicalMinimalDiff = errors.New("reserve: CanonicalJSON and MinimalDiff are mutually exclusive")
+
+type canonicalCounts struct {
+	encoded   atomic.Int64 // bodies that changed
+	unchanged atomic.Int64 // bodies already canonical
+	oversized atomic.Int64
+	failed    atomic.Int64
+}
+
+func (rr *Rewriter) canonicalStats() any {
+	return map[string]any{
+		"enabled":   rr.opts.CanonicalJSON && !rr.opts.MinimalDiff,
+		"max_bytes": rr.opts.CanonicalMaxBytes,
+		"encoded":   rr.canonical.encoded.Load(),
+		"unchanged": rr.canonical.unchanged.Load(),
+		"oversized": rr.canonical.oversized.Load(),
+		"failed":    rr.canonical.failed.Load(),
+	}
+}
+
+// canonicalize re-encodes r's body canonically; run after the hooks.
+func (r *Request) canonicalize() {
+	rr := r.rw.rr
+	bs := r.Body()
+	if max := rr.opts.CanonicalMaxBytes; max > 0 && int64(len(bs)) > max {
+		rr.canonical.oversized.Add(1)
+		return
+	}
+	if ok, _ := r.walkable(); !ok {
+		return
+	}
+	out, err := canonicalJSON(bs)
+	if err != nil {
+		rr.canonical.failed.Add(1)
+		r.Logger().Debug("canonical json: body left as it is", "route", r.Route, "error", err)
+		return
+	}
+	traceOf(r.HTTP.Context()).log("canonical_json", "bytes", len(bs), "canonical", len(out), "changed", !bytes.Equal(out, bs))
+	if bytes.Equal(out, bs) {
+		rr.canonical.unchanged.Add(1)
+		return
+	}
+	rr.canonical.encoded.Add(1)
+	r.SetBody(out)
+}
+
+// canonicalJSON returns the canonical encoding of the JSON document bs.
+func canonicalJSON(bs []byte) ([]byte, error) {
+	var v any
+	if err := canonicalAPI.Unmarshal(bs, &v); err != nil {
+		return nil, err
+	}
+	v, err := canonicalNumbers(v)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalAPI.Marshal(v)
+}
+
+// canonicalNumbers rewrites the numbers in v in their canonical form.
+func canonicalNumbers(v any) (any, error) {
+	switch x := v.(type) {
+	case map[string]any:
+		for k, e := range x {
+			c, err := canonicalNumbers(e)
+			if err != nil {
+				return nil, err
+			}
+			x[k] = c
+		}
+	case []any:
+		for i, e := range x {
+			c, err := canonicalNumbers(e)
+			if err != nil {
+				return nil, err
+			}
+			x[i] = c
+		}
+	case json.Number:
+		return canonicalNumber(x)
+	}
+	return v, nil
+}
+
+// canonicalNumber is n's shortest form: integers as digits (kept exact
+// however long), anything else the shortest decimal that parses back to
+// the same float64, in exponent form only when very large or small.
+func canonicalNumber(n json.Number) (json.Number, error) {
+	s := string(n)
+	if !strings.ContainsAny(s, ".eE") {
+		if s == "-0" {
+			return "0", nil
+		}
+		return n, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return "", err
+	}
+	if f == 0 {
+		return "0", nil
+	}
+	if a := math.Abs(f); a >= 1e-6 && a < 1e21 {
+		return json.Number(strconv.FormatFloat(f, 'f', -1, 64)), nil
+	}
+	return json.Number(strconv.FormatFloat(f, 'e', -1, 64)), nil
+}
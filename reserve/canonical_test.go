@@ -0,0 +1,129 @@
+package reserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{`{"b":1,"a":2}`, `{"a":2,"b":1}`},
+		{`{ "z" : { "y":[3, 2, {"x":null,"w":true}] }, "a":"" }`, `{"a":"","z":{"y":[3,2,{"w":true,"x":null}]}}`},
+		{`[1.0, 1e2, 1E+2, -0, -0.0, 0.5e-1, 100.000]`, `[1,100,100,0,0,0.05,100]`},
+		{`[12345678901234567890123, 1.5e300, 1e-7]`, `[12345678901234567890123,1.5e+300,1e-07]`},
+		{`{"s":"A\/b"}`, `{"s":"A/b"}`},
+	} {
+		got, err := canonicalJSON([]byte(tc.in))
+		if err != nil {
+			t.Errorf("canonicalJSON(%s): %v", tc.in, err)
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("canonicalJSON(%s) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+// FuzzCanonicalJSON checks that canonicalizing is idempotent and keeps
+// the document's meaning.
+func FuzzCanonicalJSON(f *testing.F) {
+	for _, s := range []string{
+		`{"model":"gpt-5","input":[{"role":"user","content":"hi"}],"temperature":0.70}`,
+		`{"b":{"d":1,"c":[1e3,-0.0,2.5E-10]},"a":"é\n<&>"}`,
+		`[1e21, 1e-6, 9.999999e20, 123456789012345678901234567890]`,
+		`"😀"`, `null`, `{}`,
+	} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		if !json.Valid(bs) {
+			return
+		}
+		once, err := canonicalJSON(bs)
+		if err != nil {
+			return
+		}
+		twice, err := canonicalJSON(once)
+		if err != nil {
+			t.Fatalf("canonicalJSON(%q) failed on its own output %q: %v", bs, once, err)
+		}
+		if !bytes.Equal(once, twice) {
+			t.Fatalf("not idempotent: %q -> %q -> %q", bs, once, twice)
+		}
+		var a, b any
+		if json.Unmarshal(bs, &a) != nil || json.Unmarshal(once, &b) != nil {
+			t.Fatalf("canonical %q of %q is not JSON", once, bs)
+		}
+		if !reflect.DeepEqual(a, b) {
+			t.Fatalf("canonical %q of %q changed its value", once, bs)
+		}
+	})
+}
+
+func TestCanonicalRewrite(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CanonicalJSON = true
+	rr := NewRewriter(opts)
+	// the same request from two clients formatting it differently
+	_, a := rewrite(t, rr, "/v1/responses", nil,
+		[]byte(`{"model":"gpt-5","input":[{"role":"user","content":"hi"}],"temperature":0.70,"instructions":"be brief"}`))
+	_, b := rewrite(t, rr, "/v1/responses", nil,
+		[]byte("{\n  \"instructions\": \"be brief\",\n  \"temperature\": 7e-1,\n  \"input\": [{\"content\": \"hi\", \"role\": \"user\"}],\n  \"model\": \"gpt-5\"\n}"))
+	if !bytes.Equal(a, b) {
+		t.Errorf("identical requests forwarded differently:\n%s\n%s", a, b)
+	}
+	if again, _ := canonicalJSON(a); !bytes.Equal(again, a) {
+		t.Errorf("forwarded body %s is not canonical, canonicalizes to %s", a, again)
+	}
+	_, c := rewrite(t, rr, "/v1/responses", nil, a)
+	if !bytes.Equal(c, a) {
+		t.Errorf("rewriting the forwarded body again gives\n%s\nnot\n%s", c, a)
+	}
+	st := rr.canonicalStats().(map[string]any)
+	if st["encoded"] != int64(2) || st["unchanged"] != int64(1) {
+		t.Errorf("canonical stats = %v", st)
+	}
+}
+
+func TestCanonicalSkipped(t *testing.T) {
+	unsorted := `{"model":"gpt-5","input":"hi","b":1,"a":2}`
+	for _, tc := range []struct {
+		name string
+		set  func(*Options)
+		stat string
+	}{
+		{"over CanonicalMaxBytes", func(o *Options) { o.CanonicalMaxBytes = 16 }, "oversized"},
+		{"with MinimalDiff", func(o *Options) { o.MinimalDiff = true }, ""},
+		{"off", func(o *Options) { o.CanonicalJSON = false }, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.CanonicalJSON = true
+			tc.set(&opts)
+			rr := NewRewriter(opts)
+			_, out := rewrite(t, rr, "/v1/responses", nil, []byte(unsorted))
+			if !strings.Contains(string(out), `"model":"gpt-5","input":"hi","b":1,"a":2`) {
+				t.Errorf("forwarded %s, want the client's key order", out)
+			}
+			if tc.stat != "" {
+				if n := rr.canonicalStats().(map[string]any)[tc.stat]; n != int64(1) {
+					t.Errorf("%s = %v, want 1", tc.stat, n)
+				}
+			}
+		})
+	}
+}
+
+func TestCanonicalMinimalDiffExclusive(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CanonicalJSON, opts.MinimalDiff = true, true
+	if _, err := NewProxy(opts); !errors.Is(err, errCanonicalMinimalDiff) {
+		t.Errorf("NewProxy error = %v, want errCanonicalMinimalDiff", err)
+	}
+}
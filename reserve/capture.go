@@ -0,0 +1,588 @@
+package reserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// With Options.CaptureDir, the exchanges of the clients the Policy's
+// ClientCapture names, by id, are kept whole: the request body as it went
+// upstream, after the rewrite, and the response, an event stream's text
+// deltas put back together. ClientCapture is consent, not a sample: no
+// other client's request is captured, whatever else is configured, and no
+// request header is written, so neither is any credential. Each client has
+// a directory under CaptureDir, named by its id, holding capture.jsonl;
+// past CaptureMaxBytes the file is renamed to capture-<UTC timestamp>.jsonl
+// and a new one started, and with CaptureMaxAge files not written for that
+// long are deleted. With CaptureKey every line is sealed with AES-GCM and
+// written base64-encoded; ReadCaptures opens both kinds. A request served
+// without going upstream itself, an idempotent replay or a duplicate
+// joining an in-flight request, is captured with what it was served and
+// how, in Served. Entries are
+// queued and written by one goroutine, so a request never waits on the
+// disk: a full queue or a failed write drops the entry and counts it.
+
+const (
+	captureQueue      = 1024
+	capturePurgeEvery = time.Hour
+	captureFileName   = "capture.jsonl"
+)
+
+// CaptureEntry is one captured exchange, a line of a capture file.
+type CaptureEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Client    string    `json:"client"`
+	Route     string    `json:"route"`
+	Path      string    `json:"path"`
+	// Request is the body as forwarded; RequestOmitted says why it is
+	// missing (spilled to disk, not JSON)
+	Request        json.RawMessage `json:"request,omitempty"`
+	RequestOmitted string          `json:"request_omitted,omitempty"`
+
+	Status int  `json:"status,omitempty"` // the upstream's, or the one served; 0 for none
+	Stream bool `json:"stream"`
+	// Served is how a response not from this request's own upstream
+	// request came: "replay" of the idempotent request it repeats,
+	// "dedup" of the in-flight request it joined
+	Served     string `json:"served,omitempty"`
+	ResponseID string `json:"response_id,omitempty"`
+	Model      string `json:"model,omitempty"`
+	// OutputText is the text the model answered: the output_text parts of
+	// a response, or the deltas of a stream, even one cut short
+	OutputText string `json:"output_text,omitempty"`
+	// Response is the final response object: the body, or the terminal
+	// event's response of a stream
+	Response  json.RawMessage `json:"response,omitempty"`
+	Truncated bool            `json:"truncated,omitempty"` // over MaxBody, cut
+	Error     string          `json:"error,omitempty"`
+	Duration  float64         `json:"duration_ms"`
+}
+
+type capture struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	maxBody  int64
+	aead     cipher.AEAD // nil without CaptureKey
+	clients  int         // ClientCapture entries, for the stats
+
+	entries   chan *CaptureEntry
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	files     map[string]*captureFile // by client, run's own
+
+	captured, dropped, rotations, purged, failures atomic.Int64
+}
+
+type captureFile struct {
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// pendingCapture is a request's entry while the request runs.
+type pendingCapture struct {
+	e     CaptureEntry
+	start time.Time
+	body  *captureBody // nil until the upstream answered
+}
+
+func newCapture(opts Options) (*capture, error) {
+	if opts.CaptureDir == "" {
+		return nil, nil
+	}
+	aead, err := captureAEAD(opts.CaptureKey)
+	if err != nil {
+		return nil, fmt.Errorf("reserve: CaptureKey: %w", err)
+	}
+	if err := os.MkdirAll(opts.CaptureDir, 0o700); err != nil {
+		return nil, err
+	}
+	c := &capture{
+		dir:      opts.CaptureDir,
+		maxBytes: opts.CaptureMaxBytes,
+		maxAge:   opts.CaptureMaxAge,
+		maxBody:  opts.MaxBody,
+		aead:     aead,
+		entries:  make(chan *CaptureEntry, captureQueue),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		files:    map[string]*captureFile{},
+	}
+	if opts.Policy != nil {
+		for _, ok := range opts.Policy.ClientCapture {
+			if ok {
+				c.clients++
+			}
+		}
+	}
+	go c.run()
+	return c, nil
+}
+
+// captureAEAD is the AES-GCM of the hex-encoded AES key k, nil for none.
+func captureAEAD(k Secret) (cipher.AEAD, error) {
+	if k == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(k)))
+	if err != nil {
+		return nil, errors.New("not hex")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New("want 16, 24 or 32 bytes, hex-encoded")
+	}
+	return cipher.NewGCM(block)
+}
+
+// begin starts the entry of the request of st, when its client agreed to
+// be captured; req's body is the one going upstream.
+func (c *capture) begin(req *http.Request, st *reqState, policy *RequestPolicy) *pendingCapture {
+	if c == nil || policy == nil || st.client == nil || st.route == nil || !st.route.rewrite ||
+		!policy.ClientCapture[st.client.CacheKey] {
+		return nil
+	}
+	pc := &pendingCapture{start: time.Now(), e: CaptureEntry{
+		Time:      time.Now().UTC(),
+		RequestID: st.id,
+		Client:    st.client.CacheKey,
+		Route:     st.route.name,
+		Path:      req.URL.Path,
+	}}
+	switch pb, ok := req.Body.(*pooledBody); {
+	case !ok || pb.b == nil:
+		pc.e.RequestOmitted = "not buffered"
+	case !json.Valid(pb.b.Bytes()):
+		pc.e.RequestOmitted = "not JSON"
+	default:
+		pc.e.Request = bytes.Clone(pb.b.Bytes())
+	}
+	st.trace.log("capture", "client", pc.e.Client)
+	return pc
+}
+
+// watch follows the response to a captured request.
+func (c *capture) watch(resp *http.Response, st *reqState) {
+	pc := st.capture
+	if pc == nil {
+		return
+	}
+	pc.e.Status = resp.StatusCode
+	b := &captureBody{rc: resp.Body, stream: isEventStream(resp), limit: c.maxBody,
+		gzip: resp.Header.Get("Content-Encoding") == "gzip"}
+	b.lines.limit = c.maxBody
+	pc.e.Stream = b.stream
+	pc.body = b
+	resp.Body = b
+}
+
+// served records the response the request of st was served without going
+// upstream itself; see Served. err is why the response broke off, if it
+// did.
+func (c *capture) served(st *reqState, how string, status int, header http.Header, body []byte, err error) {
+	pc := st.capture
+	if pc == nil {
+		return
+	}
+	pc.e.Status, pc.e.Served = status, how
+	b := &captureBody{rc: io.NopCloser(bytes.NewReader(body)), limit: c.maxBody,
+		stream: isEventStream(&http.Response{Header: header}), gzip: header.Get("Content-Encoding") == "gzip"}
+	b.lines.limit = c.maxBody
+	io.Copy(io.Discard, b)
+	if err != nil {
+		b.err = err
+	}
+	pc.e.Stream = b.stream
+	pc.body = b
+}
+
+// end queues the entry of the request of st, once it is over.
+func (c *capture) end(st *reqState) {
+	pc := st.capture
+	e := &pc.e
+	e.Duration = float64(time.Since(pc.start).Microseconds()) / 1000
+	if pc.body == nil {
+		e.Error = "no upstream response"
+	} else {
+		pc.body.fill(e)
+	}
+	select {
+	case c.entries <- e:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// captureBody passes a response through, keeping what the entry needs.
+type captureBody struct {
+	rc     io.ReadCloser
+	stream bool
+	gzip   bool
+	limit  int64 // 0 = none
+
+	raw   bytes.Buffer    // a body's bytes
+	lines sseLines        // a stream's
+	text  strings.Builder // a stream's deltas
+	final []byte          // a stream's terminal response object
+
+	truncated bool
+	err       error
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	if n > 0 {
+		if b.stream {
+			b.lines.write(p[:n], b.event)
+		} else if b.truncated || b.limit > 0 && int64(b.raw.Len()+n) > b.limit {
+			// nothing past the cut, or the entry has a hole
+			b.truncated = true
+		} else {
+			b.raw.Write(p[:n])
+		}
+	}
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *captureBody) Close() error { return b.rc.Close() }
+
+func (b *captureBody) event(line []byte) {
+	d, ok := bytes.CutPrefix(line, []byte("data:"))
+	if !ok {
+		return
+	}
+	var ev respEvent
+	if sonic.Unmarshal(d, &ev) != nil {
+		return
+	}
+	switch ev.Type {
+	case "response.output_text.delta":
+		if b.truncated || b.limit > 0 && int64(b.text.Len()+len(ev.Delta)) > b.limit {
+			b.truncated = true
+			return
+		}
+		b.text.WriteString(ev.Delta)
+	case "response.completed", "response.incomplete", "response.failed":
+		if r, err := sonic.Get(d, "response"); err == nil {
+			raw, _ := r.Raw()
+			b.final = []byte(raw)
+		}
+	case "error":
+		b.err = fmt.Errorf("error event: %s %s", ev.Code, ev.Message)
+	}
+}
+
+// fill completes e with what passed.
+func (b *captureBody) fill(e *CaptureEntry) {
+	e.Truncated = b.truncated
+	if b.err != nil {
+		e.Error = b.err.Error()
+	}
+	obj := b.final
+	if b.stream {
+		e.OutputText = b.text.String()
+	} else {
+		obj = b.raw.Bytes()
+		if b.gzip && !b.truncated {
+			if zr, err := gzip.NewReader(bytes.NewReader(obj)); err == nil {
+				obj, _ = io.ReadAll(zr)
+			}
+		}
+	}
+	if len(obj) == 0 || !json.Valid(obj) {
+		return
+	}
+	e.Response = obj
+	var ro respObject
+	if sonic.Unmarshal(obj, &ro) != nil {
+		return
+	}
+	e.ResponseID, e.Model = ro.ID, ro.Model
+	if !b.stream {
+		e.OutputText = outputText(&ro)
+	}
+}
+
+// outputText is the text of the output_text parts of ro's messages.
+func outputText(ro *respObject) string {
+	var b strings.Builder
+	for _, item := range ro.Output {
+		if item.Type != "message" {
+			continue
+		}
+		for _, c := range item.Content {
+			if c.Type == "output_text" {
+				b.WriteString(c.Text)
+			}
+		}
+	}
+	return b.String()
+}
+
+func (c *capture) run() {
+	defer close(c.done)
+	var purge <-chan time.Time
+	if c.maxAge > 0 {
+		c.purge(time.Now())
+		t := time.NewTicker(min(capturePurgeEvery, c.maxAge))
+		defer t.Stop()
+		purge = t.C
+	}
+	for {
+		select {
+		case e := <-c.entries:
+			c.write(e)
+		case now := <-purge:
+			c.purge(now)
+		case <-c.stop:
+			c.drain()
+			for _, cf := range c.files {
+				cf.f.Close()
+			}
+			return
+		}
+	}
+}
+
+// drain writes the queued entries without waiting for more.
+func (c *capture) drain() {
+	for {
+		select {
+		case e := <-c.entries:
+			c.write(e)
+		default:
+			return
+		}
+	}
+}
+
+func (c *capture) write(e *CaptureEntry) {
+	line, err := sonicAPI.Marshal(e)
+	if err == nil && c.aead != nil {
+		line, err = c.seal(line)
+	}
+	if err != nil {
+		c.failures.Add(1)
+		slog.Warn("capture: entry not encoded", "request_id", e.RequestID, "error", err)
+		return
+	}
+	line = append(line, '\n')
+	cf, err := c.file(e.Client, e.Time, len(line))
+	if err == nil {
+		var n int
+		n, err = cf.f.Write(line)
+		cf.size += int64(n)
+	}
+	if err != nil {
+		c.failures.Add(1)
+		slog.Warn("capture: write failed, entry dropped", "client", e.Client, "request_id", e.RequestID, "error", err)
+		if cf := c.files[e.Client]; cf != nil {
+			// reopened for the next entry
+			cf.f.Close()
+			delete(c.files, e.Client)
+		}
+		return
+	}
+	c.captured.Add(1)
+}
+
+// seal is line encrypted, base64-encoded: nonce and sealed line.
+func (c *capture) seal(line []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(line)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := c.aead.Seal(nonce, nonce, line, nil)
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(out, sealed)
+	return out, nil
+}
+
+// file is the open capture file of client for a line of n bytes at t,
+// rotated first when the line would take it past maxBytes.
+func (c *capture) file(client string, t time.Time, n int) (*captureFile, error) {
+	cf := c.files[client]
+	if cf != nil && c.maxBytes > 0 && cf.size > 0 && cf.size+int64(n) > c.maxBytes {
+		c.rotate(client, cf)
+		cf = nil
+	}
+	if cf != nil {
+		return cf, nil
+	}
+	dir := filepath.Join(c.dir, captureDirName(client))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, captureFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	cf = &captureFile{f: f, size: info.Size(), opened: t}
+	if cf.size > 0 {
+		// an earlier run's file
+		cf.opened = info.ModTime()
+	}
+	c.files[client] = cf
+	if cf.size > 0 && c.maxBytes > 0 && cf.size+int64(n) > c.maxBytes {
+		c.rotate(client, cf)
+		return c.file(client, t, n)
+	}
+	return cf, nil
+}
+
+// rotate renames the capture file of client aside.
+func (c *capture) rotate(client string, cf *captureFile) {
+	cf.f.Close()
+	delete(c.files, client)
+	cur := cf.f.Name()
+	base := strings.TrimSuffix(cur, ".jsonl") + "-" + cf.opened.UTC().Format("20060102T150405")
+	name := base + ".jsonl"
+	for i := 1; exists(name); i++ {
+		name = base + "-" + strconv.Itoa(i) + ".jsonl"
+	}
+	if err := os.Rename(cur, name); err != nil {
+		c.failures.Add(1)
+		slog.Warn("capture: rotation failed, appending on", "path", cur, "error", err)
+		return
+	}
+	c.rotations.Add(1)
+}
+
+// purge deletes the capture files not written since maxAge before now.
+func (c *capture) purge(now time.Time) {
+	files, _ := filepath.Glob(filepath.Join(c.dir, "*", "capture*.jsonl"))
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil || now.Sub(info.ModTime()) < c.maxAge {
+			continue
+		}
+		for client, cf := range c.files {
+			if cf.f.Name() == name {
+				cf.f.Close()
+				delete(c.files, client)
+			}
+		}
+		if err := os.Remove(name); err != nil {
+			c.failures.Add(1)
+			slog.Warn("capture: purge failed", "path", name, "error", err)
+			continue
+		}
+		c.purged.Add(1)
+	}
+}
+
+// captureDirName is client as a directory name; ids are hex, but nothing
+// in one may reach outside CaptureDir.
+func captureDirName(client string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, client)
+}
+
+func (p *Proxy) captureStats() any {
+	c := p.capture
+	if c == nil {
+		return map[string]any{"enabled": false}
+	}
+	return map[string]any{
+		"enabled":   true,
+		"dir":       c.dir,
+		"clients":   c.clients,
+		"encrypted": c.aead != nil,
+		"max_bytes": c.maxBytes,
+		"max_age":   c.maxAge.String(),
+		"queued":    len(c.entries),
+		"captured":  c.captured.Load(),
+		"dropped":   c.dropped.Load(),
+		"rotations": c.rotations.Load(),
+		"purged":    c.purged.Load(),
+		"errors":    c.failures.Load(),
+	}
+}
+
+// CloseCapture writes the queued capture entries and closes the capture
+// files. Without Options.CaptureDir it does nothing.
+func (p *Proxy) CloseCapture() {
+	c := p.capture
+	if c == nil {
+		return
+	}
+	c.closeOnce.Do(func() { close(c.stop) })
+	<-c.done
+}
+
+// ReadCaptures reads the entries of the capture file at path; key is the
+// CaptureKey of sealed lines, "" when there are none.
+func ReadCaptures(path string, key Secret) ([]CaptureEntry, error) {
+	aead, err := captureAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("capture key: %w", err)
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []CaptureEntry
+	for n, line := range bytes.Split(bs, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '{' {
+			if line, err = openCaptureLine(aead, line); err != nil {
+				return nil, &os.PathError{Op: "line " + strconv.Itoa(n+1), Path: path, Err: err}
+			}
+		}
+		var e CaptureEntry
+		if err := sonicAPI.Unmarshal(line, &e); err != nil {
+			return nil, &os.PathError{Op: "parse line " + strconv.Itoa(n+1), Path: path, Err: err}
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func openCaptureLine(aead cipher.AEAD, line []byte) ([]byte, error) {
+	if aead == nil {
+		return nil, errors.New("sealed, and no key")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("not a sealed line")
+	}
+	ns := aead.NonceSize()
+	return aead.Open(nil, sealed[:ns], sealed[ns:], nil)
+}
@@ -0,0 +1,184 @@
+package reserve
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureOpts captures the exchanges of sk-a in a new directory.
+func captureOpts(t *testing.T) Options {
+	opts := DefaultOptions()
+	opts.CaptureDir = t.TempDir()
+	opts.Policy = &RequestPolicy{ClientCapture: map[string]bool{cacheKey("Bearer sk-a"): true}}
+	return opts
+}
+
+// captured closes p's capture and reads the entries of client.
+func captured(t *testing.T, p *Proxy, client string) []CaptureEntry {
+	t.Helper()
+	p.CloseCapture()
+	path := filepath.Join(p.opts.CaptureDir, captureDirName(client), captureFileName)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	es, err := ReadCaptures(path, p.opts.CaptureKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return es
+}
+
+func TestCaptureBodyTruncated(t *testing.T) {
+	// a chunk over the limit is cut; a smaller one after it is not kept
+	b := &captureBody{rc: io.NopCloser(chunkReader("abcd", "0123456789", "ef")), limit: 10}
+	io.Copy(io.Discard, b)
+	if b.raw.String() != "abcd" || !b.truncated {
+		t.Errorf("kept %q, truncated %v, want abcd cut", b.raw.String(), b.truncated)
+	}
+
+	ev := func(d string) string {
+		return "data: {\"type\":\"response.output_text.delta\",\"delta\":\"" + d + "\"}\n\n"
+	}
+	// lines at the default cap, as the limit is of the text
+	b = &captureBody{rc: io.NopCloser(chunkReader(ev("abcd"), ev("0123456789"), ev("ef"))), stream: true, limit: 10}
+	io.Copy(io.Discard, b)
+	if b.text.String() != "abcd" || !b.truncated {
+		t.Errorf("kept %q, truncated %v, want abcd cut", b.text.String(), b.truncated)
+	}
+
+	b = &captureBody{rc: io.NopCloser(chunkReader("abcd", "012345")), limit: 10}
+	io.Copy(io.Discard, b)
+	if b.raw.String() != "abcd012345" || b.truncated {
+		t.Errorf("kept %q, truncated %v, want all 10 bytes", b.raw.String(), b.truncated)
+	}
+}
+
+// chunkReader reads as each of chunks in turn, one per Read.
+func chunkReader(chunks ...string) io.Reader {
+	rs := make([]io.Reader, len(chunks))
+	for i, c := range chunks {
+		rs[i] = strings.NewReader(c)
+	}
+	return io.MultiReader(rs...)
+}
+
+func TestCaptureConsent(t *testing.T) {
+	for _, key := range []Secret{"", "000102030405060708090a0b0c0d0e0f"} {
+		t.Run("key="+string(key), func(t *testing.T) {
+			u := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, `{"id":"resp_1","model":"gpt-5","output":[{"type":"message","content":[{"type":"output_text","text":"hello"}]}]}`)
+			})
+			opts := captureOpts(t)
+			opts.CaptureKey = key
+			p := newTestProxy(t, opts, u)
+			send(p, "POST", "/v1/responses", bearer("sk-a"), `{"model":"gpt-5","input":"hi"}`)
+			send(p, "POST", "/v1/responses", bearer("sk-b"), `{"model":"gpt-5","input":"hi"}`)
+			send(p, "GET", "/v1/models", bearer("sk-a"), "")
+
+			es := captured(t, p, cacheKey("Bearer sk-a"))
+			if len(es) != 1 {
+				t.Fatalf("captured %d entries of sk-a, want the 1 rewritten request", len(es))
+			}
+			e := es[0]
+			if e.Status != 200 || e.ResponseID != "resp_1" || e.Model != "gpt-5" || e.OutputText != "hello" || e.Served != "" ||
+				decodeBody(t, e.Request)["prompt_cache_key"] != cacheKey("Bearer sk-a") {
+				t.Errorf("entry %+v", e)
+			}
+			if es := captured(t, p, cacheKey("Bearer sk-b")); len(es) != 0 {
+				t.Errorf("captured %d entries of sk-b, which did not consent", len(es))
+			}
+			bs, _ := os.ReadFile(filepath.Join(opts.CaptureDir, captureDirName(cacheKey("Bearer sk-a")), captureFileName))
+			if bytes.Contains(bs, []byte("sk-a")) {
+				t.Error("capture file holds the credential")
+			}
+			if sealed := !bytes.Contains(bs, []byte("resp_1")); sealed != (key != "") {
+				t.Errorf("capture file sealed = %v with key %q", sealed, key)
+			}
+		})
+	}
+}
+
+func TestCaptureStream(t *testing.T) {
+	u := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, d := range []string{"hel", "lo"} {
+			io.WriteString(w, "event: response.output_text.delta\ndata: {\"type\":\"response.output_text.delta\",\"delta\":\""+d+"\"}\n\n")
+		}
+		io.WriteString(w, "event: response.completed\ndata: {\"type\":\"response.completed\",\"response\":{\"id\":\"resp_2\",\"model\":\"gpt-5\"}}\n\n")
+	})
+	p := newTestProxy(t, captureOpts(t), u)
+	send(p, "POST", "/v1/responses", bearer("sk-a"), `{"model":"gpt-5","input":"hi","stream":true}`)
+	es := captured(t, p, cacheKey("Bearer sk-a"))
+	if len(es) != 1 {
+		t.Fatalf("captured %d entries", len(es))
+	}
+	if e := es[0]; !e.Stream || e.OutputText != "hello" || e.ResponseID != "resp_2" || e.Truncated {
+		t.Errorf("entry %+v", e)
+	}
+}
+
+func TestCaptureServed(t *testing.T) {
+	t.Run("replay", func(t *testing.T) {
+		u := newTestUpstream(t, nil)
+		opts := captureOpts(t)
+		opts.IdempotencyTTL = time.Minute
+		p := newTestProxy(t, opts, u)
+		hdr := bearer("sk-a")
+		hdr.Set(idempotencyHeader, "k1")
+		for range 2 {
+			if w := send(p, "POST", "/v1/responses", hdr, dedupBody); w.Code != http.StatusOK {
+				t.Fatalf("answered %d %s", w.Code, w.Body)
+			}
+		}
+		if n := len(u.requests()); n != 1 {
+			t.Fatalf("upstream got %d requests, want 1 and a replay", n)
+		}
+		es := captured(t, p, cacheKey("Bearer sk-a"))
+		if len(es) != 2 {
+			t.Fatalf("captured %d entries, want 2", len(es))
+		}
+		if e := es[1]; e.Served != "replay" || e.Status != 200 || e.ResponseID != "resp_1" || e.Error != "" {
+			t.Errorf("replay entry %+v", e)
+		}
+		if es[0].Served != "" {
+			t.Errorf("first entry served %q, want from the upstream", es[0].Served)
+		}
+	})
+
+	t.Run("dedup", func(t *testing.T) {
+		u := newHeldUpstream(t)
+		opts := captureOpts(t)
+		opts.Dedup, opts.DedupWait = true, time.Minute
+		p := newTestProxy(t, opts, u.testUpstream)
+		leader := dedupSend(p, dedupBody)
+		before(t, u.started, "the leader upstream")
+		dup := dedupSend(p, dedupBody)
+		waitFor(t, "the duplicate to join", func() bool { return dedupStat(p, "joined") == int64(1) })
+		close(u.release)
+		before(t, leader.done, "the leader")
+		before(t, dup.done, "the duplicate")
+
+		es := captured(t, p, cacheKey("Bearer sk-a"))
+		if len(es) != 2 {
+			t.Fatalf("captured %d entries, want 2", len(es))
+		}
+		served := map[string]CaptureEntry{}
+		for _, e := range es {
+			served[e.Served] = e
+		}
+		for _, how := range []string{"", "dedup"} {
+			if e, ok := served[how]; !ok || e.Status != 200 || e.ResponseID != "resp_1" || e.Error != "" {
+				t.Errorf("entry served %q: %+v", how, e)
+			}
+		}
+	})
+}
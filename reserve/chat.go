@@ -0,0 +1,721 @@
+package reserve
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bytedance/sonic"
+)
+
+// The chat_completions route accepts POST /v1/chat/completions and forwards
+// it as a Responses API request, for clients that only speak the older
+// API. The request is translated before the request hooks run, so the
+// usual rewrite applies to it: leading system messages become top-level
+// instructions and take the instructions migration like any client's. The
+// Proxy translates the response back, a chat.completion object or a
+// stream of chat.completion.chunk events.
+
+const (
+	chatPath      = "/v1/chat/completions"
+	responsesPath = "/v1/responses"
+)
+
+var (
+	errChatBody = &httpError{
+		status: http.StatusBadRequest,
+		code:   "invalid_request_error",
+		msg:    "chat completions request body is not a JSON object",
+	}
+	errChatMessages = &httpError{
+		status: http.StatusBadRequest,
+		code:   "invalid_request_error",
+		msg:    "chat completions request needs a non-empty messages array",
+	}
+)
+
+// chatInfo is what the response translation needs to know about the
+// request, kept in the request's State.
+type chatInfo struct {
+	stream       bool
+	includeUsage bool
+}
+
+var chatKey = NewKey[*chatInfo]("chat_completions")
+
+// chatCopied are chat.completions parameters the Responses API takes
+// under the same name and meaning.
+var chatCopied = map[string]bool{
+	"model": true, "stream": true, "temperature": true, "top_p": true,
+	"parallel_tool_calls": true, "metadata": true, "user": true,
+	"service_tier": true, "prompt_cache_key": true, "safety_identifier": true,
+}
+
+// chatTranslation accumulates a translated request and the names of the
+// parameters it could not translate.
+type chatTranslation struct {
+	out         map[string]any
+	input       []any
+	unsupported []string
+}
+
+func (t *chatTranslation) reject(name string) { t.unsupported = append(t.unsupported, name) }
+
+// chatToResponses translates a chat.completions body into a Responses API
+// body. Parameters without an equivalent fail the request with a 400
+// listing all of them.
+func chatToResponses(bs []byte) ([]byte, *chatInfo, error) {
+	var in map[string]any
+	if err := sonic.Unmarshal(bs, &in); err != nil || in == nil {
+		return nil, nil, errChatBody
+	}
+	if in["messages"] == nil {
+		return nil, nil, errChatMessages
+	}
+	t := &chatTranslation{out: map[string]any{}}
+	info := &chatInfo{}
+
+	keys := make([]string, 0, len(in))
+	for k := range in {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // stable error messages
+	for _, k := range keys {
+		v := in[k]
+		if v == nil {
+			continue
+		}
+		switch {
+		case chatCopied[k]:
+			t.out[k] = v
+		case k == "messages":
+			msgs, _ := v.([]any)
+			if len(msgs) == 0 {
+				return nil, nil, errChatMessages
+			}
+			t.messages(msgs)
+		case k == "max_tokens" || k == "max_completion_tokens":
+			t.out["max_output_tokens"] = v
+		case k == "reasoning_effort":
+			t.out["reasoning"] = map[string]any{"effort": v}
+		case k == "store":
+			t.out["store"] = v
+		case k == "n":
+			if n, _ := v.(float64); n != 1 {
+				t.reject("n")
+			}
+		case k == "stream_options":
+			o, _ := v.(map[string]any)
+			info.includeUsage, _ = o["include_usage"].(bool)
+		case k == "tools":
+			t.tools(v)
+		case k == "tool_choice":
+			t.toolChoice(v)
+		case k == "response_format":
+			t.responseFormat(v)
+		default:
+			t.reject(k)
+		}
+	}
+	if len(t.unsupported) > 0 {
+		return nil, nil, &httpError{
+			status: http.StatusBadRequest,
+			code:   "unsupported_parameter",
+			msg:    "not translatable to the Responses API: " + strings.Join(t.unsupported, ", "),
+		}
+	}
+	t.out["input"] = t.input
+	// chat completions are not stored unless asked; Responses default to it
+	if _, ok := t.out["store"]; !ok {
+		t.out["store"] = false
+	}
+	info.stream, _ = t.out["stream"].(bool)
+
+	out, err := sonicAPI.Marshal(t.out)
+	if err != nil {
+		return nil, nil, errChatBody
+	}
+	return out, info, nil
+}
+
+// messages maps the conversation onto input items. Leading system and
+// developer messages become the top-level instructions.
+func (t *chatTranslation) messages(msgs []any) {
+	var instructions []string
+	leading := true
+	for i, m := range msgs {
+		msg, _ := m.(map[string]any)
+		role, _ := msg["role"].(string)
+		at := "messages[" + strconv.Itoa(i) + "]"
+		if role != "system" && role != "developer" {
+			leading = false
+		}
+		switch role {
+		case "system", "developer":
+			text, ok := t.textContent(msg["content"], at)
+			if !ok {
+				continue
+			}
+			if leading {
+				instructions = append(instructions, text)
+			} else {
+				t.input = append(t.input, map[string]any{"role": "developer", "content": text})
+			}
+		case "user":
+			if c := t.userContent(msg["content"], at); c != nil {
+				t.input = append(t.input, map[string]any{"role": "user", "content": c})
+			}
+		case "assistant":
+			if msg["content"] != nil {
+				if text, ok := t.textContent(msg["content"], at); ok && text != "" {
+					t.input = append(t.input, map[string]any{"role": "assistant", "content": text})
+				}
+			}
+			calls, _ := msg["tool_calls"].([]any)
+			for j, c := range calls {
+				call, _ := c.(map[string]any)
+				fn, _ := call["function"].(map[string]any)
+				if typ, _ := call["type"].(string); typ != "function" || fn == nil {
+					t.reject(at + ".tool_calls[" + strconv.Itoa(j) + "]")
+					continue
+				}
+				t.input = append(t.input, map[string]any{
+					"type": "function_call", "call_id": call["id"],
+					"name": fn["name"], "arguments": fn["arguments"],
+				})
+			}
+			if msg["function_call"] != nil {
+				t.reject(at + ".function_call")
+			}
+		case "tool":
+			text, ok := t.textContent(msg["content"], at)
+			if !ok {
+				continue
+			}
+			t.input = append(t.input, map[string]any{
+				"type": "function_call_output", "call_id": msg["tool_call_id"], "output": text,
+			})
+		default:
+			t.reject(at + ".role=" + role)
+		}
+	}
+	if len(instructions) > 0 {
+		t.out["instructions"] = strings.Join(instructions, "\n\n")
+	}
+}
+
+// textContent flattens string or text-part content.
+func (t *chatTranslation) textContent(c any, at string) (string, bool) {
+	switch c := c.(type) {
+	case string:
+		return c, true
+	case []any:
+		var b strings.Builder
+		for j, p := range c {
+			part, _ := p.(map[string]any)
+			switch part["type"] {
+			case "text":
+				s, _ := part["text"].(string)
+				b.WriteString(s)
+			case "refusal":
+				s, _ := part["refusal"].(string)
+				b.WriteString(s)
+			default:
+				t.reject(at + ".content[" + strconv.Itoa(j) + "].type=" + partType(part))
+				return "", false
+			}
+		}
+		return b.String(), true
+	}
+	t.reject(at + ".content")
+	return "", false
+}
+
+// userContent maps user content parts onto input content parts.
+func (t *chatTranslation) userContent(c any, at string) any {
+	parts, ok := c.([]any)
+	if !ok {
+		if s, ok := c.(string); ok {
+			return s
+		}
+		t.reject(at + ".content")
+		return nil
+	}
+	out := make([]any, 0, len(parts))
+	for j, p := range parts {
+		part, _ := p.(map[string]any)
+		switch part["type"] {
+		case "text":
+			out = append(out, map[string]any{"type": "input_text", "text": part["text"]})
+		case "image_url":
+			img, _ := part["image_url"].(map[string]any)
+			item := map[string]any{"type": "input_image", "image_url": img["url"], "detail": "auto"}
+			if d, ok := img["detail"].(string); ok {
+				item["detail"] = d
+			}
+			out = append(out, item)
+		case "file":
+			f, _ := part["file"].(map[string]any)
+			item := map[string]any{"type": "input_file"}
+			for _, k := range []string{"file_id", "file_data", "filename"} {
+				if v, ok := f[k]; ok {
+					item[k] = v
+				}
+			}
+			out = append(out, item)
+		default:
+			t.reject(at + ".content[" + strconv.Itoa(j) + "].type=" + partType(part))
+		}
+	}
+	return out
+}
+
+func partType(part map[string]any) string {
+	s, _ := part["type"].(string)
+	return s
+}
+
+func (t *chatTranslation) tools(v any) {
+	ts, _ := v.([]any)
+	out := make([]any, 0, len(ts))
+	for i, x := range ts {
+		tool, _ := x.(map[string]any)
+		fn, _ := tool["function"].(map[string]any)
+		if typ, _ := tool["type"].(string); typ != "function" || fn == nil {
+			t.reject("tools[" + strconv.Itoa(i) + "].type=" + partType(tool))
+			continue
+		}
+		item := map[string]any{"type": "function", "name": fn["name"]}
+		for _, k := range []string{"description", "parameters", "strict"} {
+			if v, ok := fn[k]; ok {
+				item[k] = v
+			}
+		}
+		out = append(out, item)
+	}
+	t.out["tools"] = out
+}
+
+func (t *chatTranslation) toolChoice(v any) {
+	switch c := v.(type) {
+	case string:
+		t.out["tool_choice"] = c
+		return
+	case map[string]any:
+		fn, _ := c["function"].(map[string]any)
+		if c["type"] == "function" && fn != nil {
+			t.out["tool_choice"] = map[string]any{"type": "function", "name": fn["name"]}
+			return
+		}
+	}
+	t.reject("tool_choice")
+}
+
+func (t *chatTranslation) responseFormat(v any) {
+	rf, _ := v.(map[string]any)
+	switch rf["type"] {
+	case "text", "json_object":
+		t.out["text"] = map[string]any{"format": map[string]any{"type": rf["type"]}}
+	case "json_schema":
+		js, _ := rf["json_schema"].(map[string]any)
+		format := map[string]any{"type": "json_schema"}
+		for _, k := range []string{"name", "description", "schema", "strict"} {
+			if v, ok := js[k]; ok {
+				format[k] = v
+			}
+		}
+		t.out["text"] = map[string]any{"format": format}
+	default:
+		t.reject("response_format")
+	}
+}
+
+// translateChat replaces the buffered chat.completions body with its
+// Responses translation and points the request at the responses path.
+func (rw *bodyRewrite) translateChat() error {
+	out, info, err := chatToResponses(rw.orig.Bytes())
+	if err != nil {
+		return err
+	}
+	b := getBuf(len(out))
+	b.Write(out)
+	putBuf(rw.orig)
+	rw.orig = b
+
+	u := rw.req.URL
+	u.Path = strings.TrimSuffix(u.Path, chatPath) + responsesPath
+	u.RawPath = ""
+	// the stream translation reads the upstream's events; let the transport
+	// negotiate (and undo) compression instead of passing the client's on
+	rw.req.Header.Del("Accept-Encoding")
+	if st := stateOf(rw.req.Context()); st != nil {
+		chatKey.Set(&st.vars, info)
+	}
+	return nil
+}
+
+// Responses API objects, as far as the translation reads them.
+type respObject struct {
+	ID                string           `json:"id"`
+	CreatedAt         int64            `json:"created_at"`
+	Model             string           `json:"model"`
+	Status            string           `json:"status"`
+	Output            []respOutputItem `json:"output"`
+	Usage             *respUsage       `json:"usage"`
+	IncompleteDetails *struct {
+		Reason string `json:"reason"`
+	} `json:"incomplete_details"`
+	Error *respError `json:"error"`
+}
+
+type respError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type respOutputItem struct {
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	Content []struct {
+		Type    string `json:"type"`
+		Text    string `json:"text"`
+		Refusal string `json:"refusal"`
+	} `json:"content"`
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type respUsage struct {
+	InputTokens        int64 `json:"input_tokens"`
+	OutputTokens       int64 `json:"output_tokens"`
+	TotalTokens        int64 `json:"total_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int64 `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+	OutputTokensDetails struct {
+		ReasoningTokens int64 `json:"reasoning_tokens"`
+	} `json:"output_tokens_details"`
+}
+
+type respEvent struct {
+	Type        string          `json:"type"`
+	Delta       string          `json:"delta"`
+	OutputIndex int             `json:"output_index"`
+	Item        *respOutputItem `json:"item"`
+	Response    *respObject     `json:"response"`
+	Code        string          `json:"code"`
+	Message     string          `json:"message"`
+}
+
+// chat.completions objects, fields in the order the API sends them.
+type chatCompletion struct {
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int64        `json:"created"`
+	Model   string       `json:"model"`
+	Choices []chatChoice `json:"choices"`
+	Usage   *chatUsage   `json:"usage,omitempty"`
+}
+
+type chatChoice struct {
+	Index        int          `json:"index"`
+	Message      *chatMessage `json:"message,omitempty"`
+	Delta        *chatDelta   `json:"delta,omitempty"`
+	Logprobs     any          `json:"logprobs"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type chatMessage struct {
+	Role      string         `json:"role"`
+	Content   *string        `json:"content"`
+	Refusal   *string        `json:"refusal"`
+	ToolCalls []chatToolCall `json:"tool_calls,omitempty"`
+}
+
+type chatDelta struct {
+	Role      string         `json:"role,omitempty"`
+	Content   *string        `json:"content,omitempty"`
+	Refusal   *string        `json:"refusal,omitempty"`
+	ToolCalls []chatToolCall `json:"tool_calls,omitempty"`
+}
+
+type chatToolCall struct {
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
+	Function chatFunction `json:"function"`
+}
+
+type chatFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+type chatUsage struct {
+	PromptTokens        int64 `json:"prompt_tokens"`
+	CompletionTokens    int64 `json:"completion_tokens"`
+	TotalTokens         int64 `json:"total_tokens"`
+	PromptTokensDetails struct {
+		CachedTokens int64 `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+	CompletionTokensDetails struct {
+		ReasoningTokens int64 `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details"`
+}
+
+func chatUsageFrom(u *respUsage) *chatUsage {
+	if u == nil {
+		return nil
+	}
+	cu := &chatUsage{PromptTokens: u.InputTokens, CompletionTokens: u.OutputTokens, TotalTokens: u.TotalTokens}
+	cu.PromptTokensDetails.CachedTokens = u.InputTokensDetails.CachedTokens
+	cu.CompletionTokensDetails.ReasoningTokens = u.OutputTokensDetails.ReasoningTokens
+	return cu
+}
+
+// finishReason maps a final response status onto the chat finish_reason.
+func finishReason(ro *respObject, toolCalls bool) string {
+	if ro.Status == "incomplete" && ro.IncompleteDetails != nil {
+		switch ro.IncompleteDetails.Reason {
+		case "max_output_tokens":
+			return "length"
+		case "content_filter":
+			return "content_filter"
+		}
+	}
+	if toolCalls {
+		return "tool_calls"
+	}
+	return "stop"
+}
+
+func chatID(id string) string { return "chatcmpl-" + strings.TrimPrefix(id, "resp_") }
+
+// chatCompletionFrom translates a final Responses object.
+func chatCompletionFrom(ro *respObject) *chatCompletion {
+	msg := &chatMessage{Role: "assistant"}
+	var text, refusal strings.Builder
+	hasText, hasRefusal := false, false
+	for _, item := range ro.Output {
+		switch item.Type {
+		case "message":
+			for _, c := range item.Content {
+				switch c.Type {
+				case "output_text":
+					text.WriteString(c.Text)
+					hasText = true
+				case "refusal":
+					refusal.WriteString(c.Refusal)
+					hasRefusal = true
+				}
+			}
+		case "function_call":
+			msg.ToolCalls = append(msg.ToolCalls, chatToolCall{
+				ID: item.CallID, Type: "function",
+				Function: chatFunction{Name: item.Name, Arguments: item.Arguments},
+			})
+		}
+	}
+	if hasText {
+		s := text.String()
+		msg.Content = &s
+	}
+	if hasRefusal {
+		s := refusal.String()
+		msg.Refusal = &s
+	}
+	fr := finishReason(ro, len(msg.ToolCalls) > 0)
+	return &chatCompletion{
+		ID: chatID(ro.ID), Object: "chat.completion", Created: ro.CreatedAt, Model: ro.Model,
+		Choices: []chatChoice{{Message: msg, FinishReason: &fr}},
+		Usage:   chatUsageFrom(ro.Usage),
+	}
+}
+
+// translateChatResponse turns the upstream's Responses answer to a
+// translated request back into chat.completions. Error responses share
+// the OpenAI error shape and pass through.
+func (p *Proxy) translateChatResponse(resp *http.Response, st *reqState) error {
+	info, ok := chatKey.Get(&st.vars)
+	if !ok || resp.StatusCode/100 != 2 {
+		return nil
+	}
+	if isEventStream(resp) {
+		resp.Body = newChatStream(resp.Body, info)
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return nil
+	}
+
+	r := &Response{HTTP: resp, Route: st.route.name, State: &st.vars, maxBody: p.opts.MaxBody}
+	bs, err := r.Body()
+	if err != nil {
+		return err
+	}
+	var ro respObject
+	if err := sonic.Unmarshal(bs, &ro); err != nil {
+		return err
+	}
+	if ro.Status == "failed" {
+		he := &httpError{status: http.StatusBadGateway, code: "upstream_failed", msg: "upstream response failed"}
+		if ro.Error != nil {
+			he.msg = ro.Error.Message
+		}
+		return he
+	}
+	out, err := sonicAPI.Marshal(chatCompletionFrom(&ro))
+	if err != nil {
+		return err
+	}
+	r.SetBody(out)
+	return nil
+}
+
+// chatStream reads the upstream's Responses event stream and yields it as
+// chat.completion.chunk events, ending with "data: [DONE]".
+type chatStream struct {
+	src  io.ReadCloser
+	br   *bufio.Reader
+	info *chatInfo
+	out  bytes.Buffer
+	done bool
+	err  error
+
+	id, model string
+	created   int64
+	tools     map[int]int // output_index -> tool_calls index
+}
+
+func newChatStream(src io.ReadCloser, info *chatInfo) *chatStream {
+	return &chatStream{src: src, br: bufio.NewReader(src), info: info, tools: map[int]int{}}
+}
+
+func (s *chatStream) Read(p []byte) (int, error) {
+	for s.out.Len() == 0 {
+		if s.done {
+			if s.err != nil {
+				return 0, s.err
+			}
+			return 0, io.EOF
+		}
+		s.next()
+	}
+	return s.out.Read(p)
+}
+
+func (s *chatStream) Close() error { return s.src.Close() }
+
+// next reads one upstream event and appends its translation to s.out.
+func (s *chatStream) next() {
+	var data []byte
+	for {
+		line, err := s.br.ReadBytes('\n')
+		line = bytes.TrimRight(line, "\r\n")
+		if d, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			if data != nil {
+				data = append(data, '\n')
+			}
+			data = append(data, bytes.TrimPrefix(d, []byte(" "))...)
+		}
+		if err != nil {
+			if data != nil {
+				s.event(data)
+			}
+			s.done = true
+			if !errors.Is(err, io.EOF) {
+				s.err = err
+			}
+			return
+		}
+		if len(line) == 0 && data != nil {
+			s.event(data)
+			return
+		}
+	}
+}
+
+func (s *chatStream) event(data []byte) {
+	var ev respEvent
+	if sonic.Unmarshal(data, &ev) != nil {
+		return
+	}
+	switch ev.Type {
+	case "response.created":
+		if ro := ev.Response; ro != nil {
+			s.id, s.model, s.created = chatID(ro.ID), ro.Model, ro.CreatedAt
+		}
+		empty := ""
+		s.chunk(&chatDelta{Role: "assistant", Content: &empty}, nil)
+	case "response.output_text.delta":
+		d := ev.Delta
+		s.chunk(&chatDelta{Content: &d}, nil)
+	case "response.refusal.delta":
+		d := ev.Delta
+		s.chunk(&chatDelta{Refusal: &d}, nil)
+	case "response.output_item.added":
+		if ev.Item == nil || ev.Item.Type != "function_call" {
+			return
+		}
+		idx := len(s.tools)
+		s.tools[ev.OutputIndex] = idx
+		s.chunk(&chatDelta{ToolCalls: []chatToolCall{{
+			Index: &idx, ID: ev.Item.CallID, Type: "function",
+			Function: chatFunction{Name: ev.Item.Name},
+		}}}, nil)
+	case "response.function_call_arguments.delta":
+		idx, ok := s.tools[ev.OutputIndex]
+		if !ok {
+			return
+		}
+		s.chunk(&chatDelta{ToolCalls: []chatToolCall{{
+			Index: &idx, Function: chatFunction{Arguments: ev.Delta},
+		}}}, nil)
+	case "response.completed", "response.incomplete":
+		if ev.Response == nil {
+			return
+		}
+		fr := finishReason(ev.Response, len(s.tools) > 0)
+		s.chunk(&chatDelta{}, &fr)
+		if s.info.includeUsage {
+			if u := chatUsageFrom(ev.Response.Usage); u != nil {
+				s.write(&chatCompletion{
+					ID: s.id, Object: "chat.completion.chunk", Created: s.created, Model: s.model,
+					Choices: []chatChoice{}, Usage: u,
+				})
+			}
+		}
+		s.out.WriteString("data: [DONE]\n\n")
+	case "response.failed", "error":
+		e := respError{Code: ev.Code, Message: ev.Message}
+		if ev.Response != nil && ev.Response.Error != nil {
+			e = *ev.Response.Error
+		}
+		bs, _ := sonicAPI.Marshal(errorBody{Error: errorDetail{Message: e.Message, Type: "upstream_error", Code: e.Code}})
+		s.out.WriteString("data: ")
+		s.out.Write(bs)
+		s.out.WriteString("\n\ndata: [DONE]\n\n")
+	}
+}
+
+func (s *chatStream) chunk(d *chatDelta, finish *string) {
+	s.write(&chatCompletion{
+		ID: s.id, Object: "chat.completion.chunk", Created: s.created, Model: s.model,
+		Choices: []chatChoice{{Delta: d, FinishReason: finish}},
+	})
+}
+
+func (s *chatStream) write(c *chatCompletion) {
+	bs, err := sonicAPI.Marshal(c)
+	if err != nil {
+		return
+	}
+	s.out.WriteString("data: ")
+	s.out.Write(bs)
+	s.out.WriteString("\n\n")
+}
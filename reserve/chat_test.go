@@ -0,0 +1,197 @@
+package reserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// golden compares got with testdata/<name>, or writes it there with
+// -update.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs; got\n%s\nwant\n%s", name, got, want)
+	}
+}
+
+func TestChatToResponses(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+		usage          bool
+	}{
+		{
+			name: "system becomes instructions",
+			in:   `{"model":"gpt-5","messages":[{"role":"system","content":"be brief"},{"role":"developer","content":"no emoji"},{"role":"user","content":"hi"}]}`,
+			want: `{"input":[{"content":"hi","role":"user"}],"instructions":"be brief\n\nno emoji","model":"gpt-5","store":false}`,
+		},
+		{
+			name: "later system message stays in place",
+			in:   `{"messages":[{"role":"user","content":"hi"},{"role":"system","content":[{"type":"text","text":"be "},{"type":"text","text":"brief"}]}]}`,
+			want: `{"input":[{"content":"hi","role":"user"},{"content":"be brief","role":"developer"}],"store":false}`,
+		},
+		{
+			name: "tool round trip",
+			in: `{"messages":[{"role":"user","content":[{"type":"text","text":"weather?"},{"type":"image_url","image_url":{"url":"https://x/a.png","detail":"low"}}]},` +
+				`{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{}"}}]},` +
+				`{"role":"tool","tool_call_id":"call_1","content":"sunny"}],` +
+				`"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object"}}}],"tool_choice":{"type":"function","function":{"name":"get_weather"}}}`,
+			want: `{"input":[{"content":[{"text":"weather?","type":"input_text"},{"detail":"low","image_url":"https://x/a.png","type":"input_image"}],"role":"user"},` +
+				`{"arguments":"{}","call_id":"call_1","name":"get_weather","type":"function_call"},` +
+				`{"call_id":"call_1","output":"sunny","type":"function_call_output"}],` +
+				`"store":false,"tool_choice":{"name":"get_weather","type":"function"},"tools":[{"name":"get_weather","parameters":{"type":"object"},"type":"function"}]}`,
+		},
+		{
+			name:  "renamed parameters",
+			in:    `{"messages":[{"role":"user","content":"hi"}],"max_completion_tokens":64,"reasoning_effort":"low","store":true,"n":1,"stream":true,"stream_options":{"include_usage":true},"response_format":{"type":"json_schema","json_schema":{"name":"r","schema":{"type":"object"},"strict":true}}}`,
+			want:  `{"input":[{"content":"hi","role":"user"}],"max_output_tokens":64,"reasoning":{"effort":"low"},"store":true,"stream":true,"text":{"format":{"name":"r","schema":{"type":"object"},"strict":true,"type":"json_schema"}}}`,
+			usage: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, info, err := chatToResponses([]byte(tc.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want any
+			if err := json.Unmarshal(out, &got); err != nil {
+				t.Fatal(err)
+			}
+			json.Unmarshal([]byte(tc.want), &want)
+			gb, _ := json.Marshal(got)
+			wb, _ := json.Marshal(want)
+			if !bytes.Equal(gb, wb) {
+				t.Errorf("translated to\n%s\nwant\n%s", gb, wb)
+			}
+			if info.includeUsage != tc.usage {
+				t.Errorf("includeUsage = %v", info.includeUsage)
+			}
+		})
+	}
+}
+
+func TestChatToResponsesUnsupported(t *testing.T) {
+	_, _, err := chatToResponses([]byte(`{"messages":[{"role":"user","content":[{"type":"input_audio"}]},{"role":"oracle","content":"x"}],` +
+		`"n":2,"logprobs":true,"tools":[{"type":"code_interpreter"}],"response_format":{"type":"yaml"}}`))
+	he, ok := err.(*httpError)
+	if !ok || he.status != http.StatusBadRequest || he.code != "unsupported_parameter" {
+		t.Fatalf("err = %v, want unsupported_parameter", err)
+	}
+	const want = "not translatable to the Responses API: logprobs, messages[0].content[0].type=input_audio, messages[1].role=oracle, n, response_format, tools[0].type=code_interpreter"
+	if he.msg != want {
+		t.Errorf("message %q\nwant %q", he.msg, want)
+	}
+	for _, body := range []string{`[]`, `{"model":"x"}`, `{"messages":[]}`} {
+		if _, _, err := chatToResponses([]byte(body)); err != errChatBody && err != errChatMessages {
+			t.Errorf("%s: err = %v", body, err)
+		}
+	}
+}
+
+// TestChatStreamGolden translates the Responses event streams in
+// testdata/chat/<name>.sse and compares the chat.completion.chunk stream
+// with <name>.golden.
+func TestChatStreamGolden(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		usage bool
+	}{
+		{"text", false},
+		{"usage", true},
+		{"tool_calls", true},
+		{"incomplete", false},
+		{"failed", false},
+		{"crlf", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, err := os.Open(filepath.Join("testdata", "chat", tc.name+".sse"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := newChatStream(src, &chatInfo{stream: true, includeUsage: tc.usage})
+			defer s.Close()
+			got, err := io.ReadAll(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden(t, filepath.Join("chat", tc.name+".golden"), got)
+		})
+	}
+}
+
+func TestChatThroughProxy(t *testing.T) {
+	transcript, err := os.ReadFile(filepath.Join("testdata", "chat", "usage.sse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if strings.Contains(r.URL.RawQuery, "stream") {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write(transcript)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"resp_abc","object":"response","created_at":1760000000,"status":"completed","model":"gpt-5",`+
+			`"output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hi there"}]}],`+
+			`"usage":{"input_tokens":3,"output_tokens":2,"total_tokens":5}}`)
+	})
+	p := newTestProxy(t, DefaultOptions(), u)
+
+	w := send(p, "POST", "/v1/chat/completions", bearer("sk-a"),
+		`{"model":"gpt-5","messages":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("answered %d %s", w.Code, w.Body)
+	}
+	got := u.requests()[0]
+	if got.path != "/v1/responses" {
+		t.Errorf("upstream path %s", got.path)
+	}
+	m := decodeBody(t, got.body)
+	if m["instructions"] != nil || m["prompt_cache_key"] != cacheKey("Bearer sk-a") || m["store"] != false {
+		t.Errorf("upstream body %s, want instructions migrated and the key added", got.body)
+	}
+	var cc struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Choices []struct {
+			Message      struct{ Role, Content string } `json:"message"`
+			FinishReason string                         `json:"finish_reason"`
+		} `json:"choices"`
+		Usage struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &cc); err != nil {
+		t.Fatal(err)
+	}
+	if cc.ID != "chatcmpl-abc" || cc.Object != "chat.completion" || len(cc.Choices) != 1 ||
+		cc.Choices[0].Message.Content != "hi there" || cc.Choices[0].FinishReason != "stop" || cc.Usage.TotalTokens != 5 {
+		t.Errorf("chat completion %s", w.Body)
+	}
+
+	w = send(p, "POST", "/v1/chat/completions?stream", nil,
+		`{"messages":[{"role":"user","content":"hi"}],"stream":true,"stream_options":{"include_usage":true}}`)
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	golden(t, filepath.Join("chat", "usage.golden"), w.Body.Bytes())
+}
@@ -0,0 +1,217 @@
+package reserve
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clientIdentity is who a request belongs to, resolved from its credential
+// headers. It is immutable once built, so a request may keep using it after
+// the cache has evicted the entry.
+type clientIdentity struct {
+	// CacheKey is the derived prompt_cache_key; it doubles as the client's
+	// stable, non-secret id.
+	CacheKey string
+	// Source is the header the identity came from: authorization, x-api-key,
+	// api-key, or remote (client address + User-Agent fallback, see
+	// remoteAddr), or the source given to WithClientID. Conversation
+	// keys (see conversationKey) have Source conversation.
+	Source string
+}
+
+// clientCache is a bounded LRU with TTL from credential header value (or
+// conversation id) to the resolved identity, so the hash isn't recomputed
+// for every request of the same client. A nil cache resolves without
+// caching.
+type clientCache struct {
+	size int
+	ttl  time.Duration
+
+	mu sync.Mutex
+	ll *list.List // front = most recently used
+	m  map[string]*list.Element
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type clientEntry struct {
+	k   string
+	id  *clientIdentity
+	exp time.Time
+}
+
+func newClientCache(size int, ttl time.Duration) *clientCache {
+	if size <= 0 {
+		return nil
+	}
+	return &clientCache{
+		size: size,
+		ttl:  ttl,
+		ll:   list.New(),
+		m:    make(map[string]*list.Element, size),
+	}
+}
+
+func (c *clientCache) get(k string, now time.Time) *clientIdentity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.m[k]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*clientEntry)
+	if c.ttl > 0 && now.After(e.exp) {
+		c.ll.Remove(el)
+		delete(c.m, k)
+		return nil
+	}
+	c.ll.MoveToFront(el)
+	return e.id
+}
+
+func (c *clientCache) add(k string, id *clientIdentity, now time.Time) {
+	c.addExp(k, id, now.Add(c.ttl))
+}
+
+// addExp adds k to expire at exp, rather than a TTL from now; entries
+// loaded back from a Store keep what was left of theirs.
+func (c *clientCache) addExp(k string, id *clientIdentity, exp time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &clientEntry{k: k, id: id, exp: exp}
+	if el, ok := c.m[k]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.m[k] = c.ll.PushFront(e)
+	for c.ll.Len() > c.size {
+		last := c.ll.Back()
+		c.ll.Remove(last)
+		delete(c.m, last.Value.(*clientEntry).k)
+		c.evictions.Add(1)
+	}
+}
+
+func (c *clientCache) remove(k string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.m[k]; ok {
+		c.ll.Remove(el)
+		delete(c.m, k)
+	}
+}
+
+// flush drops every entry and returns how many there were.
+func (c *clientCache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.ll.Len()
+	c.ll.Init()
+	clear(c.m)
+	return n
+}
+
+type clientIDKey struct{}
+
+type listenerID struct{ source, id string }
+
+// WithClientID returns a copy of ctx in which the caller is known as id,
+// as established by source (the tailnet login behind the connection, say).
+// A request carrying it gets its identity from id rather than from its
+// credential headers.
+func WithClientID(ctx context.Context, source, id string) context.Context {
+	return context.WithValue(ctx, clientIDKey{}, listenerID{source, id})
+}
+
+// resolveClient returns the identity of req, cached by credential.
+// Priority: WithClientID > Authorization > x-api-key > api-key >
+// (client address + UA)
+func (rr *Rewriter) resolveClient(req *http.Request) *clientIdentity {
+	if v, ok := req.Context().Value(clientIDKey{}).(listenerID); ok {
+		return rr.cachedIdentity(v.source, v.id)
+	}
+	var src, s string
+	if v := req.Header.Get("Authorization"); v != "" {
+		src, s = "authorization", v
+	} else if v := req.Header.Get("x-api-key"); v != "" {
+		src, s = "x-api-key", v
+	} else if v := req.Header.Get("api-key"); v != "" {
+		src, s = "api-key", v
+	} else {
+		addr, via := rr.remoteAddr(req)
+		rr.clientIP.count(via)
+		src, s = "remote", rr.identityAddr(addr)+"|"+req.Header.Get("User-Agent")
+	}
+	return rr.cachedIdentity(src, s)
+}
+
+// conversationKey returns the prompt_cache_key of conversation id. It
+// depends on the id alone, so every turn of a conversation shares it
+// whichever machine or credential sends it, across restarts too.
+func (rr *Rewriter) conversationKey(id string) string {
+	return rr.cachedIdentity("conversation", id).CacheKey
+}
+
+func (rr *Rewriter) cachedIdentity(src, s string) *clientIdentity {
+	c := rr.clients
+	if c == nil {
+		return newClientIdentity(src, s)
+	}
+	k := src + "\x00" + s
+	now := time.Now()
+	if id := c.get(k, now); id != nil {
+		c.hits.Add(1)
+		return id
+	}
+	c.misses.Add(1)
+	id := newClientIdentity(src, s)
+	c.add(k, id, now)
+	return id
+}
+
+// Derive a stable prompt_cache_key without leaking the raw API key.
+func newClientIdentity(src, s string) *clientIdentity {
+	sum := sha256.Sum256([]byte(s))
+	// 16 bytes -> 32 hex chars
+	return &clientIdentity{CacheKey: hex.EncodeToString(sum[:16]), Source: src}
+}
+
+// derivePromptCacheKey returns the prompt_cache_key for req, the turn of
+// conversation conv when it is not "".
+func (rr *Rewriter) derivePromptCacheKey(req *http.Request, conv string) string {
+	if conv != "" {
+		return rr.conversationKey(conv)
+	}
+	if st := stateOf(req.Context()); st != nil && st.client != nil {
+		return st.client.CacheKey
+	}
+	return rr.resolveClient(req).CacheKey
+}
+
+func (rr *Rewriter) clientCacheStats() any {
+	c := rr.clients
+	if c == nil {
+		return map[string]any{"enabled": false}
+	}
+	c.mu.Lock()
+	n := c.ll.Len()
+	c.mu.Unlock()
+	return map[string]any{
+		"enabled":   true,
+		"size":      c.size,
+		"ttl":       c.ttl.String(),
+		"entries":   n,
+		"hits":      c.hits.Load(),
+		"misses":    c.misses.Load(),
+		"evictions": c.evictions.Load(),
+	}
+}
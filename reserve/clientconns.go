@@ -0,0 +1,191 @@
+package reserve
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The server's ReadHeaderTimeout bounds only the request head: a client
+// may dribble its body for as long as it likes while the proxy buffers it,
+// on as many connections as it cares to open. With
+// Options.BodyReadTimeout the connection's read deadline is pushed that
+// far ahead before every read of a body being buffered, so a body must
+// keep coming, and is lifted again once it is in; a stalled body is
+// answered with a 408. The write side, a long SSE response included, is
+// never under a deadline. MaxConns caps the open client connections and
+// MaxConnsPerIP those of one peer address (the direct peer: behind a load
+// balancer, leave it 0); the requests of a connection over a cap are
+// answered with a 503 (429 for the per-address cap) and the connection is
+// closed. The caps need the server's ConnContext and ConnState hooks set
+// to the Proxy's.
+
+var (
+	errBodyTimeout = &httpError{
+		status: http.StatusRequestTimeout,
+		code:   "request_body_timeout",
+		msg:    "request body stalled: sent too slowly",
+	}
+	errConnsFull = &httpError{
+		status:     http.StatusServiceUnavailable,
+		code:       "too_many_connections",
+		msg:        "the proxy is at its connection limit, retry shortly",
+		retryAfter: 1,
+	}
+	errConnsPerIP = &httpError{
+		status:     http.StatusTooManyRequests,
+		code:       "too_many_connections",
+		msg:        "too many open connections from this address",
+		retryAfter: 1,
+	}
+)
+
+// deadlineBody pushes the read deadline of its request's connection d
+// ahead before every read. Close lifts it.
+type deadlineBody struct {
+	io.ReadCloser
+	rc      *http.ResponseController
+	d       time.Duration
+	expired bool // a read hit the deadline
+}
+
+// withBodyDeadline wraps r's body in a deadlineBody when the request has
+// a controller to set deadlines with (see Proxy.ServeHTTP) and its
+// connection supports them.
+func withBodyDeadline(r *http.Request, d time.Duration) {
+	st := stateOf(r.Context())
+	if d <= 0 || st == nil || st.rc == nil || r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	if st.rc.SetReadDeadline(time.Now().Add(d)) != nil {
+		return // not supported by this connection
+	}
+	r.Body = &deadlineBody{ReadCloser: r.Body, rc: st.rc, d: d}
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	_ = b.rc.SetReadDeadline(time.Now().Add(b.d))
+	n, err := b.ReadCloser.Read(p)
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		b.expired = true
+	}
+	return n, err
+}
+
+func (b *deadlineBody) Close() error {
+	_ = b.rc.SetReadDeadline(time.Time{})
+	return b.ReadCloser.Close()
+}
+
+// bodyExpired reports whether body is a deadlineBody that ran out.
+func bodyExpired(body io.ReadCloser) bool {
+	b, ok := body.(*deadlineBody)
+	return ok && b.expired
+}
+
+type connRefusalKey struct{}
+
+// connLimiter admits client connections under MaxConns and MaxConnsPerIP.
+type connLimiter struct {
+	max, perIP int
+
+	mu    sync.Mutex
+	open  int
+	byIP  map[netip.Addr]int
+	conns map[net.Conn]netip.Addr // admitted, until closed
+
+	shed      atomic.Int64 // connections over MaxConns
+	shedPerIP atomic.Int64 // over MaxConnsPerIP
+}
+
+func newConnLimiter(opts Options) *connLimiter {
+	if opts.MaxConns <= 0 && opts.MaxConnsPerIP <= 0 {
+		return nil
+	}
+	return &connLimiter{
+		max: opts.MaxConns, perIP: opts.MaxConnsPerIP,
+		byIP: map[netip.Addr]int{}, conns: map[net.Conn]netip.Addr{},
+	}
+}
+
+// ConnContext is the http.Server hook admitting the client connection c
+// under Options.MaxConns and MaxConnsPerIP; a refused one gets its
+// requests answered with an error. Use it with ConnState.
+func (p *Proxy) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	l := p.connLimit
+	if l == nil {
+		return ctx
+	}
+	ip := peerAddr(c)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.max > 0 && l.open >= l.max:
+		l.shed.Add(1)
+		return context.WithValue(ctx, connRefusalKey{}, errConnsFull)
+	case l.perIP > 0 && l.byIP[ip] >= l.perIP:
+		l.shedPerIP.Add(1)
+		return context.WithValue(ctx, connRefusalKey{}, errConnsPerIP)
+	}
+	l.open++
+	l.byIP[ip]++
+	l.conns[c] = ip
+	return ctx
+}
+
+// ConnState is the http.Server hook releasing what ConnContext admitted.
+func (p *Proxy) ConnState(c net.Conn, s http.ConnState) {
+	l := p.connLimit
+	if l == nil || s != http.StateClosed && s != http.StateHijacked {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ip, ok := l.conns[c]
+	if !ok {
+		return
+	}
+	delete(l.conns, c)
+	l.open--
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+// connRefusal is the error to answer the requests of a connection
+// ConnContext refused with, nil for an admitted one.
+func connRefusal(ctx context.Context) *httpError {
+	he, _ := ctx.Value(connRefusalKey{}).(*httpError)
+	return he
+}
+
+func peerAddr(c net.Conn) netip.Addr {
+	if ta, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return ta.AddrPort().Addr().Unmap()
+	}
+	ap, _ := netip.ParseAddrPort(c.RemoteAddr().String())
+	return ap.Addr().Unmap()
+}
+
+func (p *Proxy) clientConnStats() any {
+	out := map[string]any{
+		"body_read_timeout": p.opts.BodyReadTimeout.String(),
+		"body_timeouts":     p.rewriter.bodyTimeouts.Load(),
+		"enabled":           p.connLimit != nil,
+	}
+	if l := p.connLimit; l != nil {
+		l.mu.Lock()
+		out["open"], out["ips"] = l.open, len(l.byIP)
+		l.mu.Unlock()
+		out["max_conns"], out["max_conns_per_ip"] = l.max, l.perIP
+		out["shed"], out["shed_per_ip"] = l.shed.Load(), l.shedPerIP.Load()
+	}
+	return out
+}
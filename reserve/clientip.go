@@ -0,0 +1,162 @@
+package reserve
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Behind a reverse proxy (nginx and the like) every request's peer is the
+// proxy, so the remote fallback of resolveClient would lump all anonymous
+// clients together. With Options.TrustedProxies, a request whose peer is
+// in the list gets its client address from X-Forwarded-For instead: the
+// rightmost hop that isn't itself trusted, as every hop to its right was
+// appended by a trusted proxy and everything to its left is whatever the
+// client sent. X-Real-IP is used when there is no X-Forwarded-For. The
+// headers of untrusted peers are ignored.
+//
+// The address goes into the identity without its port, which changes
+// with every connection, and without an IPv6 zone, in canonical form;
+// Options.IdentityIPv4Prefix and IdentityIPv6Prefix mask it to a network
+// (a /64 is what one IPv6 host usually gets to roam in).
+
+type clientIPCounts struct {
+	forwarded atomic.Int64 // taken from X-Forwarded-For
+	realIP    atomic.Int64 // taken from X-Real-IP
+	peer      atomic.Int64 // trusted peer without usable headers
+	ignored   atomic.Int64 // headers from an untrusted peer
+}
+
+func (rr *Rewriter) clientIPStats() any {
+	if len(rr.opts.TrustedProxies) == 0 {
+		return map[string]any{"enabled": false}
+	}
+	c := &rr.clientIP
+	return map[string]any{
+		"enabled":         true,
+		"trusted_proxies": len(rr.opts.TrustedProxies),
+		"forwarded":       c.forwarded.Load(),
+		"real_ip":         c.realIP.Load(),
+		"peer":            c.peer.Load(),
+		"ignored":         c.ignored.Load(),
+	}
+}
+
+func (rr *Rewriter) trusted(a netip.Addr) bool {
+	for _, p := range rr.opts.TrustedProxies {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// How remoteAddr found an address, for clientIPCounts.count.
+const (
+	viaRemote    = iota // RemoteAddr, no trusted proxies or no headers
+	viaForwarded        // X-Forwarded-For
+	viaRealIP           // X-Real-IP
+	viaPeer             // a trusted peer without usable headers
+	viaIgnored          // forwarding headers from an untrusted peer
+)
+
+func (c *clientIPCounts) count(via int) {
+	switch via {
+	case viaForwarded:
+		c.forwarded.Add(1)
+	case viaRealIP:
+		c.realIP.Add(1)
+	case viaPeer:
+		c.peer.Add(1)
+	case viaIgnored:
+		c.ignored.Add(1)
+	}
+}
+
+// remoteAddr is the client address of req for its identity and the log:
+// RemoteAddr as is, or the address a trusted proxy forwarded.
+func (rr *Rewriter) remoteAddr(req *http.Request) (addr string, via int) {
+	if len(rr.opts.TrustedProxies) == 0 {
+		return req.RemoteAddr, viaRemote
+	}
+	peer, ok := parseHop(req.RemoteAddr)
+	if !ok || !rr.trusted(peer) {
+		if req.Header.Get("X-Forwarded-For") != "" || req.Header.Get("X-Real-IP") != "" {
+			return req.RemoteAddr, viaIgnored
+		}
+		return req.RemoteAddr, viaRemote
+	}
+	if xff := req.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		// the header may be repeated; its values are one list, in order
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			a, ok := parseHop(hops[i])
+			if !ok {
+				// not written by a proxy we trust: stop at the last good hop
+				break
+			}
+			client = a
+			if !rr.trusted(a) {
+				break
+			}
+		}
+		return client.String(), viaForwarded
+	}
+	if a, ok := parseHop(req.Header.Get("X-Real-IP")); ok {
+		return a.String(), viaRealIP
+	}
+	return peer.String(), viaPeer
+}
+
+// parseHop parses an address as it appears in RemoteAddr or a forwarding
+// header: bare, with a port, or bracketed IPv6. IPv4-mapped IPv6
+// addresses are unmapped so they match IPv4 prefixes.
+func parseHop(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return a.Unmap(), true
+}
+
+// identityAddr is addr as it goes into a client's identity: its IP
+// masked to the configured prefix, or addr as is when it isn't one (a
+// unix socket's "" or "@").
+func (rr *Rewriter) identityAddr(addr string) string {
+	a, ok := parseHop(addr)
+	if !ok {
+		return addr
+	}
+	a = a.WithZone("")
+	bits := rr.opts.IdentityIPv6Prefix
+	if a.Is4() {
+		bits = rr.opts.IdentityIPv4Prefix
+	}
+	if bits > 0 && bits < a.BitLen() {
+		if p, err := a.Prefix(bits); err == nil {
+			return p.String()
+		}
+	}
+	return a.String()
+}
+
+var identityAddrNote sync.Once
+
+// noteIdentityAddr logs, once, that the address fallback of client
+// identities changed, since it rotates the keys of anonymous clients.
+func noteIdentityAddr(opts Options) {
+	identityAddrNote.Do(func() {
+		slog.Info("client identity: the address fallback ignores the source port; prompt_cache_key of clients without credentials differs from earlier versions",
+			"ipv4_prefix", opts.IdentityIPv4Prefix, "ipv6_prefix", opts.IdentityIPv6Prefix)
+	})
+}
@@ -0,0 +1,199 @@
+package reserve
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func trustingRewriter(prefixes ...string) *Rewriter {
+	opts := DefaultOptions()
+	for _, s := range prefixes {
+		opts.TrustedProxies = append(opts.TrustedProxies, netip.MustParsePrefix(s))
+	}
+	return NewRewriter(opts)
+}
+
+func TestRemoteAddr(t *testing.T) {
+	rr := trustingRewriter("10.0.0.0/8", "fd00::/8", "127.0.0.1/32")
+	for _, tc := range []struct {
+		name   string
+		remote string
+		xff    []string
+		realIP string
+		want   string
+		via    int
+	}{
+		{"untrusted peer", "203.0.113.9:5000", nil, "", "203.0.113.9:5000", viaRemote},
+		{"spoofed xff", "203.0.113.9:5000", []string{"1.2.3.4"}, "", "203.0.113.9:5000", viaIgnored},
+		{"spoofed x-real-ip", "203.0.113.9:5000", nil, "1.2.3.4", "203.0.113.9:5000", viaIgnored},
+		{"trusted peer, one hop", "10.0.0.2:443", []string{"203.0.113.7"}, "", "203.0.113.7", viaForwarded},
+		{"rightmost untrusted hop", "10.0.0.2:443", []string{"1.1.1.1, 203.0.113.7, 10.0.0.5"}, "", "203.0.113.7", viaForwarded},
+		{"client-supplied hops ignored", "127.0.0.1:443", []string{"6.6.6.6,203.0.113.7"}, "", "203.0.113.7", viaForwarded},
+		{"repeated header", "10.0.0.2:443", []string{"1.1.1.1", "203.0.113.7, 10.0.0.2"}, "", "203.0.113.7", viaForwarded},
+		{"all hops trusted", "10.0.0.2:443", []string{"10.0.0.3, 10.0.0.4"}, "", "10.0.0.3", viaForwarded},
+		{"garbage hop", "10.0.0.2:443", []string{"203.0.113.7, unknown, 10.0.0.4"}, "", "10.0.0.4", viaForwarded},
+		{"hop with port", "10.0.0.2:443", []string{"203.0.113.7:61000"}, "", "203.0.113.7", viaForwarded},
+		{"ipv6 peer and hop", "[fd00::1]:443", []string{"2001:db8::1"}, "", "2001:db8::1", viaForwarded},
+		{"bracketed ipv6 hop", "[fd00::1]:443", []string{"[2001:db8::2]:1234, fd00::7"}, "", "2001:db8::2", viaForwarded},
+		{"ipv6 zone hop", "10.0.0.2:443", []string{"fe80::1%eth0"}, "", "fe80::1%eth0", viaForwarded},
+		{"ipv4-mapped peer", "[::ffff:10.0.0.2]:443", []string{"203.0.113.7"}, "", "203.0.113.7", viaForwarded},
+		{"x-real-ip", "10.0.0.2:443", nil, "203.0.113.8", "203.0.113.8", viaRealIP},
+		{"xff wins over x-real-ip", "10.0.0.2:443", []string{"203.0.113.7"}, "203.0.113.8", "203.0.113.7", viaForwarded},
+		{"bad x-real-ip", "10.0.0.2:443", nil, "nope", "10.0.0.2", viaPeer},
+		{"trusted peer, no headers", "[fd00::1]:443", nil, "", "fd00::1", viaPeer},
+		{"unix socket peer", "@", []string{"203.0.113.7"}, "", "@", viaIgnored},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/responses", nil)
+			req.RemoteAddr = tc.remote
+			for _, v := range tc.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if tc.realIP != "" {
+				req.Header.Set("X-Real-IP", tc.realIP)
+			}
+			got, via := rr.remoteAddr(req)
+			if got != tc.want || via != tc.via {
+				t.Errorf("remoteAddr = %q via %d, want %q via %d", got, via, tc.want, tc.via)
+			}
+		})
+	}
+}
+
+func TestRemoteAddrNoTrustedProxies(t *testing.T) {
+	rr := NewRewriter(DefaultOptions())
+	req := httptest.NewRequest("POST", "/v1/responses", nil)
+	req.RemoteAddr = "10.0.0.2:443"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	if got, via := rr.remoteAddr(req); got != "10.0.0.2:443" || via != viaRemote {
+		t.Errorf("remoteAddr = %q via %d, want RemoteAddr", got, via)
+	}
+	if st := rr.clientIPStats().(map[string]any); st["enabled"] != false {
+		t.Errorf("stats %v", st)
+	}
+}
+
+// TestTrustedProxyCacheKeys checks that anonymous clients behind a trusted
+// proxy keep keys of their own, and a spoofing client doesn't get one.
+func TestTrustedProxyCacheKeys(t *testing.T) {
+	rr := trustingRewriter("10.0.0.0/8")
+	key := func(remote, xff string) string {
+		req := httptest.NewRequest("POST", "/v1/responses", strings.NewReader(`{"input":"hi"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = remote
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		out := rewriteReq(t, rr, req)
+		return decodeBody(t, out)["prompt_cache_key"].(string)
+	}
+	a := key("10.0.0.2:443", "203.0.113.7")
+	if b := key("10.0.0.2:443", "203.0.113.8"); a == b {
+		t.Error("two clients behind the proxy share a key")
+	}
+	if b := key("10.0.0.3:443", "203.0.113.7"); a != b {
+		t.Error("one client's key changed with the proxy hop it came through")
+	}
+	if b := key("203.0.113.9:5000", "203.0.113.7"); a == b {
+		t.Error("an untrusted peer took another client's key with a spoofed header")
+	}
+	st := rr.clientIPStats().(map[string]any)
+	if st["forwarded"] != int64(3) || st["ignored"] != int64(1) {
+		t.Errorf("stats %v", st)
+	}
+}
+
+// rewriteReq runs req through rr and returns the forwarded body.
+func rewriteReq(t *testing.T, rr *Rewriter, req *http.Request) []byte {
+	t.Helper()
+	if _, err := rr.RewriteRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Body.Close()
+	return out
+}
+
+func TestIdentityAddr(t *testing.T) {
+	plain := NewRewriter(DefaultOptions())
+	opts := DefaultOptions()
+	opts.IdentityIPv4Prefix, opts.IdentityIPv6Prefix = 24, 64
+	masked := NewRewriter(opts)
+	for _, tc := range []struct {
+		addr, plain, masked string
+	}{
+		{"192.0.2.1:5555", "192.0.2.1", "192.0.2.0/24"},
+		{"192.0.2.77", "192.0.2.77", "192.0.2.0/24"},
+		{"[2001:db8::1]:443", "2001:db8::1", "2001:db8::/64"},
+		{"[2001:DB8:0:0:1:2:3:4]:443", "2001:db8::1:2:3:4", "2001:db8::/64"},
+		{"[2001:db8:1:2:3::4]:1", "2001:db8:1:2:3::4", "2001:db8:1:2::/64"},
+		{"[fe80::1%eth0]:1234", "fe80::1", "fe80::/64"},
+		{"fe80::1%eth0", "fe80::1", "fe80::/64"},
+		{"[::ffff:192.0.2.1]:80", "192.0.2.1", "192.0.2.0/24"},
+		{"", "", ""},
+		{"@", "@", "@"},
+	} {
+		if got := plain.identityAddr(tc.addr); got != tc.plain {
+			t.Errorf("identityAddr(%q) = %q, want %q", tc.addr, got, tc.plain)
+		}
+		if got := masked.identityAddr(tc.addr); got != tc.masked {
+			t.Errorf("identityAddr(%q) masked = %q, want %q", tc.addr, got, tc.masked)
+		}
+	}
+
+	// a whole-address prefix is no mask
+	opts.IdentityIPv4Prefix, opts.IdentityIPv6Prefix = 32, 128
+	if got := NewRewriter(opts).identityAddr("[2001:db8::1]:443"); got != "2001:db8::1" {
+		t.Errorf("identityAddr with /128 = %q", got)
+	}
+}
+
+func TestResolveClientAddressFallback(t *testing.T) {
+	opts := DefaultOptions()
+	opts.IdentityIPv6Prefix = 64
+	rr := NewRewriter(opts)
+	key := func(addr, ua string) string {
+		req := httptest.NewRequest("POST", "/v1/responses", nil)
+		req.RemoteAddr = addr
+		req.Header.Set("User-Agent", ua)
+		id := rr.resolveClient(req)
+		if id.Source != "remote" {
+			t.Errorf("%s identified by %s, want remote", addr, id.Source)
+		}
+		return id.CacheKey
+	}
+	for _, tc := range []struct {
+		name string
+		a, b string // the same client's addresses
+	}{
+		{"IPv4 source ports", "192.0.2.1:40000", "192.0.2.1:40001"},
+		{"IPv6 source ports", "[2001:db8::1]:40000", "[2001:db8::1]:40001"},
+		{"IPv6 zone", "[fe80::1%eth0]:40000", "[fe80::1%eth1]:40001"},
+		{"IPv6 /64", "[2001:db8::1]:1", "[2001:db8::ffff:2]:2"},
+		{"IPv4-mapped", "[::ffff:192.0.2.1]:1", "192.0.2.1:2"},
+		{"unix socket", "", ""},
+	} {
+		if a, b := key(tc.a, "sdk/1"), key(tc.b, "sdk/1"); a != b {
+			t.Errorf("%s: %s and %s got different keys", tc.name, tc.a, tc.b)
+		}
+	}
+	if key("192.0.2.1:1", "sdk/1") == key("192.0.2.1:1", "sdk/2") {
+		t.Error("user agents not told apart")
+	}
+	if key("192.0.2.1:1", "sdk/1") == key("192.0.2.2:1", "sdk/1") {
+		t.Error("IPv4 addresses not told apart")
+	}
+	if key("[2001:db8:0:1::1]:1", "sdk/1") == key("[2001:db8:0:2::1]:1", "sdk/1") {
+		t.Error("IPv6 /64s not told apart")
+	}
+	if key("", "sdk/1") == key("192.0.2.1:1", "sdk/1") {
+		t.Error("unix socket client shares an address client's key")
+	}
+}
@@ -0,0 +1,129 @@
+package reserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// With Options.UpstreamGzip, a buffered request body of at least that
+// many bytes goes upstream gzip-compressed, with Content-Encoding: gzip
+// and its new Content-Length. Bodies that already carry a
+// Content-Encoding (a client's gzip body the rewrite couldn't decode) and
+// spilled ones are sent as they are, and so is a body that doesn't get
+// smaller. The compressed bytes are also what GetBody replays, should the
+// transport resend the request. 0 turns it off, for gateways that refuse
+// compressed request bodies.
+
+// upstreamGzip compresses request bodies past a threshold.
+type upstreamGzip struct {
+	threshold int64
+	level     int
+	writers   sync.Pool // *gzip.Writer at level
+
+	compressed atomic.Int64
+	skipped    atomic.Int64 // no smaller compressed
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+}
+
+func newUpstreamGzip(opts Options) (*upstreamGzip, error) {
+	if opts.UpstreamGzip <= 0 {
+		return nil, nil
+	}
+	// reject a bad level up front rather than on the first large body
+	if _, err := gzip.NewWriterLevel(io.Discard, opts.UpstreamGzipLevel); err != nil {
+		return nil, err
+	}
+	return &upstreamGzip{threshold: opts.UpstreamGzip, level: opts.UpstreamGzipLevel}, nil
+}
+
+func (p *Proxy) upstreamGzipStats() any {
+	g := p.gzip
+	if g == nil {
+		return map[string]any{"enabled": false}
+	}
+	in, out := g.bytesIn.Load(), g.bytesOut.Load()
+	ratio := 0.0
+	if in > 0 {
+		ratio = float64(out) / float64(in)
+	}
+	return map[string]any{
+		"enabled":    true,
+		"threshold":  g.threshold,
+		"level":      g.level,
+		"compressed": g.compressed.Load(),
+		"skipped":    g.skipped.Load(),
+		"bytes_in":   in,
+		"bytes_out":  out,
+		"ratio":      ratio,
+	}
+}
+
+func (g *upstreamGzip) writer(w io.Writer) *gzip.Writer {
+	if zw, ok := g.writers.Get().(*gzip.Writer); ok {
+		zw.Reset(w)
+		return zw
+	}
+	zw, _ := gzip.NewWriterLevel(w, g.level) // level checked in newUpstreamGzip
+	return zw
+}
+
+// compress replaces the body of r, when it is buffered and large enough,
+// with its gzip encoding.
+func (g *upstreamGzip) compress(r *http.Request, route string) {
+	pb, ok := r.Body.(*pooledBody)
+	if !ok || pb.b == nil || int64(pb.b.Len()) < g.threshold || r.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	bs := pb.b.Bytes()
+	// not pooled: GetBody may replay it after the transport closed the body
+	var zb bytes.Buffer
+	zb.Grow(len(bs) / 4)
+	zw := g.writer(&zb)
+	_, err := zw.Write(bs)
+	if err == nil {
+		err = zw.Close()
+	}
+	g.writers.Put(zw)
+	if err != nil || zb.Len() >= len(bs) {
+		g.skipped.Add(1)
+		traceOf(r.Context()).log("upstream_gzip", "skipped", true, "bytes", len(bs), "error", err)
+		return
+	}
+	g.compressed.Add(1)
+	g.bytesIn.Add(int64(len(bs)))
+	g.bytesOut.Add(int64(zb.Len()))
+	logOf(r.Context()).Debug("upstream gzip: request body compressed", "route", route, "bytes", len(bs),
+		"compressed", zb.Len(), "ratio", strconv.FormatFloat(float64(zb.Len())/float64(len(bs)), 'f', 3, 64))
+
+	traceOf(r.Context()).log("upstream_gzip", "bytes", len(bs), "compressed", zb.Len())
+
+	out := zb.Bytes()
+	lease := pb.lease.detach()
+	lease.resize(len(out))
+	pb.Close()
+	r.Body = &gzipBody{r: bytes.NewReader(out), lease: lease}
+	r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(out)), nil }
+	r.ContentLength = int64(len(out))
+	r.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	r.Header.Set("Content-Encoding", "gzip")
+}
+
+// gzipBody is a compressed request body, holding the original's budget
+// lease (resized) until it is closed.
+type gzipBody struct {
+	r     *bytes.Reader
+	lease budgetLease
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) { return b.r.Read(p) }
+
+func (b *gzipBody) Close() error {
+	b.lease.release()
+	return nil
+}
@@ -0,0 +1,313 @@
+package reserve
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every upstream request is traced (net/http/httptrace): whether its
+// connection was reused, and the time spent getting a connection, on DNS,
+// TCP connect, the TLS handshake and waiting for the server. The phases
+// are aggregated in the upstream_conns stats section; with
+// Options.ConnTraceHeader the breakdown of each request also goes back to
+// the caller in X-Reserve-Conn. When the proxy builds its own transport,
+// its dialer counts the open connections and those idle in the pool
+// (HTTP/1 only, HTTP/2 connections are shared rather than pooled). The
+// wait for the server is also kept as a moving average, the upstream's
+// current latency, logged at debug level with each response; when
+// balancing, each upstream keeps its own, see balance.go.
+
+const connTraceHeader = "X-Reserve-Conn"
+
+// phaseStat aggregates one phase's durations.
+type phaseStat struct {
+	n, total, max atomic.Int64 // total and max in ns
+}
+
+func (s *phaseStat) add(d time.Duration) {
+	s.n.Add(1)
+	s.total.Add(int64(d))
+	for {
+		m := s.max.Load()
+		if int64(d) <= m || s.max.CompareAndSwap(m, int64(d)) {
+			return
+		}
+	}
+}
+
+// ewma is an exponentially weighted moving average of durations, each new
+// sample weighing ewmaWeight; 0 before the first.
+type ewma struct{ ns atomic.Int64 }
+
+const ewmaWeight = 0.2
+
+func (e *ewma) add(d time.Duration) {
+	for {
+		old := e.ns.Load()
+		v := int64(d)
+		if old != 0 {
+			v = old + int64(ewmaWeight*float64(int64(d)-old))
+		}
+		if e.ns.CompareAndSwap(old, v) {
+			return
+		}
+	}
+}
+
+func (e *ewma) load() time.Duration { return time.Duration(e.ns.Load()) }
+
+func (s *phaseStat) view() map[string]any {
+	n := s.n.Load()
+	avg := 0.0
+	if n > 0 {
+		avg = float64(s.total.Load()) / float64(n) / 1e6
+	}
+	return map[string]any{"count": n, "avg_ms": avg, "max_ms": float64(s.max.Load()) / 1e6}
+}
+
+// connStats aggregates the traces of a Proxy's upstream requests.
+type connStats struct {
+	requests, reused, wasIdle atomic.Int64
+	dialErrors, tlsErrors     atomic.Int64
+	protocols                 sync.Map // negotiated protocol -> *atomic.Int64
+
+	getConn, dns, connect, tls, server phaseStat
+	serverEWMA                         ewma
+
+	// notes the upstream's certificate chains, see tlserror.go
+	certs *upstreamTLS
+
+	// set by the counting dialer, see dial
+	counted    bool
+	open, idle atomic.Int64
+}
+
+func (p *Proxy) upstreamConnStats() any {
+	c := p.conns
+	protos := map[string]int64{}
+	c.protocols.Range(func(k, v any) bool {
+		protos[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+	req, reused := c.requests.Load(), c.reused.Load()
+	out := map[string]any{
+		"requests":     req,
+		"new":          req - reused,
+		"reused":       reused,
+		"was_idle":     c.wasIdle.Load(),
+		"dial_errors":  c.dialErrors.Load(),
+		"tls_errors":   c.tlsErrors.Load(),
+		"protocols":    protos,
+		"get_conn":     c.getConn.view(),
+		"dns":          c.dns.view(),
+		"connect":      c.connect.view(),
+		"tls":          c.tls.view(),
+		"server":       c.server.view(),
+		"target":       p.target.Host,
+		"ttfb_ewma_ms": float64(c.serverEWMA.load()) / 1e6,
+	}
+	if c.counted {
+		out["open"] = c.open.Load()
+		out["idle"] = c.idle.Load()
+	}
+	return out
+}
+
+// dial wraps the transport's dialer to count open and idle connections.
+func (c *connStats) dial(d func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	c.counted = true
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := d(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c.open.Add(1)
+		// idle until a request gets it: the transport pools a connection
+		// dialed for a request that meanwhile got another one
+		cc := &countedConn{Conn: conn, c: c}
+		cc.setIdle(true)
+		return cc, nil
+	}
+}
+
+// countedConn is an upstream connection of the counting dialer.
+type countedConn struct {
+	net.Conn
+	c      *connStats
+	idle   atomic.Bool
+	closed atomic.Bool
+}
+
+func (cc *countedConn) setIdle(idle bool) {
+	if cc.closed.Load() || cc.idle.Swap(idle) == idle {
+		return
+	}
+	if idle {
+		cc.c.idle.Add(1)
+	} else {
+		cc.c.idle.Add(-1)
+	}
+}
+
+func (cc *countedConn) Close() error {
+	if !cc.closed.Swap(true) {
+		cc.c.open.Add(-1)
+		if cc.idle.Swap(false) {
+			cc.c.idle.Add(-1)
+		}
+	}
+	return cc.Conn.Close()
+}
+
+// connTiming is one request's trace. The transport calls the hooks from
+// its dial, write and read goroutines, hence mu.
+type connTiming struct {
+	mu sync.Mutex
+
+	start, dnsStart, connectStart, tlsStart, wrote time.Time
+
+	conn                       *countedConn
+	reused, wasIdle            bool
+	idleTime                   time.Duration
+	proto                      string
+	getConn, dns, connect, tls time.Duration
+	server                     time.Duration
+	done                       bool // the server phase is in
+}
+
+func (t *connTiming) set(at *time.Time) {
+	t.mu.Lock()
+	*at = time.Now()
+	t.mu.Unlock()
+}
+
+// withTrace adds the connection trace of one request to r, noted in st.
+func (c *connStats) withTrace(r *http.Request, st *reqState) *http.Request {
+	t := &connTiming{}
+	st.conn = t
+	trace := &httptrace.ClientTrace{
+		GetConn:  func(string) { t.set(&t.start) },
+		DNSStart: func(httptrace.DNSStartInfo) { t.set(&t.dnsStart) },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dns = time.Since(t.dnsStart)
+			c.dns.add(t.dns)
+		},
+		ConnectStart: func(string, string) { t.set(&t.connectStart) },
+		ConnectDone: func(_, _ string, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if err != nil {
+				c.dialErrors.Add(1)
+				return
+			}
+			t.connect = time.Since(t.connectStart)
+			c.connect.add(t.connect)
+		},
+		TLSHandshakeStart: func() { t.set(&t.tlsStart) },
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			if c.certs != nil {
+				c.certs.handshake(cs, err)
+			}
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if err != nil {
+				c.tlsErrors.Add(1)
+				return
+			}
+			t.tls = time.Since(t.tlsStart)
+			c.tls.add(t.tls)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if !t.start.IsZero() {
+				t.getConn = time.Since(t.start)
+				c.getConn.add(t.getConn)
+			}
+			t.reused, t.wasIdle, t.idleTime = info.Reused, info.WasIdle, info.IdleTime
+			c.requests.Add(1)
+			if info.Reused {
+				c.reused.Add(1)
+			}
+			if info.WasIdle {
+				c.wasIdle.Add(1)
+			}
+			conn := info.Conn
+			t.proto = "http/1.1"
+			if tc, ok := conn.(*tls.Conn); ok {
+				if np := tc.ConnectionState().NegotiatedProtocol; np != "" {
+					t.proto = np
+				}
+				conn = tc.NetConn()
+			}
+			v, _ := c.protocols.LoadOrStore(t.proto, new(atomic.Int64))
+			v.(*atomic.Int64).Add(1)
+			if cc, ok := conn.(*countedConn); ok {
+				t.conn = cc
+				cc.setIdle(false)
+			}
+		},
+		PutIdleConn: func(err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if err == nil && t.conn != nil {
+				t.conn.setIdle(true)
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) { t.set(&t.wrote) },
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if !t.wrote.IsZero() && !t.done {
+				t.done = true
+				t.server = time.Since(t.wrote)
+				c.server.add(t.server)
+				c.serverEWMA.add(t.server)
+				if st.upstream != nil {
+					st.upstream.ttfb.add(t.server)
+				}
+			}
+		},
+	}
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+}
+
+// serverTime is how long the server took to answer, 0 until it did.
+func (t *connTiming) serverTime() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.server
+}
+
+// header is t as X-Reserve-Conn: "reused=1; idle=1.2s; get_conn=0.1ms;
+// dns=0ms; connect=0ms; tls=0ms; server=512ms; proto=h2".
+func (t *connTiming) header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ms := func(d time.Duration) string { return d.Round(10 * time.Microsecond).String() }
+	var b strings.Builder
+	if t.reused {
+		b.WriteString("reused=1")
+	} else {
+		b.WriteString("reused=0")
+	}
+	if t.wasIdle {
+		b.WriteString("; idle=" + ms(t.idleTime))
+	}
+	b.WriteString("; get_conn=" + ms(t.getConn))
+	b.WriteString("; dns=" + ms(t.dns))
+	b.WriteString("; connect=" + ms(t.connect))
+	b.WriteString("; tls=" + ms(t.tls))
+	b.WriteString("; server=" + ms(t.server))
+	b.WriteString("; proto=" + t.proto)
+	return b.String()
+}
@@ -0,0 +1,94 @@
+package reserve
+
+import (
+	"maps"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The rewrite reads a body as JSON text, which is UTF-8 (RFC 8259). A
+// client posting anything else to a rewrite route, multipart or protobuf
+// through a gateway shim, or NDJSON, had it buffered and scanned for
+// nothing. The rewrite now runs only on application/json bodies, with no
+// charset or utf-8 (or us-ascii, a subset); any other body goes upstream
+// as it came, unbuffered. A body without a Content-Type is still read as
+// JSON, as it always was. Each distinct content type let by is logged
+// once, the first time a rewrite route sees it.
+
+// most distinct content types the counts are kept for, the rest as "other"
+const maxBypassedContentTypes = 64
+
+type contentTypeCounts struct {
+	bypassed atomic.Int64
+
+	mu     sync.Mutex
+	byType map[string]int64
+}
+
+// jsonBody reports whether a body of Content-Type ct is read as JSON, and
+// if not the media type, with the charset when that is why.
+func jsonBody(ct string) (bool, string) {
+	if ct == "" {
+		return true, ""
+	}
+	mt, params, err := mime.ParseMediaType(ct)
+	if mt == "" {
+		// unparsable; the type is what comes before any parameter
+		mt, _, _ = strings.Cut(ct, ";")
+		mt, _, _ = strings.Cut(mt, ",")
+		mt = strings.ToLower(strings.TrimSpace(mt))
+		switch {
+		case mt == "":
+			mt = "invalid"
+		case len(mt) > 64:
+			mt = mt[:64]
+		}
+	}
+	if mt != "application/json" {
+		return false, mt
+	}
+	if err != nil {
+		return true, ""
+	}
+	switch cs := strings.ToLower(params["charset"]); cs {
+	case "", "utf-8", "utf8", "us-ascii":
+		return true, ""
+	default:
+		return false, mt + "; charset=" + cs
+	}
+}
+
+// bypass counts a body of media type mt sent to rt as it came, and logs
+// the first of each type.
+func (c *contentTypeCounts) bypass(req *http.Request, rt *route, mt string) {
+	c.bypassed.Add(1)
+	c.mu.Lock()
+	if c.byType == nil {
+		c.byType = map[string]int64{}
+	}
+	k := mt
+	if _, ok := c.byType[k]; !ok && len(c.byType) >= maxBypassedContentTypes {
+		k = "other"
+	}
+	c.byType[k]++
+	first := k == mt && c.byType[k] == 1
+	c.mu.Unlock()
+	if first {
+		logOf(req.Context()).Warn("request body is not JSON, forwarded without the rewrite",
+			"content_type", mt, "route", rt.name)
+	}
+	traceOf(req.Context()).log("content_type", "bypassed", mt)
+}
+
+func (rr *Rewriter) contentTypeStats() any {
+	c := &rr.contentTypes
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]any{
+		"bypassed": c.bypassed.Load(),
+		"by_type":  maps.Clone(c.byType),
+	}
+}
@@ -0,0 +1,123 @@
+package reserve
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSONBody(t *testing.T) {
+	for _, tc := range []struct {
+		ct   string
+		json bool
+		mt   string
+	}{
+		{"", true, ""},
+		{"application/json", true, ""},
+		{"Application/JSON", true, ""},
+		{"application/json; charset=utf-8", true, ""},
+		{"application/json; charset=UTF-8", true, ""},
+		{"application/json;charset=utf8", true, ""},
+		{"application/json; charset=us-ascii", true, ""},
+		{`application/json; charset="utf-8"`, true, ""},
+		{"application/json; charset=utf-16", false, "application/json; charset=utf-16"},
+		{"application/json; charset=ISO-8859-1", false, "application/json; charset=iso-8859-1"},
+		{"application/json; charset", true, ""},
+		{"multipart/form-data; boundary=x", false, "multipart/form-data"},
+		{"application/x-ndjson", false, "application/x-ndjson"},
+		{"application/protobuf", false, "application/protobuf"},
+		{"text/plain", false, "text/plain"},
+		// application/json with parameters past parsing is still JSON
+		{"application/json, text/plain", true, ""},
+		{"text/plain, application/json", false, "text/plain"},
+		{";", false, "invalid"},
+	} {
+		json, mt := jsonBody(tc.ct)
+		if json != tc.json || mt != tc.mt {
+			t.Errorf("jsonBody(%q) = %v, %q, want %v, %q", tc.ct, json, mt, tc.json, tc.mt)
+		}
+	}
+}
+
+func TestContentTypeBypass(t *testing.T) {
+	var logBuf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logBuf, nil)))
+
+	rr := NewRewriter(DefaultOptions())
+	const multipart = "--x\r\nContent-Disposition: form-data; name=\"input\"\r\n\r\nhi\r\n--x--\r\n"
+	const ndjson = "{\"input\":\"a\"}\n{\"input\":\"b\"}\n"
+	for _, tc := range []struct {
+		name, ct, body string
+		rewritten      bool
+	}{
+		{"multipart", "multipart/form-data; boundary=x", multipart, false},
+		{"multipart again", "multipart/form-data; boundary=y", multipart, false},
+		{"ndjson", "application/x-ndjson", ndjson, false},
+		{"JSON in UTF-16", "application/json; charset=utf-16", `{"input":"hi"}`, false},
+		{"no Content-Type", "", `{"input":"hi"}`, true},
+		{"JSON in UTF-8", "application/json; charset=UTF-8", `{"input":"hi"}`, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body := io.NopCloser(strings.NewReader(tc.body))
+			req := httptest.NewRequest("POST", "/v1/responses", nil)
+			req.Body = body
+			if tc.ct != "" {
+				req.Header.Set("Content-Type", tc.ct)
+			}
+			req.Header.Set("Authorization", "Bearer sk-a")
+			if _, err := rr.RewriteRequest(req); err != nil {
+				t.Fatalf("RewriteRequest: %v", err)
+			}
+			if !tc.rewritten {
+				if req.Body != body {
+					t.Error("body replaced, want it forwarded as it came, unread")
+				}
+				return
+			}
+			out, _ := io.ReadAll(req.Body)
+			if decodeBody(t, out)["prompt_cache_key"] != cacheKey("Bearer sk-a") {
+				t.Errorf("forwarded %s, want it rewritten", out)
+			}
+		})
+	}
+
+	st := rr.contentTypeStats().(map[string]any)
+	byType := st["by_type"].(map[string]int64)
+	if st["bypassed"] != int64(4) || byType["multipart/form-data"] != 2 || byType["application/x-ndjson"] != 1 ||
+		byType["application/json; charset=utf-16"] != 1 || len(byType) != 3 {
+		t.Errorf("content_types stats = %v", st)
+	}
+	// once per distinct type
+	if n := strings.Count(logBuf.String(), "not JSON"); n != 3 {
+		t.Errorf("logged %d times, want once for each of 3 types:\n%s", n, logBuf.String())
+	}
+}
+
+func TestContentTypeChatRefused(t *testing.T) {
+	u := newTestUpstream(t, nil)
+	p := newTestProxy(t, DefaultOptions(), u)
+	w := send(p, "POST", chatPath, http.Header{"Content-Type": {"text/plain"}}, `{"messages":[]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("text/plain chat.completions answered %d, want 400", w.Code)
+	}
+	if n := len(u.requests()); n != 0 {
+		t.Errorf("upstream got %d requests, want none", n)
+	}
+}
+
+func TestContentTypeBypassCap(t *testing.T) {
+	var c contentTypeCounts
+	req := httptest.NewRequest("POST", "/v1/responses", nil)
+	rt := &routes[0]
+	for i := range maxBypassedContentTypes + 5 {
+		c.bypass(req, rt, "application/x-"+strings.Repeat("a", i+1))
+	}
+	if len(c.byType) != maxBypassedContentTypes+1 || c.byType["other"] != 5 {
+		t.Errorf("kept %d types, other %d, want %d and 5", len(c.byType), c.byType["other"], maxBypassedContentTypes+1)
+	}
+}
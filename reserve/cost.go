@@ -0,0 +1,409 @@
+package reserve
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// With Options.Prices, the usage of every response (rewritten routes,
+// usage routes and attributed background responses) is priced and the
+// cost charged to the client and the model: it goes on the usage log
+// line, into the cost stats section and, with CostHeader, into
+// X-Reserve-Estimated-Cost on non-streaming responses. A model missing
+// from the table is priced at the default and flagged as such wherever
+// its cost shows.
+//
+// ClientBudget (or a per-client entry in the table's budgets) caps what a
+// client may spend in a calendar month (UTC). Past it, a warning is logged
+// once for the month; with BudgetReject new requests get a 402 instead
+// until the month turns.
+
+// Price is a model's price in USD per million tokens. CachedInput is
+// charged for the cached part of the input; left out, it is Input.
+type Price struct {
+	Input       float64 `json:"input"`
+	CachedInput float64 `json:"cached_input"`
+	Output      float64 `json:"output"`
+}
+
+func (p *Price) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Input       float64  `json:"input"`
+		CachedInput *float64 `json:"cached_input"`
+		Output      float64  `json:"output"`
+	}
+	if err := sonic.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	p.Input, p.CachedInput, p.Output = raw.Input, raw.Input, raw.Output
+	if raw.CachedInput != nil {
+		p.CachedInput = *raw.CachedInput
+	}
+	return nil
+}
+
+// PriceTable prices usage by model. A model is looked up by its exact
+// name, then by the longest key it starts with, so "gpt-5" also prices
+// "gpt-5-2025-08-07"; anything else gets Default. Budgets sets the
+// monthly budget (USD) of single clients, by client id, over
+// Options.ClientBudget; 0 exempts a client.
+type PriceTable struct {
+	Models  map[string]Price   `json:"models"`
+	Default Price              `json:"default"`
+	Budgets map[string]float64 `json:"budgets,omitempty"`
+}
+
+// LoadPriceTable reads a PriceTable from the JSON file at path.
+func LoadPriceTable(path string) (*PriceTable, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &PriceTable{}
+	if err := sonic.Unmarshal(bs, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// lookup returns model's price and whether it came from Default.
+func (t *PriceTable) lookup(model string) (Price, bool) {
+	if p, ok := t.Models[model]; ok {
+		return p, false
+	}
+	best := ""
+	for k := range t.Models {
+		if len(k) > len(best) && strings.HasPrefix(model, k) {
+			best = k
+		}
+	}
+	if best != "" {
+		return t.Models[best], false
+	}
+	return t.Default, true
+}
+
+var errBudgetExceeded = &httpError{
+	status: http.StatusPaymentRequired,
+	code:   "budget_exceeded",
+	msg:    "this client's monthly budget is used up",
+}
+
+// costTracker adds up the estimated cost per model and per client. Costs
+// are kept in nano-USD so they add exactly.
+type costTracker struct {
+	prices *PriceTable
+	budget float64
+	reject bool
+
+	mu      sync.Mutex
+	models  map[string]*modelSpend
+	clients map[string]*clientSpend
+
+	fallback atomic.Int64 // responses priced at the default
+	rejected atomic.Int64
+	warned   atomic.Int64
+}
+
+type modelSpend struct {
+	requests, input, cached, output, nano int64
+	fallback                              bool
+}
+
+type clientSpend struct {
+	requests, nano int64
+	month          string // of monthNano
+	monthNano      int64
+	warned         bool // over budget logged for month
+}
+
+func newCostTracker(opts Options) *costTracker {
+	if opts.Prices == nil {
+		return nil
+	}
+	return &costTracker{
+		prices:  opts.Prices,
+		budget:  opts.ClientBudget,
+		reject:  opts.BudgetReject,
+		models:  map[string]*modelSpend{},
+		clients: map[string]*clientSpend{},
+	}
+}
+
+func costMonth(t time.Time) string { return t.UTC().Format("2006-01") }
+
+func nanoUSD(n int64) float64 { return float64(n) / 1e9 }
+
+// budgetOf is client's monthly budget in nano-USD, 0 for none.
+func (c *costTracker) budgetOf(client string) int64 {
+	b := c.budget
+	if v, ok := c.prices.Budgets[client]; ok {
+		b = v
+	}
+	return int64(math.Round(b * 1e9))
+}
+
+// spendLocked returns client's entry, moved on to month; mu is held.
+func (c *costTracker) spendLocked(client, month string) *clientSpend {
+	s := c.clients[client]
+	if s == nil {
+		s = &clientSpend{month: month}
+		c.clients[client] = s
+	}
+	if s.month != month {
+		s.month, s.monthNano, s.warned = month, 0, false
+	}
+	return s
+}
+
+// admit refuses a new request of client once its budget for the month is
+// spent, when budgets are enforced.
+func (c *costTracker) admit(client *clientIdentity) error {
+	if !c.reject || client == nil {
+		return nil
+	}
+	b := c.budgetOf(client.CacheKey)
+	if b <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	spent := c.spendLocked(client.CacheKey, costMonth(time.Now())).monthNano
+	c.mu.Unlock()
+	if spent < b {
+		return nil
+	}
+	c.rejected.Add(1)
+	return errBudgetExceeded
+}
+
+// responseCost is the estimated cost of one response.
+type responseCost struct {
+	nano     int64
+	fallback bool // priced at the default
+}
+
+func (rc responseCost) usd() string { return strconv.FormatFloat(nanoUSD(rc.nano), 'f', 6, 64) }
+
+// logAttrs are rc's attributes on the usage log line.
+func (rc responseCost) logAttrs() []any {
+	src := "model"
+	if rc.fallback {
+		src = "default"
+	}
+	return []any{"cost_usd", rc.usd(), "price", src}
+}
+
+// header is rc as X-Reserve-Estimated-Cost, USD with ";price=default"
+// when the model wasn't in the table.
+func (rc responseCost) header() string {
+	if rc.fallback {
+		return rc.usd() + ";price=default"
+	}
+	return rc.usd()
+}
+
+// tokenUsage is a usage object, in the Responses shape or the
+// chat.completions / embeddings one.
+type tokenUsage struct {
+	InputTokens        int64 `json:"input_tokens"`
+	OutputTokens       int64 `json:"output_tokens"`
+	PromptTokens       int64 `json:"prompt_tokens"`
+	CompletionTokens   int64 `json:"completion_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int64 `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+	PromptTokensDetails struct {
+		CachedTokens int64 `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+	// for the usage export only
+	TotalTokens         int64 `json:"total_tokens"`
+	OutputTokensDetails struct {
+		ReasoningTokens int64 `json:"reasoning_tokens"`
+	} `json:"output_tokens_details"`
+	CompletionTokensDetails struct {
+		ReasoningTokens int64 `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details"`
+}
+
+func (u *tokenUsage) counts() (input, cached, output int64) {
+	input, cached, output = u.InputTokens, u.InputTokensDetails.CachedTokens, u.OutputTokens
+	if input == 0 {
+		input, cached = u.PromptTokens, u.PromptTokensDetails.CachedTokens
+	}
+	if output == 0 {
+		output = u.CompletionTokens
+	}
+	return input, min(cached, input), output
+}
+
+// charge prices the usage object raw of a model response and adds it to
+// client and model. ok is false when raw isn't a usage object.
+func (c *costTracker) charge(client *clientIdentity, model, raw string) (rc responseCost, ok bool) {
+	var u tokenUsage
+	if sonic.UnmarshalString(raw, &u) != nil {
+		return rc, false
+	}
+	input, cached, output := u.counts()
+	price, fallback := c.prices.lookup(model)
+	// per million tokens, in nano-USD: tokens * price * 1e3
+	rc.nano = int64(math.Round((float64(input-cached)*price.Input +
+		float64(cached)*price.CachedInput + float64(output)*price.Output) * 1e3))
+	rc.fallback = fallback
+	if fallback {
+		c.fallback.Add(1)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := c.models[model]
+	if m == nil {
+		m = &modelSpend{fallback: fallback}
+		c.models[model] = m
+	}
+	m.requests++
+	m.input += input
+	m.cached += cached
+	m.output += output
+	m.nano += rc.nano
+	if client == nil {
+		return rc, true
+	}
+	s := c.spendLocked(client.CacheKey, costMonth(time.Now()))
+	s.requests++
+	s.nano += rc.nano
+	s.monthNano += rc.nano
+	if b := c.budgetOf(client.CacheKey); b > 0 && s.monthNano >= b && !s.warned {
+		s.warned = true
+		c.warned.Add(1)
+		slog.Warn("cost: client over its monthly budget", "client", client.CacheKey, "month", s.month,
+			"spent_usd", nanoUSD(s.monthNano), "budget_usd", nanoUSD(b), "reject", c.reject)
+	}
+	return rc, true
+}
+
+func (p *Proxy) costStats() any {
+	c := p.costs
+	if c == nil {
+		return map[string]any{"enabled": false}
+	}
+	month := costMonth(time.Now())
+	c.mu.Lock()
+	models := make(map[string]any, len(c.models))
+	for name, m := range c.models {
+		models[name] = map[string]any{
+			"requests":      m.requests,
+			"input_tokens":  m.input,
+			"cached_tokens": m.cached,
+			"output_tokens": m.output,
+			"cost_usd":      nanoUSD(m.nano),
+			"default_price": m.fallback,
+		}
+	}
+	clients := make(map[string]any, len(c.clients))
+	for id, s := range c.clients {
+		monthNano := s.monthNano
+		if s.month != month {
+			monthNano = 0
+		}
+		e := map[string]any{
+			"requests":       s.requests,
+			"cost_usd":       nanoUSD(s.nano),
+			"month_cost_usd": nanoUSD(monthNano),
+		}
+		if b := c.budgetOf(id); b > 0 {
+			e["budget_usd"] = nanoUSD(b)
+			e["over_budget"] = monthNano >= b
+		}
+		clients[id] = e
+	}
+	c.mu.Unlock()
+	return map[string]any{
+		"enabled":         true,
+		"month":           month,
+		"default_price":   c.prices.Default,
+		"client_budget":   c.budget,
+		"budget_reject":   c.reject,
+		"default_priced":  c.fallback.Load(),
+		"budget_warnings": c.warned.Load(),
+		"rejected":        c.rejected.Load(),
+		"models":          models,
+		"clients":         clients,
+	}
+}
+
+// counters adds the spend to m, for the store: per model and client the
+// totals, per client the current month.
+func (c *costTracker) counters(m map[string]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, s := range c.models {
+		m["cost.model.requests."+name] = s.requests
+		m["cost.model.input."+name] = s.input
+		m["cost.model.cached."+name] = s.cached
+		m["cost.model.output."+name] = s.output
+		m["cost.model.nano."+name] = s.nano
+	}
+	for id, s := range c.clients {
+		m["cost.client.requests."+id] = s.requests
+		m["cost.client.nano."+id] = s.nano
+		m["cost.client.month."+s.month+"."+id] = s.monthNano
+	}
+}
+
+// restore adds one saved counter; a month other than the current one is
+// over and dropped.
+func (c *costTracker) restore(k string, v int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rest, ok := strings.CutPrefix(k, "cost.model."); ok {
+		field, name, _ := strings.Cut(rest, ".")
+		s := c.models[name]
+		if s == nil {
+			_, fallback := c.prices.lookup(name)
+			s = &modelSpend{fallback: fallback}
+			c.models[name] = s
+		}
+		switch field {
+		case "requests":
+			s.requests += v
+		case "input":
+			s.input += v
+		case "cached":
+			s.cached += v
+		case "output":
+			s.output += v
+		case "nano":
+			s.nano += v
+		}
+		return
+	}
+	rest, ok := strings.CutPrefix(k, "cost.client.")
+	if !ok {
+		return
+	}
+	field, id, _ := strings.Cut(rest, ".")
+	month := costMonth(time.Now())
+	if field == "month" {
+		m, cid, _ := strings.Cut(id, ".")
+		if m == month {
+			c.spendLocked(cid, month).monthNano += v
+		}
+		return
+	}
+	s := c.spendLocked(id, month)
+	switch field {
+	case "requests":
+		s.requests += v
+	case "nano":
+		s.nano += v
+	}
+}
@@ -0,0 +1,283 @@
+package reserve
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// With Options.Dedup, identical non-streaming requests in flight at the
+// same time share one upstream request: a duplicate (same route, client
+// and rewritten body) arriving while the first is still waiting for
+// upstream is parked and answered with a copy of the same response.
+//
+// The shared upstream request belongs to no single client. It runs on a
+// context detached from the client that started it and is cancelled only
+// once every client waiting for it is gone, so the first client hanging up
+// doesn't cost the others their answer. The response is buffered whole and
+// then written to each client.
+
+var kStream = []byte(`"stream"`)
+
+// the capture error of a duplicate served a shared response that broke off
+var errDedupAborted = errors.New("the shared upstream response broke off")
+
+type dedupGroup struct {
+	wait time.Duration
+
+	mu    sync.Mutex
+	calls map[[sha256.Size]byte]*dedupCall
+
+	leaders   atomic.Int64
+	joined    atomic.Int64
+	served    atomic.Int64 // duplicates answered from a shared response
+	timedOut  atomic.Int64 // duplicates that gave up waiting and went on alone
+	abandoned atomic.Int64 // shared requests cancelled, nobody left waiting
+}
+
+// dedupCall is one shared upstream request. rec is complete once done is
+// closed; refs counts the clients still waiting and is guarded by the
+// group's mu.
+type dedupCall struct {
+	key    [sha256.Size]byte
+	done   chan struct{}
+	rec    *responseRecorder
+	refs   int
+	cancel context.CancelCauseFunc
+}
+
+func newDedupGroup(opts Options) *dedupGroup {
+	if !opts.Dedup {
+		return nil
+	}
+	return &dedupGroup{wait: opts.DedupWait, calls: map[[sha256.Size]byte]*dedupCall{}}
+}
+
+func (p *Proxy) dedupStats() any {
+	g := p.dedup
+	if g == nil {
+		return map[string]any{"enabled": false}
+	}
+	g.mu.Lock()
+	n := len(g.calls)
+	g.mu.Unlock()
+	return map[string]any{
+		"enabled":   true,
+		"wait":      g.wait.String(),
+		"in_flight": n,
+		"leaders":   g.leaders.Load(),
+		"joined":    g.joined.Load(),
+		"served":    g.served.Load(),
+		"timed_out": g.timedOut.Load(),
+		"abandoned": g.abandoned.Load(),
+	}
+}
+
+// serveDedup forwards r through a shared upstream request when its body is
+// a non-streaming rewritten one, and reports whether it answered r. On
+// false r is untouched and should be forwarded as usual.
+func (p *Proxy) serveDedup(w http.ResponseWriter, r *http.Request, st *reqState) bool {
+	g := p.dedup
+	pb, ok := r.Body.(*pooledBody)
+	if !ok || pb.b == nil {
+		return false
+	}
+	bs := pb.b.Bytes()
+	if isStreamBody(bs) {
+		return false
+	}
+	client := ""
+	if st.client != nil {
+		client = st.client.CacheKey
+	}
+	h := sha256.New()
+	h.Write([]byte(st.route.name))
+	h.Write([]byte{0})
+	h.Write([]byte(client))
+	h.Write([]byte{0})
+	h.Write(bs)
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		c.refs++
+		g.mu.Unlock()
+		g.joined.Add(1)
+		st.log.Info("dedup: duplicate joined an in-flight request", "route", st.route.name, "client", client)
+		st.wide.serve("dedup")
+		st.trace.log("dedup", "joined", true)
+		return p.awaitDedup(w, r, c, false)
+	}
+	c := &dedupCall{key: key, done: make(chan struct{}), refs: 1}
+	g.calls[key] = c
+	g.mu.Unlock()
+	g.leaders.Add(1)
+	st.trace.log("dedup", "leader", true)
+
+	// values (the request state) carry over, cancellation does not
+	ctx, cancel := context.WithCancelCause(context.WithoutCancel(r.Context()))
+	c.cancel = cancel
+	go p.runDedup(c, r.WithContext(ctx))
+	return p.awaitDedup(w, r, c, true)
+}
+
+// runDedup forwards the shared request and records the response. It has
+// its own RequestTimeout, as no client's timer applies to it.
+func (p *Proxy) runDedup(c *dedupCall, r *http.Request) {
+	if d := p.opts.RequestTimeout; d > 0 {
+		t := time.AfterFunc(d, func() { c.cancel(errRequestTimeout) })
+		defer t.Stop()
+	}
+	rec := &responseRecorder{header: http.Header{}}
+	defer func() {
+		if v := recover(); v != nil {
+			// the upstream body broke off; ReverseProxy aborts with
+			// ErrAbortHandler, which every waiting client now gets
+			if v != http.ErrAbortHandler {
+				logOf(r.Context()).Error("dedup: shared request panicked", "panic", v)
+			}
+			rec.aborted = true
+		}
+		g := p.dedup
+		g.mu.Lock()
+		if g.calls[c.key] == c {
+			delete(g.calls, c.key)
+		}
+		g.mu.Unlock()
+		c.rec = rec
+		close(c.done)
+		c.cancel(nil)
+	}()
+	p.upstream(rec, r, stateOf(r.Context()))
+}
+
+// awaitDedup waits for c's response and writes it to w. The leader's body
+// is the shared request's, closed by the transport; a duplicate's is its
+// own. A duplicate gives up after DedupWait and reports false, to be
+// forwarded on its own.
+func (p *Proxy) awaitDedup(w http.ResponseWriter, r *http.Request, c *dedupCall, leader bool) bool {
+	var expired <-chan time.Time
+	wait := p.dedup.wait
+	if !leader && wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-c.done:
+		if !leader {
+			r.Body.Close()
+			p.dedup.served.Add(1)
+			var err error
+			if c.rec.aborted {
+				err = errDedupAborted
+			}
+			p.capture.served(stateOf(r.Context()), "dedup", c.rec.status, c.rec.header, c.rec.body.Bytes(), err)
+		}
+		c.rec.writeTo(w)
+		return true
+	case <-r.Context().Done():
+		p.leaveDedup(c)
+		if !leader {
+			r.Body.Close()
+		}
+		if context.Cause(r.Context()) == errRequestTimeout {
+			writeHTTPError(w, errGatewayTimeout)
+		}
+		return true
+	case <-expired:
+		p.leaveDedup(c)
+		p.dedup.timedOut.Add(1)
+		logOf(r.Context()).Warn("dedup: duplicate stopped waiting, forwarding it on its own", "route", r.URL.Path, "wait", wait)
+		traceOf(r.Context()).log("dedup", "timed_out", true, "wait", wait, "decision", "forward alone")
+		return false
+	}
+}
+
+// leaveDedup drops a waiting client from c; the last one out cancels the
+// upstream request, unless it completed already.
+func (p *Proxy) leaveDedup(c *dedupCall) {
+	g := p.dedup
+	g.mu.Lock()
+	c.refs--
+	last := c.refs == 0
+	if last && g.calls[c.key] == c {
+		delete(g.calls, c.key)
+	}
+	g.mu.Unlock()
+	if !last {
+		return
+	}
+	select {
+	case <-c.done:
+	default:
+		g.abandoned.Add(1)
+		c.cancel(ErrClientGone)
+	}
+}
+
+// isStreamBody reports whether the request body bs sets stream: true.
+func isStreamBody(bs []byte) bool {
+	if !hasJSONKey(bs, kStream) {
+		return false
+	}
+	n, err := sonic.Get(bs, "stream")
+	if err != nil {
+		return false
+	}
+	b, _ := n.Bool()
+	return b
+}
+
+// responseRecorder buffers a whole response, for replay to any number of
+// clients.
+type responseRecorder struct {
+	header  http.Header
+	status  int
+	body    bytes.Buffer
+	aborted bool
+}
+
+func (rec *responseRecorder) Header() http.Header { return rec.header }
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	// 1xx responses are informational; only the final status is kept
+	if rec.status == 0 && code >= 200 {
+		rec.status = code
+	}
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+func (rec *responseRecorder) Flush() {}
+
+// writeTo replays the response on w. A response that broke off aborts w's
+// connection too, as a direct request would have.
+func (rec *responseRecorder) writeTo(w http.ResponseWriter) {
+	if rec.aborted {
+		panic(http.ErrAbortHandler)
+	}
+	h := w.Header()
+	for k, vs := range rec.header {
+		h[k] = append([]string(nil), vs...)
+	}
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(rec.body.Bytes())
+}
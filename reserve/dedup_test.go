@@ -0,0 +1,224 @@
+package reserve
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// heldUpstream answers every request once release is closed; started
+// gets a value as each request arrives and gone one as each request's
+// context ends before release.
+type heldUpstream struct {
+	*testUpstream
+	started, gone chan struct{}
+	release       chan struct{}
+}
+
+func newHeldUpstream(t *testing.T) *heldUpstream {
+	u := &heldUpstream{started: make(chan struct{}, 8), gone: make(chan struct{}, 8), release: make(chan struct{})}
+	u.testUpstream = newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		u.started <- struct{}{}
+		select {
+		case <-u.release:
+		case <-r.Context().Done():
+			u.gone <- struct{}{}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"resp_1","object":"response"}`)
+	})
+	return u
+}
+
+func dedupProxy(t *testing.T, u *heldUpstream, wait time.Duration) *Proxy {
+	opts := DefaultOptions()
+	opts.Dedup, opts.DedupWait = true, wait
+	return newTestProxy(t, opts, u.testUpstream)
+}
+
+// dedupStat is one of p's dedup counters.
+func dedupStat(p *Proxy, name string) any {
+	return p.Stats()["dedup"].(map[string]any)[name]
+}
+
+// waitFor polls cond for up to 5s.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func before(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+type dedupClient struct {
+	w      *httptest.ResponseRecorder
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+// dedupSend serves body as sk-a on its own goroutine.
+func dedupSend(p *Proxy, body string) *dedupClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &dedupClient{w: httptest.NewRecorder(), done: make(chan struct{}), cancel: cancel}
+	req := httptest.NewRequest("POST", "/v1/responses", strings.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer sk-a")
+	go func() {
+		defer close(c.done)
+		p.ServeHTTP(c.w, req)
+	}()
+	return c
+}
+
+const dedupBody = `{"model":"gpt-5","input":"hi"}`
+
+func TestDedupSharesResponse(t *testing.T) {
+	u := newHeldUpstream(t)
+	p := dedupProxy(t, u, time.Minute)
+	leader := dedupSend(p, dedupBody)
+	before(t, u.started, "the leader upstream")
+	dup := dedupSend(p, dedupBody)
+	waitFor(t, "the duplicate to join", func() bool { return dedupStat(p, "joined") == int64(1) })
+	close(u.release)
+	before(t, leader.done, "the leader")
+	before(t, dup.done, "the duplicate")
+
+	for _, c := range []*dedupClient{leader, dup} {
+		if c.w.Code != http.StatusOK || c.w.Body.String() != `{"id":"resp_1","object":"response"}` {
+			t.Errorf("answered %d %s", c.w.Code, c.w.Body)
+		}
+	}
+	if n := len(u.requests()); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+	if dedupStat(p, "served") != int64(1) || dedupStat(p, "in_flight") != 0 {
+		t.Errorf("dedup stats %v", p.Stats()["dedup"])
+	}
+}
+
+func TestDedupLeaderCancelled(t *testing.T) {
+	u := newHeldUpstream(t)
+	p := dedupProxy(t, u, time.Minute)
+	leader := dedupSend(p, dedupBody)
+	before(t, u.started, "the leader upstream")
+	dup := dedupSend(p, dedupBody)
+	waitFor(t, "the duplicate to join", func() bool { return dedupStat(p, "joined") == int64(1) })
+
+	// the leader hangs up; the shared request goes on for the duplicate
+	leader.cancel()
+	before(t, leader.done, "the leader")
+	select {
+	case <-u.gone:
+		t.Fatal("the shared upstream request was cancelled with the leader")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(u.release)
+	before(t, dup.done, "the duplicate")
+	if dup.w.Code != http.StatusOK || !strings.Contains(dup.w.Body.String(), "resp_1") {
+		t.Errorf("duplicate answered %d %s", dup.w.Code, dup.w.Body)
+	}
+	if dedupStat(p, "abandoned") != int64(0) {
+		t.Errorf("abandoned = %v, want 0", dedupStat(p, "abandoned"))
+	}
+}
+
+func TestDedupAllCancelled(t *testing.T) {
+	u := newHeldUpstream(t)
+	defer close(u.release)
+	p := dedupProxy(t, u, time.Minute)
+	leader := dedupSend(p, dedupBody)
+	before(t, u.started, "the leader upstream")
+	dup := dedupSend(p, dedupBody)
+	waitFor(t, "the duplicate to join", func() bool { return dedupStat(p, "joined") == int64(1) })
+
+	dup.cancel()
+	before(t, dup.done, "the duplicate")
+	leader.cancel()
+	before(t, leader.done, "the leader")
+	before(t, u.gone, "the shared upstream request to be cancelled")
+	waitFor(t, "the call to be dropped", func() bool { return dedupStat(p, "in_flight") == 0 })
+	if dedupStat(p, "abandoned") != int64(1) {
+		t.Errorf("abandoned = %v, want 1", dedupStat(p, "abandoned"))
+	}
+
+	// a new request starts over rather than joining the cancelled one
+	next := dedupSend(p, dedupBody)
+	before(t, u.started, "a new upstream request")
+	next.cancel()
+	before(t, next.done, "the new request")
+}
+
+func TestDedupWaitExpires(t *testing.T) {
+	u := newHeldUpstream(t)
+	p := dedupProxy(t, u, 50*time.Millisecond)
+	leader := dedupSend(p, dedupBody)
+	before(t, u.started, "the leader upstream")
+	dup := dedupSend(p, dedupBody)
+	// the duplicate gives up and goes upstream itself
+	before(t, u.started, "the duplicate upstream")
+	close(u.release)
+	before(t, leader.done, "the leader")
+	before(t, dup.done, "the duplicate")
+	if n := len(u.requests()); n != 2 {
+		t.Errorf("upstream got %d requests, want 2", n)
+	}
+	if dedupStat(p, "timed_out") != int64(1) || dup.w.Code != http.StatusOK {
+		t.Errorf("duplicate answered %d, stats %v", dup.w.Code, p.Stats()["dedup"])
+	}
+}
+
+func TestDedupExclusions(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		a, b    string
+		authB   string
+		wantUps int
+	}{
+		{"streams", `{"input":"hi","stream":true}`, `{"input":"hi","stream":true}`, "Bearer sk-a", 2},
+		{"other body", `{"input":"hi"}`, `{"input":"ho"}`, "Bearer sk-a", 2},
+		{"other client", `{"input":"hi"}`, `{"input":"hi"}`, "Bearer sk-b", 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := newHeldUpstream(t)
+			p := dedupProxy(t, u, time.Minute)
+			var wg sync.WaitGroup
+			for i, body := range []string{tc.a, tc.b} {
+				auth := "Bearer sk-a"
+				if i == 1 {
+					auth = tc.authB
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					send(p, "POST", "/v1/responses", http.Header{"Authorization": {auth}}, body)
+				}()
+				before(t, u.started, "an upstream request")
+			}
+			close(u.release)
+			wg.Wait()
+			if n := len(u.requests()); n != tc.wantUps {
+				t.Errorf("upstream got %d requests, want %d", n, tc.wantUps)
+			}
+			if dedupStat(p, "joined") != int64(0) {
+				t.Errorf("joined = %v, want 0", dedupStat(p, "joined"))
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package reserve
+
+import (
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/ast"
+)
+
+// The developer_message hook puts the DeveloperMessage of Options.Policy
+// first in the input of every request that starts a conversation (one
+// continuing it by previous_response_id or conversation has it already).
+// The message is a text/template over developerVars: {{.Date}},
+// {{.ClientName}} (the client's entry in ClientNames), {{.Env}} and
+// {{.Model}}. It is parsed, and tried once, when the policy is loaded, so
+// a bad template or an unknown variable fails then; one that still fails
+// to render at request time is sent as written, with a warning.
+
+// developerVars are the variables of a policy's DeveloperMessage.
+type developerVars struct {
+	Date       string // today, YYYY-MM-DD in the proxy's time zone
+	ClientName string // ClientNames[client id], "" for none
+	Env        string // the policy's Env
+	Model      string // the request's model
+}
+
+// parseDeveloperMessage parses p's DeveloperMessage, once.
+func (p *RequestPolicy) parseDeveloperMessage() error {
+	if p.DeveloperMessage == "" || p.devTmpl != nil {
+		return nil
+	}
+	t, err := template.New("developer_message").Parse(p.DeveloperMessage)
+	if err != nil {
+		return err
+	}
+	// a field developerVars doesn't have only shows when executed
+	if err := t.Execute(io.Discard, developerVars{}); err != nil {
+		return err
+	}
+	p.devTmpl = t
+	return nil
+}
+
+// renderDeveloperMessage is p's DeveloperMessage for the request of model
+// by client; on a render error, the template as written.
+func (p *RequestPolicy) renderDeveloperMessage(client, model string) (string, error) {
+	var b strings.Builder
+	b.Grow(len(p.DeveloperMessage) + 32)
+	err := p.devTmpl.Execute(&b, developerVars{
+		Date:       time.Now().Format(time.DateOnly),
+		ClientName: p.ClientNames[client],
+		Env:        p.Env,
+		Model:      model,
+	})
+	if err != nil {
+		return p.DeveloperMessage, err
+	}
+	return b.String(), nil
+}
+
+func developerMessageHook(r *Request) error {
+	rr := r.rw.rr
+	p := rr.opts.Policy
+	if p == nil || p.devTmpl == nil {
+		return nil
+	}
+	bs := r.Body()
+	if hasJSONKey(bs, kPrevRespIDKey) || conversationID(bs) != "" {
+		return nil
+	}
+	var model *ast.Node
+	if r.parsed {
+		model = r.root.Get("model")
+	} else {
+		m, _ := sonic.Get(bs, "model")
+		model = &m
+	}
+	client := rr.derivePromptCacheKey(r.HTTP, "")
+	msg, err := p.renderDeveloperMessage(client, nodeString(model))
+	if err != nil {
+		rr.policy.devErrors.Add(1)
+		r.Logger().Warn("policy: developer_message render failed, sent as written", "error", err)
+	}
+	root, jerr := r.JSON()
+	if root == nil {
+		return jerr
+	}
+	prependInput(root, ast.NewObject([]ast.Pair{
+		ast.NewPair("role", ast.NewString("developer")),
+		ast.NewPair("content", ast.NewString(msg)),
+	}))
+	rr.policy.devMessages.Add(1)
+	traceOf(r.HTTP.Context()).log("developer_message", "bytes", len(msg), "client_name", p.ClientNames[client] != "",
+		"render_error", err)
+	return nil
+}
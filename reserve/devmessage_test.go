@@ -0,0 +1,127 @@
+package reserve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDeveloperMessage = "Today is {{.Date}}. You are helping {{.ClientName}} in {{.Env}} on {{.Model}}."
+
+func devPolicy(t testing.TB, msg string) *RequestPolicy {
+	t.Helper()
+	p := &RequestPolicy{
+		DeveloperMessage: msg,
+		ClientNames:      map[string]string{cacheKey("Bearer sk-a"): "Ada"},
+		Env:              "staging",
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestDeveloperMessage(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Policy = devPolicy(t, testDeveloperMessage)
+	rr := NewRewriter(opts)
+	for _, tc := range []struct {
+		name string
+		hdr  http.Header
+		body string
+		want string // the developer message, "" for none
+	}{
+		{"named client", bearer("sk-a"), `{"model":"gpt-5","input":"hi"}`,
+			"You are helping Ada in staging on gpt-5."},
+		{"unnamed client", bearer("sk-b"), `{"model":"gpt-5","input":"hi"}`,
+			"You are helping  in staging on gpt-5."},
+		{"no model", bearer("sk-a"), `{"input":"hi"}`,
+			"You are helping Ada in staging on ."},
+		{"continued", bearer("sk-a"), `{"model":"gpt-5","input":"hi","previous_response_id":"resp_1"}`, ""},
+		{"in a conversation", bearer("sk-a"), `{"model":"gpt-5","input":"hi","conversation":"conv_1"}`, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, out := rewrite(t, rr, "/v1/responses", tc.hdr, []byte(tc.body))
+			in, _ := decodeBody(t, out)["input"].([]any)
+			var first map[string]any
+			if len(in) > 0 {
+				first, _ = in[0].(map[string]any)
+			}
+			if tc.want == "" {
+				if first["role"] == "developer" {
+					t.Errorf("forwarded %s, want no developer message", out)
+				}
+				return
+			}
+			content, _ := first["content"].(string)
+			if first["role"] != "developer" || !strings.HasPrefix(content, "Today is "+time.Now().Format(time.DateOnly)) ||
+				!strings.HasSuffix(content, tc.want) {
+				t.Errorf("forwarded %s, want a developer message ending %q", out, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeveloperMessageRenderError(t *testing.T) {
+	// fine for the empty variables tried at load, failing for a short name
+	opts := DefaultOptions()
+	opts.Policy = devPolicy(t, "{{if .ClientName}}{{index .ClientName 10}}{{end}}hello")
+	rr := NewRewriter(opts)
+	_, out := rewrite(t, rr, "/v1/responses", bearer("sk-a"), []byte(`{"input":"hi"}`))
+	in, _ := decodeBody(t, out)["input"].([]any)
+	if len(in) == 0 || in[0].(map[string]any)["content"] != opts.Policy.DeveloperMessage {
+		t.Errorf("forwarded %s, want the template as written", out)
+	}
+	if st := rr.policyStats().(map[string]any); st["developer_message_errors"] != int64(1) || st["developer_messages"] != int64(1) {
+		t.Errorf("policy stats = %v", st)
+	}
+}
+
+func TestDeveloperMessageLoadErrors(t *testing.T) {
+	for _, msg := range []string{"{{.Date", "{{.Unknown}}", "{{template \"x\"}}"} {
+		p := &RequestPolicy{DeveloperMessage: msg}
+		if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "developer_message") {
+			t.Errorf("Validate of %q = %v, want a developer_message error", msg, err)
+		}
+	}
+}
+
+func BenchmarkRenderDeveloperMessage(b *testing.B) {
+	p := devPolicy(b, testDeveloperMessage)
+	client := cacheKey("Bearer sk-a")
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := p.renderDeveloperMessage(client, "gpt-5"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRewriteDeveloperMessage is the rewrite with the message, to
+// set against BenchmarkRewriteStatic for what rendering adds to a request.
+func BenchmarkRewriteDeveloperMessage(b *testing.B) {
+	benchmarkRewriteInstructions(b, testDeveloperMessage)
+}
+
+// BenchmarkRewriteStatic puts a message without template actions first.
+func BenchmarkRewriteStatic(b *testing.B) {
+	benchmarkRewriteInstructions(b, "You are helping in staging.")
+}
+
+func benchmarkRewriteInstructions(b *testing.B, msg string) {
+	opts := DefaultOptions()
+	opts.Policy = devPolicy(b, msg)
+	rr := NewRewriter(opts)
+	body := `{"model":"gpt-5","input":[{"role":"user","content":"hi"}]}`
+	b.ReportAllocs()
+	for b.Loop() {
+		req := httptest.NewRequest("POST", "/v1/responses", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer sk-a")
+		if _, err := rr.RewriteRequest(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package reserve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bytedance/sonic"
+)
+
+// An upstream 400 on a rewritten request raises the question whether the
+// rewrite caused it. For every JSON error answering a rewritten request
+// the proxy warns with the upstream's message next to what the rewrite
+// did: the hooks that changed the body, the fast or AST path, the sizes
+// before and after and, with Options.ErrorFingerprints, sha256 prints of
+// both bodies to find them in a record or debug capture without logging
+// content. The 4xx of rewritten and of untouched requests are counted
+// apart, so a rewriter regression shows as diverging ratios.
+
+// rewriteOutcome is what the body rewrite did to a request.
+type rewriteOutcome struct {
+	rewritten     bool
+	applied       []string
+	path          string // fast, ast or spill
+	before, after int
+	sums          *bodySums // nil without Options.ErrorFingerprints
+}
+
+type bodySums struct {
+	before, after [sha256.Size]byte
+}
+
+type upstreamErrorCounts struct {
+	rewritten        atomic.Int64 // responses to rewritten requests
+	rewritten4xx     atomic.Int64
+	untouched        atomic.Int64 // responses to requests forwarded as they came
+	untouched4xx     atomic.Int64
+	rewrittenLogged  atomic.Int64 // JSON errors logged with the rewrite
+	unreadableErrors atomic.Int64 // error bodies that could not be read
+}
+
+func (p *Proxy) upstreamErrorStats() any {
+	c := &p.upstreamErrors
+	return map[string]any{
+		"fingerprints":      p.opts.ErrorFingerprints,
+		"rewritten":         c.rewritten.Load(),
+		"rewritten_4xx":     c.rewritten4xx.Load(),
+		"untouched":         c.untouched.Load(),
+		"untouched_4xx":     c.untouched4xx.Load(),
+		"logged":            c.rewrittenLogged.Load(),
+		"unreadable_errors": c.unreadableErrors.Load(),
+	}
+}
+
+// outcome is rw's rewriteOutcome; run once the rewrite is done.
+func (rw *bodyRewrite) outcome() *rewriteOutcome {
+	return &rewriteOutcome{
+		rewritten: rw.rewritten, applied: rw.applied, path: rw.path,
+		before: rw.before, after: rw.after, sums: rw.sums,
+	}
+}
+
+// noteBefore records the client's body, as it is about to be rewritten.
+func (rw *bodyRewrite) noteBefore() {
+	rw.before = rw.orig.Len()
+	if rw.rr.opts.ErrorFingerprints {
+		rw.sums = &bodySums{before: sha256.Sum256(rw.orig.Bytes())}
+	}
+}
+
+// noteAfter records the body going upstream.
+func (rw *bodyRewrite) noteAfter(bs []byte) {
+	rw.after = len(bs)
+	if rw.sums != nil {
+		rw.sums.after = sha256.Sum256(bs)
+	}
+}
+
+// diagnoseUpstreamError counts resp by whether its request was rewritten
+// and, for an error answering a rewritten one, logs it with the rewrite.
+func (p *Proxy) diagnoseUpstreamError(resp *http.Response, st *reqState) {
+	ro := st.rewrite
+	if ro == nil {
+		return
+	}
+	c := &p.upstreamErrors
+	client4xx := resp.StatusCode >= 400 && resp.StatusCode < 500
+	if !ro.rewritten {
+		c.untouched.Add(1)
+		if client4xx {
+			c.untouched4xx.Add(1)
+		}
+		return
+	}
+	c.rewritten.Add(1)
+	if client4xx {
+		c.rewritten4xx.Add(1)
+	}
+	if resp.StatusCode < 300 || isEventStream(resp) ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return
+	}
+	r := &Response{HTTP: resp, maxBody: p.opts.MaxBody}
+	bs, err := r.Body()
+	if err != nil {
+		c.unreadableErrors.Add(1)
+		return
+	}
+	var eb errorBody
+	_ = sonic.Unmarshal(bs, &eb)
+	c.rewrittenLogged.Add(1)
+	attrs := []any{"route", st.route.name, "status", resp.StatusCode,
+		"type", eb.Error.Type, "code", eb.Error.Code, "message", eb.Error.Message,
+		"applied", ro.applied, "path", ro.path, "bytes", ro.before, "rewritten_bytes", ro.after}
+	if ro.sums != nil {
+		attrs = append(attrs, "sha256", hex.EncodeToString(ro.sums.before[:]),
+			"rewritten_sha256", hex.EncodeToString(ro.sums.after[:]))
+	}
+	if st.client != nil {
+		attrs = append(attrs, "client", st.client.CacheKey)
+	}
+	st.log.Warn("upstream error on a rewritten request", attrs...)
+	st.trace.log("upstream_error_rewrite", "status", resp.StatusCode, "code", eb.Error.Code,
+		"applied", ro.applied, "path", ro.path)
+}
@@ -0,0 +1,81 @@
+package reserve
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// A client giving up on a request is no error of the proxy's, and is
+// answered with nothing, but how often it happens, and when, tells how
+// slow the proxy looks from the client's side. Each abandoned request is
+// counted once, by the phase it was in where the cancellation was
+// noticed: the body upload (and the rewrite after it), the wait for an
+// upstream slot or a rate limit turn, the wait for the upstream's
+// response headers, or the response body (a stream, mostly). Timeouts of
+// the proxy's own are not counted: their cause isn't a cancellation.
+
+const (
+	leftUpload   = "upload"
+	leftQueue    = "queue"
+	leftUpstream = "upstream_headers"
+	leftResponse = "response"
+)
+
+var leftPhases = [...]string{leftUpload, leftQueue, leftUpstream, leftResponse}
+
+// disconnectCounts counts abandoned requests by phase, in leftPhases order.
+type disconnectCounts [len(leftPhases)]atomic.Int64
+
+func (rr *Rewriter) disconnectStats() any {
+	out := make(map[string]any, len(leftPhases))
+	for i, k := range leftPhases {
+		out[k] = rr.disconnects[i].Load()
+	}
+	return out
+}
+
+// clientLeft counts the request ctx belongs to as abandoned in phase, the
+// first time it is noticed, when its cancellation came from the client.
+func (rr *Rewriter) clientLeft(ctx context.Context, phase string) {
+	if errors.Is(context.Cause(ctx), context.Canceled) {
+		rr.countLeft(ctx, phase)
+	}
+}
+
+// countLeft is clientLeft for a request known to be abandoned: a write to
+// its client failed.
+func (rr *Rewriter) countLeft(ctx context.Context, phase string) {
+	st := stateOf(ctx)
+	if st != nil && !st.left.CompareAndSwap(false, true) {
+		return
+	}
+	for i, k := range leftPhases {
+		if k == phase {
+			rr.disconnects[i].Add(1)
+		}
+	}
+	var elapsed time.Duration
+	if st != nil {
+		elapsed = time.Since(st.start).Round(time.Millisecond)
+	}
+	logOf(ctx).Debug("client disconnected", "phase", phase, "elapsed", elapsed)
+	traceOf(ctx).log("client_left", "phase", phase)
+}
+
+// disconnectTransport notices clients leaving while their request waits
+// for the upstream's response headers.
+type disconnectTransport struct {
+	next http.RoundTripper
+	rr   *Rewriter
+}
+
+func (t *disconnectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.rr.clientLeft(req.Context(), leftUpstream)
+	}
+	return resp, err
+}
@@ -0,0 +1,29 @@
+package reserve_test
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/ycvk/rightcode-reserve/reserve"
+)
+
+func ExampleRewriter_RewriteRequest() {
+	rr := reserve.NewRewriter(reserve.DefaultOptions())
+	req := httptest.NewRequest("POST", "/v1/responses", strings.NewReader(`{"input":"hi"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer sk-example")
+
+	res, err := rr.RewriteRequest(req)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	fmt.Println(res.Route, res.Rewritten, res.Applied)
+	fmt.Println(string(body))
+	// Output:
+	// responses true [prompt_cache_key]
+	// {"prompt_cache_key":"ac3a082afe3387dc2178486acff3da12","input":"hi"}
+}
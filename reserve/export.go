@@ -0,0 +1,446 @@
+package reserve
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// With Options.UsageExport, every usage record (see recordUsage) is also
+// appended to that file, as JSON lines or CSV (with a header row), with
+// the UsageExportFields columns. The file is rotated past
+// UsageExportMaxBytes and, with UsageExportDaily, when the UTC day
+// changes: it is renamed to <name>-<UTC timestamp><ext>, gzipped in the
+// background with UsageExportGzip, and a new one started. Records
+// are queued and written in batches by one goroutine, so a request never
+// waits on the disk; a full queue drops the record and counts it.
+// CloseUsageExport writes what is queued before shutdown.
+
+const usageExportQueue = 4096
+
+// usageExportFields are the fields a usage record has, in their default
+// order.
+var usageExportFields = []string{
+	"time", "route", "client", "client_source", "model", "status",
+	"input_tokens", "cached_tokens", "output_tokens", "reasoning_tokens", "total_tokens",
+	"cost_usd", "duration_ms",
+}
+
+type usageRow struct {
+	time          time.Time
+	route         string
+	client        string
+	source        string
+	model, status string
+
+	input, cached, output, reasoning, total int64
+
+	cost     float64
+	priced   bool
+	duration time.Duration // 0 when unknown
+}
+
+func newUsageRow(route string, client *clientIdentity, st *reqState, model, status, raw string, rc responseCost, priced bool) usageRow {
+	r := usageRow{time: time.Now(), route: route, model: model, status: status}
+	if client != nil {
+		r.client, r.source = client.CacheKey, client.Source
+	}
+	if st != nil {
+		r.duration = time.Since(st.start)
+	}
+	var u tokenUsage
+	if sonic.UnmarshalString(raw, &u) == nil {
+		r.input, r.cached, r.output = u.counts()
+		r.reasoning = max(u.OutputTokensDetails.ReasoningTokens, u.CompletionTokensDetails.ReasoningTokens)
+		r.total = u.TotalTokens
+	}
+	if priced {
+		r.cost, r.priced = nanoUSD(rc.nano), true
+	}
+	return r
+}
+
+type usageExport struct {
+	path, format string
+	fields       []string
+	maxBytes     int64
+	daily, gzip  bool
+
+	rows        chan usageRow
+	stop, done  chan struct{}
+	closeOnce   sync.Once
+	compressing sync.WaitGroup
+
+	// owned by the writer goroutine
+	f      *os.File
+	bw     *bufio.Writer
+	size   int64
+	opened time.Time // start of the current file's period
+
+	curBytes                                       atomic.Int64
+	written, dropped, rotations, gzipped, failures atomic.Int64
+}
+
+func newUsageExport(opts Options) (*usageExport, error) {
+	if opts.UsageExport == "" {
+		return nil, nil
+	}
+	x := &usageExport{
+		path:     opts.UsageExport,
+		format:   opts.UsageExportFormat,
+		maxBytes: opts.UsageExportMaxBytes,
+		daily:    opts.UsageExportDaily,
+		gzip:     opts.UsageExportGzip,
+		rows:     make(chan usageRow, usageExportQueue),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if x.format == "" {
+		x.format = "jsonl"
+	}
+	if x.format != "jsonl" && x.format != "csv" {
+		return nil, fmt.Errorf("reserve: usage export format %q, want jsonl or csv", x.format)
+	}
+	for _, f := range opts.UsageExportFields {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if !slices.Contains(usageExportFields, f) {
+			return nil, fmt.Errorf("reserve: unknown usage export field %q", f)
+		}
+		x.fields = append(x.fields, f)
+	}
+	if len(x.fields) == 0 {
+		x.fields = usageExportFields
+	}
+	if err := x.open(time.Now()); err != nil {
+		return nil, err
+	}
+	if x.format == "csv" && x.size > 0 && !x.headerMatches() {
+		// appending rows of other columns would garble the file
+		x.rotate(time.Now())
+	}
+	go x.run()
+	return x, nil
+}
+
+func (p *Proxy) usageExportStats() any {
+	x := p.export
+	if x == nil {
+		return map[string]any{"enabled": false}
+	}
+	return map[string]any{
+		"enabled":       true,
+		"path":          x.path,
+		"format":        x.format,
+		"fields":        x.fields,
+		"max_bytes":     x.maxBytes,
+		"daily":         x.daily,
+		"gzip":          x.gzip,
+		"current_bytes": x.curBytes.Load(),
+		"queued":        len(x.rows),
+		"written":       x.written.Load(),
+		"dropped":       x.dropped.Load(),
+		"rotations":     x.rotations.Load(),
+		"gzipped":       x.gzipped.Load(),
+		"errors":        x.failures.Load(),
+	}
+}
+
+// CloseUsageExport writes the queued usage records and closes the export
+// file, waiting for rotated files being compressed. Records after it are
+// dropped. Without Options.UsageExport it does nothing.
+func (p *Proxy) CloseUsageExport() {
+	x := p.export
+	if x == nil {
+		return
+	}
+	x.closeOnce.Do(func() { close(x.stop) })
+	<-x.done
+}
+
+// record queues r, dropping it when the queue is full.
+func (x *usageExport) record(r usageRow) {
+	if x == nil {
+		return
+	}
+	select {
+	case x.rows <- r:
+	default:
+		x.dropped.Add(1)
+	}
+}
+
+func (x *usageExport) run() {
+	defer close(x.done)
+	for {
+		select {
+		case r := <-x.rows:
+			x.write(r)
+			x.drain(512)
+			x.flush()
+		case <-x.stop:
+			x.drain(-1)
+			x.flush()
+			if x.f != nil {
+				x.f.Close()
+			}
+			x.compressing.Wait()
+			return
+		}
+	}
+}
+
+// drain writes up to n (< 0: all) queued records without waiting for
+// more, so a burst costs one flush.
+func (x *usageExport) drain(n int) {
+	for ; n != 0; n-- {
+		select {
+		case r := <-x.rows:
+			x.write(r)
+		default:
+			return
+		}
+	}
+}
+
+func (x *usageExport) write(r usageRow) {
+	line := x.encode(r)
+	if x.f != nil && x.size > 0 && x.due(r.time, len(line)) {
+		x.rotate(r.time)
+	}
+	if x.f == nil {
+		// the file failed earlier; try it again
+		if err := x.open(r.time); err != nil {
+			x.failures.Add(1)
+			return
+		}
+	}
+	n, _ := x.bw.Write(line) // a failure shows in flush
+	x.size += int64(n)
+	x.curBytes.Store(x.size)
+	x.written.Add(1)
+}
+
+func (x *usageExport) flush() {
+	if x.f == nil {
+		return
+	}
+	if err := x.bw.Flush(); err != nil {
+		x.failures.Add(1)
+		slog.Warn("usage export: write failed, reopening", "path", x.path, "error", err)
+		x.f.Close()
+		x.f = nil
+	}
+}
+
+// due reports whether a line of n bytes at t goes into a new file.
+func (x *usageExport) due(t time.Time, n int) bool {
+	if x.maxBytes > 0 && x.size+int64(n) > x.maxBytes {
+		return true
+	}
+	if x.daily {
+		y1, m1, d1 := t.UTC().Date()
+		y2, m2, d2 := x.opened.UTC().Date()
+		return y1 != y2 || m1 != m2 || d1 != d2
+	}
+	return false
+}
+
+func (x *usageExport) open(now time.Time) error {
+	f, err := os.OpenFile(x.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	x.f, x.bw, x.size, x.opened = f, bufio.NewWriterSize(f, 64<<10), info.Size(), now
+	if x.size > 0 {
+		// an earlier run's file: its period started before
+		x.opened = info.ModTime()
+	}
+	if x.format == "csv" && x.size == 0 {
+		cw := csv.NewWriter(x.bw)
+		_ = cw.Write(x.fields)
+		cw.Flush()
+		x.size = int64(x.bw.Buffered())
+	}
+	x.curBytes.Store(x.size)
+	return nil
+}
+
+// headerMatches reports whether the CSV file starts with x's header row.
+func (x *usageExport) headerMatches() bool {
+	f, err := os.Open(x.path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header, err := csv.NewReader(f).Read()
+	return err == nil && slices.Equal(header, x.fields)
+}
+
+// rotate moves the current file aside and starts a new one.
+func (x *usageExport) rotate(now time.Time) {
+	x.flush()
+	if x.f == nil {
+		return
+	}
+	x.f.Close()
+	x.f = nil
+	ext := filepath.Ext(x.path)
+	base := strings.TrimSuffix(x.path, ext) + "-" + x.opened.UTC().Format("20060102T150405")
+	name := base + ext
+	for i := 1; exists(name) || exists(name+".gz"); i++ {
+		name = base + "-" + strconv.Itoa(i) + ext
+	}
+	if err := os.Rename(x.path, name); err != nil {
+		x.failures.Add(1)
+		slog.Warn("usage export: rotation failed, appending on", "path", x.path, "error", err)
+	} else {
+		x.rotations.Add(1)
+		slog.Info("usage export rotated", "path", x.path, "to", name)
+		if x.gzip {
+			x.compressing.Add(1)
+			go x.compress(name)
+		}
+	}
+	if err := x.open(now); err != nil {
+		x.failures.Add(1)
+		slog.Warn("usage export: reopen failed", "path", x.path, "error", err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// compress replaces rotated file name by name.gz.
+func (x *usageExport) compress(name string) {
+	defer x.compressing.Done()
+	err := func() error {
+		src, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return err
+		}
+		zw := gzip.NewWriter(dst)
+		_, err = io.Copy(zw, src)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(name + ".gz")
+		}
+		return err
+	}()
+	if err != nil {
+		x.failures.Add(1)
+		slog.Warn("usage export: gzip failed, rotated file kept as is", "file", name, "error", err)
+		return
+	}
+	os.Remove(name)
+	x.gzipped.Add(1)
+}
+
+// encode renders r as a line of x's format.
+func (x *usageExport) encode(r usageRow) []byte {
+	if x.format == "csv" {
+		rec := make([]string, len(x.fields))
+		for i, f := range x.fields {
+			rec[i] = r.text(f)
+		}
+		var b strings.Builder
+		cw := csv.NewWriter(&b)
+		_ = cw.Write(rec)
+		cw.Flush()
+		return []byte(b.String())
+	}
+	b := []byte{'{'}
+	for i, f := range x.fields {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendQuote(b, f) // field names are plain ASCII
+		b = append(b, ':')
+		b = append(b, r.json(f)...)
+	}
+	return append(b, '}', '\n')
+}
+
+// text is field f of r as a CSV cell, "" when unknown.
+func (r *usageRow) text(f string) string {
+	switch f {
+	case "time":
+		return r.time.UTC().Format(time.RFC3339Nano)
+	case "route":
+		return r.route
+	case "client":
+		return r.client
+	case "client_source":
+		return r.source
+	case "model":
+		return r.model
+	case "status":
+		return r.status
+	case "input_tokens":
+		return strconv.FormatInt(r.input, 10)
+	case "cached_tokens":
+		return strconv.FormatInt(r.cached, 10)
+	case "output_tokens":
+		return strconv.FormatInt(r.output, 10)
+	case "reasoning_tokens":
+		return strconv.FormatInt(r.reasoning, 10)
+	case "total_tokens":
+		return strconv.FormatInt(r.total, 10)
+	case "cost_usd":
+		if !r.priced {
+			return ""
+		}
+		return strconv.FormatFloat(r.cost, 'f', -1, 64)
+	case "duration_ms":
+		if r.duration == 0 {
+			return ""
+		}
+		return strconv.FormatFloat(float64(r.duration.Microseconds())/1000, 'f', -1, 64)
+	}
+	return ""
+}
+
+// json is field f of r as a JSON value, null when unknown.
+func (r *usageRow) json(f string) []byte {
+	switch f {
+	case "time", "route", "client", "client_source", "model", "status":
+		bs, _ := json.Marshal(r.text(f))
+		return bs
+	}
+	if s := r.text(f); s != "" {
+		return []byte(s)
+	}
+	return []byte("null")
+}
@@ -0,0 +1,175 @@
+package reserve
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/ast"
+)
+
+// With Options.ModelFallbacks, a rewritten request for one of its models
+// that the upstream refuses with a 404 model_not_found, or a 503 for lack
+// of capacity, is sent once more with the model swapped for its fallback,
+// and the client gets that answer instead, X-Reserve-Model-Fallback naming
+// the swap. The check runs after the response hooks, so a stream opening
+// with such an error event (see sniff.go) qualifies; one already relaying
+// does not. The forwarded body is kept for the retry only for the models
+// that have a fallback, and never for bodies spilled to disk.
+
+const modelFallbackHeader = "X-Reserve-Model-Fallback"
+
+type modelFallback struct {
+	to    map[string]string
+	pairs map[string]*fallbackPair // by "from -> to", fixed at construction
+}
+
+type fallbackPair struct {
+	retried, recovered, failed atomic.Int64
+}
+
+// fallbackReq is the state of one request whose model has a fallback.
+type fallbackReq struct {
+	from, to string
+	body     []byte // as forwarded, before the upstream gzip
+	used     bool
+}
+
+func newModelFallback(opts Options) *modelFallback {
+	if len(opts.ModelFallbacks) == 0 {
+		return nil
+	}
+	f := &modelFallback{to: map[string]string{}, pairs: map[string]*fallbackPair{}}
+	for from, to := range opts.ModelFallbacks {
+		if from == "" || to == "" || from == to {
+			continue
+		}
+		f.to[from] = to
+		f.pairs[from+" -> "+to] = &fallbackPair{}
+	}
+	if len(f.to) == 0 {
+		return nil
+	}
+	return f
+}
+
+func (p *Proxy) modelFallbackStats() any {
+	f := p.fallback
+	if f == nil {
+		return map[string]any{"enabled": false}
+	}
+	pairs := map[string]any{}
+	for name, c := range f.pairs {
+		pairs[name] = map[string]int64{
+			"retried":   c.retried.Load(),
+			"recovered": c.recovered.Load(),
+			"failed":    c.failed.Load(),
+		}
+	}
+	return map[string]any{"enabled": true, "pairs": pairs}
+}
+
+// prepare keeps a copy of r's body when its model has a fallback; called
+// with the final body, before it is compressed.
+func (f *modelFallback) prepare(r *http.Request, st *reqState) {
+	pb, ok := r.Body.(*pooledBody)
+	if !ok || pb.b == nil {
+		return
+	}
+	bs := pb.b.Bytes()
+	n, _ := sonic.Get(bs, "model")
+	from, err := n.String()
+	if err != nil {
+		return
+	}
+	if to, ok := f.to[from]; ok {
+		st.fallback = &fallbackReq{from: from, to: to, body: bytes.Clone(bs)}
+	}
+}
+
+// retryFallback sends the request again with the fallback model when
+// resp is an error that calls for it, and swaps its answer into resp. It
+// reports whether it did, so the response hooks can run on the new one.
+func (p *Proxy) retryFallback(resp *http.Response, st *reqState) bool {
+	fr := st.fallback
+	if fr == nil || fr.used || !fallbackStatus(resp.StatusCode) || isEventStream(resp) ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return false
+	}
+	rr := &Response{HTTP: resp, maxBody: p.opts.MaxBody}
+	bs, err := rr.Body()
+	if err != nil {
+		return false
+	}
+	var eb errorBody
+	if sonic.Unmarshal(bs, &eb) != nil || !fallbackError(resp.StatusCode, eb.Error) {
+		return false
+	}
+	fr.used = true
+	body, err := withModel(fr.body, fr.to)
+	if err != nil {
+		return false
+	}
+	c := p.fallback.pairs[fr.from+" -> "+fr.to]
+	c.retried.Add(1)
+
+	req := resp.Request.Clone(resp.Request.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	req.Header.Del("Content-Encoding")
+	st.trace.log("model_fallback", "from", fr.from, "to", fr.to, "status", resp.StatusCode, "code", eb.Error.Code)
+	// through the route's phase timeouts and the disconnect count, as the
+	// first attempt went
+	next, err := p.rp.Transport.RoundTrip(req)
+	if err != nil {
+		c.failed.Add(1)
+		st.log.Warn("model fallback: retry failed, answering with the first error", "route", st.route.name,
+			"model", fr.from, "fallback", fr.to, "error", err)
+		st.trace.log("model_fallback_error", "error", err)
+		return false
+	}
+	if next.StatusCode < 300 {
+		c.recovered.Add(1)
+	} else {
+		c.failed.Add(1)
+	}
+	st.log.Info("model fallback: retried with the fallback model", "route", st.route.name, "model", fr.from,
+		"fallback", fr.to, "status", resp.StatusCode, "code", eb.Error.Code, "retry_status", next.StatusCode)
+	resp.Body.Close()
+	*resp = *next
+	resp.Header.Set(modelFallbackHeader, fr.from+" -> "+fr.to)
+	st.wide.upstreamResponse(resp.StatusCode)
+	st.trace.log("upstream_response", "status", resp.StatusCode, "content_type", resp.Header.Get("Content-Type"),
+		"content_length", resp.ContentLength, "model_fallback", fr.to)
+	return true
+}
+
+func fallbackStatus(status int) bool {
+	return status == http.StatusNotFound || status == http.StatusServiceUnavailable
+}
+
+// fallbackError reports whether e, answered with status, says the model
+// is missing or out of capacity rather than anything about the request.
+func fallbackError(status int, e errorDetail) bool {
+	if status == http.StatusNotFound {
+		return e.Code == "model_not_found"
+	}
+	return slices.Contains([]string{"server_is_overloaded", "overloaded", "model_overloaded", "capacity_exceeded"}, e.Code) ||
+		strings.Contains(strings.ToLower(e.Message), "capacity")
+}
+
+// withModel returns bs with its model set to model.
+func withModel(bs []byte, model string) ([]byte, error) {
+	root := ast.NewRaw(string(bs))
+	if _, err := root.Set("model", ast.NewString(model)); err != nil {
+		return nil, err
+	}
+	return root.MarshalJSON()
+}
@@ -0,0 +1,50 @@
+package reserve
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModelFallbackRetryHasPhaseTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	u := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), `"gpt-5-mini"`) {
+			// the fallback stalls before its headers
+			<-release
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"message":"no such model","code":"model_not_found"}}`))
+	})
+	defer close(release)
+	opts := DefaultOptions()
+	opts.ModelFallbacks = map[string]string{"gpt-5": "gpt-5-mini"}
+	opts.RouteTimeouts = map[string]PhaseTimeouts{"responses": {ResponseHeader: 100 * time.Millisecond}}
+	p := newTestProxy(t, opts, u)
+
+	done := make(chan int, 1)
+	go func() {
+		done <- send(p, http.MethodPost, "/v1/responses", bearer("sk-a"), `{"model":"gpt-5","input":"hi"}`).Code
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusNotFound {
+			t.Errorf("status %d, want the first answer's 404", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request waited on the stalled fallback past the header timeout")
+	}
+	if n := len(u.requests()); n != 1 {
+		// the stalled one never finished on the upstream's side
+		t.Errorf("upstream finished %d requests, want the first only", n)
+	}
+	c := p.fallback.pairs["gpt-5 -> gpt-5-mini"]
+	if c.retried.Load() != 1 || c.failed.Load() != 1 {
+		t.Errorf("retried %d, failed %d; want 1 and 1", c.retried.Load(), c.failed.Load())
+	}
+}
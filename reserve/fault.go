@@ -0,0 +1,302 @@
+package reserve
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// A client's handling of a 429, a 502 or a stream that breaks off is
+// hard to test against a real upstream, which rarely fails on demand.
+// With Options.FaultInjection, the admin API's /_reserve/faults takes
+// rules that fail a percentage of a route's requests on purpose: response
+// headers held back for a while, a 429 with Retry-After or a 502 answered
+// in the upstream's stead, or an event stream cut, or fed garbage, after
+// so many events. Without the option the endpoint refuses every rule, and
+// no rules is the default either way. An injected fault is never passed
+// off as a real one: the response carries X-Reserve-Injected-Fault, and
+// the log, the wide log record and the trace name it.
+
+const (
+	faultsPath  = reservePrefix + "faults"
+	faultHeader = "X-Reserve-Injected-Fault"
+)
+
+// Faults a FaultRule injects.
+const (
+	FaultDelay      = "delay"       // response headers held back DelayMS
+	FaultRateLimit  = "rate_limit"  // 429 with Retry-After, not forwarded
+	FaultBadGateway = "bad_gateway" // 502, not forwarded
+	FaultDisconnect = "disconnect"  // event stream cut after AfterEvents events
+	FaultGarbage    = "garbage"     // garbage bytes after AfterEvents events
+)
+
+var faultKinds = []string{FaultDelay, FaultRateLimit, FaultBadGateway, FaultDisconnect, FaultGarbage}
+
+// most rules taken at once, and the longest delay
+const (
+	maxFaultRules = 32
+	maxFaultDelay = 5 * time.Minute
+)
+
+// FaultRule injects Fault into Percent (0..100) of the requests of Route
+// ("" for every route). DelayMS is the hold of FaultDelay, RetryAfter the
+// Retry-After seconds of FaultRateLimit (default 1) and AfterEvents the
+// events FaultDisconnect and FaultGarbage let through first. Rules are
+// tried in order; the first that matches and rolls under its Percent wins.
+type FaultRule struct {
+	Fault       string  `json:"fault"`
+	Percent     float64 `json:"percent"`
+	Route       string  `json:"route,omitempty"`
+	DelayMS     int     `json:"delay_ms,omitempty"`
+	RetryAfter  int     `json:"retry_after,omitempty"`
+	AfterEvents int     `json:"after_events,omitempty"`
+}
+
+func (f *FaultRule) check() error {
+	if !slices.Contains(faultKinds, f.Fault) {
+		return fmt.Errorf("fault %q: want one of %v", f.Fault, faultKinds)
+	}
+	if f.Percent < 0 || f.Percent > 100 {
+		return fmt.Errorf("percent %v: want 0..100", f.Percent)
+	}
+	if f.Route != "" && !slices.ContainsFunc(routes, func(rt route) bool { return rt.name == f.Route }) {
+		return fmt.Errorf("no route %q", f.Route)
+	}
+	if f.DelayMS < 0 || time.Duration(f.DelayMS)*time.Millisecond > maxFaultDelay {
+		return fmt.Errorf("delay_ms %d: want 0..%d", f.DelayMS, maxFaultDelay.Milliseconds())
+	}
+	if f.RetryAfter < 0 || f.AfterEvents < 0 {
+		return errors.New("retry_after and after_events can't be negative")
+	}
+	return nil
+}
+
+var (
+	errFaultsDisabled = &httpError{
+		status: http.StatusForbidden,
+		code:   "fault_injection_disabled",
+		msg:    "fault injection is not enabled (-enable-fault-injection)",
+	}
+	errInjectedDisconnect = errors.New("reserve: injected fault: stream disconnected")
+)
+
+type faultInjector struct {
+	rules    atomic.Pointer[[]FaultRule]
+	injected map[string]*atomic.Int64 // by fault, fixed at construction
+}
+
+// newFaultInjector is nil without opts.FaultInjection.
+func newFaultInjector(opts Options) *faultInjector {
+	if !opts.FaultInjection {
+		return nil
+	}
+	f := &faultInjector{injected: map[string]*atomic.Int64{}}
+	for _, k := range faultKinds {
+		f.injected[k] = new(atomic.Int64)
+	}
+	f.rules.Store(&[]FaultRule{})
+	return f
+}
+
+// pick is the rule of a request of rt, nil for none; unmatched paths
+// have none.
+func (f *faultInjector) pick(rt *route) *FaultRule {
+	if f == nil || rt == nil {
+		return nil
+	}
+	for _, rule := range *f.rules.Load() {
+		if (rule.Route == "" || rule.Route == rt.name) && rand.Float64()*100 < rule.Percent {
+			return &rule
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) faultStats() any {
+	f := p.faults
+	if f == nil {
+		return map[string]any{"enabled": false}
+	}
+	injected := make(map[string]int64, len(f.injected))
+	for k, n := range f.injected {
+		injected[k] = n.Load()
+	}
+	return map[string]any{"enabled": true, "rules": len(*f.rules.Load()), "injected": injected}
+}
+
+// serveFaults shows (GET), replaces (PUT, {"rules": [...]}) or clears
+// (DELETE) the fault rules.
+func (p *Proxy) serveFaults(w http.ResponseWriter, r *http.Request, caller string) {
+	f := p.faults
+	if f == nil {
+		writeHTTPError(w, errFaultsDisabled)
+		return
+	}
+	var rules []FaultRule
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{"rules": *f.rules.Load()})
+		return
+	case http.MethodPut:
+		bs, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+		var body struct {
+			Rules []FaultRule `json:"rules"`
+		}
+		if err != nil || sonicAPI.Unmarshal(bs, &body) != nil {
+			writeHTTPError(w, errAdminBody)
+			return
+		}
+		if len(body.Rules) > maxFaultRules {
+			writeHTTPError(w, &httpError{status: http.StatusBadRequest, code: "invalid_admin_request",
+				msg: "at most " + strconv.Itoa(maxFaultRules) + " rules"})
+			return
+		}
+		for i := range body.Rules {
+			if err := body.Rules[i].check(); err != nil {
+				writeHTTPError(w, &httpError{status: http.StatusBadRequest, code: "invalid_admin_request",
+					msg: fmt.Sprintf("rules[%d]: %v", i, err)})
+				return
+			}
+		}
+		rules = body.Rules
+	case http.MethodDelete:
+	default:
+		writeHTTPError(w, errMethod)
+		return
+	}
+	if rules == nil {
+		rules = []FaultRule{}
+	}
+	old := f.rules.Swap(&rules)
+	slog.Warn("admin fault injection change", "caller", caller, "remote", r.RemoteAddr,
+		"old", len(*old), "new", rules)
+	writeJSON(w, http.StatusOK, map[string]any{"rules": rules})
+}
+
+// injected marks the response of st, with header h, as failed on purpose.
+func (p *Proxy) injected(h http.Header, st *reqState) {
+	f := st.fault
+	p.faults.injected[f.Fault].Add(1)
+	h.Set(faultHeader, f.Fault)
+	st.wide.faulted(f.Fault)
+	st.trace.log("fault", "fault", f.Fault, "percent", f.Percent, "delay_ms", f.DelayMS,
+		"after_events", f.AfterEvents)
+	route := ""
+	if st.route != nil {
+		route = st.route.name
+	}
+	st.log.Info("fault injected", "fault", f.Fault, "route", route)
+}
+
+// injectLocalFault answers the request of st with its fault when that
+// stands in for the upstream, and reports whether it did.
+func (p *Proxy) injectLocalFault(w http.ResponseWriter, r *http.Request, st *reqState) bool {
+	var he *httpError
+	switch st.fault.Fault {
+	case FaultRateLimit:
+		he = &httpError{status: http.StatusTooManyRequests, code: "rate_limit_exceeded",
+			msg: "injected fault: rate limited", retryAfter: max(st.fault.RetryAfter, 1)}
+	case FaultBadGateway:
+		he = &httpError{status: http.StatusBadGateway, code: "upstream_error", msg: "injected fault: bad gateway"}
+	default:
+		return false
+	}
+	p.injected(w.Header(), st)
+	r.Body.Close()
+	writeHTTPError(w, he)
+	return true
+}
+
+// injectResponseFault applies the fault of st to upstream response resp,
+// the last change before the client gets it.
+func (p *Proxy) injectResponseFault(resp *http.Response, st *reqState) {
+	f := st.fault
+	switch {
+	case f == nil:
+	case f.Fault == FaultDelay:
+		p.injected(resp.Header, st)
+		t := time.NewTimer(time.Duration(f.DelayMS) * time.Millisecond)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-resp.Request.Context().Done():
+		}
+	case f.Fault == FaultDisconnect || f.Fault == FaultGarbage:
+		if resp.StatusCode != http.StatusOK || !isEventStream(resp) {
+			st.trace.log("fault", "fault", f.Fault, "skipped", "not an event stream")
+			return
+		}
+		p.injected(resp.Header, st)
+		resp.Body = &faultStream{rc: resp.Body, fault: f.Fault, after: f.AfterEvents}
+	}
+}
+
+// faultStream passes an event stream through until after events have, then
+// cuts it (FaultDisconnect) or sends garbage and carries on (FaultGarbage).
+type faultStream struct {
+	rc     io.ReadCloser
+	fault  string
+	after  int
+	events int
+	prev   byte   // last byte seen other than \r
+	rest   []byte // read past the fault's event, or garbage, yet to pass
+	fired  bool
+}
+
+func (s *faultStream) Read(b []byte) (int, error) {
+	if len(s.rest) > 0 {
+		n := copy(b, s.rest)
+		s.rest = s.rest[n:]
+		return n, nil
+	}
+	if s.fired {
+		if s.fault == FaultDisconnect {
+			return 0, errInjectedDisconnect
+		}
+		return s.rc.Read(b)
+	}
+	if s.after == 0 {
+		s.fire(nil)
+		return s.Read(b)
+	}
+	n, err := s.rc.Read(b)
+	for i, c := range b[:n] {
+		if c == '\r' {
+			continue
+		}
+		if c == '\n' && s.prev == '\n' {
+			s.prev = 0
+			if s.events++; s.events == s.after {
+				s.fire(b[i+1 : n])
+				return i + 1, nil
+			}
+			continue
+		}
+		s.prev = c
+	}
+	return n, err
+}
+
+// fire injects the fault, rest being what was read past the last event
+// let through.
+func (s *faultStream) fire(rest []byte) {
+	s.fired = true
+	if s.fault != FaultGarbage {
+		return
+	}
+	g := make([]byte, 64, 64+2+len(rest))
+	for i := range g {
+		g[i] = byte(rand.N(256))
+	}
+	s.rest = append(append(g, "\n\n"...), rest...)
+}
+
+func (s *faultStream) Close() error { return s.rc.Close() }
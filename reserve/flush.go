@@ -0,0 +1,160 @@
+package reserve
+
+import (
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The ReverseProxy flushes after every write (FlushInterval -1), which
+// event streams need but which defeats write coalescing for large JSON or
+// binary bodies. flushWriter decides per response, by its Content-Type:
+// text/event-stream and Options.FlushTypes keep flushing on every write,
+// anything else is flushed at most every Options.FlushInterval (0 only
+// when the response ends). A negative FlushInterval flushes everything
+// immediately, as before.
+
+// flushPolicy is the per-content-type flush setting of a Proxy.
+type flushPolicy struct {
+	interval  time.Duration
+	immediate map[string]bool // base media types flushed on every write
+
+	responses [2]atomic.Int64 // by mode: immediate, buffered
+	flushes   atomic.Int64    // flushes passed on to the connection
+	coalesced atomic.Int64    // flush requests absorbed by a pending one
+	periodic  atomic.Int64    // delayed flushes run
+}
+
+func newFlushPolicy(opts Options) *flushPolicy {
+	if opts.FlushInterval < 0 {
+		return nil
+	}
+	f := &flushPolicy{interval: opts.FlushInterval, immediate: map[string]bool{"text/event-stream": true}}
+	for _, t := range opts.FlushTypes {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			f.immediate[t] = true
+		}
+	}
+	return f
+}
+
+func (p *Proxy) flushStats() any {
+	f := p.flush
+	if f == nil {
+		return map[string]any{"enabled": false}
+	}
+	types := make([]string, 0, len(f.immediate))
+	for t := range f.immediate {
+		types = append(types, t)
+	}
+	slices.Sort(types)
+	return map[string]any{
+		"enabled":         true,
+		"interval":        f.interval.String(),
+		"immediate_types": types,
+		"responses": map[string]int64{
+			"immediate": f.responses[0].Load(),
+			"buffered":  f.responses[1].Load(),
+		},
+		"flushes":   f.flushes.Load(),
+		"periodic":  f.periodic.Load(),
+		"coalesced": f.coalesced.Load(),
+	}
+}
+
+// isImmediate reports whether a response of content type ct is flushed on
+// every write.
+func (f *flushPolicy) isImmediate(ct string) bool {
+	base, _, err := mime.ParseMediaType(ct)
+	return err == nil && f.immediate[base]
+}
+
+// flushWriter applies the policy to one response. Writes and flushes are
+// serialized, since a delayed flush runs on a timer goroutine.
+type flushWriter struct {
+	http.ResponseWriter
+	f *flushPolicy
+
+	mu        sync.Mutex
+	decided   bool
+	immediate bool
+	timer     *time.Timer
+	done      bool
+}
+
+func (w *flushWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	w.immediate = w.f.isImmediate(w.Header().Get("Content-Type"))
+	if w.immediate {
+		w.f.responses[0].Add(1)
+	} else {
+		w.f.responses[1].Add(1)
+	}
+}
+
+func (w *flushWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if code >= 200 {
+		w.decide()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *flushWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.decide()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *flushWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.decide()
+	switch {
+	case w.immediate:
+		w.flushLocked()
+	case w.done || w.f.interval == 0:
+	case w.timer != nil:
+		w.f.coalesced.Add(1)
+	default:
+		w.timer = time.AfterFunc(w.f.interval, w.delayed)
+	}
+}
+
+func (w *flushWriter) delayed() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.timer = nil
+	if !w.done {
+		w.f.periodic.Add(1)
+		w.flushLocked()
+	}
+}
+
+func (w *flushWriter) flushLocked() {
+	w.f.flushes.Add(1)
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// stop ends the response's delayed flushing, before the handler returns
+// and the server finishes the response itself.
+func (w *flushWriter) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.done = true
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+func (w *flushWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
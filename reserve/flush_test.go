@@ -0,0 +1,96 @@
+package reserve
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingWriter is a ResponseWriter counting what reaches the connection.
+type countingWriter struct {
+	header          http.Header
+	writes, flushes int
+}
+
+func (w *countingWriter) Header() http.Header         { return w.header }
+func (w *countingWriter) WriteHeader(int)             {}
+func (w *countingWriter) Write(b []byte) (int, error) { w.writes++; return len(b), nil }
+func (w *countingWriter) Flush()                      { w.flushes++ }
+
+// BenchmarkFlushWriter relays bodies the way the ReverseProxy does, a
+// flush after every write: a 1MB JSON body in 32KB reads, which the
+// interval coalesces, and an event stream of 100 events, each flushed.
+func BenchmarkFlushWriter(b *testing.B) {
+	json := bytes.Repeat([]byte(`{"k":"v"},`), copyBufSize/10)
+	event := []byte("event: response.output_text.delta\ndata: {\"delta\":\"hi\"}\n\n")
+	for _, bc := range []struct {
+		name, ct string
+		chunk    []byte
+		n        int
+	}{
+		{"json", "application/json", json, 32},
+		{"sse", "text/event-stream", event, 100},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			f := newFlushPolicy(DefaultOptions())
+			cw := &countingWriter{header: http.Header{"Content-Type": {bc.ct}}}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bc.chunk) * bc.n))
+			for b.Loop() {
+				w := &flushWriter{ResponseWriter: cw, f: f}
+				w.WriteHeader(http.StatusOK)
+				for range bc.n {
+					w.Write(bc.chunk)
+					w.Flush()
+				}
+				w.stop()
+			}
+			b.ReportMetric(float64(cw.writes)/float64(b.N), "writes/op")
+			b.ReportMetric(float64(cw.flushes)/float64(b.N), "flushes/op")
+		})
+	}
+}
+
+func TestFlushWriterSSEImmediate(t *testing.T) {
+	release := make(chan struct{})
+	u := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("data: 2\n\n"))
+	})
+	opts := DefaultOptions()
+	opts.FlushInterval = time.Hour // a buffered response would sit on it
+	opts.StreamSniffWait = 0
+	p := newTestProxy(t, opts, u)
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	defer close(release)
+
+	resp, err := http.Get(srv.URL + "/v1/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		got <- line
+	}()
+	select {
+	case line := <-got:
+		if !strings.HasPrefix(line, "data: 1") {
+			t.Fatalf("first line %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first event did not arrive while the upstream held the stream open")
+	}
+	if n := p.flush.responses[0].Load(); n != 1 {
+		t.Errorf("immediate responses = %d, want 1", n)
+	}
+}
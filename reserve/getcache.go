@@ -0,0 +1,330 @@
+package reserve
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clients such as IDE plugins list the models on every start, each time a
+// round trip to the upstream for the same answer. With Options.GetCacheTTL
+// the 200 responses to GET requests on Options.GetCacheRoutes are kept per
+// upstream, client identity, Accept-Encoding and URL: a copy younger than
+// GetCacheTTL is served as is, one older by up to GetCacheStale is served
+// at once while a single background request refreshes it, and one older
+// by up to GetCacheStaleIfError stands in for an upstream that fails (a
+// 5xx, a failed round trip, a timeout). An answer from the cache says so
+// in X-Reserve-Cache, a stale one in a Warning header as well.
+
+const getCacheHeader = "X-Reserve-Cache"
+
+const (
+	warnStale            = `110 - "Response is Stale"`
+	warnRevalidateFailed = `111 - "Revalidation Failed"`
+)
+
+// getCache is a bounded LRU of GET responses, capped in total body bytes.
+type getCache struct {
+	ttl          time.Duration
+	stale        time.Duration
+	staleIfError time.Duration
+	maxBytes     int64
+	routes       map[string]bool
+
+	mu    sync.Mutex
+	ll    *list.List // front = most recently used
+	m     map[string]*list.Element
+	bytes int64
+
+	hits         atomic.Int64
+	staleHits    atomic.Int64 // served stale while refreshing
+	staleOnError atomic.Int64 // served stale for a failed upstream
+	misses       atomic.Int64
+	stored       atomic.Int64
+	skipped      atomic.Int64 // responses not kept: not 200, too large, no-store
+	refreshes    atomic.Int64
+	refreshFails atomic.Int64
+	evictions    atomic.Int64
+	expired      atomic.Int64
+	flushed      atomic.Int64
+}
+
+// getCacheEntry is immutable once stored but for refreshing, guarded by
+// the cache's mu; a refresh stores a new entry in its place.
+type getCacheEntry struct {
+	k          string
+	at         time.Time
+	header     http.Header
+	body       []byte
+	refreshing bool
+}
+
+func newGetCache(opts Options) (*getCache, error) {
+	if opts.GetCacheTTL <= 0 {
+		return nil, nil
+	}
+	c := &getCache{
+		ttl:          opts.GetCacheTTL,
+		stale:        max(opts.GetCacheStale, 0),
+		staleIfError: max(opts.GetCacheStaleIfError, 0),
+		maxBytes:     opts.GetCacheMaxBytes,
+		routes:       map[string]bool{},
+		ll:           list.New(),
+		m:            map[string]*list.Element{},
+	}
+	for _, name := range opts.GetCacheRoutes {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		i := slices.IndexFunc(routes, func(rt route) bool { return rt.name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("reserve: GetCacheRoutes: no route %q", name)
+		}
+		if !routes[i].allows(http.MethodGet) || routes[i].background {
+			return nil, fmt.Errorf("reserve: GetCacheRoutes: route %q has no cacheable GET", name)
+		}
+		c.routes[name] = true
+	}
+	if len(c.routes) == 0 {
+		return nil, nil
+	}
+	return c, nil
+}
+
+func (p *Proxy) getCacheStats() any {
+	c := p.getCache
+	if c == nil {
+		return map[string]any{"enabled": false}
+	}
+	c.mu.Lock()
+	n, b := c.ll.Len(), c.bytes
+	c.mu.Unlock()
+	names := make([]string, 0, len(c.routes))
+	for name := range c.routes {
+		names = append(names, name)
+	}
+	return map[string]any{
+		"enabled":        true,
+		"routes":         names,
+		"ttl":            c.ttl.String(),
+		"stale":          c.stale.String(),
+		"stale_if_error": c.staleIfError.String(),
+		"max_bytes":      c.maxBytes,
+		"entries":        n,
+		"bytes":          b,
+		"hits":           c.hits.Load(),
+		"stale_hits":     c.staleHits.Load(),
+		"stale_on_error": c.staleOnError.Load(),
+		"misses":         c.misses.Load(),
+		"stored":         c.stored.Load(),
+		"skipped":        c.skipped.Load(),
+		"refreshes":      c.refreshes.Load(),
+		"refresh_failed": c.refreshFails.Load(),
+		"evictions":      c.evictions.Load(),
+		"expired":        c.expired.Load(),
+		"flushed":        c.flushed.Load(),
+	}
+}
+
+// lookup returns k's entry and its age, dropping it when too old for any
+// use. refresh is set for the one caller that is to refresh a stale entry.
+func (c *getCache) lookup(k string, now time.Time) (e *getCacheEntry, age time.Duration, refresh bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.m[k]
+	if !ok {
+		return nil, 0, false
+	}
+	e = el.Value.(*getCacheEntry)
+	age = now.Sub(e.at)
+	if age >= c.ttl+max(c.stale, c.staleIfError) {
+		c.expired.Add(1)
+		c.removeLocked(el)
+		return nil, 0, false
+	}
+	c.ll.MoveToFront(el)
+	if age >= c.ttl && age < c.ttl+c.stale && !e.refreshing {
+		e.refreshing, refresh = true, true
+	}
+	return e, age, refresh
+}
+
+// store keeps the 200 response of k, in place of any entry before it,
+// unless it may not or does not fit.
+func (c *getCache) store(k string, header http.Header, body []byte, now time.Time) {
+	if c.maxBytes > 0 && int64(len(body)) > c.maxBytes ||
+		strings.Contains(header.Get("Cache-Control"), "no-store") || len(header["Trailer"]) > 0 {
+		c.skipped.Add(1)
+		c.refreshed(k)
+		return
+	}
+	h := header.Clone()
+	for name := range h {
+		// the proxy's own, of the request that fetched it
+		if strings.HasPrefix(name, "X-Reserve-") || name == requestIDHeader {
+			delete(h, name)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.m[k]; ok {
+		c.removeLocked(el)
+	}
+	el := c.ll.PushFront(&getCacheEntry{k: k, at: now, header: h, body: body})
+	c.m[k] = el
+	c.bytes += int64(len(body))
+	c.stored.Add(1)
+	for c.maxBytes > 0 && c.bytes > c.maxBytes {
+		last := c.ll.Back()
+		if last == nil || last == el {
+			break
+		}
+		c.evictions.Add(1)
+		c.removeLocked(last)
+	}
+}
+
+// refreshed lets a later request refresh k's entry again, after a refresh
+// that stored nothing.
+func (c *getCache) refreshed(k string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.m[k]; ok {
+		el.Value.(*getCacheEntry).refreshing = false
+	}
+}
+
+func (c *getCache) removeLocked(el *list.Element) {
+	e := el.Value.(*getCacheEntry)
+	c.ll.Remove(el)
+	delete(c.m, e.k)
+	c.bytes -= int64(len(e.body))
+}
+
+// flush drops every entry and returns how many there were.
+func (c *getCache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.ll.Len()
+	c.ll.Init()
+	clear(c.m)
+	c.bytes = 0
+	c.flushed.Add(int64(n))
+	return n
+}
+
+// serveGetCache answers the GET request r on a cached route, from the
+// cache or through it; see above.
+func (p *Proxy) serveGetCache(w http.ResponseWriter, r *http.Request, st *reqState) {
+	c := p.getCache
+	k := p.target.String() + "\x00" + st.client.CacheKey + "\x00" + r.Header.Get("Accept-Encoding") + "\x00" + r.URL.RequestURI()
+	now := time.Now()
+	e, age, refresh := c.lookup(k, now)
+	switch {
+	case e != nil && age < c.ttl:
+		c.hits.Add(1)
+		st.trace.log("get_cache", "hit", true, "age", age)
+		p.writeCached(w, st, e, age, "hit", "")
+		return
+	case e != nil && age < c.ttl+c.stale:
+		c.staleHits.Add(1)
+		if refresh {
+			c.refreshes.Add(1)
+			// values carry over (the connection trace among them),
+			// cancellation does not; the id is the one of this request
+			rq := r.Clone(context.WithoutCancel(r.Context()))
+			rq.Header.Set(requestIDHeader, st.id)
+			go p.refreshGetCache(k, rq, st)
+		}
+		st.trace.log("get_cache", "stale", true, "age", age, "refresh", refresh)
+		p.writeCached(w, st, e, age, "stale", warnStale)
+		return
+	}
+	c.misses.Add(1)
+	st.trace.log("get_cache", "miss", true, "fallback", e != nil)
+	if e == nil {
+		// nothing to fall back on: the response goes through as it comes
+		w.Header().Set(getCacheHeader, "miss")
+		rec := &teeRecorder{ResponseWriter: w, limit: c.maxBytes}
+		if rec.limit <= 0 {
+			rec.limit = defaultLineCap
+		}
+		p.forward(rec, r, st)
+		if rec.keep() && rec.status == http.StatusOK {
+			c.store(k, rec.header, rec.body, time.Now())
+		} else {
+			c.skipped.Add(1)
+		}
+		return
+	}
+	rec := &responseRecorder{header: http.Header{}}
+	p.forward(rec, r, st)
+	if rec.status >= 500 || rec.aborted {
+		c.staleOnError.Add(1)
+		st.log.Warn("get cache: upstream failed, serving a stale copy", "route", st.route.name,
+			"status", rec.status, "age", age.Round(time.Second))
+		st.trace.log("get_cache", "stale_on_error", true, "status", rec.status, "age", age)
+		p.writeCached(w, st, e, time.Since(e.at), "stale-if-error", warnRevalidateFailed)
+		return
+	}
+	if rec.status == http.StatusOK {
+		c.store(k, rec.header, rec.body.Bytes(), time.Now())
+	} else {
+		c.skipped.Add(1)
+	}
+	rec.header.Set(getCacheHeader, "miss")
+	rec.writeTo(w)
+}
+
+// writeCached answers with entry e, age old, as the cache state tells.
+func (p *Proxy) writeCached(w http.ResponseWriter, st *reqState, e *getCacheEntry, age time.Duration, state, warning string) {
+	h := w.Header()
+	for k, vs := range e.header {
+		h[k] = append([]string(nil), vs...)
+	}
+	h.Set(requestIDHeader, st.id) // this request's, not the fetching one's
+	h.Set(getCacheHeader, state)
+	h.Set("Age", strconv.Itoa(int(age/time.Second)))
+	if warning != "" {
+		h.Set("Warning", warning)
+	}
+	h.Set("Content-Length", strconv.Itoa(len(e.body)))
+	st.wide.serve("cache")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(e.body)
+}
+
+// refreshGetCache fetches k anew for its stale entry with r, a detached
+// clone of the request that found it stale, on a request state of its
+// own: that request is answered already and may be gone.
+func (p *Proxy) refreshGetCache(k string, r *http.Request, st *reqState) {
+	c := p.getCache
+	rq, rst := p.withReqState(r)
+	defer rst.finish()
+	rst.route, rst.path, rst.client, rst.wide = st.route, st.path, st.client, nil
+	rec := &responseRecorder{header: http.Header{}}
+	defer func() {
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler {
+				rst.log.Error("get cache: refresh panicked", "panic", v)
+			}
+			rec.aborted = true
+		}
+		if rec.status == http.StatusOK && !rec.aborted {
+			c.store(k, rec.header, rec.body.Bytes(), time.Now())
+			return
+		}
+		c.refreshFails.Add(1)
+		c.refreshed(k)
+		rst.log.Warn("get cache: refresh failed, keeping the stale copy", "route", rst.route.name, "status", rec.status)
+	}()
+	p.upstream(rec, rq, rst)
+}
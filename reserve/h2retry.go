@@ -0,0 +1,195 @@
+package reserve
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An HTTP/2 connection the upstream is done with fails the requests on it
+// with a GOAWAY, a REFUSED_STREAM or an INTERNAL_ERROR stream reset, and
+// the same request sent again on a fresh connection goes through. The
+// transport is wrapped to do just that: a request failing with one of
+// those errors, before any response came back, is sent again up to
+// Options.H2Retries times after a short jittered pause, with
+// H2RetryFreshConn dropping the idle connections first so it can't land
+// on a connection about to go the same way. A body the proxy buffered is
+// replayed from its buffer, any other only through GetBody: a streamed
+// upload is never retried. The retries give up with the client's
+// context.
+
+const h2RetryBase = 50 * time.Millisecond
+
+// h2RetryClasses are the retryable transport errors, by the text that
+// tells them.
+var h2RetryClasses = []struct{ class, text string }{
+	{"goaway", "GOAWAY"},
+	{"refused_stream", "REFUSED_STREAM"},
+	{"internal_error", "INTERNAL_ERROR"},
+	{"conn_lost", "http2: client connection lost"},
+}
+
+type h2Retry struct {
+	next  http.RoundTripper
+	max   int
+	fresh bool
+
+	errors        map[string]*atomic.Int64 // retryable errors by class, fixed at construction
+	retries       atomic.Int64
+	recovered     atomic.Int64 // requests that succeeded on a retry
+	exhausted     atomic.Int64 // failed on every attempt
+	notReplayable atomic.Int64 // bodies that could not be sent again
+	canceled      atomic.Int64 // client gone during the pause
+}
+
+func newH2Retry(opts Options, next http.RoundTripper) *h2Retry {
+	if opts.H2Retries <= 0 {
+		return nil
+	}
+	t := &h2Retry{next: next, max: opts.H2Retries, fresh: opts.H2RetryFreshConn, errors: map[string]*atomic.Int64{}}
+	for _, c := range h2RetryClasses {
+		t.errors[c.class] = new(atomic.Int64)
+	}
+	return t
+}
+
+// h2ErrorClass is the class of a retryable transport error, "" for any
+// other.
+func h2ErrorClass(err error) string {
+	s := err.Error()
+	for _, c := range h2RetryClasses {
+		if strings.Contains(s, c.text) {
+			return c.class
+		}
+	}
+	return ""
+}
+
+func (t *h2Retry) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	var shared *sharedBody
+	if pb, ok := req.Body.(*pooledBody); ok && pb.b != nil {
+		shared = &sharedBody{pb: pb, bs: pb.b.Bytes()}
+		shared.refs.Store(1)
+		defer shared.release()
+	}
+	for attempt := 0; ; attempt++ {
+		out := req
+		switch {
+		case shared != nil:
+			r := *req
+			r.Body = shared.open()
+			out = &r
+		case attempt > 0 && req.GetBody != nil:
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r := *req
+			r.Body = body
+			out = &r
+		}
+		resp, err := t.next.RoundTrip(out)
+		if err == nil {
+			if attempt > 0 {
+				t.recovered.Add(1)
+			}
+			return resp, nil
+		}
+		class := h2ErrorClass(err)
+		if class == "" || ctx.Err() != nil {
+			return nil, err
+		}
+		t.errors[class].Add(1)
+		switch {
+		case attempt == t.max:
+			t.exhausted.Add(1)
+			return nil, err
+		case shared == nil && req.Body != nil && req.Body != http.NoBody && req.GetBody == nil:
+			t.notReplayable.Add(1)
+			return nil, err
+		}
+		// 50ms, 100ms, ... each within ±50%
+		d := h2RetryBase << attempt
+		d = d/2 + rand.N(d)
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			t.canceled.Add(1)
+			return nil, err
+		case <-timer.C:
+		}
+		if ci, ok := t.next.(interface{ CloseIdleConnections() }); ok && t.fresh {
+			ci.CloseIdleConnections()
+		}
+		t.retries.Add(1)
+		logOf(ctx).Debug("upstream: retrying after a transient HTTP/2 error", "class", class,
+			"attempt", attempt+1, "wait", d, "error", err)
+		traceOf(ctx).log("h2_retry", "class", class, "attempt", attempt+1, "wait", d, "error", err)
+	}
+}
+
+// CloseIdleConnections passes through to the wrapped transport.
+func (t *h2Retry) CloseIdleConnections() {
+	if ci, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
+func (t *h2Retry) stats() any {
+	if t == nil {
+		return map[string]any{"enabled": false}
+	}
+	errs := make(map[string]int64, len(t.errors))
+	for class, n := range t.errors {
+		errs[class] = n.Load()
+	}
+	return map[string]any{
+		"enabled":        true,
+		"max":            t.max,
+		"fresh_conn":     t.fresh,
+		"errors":         errs,
+		"retries":        t.retries.Load(),
+		"recovered":      t.recovered.Load(),
+		"exhausted":      t.exhausted.Load(),
+		"not_replayable": t.notReplayable.Load(),
+		"canceled":       t.canceled.Load(),
+	}
+}
+
+// sharedBody lets every attempt of a request read its pooled body, which
+// goes back to the pool once the request and every attempt's reader are
+// done with it: the transport may close a body after RoundTrip returned.
+type sharedBody struct {
+	pb   *pooledBody
+	bs   []byte
+	refs atomic.Int32
+}
+
+func (s *sharedBody) open() io.ReadCloser {
+	s.refs.Add(1)
+	return &sharedReader{Reader: bytes.NewReader(s.bs), s: s}
+}
+
+func (s *sharedBody) release() {
+	if s.refs.Add(-1) == 0 {
+		s.pb.Close()
+	}
+}
+
+type sharedReader struct {
+	*bytes.Reader
+	s    *sharedBody
+	once sync.Once
+}
+
+func (r *sharedReader) Close() error {
+	r.once.Do(r.s.release)
+	return nil
+}
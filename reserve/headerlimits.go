@@ -0,0 +1,105 @@
+package reserve
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// A client's oversized cookie would otherwise go upstream and come back
+// as a bare 431. Ahead of route matching and the body read, the proxy
+// drops the Options.DropHeaders of a request (Cookie by default: the
+// upstream has no use for it) and checks what is left against
+// MaxHeaderValueBytes, MaxHeaderBytes (the header block as sent: name,
+// ": ", value and CRLF for each value) and MaxHeaderCount (values, a
+// repeated header counting once per value), 0 leaving each unchecked. A
+// request over a limit gets a 431 naming the header, never its value.
+
+type headerLimitCounts struct {
+	value   atomic.Int64 // requests with a value over MaxHeaderValueBytes
+	total   atomic.Int64
+	count   atomic.Int64
+	dropped atomic.Int64 // requests that had a DropHeaders header removed
+}
+
+func (p *Proxy) headerLimitStats() any {
+	c := &p.headerLimits
+	return map[string]any{
+		"max_value_bytes": p.opts.MaxHeaderValueBytes,
+		"max_bytes":       p.opts.MaxHeaderBytes,
+		"max_count":       p.opts.MaxHeaderCount,
+		"drop":            p.dropHeaders,
+		"value_rejected":  c.value.Load(),
+		"total_rejected":  c.total.Load(),
+		"count_rejected":  c.count.Load(),
+		"dropped":         c.dropped.Load(),
+	}
+}
+
+// newDropHeaders is opts.DropHeaders in canonical form.
+func newDropHeaders(opts Options) []string {
+	var hs []string
+	for _, h := range opts.DropHeaders {
+		if h = strings.TrimSpace(h); h != "" {
+			hs = append(hs, http.CanonicalHeaderKey(h))
+		}
+	}
+	return hs
+}
+
+func headerTooLarge(msg string) *httpError {
+	return &httpError{status: http.StatusRequestHeaderFieldsTooLarge, code: "request_header_too_large", msg: msg}
+}
+
+// checkHeaders drops the DropHeaders of r and returns the error to answer
+// it with when its headers are over a limit.
+func (p *Proxy) checkHeaders(r *http.Request) *httpError {
+	dropped := false
+	for _, k := range p.dropHeaders {
+		if _, ok := r.Header[k]; ok {
+			delete(r.Header, k)
+			dropped = true
+		}
+	}
+	if dropped {
+		p.headerLimits.dropped.Add(1)
+	}
+	o := &p.opts
+	if o.MaxHeaderValueBytes <= 0 && o.MaxHeaderBytes <= 0 && o.MaxHeaderCount <= 0 {
+		return nil
+	}
+	total, count, largest, largestN := 0, 0, "", 0
+	for k, vs := range r.Header {
+		n := 0
+		for _, v := range vs {
+			if o.MaxHeaderValueBytes > 0 && len(v) > o.MaxHeaderValueBytes {
+				p.headerLimits.value.Add(1)
+				return p.headerRejected(r, headerTooLarge(fmt.Sprintf(
+					"request header %s is over the %d-byte limit", k, o.MaxHeaderValueBytes)), k)
+			}
+			n += len(k) + len(v) + 4
+		}
+		count += len(vs)
+		total += n
+		if n > largestN {
+			largest, largestN = k, n
+		}
+	}
+	if o.MaxHeaderCount > 0 && count > o.MaxHeaderCount {
+		p.headerLimits.count.Add(1)
+		return p.headerRejected(r, headerTooLarge(fmt.Sprintf(
+			"%d request headers, over the limit of %d", count, o.MaxHeaderCount)), "")
+	}
+	if o.MaxHeaderBytes > 0 && total > o.MaxHeaderBytes {
+		p.headerLimits.total.Add(1)
+		return p.headerRejected(r, headerTooLarge(fmt.Sprintf(
+			"request headers are over the %d-byte limit, the largest is %s", o.MaxHeaderBytes, largest)), largest)
+	}
+	return nil
+}
+
+func (p *Proxy) headerRejected(r *http.Request, e *httpError, name string) *httpError {
+	logOf(r.Context()).Info("request refused, headers over a limit", "path", r.URL.Path, "header", name, "error", e.msg)
+	return e
+}
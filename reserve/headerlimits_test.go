@@ -0,0 +1,129 @@
+package reserve
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// untouchedBody fails the test when the proxy reads it.
+type untouchedBody struct{ t *testing.T }
+
+func (b untouchedBody) Read([]byte) (int, error) {
+	b.t.Error("request body read")
+	return 0, io.EOF
+}
+
+// sendHeaders serves a POST whose headers are exactly hdr through p.
+func sendHeaders(t *testing.T, p http.Handler, hdr http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/v1/responses", strings.NewReader(`{"input":"hi"}`))
+	req.Header = hdr
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	return w
+}
+
+func TestHeaderLimits(t *testing.T) {
+	// X-A: <v>\r\n is len(v)+7 bytes
+	value := func(n int) string { return strings.Repeat("v", n) }
+	for _, tc := range []struct {
+		name   string
+		set    func(*Options)
+		hdr    http.Header
+		status int
+		header string // the header the error names
+	}{
+		{"value at the limit", func(o *Options) { o.MaxHeaderValueBytes = 100 },
+			http.Header{"X-A": {value(100)}}, http.StatusOK, ""},
+		{"value over the limit", func(o *Options) { o.MaxHeaderValueBytes = 100 },
+			http.Header{"X-A": {"short"}, "X-Big": {value(101)}}, http.StatusRequestHeaderFieldsTooLarge, "X-Big"},
+		{"repeated value over the limit", func(o *Options) { o.MaxHeaderValueBytes = 100 },
+			http.Header{"X-Big": {"short", value(101)}}, http.StatusRequestHeaderFieldsTooLarge, "X-Big"},
+		{"count at the limit", func(o *Options) { o.MaxHeaderCount = 3 },
+			http.Header{"X-A": {"1"}, "X-B": {"2", "3"}}, http.StatusOK, ""},
+		{"count over the limit", func(o *Options) { o.MaxHeaderCount = 3 },
+			http.Header{"X-A": {"1", "2"}, "X-B": {"3", "4"}}, http.StatusRequestHeaderFieldsTooLarge, ""},
+		{"total at the limit", func(o *Options) { o.MaxHeaderBytes = 2*7 + 100 + 50 },
+			http.Header{"X-A": {value(100)}, "X-B": {value(50)}}, http.StatusOK, ""},
+		{"total over the limit", func(o *Options) { o.MaxHeaderBytes = 2*7 + 100 + 50 },
+			http.Header{"X-A": {value(100)}, "X-B": {value(51)}}, http.StatusRequestHeaderFieldsTooLarge, "X-A"},
+		{"total over the limit by repeats", func(o *Options) { o.MaxHeaderBytes = 3 * 8 },
+			http.Header{"X-A": {"a", "b", "c", "d"}}, http.StatusRequestHeaderFieldsTooLarge, "X-A"},
+		{"no limits", func(o *Options) {},
+			http.Header{"X-A": {value(1 << 16)}}, http.StatusOK, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := newTestUpstream(t, nil)
+			opts := DefaultOptions()
+			tc.set(&opts)
+			p := newTestProxy(t, opts, u)
+			w := sendHeaders(t, p, tc.hdr)
+			if w.Code != tc.status {
+				t.Fatalf("answered %d %s, want %d", w.Code, w.Body, tc.status)
+			}
+			if tc.status == http.StatusOK {
+				return
+			}
+			body := w.Body.String()
+			if !strings.Contains(body, "request_header_too_large") || !strings.Contains(body, tc.header) {
+				t.Errorf("error body %s, want request_header_too_large naming %q", body, tc.header)
+			}
+			if strings.Contains(body, "vvvv") {
+				t.Errorf("error body %s quotes the header value", body)
+			}
+			if n := len(u.requests()); n != 0 {
+				t.Errorf("upstream got %d requests, want none", n)
+			}
+		})
+	}
+}
+
+func TestHeaderLimitsBeforeBody(t *testing.T) {
+	u := newTestUpstream(t, nil)
+	opts := DefaultOptions()
+	opts.MaxHeaderValueBytes = 10
+	p := newTestProxy(t, opts, u)
+	req := httptest.NewRequest("POST", "/v1/responses", untouchedBody{t})
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Big", strings.Repeat("v", 11))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("answered %d, want 431", w.Code)
+	}
+	if st := p.headerLimitStats().(map[string]any); st["value_rejected"] != int64(1) {
+		t.Errorf("header_limits stats = %v", st)
+	}
+}
+
+func TestDropHeaders(t *testing.T) {
+	u := newTestUpstream(t, nil)
+	opts := DefaultOptions()
+	opts.MaxHeaderBytes = 1000
+	opts.DropHeaders = append(opts.DropHeaders, " x-internal-token ")
+	p := newTestProxy(t, opts, u)
+
+	// a cookie far over the limit is dropped before the limit is checked
+	w := sendHeaders(t, p, http.Header{
+		"Content-Type":     {"application/json"},
+		"Cookie":           {"session=" + strings.Repeat("c", 2<<20)},
+		"X-Internal-Token": {"secret"},
+		"X-Kept":           {"1"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("answered %d %s, want 200", w.Code, w.Body)
+	}
+	got := u.requests()[0].header
+	if got.Get("Cookie") != "" || got.Get("X-Internal-Token") != "" {
+		t.Errorf("forwarded Cookie %q, X-Internal-Token %q", got.Get("Cookie"), got.Get("X-Internal-Token"))
+	}
+	if got.Get("X-Kept") != "1" {
+		t.Error("X-Kept not forwarded")
+	}
+	st := p.headerLimitStats().(map[string]any)
+	if st["dropped"] != int64(1) || strings.Join(st["drop"].([]string), ",") != "Cookie,X-Internal-Token" {
+		t.Errorf("header_limits stats = %v", st)
+	}
+}
@@ -0,0 +1,189 @@
+package reserve
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// The upstream behaves differently by User-Agent and OpenAI-Beta, and a
+// mixed fleet of clients sends every value there is. The headers of
+// Options.Policy, overlaid per route by its route_headers, normalize them
+// on the way upstream, after the Director's own changes: a User-Agent set
+// where the client sent none or forced over the client's, OpenAI-Beta
+// features added to the client's list, and Accept-Encoding set outright.
+// With gzip asked for on behalf of a client that did not, the response is
+// decompressed for it. What a header held before is written to the wide
+// log record and the trace. Unmatched paths are left alone.
+
+// User-Agent modes of a HeaderPolicy.
+const (
+	UserAgentDefault = "default"
+	UserAgentForce   = "force"
+)
+
+// HeaderPolicy names the request headers the proxy normalizes. UserAgent
+// is set when the client sent none (UserAgentMode UserAgentDefault, the
+// default) or always (UserAgentForce); OpenAIBeta lists features added to
+// OpenAI-Beta; AcceptEncoding, gzip or identity, replaces the client's.
+type HeaderPolicy struct {
+	UserAgent      string   `json:"user_agent,omitempty"`
+	UserAgentMode  string   `json:"user_agent_mode,omitempty"`
+	OpenAIBeta     []string `json:"openai_beta,omitempty"`
+	AcceptEncoding string   `json:"accept_encoding,omitempty"`
+}
+
+// Validate reports the first invalid value of h.
+func (h *HeaderPolicy) Validate() error {
+	switch h.UserAgentMode {
+	case "", UserAgentDefault:
+	case UserAgentForce:
+		if h.UserAgent == "" {
+			return fmt.Errorf("user_agent_mode %q without a user_agent", h.UserAgentMode)
+		}
+	default:
+		return fmt.Errorf("user_agent_mode %q: want %q or %q", h.UserAgentMode, UserAgentDefault, UserAgentForce)
+	}
+	for _, f := range h.OpenAIBeta {
+		if f == "" || strings.ContainsAny(f, ", ") {
+			return fmt.Errorf("openai_beta %q: want a feature name", f)
+		}
+	}
+	switch h.AcceptEncoding {
+	case "", "gzip", "identity":
+	default:
+		return fmt.Errorf("accept_encoding %q: want gzip or identity", h.AcceptEncoding)
+	}
+	return nil
+}
+
+// headersFor is the header policy of route: Headers with the route's
+// fields over it, its OpenAIBeta features added. ok is false when there
+// is nothing to do.
+func (p *RequestPolicy) headersFor(route string) (h HeaderPolicy, ok bool) {
+	if p.Headers != nil {
+		h = *p.Headers
+		h.OpenAIBeta = slices.Clone(h.OpenAIBeta)
+	}
+	if rh := p.RouteHeaders[route]; rh != nil {
+		if rh.UserAgent != "" {
+			h.UserAgent = rh.UserAgent
+		}
+		if rh.UserAgentMode != "" {
+			h.UserAgentMode = rh.UserAgentMode
+		}
+		for _, f := range rh.OpenAIBeta {
+			if !slices.Contains(h.OpenAIBeta, f) {
+				h.OpenAIBeta = append(h.OpenAIBeta, f)
+			}
+		}
+		if rh.AcceptEncoding != "" {
+			h.AcceptEncoding = rh.AcceptEncoding
+		}
+	}
+	return h, h.UserAgent != "" || len(h.OpenAIBeta) > 0 || h.AcceptEncoding != ""
+}
+
+// normalizeHeaders applies the header policy to the outgoing request r;
+// run from the Director.
+func (p *Proxy) normalizeHeaders(r *http.Request) {
+	st := stateOf(r.Context())
+	if p.opts.Policy == nil || st == nil || st.route == nil {
+		return
+	}
+	hp, ok := p.opts.Policy.headersFor(st.route.name)
+	if !ok {
+		return
+	}
+	var replaced map[string]string
+	set := func(k, v string) {
+		old := r.Header.Get(k)
+		if old == v {
+			return
+		}
+		if replaced == nil {
+			replaced = map[string]string{}
+		}
+		replaced[k] = old
+		r.Header.Set(k, v)
+	}
+	if hp.UserAgent != "" && (hp.UserAgentMode == UserAgentForce || r.Header.Get("User-Agent") == "") {
+		set("User-Agent", hp.UserAgent)
+	}
+	if len(hp.OpenAIBeta) > 0 {
+		var fs []string
+		for _, v := range r.Header.Values("OpenAI-Beta") {
+			for _, f := range strings.Split(v, ",") {
+				if f = strings.TrimSpace(f); f != "" && !slices.Contains(fs, f) {
+					fs = append(fs, f)
+				}
+			}
+		}
+		n := len(fs)
+		for _, f := range hp.OpenAIBeta {
+			if !slices.Contains(fs, f) {
+				fs = append(fs, f)
+			}
+		}
+		if len(fs) > n {
+			set("OpenAI-Beta", strings.Join(fs, ", "))
+		}
+	}
+	if ae := hp.AcceptEncoding; ae != "" {
+		old := r.Header.Get("Accept-Encoding")
+		set("Accept-Encoding", ae)
+		// the client may not read what it did not ask for
+		st.askedGzip = ae == "gzip"
+		st.gunzip = st.askedGzip && !acceptsGzip(old)
+	}
+	if replaced == nil {
+		return
+	}
+	st.wide.headersReplaced(replaced)
+	st.trace.log("headers", "replaced", replaced)
+	logOf(r.Context()).Debug("headers normalized", "route", st.route.name, "replaced", replaced)
+}
+
+// acceptsGzip reports whether the Accept-Encoding value ae takes gzip.
+func acceptsGzip(ae string) bool {
+	for _, e := range strings.Split(ae, ",") {
+		name, q, _ := strings.Cut(strings.TrimSpace(e), ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			return strings.ReplaceAll(strings.TrimSpace(q), " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gunzipResponse decompresses a gzip resp for a client that did not ask
+// for gzip (see normalizeHeaders). The reader is not pooled: the reverse
+// proxy may close a body while a read is still in flight.
+func gunzipResponse(resp *http.Response) error {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return nil
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err == io.EOF {
+		return nil // no body
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body = &gunzipBody{Reader: zr, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// gunzipBody is a response body read through gzip.
+type gunzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gunzipBody) Close() error { return b.body.Close() }
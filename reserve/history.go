@@ -0,0 +1,133 @@
+package reserve
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/ast"
+)
+
+// Clients that resend the whole history pass back the reasoning items of
+// earlier turns, which cost input tokens and help nothing: without
+// encrypted content the upstream reasons afresh anyway. With
+// Options.StripReasoning the stale_reasoning hook drops the reasoning
+// items at the top level of input, keeping those that carry
+// encrypted_content, which stateless clients rely on. It runs first, so
+// the input window sees what is left. A request continuing a stored
+// response (previous_response_id) does not resend history and is left
+// alone.
+
+var (
+	kReasoning          = []byte(`"reasoning"`)
+	kPreviousResponseID = []byte(`"previous_response_id"`)
+)
+
+type staleReasoningCounts struct {
+	requests atomic.Int64 // requests that had items dropped
+	items    atomic.Int64
+	bytes    atomic.Int64 // encoded size of the dropped items
+	chained  atomic.Int64 // requests left alone for previous_response_id
+}
+
+func (rr *Rewriter) staleReasoningStats() any {
+	return map[string]any{
+		"enabled":  rr.opts.StripReasoning,
+		"requests": rr.staleReasoning.requests.Load(),
+		"items":    rr.staleReasoning.items.Load(),
+		"bytes":    rr.staleReasoning.bytes.Load(),
+		"chained":  rr.staleReasoning.chained.Load(),
+	}
+}
+
+// staleReasoningHook drops the input reasoning items without encrypted
+// content.
+func staleReasoningHook(r *Request) error {
+	rr := r.rw.rr
+	if !rr.opts.StripReasoning {
+		return nil
+	}
+	var in, prev *ast.Node
+	if r.parsed {
+		in, prev = r.root.Get("input"), r.root.Get("previous_response_id")
+	} else {
+		// look before taking the AST
+		bs := r.Body()
+		if !hasJSONKey(bs, kInput) || !bytes.Contains(bs, kReasoning) {
+			return nil
+		}
+		if ok, err := r.walkable(); !ok {
+			return err
+		}
+		i, err := sonic.Get(bs, "input")
+		if err != nil {
+			return nil
+		}
+		in = &i
+		if hasJSONKey(bs, kPreviousResponseID) {
+			p, _ := sonic.Get(bs, "previous_response_id")
+			prev = &p
+		}
+	}
+	stale, size := staleReasoning(in)
+	if len(stale) == 0 {
+		return nil
+	}
+	if nodeString(prev) != "" {
+		rr.staleReasoning.chained.Add(1)
+		traceOf(r.HTTP.Context()).log("stale_reasoning", "chained", true, "items", len(stale))
+		return nil
+	}
+	root, err := r.JSON()
+	if root == nil {
+		return err
+	}
+	items, err := root.Get("input").ArrayUseNode()
+	if err != nil {
+		return err
+	}
+	kept := make([]ast.Node, 0, len(items))
+	for i := range items {
+		if !stale[i] {
+			kept = append(kept, items[i])
+		}
+	}
+	if _, err := root.Set("input", ast.NewArray(kept)); err != nil {
+		return err
+	}
+	rr.staleReasoning.requests.Add(1)
+	rr.staleReasoning.items.Add(int64(len(stale)))
+	rr.staleReasoning.bytes.Add(int64(size))
+	r.Logger().Debug("stale reasoning: dropped input reasoning items", "route", r.Route,
+		"items", len(stale), "bytes", size)
+	traceOf(r.HTTP.Context()).log("stale_reasoning", "items", len(stale), "bytes", size)
+	return nil
+}
+
+// staleReasoning returns the indexes of the reasoning items of the input
+// array in that carry no encrypted content, and their encoded size.
+func staleReasoning(in *ast.Node) (map[int]bool, int) {
+	if nodeType(in) != ast.V_ARRAY {
+		return nil, 0
+	}
+	items, err := in.ArrayUseNode()
+	if err != nil {
+		return nil, 0
+	}
+	var stale map[int]bool
+	size := 0
+	for i := range items {
+		it := &items[i]
+		if nodeType(it) != ast.V_OBJECT || nodeString(it.Get("type")) != "reasoning" ||
+			nodeString(it.Get("encrypted_content")) != "" {
+			continue
+		}
+		if stale == nil {
+			stale = map[int]bool{}
+		}
+		stale[i] = true
+		raw, _ := it.Raw()
+		size += len(raw)
+	}
+	return stale, size
+}
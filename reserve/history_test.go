@@ -0,0 +1,90 @@
+package reserve
+
+import (
+	"slices"
+	"testing"
+)
+
+func sealedReasoning(id string) string {
+	return `{"id":"` + id + `","type":"reasoning","summary":[],"encrypted_content":"gAAAAB` + pad[:64] + `"}`
+}
+
+func staleRewriter() *Rewriter {
+	opts := DefaultOptions()
+	opts.StripReasoning = true
+	return NewRewriter(opts)
+}
+
+func TestStaleReasoningFullHistory(t *testing.T) {
+	rr := staleRewriter()
+	body := transcript(msg("u1", "user"), reasoningItem("r1"), msg("a1", "assistant"), sealedReasoning("r2"),
+		call("c1", "a"), callOutput("o1", "a"), msg("u2", "user"), reasoningItem("r3"), msg("a2", "assistant"),
+		msg("u3", "user"))
+	res, out := rewrite(t, rr, "/v1/responses", nil, body)
+	if got, want := inputIDs(t, out), "u1,a1,r2,c1,o1,u2,a2,u3"; got != want {
+		t.Errorf("input = %s, want %s", got, want)
+	}
+	if !slices.Contains(res.Applied, "stale_reasoning") {
+		t.Errorf("applied = %v, want stale_reasoning in it", res.Applied)
+	}
+	st := rr.staleReasoningStats().(map[string]any)
+	size := int64(len(reasoningItem("r1")) + len(reasoningItem("r3")))
+	if st["requests"] != int64(1) || st["items"] != int64(2) || st["bytes"] != size {
+		t.Errorf("stale_reasoning stats = %v, want 1 request, 2 items, %d bytes", st, size)
+	}
+}
+
+func TestStaleReasoningPreviousResponse(t *testing.T) {
+	// continuing a stored response: only the new turn is sent, and
+	// whatever reasoning it carries stays
+	rr := staleRewriter()
+	body := []byte(`{"model":"gpt-5","previous_response_id":"resp_1","input":[` +
+		reasoningItem("r1") + `,` + msg("u2", "user") + `]}`)
+	res, out := rewrite(t, rr, "/v1/responses", nil, body)
+	if got, want := inputIDs(t, out), "r1,u2"; got != want {
+		t.Errorf("input = %s, want %s", got, want)
+	}
+	if slices.Contains(res.Applied, "stale_reasoning") {
+		t.Errorf("applied = %v, want no stale_reasoning", res.Applied)
+	}
+	st := rr.staleReasoningStats().(map[string]any)
+	if st["chained"] != int64(1) || st["items"] != int64(0) {
+		t.Errorf("stale_reasoning stats = %v", st)
+	}
+}
+
+func TestStaleReasoningLeftAlone(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body []byte
+		want string
+	}{
+		{"only encrypted reasoning", transcript(msg("u1", "user"), sealedReasoning("r1"), msg("u2", "user")), "u1,r1,u2"},
+		{"no reasoning", transcript(msg("u1", "user"), msg("a1", "assistant")), "u1,a1"},
+		{
+			"reasoning in a function output",
+			transcript(msg("u1", "user"), `{"id":"o1","type":"function_call_output","call_id":"a","output":[`+reasoningItem("r1")+`]}`),
+			"u1,o1",
+		},
+		{"the word in a message", transcript(`{"id":"u1","role":"user","content":"\"reasoning\" please"}`), "u1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := staleRewriter()
+			_, out := rewrite(t, rr, "/v1/responses", nil, tc.body)
+			if got := inputIDs(t, out); got != tc.want {
+				t.Errorf("input = %s, want %s", got, tc.want)
+			}
+			if st := rr.staleReasoningStats().(map[string]any); st["items"] != int64(0) {
+				t.Errorf("stale_reasoning stats = %v", st)
+			}
+		})
+	}
+}
+
+func TestStaleReasoningOff(t *testing.T) {
+	body := transcript(msg("u1", "user"), reasoningItem("r1"), msg("u2", "user"))
+	_, out := rewrite(t, NewRewriter(DefaultOptions()), "/v1/responses", nil, body)
+	if got := inputIDs(t, out); got != "u1,r1,u2" {
+		t.Errorf("input = %s with StripReasoning off", got)
+	}
+}
@@ -0,0 +1,435 @@
+package reserve
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/bytedance/sonic/ast"
+)
+
+// RequestHook edits a buffered request body before it is forwarded.
+type RequestHook interface {
+	HandleRequest(r *Request) error
+}
+
+// ResponseHook inspects or edits an upstream response before it is relayed.
+type ResponseHook interface {
+	HandleResponse(r *Response) error
+}
+
+// RequestHookFunc adapts a function to RequestHook.
+type RequestHookFunc func(r *Request) error
+
+func (f RequestHookFunc) HandleRequest(r *Request) error { return f(r) }
+
+// ResponseHookFunc adapts a function to ResponseHook.
+type ResponseHookFunc func(r *Response) error
+
+func (f ResponseHookFunc) HandleResponse(r *Response) error { return f(r) }
+
+// OnError is what happens when a hook returns an error. Errors made with
+// Abort always answer the request, whatever the hook declares.
+type OnError int
+
+const (
+	// FailRequest answers the request with 500 hook_failed.
+	FailRequest OnError = iota
+	// SkipHook logs the error and carries on with the remaining hooks. Edits
+	// the hook made before failing are kept.
+	SkipHook
+)
+
+// Hook is one entry of Options.Hooks. Request hooks run, in order, on the
+// bodies of rewritten routes; response hooks run, in order, on every
+// response of a matched route. Either may be nil.
+type Hook struct {
+	Name     string
+	Request  RequestHook
+	Response ResponseHook
+	OnError  OnError
+}
+
+var errHookFailed = &httpError{
+	status: http.StatusInternalServerError,
+	code:   "hook_failed",
+	msg:    "a proxy hook failed to process the request",
+}
+
+// Abort returns an error that makes the proxy answer the request with
+// status instead of forwarding it (or relaying the response). The body
+// has the OpenAI error shape with code and msg.
+func Abort(status int, code, msg string) error {
+	return &httpError{status: status, code: code, msg: msg}
+}
+
+// DefaultHooks is the built-in rewrite. A nil Options.Hooks runs these
+// hooks, in this order. On requests:
+//
+//   - stale_reasoning drops stale reasoning items (with
+//     Options.StripReasoning, history.go)
+//   - input_window drops the oldest input items of requests over
+//     Options.InputTokenBudget (window.go)
+//   - instructions migrates instructions into a developer message
+//   - developer_message puts the policy's DeveloperMessage first
+//     (devmessage.go)
+//   - system_role turns system messages into developer messages (with
+//     Options.SystemToDeveloper, system.go)
+//   - policy sets the seed and service_tier of Options.Policy (policy.go)
+//   - tool_choice sets the policy's tool_choice (toolchoice.go)
+//   - text_format sets the policy's text.format (textformat.go)
+//   - reasoning_include asks for encrypted reasoning (with
+//     Options.ReasoningInclude)
+//   - prompt_cache_key injects the client's prompt_cache_key
+//
+// On responses:
+//
+//   - stream_errors turns error streams into error responses (sniff.go)
+//   - public_urls points upstream URLs at the proxy (publicurl.go)
+func DefaultHooks() []Hook {
+	return []Hook{
+		{Name: "stale_reasoning", Request: RequestHookFunc(staleReasoningHook), OnError: SkipHook},
+		{Name: "input_window", Request: RequestHookFunc(inputWindowHook), Response: ResponseHookFunc(inputWindowResponse), OnError: SkipHook},
+		{Name: "instructions", Request: RequestHookFunc(migrateInstructionsHook), OnError: SkipHook},
+		{Name: "developer_message", Request: RequestHookFunc(developerMessageHook), OnError: SkipHook},
+		{Name: "system_role", Request: RequestHookFunc(systemRoleHook), OnError: SkipHook},
+		{Name: "policy", Request: RequestHookFunc(policyHook), OnError: SkipHook},
+		{Name: "tool_choice", Request: RequestHookFunc(toolChoiceHook), OnError: SkipHook},
+		{Name: "text_format", Request: RequestHookFunc(textFormatHook), OnError: SkipHook},
+		{Name: "reasoning_include", Request: RequestHookFunc(reasoningIncludeHook), Response: ResponseHookFunc(reasoningIncludeResponse), OnError: SkipHook},
+		{Name: "prompt_cache_key", Request: RequestHookFunc(promptCacheKeyHook), OnError: SkipHook},
+		{Name: "stream_errors", Response: ResponseHookFunc(streamErrorsHook), OnError: SkipHook},
+		{Name: "public_urls", Response: ResponseHookFunc(publicURLsHook), OnError: SkipHook},
+	}
+}
+
+// State is a per-request bag for hooks to pass values to later hooks,
+// request hooks to response hooks included. It is accessed through Keys
+// and is not safe for concurrent use.
+type State struct {
+	m map[any]any
+}
+
+// Key is a typed State slot. Keys compare by identity, so two keys made
+// with the same name are still distinct.
+type Key[T any] struct {
+	name string
+}
+
+func NewKey[T any](name string) *Key[T] { return &Key[T]{name: name} }
+
+func (k *Key[T]) String() string { return k.name }
+
+func (k *Key[T]) Get(s *State) (v T, ok bool) {
+	if s == nil {
+		return v, false
+	}
+	v, ok = s.m[k].(T)
+	return v, ok
+}
+
+func (k *Key[T]) Set(s *State, v T) {
+	if s.m == nil {
+		s.m = map[any]any{}
+	}
+	s.m[k] = v
+}
+
+// hookError applies h's error policy; it returns the error to answer the
+// request with, or nil to carry on.
+func hookError(log *slog.Logger, h *Hook, phase string, err error) error {
+	if he, ok := err.(*httpError); ok {
+		return he
+	}
+	if h.OnError == SkipHook {
+		log.Warn("hook failed, skipped", "hook", h.Name, "phase", phase, "error", err)
+		return nil
+	}
+	log.Error("hook failed", "hook", h.Name, "phase", phase, "error", err)
+	return errHookFailed
+}
+
+// Request is a request body being rewritten by request hooks. The body is
+// buffered and decompressed; hooks edit it either as bytes (Body/SetBody)
+// or as a sonic AST (JSON), and the proxy encodes the AST once at the end.
+type Request struct {
+	// HTTP is the client request, for its headers and URL. Its Body has
+	// been read; use Body instead.
+	HTTP *http.Request
+	// Route is the name of the matched route.
+	Route string
+	State *State
+
+	rw *bodyRewrite
+
+	root   ast.Node
+	parsed bool // root holds cur()
+	dirty  bool // root was handed out and may differ from cur()
+	noJSON bool // cur() is over the limits or doesn't parse
+
+	limits int // 0 unchecked, 1 ok, -1 over
+	change bool
+	edits  int // SetBody/JSON calls, to tell which hooks edited the body
+	parses int // successful AST parses
+
+	applied []string
+}
+
+// Logger returns the logger of the request, which adds its request_id.
+func (r *Request) Logger() *slog.Logger { return logOf(r.HTTP.Context()) }
+
+// Body returns the current body. It stays valid until the body changes and
+// must not be modified.
+func (r *Request) Body() []byte {
+	if r.dirty {
+		r.encode()
+	}
+	return r.rw.cur().Bytes()
+}
+
+// SetBody replaces the body with a copy of b.
+func (r *Request) SetBody(b []byte) {
+	out := getBuf(len(b))
+	out.Write(b)
+	r.setBuf(out)
+}
+
+func (r *Request) setBuf(out *bytes.Buffer) {
+	r.edits++
+	r.replace(out)
+}
+
+func (r *Request) replace(out *bytes.Buffer) {
+	r.root, r.parsed, r.dirty = ast.Node{}, false, false
+	r.rw.setOut(out)
+	r.noJSON, r.limits, r.change = false, 0, true
+}
+
+// JSON returns the body as a sonic AST, parsing it on first use; edits
+// made to the node are what gets forwarded. A nil node (with a nil error)
+// means the body is not a JSON document the proxy will parse (malformed,
+// or over the JSON limits) and should be left alone. A non-nil error
+// rejects the request.
+func (r *Request) JSON() (*ast.Node, error) {
+	root, err := r.load()
+	if root != nil {
+		r.dirty = true
+		r.edits++
+	}
+	return root, err
+}
+
+// load is JSON for reading: the parsed AST, not counted as an edit.
+func (r *Request) load() (*ast.Node, error) {
+	if r.parsed {
+		return &r.root, nil
+	}
+	if r.noJSON {
+		return nil, nil
+	}
+	if ok, err := r.walkable(); !ok {
+		return nil, err
+	}
+
+	root, perr, parsing, timedOut := r.rw.rr.parseAST(r.Logger(), bytesToString(r.rw.cur().Bytes()))
+	traceOf(r.HTTP.Context()).log("ast_parse", "ok", !timedOut && perr == 0, "over_budget", timedOut, "perr", int(perr))
+	if timedOut {
+		r.rw.retire(parsing)
+		r.noJSON = true
+		return nil, nil
+	}
+	// perr == 0 表示成功
+	if perr != 0 {
+		r.Logger().Error("ast parse error", "perr", perr)
+		r.noJSON = true
+		return nil, nil
+	}
+	// the AST may reference the body's bytes, so the buffer stays put until
+	// the AST is encoded or dropped
+	r.root, r.parsed = root, true
+	r.parses++
+	return &r.root, nil
+}
+
+// walkable does the JSON limit check once per body version: anything that
+// walks or parses the whole document goes through here first.
+func (r *Request) walkable() (bool, error) {
+	if r.limits == 0 {
+		r.limits = 1
+		bs := r.rw.cur().Bytes()
+		ok := r.rw.rr.checkJSONLimits(bs)
+		traceOf(r.HTTP.Context()).log("json_limits", "ok", ok, "bytes", len(bs),
+			"max_depth", r.rw.rr.opts.MaxJSONDepth, "max_keys", r.rw.rr.opts.MaxJSONKeys)
+		if !ok {
+			r.Logger().Warn("request body over json limits", "body_len", len(bs))
+			r.limits = -1
+		}
+	}
+	if r.limits < 0 {
+		r.noJSON = true
+		return false, r.rw.rr.jsonLimitResult()
+	}
+	return true, nil
+}
+
+// encode replaces the body with the encoded AST. On failure the body is
+// left as it was before the AST edits.
+func (r *Request) encode() {
+	root := r.root
+	r.root, r.parsed, r.dirty = ast.Node{}, false, false
+
+	out := getBuf(r.rw.cur().Len() + 64)
+	enc := sonicAPI.NewEncoder(out)
+	if err := enc.Encode(&root); err != nil {
+		r.Logger().Error("ast encode error", "error", err)
+		putBuf(out)
+		return
+	}
+	r.replace(out)
+}
+
+func (rr *Rewriter) runRequestHooks(r *Request) error {
+	for i := range rr.hooks {
+		h := &rr.hooks[i]
+		if h.Request == nil {
+			continue
+		}
+		edits := r.edits
+		herr := h.Request.HandleRequest(r)
+		traceOf(r.HTTP.Context()).log("hook", "hook", h.Name, "edited", r.edits != edits, "error", herr)
+		if herr != nil {
+			if err := hookError(r.Logger(), h, "request", herr); err != nil {
+				return err
+			}
+		}
+		if r.edits != edits {
+			r.applied = append(r.applied, h.Name)
+		}
+	}
+	if r.dirty {
+		r.encode()
+	}
+	return nil
+}
+
+// ErrStreaming is returned by Response.Body for event streams, which are
+// relayed as they arrive and never buffered.
+var ErrStreaming = errors.New("reserve: response is a stream")
+
+// Response is an upstream response seen by response hooks.
+type Response struct {
+	// HTTP is the upstream response; headers may be edited in place.
+	HTTP  *http.Response
+	Route string
+	State *State
+
+	maxBody int64
+	proxy   *Proxy // the built-in hooks' settings
+	body    *bytes.Buffer
+}
+
+// Logger returns the logger of the request, which adds its request_id.
+func (r *Response) Logger() *slog.Logger {
+	if r.HTTP.Request == nil {
+		return slog.Default()
+	}
+	return logOf(r.HTTP.Request.Context())
+}
+
+// Body buffers and returns the response body, gzip-decoded. It stays
+// valid until SetBody and must not be modified.
+func (r *Response) Body() ([]byte, error) {
+	if r.body != nil {
+		return r.body.Bytes(), nil
+	}
+	resp := r.HTTP
+	if isEventStream(resp) {
+		return nil, ErrStreaming
+	}
+	var src io.Reader = resp.Body
+	ce := resp.Header.Get("Content-Encoding")
+	if ce != "" && ce != "gzip" && ce != "identity" {
+		return nil, errors.New("reserve: unsupported response content-encoding " + ce)
+	}
+	if ce == "gzip" {
+		zr, rest, err := getGzipReader(resp.Body)
+		if err != nil {
+			// the body stays whole for whoever forwards it
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{rest, resp.Body}
+			return nil, err
+		}
+		defer putGzipReader(zr)
+		src = zr
+	}
+	if r.maxBody > 0 {
+		src = io.LimitReader(src, r.maxBody+1)
+	}
+	b := getBuf(int(max(resp.ContentLength, 0)))
+	n, err := b.ReadFrom(src)
+	resp.Body.Close()
+	if err == nil && r.maxBody > 0 && n > r.maxBody {
+		err = errResponseTooLarge
+	}
+	if err != nil {
+		putBuf(b)
+		resp.Body = io.NopCloser(eofReader{err})
+		return nil, err
+	}
+	r.install(b)
+	return b.Bytes(), nil
+}
+
+// SetBody replaces the response body with a copy of b.
+func (r *Response) SetBody(b []byte) {
+	if r.body == nil {
+		r.HTTP.Body.Close()
+	}
+	out := getBuf(len(b))
+	out.Write(b)
+	r.install(out)
+}
+
+func (r *Response) install(b *bytes.Buffer) {
+	resp := r.HTTP
+	if r.body != nil && r.body != b {
+		putBuf(r.body)
+	}
+	r.body = b
+	resp.Body = &pooledBody{r: bytes.NewReader(b.Bytes()), b: b}
+	resp.ContentLength = int64(b.Len())
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Transfer-Encoding")
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Length", strconv.Itoa(b.Len()))
+}
+
+var errResponseTooLarge = errors.New("reserve: response body exceeds MaxBody")
+
+// eofReader fails every read with err, standing in for a body that could
+// not be buffered.
+type eofReader struct{ err error }
+
+func (e eofReader) Read([]byte) (int, error) { return 0, e.err }
+
+func (p *Proxy) runResponseHooks(resp *http.Response, st *reqState) error {
+	r := &Response{HTTP: resp, Route: st.route.name, State: &st.vars, maxBody: p.opts.MaxBody, proxy: p}
+	hooks := p.rewriter.hooks
+	for i := range hooks {
+		h := &hooks[i]
+		if h.Response == nil {
+			continue
+		}
+		if err := h.Response.HandleResponse(r); err != nil {
+			if err := hookError(r.Logger(), h, "response", err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package reserve
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// httpError is a failure the proxy answers locally instead of forwarding.
+// The body mimics the OpenAI error shape so clients surface the message.
+type httpError struct {
+	status     int
+	code       string
+	msg        string
+	retryAfter int // seconds, 0 = no Retry-After header
+	// authenticate is the WWW-Authenticate challenge of a 401
+	authenticate string
+	allow        string // the Allow header of a 405
+}
+
+func (e *httpError) Error() string { return e.msg }
+
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	// RequestID is set in the proxy's own errors, see requestid.go
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func writeHTTPError(w http.ResponseWriter, e *httpError) {
+	wideOf(w).fail(e.code, e.msg)
+	bs, _ := sonicAPI.Marshal(errorBody{Error: errorDetail{
+		Message:   e.msg,
+		Type:      "proxy_error",
+		Code:      e.code,
+		RequestID: w.Header().Get(requestIDHeader),
+	}})
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("Content-Length", strconv.Itoa(len(bs)))
+	if e.retryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(e.retryAfter))
+	}
+	if e.authenticate != "" {
+		h.Set("WWW-Authenticate", e.authenticate)
+	}
+	if e.allow != "" {
+		h.Set("Allow", e.allow)
+	}
+	w.WriteHeader(e.status)
+	_, _ = w.Write(bs)
+}
+
+// WriteError answers w with err when it is one of the errors the proxy
+// answers locally (as returned by RewriteRequest), and reports whether it
+// did. ErrClientGone and unknown errors are left to the caller.
+func WriteError(w http.ResponseWriter, err error) bool {
+	he, ok := err.(*httpError)
+	if ok {
+		writeHTTPError(w, he)
+	}
+	return ok
+}
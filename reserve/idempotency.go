@@ -0,0 +1,287 @@
+package reserve
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Requests carrying an Idempotency-Key header are remembered per client
+// for Options.IdempotencyTTL: a retry with the same key and the same body
+// gets the first response again instead of a new generation, one with the
+// same key and a different body is refused. Only non-streaming responses
+// below 500 are kept, so a retry after an upstream failure goes through.
+
+const idempotencyHeader = "Idempotency-Key"
+
+var (
+	errIdempotencyMismatch = &httpError{
+		status: http.StatusConflict,
+		code:   "idempotency_key_reused",
+		msg:    "Idempotency-Key was already used with a different request body",
+	}
+	errIdempotencyInFlight = &httpError{
+		status: http.StatusConflict,
+		code:   "idempotency_request_in_progress",
+		msg:    "a request with this Idempotency-Key is still in progress, retry later",
+	}
+)
+
+// idempotencyCache is a bounded LRU of replayable responses, capped in
+// total body bytes, with a TTL. An entry is pending from the first request
+// until its response is stored or dropped.
+type idempotencyCache struct {
+	ttl      time.Duration
+	maxBytes int64
+
+	mu    sync.Mutex
+	ll    *list.List // front = most recently used
+	m     map[string]*list.Element
+	bytes int64
+
+	replays   atomic.Int64
+	conflicts atomic.Int64
+	inFlight  atomic.Int64
+	stored    atomic.Int64
+	evictions atomic.Int64
+	expired   atomic.Int64
+	skipped   atomic.Int64 // responses not kept: streams, errors, too large
+}
+
+type idempotencyEntry struct {
+	k       string
+	sum     [sha256.Size]byte
+	exp     time.Time
+	pending bool
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+func newIdempotencyCache(opts Options) *idempotencyCache {
+	if opts.IdempotencyTTL <= 0 {
+		return nil
+	}
+	return &idempotencyCache{
+		ttl:      opts.IdempotencyTTL,
+		maxBytes: opts.IdempotencyMaxBytes,
+		ll:       list.New(),
+		m:        map[string]*list.Element{},
+	}
+}
+
+func (p *Proxy) idempotencyStats() any {
+	c := p.idempotency
+	if c == nil {
+		return map[string]any{"enabled": false}
+	}
+	c.mu.Lock()
+	n, b := c.ll.Len(), c.bytes
+	c.mu.Unlock()
+	return map[string]any{
+		"enabled":     true,
+		"ttl":         c.ttl.String(),
+		"max_bytes":   c.maxBytes,
+		"entries":     n,
+		"bytes":       b,
+		"replays":     c.replays.Load(),
+		"conflicts":   c.conflicts.Load(),
+		"in_progress": c.inFlight.Load(),
+		"stored":      c.stored.Load(),
+		"skipped":     c.skipped.Load(),
+		"evictions":   c.evictions.Load(),
+		"expired":     c.expired.Load(),
+	}
+}
+
+// begin looks up k. With no live entry it adds a pending one and returns
+// nil, nil: the caller forwards the request and calls finish. Otherwise
+// it returns the stored entry to replay, or the error to answer with.
+func (c *idempotencyCache) begin(k string, sum [sha256.Size]byte, now time.Time) (*idempotencyEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.m[k]; ok {
+		e := el.Value.(*idempotencyEntry)
+		switch {
+		case !e.pending && now.After(e.exp):
+			c.expired.Add(1)
+			c.removeLocked(el)
+		case e.sum != sum:
+			c.conflicts.Add(1)
+			return nil, errIdempotencyMismatch
+		case e.pending:
+			c.inFlight.Add(1)
+			return nil, errIdempotencyInFlight
+		default:
+			c.ll.MoveToFront(el)
+			c.replays.Add(1)
+			return e, nil
+		}
+	}
+	c.m[k] = c.ll.PushFront(&idempotencyEntry{k: k, sum: sum, pending: true})
+	return nil, nil
+}
+
+// finish stores the response of k's pending entry, or drops the entry
+// when rec is nil or its body alone exceeds maxBytes.
+func (c *idempotencyCache) finish(k string, rec *teeRecorder, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.m[k]
+	if !ok {
+		return
+	}
+	e := el.Value.(*idempotencyEntry)
+	if !e.pending {
+		return
+	}
+	if rec == nil || c.maxBytes > 0 && int64(len(rec.body)) > c.maxBytes {
+		c.skipped.Add(1)
+		c.removeLocked(el)
+		return
+	}
+	e.pending = false
+	e.exp = now.Add(c.ttl)
+	e.status, e.header, e.body = rec.status, rec.header, rec.body
+	c.bytes += int64(len(e.body))
+	c.stored.Add(1)
+	for c.maxBytes > 0 && c.bytes > c.maxBytes {
+		last := c.ll.Back()
+		if last == nil || last == el {
+			break
+		}
+		c.evictions.Add(1)
+		c.removeLocked(last)
+	}
+}
+
+func (c *idempotencyCache) removeLocked(el *list.Element) {
+	e := el.Value.(*idempotencyEntry)
+	c.ll.Remove(el)
+	delete(c.m, e.k)
+	c.bytes -= int64(len(e.body))
+}
+
+// serveIdempotent answers r from the idempotency cache when it carries an
+// Idempotency-Key, and reports whether it did. When it reports false with
+// a non-nil writer, the request is forwarded through that writer and done
+// is called after, with whether the forward ran to completion (a broken
+// off response is not kept).
+func (p *Proxy) serveIdempotent(w http.ResponseWriter, r *http.Request, st *reqState) (handled bool, tw http.ResponseWriter, done func(completed bool)) {
+	c := p.idempotency
+	ik := r.Header.Get(idempotencyHeader)
+	if ik == "" {
+		return false, nil, nil
+	}
+	pb, ok := r.Body.(*pooledBody)
+	if !ok || pb.b == nil {
+		return false, nil, nil
+	}
+	bs := pb.b.Bytes()
+	if isStreamBody(bs) {
+		return false, nil, nil
+	}
+	client := ""
+	if st.client != nil {
+		client = st.client.CacheKey
+	}
+	k := client + "\x00" + st.route.name + "\x00" + ik
+	sum := sha256.Sum256(bs)
+
+	e, err := c.begin(k, sum, time.Now())
+	if err != nil {
+		r.Body.Close()
+		if err == errIdempotencyInFlight {
+			w.Header().Set("Retry-After", "1")
+		}
+		st.log.Info("idempotency: request refused", "route", st.route.name, "client", client, "reason", err.(*httpError).code)
+		st.trace.log("idempotency", "refused", err.(*httpError).code)
+		writeHTTPError(w, err.(*httpError))
+		return true, nil, nil
+	}
+	if e != nil {
+		r.Body.Close()
+		h := w.Header()
+		for k, vs := range e.header {
+			h[k] = append([]string(nil), vs...)
+		}
+		h.Set(requestIDHeader, st.id) // this request's, not the original's
+		h.Set("X-Reserve-Idempotent-Replay", "1")
+		st.wide.serve("replay")
+		st.trace.log("idempotency", "replay", true, "status", e.status, "bytes", len(e.body))
+		p.capture.served(st, "replay", e.status, e.header, e.body, nil)
+		h.Set("Content-Length", strconv.Itoa(len(e.body)))
+		w.WriteHeader(e.status)
+		_, _ = w.Write(e.body)
+		return true, nil, nil
+	}
+
+	limit := p.opts.MaxBody
+	if limit <= 0 {
+		limit = defaultLineCap
+	}
+	rec := &teeRecorder{ResponseWriter: w, limit: limit}
+	return false, rec, func(completed bool) {
+		if completed && rec.keep() {
+			c.finish(k, rec, time.Now())
+		} else {
+			c.finish(k, nil, time.Now())
+		}
+	}
+}
+
+// teeRecorder writes a response through to the client while keeping a
+// copy of it, up to limit body bytes.
+type teeRecorder struct {
+	http.ResponseWriter
+	limit int64
+
+	status int
+	header http.Header
+	body   []byte
+	over   bool // body past limit, or a write failed
+}
+
+func (t *teeRecorder) WriteHeader(code int) {
+	if t.status == 0 && code >= 200 {
+		t.status = code
+		t.header = t.ResponseWriter.Header().Clone()
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *teeRecorder) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+	if !t.over {
+		if int64(len(t.body)+len(b)) > t.limit {
+			t.over, t.body = true, nil
+		} else {
+			t.body = append(t.body, b...)
+		}
+	}
+	n, err := t.ResponseWriter.Write(b)
+	if err != nil {
+		t.over, t.body = true, nil
+	}
+	return n, err
+}
+
+func (t *teeRecorder) Flush() { _ = http.NewResponseController(t.ResponseWriter).Flush() }
+
+func (t *teeRecorder) Unwrap() http.ResponseWriter { return t.ResponseWriter }
+
+// keep reports whether the recorded response may be replayed.
+func (t *teeRecorder) keep() bool {
+	if t.status == 0 || t.status >= 500 || t.over {
+		return false
+	}
+	return !strings.HasPrefix(t.header.Get("Content-Type"), "text/event-stream")
+}
@@ -0,0 +1,102 @@
+package reserve
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bytedance/sonic/ast"
+)
+
+var errJSONLimits = &httpError{
+	status: http.StatusBadRequest,
+	code:   "request_body_too_complex",
+	msg:    "request body exceeds the proxy's JSON nesting or key limits",
+}
+
+// checkJSONLimits bounds bs before it reaches sonic's AST parser: nesting
+// depth over the whole body, whatever its top level, and the key count of
+// a top-level object. Both are cheap scanner passes; a malformed body
+// within the depth limit passes, as sonic's parse rejects it anyway.
+func (rr *Rewriter) checkJSONLimits(bs []byte) bool {
+	maxDepth, maxKeys := rr.opts.MaxJSONDepth, rr.opts.MaxJSONKeys
+	if maxDepth > 0 && !nestingWithin(bs, maxDepth) {
+		rr.jsonLimits.depth.Add(1)
+		return false
+	}
+	if maxKeys <= 0 {
+		return true
+	}
+	keys := 0
+	_, _, _ = scanObject(bs, func(jsonMember) bool {
+		keys++
+		return keys <= maxKeys
+	})
+	if keys > maxKeys {
+		rr.jsonLimits.keys.Add(1)
+		return false
+	}
+	return true
+}
+
+// jsonLimitResult is what the rewrite does with a body over the limits:
+// forward it untouched (default) or reject it.
+func (rr *Rewriter) jsonLimitResult() error {
+	if rr.opts.JSONLimitReject {
+		return errJSONLimits
+	}
+	return nil
+}
+
+// parseAST parses src, giving up after ParseBudget. perr is sonic's
+// parsing error code (0 = success). On timeout the parse keeps running in
+// the background and src must stay untouched until done is closed.
+//
+// The budget bounds only how long the request waits: sonic's parse can't
+// be interrupted, so an abandoned parse still spends its CPU and memory.
+// What bounds those is the input, MaxBody and checkJSONLimits having run
+// before any parse.
+func (rr *Rewriter) parseAST(log *slog.Logger, src string) (root ast.Node, perr uint, done <-chan struct{}, timedOut bool) {
+	d := rr.opts.ParseBudget
+	if d <= 0 {
+		p := ast.NewParserObj(src)
+		root, e := p.Parse()
+		return root, uint(e), nil, false
+	}
+
+	type result struct {
+		root ast.Node
+		perr uint
+	}
+	ch := make(chan result, 1)
+	fin := make(chan struct{})
+	go func() {
+		defer close(fin)
+		p := ast.NewParserObj(src)
+		r, e := p.Parse()
+		ch <- result{r, uint(e)}
+	}()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case r := <-ch:
+		return r.root, r.perr, nil, false
+	case <-t.C:
+		rr.jsonLimits.parseBudget.Add(1)
+		log.Warn("ast parse over budget, forwarding original body", "budget", d, "body_len", len(src))
+		return ast.Node{}, 0, fin, true
+	}
+}
+
+func (rr *Rewriter) jsonLimitStats() any {
+	return map[string]any{
+		"max_depth":         rr.opts.MaxJSONDepth,
+		"max_keys":          rr.opts.MaxJSONKeys,
+		"parse_budget":      rr.opts.ParseBudget.String(),
+		"reject":            rr.opts.JSONLimitReject,
+		"depth_exceeded":    rr.jsonLimits.depth.Load(),
+		"keys_exceeded":     rr.jsonLimits.keys.Load(),
+		"parse_over_budget": rr.jsonLimits.parseBudget.Load(),
+	}
+}
@@ -0,0 +1,136 @@
+package reserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func nested(open, close string, n int) string {
+	return strings.Repeat(open, n) + strings.Repeat(close, n)
+}
+
+func TestCheckJSONLimits(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxJSONDepth, opts.MaxJSONKeys = 4, 3
+	rr := NewRewriter(opts)
+	for _, tc := range []struct {
+		name string
+		body string
+		ok   bool
+	}{
+		{"flat object", `{"a":1,"b":"x"}`, true},
+		{"at depth limit", `{"a":[[{"b":1}]]}`, true},
+		{"object over depth", `{"a":[[[{"b":1}]]]}`, false},
+		{"brackets in strings", `{"a":"[[[[[[{{{{"}`, true},
+		{"top-level array over depth", nested("[", "]", 5), false},
+		{"top-level array within depth", nested("[", "]", 4), true},
+		{"malformed over depth", nested("[", "", 100000), false},
+		{"malformed object over depth", `{"a": ` + nested("[", "", 10) + `, }`, false},
+		{"malformed within depth", `{"a":, }`, true},
+		{"at key limit", `{"a":1,"b":2,"c":3}`, true},
+		{"over key limit", `{"a":1,"b":2,"c":3,"d":4}`, false},
+		{"nested keys don't count", `{"a":{"b":1,"c":2,"d":3,"e":4}}`, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := rr.checkJSONLimits([]byte(tc.body)); got != tc.ok {
+				t.Errorf("checkJSONLimits(%.40q) = %v, want %v", tc.body, got, tc.ok)
+			}
+		})
+	}
+}
+
+func TestJSONLimitsReject(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxJSONDepth, opts.JSONLimitReject = 8, true
+	rr := NewRewriter(opts)
+	body := `{"instructions":"be brief","input":` + nested("[", "", 100)
+	req := httptest.NewRequest("POST", "/v1/responses", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	_, err := rr.RewriteRequest(req)
+	var he *httpError
+	if !errors.As(err, &he) || he.code != "request_body_too_complex" {
+		t.Fatalf("RewriteRequest error = %v, want request_body_too_complex", err)
+	}
+}
+
+// jsonDepth is the nesting depth of a valid JSON document, the reference
+// nestingWithin is checked against.
+func jsonDepth(bs []byte) int {
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	depth, deepest := 0, 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return deepest
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			deepest = max(deepest, depth)
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+func FuzzNestingWithin(f *testing.F) {
+	for _, s := range []string{
+		`{}`, `[]`, `{"a":[1,{"b":"]"}]}`, `"[[["`, `[[[[[[[[`, `{"a":"\"["}`,
+		nested("[", "]", 40), nested(`{"a":`, "}", 20),
+	} {
+		f.Add([]byte(s), 8)
+	}
+	f.Fuzz(func(t *testing.T, bs []byte, limit int) {
+		if limit < 1 || limit > 64 || !json.Valid(bs) {
+			return
+		}
+		if got, want := nestingWithin(bs, limit), jsonDepth(bs) <= limit; got != want {
+			t.Fatalf("nestingWithin(%q, %d) = %v, want %v", bs, limit, got, want)
+		}
+	})
+}
+
+// FuzzRewriteMemory sends adversarial bodies through the default rewrite,
+// with instructions forcing the AST path, and checks that what it
+// allocates stays within a fixed multiple of the body size.
+func FuzzRewriteMemory(f *testing.F) {
+	for _, s := range []string{
+		`{"model":"gpt-5","input":"hi"}`,
+		nested("[", "]", 200000),
+		nested("[", "", 200000),
+		nested(`{"a":`, "}", 50000),
+		`{"input":` + nested("[", "]", 255) + `}`,
+		`{"input":"` + strings.Repeat(`\"`, 100000) + `"}`,
+		`{` + strings.Repeat(`"k":1,`, 5000) + `"z":0}`,
+		`[` + strings.Repeat(`{},`, 100000) + `{}]`,
+	} {
+		f.Add([]byte(s))
+	}
+	rr := NewRewriter(DefaultOptions())
+	f.Fuzz(func(t *testing.T, body []byte) {
+		body = append([]byte(`{"instructions":"be brief","x":`), body...)
+		body = append(body, '}')
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		req := httptest.NewRequest("POST", "/v1/responses", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if _, err := rr.RewriteRequest(req); err == nil {
+			_, _ = io.Copy(io.Discard, req.Body)
+			req.Body.Close()
+		}
+		runtime.ReadMemStats(&after)
+
+		const envelope = 16
+		if got, limit := after.TotalAlloc-before.TotalAlloc, uint64(envelope*len(body)+1<<20); got > limit {
+			t.Fatalf("rewriting a %d byte body allocated %d bytes, over %d", len(body), got, limit)
+		}
+	})
+}
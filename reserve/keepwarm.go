@@ -0,0 +1,272 @@
+package reserve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// After a quiet night the first request pays for DNS, TCP and TLS to the
+// upstream again: the transport reaps connections idle for its
+// IdleConnTimeout. With Options.KeepWarmConns, a keeper sends that many
+// cheap requests (KeepWarmMethod on KeepWarmPath, HEAD / by default) at
+// once every KeepWarmInterval, by default three quarters of the idle
+// timeout, each round shifted by up to a tenth either way so that a fleet
+// of proxies doesn't probe in step. A probe's connection is back in the
+// pool idle, its clock reset. Over HTTP/2 the transport multiplexes the
+// probes of a round on one connection, so KeepWarmConns is then the
+// probes sharing it, not connections kept: "kept" and "dialed" in the
+// stats tell what the probes found. The keeper stands down while the
+// upstream is failing: after a failed round, for twice as many rounds
+// each time up to maxKeepWarmBackoff, and while the error rate of the
+// proxy's own upstream requests is over Options.NotifyErrorRate
+// (keepWarmErrorRate without) over NotifyWindow, notifications or not.
+// Proxy.Close stops it.
+
+// most rounds skipped after failed ones, 1<<5
+const maxKeepWarmBackoff = 32
+
+// a probe's time limit
+const keepWarmTimeout = 10 * time.Second
+
+// the upstream error rate the keeper stands down at without
+// Options.NotifyErrorRate
+const keepWarmErrorRate = 0.5
+
+type keepWarm struct {
+	rt       http.RoundTripper
+	url      string
+	method   string
+	conns    int // probes per round
+	interval time.Duration
+
+	rate        errorRate // of the proxy's upstream requests
+	threshold   float64
+	minRequests int
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	rounds    atomic.Int64
+	probes    atomic.Int64
+	reused    atomic.Int64 // probes that found an idle connection, kept warm
+	dialed    atomic.Int64 // probes that needed a new one
+	failures  atomic.Int64
+	skipped   atomic.Int64 // rounds stood down, failing upstream
+	backoff   atomic.Int64 // rounds left to skip
+	failedRun int          // failed rounds in a row, run's own
+
+	mu      sync.Mutex
+	last    time.Time
+	lastErr string
+}
+
+// newKeepWarm starts p's keeper; nil without opts.KeepWarmConns. idle is
+// the transport's IdleConnTimeout.
+func newKeepWarm(p *Proxy, opts Options, idle time.Duration) (*keepWarm, error) {
+	if opts.KeepWarmConns <= 0 {
+		return nil, nil
+	}
+	method := opts.KeepWarmMethod
+	switch method {
+	case "":
+		method = http.MethodHead
+	case http.MethodHead, http.MethodOptions, http.MethodGet:
+	default:
+		return nil, fmt.Errorf("reserve: KeepWarmMethod %q: want HEAD, OPTIONS or GET", method)
+	}
+	u := *p.target
+	if opts.KeepWarmPath != "" {
+		ref, err := url.Parse(opts.KeepWarmPath)
+		if err != nil || ref.IsAbs() || ref.Host != "" {
+			return nil, fmt.Errorf("reserve: KeepWarmPath %q: want a path", opts.KeepWarmPath)
+		}
+		u = *u.ResolveReference(ref)
+	}
+	interval := opts.KeepWarmInterval
+	if interval <= 0 {
+		interval = idle * 3 / 4
+	}
+	if interval <= 0 {
+		return nil, errors.New("reserve: KeepWarmConns without a KeepWarmInterval or an idle timeout")
+	}
+	k := &keepWarm{rt: p.transport, url: u.String(), method: method, conns: opts.KeepWarmConns,
+		interval: interval, threshold: opts.NotifyErrorRate, minRequests: opts.NotifyMinRequests,
+		stop: make(chan struct{}), done: make(chan struct{})}
+	if k.threshold <= 0 {
+		k.threshold = keepWarmErrorRate
+	}
+	k.rate.init(opts.NotifyWindow)
+	go k.run()
+	return k, nil
+}
+
+func (k *keepWarm) run() {
+	defer close(k.done)
+	for {
+		// ±10%, so a fleet's rounds spread out
+		t := time.NewTimer(k.interval + time.Duration((rand.Float64()*0.2-0.1)*float64(k.interval)))
+		select {
+		case <-t.C:
+			k.round()
+		case <-k.stop:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// close stops the keeper, waiting for a round under way.
+func (k *keepWarm) close() {
+	if k == nil {
+		return
+	}
+	k.closeOnce.Do(func() { close(k.stop) })
+	<-k.done
+}
+
+// upstreamResult counts one outcome of the proxy's upstream requests; see
+// notifier.upstreamResult.
+func (k *keepWarm) upstreamResult(err bool) {
+	if k == nil {
+		return
+	}
+	k.rate.add(err, k.threshold, k.minRequests)
+}
+
+// failing reports whether the upstream error rate is over the threshold.
+func (k *keepWarm) failing() bool {
+	_, _, alerting := k.rate.snapshot()
+	return alerting
+}
+
+// round probes, unless the upstream is failing.
+func (k *keepWarm) round() {
+	if k.backoff.Load() > 0 {
+		k.backoff.Add(-1)
+		k.skipped.Add(1)
+		return
+	}
+	if k.failing() {
+		k.skipped.Add(1)
+		return
+	}
+	k.rounds.Add(1)
+	var (
+		wg     sync.WaitGroup
+		failed atomic.Int64
+		first  atomic.Pointer[error]
+	)
+	for range k.conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := k.probe(); err != nil {
+				failed.Add(1)
+				first.CompareAndSwap(nil, &err)
+			}
+		}()
+	}
+	wg.Wait()
+	k.mu.Lock()
+	k.last = time.Now()
+	k.lastErr = ""
+	if e := first.Load(); e != nil {
+		k.lastErr = (*e).Error()
+	}
+	k.mu.Unlock()
+	if failed.Load() == 0 {
+		if k.failedRun > 0 {
+			slog.Info("keep-warm probes succeed again", "after_failed_rounds", k.failedRun)
+		}
+		k.failedRun = 0
+		return
+	}
+	k.failedRun++
+	skip := maxKeepWarmBackoff
+	if k.failedRun <= 5 {
+		skip = 1 << (k.failedRun - 1)
+	}
+	k.backoff.Store(int64(skip))
+	slog.Warn("keep-warm probes failed, standing down", "failed", failed.Load(), "of", k.conns,
+		"skip_rounds", skip, "error", k.lastErr)
+}
+
+// probe sends one request and drains its answer. Any answer counts: an
+// upstream that doesn't serve the method still keeps the connection.
+func (k *keepWarm) probe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), keepWarmTimeout)
+	defer cancel()
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				k.reused.Add(1)
+			} else {
+				k.dialed.Add(1)
+			}
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, k.method, k.url, nil)
+	if err != nil {
+		return err
+	}
+	k.probes.Add(1)
+	resp, err := k.rt.RoundTrip(req)
+	if err != nil {
+		k.failures.Add(1)
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		k.failures.Add(1)
+		return fmt.Errorf("upstream answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *Proxy) keepWarmStats() any {
+	k := p.keepWarm
+	if k == nil {
+		return map[string]any{"enabled": false}
+	}
+	k.mu.Lock()
+	last, lastErr := k.last, k.lastErr
+	k.mu.Unlock()
+	total, errs, failing := k.rate.snapshot()
+	out := map[string]any{
+		"enabled": true,
+		// probes per round; over HTTP/2 they share a connection
+		"conns":    k.conns,
+		"interval": k.interval.String(),
+		"probe":    k.method + " " + k.url,
+		"rounds":   k.rounds.Load(),
+		"probes":   k.probes.Load(),
+		"kept":     k.reused.Load(),
+		"dialed":   k.dialed.Load(),
+		"failures": k.failures.Load(),
+		"skipped":  k.skipped.Load(),
+		"backoff":  k.backoff.Load(),
+
+		"upstream_requests": total,
+		"upstream_errors":   errs,
+		"upstream_failing":  failing,
+	}
+	if !last.IsZero() {
+		out["last_round"] = last.UTC().Format(time.RFC3339)
+	}
+	if lastErr != "" {
+		out["last_error"] = lastErr
+	}
+	return out
+}
@@ -0,0 +1,81 @@
+package reserve
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeepWarmStandsDownOnErrorRate(t *testing.T) {
+	// no NotifyURL: the keeper counts the proxy's upstream requests itself
+	var failing atomic.Bool
+	var probes atomic.Int64
+	u := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			probes.Add(1)
+			return
+		}
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"id":"resp_1"}`))
+	})
+	opts := DefaultOptions()
+	opts.KeepWarmConns = 2
+	opts.KeepWarmInterval = time.Hour // rounds run by hand
+	opts.NotifyMinRequests = 4
+	p := newTestProxy(t, opts, u)
+	defer p.Close()
+	k := p.keepWarm
+
+	k.round()
+	if probes.Load() != 2 || k.rounds.Load() != 1 {
+		t.Fatalf("%d probes in %d rounds, want 2 in 1", probes.Load(), k.rounds.Load())
+	}
+
+	failing.Store(true)
+	for range 4 {
+		send(p, "POST", "/v1/responses", nil, `{"input":"hi"}`)
+	}
+	k.round()
+	if probes.Load() != 2 || k.skipped.Load() != 1 {
+		t.Errorf("%d probes, %d rounds skipped with the upstream failing, want 2 and 1", probes.Load(), k.skipped.Load())
+	}
+	if st := p.keepWarmStats().(map[string]any); st["upstream_failing"] != true || st["upstream_errors"] != int64(4) {
+		t.Errorf("keep_warm stats = %v", st)
+	}
+
+	// back under the rate: 4 errors of 9 requests
+	failing.Store(false)
+	for range 5 {
+		send(p, "POST", "/v1/responses", nil, `{"input":"hi"}`)
+	}
+	k.round()
+	if probes.Load() != 4 {
+		t.Errorf("%d probes once the upstream recovered, want 4", probes.Load())
+	}
+}
+
+func TestKeepWarmClose(t *testing.T) {
+	opts := DefaultOptions()
+	opts.KeepWarmConns = 1
+	opts.KeepWarmInterval = time.Hour
+	p := newTestProxy(t, opts, newTestUpstream(t, nil))
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		p.Close()
+		close(closed)
+	}()
+	before(t, closed, "Close")
+	select {
+	case <-p.keepWarm.done:
+	default:
+		t.Error("keeper still running after Close")
+	}
+
+	// a proxy without a keeper closes too
+	newTestProxy(t, DefaultOptions(), newTestUpstream(t, nil)).Close()
+}
@@ -0,0 +1,88 @@
+package reserve
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// An upstream that dies partway through a stream leaves the client with
+// the events sent so far and a connection dropped without a word, which
+// SDKs take for a network error and often retry blindly. The stream
+// watch (streamend.go) turns such a read error into a terminal SSE error
+// event and a clean end instead. An error reaching the ErrorHandler once
+// the response has begun can't be a 502 any more: a stream gets the same
+// event, anything else has its connection aborted, so the client sees
+// the response is incomplete rather than a short body.
+
+// terminal event appended to a stream the upstream broke off, in the
+// Responses API error event shape
+var sseUpstreamBrokenEvent = []byte("event: error\ndata: " +
+	`{"type":"error","code":"upstream_stream_broken","message":"upstream connection lost mid-stream","param":null}` +
+	"\n\n")
+
+type midstreamCounts struct {
+	streams atomic.Int64 // streams ended with sseUpstreamBrokenEvent
+	aborted atomic.Int64 // other responses aborted by ErrorHandler
+}
+
+func (p *Proxy) midstreamStats() any {
+	return map[string]any{
+		"streams_terminated": p.midstream.streams.Load(),
+		"responses_aborted":  p.midstream.aborted.Load(),
+	}
+}
+
+// startWriter notes whether the response has begun, for ErrorHandler, and
+// a client gone when writing to it fails (see disconnect.go).
+type startWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	rr      *Rewriter
+	started bool
+}
+
+func (w *startWriter) WriteHeader(code int) {
+	if code >= 200 {
+		w.started = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *startWriter) Write(b []byte) (int, error) {
+	w.started = true
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil {
+		w.rr.countLeft(w.ctx, leftResponse)
+	}
+	return n, err
+}
+
+func (w *startWriter) Flush() { _ = http.NewResponseController(w.ResponseWriter).Flush() }
+
+func (w *startWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// failStarted ends a response that had begun when err came: see above.
+// It reports false when w hadn't begun, for the usual error response.
+func (p *Proxy) failStarted(w http.ResponseWriter, r *http.Request, err error) bool {
+	sw, ok := w.(*startWriter)
+	if !ok || !sw.started {
+		return false
+	}
+	st := stateOf(r.Context())
+	if st != nil {
+		st.wide.fail("upstream_error", err.Error())
+		st.trace.log("upstream_error", "error", err, "midstream", true)
+	}
+	if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		logOf(r.Context()).Warn("upstream error mid-stream, stream terminated", "error", err)
+		p.midstream.streams.Add(1)
+		_, _ = w.Write(sseUpstreamBrokenEvent)
+		_ = http.NewResponseController(w).Flush()
+		return true
+	}
+	logOf(r.Context()).Warn("upstream error after the response began, connection aborted", "error", err)
+	p.midstream.aborted.Add(1)
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,142 @@
+package reserve
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// dyingUpstream streams n events, then tail, and drops the connection
+// without ending the stream.
+func dyingUpstream(t *testing.T, n int, tail string) *testUpstream {
+	return newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		for i := range n {
+			fmt.Fprintf(w, "event: response.output_text.delta\ndata: {\"type\":\"response.output_text.delta\",\"delta\":\"%d\"}\n\n", i)
+		}
+		io.WriteString(w, tail)
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	})
+}
+
+func TestMidstreamUpstreamDies(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		n    int
+		tail string
+	}{
+		{"before any event", 0, ""},
+		{"after one event", 1, ""},
+		{"after five events", 5, ""},
+		{"inside an event", 2, "event: response.output_text.delta\ndata: {\"ty"},
+		{"after a line", 2, "event: response.output_text.delta\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := dyingUpstream(t, tc.n, tc.tail)
+			p := newTestProxy(t, DefaultOptions(), u)
+			srv := httptest.NewUnstartedServer(p)
+			var serverLog bytes.Buffer
+			srv.Config.ErrorLog = log.New(&serverLog, "", 0)
+			srv.Start()
+			defer srv.Close()
+
+			resp, err := http.Post(srv.URL+"/v1/responses", "application/json", strings.NewReader(`{"input":"hi","stream":true}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("answered %d, want the upstream's 200", resp.StatusCode)
+			}
+			bs, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("reading the stream: %v, want a clean end", err)
+			}
+			// the events sent, what was cut short of one, the error event
+			want := ""
+			for i := range tc.n {
+				want += fmt.Sprintf("event: response.output_text.delta\ndata: {\"type\":\"response.output_text.delta\",\"delta\":\"%d\"}\n\n", i)
+			}
+			if tc.tail != "" {
+				want += tc.tail + "\n\n"
+			}
+			want += string(sseUpstreamBrokenEvent)
+			if string(bs) != want {
+				t.Errorf("client got\n%q\nwant\n%q", bs, want)
+			}
+			if strings.Contains(serverLog.String(), "superfluous") {
+				t.Errorf("server log: %s", serverLog.String())
+			}
+			if st := p.midstreamStats().(map[string]any); st["streams_terminated"] != int64(1) {
+				t.Errorf("midstream stats = %v", st)
+			}
+			if st := p.streamStats().(map[string]any); st[streamUpstream] != int64(1) {
+				t.Errorf("stream stats = %v, want one %s", st, streamUpstream)
+			}
+		})
+	}
+}
+
+func TestMidstreamCompletedStream(t *testing.T) {
+	// a stream that did end properly before the connection went is left
+	// as it is
+	u := dyingUpstream(t, 1, "event: response.completed\ndata: {\"type\":\"response.completed\"}\n\n")
+	srv := httptest.NewServer(newTestProxy(t, DefaultOptions(), u))
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/v1/responses", "application/json", strings.NewReader(`{"input":"hi","stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, _ := io.ReadAll(resp.Body)
+	if bytes.Contains(bs, []byte("upstream_stream_broken")) {
+		t.Errorf("completed stream got an error event: %s", bs)
+	}
+}
+
+func TestFailStarted(t *testing.T) {
+	p := newTestProxy(t, DefaultOptions(), newTestUpstream(t, nil))
+	r := httptest.NewRequest("POST", "/v1/responses", nil)
+	start := func(ct string) (*startWriter, *httptest.ResponseRecorder) {
+		rec := httptest.NewRecorder()
+		w := &startWriter{ResponseWriter: rec, ctx: r.Context(), rr: p.rewriter}
+		w.Header().Set("Content-Type", ct)
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "event: response.created\ndata: {}\n\n")
+		return w, rec
+	}
+	broken := errors.New("broken")
+
+	unstarted := &startWriter{ResponseWriter: httptest.NewRecorder(), ctx: r.Context(), rr: p.rewriter}
+	if p.failStarted(unstarted, r, broken) {
+		t.Error("failStarted took a response that had not begun")
+	}
+
+	w, rec := start("text/event-stream")
+	if !p.failStarted(w, r, broken) {
+		t.Fatal("failStarted left a started stream")
+	}
+	if rec.Code != http.StatusOK || !bytes.HasSuffix(rec.Body.Bytes(), sseUpstreamBrokenEvent) {
+		t.Errorf("stream answered %d %q, want the error event after what was sent", rec.Code, rec.Body)
+	}
+
+	w, _ = start("application/json")
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("failStarted on a started JSON response panicked with %v, want http.ErrAbortHandler", v)
+		}
+		if st := p.midstreamStats().(map[string]any); st["streams_terminated"] != int64(1) || st["responses_aborted"] != int64(1) {
+			t.Errorf("midstream stats = %v", st)
+		}
+	}()
+	p.failStarted(w, r, broken)
+}
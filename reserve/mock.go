@@ -0,0 +1,314 @@
+package reserve
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// MockOptions configures NewMockUpstream.
+type MockOptions struct {
+	// Text is the assistant reply, a text/template over .Model, .Input (the
+	// last input text) and .PromptCacheKey.
+	Text string
+	// Deltas is the number of output_text.delta events a stream is split
+	// into, Delay the pause before each.
+	Deltas int
+	Delay  time.Duration
+	// Fail is the failure injected into every request, in the syntax of the
+	// mock_fail query parameter; a request's own parameter wins.
+	Fail string
+}
+
+// DefaultMockOptions returns the options `rc-proxy mock` runs with.
+func DefaultMockOptions() MockOptions {
+	return MockOptions{
+		Text:   "This is a mock response from rc-proxy to: {{.Input}}",
+		Deltas: 8,
+		Delay:  50 * time.Millisecond,
+	}
+}
+
+// mockUpstream is a fake right.codes answering POST .../v1/responses.
+//
+// Failures are injected with query parameters (they pass through the
+// proxy untouched):
+//
+//	mock_fail=429          429 with Retry-After (mock_retry_after, default 1)
+//	mock_fail=500          500 server_error
+//	mock_fail=disconnect   streams cut after mock_after deltas (default 2)
+//	mock_fail=slow_headers response headers delayed by mock_slow (default 5s)
+//	mock_fail=stream_error 200 event stream whose only event is a rate limit error
+//
+// mock_delay overrides the per-delta delay.
+type mockUpstream struct {
+	opts MockOptions
+	tmpl *template.Template
+	seq  atomic.Int64 // response ids
+}
+
+// NewMockUpstream returns a handler behaving like the Responses API, for
+// offline demos and end-to-end tests.
+func NewMockUpstream(opts MockOptions) (http.Handler, error) {
+	t, err := template.New("text").Parse(opts.Text)
+	if err != nil {
+		return nil, err
+	}
+	return &mockUpstream{opts: opts, tmpl: t}, nil
+}
+
+type mockRequest struct {
+	Model          string `json:"model"`
+	Stream         bool   `json:"stream"`
+	PromptCacheKey string `json:"prompt_cache_key"`
+	Input          any    `json:"input"`
+}
+
+func (m *mockUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/v1/responses") {
+		writeHTTPError(w, errNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeHTTPError(w, errMethod)
+		return
+	}
+
+	q := r.URL.Query()
+	fail := q.Get("mock_fail")
+	if fail == "" {
+		fail = m.opts.Fail
+	}
+	switch fail {
+	case "429":
+		ra := q.Get("mock_retry_after")
+		if ra == "" {
+			ra = "1"
+		}
+		w.Header().Set("Retry-After", ra)
+		mockError(w, http.StatusTooManyRequests, "rate_limit_exceeded", "mock rate limit")
+		return
+	case "500":
+		mockError(w, http.StatusInternalServerError, "server_error", "mock server error")
+		return
+	case "stream_error":
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, "event: error\ndata: "+
+			`{"type":"error","code":"rate_limit_exceeded","message":"mock rate limit","param":null}`+"\n\n")
+		return
+	case "slow_headers":
+		d := 5 * time.Second
+		if v, err := time.ParseDuration(q.Get("mock_slow")); err == nil {
+			d = v
+		}
+		select {
+		case <-time.After(d):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(r.Body); err != nil {
+		return
+	}
+	var req mockRequest
+	if err := sonicAPI.Unmarshal(body.Bytes(), &req); err != nil {
+		mockError(w, http.StatusBadRequest, "invalid_json", "request body is not valid JSON")
+		return
+	}
+	if req.Model == "" {
+		req.Model = "mock-model"
+	}
+
+	var text strings.Builder
+	if err := m.tmpl.Execute(&text, map[string]string{
+		"Model":          req.Model,
+		"Input":          lastInputText(req.Input),
+		"PromptCacheKey": req.PromptCacheKey,
+	}); err != nil {
+		mockError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	n := m.seq.Add(1)
+	resp := &mockResponse{
+		id:      "resp_mock_" + strconv.FormatInt(n, 10),
+		msgID:   "msg_mock_" + strconv.FormatInt(n, 10),
+		model:   req.Model,
+		created: time.Now().Unix(),
+		text:    text.String(),
+		inTok:   max(body.Len()/4, 1),
+		outTok:  max(len(strings.Fields(text.String())), 1),
+		cacheK:  req.PromptCacheKey,
+	}
+	if !req.Stream {
+		bs, _ := statsAPI.Marshal(resp.object("completed", true))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bs)
+		return
+	}
+
+	delay := m.opts.Delay
+	if v, err := time.ParseDuration(q.Get("mock_delay")); err == nil {
+		delay = v
+	}
+	cutAfter := -1
+	if fail == "disconnect" {
+		cutAfter = 2
+		if v, err := strconv.Atoi(q.Get("mock_after")); err == nil {
+			cutAfter = v
+		}
+	}
+	m.stream(w, r, resp, delay, cutAfter)
+}
+
+type mockResponse struct {
+	id, msgID, model string
+	created          int64
+	text             string
+	inTok, outTok    int
+	cacheK           string
+}
+
+// message is the output item; content stays empty until it completes.
+func (m *mockResponse) message(status string) map[string]any {
+	content := []any{}
+	if status == "completed" {
+		content = append(content, map[string]any{"type": "output_text", "text": m.text, "annotations": []any{}})
+	}
+	return map[string]any{
+		"type": "message", "id": m.msgID, "status": status, "role": "assistant", "content": content,
+	}
+}
+
+func (m *mockResponse) object(status string, done bool) map[string]any {
+	o := map[string]any{
+		"id": m.id, "object": "response", "created_at": m.created,
+		"status": status, "model": m.model, "output": []any{},
+	}
+	if m.cacheK != "" {
+		o["prompt_cache_key"] = m.cacheK
+	}
+	if done {
+		o["output"] = []any{m.message("completed")}
+		o["usage"] = map[string]any{
+			"input_tokens":          m.inTok,
+			"input_tokens_details":  map[string]any{"cached_tokens": 0},
+			"output_tokens":         m.outTok,
+			"output_tokens_details": map[string]any{"reasoning_tokens": 0},
+			"total_tokens":          m.inTok + m.outTok,
+		}
+	}
+	return o
+}
+
+func (m *mockUpstream) stream(w http.ResponseWriter, r *http.Request, resp *mockResponse, delay time.Duration, cutAfter int) {
+	fl, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	seq := 0
+	emit := func(typ string, data map[string]any) {
+		data["type"] = typ
+		data["sequence_number"] = seq
+		seq++
+		bs, _ := statsAPI.Marshal(data)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typ, bs)
+		if fl != nil {
+			fl.Flush()
+		}
+	}
+
+	emit("response.created", map[string]any{"response": resp.object("in_progress", false)})
+	emit("response.in_progress", map[string]any{"response": resp.object("in_progress", false)})
+	emit("response.output_item.added", map[string]any{"output_index": 0, "item": resp.message("in_progress")})
+	emit("response.content_part.added", map[string]any{
+		"item_id": resp.msgID, "output_index": 0, "content_index": 0,
+		"part": map[string]any{"type": "output_text", "text": "", "annotations": []any{}},
+	})
+	for i, d := range splitText(resp.text, m.opts.Deltas) {
+		if i == cutAfter {
+			// drop the connection mid-stream, no terminal event
+			if hj, ok := w.(http.Hijacker); ok {
+				if c, _, err := hj.Hijack(); err == nil {
+					_ = c.Close()
+				}
+			}
+			panic(http.ErrAbortHandler)
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		emit("response.output_text.delta", map[string]any{
+			"item_id": resp.msgID, "output_index": 0, "content_index": 0, "delta": d,
+		})
+	}
+	emit("response.output_text.done", map[string]any{
+		"item_id": resp.msgID, "output_index": 0, "content_index": 0, "text": resp.text,
+	})
+	emit("response.content_part.done", map[string]any{
+		"item_id": resp.msgID, "output_index": 0, "content_index": 0,
+		"part": map[string]any{"type": "output_text", "text": resp.text, "annotations": []any{}},
+	})
+	emit("response.output_item.done", map[string]any{"output_index": 0, "item": resp.message("completed")})
+	emit("response.completed", map[string]any{"response": resp.object("completed", true)})
+}
+
+// splitText cuts s into up to n roughly equal pieces on rune boundaries.
+func splitText(s string, n int) []string {
+	rs := []rune(s)
+	n = max(min(n, len(rs)), 1)
+	out := make([]string, 0, n)
+	for i := range n {
+		out = append(out, string(rs[i*len(rs)/n:(i+1)*len(rs)/n]))
+	}
+	return out
+}
+
+// lastInputText is the text of the last input item: a plain string input,
+// or the last message's string content / last input_text part.
+func lastInputText(in any) string {
+	switch v := in.(type) {
+	case string:
+		return v
+	case []any:
+		for i := len(v) - 1; i >= 0; i-- {
+			msg, _ := v[i].(map[string]any)
+			switch c := msg["content"].(type) {
+			case string:
+				return c
+			case []any:
+				for j := len(c) - 1; j >= 0; j-- {
+					if part, _ := c[j].(map[string]any); part != nil {
+						if t, ok := part["text"].(string); ok {
+							return t
+						}
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func mockError(w http.ResponseWriter, status int, code, msg string) {
+	bs, _ := statsAPI.Marshal(map[string]any{"error": map[string]any{
+		"message": msg, "type": code, "code": code, "param": nil,
+	}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bs)
+}
@@ -0,0 +1,185 @@
+package reserve
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockProxy serves a Proxy with opts in front of a mock upstream with
+// mopts and returns its URL.
+func mockProxy(t *testing.T, opts Options, mopts MockOptions) string {
+	t.Helper()
+	h, err := NewMockUpstream(mopts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := httptest.NewServer(h)
+	t.Cleanup(mock.Close)
+	opts.Target = mock.URL
+	p, err := NewProxy(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func fastMock() MockOptions {
+	mopts := DefaultMockOptions()
+	mopts.Delay = 0
+	mopts.Text = "{{.Model}} says hi to {{.Input}}"
+	return mopts
+}
+
+func postJSON(t *testing.T, url, auth, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// sseEvent is one event of a stream: its name and decoded data.
+type sseEvent struct {
+	name string
+	data map[string]any
+}
+
+func readEvents(t *testing.T, r io.Reader) ([]sseEvent, error) {
+	t.Helper()
+	var (
+		evs []sseEvent
+		ev  sseEvent
+	)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			ev.name = line[len("event: "):]
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(line[len("data: "):]), &ev.data); err != nil {
+				t.Errorf("event %s data %q: %v", ev.name, line, err)
+			}
+		case line == "" && ev.name != "":
+			evs = append(evs, ev)
+			ev = sseEvent{}
+		}
+	}
+	return evs, sc.Err()
+}
+
+func TestMockThroughProxy(t *testing.T) {
+	url := mockProxy(t, DefaultOptions(), fastMock())
+	resp := postJSON(t, url+"/v1/responses", "Bearer sk-a",
+		`{"model":"gpt-5","instructions":"be brief","input":"the tests"}`)
+	defer resp.Body.Close()
+	var got struct {
+		Status         string `json:"status"`
+		PromptCacheKey string `json:"prompt_cache_key"`
+		Output         []struct {
+			Content []struct{ Text string } `json:"content"`
+		} `json:"output"`
+		Usage struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != "completed" || got.Usage.TotalTokens == 0 {
+		t.Errorf("response %+v, want a completed one with usage", got)
+	}
+	if got.PromptCacheKey != cacheKey("Bearer sk-a") {
+		t.Errorf("mock saw prompt_cache_key %q, want the proxy's", got.PromptCacheKey)
+	}
+	if len(got.Output) != 1 || len(got.Output[0].Content) != 1 || got.Output[0].Content[0].Text != "gpt-5 says hi to the tests" {
+		t.Errorf("output %+v", got.Output)
+	}
+}
+
+func TestMockStreamThroughProxy(t *testing.T) {
+	url := mockProxy(t, DefaultOptions(), fastMock())
+	resp := postJSON(t, url+"/v1/responses", "Bearer sk-a", `{"model":"gpt-5","input":"the tests","stream":true}`)
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	evs, err := readEvents(t, resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var text strings.Builder
+	for i, ev := range evs {
+		names = append(names, ev.name)
+		if n, _ := ev.data["sequence_number"].(float64); int(n) != i {
+			t.Errorf("event %d has sequence_number %v", i, ev.data["sequence_number"])
+		}
+		if ev.name == "response.output_text.delta" {
+			text.WriteString(ev.data["delta"].(string))
+		}
+	}
+	if len(names) == 0 || names[0] != "response.created" || names[len(names)-1] != "response.completed" {
+		t.Fatalf("events %v", names)
+	}
+	if got, n := strings.Count(strings.Join(names, ","), "output_text.delta"), fastMock().Deltas; got != n {
+		t.Errorf("%d deltas, want %d", got, n)
+	}
+	if text.String() != "gpt-5 says hi to the tests" {
+		t.Errorf("deltas add up to %q", text.String())
+	}
+}
+
+func TestMockFailuresThroughProxy(t *testing.T) {
+	url := mockProxy(t, DefaultOptions(), fastMock())
+
+	resp := postJSON(t, url+"/v1/responses?mock_fail=429&mock_retry_after=7", "", `{"input":"hi"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "7" {
+		t.Errorf("429: answered %d Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	resp = postJSON(t, url+"/v1/responses?mock_fail=500", "", `{"input":"hi"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("500: answered %d", resp.StatusCode)
+	}
+
+	start := time.Now()
+	resp = postJSON(t, url+"/v1/responses?mock_fail=slow_headers&mock_slow=200ms", "", `{"input":"hi"}`)
+	resp.Body.Close()
+	if d := time.Since(start); resp.StatusCode != http.StatusOK || d < 200*time.Millisecond {
+		t.Errorf("slow_headers: answered %d after %v", resp.StatusCode, d)
+	}
+
+	resp = postJSON(t, url+"/v1/responses?mock_fail=disconnect&mock_after=3", "", `{"input":"hi","stream":true}`)
+	evs, _ := readEvents(t, resp.Body)
+	resp.Body.Close()
+	deltas := 0
+	for _, ev := range evs {
+		switch ev.name {
+		case "response.output_text.delta":
+			deltas++
+		case "response.completed":
+			t.Errorf("disconnect: stream completed")
+		}
+	}
+	if deltas != 3 {
+		t.Errorf("disconnect: %d deltas before the cut, want 3", deltas)
+	}
+}
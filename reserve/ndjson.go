@@ -0,0 +1,168 @@
+package reserve
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/bytedance/sonic"
+)
+
+// NDJSON routes (Options.NDJSONPaths) take several Responses requests in
+// one body, one JSON object per line. Each line is rewritten on its own as
+// the body streams through; blank lines, line endings and a missing final
+// newline are kept exactly.
+
+// defaultLineCap bounds a line when Options.MaxBody is unlimited.
+const defaultLineCap = 32 << 20
+
+// ndjsonRoute is matched at every configured NDJSON path; its body is not
+// buffered, so it is not a rewrite route.
+var ndjsonRoute = route{name: "ndjson", method: http.MethodPost, identify: true, ndjson: true}
+
+// lineCounts counts the lines of streamed line-by-line rewrites.
+type lineCounts struct {
+	lines     atomic.Int64
+	rewritten atomic.Int64
+	failed    atomic.Int64 // passed through unmodified
+}
+
+func (c *lineCounts) stats() map[string]any {
+	return map[string]any{
+		"lines":          c.lines.Load(),
+		"lines_modified": c.rewritten.Load(),
+		"lines_failed":   c.failed.Load(),
+	}
+}
+
+type ndjsonCounts struct {
+	bodies atomic.Int64
+	lineCounts
+}
+
+func (rr *Rewriter) ndjsonStats() any {
+	s := rr.ndjson.stats()
+	s["paths"] = rr.ndjsonPaths
+	s["bodies"] = rr.ndjson.bodies.Load()
+	return s
+}
+
+// rewriteNDJSON replaces req's body with a stream rewriting it line by
+// line, and reports whether it did. The rewritten length is only known
+// once the last line is through, so the body goes out chunked rather than
+// with a recomputed Content-Length. Compressed bodies pass untouched.
+func (rr *Rewriter) rewriteNDJSON(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	rr.ndjson.bodies.Add(1)
+
+	src := req.Body
+	pr, pw := io.Pipe()
+	go func() {
+		err := rr.rewriteLines(logOf(req.Context()), src, pw, "ndjson", &rr.ndjson.lineCounts, func(line []byte, n int) []byte {
+			return rr.rewriteNDJSONLine(req, line, n)
+		})
+		src.Close()
+		pw.CloseWithError(err)
+	}()
+	// the transport closes pr when done, which stops the copy
+	req.Body = pr
+	req.ContentLength = -1
+	req.Header.Del("Content-Length")
+	return true
+}
+
+// rewriteNDJSONLine returns line with its object rewritten, else line
+// itself.
+func (rr *Rewriter) rewriteNDJSONLine(req *http.Request, line []byte, n int) []byte {
+	text := bytes.TrimRight(line, "\r\n")
+	if len(bytes.TrimSpace(text)) == 0 {
+		return line
+	}
+	rr.ndjson.lines.Add(1)
+	// the splice-only rewrite path would edit a truncated object too
+	if !sonic.Valid(text) {
+		rr.ndjson.failed.Add(1)
+		logOf(req.Context()).Warn("ndjson line is not JSON, passed through", "path", req.URL.Path, "line", n)
+		return line
+	}
+	body, ok := rr.rewriteEmbedded(req, string(text))
+	if !ok {
+		rr.ndjson.failed.Add(1)
+		logOf(req.Context()).Warn("ndjson line not rewritten, passed through", "path", req.URL.Path, "line", n)
+		return line
+	}
+	if body == nil {
+		return line
+	}
+	rr.ndjson.rewritten.Add(1)
+	return append(body, line[len(text):]...)
+}
+
+// rewriteLines copies src to dst line by line, replacing each line with
+// fn's result; fn gets the line with its ending and counts it into c. A
+// line longer than the body cap is copied through unread, so only one
+// line is held in memory at a time.
+func (rr *Rewriter) rewriteLines(log *slog.Logger, src io.Reader, dst io.Writer, what string, c *lineCounts, fn func(line []byte, n int) []byte) error {
+	limit := int(rr.opts.MaxBody)
+	if limit <= 0 {
+		limit = defaultLineCap
+	}
+	br := bufio.NewReaderSize(src, 64<<10)
+	var line []byte
+	n := 0
+	for {
+		chunk, err := br.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			if len(line) <= limit {
+				continue
+			}
+			n++
+			c.lines.Add(1)
+			c.failed.Add(1)
+			log.Warn(what+" line over the body cap, passed through", "line", n, "limit", limit)
+			if _, err := dst.Write(line); err != nil {
+				return err
+			}
+			line = line[:0]
+			if err := copyLineRest(br, dst); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(line) > 0 {
+			n++
+			if _, werr := dst.Write(fn(line, n)); werr != nil {
+				return werr
+			}
+		}
+		line = line[:0]
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copyLineRest copies up to and including the next newline.
+func copyLineRest(br *bufio.Reader, dst io.Writer) error {
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if _, werr := dst.Write(chunk); werr != nil {
+			return werr
+		}
+		if err != bufio.ErrBufferFull {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
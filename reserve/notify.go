@@ -0,0 +1,386 @@
+package reserve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// With Options.NotifyURL, events worth a ping are POSTed to a webhook
+// (Slack incoming webhooks or anything else taking JSON): the upstream
+// error rate crossing NotifyErrorRate over NotifyWindow and going back
+// under it, and whatever an embedder reports through Proxy.Notify. The
+// payload is the NotifyTemplate text/template, by default a JSON object
+// with a Slack-compatible "text". Each event name is sent at most once per
+// NotifyCooldown, later ones counted into the next; a delivery is retried
+// NotifyRetries times with backoff, then written to the dead letter log
+// (NotifyDeadLetter, or the process log when that is empty).
+
+const notifyTestPath = reservePrefix + "notify/test"
+
+// notifyBuckets is how many slices the error rate window is counted in.
+const notifyBuckets = 10
+
+// defaultNotifyTemplate is the payload without Options.NotifyTemplate.
+const defaultNotifyTemplate = `{"text":{{json .Text}},"event":{{json .Event}},"time":{{json .Time}},"suppressed":{{.Suppressed}},"details":{{json .Details}}}`
+
+// Notification is what a NotifyTemplate renders: Suppressed counts the
+// events of the same name held back by the cooldown since the last one.
+type Notification struct {
+	Event      string
+	Text       string
+	Time       string
+	Suppressed int64
+	Details    map[string]any
+}
+
+// notifier sends a Proxy's notifications from one worker, in order.
+type notifier struct {
+	opts  Options
+	url   string
+	tmpl  *template.Template
+	queue chan *Notification
+	http  *http.Client
+
+	mu         sync.Mutex
+	last       map[string]time.Time // event name -> last sent
+	suppressed map[string]int64     // event name -> held back since
+
+	rate errorRate
+
+	sent, failed, retried atomic.Int64
+	held, dropped         atomic.Int64
+}
+
+var errNotifyTest = &httpError{
+	status: http.StatusBadGateway,
+	code:   "notify_failed",
+	msg:    "the webhook did not accept the test notification",
+}
+
+func newNotifier(opts Options) (*notifier, error) {
+	if opts.NotifyURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(string(opts.NotifyURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("reserve: notify URL must be an absolute http(s) URL")
+	}
+	text := opts.NotifyTemplate
+	if text == "" {
+		text = defaultNotifyTemplate
+	}
+	tmpl, err := template.New("notify").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			bs, err := statsAPI.Marshal(v)
+			return string(bs), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("reserve: notify template: %w", err)
+	}
+	n := &notifier{
+		opts:       opts,
+		url:        string(opts.NotifyURL),
+		tmpl:       tmpl,
+		queue:      make(chan *Notification, 64),
+		http:       &http.Client{Timeout: 10 * time.Second},
+		last:       map[string]time.Time{},
+		suppressed: map[string]int64{},
+	}
+	n.rate.init(opts.NotifyWindow)
+	go n.run()
+	return n, nil
+}
+
+func (p *Proxy) notifyStats() any {
+	n := p.notify
+	if n == nil {
+		return map[string]any{"enabled": false}
+	}
+	total, errs, alerting := n.rate.snapshot()
+	return map[string]any{
+		"enabled":    true,
+		"sent":       n.sent.Load(),
+		"failed":     n.failed.Load(),
+		"retried":    n.retried.Load(),
+		"suppressed": n.held.Load(),
+		"dropped":    n.dropped.Load(),
+		"error_rate": map[string]any{
+			"threshold": n.opts.NotifyErrorRate,
+			"window":    n.opts.NotifyWindow.String(),
+			"requests":  total,
+			"errors":    errs,
+			"alerting":  alerting,
+		},
+	}
+}
+
+// Notify sends a notification named event through p's webhook, subject to
+// its cooldown; it is a no-op without Options.NotifyURL. Embedders report
+// their own events (a circuit breaker, a health probe) with it.
+func (p *Proxy) Notify(event, text string, details map[string]any) {
+	if p.notify != nil {
+		p.notify.post(event, text, details)
+	}
+}
+
+// post queues a notification unless event is cooling down.
+func (n *notifier) post(event, text string, details map[string]any) {
+	now := time.Now()
+	n.mu.Lock()
+	if last, ok := n.last[event]; ok && now.Sub(last) < n.opts.NotifyCooldown {
+		n.suppressed[event]++
+		n.mu.Unlock()
+		n.held.Add(1)
+		return
+	}
+	n.last[event] = now
+	held := n.suppressed[event]
+	delete(n.suppressed, event)
+	n.mu.Unlock()
+
+	msg := &Notification{Event: event, Text: text, Time: now.UTC().Format(time.RFC3339), Suppressed: held, Details: details}
+	select {
+	case n.queue <- msg:
+	default:
+		// the webhook is slower than events come in; don't block requests
+		n.dropped.Add(1)
+		n.deadLetter(msg, errors.New("notification queue full"))
+	}
+}
+
+func (n *notifier) run() {
+	for msg := range n.queue {
+		if _, err := n.deliver(context.Background(), msg); err != nil {
+			n.deadLetter(msg, err)
+		}
+	}
+}
+
+// deliver POSTs msg, retrying with backoff, and returns the attempts made.
+func (n *notifier) deliver(ctx context.Context, msg *Notification) (int, error) {
+	var body bytes.Buffer
+	if err := n.tmpl.Execute(&body, msg); err != nil {
+		n.failed.Add(1)
+		return 0, err
+	}
+	var err error
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		if err = n.send(ctx, body.Bytes()); err == nil {
+			n.sent.Add(1)
+			return attempt + 1, nil
+		}
+		if attempt == n.opts.NotifyRetries {
+			n.failed.Add(1)
+			return attempt + 1, err
+		}
+		n.retried.Add(1)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			n.failed.Add(1)
+			return attempt + 1, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (n *notifier) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.http.Do(req)
+	if err != nil {
+		// the URL carries the webhook's secret
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// deadLetter records a notification that could not be delivered.
+func (n *notifier) deadLetter(msg *Notification, cause error) {
+	if path := n.opts.NotifyDeadLetter; path != "" {
+		line, err := statsAPI.Marshal(map[string]any{
+			"event": msg.Event, "text": msg.Text, "time": msg.Time,
+			"details": msg.Details, "error": cause.Error(),
+		})
+		if err == nil {
+			var f *os.File
+			if f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err == nil {
+				_, err = f.Write(append(line, '\n'))
+				if cerr := f.Close(); err == nil {
+					err = cerr
+				}
+			}
+		}
+		if err == nil {
+			slog.Warn("notify: delivery failed, dead-lettered", "event", msg.Event, "error", cause, "file", path)
+			return
+		}
+		slog.Error("notify: dead letter log", "file", path, "error", err)
+	}
+	slog.Error("notify: delivery failed", "event", msg.Event, "text", msg.Text, "details", msg.Details, "error", cause)
+}
+
+// serveNotifyTest sends a test notification right away, bypassing the
+// cooldown and queue, and reports whether the webhook took it.
+func (p *Proxy) serveNotifyTest(w http.ResponseWriter, r *http.Request, caller string) {
+	if r.Method != http.MethodPost {
+		writeHTTPError(w, errMethod)
+		return
+	}
+	if p.notify == nil {
+		writeHTTPError(w, &httpError{status: http.StatusNotFound, code: "notify_disabled", msg: "no notify URL is configured"})
+		return
+	}
+	msg := &Notification{
+		Event:   "test",
+		Text:    "rc-proxy test notification from " + caller,
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Details: map[string]any{"caller": caller, "target": p.opts.Target},
+	}
+	attempts, err := p.notify.deliver(r.Context(), msg)
+	slog.Info("admin notify test", "caller", caller, "remote", r.RemoteAddr, "attempts", attempts, "error", err)
+	if err != nil {
+		he := *errNotifyTest
+		he.msg += ": " + err.Error()
+		writeHTTPError(w, &he)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"delivered": true, "attempts": attempts})
+}
+
+// failing reports whether the upstream error rate is over
+// Options.NotifyErrorRate.
+func (n *notifier) failing() bool {
+	if n == nil || n.opts.NotifyErrorRate <= 0 {
+		return false
+	}
+	_, _, alerting := n.rate.snapshot()
+	return alerting
+}
+
+// upstreamResult counts one upstream outcome into the error rate and
+// notifies when the rate crosses the threshold either way. err is true for
+// 5xx responses, failed round trips and upstream timeouts.
+func (n *notifier) upstreamResult(err bool) {
+	if n == nil || n.opts.NotifyErrorRate <= 0 {
+		return
+	}
+	flip, total, errs := n.rate.add(err, n.opts.NotifyErrorRate, n.opts.NotifyMinRequests)
+	if flip == 0 {
+		return
+	}
+	rate := float64(errs) / float64(total)
+	details := map[string]any{
+		"requests":  total,
+		"errors":    errs,
+		"rate":      rate,
+		"threshold": n.opts.NotifyErrorRate,
+		"window":    n.opts.NotifyWindow.String(),
+		"target":    n.opts.Target,
+	}
+	if flip > 0 {
+		slog.Warn("notify: upstream error rate over threshold", "rate", rate, "requests", total)
+		n.post("error_rate", fmt.Sprintf("upstream error rate %.0f%% (%d of %d) over the last %s, above %.0f%%",
+			rate*100, errs, total, n.opts.NotifyWindow, n.opts.NotifyErrorRate*100), details)
+		return
+	}
+	slog.Info("notify: upstream error rate recovered", "rate", rate, "requests", total)
+	n.post("error_rate_recovered", fmt.Sprintf("upstream error rate back to %.0f%% (%d of %d) over the last %s",
+		rate*100, errs, total, n.opts.NotifyWindow), details)
+}
+
+// errorRate counts upstream outcomes over a sliding window, in
+// notifyBuckets slices of it.
+type errorRate struct {
+	mu       sync.Mutex
+	slice    time.Duration
+	at       int64 // index of the current slice since the epoch
+	total    [notifyBuckets]int64
+	errs     [notifyBuckets]int64
+	alerting bool
+}
+
+func (e *errorRate) init(window time.Duration) {
+	e.slice = window / notifyBuckets
+	if e.slice <= 0 {
+		e.slice = time.Second
+	}
+}
+
+// advance drops the slices that fell out of the window. Called with mu held.
+func (e *errorRate) advance() {
+	now := time.Now().UnixNano() / int64(e.slice)
+	if gap := now - e.at; gap >= notifyBuckets {
+		e.total, e.errs = [notifyBuckets]int64{}, [notifyBuckets]int64{}
+	} else {
+		for i := e.at + 1; i <= now; i++ {
+			e.total[i%notifyBuckets], e.errs[i%notifyBuckets] = 0, 0
+		}
+	}
+	e.at = now
+}
+
+func (e *errorRate) sums() (total, errs int64) {
+	for i := range notifyBuckets {
+		total += e.total[i]
+		errs += e.errs[i]
+	}
+	return total, errs
+}
+
+// add counts one outcome and returns 1 when the window went over
+// threshold (with at least min requests in it), -1 when it went back under.
+func (e *errorRate) add(err bool, threshold float64, min int) (flip int, total, errs int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+	i := e.at % notifyBuckets
+	e.total[i]++
+	if err {
+		e.errs[i]++
+	}
+	total, errs = e.sums()
+	over := float64(errs) >= threshold*float64(total)
+	switch {
+	case !e.alerting && over && total >= int64(min):
+		e.alerting = true
+		return 1, total, errs
+	case e.alerting && !over:
+		e.alerting = false
+		return -1, total, errs
+	}
+	return 0, total, errs
+}
+
+func (e *errorRate) snapshot() (total, errs int64, alerting bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+	total, errs = e.sums()
+	return total, errs, e.alerting
+}
@@ -0,0 +1,484 @@
+package reserve
+
+import (
+	"compress/gzip"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// Options configures a Rewriter or Proxy. Start from DefaultOptions; the
+// zero value of a limit disables it.
+type Options struct {
+	// Target is the upstream base URL (Proxy only).
+	Target string
+	// Upstreams, when set, are further upstream base URLs, each "url" or
+	// "url=weight", requests are balanced over along with Target (weight
+	// 1) by the Balance strategy: "weighted-rr" (the default, ""),
+	// "least-latency" or "least-inflight". See balance.go (Proxy only).
+	Upstreams []string
+	Balance   string
+	// Transport is used for upstream requests; nil uses a transport tuned
+	// for long-lived streaming connections (Proxy only).
+	Transport http.RoundTripper
+
+	// Mounts are the path prefixes the route table is matched under
+	// ("" is the root).
+	Mounts []string
+	// NDJSONPaths are extra POST routes, matched under each mount, whose
+	// bodies hold one Responses request per line; each is rewritten on its
+	// own as the body streams through.
+	NDJSONPaths []string
+
+	// InstructionsRewrite enables the instructions migration hook; it is the
+	// initial value of the Runtime setting of the same name.
+	InstructionsRewrite bool
+	// LogLevel, when set, is the level the admin API may adjust at runtime.
+	LogLevel *slog.LevelVar
+
+	// SystemToDeveloper turns system messages in input into developer
+	// messages, dropping those that repeat a developer message.
+	SystemToDeveloper bool
+
+	// StripReasoning drops the reasoning items without encrypted_content
+	// from resent input, unless the request sets previous_response_id; see
+	// history.go.
+	StripReasoning bool
+
+	// Policy, when set, sets seed and service_tier on rewritten requests;
+	// see policy.go. NewProxy rejects an invalid one.
+	Policy *RequestPolicy
+
+	// ReasoningInclude asks for reasoning.encrypted_content in include on
+	// requests with store: false, so stateless clients can carry reasoning
+	// across turns.
+	ReasoningInclude bool
+
+	// TolerantJSON strips comments and trailing commas from a body that
+	// is not valid JSON, when that makes it valid; see tolerant.go.
+	TolerantJSON bool
+	// UnwrapBodies replaces a body that is a JSON string holding the
+	// request object, or a one-element array of it, with the object; see
+	// unwrap.go.
+	UnwrapBodies bool
+
+	// MinimalDiff rewrites bodies with byte splices instead of re-encoding,
+	// preserving the client's key order and formatting.
+	MinimalDiff bool
+	// CanonicalJSON re-encodes rewritten bodies with sorted keys and
+	// normalized numbers, for upstreams caching on exact body prefixes;
+	// bodies over CanonicalMaxBytes (0 = no cap) are left alone. It excludes
+	// MinimalDiff (NewProxy fails, a Rewriter ignores it). See canonical.go.
+	CanonicalJSON     bool
+	CanonicalMaxBytes int64
+
+	// MaxJSONDepth / MaxJSONKeys bound bodies before the AST parse and
+	// ParseBudget bounds the wait for the parse itself; over a limit the
+	// body is forwarded untouched, or rejected with JSONLimitReject. A parse
+	// over budget isn't stopped, only abandoned, so it is MaxBody and the
+	// depth and key limits that bound its CPU and memory.
+	MaxJSONDepth    int
+	MaxJSONKeys     int
+	ParseBudget     time.Duration
+	JSONLimitReject bool
+
+	// ValidateRoutes names the routes whose bodies are checked against the
+	// embedded Responses request schema, and answered with a 400 when they
+	// don't match; see schema.go. NewProxy rejects a route without a
+	// Responses body.
+	ValidateRoutes []string
+
+	// InputTokenBudget, when set, drops the oldest input items of requests
+	// estimated at more tokens than that, keeping the leading developer
+	// messages and the last InputKeepTurns user turns. TokenEstimate counts
+	// the tokens of a JSON value; nil is EstimateTokens. See window.go.
+	InputTokenBudget int
+	InputKeepTurns   int
+	TokenEstimate    func([]byte) int
+	// TokenizerVocab, when set and TokenEstimate is not, is the path of a
+	// tiktoken vocabulary counting tokens in place of EstimateTokens.
+	// EstimateInputTokens estimates the input tokens of each rewritten
+	// request, for the wide log and the token_estimate stats, which
+	// compare it with the usage the upstream reports; TokenEstimateHeader
+	// also returns it in X-Reserve-Estimated-Input-Tokens. See tokenizer.go
+	// (Proxy only).
+	TokenizerVocab      string
+	EstimateInputTokens bool
+	TokenEstimateHeader bool
+
+	// MaxBody caps a single buffered request body after decompression.
+	MaxBody int64
+
+	// SpillThreshold, when set, keeps only that many bytes of a larger body
+	// in memory and the rest in a temp file in SpillDir (os.TempDir when
+	// empty); such bodies get the byte-level rewrite only, see spill.go.
+	SpillThreshold int64
+	SpillDir       string
+
+	// BodyBudget caps the bytes of request bodies buffered at once.
+	BodyBudget int64
+	// BodyBudgetWait is how long a rewrite may wait for budget before a 503, 0 fails fast.
+	BodyBudgetWait time.Duration
+
+	// RequestTimeout caps a whole non-streaming request; streams switch to
+	// StreamIdleTimeout once response headers arrive (Proxy only).
+	RequestTimeout    time.Duration
+	StreamIdleTimeout time.Duration
+
+	// DialTimeout, TLSHandshakeTimeout and ResponseHeaderTimeout bound the
+	// phases of an upstream request before its response: connecting, the
+	// TLS handshake and, once the request is written, the wait for the
+	// response headers. Zero keeps the built-in transport's 30s, 10s and
+	// 60s, a negative value is no bound; a custom Transport has its own.
+	// RouteTimeouts gives routes, by name, their own, and their own
+	// StreamIdleTimeout. See timeout.go (Proxy only).
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	RouteTimeouts         map[string]PhaseTimeouts
+
+	// UpstreamGzip, when positive, gzip-compresses buffered request bodies
+	// of at least that many bytes toward the upstream, at
+	// UpstreamGzipLevel (Proxy only).
+	UpstreamGzip      int64
+	UpstreamGzipLevel int
+	// UpstreamAcceptGzip sends every request upstream with
+	// Accept-Encoding: gzip, decompressing the response for clients that
+	// did not ask for it; see acceptencoding.go (Proxy only).
+	UpstreamAcceptGzip bool
+	// H2Retries is how many times a request failing with a transient
+	// HTTP/2 error (GOAWAY, REFUSED_STREAM, INTERNAL_ERROR) before any
+	// response is sent again (0 = never); H2RetryFreshConn closes the idle
+	// upstream connections before each retry. See h2retry.go (Proxy only).
+	H2Retries        int
+	H2RetryFreshConn bool
+	// KeepWarmConns, when set, is how many upstream connections a keeper
+	// keeps from going idle long enough to be closed, with a
+	// KeepWarmMethod (HEAD, the default, OPTIONS or GET) request on
+	// KeepWarmPath (relative to Target, "" for Target itself) each every
+	// KeepWarmInterval (0 = three quarters of the idle timeout). Over
+	// HTTP/2 the requests share one connection. See keepwarm.go (Proxy
+	// only).
+	KeepWarmConns    int
+	KeepWarmMethod   string
+	KeepWarmPath     string
+	KeepWarmInterval time.Duration
+
+	// FlushInterval is how often a response other than an event stream or
+	// one of FlushTypes (media types, flushed on every write) is flushed
+	// to the client; 0 flushes it only at the end, a negative value every
+	// write (Proxy only).
+	FlushInterval time.Duration
+	FlushTypes    []string
+
+	// PublicURL is the proxy's externally visible base URL; when set,
+	// absolute upstream URLs in the URLHeaders of responses, and in the
+	// URLBodyFields of JSON responses, are rewritten onto it (Proxy only).
+	PublicURL     string
+	URLHeaders    []string
+	URLBodyFields []string
+
+	// StreamSniffWait bounds how long the stream_errors hook waits for the
+	// first event of a 200 stream to check it for an error; 0 turns the
+	// check off (Proxy only).
+	StreamSniffWait time.Duration
+
+	// BackgroundWait, when set, makes the proxy poll a background response
+	// (background: true) itself and hold the creation request until it is
+	// terminal, for at most this long (Proxy only).
+	BackgroundWait time.Duration
+
+	// Dedup shares one upstream request between identical non-streaming
+	// requests of the same client in flight at once; a duplicate waits at
+	// most DedupWait for it before going on alone (Proxy only).
+	Dedup     bool
+	DedupWait time.Duration
+
+	// IdempotencyTTL is how long the response to a request carrying an
+	// Idempotency-Key is kept for replay to a retry; 0 turns the header
+	// support off. Kept responses are capped at IdempotencyMaxBytes of body
+	// in total (Proxy only).
+	IdempotencyTTL      time.Duration
+	IdempotencyMaxBytes int64
+
+	// GetCacheTTL, when set, answers GET requests on GetCacheRoutes (route
+	// names) from a per-client cache of their 200 responses: fresh for
+	// GetCacheTTL, then served stale while refreshed in the background for
+	// GetCacheStale, and in place of an upstream error for
+	// GetCacheStaleIfError past GetCacheTTL. The bodies kept are capped at
+	// GetCacheMaxBytes in total (0 = no cap). See getcache.go (Proxy only).
+	GetCacheTTL          time.Duration
+	GetCacheStale        time.Duration
+	GetCacheStaleIfError time.Duration
+	GetCacheRoutes       []string
+	GetCacheMaxBytes     int64
+
+	// UpstreamConcurrency caps the rewritten requests with the upstream at
+	// once, UpstreamClientConcurrency those of one client; 0 leaves either
+	// unlimited. Requests over a cap wait in a FIFO queue of at most
+	// UpstreamQueue for up to UpstreamQueueWait (0 = as long as the request
+	// lasts) before a 429 (Proxy only).
+	UpstreamConcurrency       int
+	UpstreamClientConcurrency int
+	UpstreamQueue             int
+	UpstreamQueueWait         time.Duration
+
+	// RateLimit caps the rewritten requests starting per second across all
+	// clients (0 = no cap), in bursts of up to RateBurst (0 = one second's
+	// worth). A request over it waits up to RateQueueWait for its turn and
+	// is refused with a 429 past that (0 = at once). See ratelimit.go
+	// (Proxy only).
+	RateLimit     float64
+	RateBurst     int
+	RateQueueWait time.Duration
+
+	// RateLimitHeaders is how the limits of RateLimit and Quotas are
+	// reported in the x-ratelimit-* response headers: "merged" (the
+	// default, "") with the upstream's values, which stay where they are
+	// tighter, "proxy" in place of them, or "off". See ratelimitheaders.go
+	// (Proxy only).
+	RateLimitHeaders string
+
+	// ResponseHeaders, when set, is the policy of the upstream response
+	// headers passed to the clients, the Runtime's until the admin API
+	// replaces it. See respheaders.go (Proxy only).
+	ResponseHeaders *ResponseHeaderPolicy
+
+	// ModelFallbacks maps a model to the one a rewritten request is retried
+	// with, once, when the upstream answers it with model_not_found or a
+	// 503 for lack of capacity. See fallback.go (Proxy only).
+	ModelFallbacks map[string]string
+
+	// MaxResponseBytes caps the body of a non-streaming response by route
+	// name ("*" = every route not listed, 0 = no cap): one announcing a
+	// longer Content-Length is answered with a 502, one of unknown length
+	// is cut at the cap with an X-Reserve-Truncated trailer.
+	// MaxStreamBytes caps the bytes of an event stream of any route, which
+	// then ends with an error event. See respsize.go (Proxy only).
+	MaxResponseBytes map[string]int64
+	MaxStreamBytes   int64
+
+	// RequireAuth names the routes ("*" = all) answering requests without
+	// credential headers with a 401 instead of forwarding them; NewProxy
+	// rejects unknown names. See auth.go (Proxy only).
+	RequireAuth []string
+
+	// MaxHeaderValueBytes, MaxHeaderBytes and MaxHeaderCount bound a single
+	// request header value, all request headers and their number (0 = no
+	// limit); a request over one is answered with a 431 naming the header.
+	// DropHeaders are removed from every request first, never forwarded.
+	// See headerlimits.go (Proxy only).
+	MaxHeaderValueBytes int
+	MaxHeaderBytes      int
+	MaxHeaderCount      int
+	DropHeaders         []string
+
+	// BodyReadTimeout is how long a buffered request body may go without
+	// sending a byte before it is answered with a 408 (0 = no limit).
+	// MaxConns caps the open client connections and MaxConnsPerIP those
+	// of one peer address (0 = no cap); past them requests get a 503 (429
+	// per address), given the server's ConnContext and ConnState are set
+	// to the Proxy's. See clientconns.go (Proxy only).
+	BodyReadTimeout time.Duration
+	MaxConns        int
+	MaxConnsPerIP   int
+
+	// Prices, when set, prices the usage of responses for the cost stats,
+	// the usage log line and, with CostHeader, X-Reserve-Estimated-Cost.
+	// ClientBudget is each client's monthly budget in USD (0 = none, see
+	// PriceTable.Budgets for single clients); over it a warning is logged,
+	// and with BudgetReject new requests get a 402 (Proxy only).
+	Prices       *PriceTable
+	CostHeader   bool
+	ClientBudget float64
+	BudgetReject bool
+
+	// Quotas, when set, caps what single clients may use per day, week or
+	// month: requests, and the tokens their responses report. A request
+	// over a quota gets a 429 (Proxy only). See quota.go.
+	Quotas *QuotaTable
+
+	// StoreFlush is how often an attached Store (see AttachStore) gets the
+	// usage aggregates and is swept of expired entries (Proxy only).
+	StoreFlush time.Duration
+
+	// NotifyURL, when set, is the webhook notifications are POSTed to,
+	// rendered with NotifyTemplate (a text/template over Notification; ""
+	// is a JSON object with a Slack-compatible "text"). An upstream error
+	// rate (5xx, failed round trips, timeouts) of NotifyErrorRate or more
+	// over NotifyWindow, with at least NotifyMinRequests in it, notifies
+	// (0 = off), as does its recovery. An event is sent at most once per
+	// NotifyCooldown; a failed delivery is retried NotifyRetries times and
+	// then appended to the NotifyDeadLetter file (or logged). See notify.go
+	// (Proxy only).
+	NotifyURL         Secret
+	NotifyTemplate    string
+	NotifyErrorRate   float64
+	NotifyWindow      time.Duration
+	NotifyMinRequests int
+	NotifyCooldown    time.Duration
+	NotifyRetries     int
+	NotifyDeadLetter  string
+
+	// CaptureDir, when set, keeps the whole exchanges of the clients the
+	// Policy's ClientCapture names, as JSON lines in a directory per
+	// client, rotated past CaptureMaxBytes (0 = never) and deleted
+	// CaptureMaxAge after their last write (0 = kept). CaptureKey, a
+	// hex-encoded AES key, seals every line with AES-GCM. See capture.go
+	// (Proxy only).
+	CaptureDir      string
+	CaptureMaxBytes int64
+	CaptureMaxAge   time.Duration
+	CaptureKey      Secret
+
+	// WideLog, when set, gets one "request" record per proxied request with
+	// everything known about it at completion (see wide.go). WideSample is
+	// the fraction of successful requests kept, failed ones always are;
+	// WideRedact lists record fields (dotted paths) logged as a hash of
+	// their value (Proxy only).
+	WideLog    *slog.Logger
+	WideSample float64
+	WideRedact []string
+
+	// TraceSecret, when set, traces requests sending it in X-Reserve-Trace:
+	// each of their stages is logged at info level under one trace id,
+	// echoed back in X-Reserve-Trace-Id with TraceEchoID (Proxy only).
+	TraceSecret Secret
+	TraceEchoID bool
+	// RequestIDHeader is the header the request id goes upstream in, ""
+	// for none; see requestid.go (Proxy only).
+	RequestIDHeader string
+
+	// UsageExport, when set, is the file every usage record is appended to,
+	// in UsageExportFormat ("jsonl" or "csv") with the UsageExportFields
+	// columns ("" = all). It is rotated past UsageExportMaxBytes (0 = no
+	// cap) and, with UsageExportDaily, on each UTC day, the rotated files
+	// gzipped with UsageExportGzip. See export.go (Proxy only).
+	UsageExport         string
+	UsageExportFormat   string
+	UsageExportFields   []string
+	UsageExportMaxBytes int64
+	UsageExportDaily    bool
+	UsageExportGzip     bool
+
+	// ProfileDir, when set, is where heap and goroutine profiles are
+	// written, on demand from the admin API and, every WatchInterval, when
+	// the heap in use reaches WatchHeap bytes, the goroutines reach
+	// WatchGoroutines or the heap has grown WatchGrowth samples in a row
+	// (0 = off each). Automatic captures are at most one per
+	// ProfileCooldown; the oldest profiles are removed past ProfileMaxBytes
+	// (0 = never). See watchdog.go (Proxy only).
+	ProfileDir      string
+	WatchHeap       int64
+	WatchGoroutines int
+	WatchGrowth     int
+	WatchInterval   time.Duration
+	ProfileCooldown time.Duration
+	ProfileMaxBytes int64
+
+	// FaultInjection lets the admin API's /_reserve/faults take rules
+	// that fail requests on purpose, for testing clients; see fault.go
+	// (Proxy only).
+	FaultInjection bool
+
+	// VersionHeader adds X-Reserve-Version to every response (Proxy only).
+	VersionHeader bool
+	// ConnTraceHeader adds X-Reserve-Conn, the upstream connection timings
+	// of the request, to proxied responses (Proxy only).
+	ConnTraceHeader bool
+	// ErrorFingerprints hashes each client body and its rewritten form, so
+	// the warning for an upstream error on a rewritten request carries
+	// both sha256 prints; see diagnose.go (Proxy only).
+	ErrorFingerprints bool
+
+	// Hooks run on every rewritten request (and its response) in order;
+	// nil runs DefaultHooks, an empty slice none.
+	Hooks []Hook
+
+	// ClientCacheSize bounds the credential -> identity LRU.
+	ClientCacheSize int
+	ClientCacheTTL  time.Duration
+	// TrustedProxies are the peers whose X-Forwarded-For (or X-Real-IP)
+	// names the client, for the address fallback of a client's identity;
+	// see clientip.go.
+	TrustedProxies []netip.Prefix
+	// IdentityIPv4Prefix and IdentityIPv6Prefix mask that address to a
+	// network of so many bits, e.g. 64 for IPv6 (0 = the whole address).
+	IdentityIPv4Prefix int
+	IdentityIPv6Prefix int
+}
+
+// DefaultOptions returns the options rc-proxy runs with by default.
+func DefaultOptions() Options {
+	return Options{
+		Target:  "https://right.codes",
+		Balance: "weighted-rr",
+		Mounts:  []string{"", "/codex"},
+
+		InstructionsRewrite: true,
+
+		MaxJSONDepth: 256,
+		MaxJSONKeys:  1024,
+
+		MaxBody: 32 << 20,
+
+		CanonicalMaxBytes: 1 << 20,
+
+		InputKeepTurns: 2,
+
+		RequestTimeout:    10 * time.Minute,
+		StreamIdleTimeout: 5 * time.Minute,
+		StreamSniffWait:   200 * time.Millisecond,
+		FlushInterval:     100 * time.Millisecond,
+		UpstreamGzipLevel: gzip.DefaultCompression,
+		DedupWait:         30 * time.Second,
+
+		DialTimeout:           defaultDialTimeout,
+		TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
+		ResponseHeaderTimeout: defaultResponseHeaderTimeout,
+
+		CaptureMaxBytes: 64 << 20,
+
+		URLHeaders:  []string{"Location", "Content-Location"},
+		DropHeaders: []string{"Cookie"},
+
+		BodyReadTimeout: time.Minute,
+		H2Retries:       2,
+		KeepWarmMethod:  http.MethodHead,
+
+		IdempotencyTTL:      time.Minute,
+		IdempotencyMaxBytes: 64 << 20,
+
+		GetCacheStale:        5 * time.Minute,
+		GetCacheStaleIfError: time.Hour,
+		GetCacheRoutes:       []string{"models"},
+		GetCacheMaxBytes:     8 << 20,
+
+		RateLimitHeaders: "merged",
+
+		UpstreamQueue:     256,
+		UpstreamQueueWait: 30 * time.Second,
+
+		StoreFlush: time.Minute,
+
+		WideSample: 1,
+
+		TraceEchoID:     true,
+		RequestIDHeader: "X-Request-Id",
+
+		UsageExportFormat: "jsonl",
+
+		WatchInterval:   time.Minute,
+		ProfileCooldown: time.Hour,
+		ProfileMaxBytes: 256 << 20,
+
+		NotifyWindow:      5 * time.Minute,
+		NotifyMinRequests: 20,
+		NotifyCooldown:    10 * time.Minute,
+		NotifyRetries:     3,
+
+		ClientCacheSize: 1024,
+		ClientCacheTTL:  10 * time.Minute,
+	}
+}
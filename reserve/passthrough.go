@@ -0,0 +1,56 @@
+package reserve
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// httputil.ReverseProxy already relays 1xx responses (its own
+// Got1xxResponse hook) and declares/copies trailers, streaming bodies
+// included. These counters make that visible; the trace below composes
+// with the proxy's hook rather than replacing it.
+type passthroughCounts struct {
+	informational sync.Map // status code -> *atomic.Int64
+	trailerResps  atomic.Int64
+
+	trace *httptrace.ClientTrace
+}
+
+func newPassthroughCounts() *passthroughCounts {
+	c := &passthroughCounts{}
+	c.trace = &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, _ textproto.MIMEHeader) error {
+			v, _ := c.informational.LoadOrStore(code, new(atomic.Int64))
+			v.(*atomic.Int64).Add(1)
+			return nil
+		},
+	}
+	return c
+}
+
+func (c *passthroughCounts) withTrace(r *http.Request) *http.Request {
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), c.trace))
+}
+
+// countTrailers notes responses that announce trailers in their headers.
+func (c *passthroughCounts) countTrailers(resp *http.Response) {
+	if len(resp.Trailer) > 0 {
+		c.trailerResps.Add(1)
+	}
+}
+
+func (c *passthroughCounts) stats() any {
+	codes := map[string]int64{}
+	c.informational.Range(func(k, v any) bool {
+		codes[strconv.Itoa(k.(int))] = v.(*atomic.Int64).Load()
+		return true
+	})
+	return map[string]any{
+		"informational":     codes,
+		"trailer_responses": c.trailerResps.Load(),
+	}
+}
@@ -0,0 +1,92 @@
+package reserve
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestPassthroughEarlyHints(t *testing.T) {
+	u := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "event: response.completed\ndata: {\"type\":\"response.completed\"}\n\n")
+	})
+	p := newTestProxy(t, DefaultOptions(), u)
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	var hints []string
+	trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, h textproto.MIMEHeader) error {
+		if code == http.StatusEarlyHints {
+			hints = append(hints, h.Get("Link"))
+		}
+		return nil
+	}}
+	req, _ := http.NewRequest("POST", srv.URL+"/v1/responses", strings.NewReader(`{"input":"hi","stream":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if len(hints) != 1 || hints[0] != "</style.css>; rel=preload" {
+		t.Errorf("client got 103s with Link %q, want the upstream's one", hints)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "response.completed") {
+		t.Errorf("answered %d %q, want the stream", resp.StatusCode, body)
+	}
+	st := p.Stats()["passthrough"].(map[string]any)
+	if n := st["informational"].(map[string]int64)["103"]; n != 1 {
+		t.Errorf("informational[103] = %d, want 1", n)
+	}
+}
+
+func TestPassthroughTrailers(t *testing.T) {
+	for _, tc := range []struct{ ctype, body string }{
+		{"application/json", `{"id":"resp_1","object":"response"}`},
+		{"text/event-stream", "event: response.completed\ndata: {\"type\":\"response.completed\"}\n\n"},
+	} {
+		t.Run(tc.ctype, func(t *testing.T) {
+			u := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				w.Header().Set("Trailer", "X-Trace-Id")
+				w.Header().Set("Content-Type", tc.ctype)
+				io.WriteString(w, tc.body)
+				w.(http.Flusher).Flush()
+				w.Header().Set("X-Trace-Id", "trace_42")
+			})
+			p := newTestProxy(t, DefaultOptions(), u)
+			srv := httptest.NewServer(p)
+			defer srv.Close()
+
+			resp, err := http.Post(srv.URL+"/v1/responses", "application/json", strings.NewReader(`{"input":"hi"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if string(body) != tc.body {
+				t.Errorf("body = %q, want %q", body, tc.body)
+			}
+			if got := resp.Trailer.Get("X-Trace-Id"); got != "trace_42" {
+				t.Errorf("trailer X-Trace-Id = %q, want trace_42", got)
+			}
+			st := p.Stats()["passthrough"].(map[string]any)
+			if n := st["trailer_responses"]; n != int64(1) {
+				t.Errorf("trailer_responses = %v, want 1", n)
+			}
+		})
+	}
+}
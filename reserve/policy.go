@@ -0,0 +1,290 @@
+package reserve
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"text/template"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/ast"
+)
+
+// Options.Policy pins request fields the clients would otherwise choose:
+// seed, for reproducible evals, either set when the body has none or
+// forced over the client's; service_tier, by client (its id, as in the
+// price table's budgets) or a default for everyone else; tool_choice, by
+// client, route or a default (see toolchoice.go); the text.format of
+// requests that leave it out (see textformat.go); and a developer message
+// leading new conversations (see devmessage.go). The policy, tool_choice,
+// text_format and developer_message hooks apply it on the AST, so the
+// change shows among the applied hooks of rc-proxy transform and in a
+// trace. Its headers are request headers normalized on the way upstream
+// (see headers.go). Values are checked when the policy is loaded, never
+// at request time.
+
+// Seed modes of a RequestPolicy.
+const (
+	SeedIfAbsent = "if_absent"
+	SeedForce    = "force"
+)
+
+// serviceTiers are the service_tier values the Responses API accepts.
+var serviceTiers = []string{"auto", "default", "flex", "priority", "scale"}
+
+// RequestPolicy names the request fields the proxy sets. Seed, when set, is
+// the seed; SeedMode is SeedIfAbsent (the default) or SeedForce.
+// ServiceTier is the service_tier of every client missing from
+// ClientTiers (empty = the client's own), ClientTiers that of single
+// clients by id (empty = the client's own). ToolChoice is the tool_choice
+// of every request, RouteToolChoices that of a route by name and
+// ClientToolChoices that of a client by id, the client's taking
+// precedence; each is none, auto, required or function:<name>.
+// TextFormat, RouteTextFormats and ClientTextFormats likewise name the
+// text.format of requests without one, json_object or json_schema:<name>
+// of a schema in JSONSchemas (name to file, relative to the policy file);
+// requests for NoStructuredOutputModels are left alone. Headers is the
+// HeaderPolicy of every route, RouteHeaders what a route changes in it.
+// DeveloperMessage is a template of the developer message put first in
+// new conversations, ClientNames the display names of clients by id and
+// Env the environment tag it may use (see devmessage.go). ClientCapture
+// names the clients, by id, who agreed to have their exchanges kept with
+// Options.CaptureDir (see capture.go); no one else's ever are.
+type RequestPolicy struct {
+	Seed        *int64            `json:"seed,omitempty"`
+	SeedMode    string            `json:"seed_mode,omitempty"`
+	ServiceTier string            `json:"service_tier,omitempty"`
+	ClientTiers map[string]string `json:"client_tiers,omitempty"`
+
+	ToolChoice        string            `json:"tool_choice,omitempty"`
+	RouteToolChoices  map[string]string `json:"route_tool_choices,omitempty"`
+	ClientToolChoices map[string]string `json:"client_tool_choices,omitempty"`
+
+	TextFormat               string            `json:"text_format,omitempty"`
+	RouteTextFormats         map[string]string `json:"route_text_formats,omitempty"`
+	ClientTextFormats        map[string]string `json:"client_text_formats,omitempty"`
+	JSONSchemas              map[string]string `json:"json_schemas,omitempty"`
+	NoStructuredOutputModels []string          `json:"no_structured_output_models,omitempty"`
+
+	Headers      *HeaderPolicy            `json:"headers,omitempty"`
+	RouteHeaders map[string]*HeaderPolicy `json:"route_headers,omitempty"`
+
+	DeveloperMessage string            `json:"developer_message,omitempty"`
+	ClientNames      map[string]string `json:"client_names,omitempty"`
+	Env              string            `json:"env,omitempty"`
+
+	ClientCapture map[string]bool `json:"client_capture,omitempty"`
+
+	schemas map[string][]byte  // JSONSchemas, read
+	devTmpl *template.Template // DeveloperMessage, parsed
+}
+
+// LoadRequestPolicy reads a RequestPolicy from the JSON file at path and
+// validates it.
+func LoadRequestPolicy(path string) (*RequestPolicy, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &RequestPolicy{}
+	if err := sonic.Unmarshal(bs, p); err != nil {
+		return nil, err
+	}
+	if err := p.loadSchemas(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Validate reports the first invalid value of p. The JSONSchemas files not
+// read yet are read, relative to the working directory.
+func (p *RequestPolicy) Validate() error {
+	switch p.SeedMode {
+	case "", SeedIfAbsent:
+	case SeedForce:
+		if p.Seed == nil {
+			return fmt.Errorf("seed_mode %q without a seed", p.SeedMode)
+		}
+	default:
+		return fmt.Errorf("seed_mode %q: want %q or %q", p.SeedMode, SeedIfAbsent, SeedForce)
+	}
+	if p.ServiceTier != "" && !slices.Contains(serviceTiers, p.ServiceTier) {
+		return fmt.Errorf("service_tier %q: want one of %v", p.ServiceTier, serviceTiers)
+	}
+	for id, t := range p.ClientTiers {
+		if t != "" && !slices.Contains(serviceTiers, t) {
+			return fmt.Errorf("client_tiers[%q] %q: want one of %v", id, t, serviceTiers)
+		}
+	}
+	if err := checkToolChoice(p.ToolChoice); err != nil {
+		return fmt.Errorf("tool_choice: %w", err)
+	}
+	for name, c := range p.RouteToolChoices {
+		if err := checkToolChoice(c); err != nil {
+			return fmt.Errorf("route_tool_choices[%q]: %w", name, err)
+		}
+	}
+	for id, c := range p.ClientToolChoices {
+		if err := checkToolChoice(c); err != nil {
+			return fmt.Errorf("client_tool_choices[%q]: %w", id, err)
+		}
+	}
+	if err := p.loadSchemas(""); err != nil {
+		return err
+	}
+	if err := p.checkTextFormat(p.TextFormat); err != nil {
+		return fmt.Errorf("text_format: %w", err)
+	}
+	for name, f := range p.RouteTextFormats {
+		if err := p.checkTextFormat(f); err != nil {
+			return fmt.Errorf("route_text_formats[%q]: %w", name, err)
+		}
+	}
+	for id, f := range p.ClientTextFormats {
+		if err := p.checkTextFormat(f); err != nil {
+			return fmt.Errorf("client_text_formats[%q]: %w", id, err)
+		}
+	}
+	if p.Headers != nil {
+		if err := p.Headers.Validate(); err != nil {
+			return fmt.Errorf("headers: %w", err)
+		}
+	}
+	for name, h := range p.RouteHeaders {
+		if h == nil {
+			continue
+		}
+		if err := h.Validate(); err != nil {
+			return fmt.Errorf("route_headers[%q]: %w", name, err)
+		}
+	}
+	if err := p.parseDeveloperMessage(); err != nil {
+		return fmt.Errorf("developer_message: %w", err)
+	}
+	return nil
+}
+
+func (p *RequestPolicy) tier(client string) string {
+	if t, ok := p.ClientTiers[client]; ok {
+		return t
+	}
+	return p.ServiceTier
+}
+
+type policyCounts struct {
+	seeds  atomic.Int64 // seeds added
+	forced atomic.Int64 // client seeds replaced
+	tiers  atomic.Int64 // service_tier set or replaced
+
+	toolChoices   atomic.Int64 // tool_choice set or replaced
+	toolFallbacks atomic.Int64 // named functions missing from tools, auto instead
+
+	textFormats  atomic.Int64 // text.format added
+	unstructured atomic.Int64 // skipped for NoStructuredOutputModels
+
+	devMessages atomic.Int64 // developer messages put first
+	devErrors   atomic.Int64 // rendered as written after a template error
+}
+
+func (rr *Rewriter) policyStats() any {
+	p := rr.opts.Policy
+	if p == nil {
+		return map[string]any{"enabled": false}
+	}
+	out := map[string]any{
+		"enabled":      true,
+		"service_tier": p.ServiceTier,
+		"client_tiers": len(p.ClientTiers),
+		"seeds":        rr.policy.seeds.Load(),
+		"forced":       rr.policy.forced.Load(),
+		"tiers":        rr.policy.tiers.Load(),
+
+		"tool_choice":         p.ToolChoice,
+		"route_tool_choices":  len(p.RouteToolChoices),
+		"client_tool_choices": len(p.ClientToolChoices),
+		"tool_choices":        rr.policy.toolChoices.Load(),
+		"tool_fallbacks":      rr.policy.toolFallbacks.Load(),
+
+		"text_format":         p.TextFormat,
+		"route_text_formats":  len(p.RouteTextFormats),
+		"client_text_formats": len(p.ClientTextFormats),
+		"json_schemas":        len(p.JSONSchemas),
+		"text_formats":        rr.policy.textFormats.Load(),
+		"unstructured":        rr.policy.unstructured.Load(),
+
+		"developer_message":        p.DeveloperMessage != "",
+		"client_names":             len(p.ClientNames),
+		"developer_messages":       rr.policy.devMessages.Load(),
+		"developer_message_errors": rr.policy.devErrors.Load(),
+	}
+	if p.Seed != nil {
+		out["seed"] = *p.Seed
+		out["seed_mode"] = cmp.Or(p.SeedMode, SeedIfAbsent)
+	}
+	return out
+}
+
+// policyHook sets seed and service_tier as Options.Policy says.
+func policyHook(r *Request) error {
+	rr := r.rw.rr
+	p := rr.opts.Policy
+	if p == nil {
+		return nil
+	}
+	tier := p.tier(rr.derivePromptCacheKey(r.HTTP, ""))
+	if p.Seed == nil && tier == "" {
+		return nil
+	}
+	var seed, curTier *ast.Node
+	if r.parsed {
+		seed, curTier = r.root.Get("seed"), r.root.Get("service_tier")
+	} else {
+		bs := r.Body()
+		s, _ := sonic.Get(bs, "seed")
+		t, _ := sonic.Get(bs, "service_tier")
+		seed, curTier = &s, &t
+	}
+	hasSeed := nodeType(seed) != ast.V_NONE && nodeType(seed) != ast.V_NULL
+	setSeed := p.Seed != nil && (!hasSeed || p.SeedMode == SeedForce && !isSeed(seed, *p.Seed))
+	setTier := tier != "" && nodeString(curTier) != tier
+	if !setSeed && !setTier {
+		return nil
+	}
+	root, err := r.JSON()
+	if root == nil {
+		return err
+	}
+	if setSeed {
+		if _, err := root.Set("seed", ast.NewNumber(strconv.FormatInt(*p.Seed, 10))); err != nil {
+			return err
+		}
+		if hasSeed {
+			rr.policy.forced.Add(1)
+		} else {
+			rr.policy.seeds.Add(1)
+		}
+	}
+	if setTier {
+		if _, err := root.Set("service_tier", ast.NewString(tier)); err != nil {
+			return err
+		}
+		rr.policy.tiers.Add(1)
+	}
+	r.Logger().Debug("policy: request fields set", "route", r.Route, "seed", setSeed, "service_tier", tier)
+	traceOf(r.HTTP.Context()).log("policy", "seed", setSeed, "forced", setSeed && hasSeed,
+		"service_tier", tier, "tier_set", setTier)
+	return nil
+}
+
+// isSeed reports whether n is the number seed.
+func isSeed(n *ast.Node, seed int64) bool {
+	v, err := n.Int64()
+	return err == nil && nodeType(n) == ast.V_NUMBER && v == seed
+}
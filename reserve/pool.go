@@ -0,0 +1,415 @@
+package reserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/bits"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	preGrow       = 32 << 10 // fallback pre-grow when there is no size history
+	smallKeepCap  = 64 << 10
+	maxKeepBufCap = 1 << 20 // 1MB
+	copyBufSize   = 32 << 10
+
+	sizeRingLen     = 512 // recent body sizes used for the pre-grow percentile
+	sizeRecalcEvery = 64
+	sizePercentile  = 90
+	sizeBuckets     = 16 // power-of-two buckets from 1KB up to 32MB
+)
+
+// bufClass is one size class of pooled body buffers. Buffers go back to the
+// class matching their capacity, so a buffer that grew past small ends up
+// in medium/large instead of being dropped.
+type bufClass struct {
+	name    string
+	maxKeep int
+	pool    sync.Pool
+
+	gets atomic.Int64
+	news atomic.Int64
+	puts atomic.Int64
+}
+
+// The largest buffers the pools keep, see SetPoolMaxKeep. They are only
+// written before the pools are used.
+var (
+	largeKeepCap   = 8 << 20
+	maxKeepCopyCap = 1 << 20
+)
+
+var (
+	bufClasses = [...]*bufClass{
+		{name: "small", maxKeep: smallKeepCap},
+		{name: "medium", maxKeep: maxKeepBufCap},
+		{name: "large", maxKeep: largeKeepCap},
+	}
+	bufDiscards atomic.Int64 // over largeKeepCap
+
+	copyPool   = sync.Pool{New: func() any { copyCounts.news.Add(1); return make([]byte, copyBufSize) }}
+	copyCounts struct {
+		gets, news, puts atomic.Int64
+		discards         atomic.Int64 // over maxKeepCopyCap, or shrunk below copyBufSize
+	}
+
+	gzipPool   = sync.Pool{New: func() any { return (*gzipReader)(nil) }}
+	gzipCounts struct {
+		hits, misses, resetFailures, puts atomic.Int64
+		recovered                         atomic.Int64 // reset failures the retry got past
+	}
+
+	sizeHist bodySizeHist
+)
+
+// SetPoolMaxKeep sets the capacity of the largest request body buffer
+// (default 8MB) and response copy buffer (default 1MB) the process-wide
+// pools keep; larger ones are dropped for the GC. 0 keeps a default. A
+// body cap under 1MB lowers the medium class's too. Call it before any
+// Rewriter or Proxy is used.
+func SetPoolMaxKeep(buf, copyBuf int) error {
+	if buf != 0 && buf < smallKeepCap {
+		return fmt.Errorf("reserve: body buffer max keep must be at least %d bytes", smallKeepCap)
+	}
+	if copyBuf != 0 && copyBuf < copyBufSize {
+		return fmt.Errorf("reserve: copy buffer max keep must be at least %d bytes", copyBufSize)
+	}
+	if buf != 0 {
+		largeKeepCap = buf
+		bufClasses[1].maxKeep = min(maxKeepBufCap, buf)
+		bufClasses[2].maxKeep = buf
+	}
+	if copyBuf != 0 {
+		maxKeepCopyCap = copyBuf
+	}
+	return nil
+}
+
+func classFor(n int) *bufClass {
+	for _, c := range bufClasses {
+		if n <= c.maxKeep {
+			return c
+		}
+	}
+	return bufClasses[len(bufClasses)-1]
+}
+
+// getBuf returns an empty buffer grown to hint bytes. hint <= 0 means the
+// size is unknown and the recent-size percentile is used instead.
+func getBuf(hint int) *bytes.Buffer {
+	if hint <= 0 {
+		hint = sizeHist.preGrow()
+	}
+	c := classFor(hint)
+	c.gets.Add(1)
+	b, _ := c.pool.Get().(*bytes.Buffer)
+	if b == nil {
+		c.news.Add(1)
+		b = new(bytes.Buffer)
+	}
+	b.Reset()
+	if hint <= largeKeepCap {
+		b.Grow(hint)
+	}
+	return b
+}
+
+func putBuf(b *bytes.Buffer) {
+	c := classFor(b.Cap())
+	if b.Cap() > c.maxKeep {
+		bufDiscards.Add(1)
+		return
+	}
+	c.puts.Add(1)
+	b.Reset()
+	c.pool.Put(b)
+}
+
+type pooledBody struct {
+	r     *bytes.Reader
+	b     *bytes.Buffer
+	lease budgetLease
+}
+
+func (p *pooledBody) Read(x []byte) (int, error) { return p.r.Read(x) }
+func (p *pooledBody) Close() error {
+	if p.b != nil {
+		putBuf(p.b)
+		p.b = nil
+		p.lease.release()
+	}
+	return nil
+}
+
+type proxyBufPool struct{}
+
+func (proxyBufPool) Get() []byte {
+	copyCounts.gets.Add(1)
+	return copyPool.Get().([]byte)
+}
+
+func (proxyBufPool) Put(p []byte) {
+	if cap(p) > maxKeepCopyCap || cap(p) < copyBufSize {
+		copyCounts.discards.Add(1)
+		return
+	}
+	copyCounts.puts.Add(1)
+	copyPool.Put(p[:copyBufSize])
+}
+
+// gzipReader is a pooled gzip decoder together with the buffered reader
+// it reads its source through, which replaces the bufio.Reader gzip would
+// allocate on every Reset and can put back what a failed Reset read.
+type gzipReader struct {
+	gzip.Reader
+	src rewindReader
+}
+
+// getGzipReader returns a pooled reader decoding r. A Reset failing (a
+// source read error, or a header that doesn't parse) is retried once on
+// the same reader from the first byte, which gets past a source whose
+// read failed once. When that fails too the reader goes back to the pool
+// and rest is r as it was, nothing read from it lost, for the caller to
+// forward instead.
+func getGzipReader(r io.Reader) (zr *gzipReader, rest io.Reader, err error) {
+	zr, _ = gzipPool.Get().(*gzipReader)
+	if zr != nil {
+		gzipCounts.hits.Add(1)
+	} else {
+		gzipCounts.misses.Add(1)
+		zr = new(gzipReader)
+	}
+	zr.src.start(r)
+	if err = zr.Reader.Reset(&zr.src); err != nil {
+		gzipCounts.resetFailures.Add(1)
+		zr.src.rewind()
+		if err = zr.Reader.Reset(&zr.src); err == nil {
+			gzipCounts.recovered.Add(1)
+		}
+	}
+	if err != nil {
+		// no Close: a reader that never reset has no decompressor
+		rest = zr.src.unread()
+		recycleGzipReader(zr)
+		return nil, rest, err
+	}
+	zr.src.mark = false
+	return zr, nil, nil
+}
+
+func putGzipReader(zr *gzipReader) {
+	_ = zr.Close()
+	recycleGzipReader(zr)
+}
+
+func recycleGzipReader(zr *gzipReader) {
+	zr.src.release()
+	gzipCounts.puts.Add(1)
+	gzipPool.Put(zr)
+}
+
+const (
+	rewindBufSize = 4 << 10
+	maxRewindKeep = 64 << 10 // a larger buffer (a huge gzip header) is dropped
+)
+
+// rewindReader buffers reads of src like a bufio.Reader. While mark is
+// set nothing it buffered is discarded, so rewind can start over from the
+// first byte read.
+type rewindReader struct {
+	src  io.Reader
+	buf  []byte
+	r, w int // read and write offsets in buf
+	err  error
+	mark bool
+}
+
+func (b *rewindReader) start(src io.Reader) {
+	if b.buf == nil {
+		b.buf = make([]byte, rewindBufSize)
+	}
+	b.src, b.r, b.w, b.err, b.mark = src, 0, 0, nil, true
+}
+
+// rewind goes back to the first byte read; a read error of src is
+// forgotten so it is tried again.
+func (b *rewindReader) rewind() { b.r, b.err = 0, nil }
+
+// unread is src with everything read from it put back in front.
+func (b *rewindReader) unread() io.Reader {
+	if b.w == 0 {
+		return b.src
+	}
+	return io.MultiReader(bytes.NewReader(bytes.Clone(b.buf[:b.w])), b.src)
+}
+
+// release drops src, keeping buf for the next start.
+func (b *rewindReader) release() {
+	b.src, b.r, b.w, b.err = nil, 0, 0, nil
+	if cap(b.buf) > maxRewindKeep {
+		b.buf = nil
+	}
+}
+
+// fill reads more of src into buf, growing it while mark is set.
+func (b *rewindReader) fill() {
+	if !b.mark && b.r == b.w {
+		b.r, b.w = 0, 0
+	}
+	if b.w == len(b.buf) {
+		b.buf = slices.Grow(b.buf, len(b.buf))[:2*len(b.buf)]
+	}
+	for range 100 {
+		n, err := b.src.Read(b.buf[b.w:])
+		b.w += n
+		if err != nil {
+			b.err = err
+			return
+		}
+		if n > 0 {
+			return
+		}
+	}
+	b.err = io.ErrNoProgress
+}
+
+func (b *rewindReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if b.r == b.w {
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.fill()
+		if b.r == b.w {
+			return 0, b.err
+		}
+	}
+	n := copy(p, b.buf[b.r:b.w])
+	b.r += n
+	return n, nil
+}
+
+func (b *rewindReader) ReadByte() (byte, error) {
+	if b.r == b.w {
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.fill()
+		if b.r == b.w {
+			return 0, b.err
+		}
+	}
+	c := b.buf[b.r]
+	b.r++
+	return c, nil
+}
+
+// bodySizeHist tracks sizes of buffered bodies: a bucketed histogram for
+// stats and a ring of recent sizes whose percentile drives pre-grow.
+type bodySizeHist struct {
+	buckets [sizeBuckets + 1]atomic.Int64
+
+	mu   sync.Mutex
+	ring [sizeRingLen]int
+	n    int // total observations, ring index is n % sizeRingLen
+	pct  atomic.Int64
+}
+
+func sizeBucket(n int) int {
+	// bucket 0: <=1KB, bucket i: <=1KB<<i, last bucket: everything above
+	i := 0
+	if n > 1<<10 {
+		i = bits.Len(uint(n-1)) - 10
+	}
+	return min(i, sizeBuckets)
+}
+
+func (h *bodySizeHist) observe(n int) {
+	h.buckets[sizeBucket(n)].Add(1)
+
+	h.mu.Lock()
+	h.ring[h.n%sizeRingLen] = n
+	h.n++
+	if h.n%sizeRecalcEvery == 0 || h.n == 1 {
+		cnt := min(h.n, sizeRingLen)
+		tmp := make([]int, cnt)
+		copy(tmp, h.ring[:cnt])
+		slices.Sort(tmp)
+		h.pct.Store(int64(tmp[(cnt-1)*sizePercentile/100]))
+	}
+	h.mu.Unlock()
+}
+
+// preGrow is the pre-grow size for bodies of unknown length.
+func (h *bodySizeHist) preGrow() int {
+	if p := int(h.pct.Load()); p > 0 {
+		return min(p, largeKeepCap)
+	}
+	return preGrow
+}
+
+func bufPoolStats() any {
+	classes := make(map[string]any, len(bufClasses))
+	for _, c := range bufClasses {
+		classes[c.name] = map[string]int64{
+			"max_keep": int64(c.maxKeep),
+			"gets":     c.gets.Load(),
+			"news":     c.news.Load(),
+			"puts":     c.puts.Load(),
+		}
+	}
+	hist := make(map[string]int64, sizeBuckets+1)
+	for i := range sizeBuckets {
+		hist["le_"+sizeLabel(1<<(10+i))] = sizeHist.buckets[i].Load()
+	}
+	hist["gt_"+sizeLabel(1<<(10+sizeBuckets-1))] = sizeHist.buckets[sizeBuckets].Load()
+	return map[string]any{
+		"classes": classes,
+		// buffers grown past the large class's max_keep
+		"discards":          bufDiscards.Load(),
+		"discards_max_keep": largeKeepCap,
+		"pregrow":           sizeHist.preGrow(),
+		"size_histogram":    hist,
+	}
+}
+
+// copyPoolStats is the "copypool" section: the response copy buffers.
+func copyPoolStats() any {
+	return map[string]any{
+		"buffer_size": copyBufSize,
+		"gets":        copyCounts.gets.Load(),
+		"news":        copyCounts.news.Load(),
+		"puts":        copyCounts.puts.Load(),
+		// over discards_max_keep, or shrunk below buffer_size
+		"discards":          copyCounts.discards.Load(),
+		"discards_max_keep": maxKeepCopyCap,
+	}
+}
+
+// gzipPoolStats is the "gzip_readers" section: decoders of gzip request
+// and response bodies. A miss allocates a reader; a reset failure is a
+// body whose gzip header didn't parse or couldn't be read, recovered when
+// the retry from the first byte got past it.
+func gzipPoolStats() any {
+	return map[string]any{
+		"hits":           gzipCounts.hits.Load(),
+		"misses":         gzipCounts.misses.Load(),
+		"reset_failures": gzipCounts.resetFailures.Load(),
+		"recovered":      gzipCounts.recovered.Load(),
+		"puts":           gzipCounts.puts.Load(),
+	}
+}
+
+func sizeLabel(n int) string {
+	if n >= 1<<20 {
+		return strconv.Itoa(n>>20) + "MB"
+	}
+	return strconv.Itoa(n>>10) + "KB"
+}
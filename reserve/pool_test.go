@@ -0,0 +1,183 @@
+package reserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestClassFor(t *testing.T) {
+	for _, tc := range []struct {
+		n    int
+		want string
+	}{
+		{0, "small"}, {smallKeepCap, "small"}, {smallKeepCap + 1, "medium"},
+		{maxKeepBufCap, "medium"}, {maxKeepBufCap + 1, "large"}, {largeKeepCap * 2, "large"},
+	} {
+		if got := classFor(tc.n).name; got != tc.want {
+			t.Errorf("classFor(%d) = %s, want %s", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestGetBufGrows(t *testing.T) {
+	for _, hint := range []int{1, 4 << 10, smallKeepCap + 1, maxKeepBufCap + 1} {
+		b := getBuf(hint)
+		if b.Len() != 0 || b.Cap() < hint {
+			t.Errorf("getBuf(%d): len %d cap %d", hint, b.Len(), b.Cap())
+		}
+		b.WriteString("leftover")
+		putBuf(b)
+	}
+	if b := getBuf(16); b.Len() != 0 {
+		t.Errorf("pooled buffer came back holding %q", b.Bytes())
+	}
+}
+
+func TestPutBufDiscardsHuge(t *testing.T) {
+	before := bufDiscards.Load()
+	putBuf(bytes.NewBuffer(make([]byte, 0, largeKeepCap+1)))
+	if bufDiscards.Load() != before+1 {
+		t.Error("a buffer over the large class's max keep was pooled")
+	}
+}
+
+func TestSizeBucket(t *testing.T) {
+	for _, tc := range []struct{ n, want int }{
+		{0, 0}, {1 << 10, 0}, {1<<10 + 1, 1}, {2 << 10, 1}, {1 << 20, 10}, {32 << 20, 15}, {64 << 20, 16}, {1 << 40, 16},
+	} {
+		if got := sizeBucket(tc.n); got != tc.want {
+			t.Errorf("sizeBucket(%d) = %d, want %d", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestRewindReader(t *testing.T) {
+	var b rewindReader
+	b.start(strings.NewReader("hello, world"))
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(&b, head); err != nil || string(head) != "hello" {
+		t.Fatalf("read %q, %v", head, err)
+	}
+	b.rewind()
+	all, err := io.ReadAll(&b)
+	if err != nil || string(all) != "hello, world" {
+		t.Errorf("after rewind read %q, %v", all, err)
+	}
+	b.release()
+}
+
+func TestGetGzipReaderNotGzip(t *testing.T) {
+	// drain the pool so the reader is a new one, never reset
+	for zr, _ := gzipPool.Get().(*gzipReader); zr != nil; zr, _ = gzipPool.Get().(*gzipReader) {
+	}
+	const body = `{"input":"hi"}`
+	for range 2 {
+		zr, rest, err := getGzipReader(strings.NewReader(body))
+		if err == nil {
+			putGzipReader(zr)
+			t.Fatal("getGzipReader accepted a body that is not gzip")
+		}
+		if got, _ := io.ReadAll(rest); string(got) != body {
+			t.Errorf("rest = %q, want %q", got, body)
+		}
+	}
+}
+
+// flakyReader returns the first n bytes of r with err, once, then reads r
+// on.
+type flakyReader struct {
+	r      io.Reader
+	n      int
+	err    error
+	failed bool
+}
+
+func (f *flakyReader) Read(p []byte) (int, error) {
+	if f.failed {
+		return f.r.Read(p)
+	}
+	f.failed = true
+	n, _ := io.ReadFull(f.r, p[:min(f.n, len(p))])
+	return n, f.err
+}
+
+func TestGetGzipReaderReadErrorOnce(t *testing.T) {
+	const body = `{"input":"hi","model":"gpt-5"}`
+	var zb bytes.Buffer
+	zw := gzip.NewWriter(&zb)
+	io.WriteString(zw, body)
+	zw.Close()
+	flaky := errors.New("connection reset, once")
+
+	for _, tc := range []struct {
+		name   string
+		src    io.Reader
+		failed bool // whether the first Reset fails
+	}{
+		{"error before any byte", &flakyReader{r: bytes.NewReader(zb.Bytes()), err: flaky}, true},
+		{"error inside the header", &flakyReader{r: bytes.NewReader(zb.Bytes()), n: 5, err: flaky}, true},
+		{"one byte at a time", iotest.OneByteReader(bytes.NewReader(zb.Bytes())), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			failures, recovered := gzipCounts.resetFailures.Load(), gzipCounts.recovered.Load()
+			zr, _, err := getGzipReader(tc.src)
+			if err != nil {
+				t.Fatalf("getGzipReader: %v", err)
+			}
+			got, err := io.ReadAll(zr)
+			putGzipReader(zr)
+			if err != nil || string(got) != body {
+				t.Errorf("decoded %q, %v, want %q", got, err, body)
+			}
+			if tc.failed && (gzipCounts.resetFailures.Load() != failures+1 || gzipCounts.recovered.Load() != recovered+1) {
+				t.Error("the failed Reset was not counted as a failure recovered")
+			}
+		})
+	}
+}
+
+func TestGetGzipReaderReadErrorTwice(t *testing.T) {
+	// a source failing on every read: the error comes back, and rest has
+	// the bytes read before it
+	src := io.MultiReader(strings.NewReader("\x1f\x8b"), iotest.ErrReader(errors.New("gone")))
+	zr, rest, err := getGzipReader(src)
+	if err == nil {
+		putGzipReader(zr)
+		t.Fatal("getGzipReader succeeded on a broken source")
+	}
+	got, err := io.ReadAll(rest)
+	if string(got) != "\x1f\x8b" || err == nil {
+		t.Errorf("rest read %q, %v, want the 2 bytes then the source's error", got, err)
+	}
+}
+
+func TestGzipReaderPooled(t *testing.T) {
+	var zb bytes.Buffer
+	zw := gzip.NewWriter(&zb)
+	io.WriteString(zw, "x")
+	zw.Close()
+	zr, _, err := getGzipReader(bytes.NewReader(zb.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(zr)
+	putGzipReader(zr)
+	hits := gzipCounts.hits.Load()
+	zr2, _, err := getGzipReader(bytes.NewReader(zb.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer putGzipReader(zr2)
+	// sync.Pool may drop what it holds, so one miss is no failure
+	if zr2 == zr && gzipCounts.hits.Load() != hits+1 {
+		t.Error("reader taken from the pool not counted as a hit")
+	}
+	if got, _ := io.ReadAll(zr2); string(got) != "x" {
+		t.Errorf("pooled reader decoded %q", got)
+	}
+}
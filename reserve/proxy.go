@@ -0,0 +1,705 @@
+// Package reserve is the request rewriting reverse proxy behind rc-proxy.
+//
+// A Rewriter rewrites OpenAI Responses API request bodies in place and can
+// be embedded in any handler chain; a Proxy is a complete http.Handler that
+// rewrites and forwards to an upstream, with the timeouts, limits and the
+// /_reserve/stats endpoint of the standalone binary.
+package reserve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Proxy rewrites requests with its Rewriter and forwards them to
+// Options.Target. Paths under /_reserve/ are its own: stats are served,
+// the rest, the admin API's (see AdminHandler), answered 404.
+type Proxy struct {
+	opts      Options
+	target    *url.URL
+	transport http.RoundTripper
+	rewriter  *Rewriter
+	rp        *httputil.ReverseProxy
+
+	stats       statsRegistry
+	config      statsRegistry // admin config endpoint sections
+	passthrough *passthroughCounts
+	routes      *routeCounts
+	background  *backgroundTracker
+	dedup       *dedupGroup       // nil unless Options.Dedup
+	idempotency *idempotencyCache // nil when Options.IdempotencyTTL is 0
+	getCache    *getCache         // nil when Options.GetCacheTTL is 0
+	limiter     *upstreamLimiter  // nil unless an upstream concurrency is set
+	rate        *rateLimiter      // nil without Options.RateLimit
+	costs       *costTracker      // nil without Options.Prices
+	urls        *publicURLs       // nil without Options.PublicURL
+	flush       *flushPolicy      // nil with a negative Options.FlushInterval
+	gzip        *upstreamGzip     // nil without Options.UpstreamGzip
+	notify      *notifier         // nil without Options.NotifyURL
+	watchdog    *watchdog         // nil without Options.ProfileDir
+	export      *usageExport      // nil without Options.UsageExport
+	faults      *faultInjector    // nil without Options.FaultInjection
+	keepWarm    *keepWarm         // nil without Options.KeepWarmConns
+	capture     *capture          // nil without Options.CaptureDir
+	fallback    *modelFallback    // nil without Options.ModelFallbacks
+	auth        *authGate         // nil without Options.RequireAuth
+	connLimit   *connLimiter      // nil without Options.MaxConns or MaxConnsPerIP
+	h2retry     *h2Retry          // nil with Options.H2Retries 0; wraps transport
+	sizeCaps    *responseCaps     // nil without Options.MaxResponseBytes or MaxStreamBytes
+	phases      *phaseTimeouts    // see timeout.go
+	quotas      *quotaTracker     // nil without Options.Quotas
+	balance     *balancer         // nil without Options.Upstreams
+	dropHeaders []string          // Options.DropHeaders, canonical
+	conns       *connStats
+	upstreamTLS *upstreamTLS
+	tokens      *tokenEstimates
+	wide        wideCounts
+	traces      traceCounts
+	store       atomic.Pointer[persister] // nil unless AttachStore
+	storeLoaded atomic.Bool
+	streamEnds  streamEndCounts
+	// upstream responses by whether the request was rewritten
+	upstreamErrors upstreamErrorCounts
+	headerLimits   headerLimitCounts
+	acceptEncoding acceptEncodingCounts
+	midstream      midstreamCounts
+	requestIDs     requestIDCounts
+	rlHeaders      rateLimitHeaderCounts // see ratelimitheaders.go
+	respHeaders    responseHeaderCounts  // see respheaders.go
+	timeouts       struct {
+		request        atomic.Int64
+		streamIdle     atomic.Int64
+		dial           atomic.Int64
+		tls            atomic.Int64
+		responseHeader atomic.Int64
+	}
+}
+
+// NewProxy builds a Proxy for opts.Target.
+func NewProxy(opts Options) (*Proxy, error) {
+	tu, err := url.Parse(opts.Target)
+	if err != nil {
+		return nil, err
+	}
+	if tu.Scheme == "" || tu.Host == "" {
+		return nil, errors.New("reserve: target must be an absolute URL")
+	}
+	if opts.CanonicalJSON && opts.MinimalDiff {
+		return nil, errCanonicalMinimalDiff
+	}
+	if opts.Policy != nil {
+		if err := opts.Policy.Validate(); err != nil {
+			return nil, fmt.Errorf("reserve: policy: %w", err)
+		}
+	}
+	if opts.ResponseHeaders != nil {
+		if err := opts.ResponseHeaders.Validate(); err != nil {
+			return nil, fmt.Errorf("reserve: response headers: %w", err)
+		}
+	}
+	tokens, err := newTokenEstimates(opts)
+	if err != nil {
+		return nil, err
+	}
+	if tokens.bpe != nil {
+		opts.TokenEstimate = tokens.bpe.Count
+	}
+
+	p := &Proxy{
+		opts:        opts,
+		target:      tu,
+		transport:   opts.Transport,
+		rewriter:    NewRewriter(opts),
+		passthrough: newPassthroughCounts(),
+		routes:      newRouteCounts(),
+		background:  newBackgroundTracker(),
+		dedup:       newDedupGroup(opts),
+		idempotency: newIdempotencyCache(opts),
+		limiter:     newUpstreamLimiter(opts),
+		rate:        newRateLimiter(opts),
+		fallback:    newModelFallback(opts),
+		costs:       newCostTracker(opts),
+		dropHeaders: newDropHeaders(opts),
+		connLimit:   newConnLimiter(opts),
+		upstreamTLS: newUpstreamTLS(),
+		tokens:      tokens,
+		faults:      newFaultInjector(opts),
+	}
+	p.conns = &connStats{certs: p.upstreamTLS}
+	p.flush = newFlushPolicy(opts)
+	if p.auth, err = newAuthGate(opts); err != nil {
+		return nil, err
+	}
+	if p.sizeCaps, err = newResponseCaps(opts); err != nil {
+		return nil, err
+	}
+	if p.phases, err = newPhaseTimeouts(opts); err != nil {
+		return nil, err
+	}
+	if err := checkRateLimitHeaders(opts.RateLimitHeaders); err != nil {
+		return nil, err
+	}
+	if err := checkValidateRoutes(opts.ValidateRoutes); err != nil {
+		return nil, err
+	}
+	if p.quotas, err = newQuotaTracker(opts); err != nil {
+		return nil, err
+	}
+	if p.balance, err = newBalancer(opts, tu); err != nil {
+		return nil, err
+	}
+	if p.getCache, err = newGetCache(opts); err != nil {
+		return nil, err
+	}
+	if p.gzip, err = newUpstreamGzip(opts); err != nil {
+		return nil, err
+	}
+	if p.urls, err = newPublicURLs(opts, tu); err != nil {
+		return nil, err
+	}
+	if p.notify, err = newNotifier(opts); err != nil {
+		return nil, err
+	}
+	if p.export, err = newUsageExport(opts); err != nil {
+		return nil, err
+	}
+	if p.capture, err = newCapture(opts); err != nil {
+		return nil, err
+	}
+	p.watchdog = newWatchdog(p, opts)
+	if p.transport == nil {
+		p.transport = &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			MaxIdleConns:          4096,
+			MaxIdleConnsPerHost:   4096,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   p.phases.transport.TLSHandshake,
+			ResponseHeaderTimeout: p.phases.transport.ResponseHeader,
+			ExpectContinueTimeout: 1 * time.Second,
+			ForceAttemptHTTP2:     true,
+			DialContext: p.conns.dial((&net.Dialer{
+				Timeout:   p.phases.transport.Dial,
+				KeepAlive: 30 * time.Second,
+			}).DialContext),
+		}
+	}
+
+	var idle time.Duration
+	if t, ok := p.transport.(*http.Transport); ok {
+		idle = t.IdleConnTimeout
+	}
+	if p.h2retry = newH2Retry(opts, p.transport); p.h2retry != nil {
+		p.transport = p.h2retry
+	}
+	if p.keepWarm, err = newKeepWarm(p, opts, idle); err != nil {
+		return nil, err
+	}
+
+	rp := &httputil.ReverseProxy{}
+	rp.BufferPool = proxyBufPool{}
+	rp.FlushInterval = -1 // 立即刷新，SSE/流式响应必需；其余响应由 flushWriter 合并
+	next := p.transport
+	if len(p.phases.routes) > 0 {
+		next = &phaseTransport{next: next, phases: p.phases}
+	}
+	rp.Transport = &disconnectTransport{next: next, rr: p.rewriter}
+
+	// 自定义错误处理：客户端主动断开是正常行为，不记录为错误
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if p.failStarted(w, r, err) {
+			return
+		}
+		if he, ok := err.(*httpError); ok {
+			// a response hook aborted
+			writeHTTPError(w, he)
+			return
+		}
+		st := stateOf(r.Context())
+		if context.Cause(r.Context()) == errRequestTimeout {
+			logOf(r.Context()).Warn("upstream request timeout", "timeout", opts.RequestTimeout)
+			if st != nil {
+				st.trace.log("upstream_timeout", "timeout", opts.RequestTimeout)
+			}
+			p.upstreamResult(st, true)
+			writeHTTPError(w, errGatewayTimeout)
+			return
+		}
+		if phase := phaseTimeout(r.Context(), err); phase != "" {
+			p.failPhaseTimeout(w, r, phase, err)
+			return
+		}
+		if r.Context().Err() != nil {
+			// context canceled 或 deadline exceeded - 客户端已断开，静默处理
+			if st != nil {
+				st.wide.fail("client_disconnect", err.Error())
+				st.trace.log("client_disconnect", "error", err)
+			}
+			return
+		}
+		if p.upstreamTLS.failed(r.Context(), err) {
+			if st != nil {
+				st.wide.fail("upstream_tls_error", err.Error())
+				st.trace.log("upstream_tls_error", "error", err)
+			}
+			p.upstreamResult(st, true)
+			writeHTTPError(w, errUpstreamTLS)
+			return
+		}
+		logOf(r.Context()).Error("proxy error", "error", err)
+		if st != nil {
+			st.wide.fail("upstream_error", err.Error())
+			st.trace.log("upstream_error", "error", err)
+		}
+		p.upstreamResult(st, true)
+		writeHTTPError(w, errBadGateway)
+	}
+
+	rp.ModifyResponse = func(resp *http.Response) error {
+		p.passthrough.countTrailers(resp)
+		st := stateOf(resp.Request.Context())
+		p.upstreamResult(st, resp.StatusCode >= 500)
+		if st != nil {
+			markUpstreamRequestID(resp, st.id)
+			if err := p.decodeResponse(resp, st); err != nil {
+				return err
+			}
+			p.filterResponseHeaders(resp, st)
+		}
+		if st != nil {
+			st.wide.upstreamResponse(resp.StatusCode)
+			st.trace.log("upstream_response", "status", resp.StatusCode,
+				"content_type", resp.Header.Get("Content-Type"), "content_length", resp.ContentLength,
+				"content_encoding", resp.Header.Get("Content-Encoding"), "proto", resp.Proto)
+		}
+		if st != nil && st.conn != nil && st.log.Enabled(resp.Request.Context(), slog.LevelDebug) {
+			st.log.Debug("upstream responded", "target", p.targetOf(st).Host, "status", resp.StatusCode,
+				"ttfb", st.conn.serverTime(), "ttfb_ewma", p.ttfbEWMA(st).Round(time.Microsecond))
+		}
+		if p.opts.ConnTraceHeader && st != nil && st.conn != nil {
+			resp.Header.Set(connTraceHeader, st.conn.header())
+		}
+		if st != nil {
+			p.setEstimateHeader(resp.Header, st)
+		}
+		if st != nil && st.route != nil {
+			if err := p.runResponseHooks(resp, st); err != nil {
+				return err
+			}
+			if p.fallback != nil && p.retryFallback(resp, st) {
+				if err := p.decodeResponse(resp, st); err != nil {
+					return err
+				}
+				p.filterResponseHeaders(resp, st)
+				if err := p.runResponseHooks(resp, st); err != nil {
+					return err
+				}
+			}
+			if st.route.rewrite {
+				p.diagnoseUpstreamError(resp, st)
+			}
+			// below the idle timeout, so it sees the stream's real end
+			if resp.StatusCode == http.StatusOK && isEventStream(resp) {
+				p.watchStream(resp, st)
+			}
+			// background responses are priced once terminal, see attributeUsage
+			if st.route.usage || (p.costs != nil || p.quotas != nil || st.wide != nil || p.export != nil || p.tokens.enabled) && st.route.rewrite && !st.background {
+				p.logUsage(resp, st)
+			}
+			if p.rate != nil || p.quotas != nil {
+				p.setRateLimitHeaders(resp, st)
+			}
+			if st.route.background {
+				if st.route.rewrite {
+					if st.background {
+						p.backgroundCreated(resp, st)
+					}
+				} else {
+					p.backgroundPolled(resp, st)
+				}
+			}
+		}
+		p.applyStreamTimeout(resp)
+		if st != nil {
+			// in the Responses shape, the same as the request
+			p.capture.watch(resp, st)
+		}
+		// after the idle timeout, so its error event is translated too
+		if st != nil && st.route != nil && st.route.chat {
+			if err := p.translateChatResponse(resp, st); err != nil {
+				return err
+			}
+		}
+		// last, on the body the client gets
+		if err := p.capResponse(resp, st); err != nil {
+			return err
+		}
+		if st != nil {
+			p.injectResponseFault(resp, st)
+		}
+		return nil
+	}
+
+	rp.Director = func(r *http.Request) {
+		p.direct(r)
+		p.normalizeHeaders(r)
+		p.forwardRequestID(r)
+		p.advertiseGzip(r)
+	}
+	p.rp = rp
+
+	startMemSampler()
+	p.rewriter.registerStats(&p.stats)
+	p.stats.register("accept_encoding", p.acceptEncodingStats)
+	p.stats.register("auth", p.auth.stats)
+	p.stats.register("background", p.backgroundStats)
+	p.stats.register("balance", p.balanceStats)
+	p.stats.register("bufpool", bufPoolStats)
+	p.stats.register("capture", p.captureStats)
+	p.stats.register("client_conns", p.clientConnStats)
+	p.stats.register("copypool", copyPoolStats)
+	p.stats.register("gzip_readers", gzipPoolStats)
+	p.stats.register("gc", gcStats)
+	p.stats.register("get_cache", p.getCacheStats)
+	p.stats.register("h2_retry", p.h2retry.stats)
+	p.stats.register("cost", p.costStats)
+	p.stats.register("dedup", p.dedupStats)
+	p.stats.register("faults", p.faultStats)
+	p.stats.register("header_limits", p.headerLimitStats)
+	p.stats.register("idempotency", p.idempotencyStats)
+	p.stats.register("keep_warm", p.keepWarmStats)
+	p.stats.register("upstream_errors", p.upstreamErrorStats)
+	p.stats.register("upstream_queue", p.upstreamQueueStats)
+	p.stats.register("usage_export", p.usageExportStats)
+	p.stats.register("watchdog", p.watchdogStats)
+	p.stats.register("memory", memStats)
+	p.stats.register("model_fallback", p.modelFallbackStats)
+	p.stats.register("notify", p.notifyStats)
+	p.stats.register("passthrough", p.passthrough.stats)
+	p.stats.register("rate_limit", p.rateLimitStats)
+	p.stats.register("ratelimit_headers", p.rateLimitHeaderStats)
+	p.stats.register("request_id", p.requestIDStats)
+	p.stats.register("response_headers", p.responseHeaderStats)
+	p.stats.register("response_caps", p.sizeCaps.stats)
+	p.stats.register("public_urls", p.publicURLStats)
+	p.stats.register("quotas", p.quotaStats)
+	p.stats.register("flush", p.flushStats)
+	p.stats.register("upstream_gzip", p.upstreamGzipStats)
+	p.stats.register("upstream_conns", p.upstreamConnStats)
+	p.stats.register("upstream_tls", p.upstreamTLSStats)
+	p.stats.register("routes", p.routes.stats)
+	p.stats.register("store", p.storeStats)
+	p.stats.register("stream_sniff", streamSniffStats)
+	p.stats.register("streams", p.streamStats)
+	p.stats.register("midstream", p.midstreamStats)
+	p.stats.register("timeouts", p.timeoutStats)
+	p.stats.register("token_estimate", p.tokenEstimateStats)
+	p.stats.register("trace", p.traceStats)
+	p.stats.register("wide_events", p.wideStats)
+	p.stats.register("build", func() any { return Build() })
+
+	p.config.register("options", func() any { return optionsView(p.opts) })
+	p.config.register("runtime", func() any { return p.rewriter.Runtime() })
+	p.config.register("schema", func() any {
+		return map[string]any{"version": responsesSchemaVersion, "routes": p.rewriter.validateRoutes()}
+	})
+	return p, nil
+}
+
+// Rewriter returns the Rewriter p rewrites requests with.
+func (p *Proxy) Rewriter() *Rewriter { return p.rewriter }
+
+// RegisterStats adds a section to p's stats endpoint, replacing any section
+// of the same name. fn is called on every stats request.
+func (p *Proxy) RegisterStats(name string, fn func() any) { p.stats.register(name, fn) }
+
+// Stats returns the sections served at /_reserve/stats.
+func (p *Proxy) Stats() map[string]any { return p.stats.snapshot() }
+
+// RegisterConfig adds a section to the admin config endpoint, replacing any
+// section of the same name; embedders use it for settings outside Options.
+// Keep credentials in Secret-typed fields so they are fingerprinted.
+func (p *Proxy) RegisterConfig(name string, fn func() any) { p.config.register(name, fn) }
+
+// Config returns the sections served at /_reserve/config.
+func (p *Proxy) Config() map[string]any { return p.config.snapshot() }
+
+// Close stops the keep-warm keeper, once a round under way is done; the
+// queues CloseCapture and CloseUsageExport write out are left to them.
+// Call it once p serves no more requests.
+func (p *Proxy) Close() { p.keepWarm.close() }
+
+// upstreamResult counts one upstream outcome into the error rates the
+// notifier alerts on and the keep-warm keeper stands down on, and into the
+// health of st's upstream when balancing.
+func (p *Proxy) upstreamResult(st *reqState, err bool) {
+	p.notify.upstreamResult(err)
+	p.keepWarm.upstreamResult(err)
+	if st != nil && st.upstream != nil {
+		st.upstream.result(err)
+	}
+}
+
+// ServeHTTP rewrites and forwards r. The body rewrite runs here rather than
+// in the Director so it can answer the request itself (e.g. 503 when the
+// body budget is exhausted).
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.opts.VersionHeader {
+		w.Header().Set("X-Reserve-Version", Build().Version)
+	}
+	if r.URL.Path == statsPath {
+		p.stats.ServeHTTP(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, reservePrefix) {
+		// the rest of /_reserve/ is the admin API's, never served here
+		// (whatever the listener) nor forwarded
+		writeHTTPError(w, errNotFound)
+		return
+	}
+
+	r, st := p.withReqState(r)
+	defer st.finish()
+	w.Header().Set(requestIDHeader, st.id)
+	if st.trace = p.startTrace(w, r, st); st.trace != nil {
+		defer st.trace.log("done")
+	}
+	if st.wide != nil {
+		w = &wideWriter{ResponseWriter: w, e: st.wide}
+		defer func() { p.writeWide(r, st) }()
+	}
+	if st.rt.Maintenance {
+		st.trace.log("maintenance")
+		writeHTTPError(w, errMaintenance)
+		return
+	}
+	if he := connRefusal(r.Context()); he != nil {
+		st.trace.log("client_conns", "refused", true, "code", he.code)
+		r.Body.Close()
+		w.Header().Set("Connection", "close")
+		writeHTTPError(w, he)
+		return
+	}
+	if p.opts.BodyReadTimeout > 0 {
+		st.rc = http.NewResponseController(w)
+	}
+	if he := p.checkHeaders(r); he != nil {
+		st.trace.log("header_limits", "refused", true, "error", he.msg)
+		r.Body.Close()
+		writeHTTPError(w, he)
+		return
+	}
+	r = p.passthrough.withTrace(r)
+	r = p.conns.withTrace(r, st)
+
+	rr := p.rewriter
+	st.path = r.URL.Path
+	st.route = rr.matchRoute(r.Method, r.URL.Path)
+	if st.route != nil {
+		p.routes.request(st.route)
+		if st.route.identify {
+			st.client = rr.resolveClient(r)
+		}
+		if slog.Default().Enabled(r.Context(), slog.LevelDebug) {
+			remote, _ := rr.remoteAddr(r)
+			client := ""
+			if st.client != nil {
+				client = st.client.CacheKey
+			}
+			st.log.Debug("request routed", "method", r.Method, "path", r.URL.Path,
+				"route", st.route.name, "features", st.route.features(), "client", client,
+				"remote", remote)
+		}
+	}
+	if st.trace != nil {
+		attrs := []any{"route", "", "target", p.target.Host}
+		if st.route != nil {
+			attrs[1] = st.route.name
+			attrs = append(attrs, "features", st.route.features())
+		}
+		if st.client != nil {
+			attrs = append(attrs, "client", st.client.CacheKey, "client_source", st.client.Source)
+		}
+		st.trace.log("route", attrs...)
+	}
+	if st.route == nil {
+		if rt, he := rr.methodRefusal(r.Method, r.URL.Path); he != nil {
+			p.routes.m[rt.name].refused.Add(1)
+			st.log.Info("request refused, method not allowed", "method", r.Method, "path", r.URL.Path,
+				"route", rt.name, "allow", he.allow)
+			st.trace.log("method_refused", "method", r.Method, "route", rt.name, "allow", he.allow)
+			r.Body.Close()
+			writeHTTPError(w, he)
+			return
+		}
+	}
+	if st.route != nil {
+		if err := p.auth.check(rr, st.route, r); err != nil {
+			st.trace.log("auth", "refused", true)
+			r.Body.Close()
+			writeHTTPError(w, err.(*httpError))
+			return
+		}
+	}
+	if p.costs != nil && st.route != nil && (st.route.rewrite || st.route.usage) {
+		if err := p.costs.admit(st.client); err != nil {
+			st.log.Info("cost: request refused, monthly budget spent", "route", st.route.name, "client", st.client.CacheKey)
+			st.trace.log("cost", "refused", true)
+			r.Body.Close()
+			writeHTTPError(w, err.(*httpError))
+			return
+		}
+	}
+	if p.quotas != nil && st.route != nil && st.client != nil && (st.route.rewrite || st.route.usage) {
+		remaining, he := p.quotas.admit(st.client.CacheKey)
+		if he != nil {
+			st.log.Info("quota: request refused", "route", st.route.name, "client", st.client.CacheKey, "retry_after", he.retryAfter)
+			st.trace.log("quota", "refused", true, "error", he.msg)
+			r.Body.Close()
+			writeHTTPError(w, he)
+			return
+		}
+		for _, v := range remaining {
+			w.Header().Add(quotaRemainingHeader, v)
+		}
+		if remaining != nil {
+			st.trace.log("quota", "remaining", remaining)
+		}
+	}
+	// ahead of the body read, so a shed request costs next to nothing
+	if p.rate != nil && st.route != nil && st.route.rewrite {
+		waited, err := p.rate.wait(r.Context())
+		st.trace.log("rate_limit", "waited", waited, "error", err)
+		if err != nil {
+			r.Body.Close()
+			if he, ok := err.(*httpError); ok {
+				st.log.Info("rate limit: request shed", "route", st.route.name, "retry_after", he.retryAfter)
+				writeHTTPError(w, he)
+			} else {
+				st.wide.fail("client_disconnect", "client gone while waiting for the rate limit")
+				p.rewriter.clientLeft(r.Context(), leftQueue)
+			}
+			return
+		}
+	}
+	if st.fault = p.faults.pick(st.route); st.fault != nil && p.injectLocalFault(w, r, st) {
+		return
+	}
+	if st.route != nil && st.route.rewrite {
+		began := time.Now()
+		rw, err := rr.tweakBodySonic(r, st.route)
+		st.wide.rewrote(rw.rewritten, rw.applied, time.Since(began))
+		st.trace.log("rewrite_done", "rewritten", rw.rewritten, "applied", rw.applied,
+			"took", time.Since(began), "content_length", r.ContentLength, "error", err)
+		if err != nil {
+			if !WriteError(w, err) {
+				st.wide.fail("rewrite", err.Error())
+			}
+			return
+		}
+		st.rewrite = rw.outcome()
+		// don't start an upstream generation nobody is waiting for
+		if errors.Is(context.Cause(r.Context()), context.Canceled) {
+			st.wide.fail("client_disconnect", "client gone before the request went upstream")
+			st.trace.log("abandoned", "cause", context.Cause(r.Context()))
+			rr.abandoned.Add(1)
+			rr.clientLeft(r.Context(), leftUpload)
+			r.Body.Close()
+			return
+		}
+	}
+	if st.capture = p.capture.begin(r, st, p.opts.Policy); st.capture != nil {
+		defer p.capture.end(st)
+	}
+	if st.route != nil && st.route.batch {
+		rr.rewriteBatchUpload(r)
+	}
+	if st.route != nil && st.route.ndjson {
+		rr.rewriteNDJSON(r)
+	}
+	if p.idempotency != nil && st.route != nil && st.route.rewrite {
+		handled, tw, done := p.serveIdempotent(w, r, st)
+		if handled {
+			return
+		}
+		if tw != nil {
+			completed := false
+			defer func() { done(completed) }()
+			p.forward(tw, r, st)
+			completed = true
+			return
+		}
+	}
+	if p.getCache != nil && st.route != nil && st.client != nil && r.Method == http.MethodGet && p.getCache.routes[st.route.name] {
+		p.serveGetCache(w, r, st)
+		return
+	}
+	p.forward(w, r, st)
+}
+
+// forward sends r upstream, through a shared request when dedup applies.
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request, st *reqState) {
+	if p.dedup != nil && st.route != nil && st.route.rewrite && p.serveDedup(w, r, st) {
+		return
+	}
+	p.upstream(w, r, st)
+}
+
+// upstream hands r to the ReverseProxy, holding an upstream slot for the
+// duration when the limiter applies.
+func (p *Proxy) upstream(w http.ResponseWriter, r *http.Request, st *reqState) {
+	if p.limiter != nil && st != nil && st.route != nil && st.route.rewrite {
+		client := ""
+		if st.client != nil {
+			client = st.client.CacheKey
+		}
+		began := time.Now()
+		release, err := p.limiter.acquire(r.Context(), client)
+		st.wide.queued(time.Since(began))
+		st.trace.log("upstream_queue", "waited", time.Since(began), "error", err)
+		if err != nil {
+			r.Body.Close()
+			if q, ok := err.(*queueRejection); ok {
+				st.log.Warn("upstream queue: request refused", "route", st.route.name, "code", q.code, "position", q.position)
+				q.write(w)
+			} else if context.Cause(r.Context()) == errRequestTimeout {
+				writeHTTPError(w, errGatewayTimeout)
+			} else {
+				p.rewriter.clientLeft(r.Context(), leftQueue)
+			}
+			return
+		}
+		defer release()
+	}
+	if p.fallback != nil && st != nil && st.route != nil && st.route.rewrite {
+		p.fallback.prepare(r, st)
+	}
+	if p.gzip != nil && st != nil && st.route != nil {
+		p.gzip.compress(r, st.route.name)
+	}
+	if p.balance != nil && st != nil {
+		st.upstream = p.balance.pick()
+		st.upstream.requests.Add(1)
+		st.upstream.inflight.Add(1)
+		defer st.upstream.inflight.Add(-1)
+	}
+	if st != nil {
+		st.wide.serve("upstream")
+		st.trace.log("upstream", "target", p.targetOf(st).Host, "method", r.Method, "path", r.URL.Path,
+			"content_length", r.ContentLength, "content_encoding", r.Header.Get("Content-Encoding"))
+	}
+	if p.flush != nil {
+		fw := &flushWriter{ResponseWriter: w, f: p.flush}
+		defer fw.stop()
+		w = fw
+	}
+	p.rp.ServeHTTP(&startWriter{ResponseWriter: w, ctx: r.Context(), rr: p.rewriter}, r)
+}
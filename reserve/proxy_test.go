@@ -0,0 +1,262 @@
+package reserve
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upstreamRequest is what a test upstream received.
+type upstreamRequest struct {
+	method, path string
+	header       http.Header
+	body         []byte
+}
+
+// testUpstream is an httptest upstream that records the requests it gets
+// and answers them with h, or with a small JSON response when h is nil.
+// The recorded body is what h read of it (all of it when h is nil).
+type testUpstream struct {
+	*httptest.Server
+	mu  sync.Mutex
+	got []upstreamRequest
+}
+
+func newTestUpstream(t *testing.T, h http.HandlerFunc) *testUpstream {
+	t.Helper()
+	u := &testUpstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body bytes.Buffer
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, &body), r.Body}
+		defer func() {
+			u.mu.Lock()
+			u.got = append(u.got, upstreamRequest{r.Method, r.URL.Path, r.Header.Clone(), body.Bytes()})
+			u.mu.Unlock()
+		}()
+		if h == nil {
+			io.Copy(io.Discard, r.Body)
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"id":"resp_1","object":"response"}`)
+			return
+		}
+		h(w, r)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+// requests returns what the upstream has received so far.
+func (u *testUpstream) requests() []upstreamRequest {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]upstreamRequest(nil), u.got...)
+}
+
+// newTestProxy builds a Proxy with opts in front of u.
+func newTestProxy(t *testing.T, opts Options, u *testUpstream) *Proxy {
+	t.Helper()
+	opts.Target = u.URL
+	p, err := NewProxy(opts)
+	if err != nil {
+		t.Fatalf("NewProxy: %v", err)
+	}
+	return p
+}
+
+// send serves one request through p and returns the recorded response.
+func send(p http.Handler, method, path string, hdr http.Header, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, vs := range hdr {
+		req.Header[k] = vs
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	return w
+}
+
+func TestNewProxyTarget(t *testing.T) {
+	for _, target := range []string{"", "right.codes", "/v1", "://x"} {
+		opts := DefaultOptions()
+		opts.Target = target
+		if _, err := NewProxy(opts); err == nil {
+			t.Errorf("NewProxy accepted target %q", target)
+		}
+	}
+}
+
+func TestProxyForwardsRewrittenBody(t *testing.T) {
+	u := newTestUpstream(t, nil)
+	p := newTestProxy(t, DefaultOptions(), u)
+	w := send(p, "POST", "/v1/responses", bearer("sk-a"), `{"model":"gpt-5","input":"hi"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "resp_1") {
+		t.Fatalf("answered %d %s", w.Code, w.Body)
+	}
+	got := u.requests()
+	if len(got) != 1 {
+		t.Fatalf("upstream got %d requests, want 1", len(got))
+	}
+	if got[0].path != "/v1/responses" {
+		t.Errorf("upstream path = %s", got[0].path)
+	}
+	if m := decodeBody(t, got[0].body); m["prompt_cache_key"] != cacheKey("Bearer sk-a") {
+		t.Errorf("upstream body = %s", got[0].body)
+	}
+	if got[0].header.Get("Authorization") != "Bearer sk-a" {
+		t.Errorf("Authorization = %q, want it forwarded", got[0].header.Get("Authorization"))
+	}
+}
+
+func TestProxyPassesUnmatchedPaths(t *testing.T) {
+	u := newTestUpstream(t, nil)
+	p := newTestProxy(t, DefaultOptions(), u)
+	body := `{"input":"hi"}`
+	send(p, "POST", "/v2/other", bearer("sk-a"), body)
+	if got := u.requests(); len(got) != 1 || string(got[0].body) != body {
+		t.Fatalf("upstream got %+v, want the body untouched", got)
+	}
+}
+
+func TestProxyStreams(t *testing.T) {
+	u := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, ev := range []string{"response.created", "response.output_text.delta", "response.completed"} {
+			io.WriteString(w, "event: "+ev+"\ndata: {\"type\":\""+ev+"\"}\n\n")
+			w.(http.Flusher).Flush()
+		}
+	})
+	p := newTestProxy(t, DefaultOptions(), u)
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/v1/responses", "application/json", strings.NewReader(`{"input":"hi","stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var events []string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if ev, ok := strings.CutPrefix(sc.Text(), "event: "); ok {
+			events = append(events, ev)
+		}
+	}
+	if got := strings.Join(events, ","); got != "response.created,response.output_text.delta,response.completed" {
+		t.Errorf("events = %s", got)
+	}
+}
+
+func TestProxyUpstreamDown(t *testing.T) {
+	u := newTestUpstream(t, nil)
+	p := newTestProxy(t, DefaultOptions(), u)
+	u.Close()
+	if w := send(p, "POST", "/v1/responses", nil, `{"input":"hi"}`); w.Code != http.StatusBadGateway {
+		t.Errorf("answered %d, want 502", w.Code)
+	}
+}
+
+func TestProxyMaxBody(t *testing.T) {
+	u := newTestUpstream(t, nil)
+	opts := DefaultOptions()
+	opts.MaxBody = 64
+	p := newTestProxy(t, opts, u)
+	w := send(p, "POST", "/v1/responses", nil, `{"input":"`+strings.Repeat("x", 100)+`"}`)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("answered %d, want 413", w.Code)
+	}
+	if n := len(u.requests()); n != 0 {
+		t.Errorf("upstream got %d requests, want none", n)
+	}
+}
+
+func TestProxyStats(t *testing.T) {
+	u := newTestUpstream(t, nil)
+	p := newTestProxy(t, DefaultOptions(), u)
+	p.RegisterStats("custom", func() any { return 42 })
+	send(p, "POST", "/v1/responses", nil, `{"input":"hi"}`)
+	st := p.Stats()
+	if st["custom"] != 42 {
+		t.Errorf("custom stats section = %v", st["custom"])
+	}
+	for _, name := range []string{"rewrite", "bufpool"} {
+		if _, ok := st[name]; !ok {
+			t.Errorf("no %s stats section", name)
+		}
+	}
+}
+
+// expectUpstream refuses every request still carrying Expect with a 417,
+// before reading its body, as upstreams that don't do 100-continue may.
+func expectUpstream(t *testing.T) *testUpstream {
+	return newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Expect") != "" {
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, `{"id":"resp_1"}`)
+	})
+}
+
+func postExpect(t *testing.T, url, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Expect", "100-continue")
+	tr := &http.Transport{ExpectContinueTimeout: 5 * time.Second}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestProxyExpectContinue(t *testing.T) {
+	u := expectUpstream(t)
+	if resp := postExpect(t, u.URL+"/v1/responses", `{"input":"hi"}`); resp.StatusCode != http.StatusExpectationFailed {
+		t.Fatalf("upstream answered %d directly, want its 417", resp.StatusCode)
+	}
+
+	srv := httptest.NewServer(newTestProxy(t, DefaultOptions(), u))
+	defer srv.Close()
+	start := time.Now()
+	resp := postExpect(t, srv.URL+"/v1/responses", `{"input":"hi"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("answered %d through the proxy, want 200", resp.StatusCode)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("took %v, the client stalled on 100-continue", d)
+	}
+	got := u.requests()
+	last := got[len(got)-1]
+	if last.header.Get("Expect") != "" {
+		t.Errorf("Expect forwarded: %q", last.header.Get("Expect"))
+	}
+	if m := decodeBody(t, last.body); m["input"] != "hi" || m["prompt_cache_key"] == nil {
+		t.Errorf("upstream body = %s, want the whole rewritten body", last.body)
+	}
+}
+
+func TestProxyExpectContinueUnbuffered(t *testing.T) {
+	// a body the proxy streams through keeps Expect, and the upstream's
+	// 417 reaches the client
+	u := expectUpstream(t)
+	srv := httptest.NewServer(newTestProxy(t, DefaultOptions(), u))
+	defer srv.Close()
+	if resp := postExpect(t, srv.URL+"/v2/other", `{"input":"hi"}`); resp.StatusCode != http.StatusExpectationFailed {
+		t.Errorf("answered %d, want the upstream's 417", resp.StatusCode)
+	}
+}
@@ -0,0 +1,187 @@
+package reserve
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/ast"
+)
+
+// With Options.PublicURL, absolute URLs into the upstream that responses
+// hand out (a Location header, a file download link in the body) are
+// rewritten to point at the proxy, so a client following them keeps going
+// through it. Only URLs on the exact upstream origin (scheme and host, and
+// under Target's path) are rewritten; relative URLs and other origins pass
+// through. The headers are Options.URLHeaders; body fields are rewritten
+// only when listed in Options.URLBodyFields, as dotted paths ("url",
+// "data.download_url"), arrays along the way applying to every element.
+
+var errPublicURL = errors.New("reserve: public URL must be absolute")
+
+// publicURLs maps upstream URLs to the proxy's public base URL.
+type publicURLs struct {
+	scheme, host string
+	prefix       string // the target's path, without the trailing slash
+	base         string // the public URL, without the trailing slash
+	headers      []string
+	fields       [][]string
+
+	rewrittenHeaders atomic.Int64
+	rewrittenFields  atomic.Int64
+}
+
+func newPublicURLs(opts Options, target *url.URL) (*publicURLs, error) {
+	if opts.PublicURL == "" {
+		return nil, nil
+	}
+	pu, err := url.Parse(opts.PublicURL)
+	if err != nil {
+		return nil, err
+	}
+	if pu.Scheme == "" || pu.Host == "" {
+		return nil, errPublicURL
+	}
+	u := &publicURLs{
+		scheme: target.Scheme,
+		host:   target.Host,
+		prefix: strings.TrimRight(target.EscapedPath(), "/"),
+		base:   strings.TrimSuffix(pu.Scheme+"://"+pu.Host+pu.EscapedPath(), "/"),
+	}
+	for _, h := range opts.URLHeaders {
+		if h = strings.TrimSpace(h); h != "" {
+			u.headers = append(u.headers, http.CanonicalHeaderKey(h))
+		}
+	}
+	for _, f := range opts.URLBodyFields {
+		if f = strings.TrimSpace(f); f != "" {
+			u.fields = append(u.fields, strings.Split(f, "."))
+		}
+	}
+	return u, nil
+}
+
+func (p *Proxy) publicURLStats() any {
+	u := p.urls
+	if u == nil {
+		return map[string]any{"enabled": false}
+	}
+	return map[string]any{
+		"enabled":     true,
+		"public_url":  u.base,
+		"headers":     u.headers,
+		"body_fields": len(u.fields),
+		"rewritten": map[string]int64{
+			"headers": u.rewrittenHeaders.Load(),
+			"fields":  u.rewrittenFields.Load(),
+		},
+	}
+}
+
+// rewrite returns s pointed at the proxy when it is an absolute URL on the
+// upstream origin.
+func (u *publicURLs) rewrite(s string) (string, bool) {
+	pu, err := url.Parse(s)
+	if err != nil || !strings.EqualFold(pu.Scheme, u.scheme) || !strings.EqualFold(pu.Host, u.host) || pu.User != nil {
+		return s, false
+	}
+	rest := pu.EscapedPath()
+	if u.prefix != "" {
+		r, ok := strings.CutPrefix(rest, u.prefix)
+		if !ok || r != "" && r[0] != '/' {
+			return s, false
+		}
+		rest = r
+	}
+	out := u.base + rest
+	if pu.RawQuery != "" || pu.ForceQuery {
+		out += "?" + pu.RawQuery
+	}
+	if pu.Fragment != "" {
+		out += "#" + pu.EscapedFragment()
+	}
+	return out, true
+}
+
+func publicURLsHook(r *Response) error {
+	u := r.proxy.urls
+	if u == nil {
+		return nil
+	}
+	h := r.HTTP.Header
+	for _, name := range u.headers {
+		vs := h[name]
+		for i, v := range vs {
+			if out, ok := u.rewrite(v); ok {
+				vs[i] = out
+				u.rewrittenHeaders.Add(1)
+			}
+		}
+	}
+	if len(u.fields) == 0 || isEventStream(r.HTTP) ||
+		!strings.HasPrefix(h.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	bs, err := r.Body()
+	if err != nil {
+		return err
+	}
+	root, err := sonic.Get(bs)
+	if err != nil {
+		return nil
+	}
+	n := 0
+	for _, path := range u.fields {
+		n += u.rewriteField(&root, path)
+	}
+	if n == 0 {
+		return nil
+	}
+	out, err := root.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	u.rewrittenFields.Add(int64(n))
+	r.SetBody(out)
+	return nil
+}
+
+// rewriteField rewrites the string at path below n, through every element
+// of the arrays on the way, and returns how many it changed.
+func (u *publicURLs) rewriteField(n *ast.Node, path []string) int {
+	switch n.TypeSafe() {
+	case ast.V_ARRAY:
+		if n.Load() != nil {
+			return 0
+		}
+		l, _ := n.Len()
+		c := 0
+		for i := range l {
+			c += u.rewriteField(n.Index(i), path)
+		}
+		return c
+	case ast.V_OBJECT:
+	default:
+		return 0
+	}
+	child := n.Get(path[0])
+	if !child.Exists() {
+		return 0
+	}
+	if len(path) > 1 {
+		return u.rewriteField(child, path[1:])
+	}
+	s, err := child.String()
+	if err != nil || child.TypeSafe() != ast.V_STRING {
+		return 0
+	}
+	out, ok := u.rewrite(s)
+	if !ok {
+		return 0
+	}
+	_, _ = n.Set(path[0], ast.NewString(out))
+	return 1
+}
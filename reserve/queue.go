@@ -0,0 +1,285 @@
+package reserve
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With Options.UpstreamConcurrency (and/or UpstreamClientConcurrency) at
+// most that many rewritten requests are with the upstream at once, in
+// total and per client; the rest wait in one FIFO queue. A request holds
+// its slot until the upstream response has been relayed in full, so a
+// stream keeps it until the stream ends. A waiter whose client leaves
+// gives its place up at once; one that waits UpstreamQueueWait, or finds
+// the queue full, gets a 429 telling it its position and the expected
+// wait.
+//
+// The queue is FIFO among the requests that can run: when a slot frees,
+// the earliest waiter that fits is let through, so one client at its own
+// limit doesn't hold up the others.
+
+var queueWaitBuckets = [...]time.Duration{
+	10 * time.Millisecond, 100 * time.Millisecond, time.Second,
+	5 * time.Second, 30 * time.Second, time.Minute,
+}
+
+type upstreamLimiter struct {
+	global    int // 0 = no overall limit
+	perClient int // 0 = no per-client limit
+	maxQueue  int
+	wait      time.Duration
+
+	mu      sync.Mutex
+	active  int
+	clients map[string]int // active per client, entries dropped at 0
+	queue   list.List      // of *queueWaiter, front = first in line
+
+	holdAvg atomic.Int64 // ns, moving average of slot hold time
+
+	admitted atomic.Int64
+	queued   atomic.Int64 // requests that had to wait
+	timeouts atomic.Int64
+	full     atomic.Int64
+	gone     atomic.Int64 // clients that left while queued
+	waitHist [len(queueWaitBuckets) + 1]atomic.Int64
+}
+
+type queueWaiter struct {
+	client  string
+	ready   chan struct{} // closed once granted
+	granted bool          // guarded by the limiter's mu
+}
+
+func newUpstreamLimiter(opts Options) *upstreamLimiter {
+	if opts.UpstreamConcurrency <= 0 && opts.UpstreamClientConcurrency <= 0 {
+		return nil
+	}
+	return &upstreamLimiter{
+		global:    max(opts.UpstreamConcurrency, 0),
+		perClient: max(opts.UpstreamClientConcurrency, 0),
+		maxQueue:  max(opts.UpstreamQueue, 0),
+		wait:      opts.UpstreamQueueWait,
+		clients:   map[string]int{},
+	}
+}
+
+func (p *Proxy) upstreamQueueStats() any {
+	l := p.limiter
+	if l == nil {
+		return map[string]any{"enabled": false}
+	}
+	l.mu.Lock()
+	active, depth := l.active, l.queue.Len()
+	l.mu.Unlock()
+	// queued requests by their wait for a slot
+	hist := make(map[string]int64, len(l.waitHist))
+	for i, d := range queueWaitBuckets {
+		hist["le_"+d.String()] = l.waitHist[i].Load()
+	}
+	hist["gt_"+queueWaitBuckets[len(queueWaitBuckets)-1].String()] = l.waitHist[len(queueWaitBuckets)].Load()
+	return map[string]any{
+		"enabled":        true,
+		"concurrency":    l.global,
+		"per_client":     l.perClient,
+		"max_queue":      l.maxQueue,
+		"wait":           l.wait.String(),
+		"active":         active,
+		"depth":          depth,
+		"admitted":       l.admitted.Load(),
+		"queued":         l.queued.Load(),
+		"timeouts":       l.timeouts.Load(),
+		"queue_full":     l.full.Load(),
+		"gone":           l.gone.Load(),
+		"avg_hold":       time.Duration(l.holdAvg.Load()).String(),
+		"wait_histogram": hist,
+	}
+}
+
+// fits reports whether client may take a slot now; mu is held.
+func (l *upstreamLimiter) fits(client string) bool {
+	return (l.global == 0 || l.active < l.global) &&
+		(l.perClient == 0 || l.clients[client] < l.perClient)
+}
+
+// takeLocked gives client a slot; mu is held.
+func (l *upstreamLimiter) takeLocked(client string) {
+	l.active++
+	l.clients[client]++
+}
+
+// acquire waits for a slot for client and returns its release. The error
+// is ErrClientGone when ctx ended first, else a *queueRejection.
+func (l *upstreamLimiter) acquire(ctx context.Context, client string) (func(), error) {
+	l.mu.Lock()
+	if l.fits(client) {
+		l.takeLocked(client)
+		l.mu.Unlock()
+		l.admitted.Add(1)
+		return l.releaser(client), nil
+	}
+	if n := l.queue.Len(); n >= l.maxQueue {
+		l.mu.Unlock()
+		l.full.Add(1)
+		return nil, l.rejection(n+1, "upstream_queue_full",
+			"too many requests are waiting for the upstream, retry later")
+	}
+	w := &queueWaiter{client: client, ready: make(chan struct{})}
+	el := l.queue.PushBack(w)
+	l.mu.Unlock()
+	l.queued.Add(1)
+	start := time.Now()
+
+	var expired <-chan time.Time
+	if l.wait > 0 {
+		t := time.NewTimer(l.wait)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		if !l.leave(el) {
+			l.gone.Add(1)
+			return nil, ErrClientGone
+		}
+		// granted as it left: give the slot straight back
+		l.releaser(client)()
+		return nil, ErrClientGone
+	case <-expired:
+		pos := l.position(el)
+		if !l.leave(el) {
+			l.timeouts.Add(1)
+			return nil, l.rejection(pos, "upstream_queue_timeout",
+				"timed out waiting for an upstream slot, retry later")
+		}
+		// granted just in time
+	}
+	l.observeWait(time.Since(start))
+	l.admitted.Add(1)
+	return l.releaser(client), nil
+}
+
+// leave takes el out of the queue and reports whether it had been granted
+// a slot already.
+func (l *upstreamLimiter) leave(el *list.Element) (granted bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w := el.Value.(*queueWaiter)
+	if !w.granted {
+		l.queue.Remove(el)
+	}
+	return w.granted
+}
+
+// position is el's 1-based place in the queue.
+func (l *upstreamLimiter) position(el *list.Element) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 1
+	for e := l.queue.Front(); e != nil && e != el; e = e.Next() {
+		n++
+	}
+	return n
+}
+
+func (l *upstreamLimiter) releaser(client string) func() {
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.observeHold(time.Since(start))
+			l.release(client)
+		})
+	}
+}
+
+// release frees client's slot and lets through the earliest waiters that
+// now fit.
+func (l *upstreamLimiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if l.clients[client]--; l.clients[client] <= 0 {
+		delete(l.clients, client)
+	}
+	for e := l.queue.Front(); e != nil; {
+		next := e.Next()
+		w := e.Value.(*queueWaiter)
+		if l.fits(w.client) {
+			l.queue.Remove(e)
+			l.takeLocked(w.client)
+			w.granted = true
+			close(w.ready)
+		}
+		if l.global > 0 && l.active >= l.global {
+			break
+		}
+		e = next
+	}
+}
+
+func (l *upstreamLimiter) observeHold(d time.Duration) {
+	for {
+		old := l.holdAvg.Load()
+		n := int64(d)
+		if old != 0 {
+			n = old + (int64(d)-old)/8
+		}
+		if l.holdAvg.CompareAndSwap(old, n) {
+			return
+		}
+	}
+}
+
+func (l *upstreamLimiter) observeWait(d time.Duration) {
+	for i, b := range queueWaitBuckets {
+		if d <= b {
+			l.waitHist[i].Add(1)
+			return
+		}
+	}
+	l.waitHist[len(queueWaitBuckets)].Add(1)
+}
+
+// queueRejection is a 429 from the limiter, with the position the request
+// had and the wait expected from there.
+type queueRejection struct {
+	*httpError
+	position int
+	wait     time.Duration
+}
+
+// rejection builds the 429 for a request at position pos: the expected
+// wait is the slots' average hold time for every full round of slots
+// ahead of it.
+func (l *upstreamLimiter) rejection(pos int, code, msg string) *queueRejection {
+	slots := l.global
+	if slots == 0 {
+		slots = l.perClient
+	}
+	rounds := (pos + slots - 1) / slots
+	wait := time.Duration(rounds) * time.Duration(l.holdAvg.Load())
+	return &queueRejection{
+		httpError: &httpError{
+			status:     http.StatusTooManyRequests,
+			code:       code,
+			msg:        msg,
+			retryAfter: max(int(math.Ceil(wait.Seconds())), 1),
+		},
+		position: pos,
+		wait:     wait,
+	}
+}
+
+func (q *queueRejection) write(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("X-Reserve-Queue-Position", strconv.Itoa(q.position))
+	h.Set("X-Reserve-Queue-Wait", strconv.FormatFloat(q.wait.Seconds(), 'f', 1, 64))
+	writeHTTPError(w, q.httpError)
+}
@@ -0,0 +1,450 @@
+package reserve
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// With Options.Quotas, single clients are held to what they may use in a
+// calendar day, week (from Monday) or month, in the table's timezone:
+// requests started, and the input, output or total tokens their
+// responses report, counted where the usage is recorded (see recordUsage).
+// A request of a client with a quota used up gets a 429 with the reset
+// time (requests admitted before finish, tokens may overshoot); past the
+// WarnAt share of a quota, responses carry X-Reserve-Quota-Remaining. The counts of
+// the current periods survive restarts with a store attached, and the
+// admin API shows and resets them.
+
+const (
+	quotaPath            = reservePrefix + "quotas"
+	quotaRemainingHeader = "X-Reserve-Quota-Remaining"
+	defaultQuotaWarnAt   = 0.8
+)
+
+var (
+	quotaPeriods    = []string{"day", "week", "month"}
+	quotaAdjectives = map[string]string{"day": "daily", "week": "weekly", "month": "monthly"}
+)
+
+// Quota caps a client's use in one calendar period, "day", "week" or
+// "month". A dimension left 0 is unlimited.
+type Quota struct {
+	Period       string `json:"period"`
+	Requests     int64  `json:"requests,omitempty"`
+	InputTokens  int64  `json:"input_tokens,omitempty"`
+	OutputTokens int64  `json:"output_tokens,omitempty"`
+	Tokens       int64  `json:"tokens,omitempty"` // input plus output
+}
+
+// QuotaTable holds the quotas by client id; Default applies to the
+// clients not listed, and an empty list exempts a client. Periods begin
+// at midnight in Timezone (an IANA name, UTC when empty). WarnAt is the
+// share of a quota past which responses tell what remains (0 = 0.8).
+type QuotaTable struct {
+	Timezone string             `json:"timezone,omitempty"`
+	WarnAt   float64            `json:"warn_at,omitempty"`
+	Default  []Quota            `json:"default,omitempty"`
+	Clients  map[string][]Quota `json:"clients,omitempty"`
+}
+
+// LoadQuotaTable reads a QuotaTable from the JSON file at path.
+func LoadQuotaTable(path string) (*QuotaTable, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &QuotaTable{}
+	if err := sonic.Unmarshal(bs, t); err != nil {
+		return nil, err
+	}
+	if _, err := t.location(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// location checks t and returns its timezone.
+func (t *QuotaTable) location() (*time.Location, error) {
+	loc, err := time.LoadLocation(t.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("reserve: quotas: timezone: %w", err)
+	}
+	if t.WarnAt < 0 || t.WarnAt > 1 {
+		return nil, errors.New("reserve: quotas: warn_at must be between 0 and 1")
+	}
+	check := func(who string, qs []Quota) error {
+		var seen []string
+		for _, q := range qs {
+			switch {
+			case !slices.Contains(quotaPeriods, q.Period):
+				return fmt.Errorf("reserve: quotas: %s: period %q, want day, week or month", who, q.Period)
+			case slices.Contains(seen, q.Period):
+				return fmt.Errorf("reserve: quotas: %s: two %s quotas", who, q.Period)
+			case q.Requests < 0 || q.InputTokens < 0 || q.OutputTokens < 0 || q.Tokens < 0:
+				return fmt.Errorf("reserve: quotas: %s: negative %s quota", who, q.Period)
+			}
+			seen = append(seen, q.Period)
+		}
+		return nil
+	}
+	if err := check("default", t.Default); err != nil {
+		return nil, err
+	}
+	for id, qs := range t.Clients {
+		if err := check("client "+id, qs); err != nil {
+			return nil, err
+		}
+	}
+	return loc, nil
+}
+
+// quotasOf are the quotas of client.
+func (t *QuotaTable) quotasOf(client string) []Quota {
+	if qs, ok := t.Clients[client]; ok {
+		return qs
+	}
+	return t.Default
+}
+
+// quotaPeriod is the period of kind holding now: a key naming it, and when
+// the next one begins.
+func quotaPeriod(kind string, now time.Time) (key string, reset time.Time) {
+	y, m, d := now.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	switch kind {
+	case "day":
+		return day.Format("2006-01-02"), day.AddDate(0, 0, 1)
+	case "week":
+		monday := day.AddDate(0, 0, -(int(now.Weekday())+6)%7)
+		return monday.Format("2006-01-02"), monday.AddDate(0, 0, 7)
+	default:
+		month := time.Date(y, m, 1, 0, 0, 0, 0, now.Location())
+		return month.Format("2006-01"), month.AddDate(0, 1, 0)
+	}
+}
+
+// quotaTracker counts what each client with quotas used in their current
+// periods.
+type quotaTracker struct {
+	t      *QuotaTable
+	loc    *time.Location
+	warnAt float64
+
+	mu  sync.Mutex
+	use map[string]map[string]*quotaUse // client, period kind
+
+	rejected atomic.Int64
+	warned   atomic.Int64 // responses given quotaRemainingHeader
+	resets   atomic.Int64 // by the admin API
+}
+
+type quotaUse struct {
+	key                     string // of the period counted
+	requests, input, output int64
+}
+
+func newQuotaTracker(opts Options) (*quotaTracker, error) {
+	if opts.Quotas == nil {
+		return nil, nil
+	}
+	loc, err := opts.Quotas.location()
+	if err != nil {
+		return nil, err
+	}
+	q := &quotaTracker{t: opts.Quotas, loc: loc, warnAt: opts.Quotas.WarnAt, use: map[string]map[string]*quotaUse{}}
+	if q.warnAt == 0 {
+		q.warnAt = defaultQuotaWarnAt
+	}
+	return q, nil
+}
+
+func (q *quotaTracker) now() time.Time { return time.Now().In(q.loc) }
+
+// useLocked returns client's count for the period of kind holding now,
+// moved on to it; mu is held.
+func (q *quotaTracker) useLocked(client, kind string, now time.Time) *quotaUse {
+	byKind := q.use[client]
+	if byKind == nil {
+		byKind = map[string]*quotaUse{}
+		q.use[client] = byKind
+	}
+	key, _ := quotaPeriod(kind, now)
+	u := byKind[kind]
+	if u == nil {
+		u = &quotaUse{key: key}
+		byKind[kind] = u
+	}
+	if u.key != key {
+		*u = quotaUse{key: key}
+	}
+	return u
+}
+
+// peekLocked is what client used of kind in the current period, without
+// recording anything: zero for a client or a period with no use yet.
+func (q *quotaTracker) peekLocked(client, kind string, now time.Time) *quotaUse {
+	key, _ := quotaPeriod(kind, now)
+	if u := q.use[client][kind]; u != nil && u.key == key {
+		c := *u
+		return &c
+	}
+	return &quotaUse{key: key}
+}
+
+// quotaDim is one dimension of a quota: its limit and what was used of it.
+type quotaDim struct {
+	name       string
+	limit, use int64
+}
+
+func quotaDims(qt Quota, u *quotaUse) []quotaDim {
+	return []quotaDim{
+		{"requests", qt.Requests, u.requests},
+		{"input_tokens", qt.InputTokens, u.input},
+		{"output_tokens", qt.OutputTokens, u.output},
+		{"tokens", qt.Tokens, u.input + u.output},
+	}
+}
+
+// admit counts a new request of client against its quotas, or refuses it
+// with a 429 when one is used up. remaining are the
+// X-Reserve-Quota-Remaining values of the quotas past WarnAt.
+func (q *quotaTracker) admit(client string) (remaining []string, err *httpError) {
+	qs := q.t.quotasOf(client)
+	if len(qs) == 0 {
+		return nil, nil
+	}
+	now := q.now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, qt := range qs {
+		u := q.useLocked(client, qt.Period, now)
+		for _, d := range quotaDims(qt, u) {
+			if d.limit > 0 && d.use >= d.limit {
+				_, reset := quotaPeriod(qt.Period, now)
+				q.rejected.Add(1)
+				return nil, &httpError{
+					status: http.StatusTooManyRequests,
+					code:   "quota_exceeded",
+					msg: fmt.Sprintf("this client's %s quota of %d %s is used up until %s",
+						quotaAdjectives[qt.Period], d.limit, strings.ReplaceAll(d.name, "_", " "), reset.Format(time.RFC3339)),
+					retryAfter: int(math.Ceil(reset.Sub(now).Seconds())),
+				}
+			}
+		}
+	}
+	for _, qt := range qs {
+		u := q.useLocked(client, qt.Period, now)
+		u.requests++
+		warn := false
+		var b strings.Builder
+		b.WriteString(qt.Period)
+		for _, d := range quotaDims(qt, u) {
+			if d.limit <= 0 {
+				continue
+			}
+			if float64(d.use) >= q.warnAt*float64(d.limit) {
+				warn = true
+			}
+			fmt.Fprintf(&b, "; %s=%d", d.name, max(d.limit-d.use, 0))
+		}
+		if warn {
+			_, reset := quotaPeriod(qt.Period, now)
+			fmt.Fprintf(&b, "; reset=%s", reset.Format(time.RFC3339))
+			remaining = append(remaining, b.String())
+		}
+	}
+	if remaining != nil {
+		q.warned.Add(1)
+	}
+	return remaining, nil
+}
+
+// charge adds the tokens of usage object raw to client's quotas.
+func (q *quotaTracker) charge(client *clientIdentity, raw string) {
+	if client == nil {
+		return
+	}
+	qs := q.t.quotasOf(client.CacheKey)
+	if len(qs) == 0 {
+		return
+	}
+	var tu tokenUsage
+	if sonic.UnmarshalString(raw, &tu) != nil {
+		return
+	}
+	input, _, output := tu.counts()
+	now := q.now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, qt := range qs {
+		u := q.useLocked(client.CacheKey, qt.Period, now)
+		u.input += input
+		u.output += output
+	}
+}
+
+// view shows the quotas and current use of client, or of every client
+// with counts when client is "".
+func (q *quotaTracker) view(client string) map[string]any {
+	now := q.now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	one := func(id string) map[string]any {
+		out := map[string]any{}
+		for _, qt := range q.t.quotasOf(id) {
+			u := q.peekLocked(id, qt.Period, now)
+			_, reset := quotaPeriod(qt.Period, now)
+			e := map[string]any{"period_start": u.key, "reset": reset.Format(time.RFC3339)}
+			for _, d := range quotaDims(qt, u) {
+				e[d.name] = d.use
+				if d.limit > 0 {
+					e[d.name+"_limit"] = d.limit
+				}
+			}
+			out[qt.Period] = e
+		}
+		return out
+	}
+	clients := map[string]any{}
+	if client != "" {
+		clients[client] = one(client)
+	} else {
+		for id := range q.use {
+			clients[id] = one(id)
+		}
+	}
+	return clients
+}
+
+// reset forgets what client (every client for "*") used in the current
+// period of kind, or of every kind for "", and returns how many counts it
+// cleared.
+func (q *quotaTracker) reset(client, kind string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for id, byKind := range q.use {
+		if client != "*" && id != client {
+			continue
+		}
+		for k := range byKind {
+			if kind == "" || k == kind {
+				delete(byKind, k)
+				n++
+			}
+		}
+		if len(byKind) == 0 {
+			delete(q.use, id)
+		}
+	}
+	q.resets.Add(int64(n))
+	return n
+}
+
+func (p *Proxy) quotaStats() any {
+	q := p.quotas
+	if q == nil {
+		return map[string]any{"enabled": false}
+	}
+	return map[string]any{
+		"enabled":  true,
+		"timezone": q.loc.String(),
+		"warn_at":  q.warnAt,
+		"default":  q.t.Default,
+		"rejected": q.rejected.Load(),
+		"warned":   q.warned.Load(),
+		"resets":   q.resets.Load(),
+		"clients":  q.view(""),
+	}
+}
+
+// counters adds the counts of the current periods to m, for the store.
+func (q *quotaTracker) counters(m map[string]int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, byKind := range q.use {
+		for kind, u := range byKind {
+			pre := "quota." + kind + "." + u.key + "."
+			m[pre+"requests."+id] = u.requests
+			m[pre+"input."+id] = u.input
+			m[pre+"output."+id] = u.output
+		}
+	}
+}
+
+// restore adds one saved count; a period other than the current one is
+// over and dropped.
+func (q *quotaTracker) restore(k string, v int64) {
+	parts := strings.SplitN(strings.TrimPrefix(k, "quota."), ".", 4)
+	if len(parts) != 4 || !slices.Contains(quotaPeriods, parts[0]) {
+		return
+	}
+	kind, key, field, id := parts[0], parts[1], parts[2], parts[3]
+	now := q.now()
+	if cur, _ := quotaPeriod(kind, now); cur != key {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.useLocked(id, kind, now)
+	switch field {
+	case "requests":
+		u.requests += v
+	case "input":
+		u.input += v
+	case "output":
+		u.output += v
+	}
+}
+
+// serveQuotas is the admin quota endpoint: GET shows the current use of
+// every client with counts (or of ?client=), DELETE resets the current
+// periods of ?client= ("*" = all), only the one of ?period= if given.
+func (p *Proxy) serveQuotas(w http.ResponseWriter, r *http.Request, caller string) {
+	q := p.quotas
+	if q == nil {
+		writeHTTPError(w, errQuotasDisabled)
+		return
+	}
+	client, kind := r.URL.Query().Get("client"), r.URL.Query().Get("period")
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{"clients": q.view(client)})
+	case http.MethodDelete:
+		if client == "" || kind != "" && !slices.Contains(quotaPeriods, kind) {
+			writeHTTPError(w, errQuotaReset)
+			return
+		}
+		n := q.reset(client, kind)
+		slog.Info("admin quota reset", "caller", caller, "remote", r.RemoteAddr, "client", client,
+			"period", kind, "reset", n)
+		writeJSON(w, http.StatusOK, map[string]any{"reset": n})
+	default:
+		writeHTTPError(w, errMethod)
+	}
+}
+
+var (
+	errQuotasDisabled = &httpError{
+		status: http.StatusNotFound,
+		code:   "quotas_disabled",
+		msg:    "no quota table is configured",
+	}
+	errQuotaReset = &httpError{
+		status: http.StatusBadRequest,
+		code:   "invalid_admin_request",
+		msg:    "a quota reset needs ?client= (* = all) and optionally ?period=day, week or month",
+	}
+)
@@ -0,0 +1,45 @@
+package reserve
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQuotaViewUnknownClient(t *testing.T) {
+	q, err := newQuotaTracker(Options{Quotas: &QuotaTable{
+		Default: []Quota{{Period: "day", Requests: 100}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := q.now()
+	q.mu.Lock()
+	q.useLocked("c", "day", now).requests = 4
+	q.mu.Unlock()
+
+	day := q.view("nobody")["nobody"].(map[string]any)["day"].(map[string]any)
+	if day["requests"] != int64(0) || day["requests_limit"] != int64(100) {
+		t.Errorf("unknown client's day = %v, want 0 of 100 requests", day)
+	}
+	q.mu.Lock()
+	_, inserted := q.use["nobody"]
+	q.mu.Unlock()
+	if inserted {
+		t.Error("viewing an unknown client recorded a window for it")
+	}
+	m := map[string]int64{}
+	q.counters(m)
+	for k := range m {
+		if strings.HasSuffix(k, ".nobody") {
+			t.Errorf("counters have %s, for the store to keep", k)
+		}
+	}
+
+	day = q.view("c")["c"].(map[string]any)["day"].(map[string]any)
+	if day["requests"] != int64(4) {
+		t.Errorf("c's day = %v, want 4 requests", day)
+	}
+	if all := q.view(""); len(all) != 1 || all["c"] == nil {
+		t.Errorf("view of all = %v, want c alone", all)
+	}
+}
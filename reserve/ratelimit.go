@@ -0,0 +1,119 @@
+package reserve
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With Options.RateLimit, at most that many rewritten requests (new
+// generations) per second start, across all clients, with bursts of up to
+// RateBurst: a leaky bucket, applied before the body is read so a shed
+// request costs next to nothing. A request over the rate waits for its
+// turn when that comes within RateQueueWait, and is shed with a 429
+// otherwise, its Retry-After the time until the bucket has room again.
+// The stats endpoint and the admin API are never limited.
+
+type rateLimiter struct {
+	interval time.Duration // between two requests at the rate
+	burst    int
+	maxWait  time.Duration
+
+	mu  sync.Mutex
+	tat time.Time // theoretical arrival time of the next request at the rate
+
+	accepted, queued, shed, gone atomic.Int64
+}
+
+func newRateLimiter(opts Options) *rateLimiter {
+	if opts.RateLimit <= 0 {
+		return nil
+	}
+	burst := opts.RateBurst
+	if burst <= 0 {
+		burst = max(int(math.Ceil(opts.RateLimit)), 1)
+	}
+	return &rateLimiter{
+		interval: time.Duration(float64(time.Second) / opts.RateLimit),
+		burst:    burst,
+		maxWait:  max(opts.RateQueueWait, 0),
+	}
+}
+
+func (p *Proxy) rateLimitStats() any {
+	l := p.rate
+	if l == nil {
+		return map[string]any{"enabled": false}
+	}
+	l.mu.Lock()
+	delay := l.delayLocked(time.Now())
+	l.mu.Unlock()
+	return map[string]any{
+		"enabled":    true,
+		"rate":       float64(time.Second) / float64(l.interval),
+		"burst":      l.burst,
+		"queue_wait": l.maxWait.String(),
+		"delay":      max(delay, 0).String(),
+		"accepted":   l.accepted.Load(),
+		"queued":     l.queued.Load(),
+		"shed":       l.shed.Load(),
+		"gone":       l.gone.Load(),
+	}
+}
+
+// delayLocked is how long a request arriving at now would wait; mu is
+// held. Negative when there is room to spare.
+func (l *rateLimiter) delayLocked(now time.Time) time.Duration {
+	tat := l.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	return tat.Sub(now) - time.Duration(l.burst-1)*l.interval
+}
+
+// wait admits a request, after waiting for its turn if need be, and
+// returns how long it waited. The error is ErrClientGone when ctx ended
+// first, else the 429.
+func (l *rateLimiter) wait(ctx context.Context) (time.Duration, error) {
+	now := time.Now()
+	l.mu.Lock()
+	delay := l.delayLocked(now)
+	if delay > l.maxWait {
+		l.mu.Unlock()
+		l.shed.Add(1)
+		return 0, &httpError{
+			status:     http.StatusTooManyRequests,
+			code:       "rate_limit_exceeded",
+			msg:        "the proxy's request rate is exhausted, retry later",
+			retryAfter: max(int(math.Ceil(delay.Seconds())), 1),
+		}
+	}
+	// take the turn: the bucket fills by one request
+	if l.tat.Before(now) {
+		l.tat = now
+	}
+	l.tat = l.tat.Add(l.interval)
+	l.mu.Unlock()
+	if delay <= 0 {
+		l.accepted.Add(1)
+		return 0, nil
+	}
+	l.queued.Add(1)
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		l.accepted.Add(1)
+		return delay, nil
+	case <-ctx.Done():
+		// hand the turn back
+		l.mu.Lock()
+		l.tat = l.tat.Add(-l.interval)
+		l.mu.Unlock()
+		l.gone.Add(1)
+		return time.Since(now), ErrClientGone
+	}
+}
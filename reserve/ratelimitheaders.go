@@ -0,0 +1,169 @@
+package reserve
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Client libraries self-throttle on the upstream's x-ratelimit-* headers,
+// which say nothing of the proxy's own limits when those bind first. With
+// Options.RateLimit or Options.Quotas set, the responses of the routes they
+// apply to report the proxy's limits in the same headers, per variant
+// (requests, tokens): the limit, what is left of it and the time until it
+// is whole again, of the tightest of the proxy's limits. With
+// Options.RateLimitHeaders "merged" the upstream's values stay when they
+// are tighter still; with "proxy" they are replaced whatever they say.
+
+const (
+	rateLimitHeadersMerged = "merged"
+	rateLimitHeadersProxy  = "proxy"
+	rateLimitHeadersOff    = "off"
+)
+
+var rateLimitVariants = [...]string{"requests", "tokens"}
+
+// rateLimitReport is one limit in the terms of the x-ratelimit-* headers.
+type rateLimitReport struct {
+	limit, remaining int64
+	reset            time.Duration
+}
+
+type rateLimitHeaderCounts struct {
+	set          atomic.Int64 // variants reported from a proxy limit
+	keptUpstream atomic.Int64 // upstream values tighter, left as they were
+}
+
+func checkRateLimitHeaders(mode string) error {
+	switch mode {
+	case "", rateLimitHeadersMerged, rateLimitHeadersProxy, rateLimitHeadersOff:
+		return nil
+	}
+	return fmt.Errorf("reserve: RateLimitHeaders: want merged, proxy or off, not %q", mode)
+}
+
+func (p *Proxy) rateLimitHeaderStats() any {
+	mode := p.opts.RateLimitHeaders
+	if mode == "" {
+		mode = rateLimitHeadersMerged
+	}
+	return map[string]any{
+		"mode":          mode,
+		"active":        mode != rateLimitHeadersOff && (p.rate != nil || p.quotas != nil),
+		"set":           p.rlHeaders.set.Load(),
+		"kept_upstream": p.rlHeaders.keptUpstream.Load(),
+	}
+}
+
+// tighter is the one of a and b with less remaining, a on a tie.
+func tighter(a, b *rateLimitReport) *rateLimitReport {
+	if a == nil || b != nil && b.remaining < a.remaining {
+		return b
+	}
+	return a
+}
+
+// formatRateLimitReset renders d the way the upstream does: whole
+// milliseconds below a second ("250ms"), whole seconds above ("6m0s").
+func formatRateLimitReset(d time.Duration) string {
+	switch {
+	case d <= 0:
+		return "0s"
+	case d < time.Second:
+		return max(d.Round(time.Millisecond), time.Millisecond).String()
+	default:
+		return d.Round(time.Second).String()
+	}
+}
+
+// report is the rate limiter in x-ratelimit-requests terms: the burst,
+// the requests that would start at once, and the time until the bucket
+// is empty.
+func (l *rateLimiter) report(now time.Time) *rateLimitReport {
+	l.mu.Lock()
+	ahead := l.tat.Sub(now)
+	l.mu.Unlock()
+	ahead = max(ahead, 0)
+	used := int64((ahead + l.interval - 1) / l.interval)
+	return &rateLimitReport{
+		limit:     int64(l.burst),
+		remaining: max(int64(l.burst)-used, 0),
+		reset:     ahead,
+	}
+}
+
+// report is client's tightest quota of requests, and of tokens (input,
+// output or both), nil for none.
+func (q *quotaTracker) report(client string) (requests, tokens *rateLimitReport) {
+	qs := q.t.quotasOf(client)
+	if len(qs) == 0 {
+		return nil, nil
+	}
+	now := q.now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, qt := range qs {
+		u := q.useLocked(client, qt.Period, now)
+		_, reset := quotaPeriod(qt.Period, now)
+		for _, d := range quotaDims(qt, u) {
+			if d.limit <= 0 {
+				continue
+			}
+			r := &rateLimitReport{limit: d.limit, remaining: max(d.limit-d.use, 0), reset: reset.Sub(now)}
+			if d.name == "requests" {
+				requests = tighter(requests, r)
+			} else {
+				tokens = tighter(tokens, r)
+			}
+		}
+	}
+	return requests, tokens
+}
+
+// setRateLimitHeaders reports the proxy's limits of st's request on resp;
+// see above.
+func (p *Proxy) setRateLimitHeaders(resp *http.Response, st *reqState) {
+	if p.opts.RateLimitHeaders == rateLimitHeadersOff {
+		return
+	}
+	var ours [len(rateLimitVariants)]*rateLimitReport
+	if p.rate != nil && st.route.rewrite {
+		ours[0] = p.rate.report(time.Now())
+	}
+	if p.quotas != nil && st.client != nil && (st.route.rewrite || st.route.usage) {
+		requests, tokens := p.quotas.report(st.client.CacheKey)
+		ours[0] = tighter(ours[0], requests)
+		ours[1] = tokens
+	}
+	for i, v := range rateLimitVariants {
+		if ours[i] == nil {
+			continue
+		}
+		set := mergeRateLimit(resp.Header, v, ours[i], p.opts.RateLimitHeaders != rateLimitHeadersProxy)
+		if set {
+			p.rlHeaders.set.Add(1)
+		} else {
+			p.rlHeaders.keptUpstream.Add(1)
+		}
+	}
+}
+
+// mergeRateLimit sets the x-ratelimit-*-variant headers of h to ours,
+// unless merged and h holds an upstream remaining that is no larger, and
+// reports whether it did.
+func mergeRateLimit(h http.Header, variant string, ours *rateLimitReport, merged bool) bool {
+	if merged {
+		if s := h.Get("X-Ratelimit-Remaining-" + variant); s != "" {
+			if n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64); err == nil && n <= ours.remaining {
+				return false
+			}
+		}
+	}
+	h.Set("X-Ratelimit-Limit-"+variant, strconv.FormatInt(ours.limit, 10))
+	h.Set("X-Ratelimit-Remaining-"+variant, strconv.FormatInt(ours.remaining, 10))
+	h.Set("X-Ratelimit-Reset-"+variant, formatRateLimitReset(ours.reset))
+	return true
+}
@@ -0,0 +1,229 @@
+package reserve
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFormatRateLimitReset(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{-time.Second, "0s"},
+		{0, "0s"},
+		{time.Nanosecond, "1ms"},
+		{250 * time.Millisecond, "250ms"},
+		{250*time.Millisecond + 400*time.Microsecond, "250ms"},
+		{999*time.Millisecond + 600*time.Microsecond, "1s"},
+		{time.Second, "1s"},
+		{1499 * time.Millisecond, "1s"},
+		{1500 * time.Millisecond, "2s"},
+		{6 * time.Minute, "6m0s"},
+		{25*time.Hour + 30*time.Minute + 500*time.Millisecond, "25h30m1s"},
+	} {
+		if got := formatRateLimitReset(tc.d); got != tc.want {
+			t.Errorf("formatRateLimitReset(%v) = %q, want %q", tc.d, got, tc.want)
+		}
+	}
+}
+
+func TestTighter(t *testing.T) {
+	a := &rateLimitReport{limit: 10, remaining: 5}
+	b := &rateLimitReport{limit: 100, remaining: 5}
+	c := &rateLimitReport{limit: 100, remaining: 4}
+	for _, tc := range []struct {
+		name       string
+		x, y, want *rateLimitReport
+	}{
+		{"none", nil, nil, nil},
+		{"only the first", a, nil, a},
+		{"only the second", nil, a, a},
+		{"tie", a, b, a},
+		{"second less remaining", a, c, c},
+		{"first less remaining", c, a, c},
+	} {
+		if got := tighter(tc.x, tc.y); got != tc.want {
+			t.Errorf("%s: tighter = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMergeRateLimit(t *testing.T) {
+	ours := &rateLimitReport{limit: 10, remaining: 5, reset: 1500 * time.Millisecond}
+	for _, tc := range []struct {
+		name     string
+		upstream string // X-Ratelimit-Remaining-Requests, "" for none
+		merged   bool
+		set      bool
+	}{
+		{"no upstream value", "", true, true},
+		{"upstream looser", "50", true, true},
+		{"upstream tied", "5", true, false},
+		{"upstream tighter", "1", true, false},
+		{"upstream tighter, spaced", " 1 ", true, false},
+		{"upstream not a number", "lots", true, true},
+		{"upstream tighter, proxy only", "1", false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := http.Header{}
+			if tc.upstream != "" {
+				h.Set("X-Ratelimit-Limit-Requests", "1000")
+				h.Set("X-Ratelimit-Remaining-Requests", tc.upstream)
+				h.Set("X-Ratelimit-Reset-Requests", "20ms")
+			}
+			h.Set("X-Ratelimit-Remaining-Tokens", "7")
+			before := h.Clone()
+			if got := mergeRateLimit(h, "requests", ours, tc.merged); got != tc.set {
+				t.Fatalf("mergeRateLimit = %v, want %v", got, tc.set)
+			}
+			if !tc.set {
+				if !equalHeaders(h, before) {
+					t.Errorf("headers changed to %v with the upstream's kept", h)
+				}
+				return
+			}
+			want := map[string]string{
+				"X-Ratelimit-Limit-Requests":     "10",
+				"X-Ratelimit-Remaining-Requests": "5",
+				"X-Ratelimit-Reset-Requests":     "2s",
+				"X-Ratelimit-Remaining-Tokens":   "7",
+			}
+			for k, v := range want {
+				if got := h.Values(k); len(got) != 1 || got[0] != v {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func equalHeaders(a, b http.Header) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if a.Get(k) != b.Get(k) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRateLimiterReport(t *testing.T) {
+	l := newRateLimiter(Options{RateLimit: 10, RateBurst: 5})
+	now := time.Now()
+	for _, tc := range []struct {
+		ahead     time.Duration // tat after now
+		remaining int64
+		reset     time.Duration
+	}{
+		{-time.Second, 5, 0},
+		{0, 5, 0},
+		{time.Millisecond, 4, time.Millisecond},
+		{100 * time.Millisecond, 4, 100 * time.Millisecond},
+		{101 * time.Millisecond, 3, 101 * time.Millisecond},
+		{500 * time.Millisecond, 0, 500 * time.Millisecond},
+		{time.Second, 0, time.Second},
+	} {
+		l.tat = now.Add(tc.ahead)
+		r := l.report(now)
+		if r.limit != 5 || r.remaining != tc.remaining || r.reset != tc.reset {
+			t.Errorf("tat %v ahead: report %+v, want limit 5, remaining %d, reset %v", tc.ahead, *r, tc.remaining, tc.reset)
+		}
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	u := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ratelimit-Limit-Requests", "1000")
+		w.Header().Set("X-Ratelimit-Remaining-Requests", r.Header.Get("X-Upstream-Remaining"))
+		w.Header().Set("X-Ratelimit-Reset-Requests", "20ms")
+		w.Write([]byte(`{"id":"resp_1"}`))
+	})
+	for _, tc := range []struct {
+		mode, upstream string
+		remaining      string // forwarded X-Ratelimit-Remaining-Requests
+	}{
+		{"merged", "999", "2"},
+		{"merged", "0", "0"},
+		{"proxy", "0", "2"},
+		{"off", "999", "999"},
+	} {
+		t.Run(tc.mode+"/"+tc.upstream, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.RateLimit = 1
+			opts.RateBurst = 3
+			opts.RateLimitHeaders = tc.mode
+			p := newTestProxy(t, opts, u)
+			w := send(p, "POST", "/v1/responses", http.Header{"X-Upstream-Remaining": {tc.upstream}}, `{"input":"hi"}`)
+			if got := w.Header().Get("X-Ratelimit-Remaining-Requests"); got != tc.remaining {
+				t.Errorf("X-Ratelimit-Remaining-Requests = %q, want %q", got, tc.remaining)
+			}
+			if tc.remaining != tc.upstream && w.Header().Get("X-Ratelimit-Limit-Requests") != "3" {
+				t.Errorf("X-Ratelimit-Limit-Requests = %q, want the burst 3", w.Header().Get("X-Ratelimit-Limit-Requests"))
+			}
+			if w.Header().Get("X-Ratelimit-Remaining-Tokens") != "" {
+				t.Error("tokens reported without a token quota")
+			}
+			// a route the rate limit does not apply to is left alone
+			w = send(p, "GET", "/v1/models", http.Header{"X-Upstream-Remaining": {tc.upstream}}, "")
+			if got := w.Header().Get("X-Ratelimit-Remaining-Requests"); got != tc.upstream {
+				t.Errorf("models X-Ratelimit-Remaining-Requests = %q, want the upstream's %q", got, tc.upstream)
+			}
+		})
+	}
+
+	opts := DefaultOptions()
+	opts.Target = u.URL
+	opts.RateLimitHeaders = "tight"
+	if _, err := NewProxy(opts); err == nil {
+		t.Error(`NewProxy took RateLimitHeaders "tight"`)
+	}
+}
+
+func TestQuotaTrackerReport(t *testing.T) {
+	q, err := newQuotaTracker(Options{Quotas: &QuotaTable{
+		Default: []Quota{
+			{Period: "day", Requests: 100, Tokens: 1000},
+			{Period: "month", Requests: 10, InputTokens: 500},
+		},
+		Clients: map[string][]Quota{"exempt": {}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := q.now()
+	q.mu.Lock()
+	day, month := q.useLocked("c", "day", now), q.useLocked("c", "month", now)
+	day.requests, day.input, day.output = 4, 300, 400
+	month.requests, month.input = 4, 450
+	q.mu.Unlock()
+
+	requests, tokens := q.report("c")
+	// the month's 6 requests left under the day's 96, its 50 input tokens
+	// under the day's 300 tokens
+	if requests == nil || requests.limit != 10 || requests.remaining != 6 {
+		t.Errorf("requests report %+v, want the month's 6 of 10", requests)
+	}
+	if tokens == nil || tokens.limit != 500 || tokens.remaining != 50 {
+		t.Errorf("tokens report %+v, want the month's 50 of 500 input tokens", tokens)
+	}
+	if _, reset := quotaPeriod("month", now); requests != nil {
+		if d := reset.Sub(now) - requests.reset; d < 0 || d > time.Minute {
+			t.Errorf("requests reset %v, want the %v to the next month", requests.reset, reset.Sub(now))
+		}
+	}
+
+	// a used up quota reports none remaining, not a negative count
+	q.mu.Lock()
+	month.input = 900
+	q.mu.Unlock()
+	if _, tokens := q.report("c"); tokens == nil || tokens.remaining != 0 {
+		t.Errorf("tokens report %+v past the quota, want 0 remaining", tokens)
+	}
+	if requests, tokens := q.report("exempt"); requests != nil || tokens != nil {
+		t.Errorf("exempt client reported %+v, %+v", requests, tokens)
+	}
+}
@@ -0,0 +1,191 @@
+package reserve
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/ast"
+)
+
+// Stateless requests (store: false) lose the model's reasoning between
+// turns unless the client asks for it back encrypted and passes it in the
+// next turn's input. With Options.ReasoningInclude the proxy asks on the
+// client's behalf, and warns when the response still comes back without.
+
+const encryptedReasoning = "reasoning.encrypted_content"
+
+var (
+	kStore = []byte(`"store"`)
+
+	// set when the request asks for encrypted reasoning and is not stored
+	reasoningExpectKey = NewKey[bool]("reasoning_include")
+
+	errIncludeNotArray = errors.New("include is not an array, left alone")
+)
+
+// reasoningIncludeHook adds reasoning.encrypted_content to include when
+// the body sets store to false, merging with the client's include list.
+func reasoningIncludeHook(r *Request) error {
+	if !r.rw.rr.opts.ReasoningInclude {
+		return nil
+	}
+	var store, include *ast.Node
+	if r.parsed {
+		store, include = r.root.Get("store"), r.root.Get("include")
+	} else {
+		bs := r.Body()
+		if !hasJSONKey(bs, kStore) {
+			return nil
+		}
+		s, _ := sonic.Get(bs, "store")
+		i, _ := sonic.Get(bs, "include")
+		store, include = &s, &i
+	}
+	if store == nil {
+		return nil
+	}
+	if stored, err := store.Bool(); err != nil || stored {
+		return nil
+	}
+
+	switch t := nodeType(include); t {
+	case ast.V_NONE, ast.V_NULL:
+	case ast.V_ARRAY:
+		if includes(include, encryptedReasoning) {
+			reasoningExpectKey.Set(r.State, true)
+			return nil
+		}
+	default:
+		return errIncludeNotArray
+	}
+
+	root, err := r.JSON()
+	if root == nil {
+		return err
+	}
+	v := ast.NewString(encryptedReasoning)
+	if inc := root.Get("include"); nodeType(inc) == ast.V_ARRAY {
+		if err := inc.Add(v); err != nil {
+			return err
+		}
+	} else if _, err := root.Set("include", ast.NewArray([]ast.Node{v})); err != nil {
+		return err
+	}
+	reasoningExpectKey.Set(r.State, true)
+	return nil
+}
+
+func nodeType(n *ast.Node) int {
+	if n == nil || !n.Exists() {
+		return ast.V_NONE
+	}
+	return n.TypeSafe()
+}
+
+// includes reports whether the array n holds the string s.
+func includes(n *ast.Node, s string) bool {
+	vs, err := n.ArrayUseNode()
+	if err != nil {
+		return false
+	}
+	for i := range vs {
+		if v, err := vs[i].String(); err == nil && v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// reasoningIncludeResponse checks a successful response to a request that
+// asked for encrypted reasoning: every reasoning item should carry it.
+// Streams are checked as they pass, once they end.
+func reasoningIncludeResponse(r *Response) error {
+	if ok, _ := reasoningExpectKey.Get(r.State); !ok || r.HTTP.StatusCode != http.StatusOK {
+		return nil
+	}
+	if isEventStream(r.HTTP) {
+		r.HTTP.Body = &reasoningWatch{ReadCloser: r.HTTP.Body, route: r.Route, log: r.Logger()}
+		return nil
+	}
+	bs, err := r.Body()
+	if err != nil {
+		return err
+	}
+	out, err := sonic.Get(bs, "output")
+	if err != nil {
+		return nil
+	}
+	items, err := out.ArrayUseNode()
+	if err != nil {
+		return nil
+	}
+	for i := range items {
+		it := &items[i]
+		if t, _ := it.Get("type").String(); t != "reasoning" {
+			continue
+		}
+		if ec, _ := it.Get("encrypted_content").String(); ec == "" {
+			warnNoEncryptedReasoning(r.Logger(), r.Route)
+			return nil
+		}
+	}
+	return nil
+}
+
+func warnNoEncryptedReasoning(log *slog.Logger, route string) {
+	log.Warn("reasoning came back without encrypted_content, the next stateless turn starts without it",
+		"route", route, "include", encryptedReasoning)
+}
+
+var (
+	kReasoningItem    = []byte(`"type":"reasoning"`)
+	kEncryptedContent = []byte(`"encrypted_content":"`)
+)
+
+// reasoningWatch relays a response stream, noting whether it carried a
+// reasoning item and encrypted content; at the end of the stream it warns
+// when there was reasoning without any. The upstream encodes events
+// compactly, so plain byte matches are enough.
+type reasoningWatch struct {
+	io.ReadCloser
+	route string
+	log   *slog.Logger
+
+	buf       []byte // the tail of the previous read, then the current one
+	reasoning bool
+	encrypted bool
+	reported  bool
+}
+
+func (w *reasoningWatch) Read(p []byte) (int, error) {
+	n, err := w.ReadCloser.Read(p)
+	if !w.encrypted && n > 0 {
+		w.scan(p[:n])
+	}
+	if err == io.EOF && !w.reported {
+		w.reported = true
+		if w.reasoning && !w.encrypted {
+			warnNoEncryptedReasoning(w.log, w.route)
+		}
+	}
+	return n, err
+}
+
+func (w *reasoningWatch) scan(b []byte) {
+	w.buf = append(w.buf, b...)
+	if !w.reasoning && bytes.Contains(w.buf, kReasoningItem) {
+		w.reasoning = true
+	}
+	if bytes.Contains(w.buf, kEncryptedContent) {
+		w.encrypted = true
+	}
+	// keep enough to match a token split across reads
+	keep := max(len(kReasoningItem), len(kEncryptedContent)) - 1
+	if len(w.buf) > keep {
+		w.buf = append(w.buf[:0], w.buf[len(w.buf)-keep:]...)
+	}
+}
@@ -0,0 +1,217 @@
+package reserve
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RecordEntry is one recorded request, a line of a record file.
+type RecordEntry struct {
+	ID        string      `json:"id"`
+	RequestID string      `json:"request_id,omitempty"` // see RequestID; names the file
+	Time      time.Time   `json:"time"`
+	Method    string      `json:"method"`
+	Path      string      `json:"path"`
+	Header    http.Header `json:"header"`
+	Body      string      `json:"body"`
+	Status    int         `json:"status"`
+	Latency   float64     `json:"latency_ms"`
+}
+
+// credential headers never written to a record
+var recordDropHeaders = []string{
+	"Authorization", "X-Api-Key", "Api-Key", "Cookie", "Proxy-Authorization",
+	"Content-Length", "Content-Encoding", "Transfer-Encoding",
+}
+
+// Recorder writes rewritten requests, with their response status and
+// latency, to a directory for later replay. An entry is written to
+// <request id>.jsonl, so the capture of a request a client complains
+// about is found by the X-Request-Id it got back; its id field is a hash
+// of method, path and body, the same for repeats of the same request.
+// Outside a Proxy, without a request id, entries are appended to
+// <id>.jsonl instead.
+type Recorder struct {
+	dir      string
+	sample   float64
+	maxBody  int
+	maxBytes int64
+
+	mu      sync.Mutex
+	written int64
+
+	recorded atomic.Int64
+	skipped  atomic.Int64
+	failed   atomic.Int64
+}
+
+type pendingRecord struct {
+	e     RecordEntry
+	start time.Time
+}
+
+var recordKey = NewKey[*pendingRecord]("record")
+
+// NewRecorder records a sample fraction of requests into dir, skipping
+// bodies over maxBody bytes and stopping once dir holds maxBytes (0
+// disables either cap).
+func NewRecorder(dir string, sample float64, maxBody int, maxBytes int64) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	rec := &Recorder{dir: dir, sample: sample, maxBody: maxBody, maxBytes: maxBytes}
+	// the cap covers what earlier runs left behind
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if fi, err := d.Info(); err == nil {
+				rec.written += fi.Size()
+			}
+		}
+		return nil
+	})
+	return rec, nil
+}
+
+// Hook returns the hook that records; put it last so it sees the body as
+// forwarded.
+func (rec *Recorder) Hook() Hook {
+	return Hook{
+		Name:     "record",
+		Request:  RequestHookFunc(rec.request),
+		Response: ResponseHookFunc(rec.response),
+		OnError:  SkipHook,
+	}
+}
+
+func (rec *Recorder) request(r *Request) error {
+	if rec.sample < 1 && rand.Float64() >= rec.sample {
+		return nil
+	}
+	bs := r.Body()
+	if rec.maxBody > 0 && len(bs) > rec.maxBody {
+		rec.skipped.Add(1)
+		return nil
+	}
+	h := r.HTTP.Header.Clone()
+	for _, k := range recordDropHeaders {
+		h.Del(k)
+	}
+	sum := sha256.New()
+	sum.Write([]byte(r.HTTP.Method + " " + r.HTTP.URL.Path + "\n"))
+	sum.Write(bs)
+	recordKey.Set(r.State, &pendingRecord{
+		e: RecordEntry{
+			ID:        hex.EncodeToString(sum.Sum(nil)[:8]),
+			RequestID: RequestID(r.HTTP.Context()),
+			Time:      time.Now().UTC(),
+			Method:    r.HTTP.Method,
+			Path:      r.HTTP.URL.RequestURI(),
+			Header:    h,
+			Body:      string(bs),
+		},
+		start: time.Now(),
+	})
+	return nil
+}
+
+func (rec *Recorder) response(r *Response) error {
+	pr, ok := recordKey.Get(r.State)
+	if !ok {
+		return nil
+	}
+	pr.e.Status = r.HTTP.StatusCode
+	pr.e.Latency = float64(time.Since(pr.start).Microseconds()) / 1000
+	rec.write(&pr.e)
+	return nil
+}
+
+func (rec *Recorder) write(e *RecordEntry) {
+	line, err := sonicAPI.Marshal(e)
+	if err != nil {
+		rec.failed.Add(1)
+		return
+	}
+	line = append(line, '\n')
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.maxBytes > 0 && rec.written+int64(len(line)) > rec.maxBytes {
+		rec.skipped.Add(1)
+		return
+	}
+	name := e.RequestID
+	if name == "" {
+		name = e.ID
+	}
+	f, err := os.OpenFile(filepath.Join(rec.dir, name+".jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err == nil {
+		_, err = f.Write(line)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		rec.failed.Add(1)
+		slog.Warn("record write failed", "error", err)
+		return
+	}
+	rec.written += int64(len(line))
+	rec.recorded.Add(1)
+}
+
+func (rec *Recorder) Stats() any {
+	rec.mu.Lock()
+	written := rec.written
+	rec.mu.Unlock()
+	return map[string]any{
+		"dir":       rec.dir,
+		"sample":    rec.sample,
+		"bytes":     written,
+		"max_bytes": rec.maxBytes,
+		"recorded":  rec.recorded.Load(),
+		"skipped":   rec.skipped.Load(),
+		"failed":    rec.failed.Load(),
+	}
+}
+
+// ReadRecords reads every entry of the record files in dir.
+func ReadRecords(dir string) ([]RecordEntry, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	var out []RecordEntry
+	for _, f := range files {
+		bs, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		for len(bs) > 0 {
+			line := bs
+			if i := bytes.IndexByte(bs, '\n'); i >= 0 {
+				line, bs = bs[:i], bs[i+1:]
+			} else {
+				bs = nil
+			}
+			if len(line) == 0 {
+				continue
+			}
+			var e RecordEntry
+			if err := sonicAPI.Unmarshal(line, &e); err != nil {
+				return nil, &os.PathError{Op: "parse", Path: f, Err: err}
+			}
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
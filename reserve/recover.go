@@ -0,0 +1,59 @@
+package reserve
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+const panicKeysMax = 32
+
+var errRewriteFailed = &httpError{
+	status: http.StatusBadRequest,
+	code:   "invalid_request_body",
+	msg:    "request body could not be processed by the proxy",
+}
+
+// recoverRewrite cleans up after a panic in a body rewrite. It logs the
+// body's shape (length and top-level keys, never content), returns the
+// pooled buffers, and forwards the original body when it was fully read;
+// otherwise the body is gone and the request fails with 400.
+func recoverRewrite(rw *bodyRewrite, p any) error {
+	rw.rr.panics.Add(1)
+
+	var (
+		n    int
+		keys []string
+	)
+	if rw.orig != nil {
+		n = rw.orig.Len()
+		keys = topLevelKeys(rw.orig.Bytes(), panicKeysMax)
+	}
+	logOf(rw.req.Context()).Error("rewrite panic",
+		"panic", p,
+		"path", rw.req.URL.Path,
+		"body_len", n,
+		"keys", keys,
+		"stack", string(debug.Stack()),
+	)
+
+	if rw.done {
+		return nil
+	}
+	if rw.out != nil {
+		putBuf(rw.out)
+		rw.out = nil
+	}
+	if rw.orig != nil && rw.intact {
+		return rw.keep()
+	}
+	return rw.fail(errRewriteFailed)
+}
+
+func (rr *Rewriter) rewriteStats() any {
+	return map[string]any{
+		"panics":                    rr.panics.Load(),
+		"abandoned_before_upstream": rr.abandoned.Load(),
+		"path_fast":                 rr.paths.fast.Load(),
+		"path_ast":                  rr.paths.ast.Load(),
+	}
+}
@@ -0,0 +1,91 @@
+package reserve
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type reqStateKey struct{}
+
+// reqState is per-request proxy state, carried in the request context from
+// the handler through the Director, transport and ModifyResponse.
+type reqState struct {
+	start  time.Time
+	cancel context.CancelCauseFunc
+	route  *route          // nil: unmatched path, proxied untouched
+	path   string          // as the client sent it, see target.go
+	client *clientIdentity // set on routes with identify
+	vars   State           // shared by the request's hooks
+	id     string          // see requestid.go
+	log    *slog.Logger    // the default logger with the request_id
+	left   atomic.Bool     // counted as abandoned, see disconnect.go
+	rt     *Runtime
+	// background is set when the forwarded body asks for background: true
+	background bool
+	// inputTokens is the forwarded body's estimate, see tokenizer.go
+	inputTokens int
+
+	conn *connTiming // the upstream connection trace, see conntrace.go
+	// upstream is the one the balancer picked, see balance.go
+	upstream *upstream
+	wide     *wideEvent // nil without Options.WideLog, see wide.go
+	trace    *reqTrace  // nil unless the request asked for it, see trace.go
+
+	// fault is the fault injected into the request, see fault.go
+	fault *FaultRule
+	// capture is set when the client agreed to be captured, see capture.go
+	capture *pendingCapture
+	// fallback is set when the model has a fallback, see fallback.go
+	fallback *fallbackReq
+	// rewrite is set once the body rewrite succeeded, see diagnose.go
+	rewrite *rewriteOutcome
+	// askedGzip is set when the proxy sent the upstream Accept-Encoding:
+	// gzip, gunzip when the client did not accept gzip itself; see
+	// headers.go and acceptencoding.go
+	askedGzip, gunzip bool
+	// rc sets the connection's read deadline, with Options.BodyReadTimeout;
+	// see clientconns.go
+	rc *http.ResponseController
+
+	// hardCap enforces RequestTimeout; stopped once a stream starts.
+	hardCap *time.Timer
+}
+
+func (p *Proxy) withReqState(r *http.Request) (*http.Request, *reqState) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	st := &reqState{start: time.Now(), cancel: cancel, rt: p.rewriter.runtime.load(), id: p.requestID(r)}
+	st.log = slog.Default().With("request_id", st.id)
+	if p.opts.WideLog != nil {
+		st.wide = &wideEvent{}
+	}
+	if d := p.opts.RequestTimeout; d > 0 {
+		st.hardCap = time.AfterFunc(d, func() {
+			p.timeouts.request.Add(1)
+			cancel(errRequestTimeout)
+		})
+	}
+	return r.WithContext(context.WithValue(ctx, reqStateKey{}, st)), st
+}
+
+func stateOf(ctx context.Context) *reqState {
+	st, _ := ctx.Value(reqStateKey{}).(*reqState)
+	return st
+}
+
+// logger is the request's logger, the default one for no request.
+func (st *reqState) logger() *slog.Logger {
+	if st == nil {
+		return slog.Default()
+	}
+	return st.log
+}
+
+func (st *reqState) finish() {
+	if st.hardCap != nil {
+		st.hardCap.Stop()
+	}
+	st.cancel(nil)
+}
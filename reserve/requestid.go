@@ -0,0 +1,136 @@
+package reserve
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Every request gets an id tying together what the client saw, the
+// proxy's log and the upstream's: the client's X-Request-Id when it is a
+// plausible one (up to 128 letters, digits, '.', '_' and '-'), else a new
+// UUIDv7. Every log line of the request carries it as request_id, it goes
+// upstream in Options.RequestIDHeader and back to the client in
+// X-Request-Id, the upstream's own X-Request-Id moving to
+// X-Upstream-Request-Id. The proxy's error bodies, the wide-event record
+// and the recorder's files carry it too.
+
+const (
+	requestIDHeader         = "X-Request-Id"
+	upstreamRequestIDHeader = "X-Upstream-Request-Id"
+	maxRequestIDLen         = 128
+)
+
+type requestIDCounts struct {
+	accepted  atomic.Int64 // the client's id
+	generated atomic.Int64 // none sent
+	malformed atomic.Int64 // one sent but replaced
+}
+
+func (p *Proxy) requestIDStats() any {
+	return map[string]any{
+		"forward_header": p.opts.RequestIDHeader,
+		"accepted":       p.requestIDs.accepted.Load(),
+		"generated":      p.requestIDs.generated.Load(),
+		"malformed":      p.requestIDs.malformed.Load(),
+	}
+}
+
+// requestID is the id of request r: see above.
+func (p *Proxy) requestID(r *http.Request) string {
+	v := r.Header.Get(requestIDHeader)
+	switch {
+	case validRequestID(v):
+		p.requestIDs.accepted.Add(1)
+		return v
+	case v != "":
+		p.requestIDs.malformed.Add(1)
+	default:
+		p.requestIDs.generated.Add(1)
+	}
+	return newUUIDv7()
+}
+
+func validRequestID(v string) bool {
+	if v == "" || len(v) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newUUIDv7 returns a random UUID whose first 48 bits are the Unix time in
+// milliseconds, so ids sort by creation time (RFC 9562).
+func newUUIDv7() string {
+	var b [16]byte
+	ms := time.Now().UnixMilli()
+	for i := range 6 {
+		b[i] = byte(ms >> (40 - 8*i))
+	}
+	_, _ = rand.Read(b[6:])
+	b[6] = b[6]&0x0f | 0x70 // version 7
+	b[8] = b[8]&0x3f | 0x80 // RFC 9562 variant
+	var s [36]byte
+	hex.Encode(s[0:8], b[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], b[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], b[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], b[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], b[10:])
+	return string(s[:])
+}
+
+// RequestID returns the id of the request ctx belongs to, "" outside a
+// request the Proxy serves.
+func RequestID(ctx context.Context) string {
+	if st := stateOf(ctx); st != nil {
+		return st.id
+	}
+	return ""
+}
+
+// logOf is the logger of the request ctx belongs to, which adds its
+// request_id, or the default logger outside a request.
+func logOf(ctx context.Context) *slog.Logger {
+	return stateOf(ctx).logger()
+}
+
+var errBadGateway = &httpError{
+	status: http.StatusBadGateway,
+	code:   "upstream_unreachable",
+	msg:    "the upstream request failed",
+}
+
+// forwardRequestID sends the request's id upstream in
+// Options.RequestIDHeader; run in the Director.
+func (p *Proxy) forwardRequestID(r *http.Request) {
+	if h := p.opts.RequestIDHeader; h != "" {
+		if st := stateOf(r.Context()); st != nil {
+			r.Header.Set(h, st.id)
+		}
+	}
+}
+
+// markUpstreamRequestID moves the upstream's request id of resp out of
+// the way of the proxy's.
+func markUpstreamRequestID(resp *http.Response, id string) {
+	if v := resp.Header.Get(requestIDHeader); v != "" {
+		resp.Header.Del(requestIDHeader)
+		if v != id {
+			resp.Header.Set(upstreamRequestIDHeader, v)
+		}
+	}
+}
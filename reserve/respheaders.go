@@ -0,0 +1,228 @@
+package reserve
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bytedance/sonic"
+)
+
+// Whatever the upstream and the CDNs before it add to a response (server
+// banners, tracing ids, cookies, cache diagnostics) reaches the clients
+// unless the proxy takes it off. A ResponseHeaderPolicy does, on the
+// upstream's headers, before the proxy adds its own: in ResponseAllow
+// mode only the listed headers pass, in ResponseDeny mode the listed ones
+// are dropped, and a route may have its own list or mode. The headers a
+// client needs to read the body at all (Content-Type, Content-Length,
+// Content-Encoding) always pass, and so do the caching and buffering hints
+// of an event stream; hop-by-hop headers are net/http's. The policy is
+// part of the Runtime, so the admin API can replace it while serving.
+
+// Modes of a ResponseHeaderPolicy.
+const (
+	ResponseAllow = "allow"
+	ResponseDeny  = "deny"
+	ResponseOff   = "off"
+)
+
+// most header names the dropped counts are kept for, the rest as "other"
+const maxDroppedHeaderNames = 128
+
+var (
+	// always passed: without them the body can't be read
+	responseBodyHeaders = []string{"Content-Type", "Content-Length", "Content-Encoding"}
+	// passed on event streams: without them a cache or a reverse proxy on
+	// the way may buffer the stream
+	responseStreamHeaders = []string{"Cache-Control", "X-Accel-Buffering"}
+)
+
+// ResponseHeaderPolicy names the upstream response headers passed to the
+// clients. Mode is ResponseAllow, ResponseDeny or ResponseOff (the
+// default); Headers are the names allowed or denied, a trailing * matching
+// any name with that prefix, e.g. "X-Ratelimit-*". Routes gives single
+// routes, by name, their own Headers and, when set, Mode.
+type ResponseHeaderPolicy struct {
+	Mode    string                           `json:"mode,omitempty"`
+	Headers []string                         `json:"headers,omitempty"`
+	Routes  map[string]*ResponseHeaderPolicy `json:"routes,omitempty"`
+
+	names    map[string]bool // Headers, canonical
+	prefixes []string        // Headers ending in *, canonical, the * cut
+}
+
+// LoadResponseHeaderPolicy reads a ResponseHeaderPolicy from the JSON
+// file at path and validates it.
+func LoadResponseHeaderPolicy(path string) (*ResponseHeaderPolicy, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	h := &ResponseHeaderPolicy{}
+	if err := sonic.Unmarshal(bs, h); err != nil {
+		return nil, err
+	}
+	if err := h.Validate(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Validate reports the first invalid value of h, and readies it for use.
+func (h *ResponseHeaderPolicy) Validate() error {
+	if err := h.compile(); err != nil {
+		return err
+	}
+	for name, rh := range h.Routes {
+		if rh == nil {
+			continue
+		}
+		if len(rh.Routes) > 0 {
+			return fmt.Errorf("routes[%q]: routes of a route", name)
+		}
+		if err := rh.compile(); err != nil {
+			return fmt.Errorf("routes[%q]: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (h *ResponseHeaderPolicy) compile() error {
+	switch h.Mode {
+	case "", ResponseAllow, ResponseDeny, ResponseOff:
+	default:
+		return fmt.Errorf("mode %q: want %q, %q or %q", h.Mode, ResponseAllow, ResponseDeny, ResponseOff)
+	}
+	h.names, h.prefixes = map[string]bool{}, nil
+	for _, k := range h.Headers {
+		k = strings.TrimSpace(k)
+		prefix, wild := strings.CutSuffix(k, "*")
+		if prefix == "" || strings.ContainsAny(prefix, " :*") {
+			return fmt.Errorf("headers: %q is not a header name", k)
+		}
+		if wild {
+			h.prefixes = append(h.prefixes, http.CanonicalHeaderKey(prefix))
+		} else {
+			h.names[http.CanonicalHeaderKey(k)] = true
+		}
+	}
+	return nil
+}
+
+// String is h in brief, for the log of a runtime change.
+func (h *ResponseHeaderPolicy) String() string {
+	if h == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%s%v routes=%d", cmp.Or(h.Mode, ResponseOff), h.Headers, len(h.Routes))
+}
+
+// forRoute is the policy of route and its mode.
+func (h *ResponseHeaderPolicy) forRoute(route string) (*ResponseHeaderPolicy, string) {
+	mode := h.Mode
+	if rh := h.Routes[route]; rh != nil {
+		if rh.Mode != "" {
+			mode = rh.Mode
+		}
+		h = rh
+	}
+	return h, mode
+}
+
+// lists reports whether the canonical header name k is among h's Headers.
+func (h *ResponseHeaderPolicy) lists(k string) bool {
+	if h.names[k] {
+		return true
+	}
+	for _, p := range h.prefixes {
+		if strings.HasPrefix(k, p) {
+			return true
+		}
+	}
+	return false
+}
+
+type responseHeaderCounts struct {
+	responses atomic.Int64 // responses a header was dropped from
+	dropped   atomic.Int64 // headers dropped
+
+	mu     sync.Mutex
+	byName map[string]int64
+}
+
+func (c *responseHeaderCounts) drop(names []string) {
+	c.responses.Add(1)
+	c.dropped.Add(int64(len(names)))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.byName == nil {
+		c.byName = map[string]int64{}
+	}
+	for _, k := range names {
+		if _, ok := c.byName[k]; !ok && len(c.byName) >= maxDroppedHeaderNames {
+			k = "other"
+		}
+		c.byName[k]++
+	}
+}
+
+func (p *Proxy) responseHeaderStats() any {
+	out := map[string]any{"mode": ResponseOff}
+	if h := p.rewriter.runtime.load().ResponseHeaders; h != nil {
+		out["mode"] = cmp.Or(h.Mode, ResponseOff)
+		out["headers"] = len(h.Headers)
+		out["routes"] = len(h.Routes)
+	}
+	c := &p.respHeaders
+	out["responses"] = c.responses.Load()
+	out["dropped"] = c.dropped.Load()
+	c.mu.Lock()
+	out["by_name"] = maps.Clone(c.byName)
+	c.mu.Unlock()
+	return out
+}
+
+// filterResponseHeaders applies the request's ResponseHeaderPolicy to the
+// upstream's headers of resp; see above.
+func (p *Proxy) filterResponseHeaders(resp *http.Response, st *reqState) {
+	h := st.rt.ResponseHeaders
+	if h == nil {
+		return
+	}
+	route := ""
+	if st.route != nil {
+		route = st.route.name
+	}
+	h, mode := h.forRoute(route)
+	if mode == "" || mode == ResponseOff {
+		return
+	}
+	stream := isEventStream(resp)
+	var dropped []string
+	for k := range resp.Header {
+		if slices.Contains(responseBodyHeaders, k) || stream && slices.Contains(responseStreamHeaders, k) {
+			continue
+		}
+		if h.lists(k) == (mode == ResponseAllow) {
+			continue
+		}
+		delete(resp.Header, k)
+		dropped = append(dropped, k)
+	}
+	if dropped == nil {
+		return
+	}
+	slices.Sort(dropped)
+	p.respHeaders.drop(dropped)
+	st.trace.log("response_headers", "mode", mode, "dropped", dropped)
+	if st.log.Enabled(resp.Request.Context(), slog.LevelDebug) {
+		st.log.Debug("response headers dropped", "route", route, "mode", mode, "dropped", dropped)
+	}
+}
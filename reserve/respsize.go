@@ -0,0 +1,183 @@
+package reserve
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+)
+
+// A misbehaving upstream can answer a request for a few KB with gigabytes
+// the proxy would relay in full. Options.MaxResponseBytes caps the body of
+// a non-streaming response per route: one whose Content-Length is over
+// the cap is answered with a 502 before anything is written, one of
+// unknown length is cut at the cap, the upstream body closed and the cut
+// told in the X-Reserve-Truncated trailer. Options.MaxStreamBytes caps an
+// event stream, much larger as a rule, which on breach ends with a
+// terminal error event like a stream the upstream broke off.
+
+const truncatedTrailer = "X-Reserve-Truncated"
+
+// terminal event of a stream cut at Options.MaxStreamBytes
+var sseStreamTooLargeEvent = []byte("event: error\ndata: " +
+	`{"type":"error","code":"upstream_stream_too_large","message":"upstream stream exceeded the proxy's size limit","param":null}` +
+	"\n\n")
+
+var errUpstreamTooLarge = &httpError{
+	status: http.StatusBadGateway,
+	code:   "upstream_response_too_large",
+	msg:    "the upstream response exceeds the proxy's size limit",
+}
+
+type responseCaps struct {
+	limits map[string]int64 // by route name, "*" for the rest
+	stream int64
+	counts map[string]*responseCapCount // fixed at construction, read-only after
+}
+
+type responseCapCount struct {
+	refused   atomic.Int64 // 502 for an announced length over the cap
+	truncated atomic.Int64 // cut at the cap
+	streams   atomic.Int64 // streams cut at MaxStreamBytes
+}
+
+func newResponseCaps(opts Options) (*responseCaps, error) {
+	c := &responseCaps{limits: map[string]int64{}, stream: opts.MaxStreamBytes}
+	for name, n := range opts.MaxResponseBytes {
+		if name != "*" && name != ndjsonRoute.name && !slices.ContainsFunc(routes, func(rt route) bool { return rt.name == name }) {
+			return nil, fmt.Errorf("reserve: MaxResponseBytes: no route %q", name)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("reserve: MaxResponseBytes: negative cap for %q", name)
+		}
+		if n > 0 {
+			c.limits[name] = n
+		}
+	}
+	if len(c.limits) == 0 && c.stream <= 0 {
+		return nil, nil
+	}
+	c.counts = make(map[string]*responseCapCount, len(routes)+1)
+	for i := range routes {
+		c.counts[routes[i].name] = &responseCapCount{}
+	}
+	c.counts[ndjsonRoute.name] = &responseCapCount{}
+	return c, nil
+}
+
+// limit is the cap of non-streaming responses on route, 0 for none.
+func (c *responseCaps) limit(route string) int64 {
+	if n, ok := c.limits[route]; ok {
+		return n
+	}
+	return c.limits["*"]
+}
+
+func (c *responseCaps) stats() any {
+	if c == nil {
+		return map[string]any{"enabled": false}
+	}
+	byRoute := make(map[string]any, len(c.counts))
+	for name, rc := range c.counts {
+		byRoute[name] = map[string]any{
+			"max_bytes": c.limit(name),
+			"refused":   rc.refused.Load(),
+			"truncated": rc.truncated.Load(),
+			"streams":   rc.streams.Load(),
+		}
+	}
+	return map[string]any{
+		"enabled":          true,
+		"max_stream_bytes": c.stream,
+		"routes":           byRoute,
+	}
+}
+
+// capResponse applies the route's cap to non-streaming response resp; see
+// above. Run last in ModifyResponse, on the body the client gets.
+func (p *Proxy) capResponse(resp *http.Response, st *reqState) error {
+	if p.sizeCaps == nil || st == nil || st.route == nil || isEventStream(resp) {
+		return nil
+	}
+	max := p.sizeCaps.limit(st.route.name)
+	if max <= 0 || resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+	if resp.ContentLength > max {
+		resp.Body.Close()
+		p.sizeCaps.counts[st.route.name].refused.Add(1)
+		st.log.Warn("upstream response over the size limit, refused", "route", st.route.name,
+			"content_length", resp.ContentLength, "max_bytes", max)
+		st.trace.log("response_cap", "refused", true, "content_length", resp.ContentLength, "max_bytes", max)
+		return errUpstreamTooLarge
+	}
+	if resp.ContentLength >= 0 {
+		return nil
+	}
+	if resp.Trailer == nil {
+		resp.Trailer = http.Header{}
+	}
+	// announced up front, set only on a cut
+	resp.Trailer[truncatedTrailer] = nil
+	resp.Body = &cappedBody{rc: resp.Body, resp: resp, left: max, max: max, p: p, st: st}
+	return nil
+}
+
+// cappedBody passes up to max bytes of rc through and ends the body there
+// when rc has more.
+type cappedBody struct {
+	rc   io.ReadCloser
+	resp *http.Response
+	left int64
+	max  int64
+	p    *Proxy
+	st   *reqState
+	cut  bool
+}
+
+func (b *cappedBody) Read(x []byte) (int, error) {
+	if b.cut {
+		return 0, io.EOF
+	}
+	if b.left > 0 {
+		if int64(len(x)) > b.left {
+			x = x[:b.left]
+		}
+		n, err := b.rc.Read(x)
+		b.left -= int64(n)
+		return n, err
+	}
+	// at the cap: one more byte tells a body of exactly max bytes from a
+	// longer one
+	var probe [1]byte
+	n, err := b.rc.Read(probe[:])
+	if n == 0 {
+		return 0, err
+	}
+	b.cut = true
+	b.rc.Close()
+	b.resp.Trailer.Set(truncatedTrailer, strconv.FormatInt(b.max, 10))
+	b.p.sizeCaps.counts[b.st.route.name].truncated.Add(1)
+	b.st.log.Warn("upstream response over the size limit, truncated", "route", b.st.route.name, "max_bytes", b.max)
+	b.st.trace.log("response_cap", "truncated", true, "max_bytes", b.max)
+	return 0, io.EOF
+}
+
+func (b *cappedBody) Close() error { return b.rc.Close() }
+
+// capStream cuts n bytes just read by w to what fits under
+// Options.MaxStreamBytes, and reports whether the stream is over it.
+func (w *streamWatch) capStream(n int) (int, bool) {
+	c := w.p.sizeCaps
+	if c == nil || c.stream <= 0 || w.bytes+int64(n) <= c.stream {
+		return n, false
+	}
+	n = int(c.stream - w.bytes)
+	c.counts[w.st.route.name].streams.Add(1)
+	w.st.log.Warn("upstream stream over the size limit, terminated", "route", w.st.route.name,
+		"max_bytes", c.stream)
+	w.st.trace.log("response_cap", "stream", true, "max_bytes", c.stream)
+	return n, true
+}
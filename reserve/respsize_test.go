@@ -0,0 +1,162 @@
+package reserve
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sizedUpstream answers every request with n bytes, announcing the length
+// or, without known, sending them chunked.
+func sizedUpstream(t *testing.T, n int, known bool) *testUpstream {
+	return newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		if known {
+			w.Header().Set("Content-Length", strconv.Itoa(n))
+		}
+		w.WriteHeader(http.StatusOK)
+		body := bytes.Repeat([]byte("x"), n)
+		for len(body) > 0 {
+			k := min(len(body), 4096)
+			w.Write(body[:k])
+			w.(http.Flusher).Flush()
+			body = body[k:]
+		}
+	})
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	const max = 10000
+	for _, tc := range []struct {
+		name    string
+		n       int
+		known   bool
+		status  int
+		got     int    // bytes the client gets
+		trailer string // X-Reserve-Truncated
+	}{
+		{"known length at the cap", max, true, http.StatusOK, max, ""},
+		{"known length over the cap", max + 1, true, http.StatusBadGateway, -1, ""},
+		{"chunked under the cap", max - 1, false, http.StatusOK, max - 1, ""},
+		{"chunked at the cap", max, false, http.StatusOK, max, ""},
+		{"chunked one over the cap", max + 1, false, http.StatusOK, max, "10000"},
+		{"chunked far over the cap", 50 * max, false, http.StatusOK, max, "10000"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.MaxResponseBytes = map[string]int64{"models": max}
+			p := newTestProxy(t, opts, sizedUpstream(t, tc.n, tc.known))
+			srv := httptest.NewServer(p)
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL + "/v1/models")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			bs, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("reading the body: %v, want a clean end", err)
+			}
+			if resp.StatusCode != tc.status {
+				t.Fatalf("answered %d %.200s, want %d", resp.StatusCode, bs, tc.status)
+			}
+			if tc.got < 0 {
+				if !strings.Contains(string(bs), "upstream_response_too_large") {
+					t.Errorf("error body %s, want upstream_response_too_large", bs)
+				}
+			} else if len(bs) != tc.got {
+				t.Errorf("client got %d bytes, want %d", len(bs), tc.got)
+			}
+			if got := resp.Trailer.Get(truncatedTrailer); got != tc.trailer {
+				t.Errorf("%s trailer = %q, want %q", truncatedTrailer, got, tc.trailer)
+			}
+
+			rc := p.sizeCaps.counts["models"]
+			refused, truncated := int64(0), int64(0)
+			if tc.status == http.StatusBadGateway {
+				refused = 1
+			}
+			if tc.trailer != "" {
+				truncated = 1
+			}
+			if rc.refused.Load() != refused || rc.truncated.Load() != truncated {
+				t.Errorf("models counts refused %d, truncated %d, want %d, %d",
+					rc.refused.Load(), rc.truncated.Load(), refused, truncated)
+			}
+		})
+	}
+}
+
+func TestMaxResponseBytesRoutes(t *testing.T) {
+	// the named route's cap over *, * for the rest
+	opts := DefaultOptions()
+	opts.MaxResponseBytes = map[string]int64{"models": 100, "*": 10}
+	p := newTestProxy(t, opts, sizedUpstream(t, 50, true))
+	if w := send(p, "GET", "/v1/models", nil, ""); w.Code != http.StatusOK || w.Body.Len() != 50 {
+		t.Errorf("models answered %d with %d bytes, want the 50 under its cap", w.Code, w.Body.Len())
+	}
+	if w := send(p, "GET", "/v1/files", nil, ""); w.Code != http.StatusBadGateway {
+		t.Errorf("files answered %d, want 502 over the * cap", w.Code)
+	}
+
+	for _, bad := range []map[string]int64{{"nope": 1}, {"models": -1}} {
+		opts := DefaultOptions()
+		opts.Target = "http://127.0.0.1:1"
+		opts.MaxResponseBytes = bad
+		if _, err := NewProxy(opts); err == nil {
+			t.Errorf("NewProxy took MaxResponseBytes %v", bad)
+		}
+	}
+}
+
+func TestMaxStreamBytes(t *testing.T) {
+	event := "event: response.output_text.delta\ndata: {\"type\":\"response.output_text.delta\",\"delta\":\"x\"}\n\n"
+	for _, tc := range []struct {
+		name string
+		n    int // events sent
+		max  int64
+		cut  bool
+	}{
+		{"under the cap", 3, int64(4*len(event)) - 1, false},
+		{"at the cap", 4, int64(4 * len(event)), false},
+		{"over the cap", 5, int64(4*len(event)) + 10, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				w.Header().Set("Content-Type", "text/event-stream")
+				for range tc.n {
+					io.WriteString(w, event)
+					w.(http.Flusher).Flush()
+				}
+			})
+			opts := DefaultOptions()
+			opts.MaxStreamBytes = tc.max
+			p := newTestProxy(t, opts, u)
+			w := send(p, "POST", "/v1/responses", nil, `{"input":"hi","stream":true}`)
+			bs := w.Body.Bytes()
+			want := strings.Repeat(event, tc.n)
+			if tc.cut {
+				// the bytes under the cap, the event cut short of ended,
+				// the error event
+				want = want[:tc.max] + "\n\n" + string(sseStreamTooLargeEvent)
+			}
+			if string(bs) != want {
+				t.Errorf("client got\n%q\nwant\n%q", bs, want)
+			}
+			cut := int64(0)
+			if tc.cut {
+				cut = 1
+			}
+			if got := p.sizeCaps.counts["responses"].streams.Load(); got != cut {
+				t.Errorf("responses streams cut = %d, want %d", got, cut)
+			}
+		})
+	}
+}
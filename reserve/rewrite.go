@@ -0,0 +1,714 @@
+package reserve
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/ast"
+)
+
+var (
+	// sonic encoder: avoid trailing '\n'; sort map keys so translated
+	// bodies (built as maps) come out byte-identical on every run
+	sonicAPI = sonic.Config{NoEncoderNewline: true, SortMapKeys: true}.Froze()
+
+	// fast-path keys (need to confirm ':' after optional whitespace)
+	kInstrKey       = []byte(`"instructions"`)
+	kPromptCacheKey = []byte(`"prompt_cache_key"`)
+	kPrevRespIDKey  = []byte(`"previous_response_id"`)
+	kConversation   = []byte(`"conversation"`)
+
+	// dropped from the front of request bodies, see trimBOM
+	utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+	// ErrClientGone is returned when the client disconnected while its body
+	// was being read or rewritten; there is nobody left to answer.
+	ErrClientGone = errors.New("client disconnected")
+
+	errBodyRead = &httpError{
+		status: http.StatusBadRequest,
+		code:   "request_body_read_failed",
+		msg:    "failed to read request body",
+	}
+)
+
+// Rewriter rewrites Responses API request bodies: it injects a stable
+// prompt_cache_key derived from the client's credential and moves
+// top-level instructions into input as a developer message. It is safe for
+// concurrent use.
+type Rewriter struct {
+	opts   Options
+	hooks  []Hook
+	mounts []string
+	// ndjsonPaths are matched under each mount, like the route table
+	ndjsonPaths []string
+	budget      *byteBudget
+	clients     *clientCache
+	runtime     runtimeConfig
+	validate    map[string]bool // routes of Options.ValidateRoutes
+
+	bodyTooLarge atomic.Int64
+	panics       atomic.Int64
+	// requests whose client left before they were sent upstream
+	abandoned atomic.Int64
+	// abandoned requests by phase, see disconnect.go
+	disconnects disconnectCounts
+	// bodies that stalled past BodyReadTimeout
+	bodyTimeouts atomic.Int64
+	// rewritten bodies by path: bytes only, or parsed into an AST
+	paths struct {
+		fast atomic.Int64
+		ast  atomic.Int64
+	}
+	batch          batchCounts
+	ndjson         ndjsonCounts
+	spill          spillCounts
+	clientIP       clientIPCounts
+	window         windowCounts
+	systemRole     systemRoleCounts
+	canonical      canonicalCounts
+	policy         policyCounts
+	unwrap         unwrapCounts
+	contentTypes   contentTypeCounts
+	tolerant       tolerantCounts
+	staleReasoning staleReasoningCounts
+	schema         schemaCounts
+	jsonLimits     struct {
+		depth       atomic.Int64
+		keys        atomic.Int64
+		parseBudget atomic.Int64
+	}
+}
+
+// NewRewriter builds a Rewriter; the Proxy-only fields of opts are ignored.
+func NewRewriter(opts Options) *Rewriter {
+	hooks := opts.Hooks
+	if hooks == nil {
+		hooks = DefaultHooks()
+	}
+	rr := &Rewriter{
+		opts:        opts,
+		hooks:       hooks,
+		mounts:      normalizeMounts(opts.Mounts),
+		ndjsonPaths: normalizeNDJSONPaths(opts.NDJSONPaths),
+		validate:    validateRouteSet(opts.ValidateRoutes),
+		budget:      newByteBudget(opts.BodyBudget, opts.BodyBudgetWait),
+		clients:     newClientCache(opts.ClientCacheSize, opts.ClientCacheTTL),
+	}
+	rt := &Runtime{InstructionsRewrite: opts.InstructionsRewrite, ResponseHeaders: opts.ResponseHeaders}
+	if opts.LogLevel != nil {
+		rt.LogLevel = opts.LogLevel.Level().String()
+		rr.runtime.level = opts.LogLevel
+	}
+	rr.runtime.p.Store(rt)
+	noteIdentityAddr(opts)
+	return rr
+}
+
+// Result describes what RewriteRequest did.
+type Result struct {
+	// Route is the matched route's name, "" when the request is not one the
+	// proxy handles (it should be forwarded untouched).
+	Route string
+	// Rewritten reports that req.Body was replaced with a rewritten body.
+	// When false the body is forwarded as the client sent it, though it
+	// may have been buffered and decompressed.
+	Rewritten bool
+	// Applied names the hooks that edited the body, in order.
+	Applied []string
+}
+
+// RewriteRequest matches req against the route table and rewrites its body
+// in place when the route calls for it. On error the body has been
+// consumed (or, for a method the route's path doesn't allow, left unread)
+// and req must not be forwarded: answer it with WriteError, or drop it
+// when the error is ErrClientGone.
+func (rr *Rewriter) RewriteRequest(req *http.Request) (Result, error) {
+	rt := rr.matchRoute(req.Method, req.URL.Path)
+	if rt == nil {
+		if rt, he := rr.methodRefusal(req.Method, req.URL.Path); he != nil {
+			return Result{Route: rt.name}, he
+		}
+		return Result{}, nil
+	}
+	res := Result{Route: rt.name}
+	if rt.batch {
+		res.Rewritten = rr.rewriteBatchUpload(req)
+		return res, nil
+	}
+	if rt.ndjson {
+		res.Rewritten = rr.rewriteNDJSON(req)
+		return res, nil
+	}
+	if !rt.rewrite {
+		return res, nil
+	}
+	rw, err := rr.tweakBodySonic(req, rt)
+	res.Rewritten, res.Applied = rw.rewritten, rw.applied
+	return res, err
+}
+
+// setBody installs b as the request body; the pooled body takes over the
+// budget lease and returns both on Close.
+func setBody(req *http.Request, b *bytes.Buffer, lease *budgetLease) {
+	bs := b.Bytes()
+	lease.resize(len(bs))
+	req.Body = &pooledBody{r: bytes.NewReader(bs), b: b, lease: lease.detach()}
+	req.ContentLength = int64(len(bs))
+	req.Header.Set("Content-Length", strconv.Itoa(len(bs)))
+	req.Header.Del("Transfer-Encoding")
+	req.TransferEncoding = nil
+
+	// The whole body is buffered, so 100-continue negotiation with the
+	// upstream is moot (the client already got its 100 from net/http when we
+	// read the body). Forwarding Expect would only risk stalling for
+	// ExpectContinueTimeout on upstreams that never answer it.
+	req.Header.Del("Expect")
+}
+
+func isWS(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' }
+
+// fast-path: find `"key"` and ensure next non-ws char is ':'
+func hasJSONKey(bs []byte, key []byte) bool {
+	for off := 0; ; {
+		idx := bytes.Index(bs[off:], key)
+		if idx < 0 {
+			return false
+		}
+		pos := off + idx + len(key)
+		for pos < len(bs) && isWS(bs[pos]) {
+			pos++
+		}
+		if pos < len(bs) && bs[pos] == ':' {
+			return true
+		}
+		off = off + idx + 1
+	}
+}
+
+func bytesToString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
+
+// trimBOM drops a leading UTF-8 BOM (and nothing else). JSON text must not
+// carry one (RFC 8259), and some Windows clients add it anyway, which would
+// otherwise make every rewrite fall through. It is dropped rather than
+// preserved so the forwarded body is plain JSON whichever path ran.
+func trimBOM(bs []byte) []byte { return bytes.TrimPrefix(bs, utf8BOM) }
+
+// Pure byte insertion for prompt_cache_key at the start of a JSON object.
+// Requires: prompt_cache_key missing AND we don't need to rewrite instructions.
+func injectPromptCacheKeyFast(bs []byte, key string) (*bytes.Buffer, bool) {
+	bs = trimBOM(bs)
+
+	// skip leading whitespace
+	i := 0
+	for i < len(bs) && isWS(bs[i]) {
+		i++
+	}
+	if i >= len(bs) || bs[i] != '{' {
+		return nil, false
+	}
+
+	out := getBuf(len(bs) + len(key) + 32)
+
+	// write up to and including '{'
+	out.Write(bs[:i+1])
+
+	// write `"prompt_cache_key":"<key>"`
+	out.WriteString(`"prompt_cache_key":"`)
+	out.WriteString(key)
+	out.WriteByte('"')
+
+	// detect empty object: next non-ws after '{' is '}'
+	j := i + 1
+	for j < len(bs) && isWS(bs[j]) {
+		j++
+	}
+	if j < len(bs) && bs[j] == '}' {
+		out.Write(bs[j:])
+		return out, true
+	}
+
+	// non-empty object
+	out.WriteByte(',')
+	out.Write(bs[i+1:])
+	return out, true
+}
+
+// bodyRewrite owns the buffers of one request body rewrite. orig holds the
+// body exactly as read (decompressed) and is never written to, so every
+// fallback can forward it; it lives until one of the outcomes runs:
+//
+//	keep    forward orig
+//	install forward a rewritten buffer, return orig to the pool
+//	fail    forward nothing, the handler answers with the error
+//
+// Anything not handed off by then is returned by cleanup.
+type bodyRewrite struct {
+	rr    *Rewriter
+	rt    *Runtime // the request's snapshot
+	req   *http.Request
+	route *route
+	lease budgetLease
+
+	orig   *bytes.Buffer
+	intact bool       // orig holds the complete body, or its head and spill the rest
+	spill  *spillFile // the body past SpillThreshold, see spill.go
+	out    *bytes.Buffer
+	done   bool
+
+	rewritten bool // the forwarded body differs from the client's
+	applied   []string
+
+	// for the upstream error diagnostics, see diagnose.go
+	path          string
+	before, after int
+	sums          *bodySums
+}
+
+func (rw *bodyRewrite) keep() error {
+	if rw.spill != nil {
+		setSpillBody(rw.req, rw.orig, rw.spill, &rw.lease)
+	} else {
+		setBody(rw.req, rw.orig, &rw.lease)
+	}
+	rw.orig, rw.spill, rw.done = nil, nil, true
+	return nil
+}
+
+func (rw *bodyRewrite) install(out *bytes.Buffer) error {
+	if rw.orig != nil {
+		putBuf(rw.orig)
+	}
+	setBody(rw.req, out, &rw.lease)
+	rw.orig, rw.out, rw.done = nil, nil, true
+	return nil
+}
+
+func (rw *bodyRewrite) fail(err error) error {
+	rw.cleanup()
+	rw.done = true
+	return err
+}
+
+// cur is the body as it stands: the latest rewrite, or orig.
+func (rw *bodyRewrite) cur() *bytes.Buffer {
+	if rw.out != nil {
+		return rw.out
+	}
+	return rw.orig
+}
+
+// setOut replaces the current rewrite with out.
+func (rw *bodyRewrite) setOut(out *bytes.Buffer) {
+	if rw.out != nil {
+		putBuf(rw.out)
+	}
+	rw.out = out
+}
+
+// retire swaps the current buffer for a copy while something (an abandoned
+// parse) still reads it; the buffer goes back to the pool once busy is
+// closed.
+func (rw *bodyRewrite) retire(busy <-chan struct{}) {
+	old := rw.cur()
+	cp := getBuf(old.Len())
+	cp.Write(old.Bytes())
+	if rw.out != nil {
+		rw.out = cp
+	} else {
+		rw.orig = cp
+	}
+	go func() { <-busy; putBuf(old) }()
+}
+
+func (rw *bodyRewrite) cleanup() {
+	if rw.out != nil {
+		putBuf(rw.out)
+		rw.out = nil
+	}
+	if rw.orig != nil {
+		putBuf(rw.orig)
+		rw.orig = nil
+	}
+	if rw.spill != nil {
+		rw.spill.Close()
+		rw.spill = nil
+	}
+	rw.lease.release()
+}
+
+// read buffers the request body into rw.orig. rewritable is false when the
+// body must be forwarded as-is: a gzip body that doesn't decompress goes
+// upstream still compressed, byte for byte, and lets the upstream answer.
+// A body that can't be read in full is gone, so that is an error.
+func (rw *bodyRewrite) read() (rewritable bool, err error) {
+	req := rw.req
+
+	// pre-grow based on Content-Length if available; chunked bodies fall
+	// back to the recent-size percentile
+	hint := 0
+	if req.ContentLength > 0 && req.ContentLength <= int64(largeKeepCap) {
+		hint = int(req.ContentLength)
+	}
+	ctx := req.Context()
+	withBodyDeadline(req, rw.rr.opts.BodyReadTimeout)
+	spill := rw.canSpill()
+	if spill {
+		hint = min(hint, int(rw.rr.opts.SpillThreshold)+1)
+	}
+	raw := getBuf(hint)
+	if spill {
+		rw.spill, err = rw.readSpill(ctx, raw)
+	} else {
+		err = rw.rr.readBody(ctx, raw, req.Body)
+	}
+	req.Body.Close()
+	if err != nil {
+		dropBuf(raw, err)
+		switch {
+		case err == errBodyTooLarge, err == errSpill:
+			return false, err
+		case bodyExpired(req.Body):
+			rw.rr.bodyTimeouts.Add(1)
+			return false, errBodyTimeout
+		case ctx.Err() != nil:
+			rw.rr.clientLeft(ctx, leftUpload)
+			return false, ErrClientGone
+		}
+		return false, errBodyRead
+	}
+
+	tr := traceOf(ctx)
+	if req.Header.Get("Content-Encoding") != "gzip" {
+		rw.orig, rw.intact = raw, true
+		tr.log("body_read", "bytes", raw.Len(), "spilled", rw.spill != nil)
+		return true, nil
+	}
+
+	// the size cap applies to decompressed bytes; decompressed size is
+	// unknown up front, so pre-grow from history
+	zr, _, err := getGzipReader(bytes.NewReader(raw.Bytes()))
+	if err == nil {
+		b := getBuf(0)
+		err = rw.rr.readBody(ctx, b, zr)
+		putGzipReader(zr)
+		if err == nil {
+			tr.log("body_read", "bytes", raw.Len(), "gzip", true, "decoded", b.Len())
+			putBuf(raw)
+			req.Header.Del("Content-Encoding")
+			rw.orig, rw.intact = b, true
+			return true, nil
+		}
+		dropBuf(b, err)
+		switch {
+		case err == errBodyTooLarge:
+			putBuf(raw)
+			return false, err
+		case ctx.Err() != nil:
+			putBuf(raw)
+			rw.rr.clientLeft(ctx, leftUpload)
+			return false, ErrClientGone
+		}
+	}
+	logOf(rw.req.Context()).Warn("gzip request body does not decompress, forwarding as-is", "error", err)
+	rw.orig, rw.intact = raw, true
+	return false, nil
+}
+
+// tweakBodySonic buffers and rewrites req's body. The returned bodyRewrite
+// only reports the outcome; its buffers have been handed off.
+func (rr *Rewriter) tweakBodySonic(req *http.Request, rt *route) (rw *bodyRewrite, err error) {
+	rw = &bodyRewrite{rr: rr, rt: rr.runtime.load(), req: req, route: rt}
+	if req.Body == nil {
+		return rw, nil
+	}
+	if ok, mt := jsonBody(req.Header.Get("Content-Type")); !ok {
+		if rt.chat {
+			// nothing upstream answers a chat.completions body
+			return rw, errChatBody
+		}
+		rr.contentTypes.bypass(req, rt, mt)
+		return rw, nil
+	}
+
+	// declared too large: reject before reserving or reading anything
+	if rr.opts.MaxBody > 0 && req.ContentLength > rr.opts.MaxBody {
+		rr.bodyTooLarge.Add(1)
+		return rw, errBodyTooLarge
+	}
+
+	// reserve budget before reading anything; exact size is settled in
+	// setBody. Past SpillThreshold the body is on disk and not counted.
+	n := req.ContentLength
+	if rw.canSpill() {
+		n = min(n, rr.opts.SpillThreshold)
+	}
+	if rw.lease, err = rr.budget.acquire(req.Context(), n); err != nil {
+		return rw, err
+	}
+	if st := stateOf(req.Context()); st != nil {
+		rw.rt = st.rt
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = recoverRewrite(rw, p)
+		}
+		if !rw.done {
+			rw.cleanup()
+		}
+		if err != nil {
+			rw.rewritten, rw.applied = false, nil
+		}
+		if err == ErrClientGone {
+			rr.abandoned.Add(1)
+		}
+	}()
+
+	rewritable, err := rw.read()
+	if err != nil {
+		return rw, rw.fail(err)
+	}
+	if !rewritable {
+		if rt.chat {
+			// nothing upstream answers a chat.completions body
+			return rw, rw.fail(errChatBody)
+		}
+		return rw, rw.keep()
+	}
+	if req.Context().Err() != nil {
+		return rw, rw.fail(ErrClientGone)
+	}
+	if bytes.HasPrefix(rw.orig.Bytes(), utf8BOM) {
+		rw.orig.Next(len(utf8BOM)) // setBody forwards orig.Bytes(), now without the BOM
+	}
+	if rw.spill != nil {
+		return rw, rewriteSpilled(rw)
+	}
+	rw.noteBefore()
+	if rr.opts.TolerantJSON {
+		rw.repairBody()
+	}
+	if rr.opts.UnwrapBodies {
+		rw.unwrapBody()
+	}
+	if rt.chat {
+		if err := rw.translateChat(); err != nil {
+			return rw, rw.fail(err)
+		}
+		rw.rewritten = true
+	}
+	return rw, rewriteBody(rw, rw.orig.Bytes())
+}
+
+// rewriteBody runs the request hooks over bs (the buffered orig) and ends
+// in exactly one of rw's outcomes.
+func rewriteBody(rw *bodyRewrite, bs []byte) error {
+	req := rw.req
+	sizeHist.observe(len(bs))
+
+	// 打印 model 和 reasoning.effort
+	var modelStr, effort string
+	if model, _ := sonic.Get(bs, "model"); model.Exists() {
+		modelStr, _ = model.String()
+		if re, _ := sonic.Get(bs, "reasoning", "effort"); re.Valid() {
+			effort, _ = re.String()
+			logOf(rw.req.Context()).Info("request info", "model", modelStr, "reasoning.effort", effort)
+		} else {
+			logOf(rw.req.Context()).Info("request info", "model", modelStr)
+		}
+	}
+	if st := stateOf(req.Context()); st != nil && (st.wide != nil || st.trace != nil) {
+		stream, _ := sonic.Get(bs, "stream")
+		isStream, _ := stream.Bool()
+		st.wide.request(modelStr, effort, isStream, len(bs))
+		st.trace.log("body", "bytes", len(bs), "keys", topLevelKeys(bs, 32),
+			"model", modelStr, "effort", effort, "stream", isStream)
+	}
+
+	r := &Request{HTTP: req, rw: rw}
+	if rw.route != nil {
+		r.Route = rw.route.name
+	}
+	if st := stateOf(req.Context()); st != nil {
+		r.State = &st.vars
+	} else {
+		r.State = &State{}
+	}
+	if err := rw.rr.validateRequest(r); err != nil {
+		return rw.fail(err)
+	}
+	if err := rw.rr.runRequestHooks(r); err != nil {
+		return rw.fail(err)
+	}
+	if rw.rr.opts.CanonicalJSON && !rw.rr.opts.MinimalDiff {
+		r.canonicalize()
+	}
+
+	path := "fast"
+	if r.parses > 0 {
+		path = "ast"
+		rw.rr.paths.ast.Add(1)
+	} else {
+		rw.rr.paths.fast.Add(1)
+	}
+	traceOf(req.Context()).log("rewrite", "path", path, "changed", r.change, "applied", r.applied,
+		"bytes", rw.cur().Len())
+	rw.rewritten, rw.applied = rw.rewritten || r.change, r.applied
+	rw.path = path
+	rw.noteAfter(rw.cur().Bytes())
+	if st := stateOf(req.Context()); st != nil {
+		st.background = isBackground(rw.cur().Bytes())
+		rw.rr.noteEstimate(st, rw.cur().Bytes())
+	}
+	if rw.out == nil {
+		return rw.keep()
+	}
+	return rw.install(rw.out)
+}
+
+// migrateInstructionsHook moves top-level instructions into input, unless
+// the request continues a conversation, by previous_response_id or
+// conversation (avoid re-injecting it every turn and bloating the
+// conversation).
+func migrateInstructionsHook(r *Request) error {
+	if !r.rw.rt.InstructionsRewrite {
+		return nil
+	}
+	bs := r.Body()
+	if !hasJSONKey(bs, kInstrKey) || hasJSONKey(bs, kPrevRespIDKey) || conversationID(bs) != "" {
+		return nil
+	}
+	if ok, err := r.walkable(); !ok {
+		return err
+	}
+
+	// minimal-diff mode: the same edit as byte splices, no re-encode
+	if r.rw.rr.opts.MinimalDiff {
+		if out, ok := spliceRewrite(bs, "", true); ok {
+			if out != nil {
+				r.setBuf(out)
+			}
+			return nil
+		}
+	}
+
+	root, err := r.JSON()
+	if root == nil {
+		return err
+	}
+	migrateInstructions(root)
+	return nil
+}
+
+// promptCacheKeyHook injects prompt_cache_key when the body has none:
+// the conversation's key when it names one, else the client's.
+func promptCacheKeyHook(r *Request) error {
+	if r.parsed {
+		// an earlier hook parsed the body: set it on the AST, encoded once
+		pk := r.root.Get("prompt_cache_key")
+		if pk == nil || !pk.Exists() {
+			conv := conversationNodeID(r.root.Get("conversation"))
+			_, _ = r.root.Set("prompt_cache_key", ast.NewString(r.rw.rr.derivePromptCacheKey(r.HTTP, conv)))
+			r.dirty = true
+			r.edits++
+		}
+		return nil
+	}
+
+	bs := r.Body()
+	if hasJSONKey(bs, kPromptCacheKey) {
+		return nil
+	}
+	// pure byte insertion at the start of the object
+	if out, ok := injectPromptCacheKeyFast(bs, r.rw.rr.derivePromptCacheKey(r.HTTP, conversationID(bs))); ok {
+		r.setBuf(out)
+	}
+	return nil
+}
+
+// conversationID returns the id in the body's top-level conversation, or
+// "". The Conversations API accepts it as a string or as {"id": ...}.
+func conversationID(bs []byte) string {
+	if !hasJSONKey(bs, kConversation) {
+		return ""
+	}
+	n, err := sonic.Get(bs, "conversation")
+	if err != nil {
+		return ""
+	}
+	return conversationNodeID(&n)
+}
+
+func conversationNodeID(n *ast.Node) string {
+	if n == nil || !n.Exists() {
+		return ""
+	}
+	switch n.TypeSafe() {
+	case ast.V_STRING:
+		id, _ := n.String()
+		return id
+	case ast.V_OBJECT:
+		id, _ := n.Get("id").String()
+		return id
+	}
+	return ""
+}
+
+// migrateInstructions moves a top-level string "instructions" into input
+// as a leading developer message.
+func migrateInstructions(root *ast.Node) {
+	ins := root.Get("instructions")
+	if ins == nil || !ins.Exists() || ins.TypeSafe() != ast.V_STRING {
+		return
+	}
+	content := *ins
+	_, _ = root.Unset("instructions")
+
+	// dev = {"role":"developer","content":<ins>}
+	dev := ast.NewObject([]ast.Pair{
+		ast.NewPair("role", ast.NewString("developer")),
+		ast.NewPair("content", content),
+	})
+	prependInput(root, dev)
+}
+
+// prependInput makes item the first input item of root, a string input
+// becoming the user message after it.
+func prependInput(root *ast.Node, item ast.Node) {
+	in := root.Get("input")
+
+	// missing / null
+	if in == nil || !in.Exists() || in.TypeSafe() == ast.V_NULL {
+		_, _ = root.Set("input", ast.NewArray([]ast.Node{item}))
+		return
+	}
+
+	switch in.TypeSafe() {
+	case ast.V_STRING:
+		user := ast.NewObject([]ast.Pair{
+			ast.NewPair("role", ast.NewString("user")),
+			ast.NewPair("content", *in),
+		})
+		_, _ = root.Set("input", ast.NewArray([]ast.Node{item, user}))
+
+	case ast.V_ARRAY:
+		// in-place prepend: Add at end then Move to 0
+		if err := in.Add(item); err == nil {
+			if n, err := in.Len(); err == nil && n > 1 {
+				_ = in.Move(0, n-1)
+			}
+		} else {
+			_, _ = root.Set("input", ast.NewArray([]ast.Node{item}))
+		}
+
+	default:
+		_, _ = root.Set("input", ast.NewArray([]ast.Node{item}))
+	}
+}
@@ -0,0 +1,344 @@
+package reserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bytedance/sonic/ast"
+)
+
+// rewrite runs body through rr as a POST to path and returns the result
+// and the body that would be forwarded.
+func rewrite(t *testing.T, rr *Rewriter, path string, hdr http.Header, body []byte) (Result, []byte) {
+	t.Helper()
+	req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for k, vs := range hdr {
+		req.Header[k] = vs
+	}
+	res, err := rr.RewriteRequest(req)
+	if err != nil {
+		t.Fatalf("RewriteRequest: %v", err)
+	}
+	out, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("reading rewritten body: %v", err)
+	}
+	req.Body.Close()
+	return res, out
+}
+
+// decodeBody unmarshals a forwarded JSON body for assertions.
+func decodeBody(t *testing.T, bs []byte) map[string]any {
+	t.Helper()
+	var m map[string]any
+	if err := json.Unmarshal(bs, &m); err != nil {
+		t.Fatalf("forwarded body %q is not JSON: %v", bs, err)
+	}
+	return m
+}
+
+// cacheKey is the prompt_cache_key a client with credential s gets.
+func cacheKey(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:16])
+}
+
+func bearer(tok string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + tok}}
+}
+
+func TestRewriteRequestPromptCacheKey(t *testing.T) {
+	rr := NewRewriter(DefaultOptions())
+	for _, tc := range []struct {
+		name string
+		hdr  http.Header
+		body string
+		want string
+	}{
+		{"authorization", bearer("sk-a"), `{"model":"gpt-5","input":"hi"}`, cacheKey("Bearer sk-a")},
+		{"x-api-key", http.Header{"X-Api-Key": {"sk-b"}}, `{"input":"hi"}`, cacheKey("sk-b")},
+		{"api-key", http.Header{"Api-Key": {"sk-c"}}, `{"input":"hi"}`, cacheKey("sk-c")},
+		{"authorization wins", http.Header{"Authorization": {"Bearer sk-a"}, "X-Api-Key": {"sk-b"}}, `{"input":"hi"}`, cacheKey("Bearer sk-a")},
+		{"client's key kept", bearer("sk-a"), `{"input":"hi","prompt_cache_key":"mine"}`, "mine"},
+		{"empty object", bearer("sk-a"), `{}`, cacheKey("Bearer sk-a")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, out := rewrite(t, rr, "/v1/responses", tc.hdr, []byte(tc.body))
+			if res.Route != "responses" {
+				t.Errorf("Route = %q, want responses", res.Route)
+			}
+			if got := decodeBody(t, out)["prompt_cache_key"]; got != tc.want {
+				t.Errorf("prompt_cache_key = %v, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRewriteRequestMounts(t *testing.T) {
+	rr := NewRewriter(DefaultOptions())
+	for _, path := range []string{"/v1/responses", "/codex/v1/responses"} {
+		res, out := rewrite(t, rr, path, bearer("sk-a"), []byte(`{"input":"hi"}`))
+		if res.Route != "responses" || !res.Rewritten {
+			t.Errorf("%s: Route = %q, Rewritten = %v", path, res.Route, res.Rewritten)
+			continue
+		}
+		if _, ok := decodeBody(t, out)["prompt_cache_key"]; !ok {
+			t.Errorf("%s: no prompt_cache_key in %s", path, out)
+		}
+	}
+}
+
+func TestRewriteRequestUnmatched(t *testing.T) {
+	rr := NewRewriter(DefaultOptions())
+	body := `{"input":"hi"}`
+	res, out := rewrite(t, rr, "/v2/other", bearer("sk-a"), []byte(body))
+	if res.Route != "" || res.Rewritten {
+		t.Errorf("Result = %+v, want no route", res)
+	}
+	if string(out) != body {
+		t.Errorf("body = %s, want it untouched", out)
+	}
+}
+
+func TestRewriteRequestInstructions(t *testing.T) {
+	rr := NewRewriter(DefaultOptions())
+	_, out := rewrite(t, rr, "/v1/responses", bearer("sk-a"),
+		[]byte(`{"model":"gpt-5","instructions":"be brief","input":"hi"}`))
+	m := decodeBody(t, out)
+	if _, ok := m["instructions"]; ok {
+		t.Errorf("instructions still in %s", out)
+	}
+	in, _ := m["input"].([]any)
+	if len(in) != 2 {
+		t.Fatalf("input = %v, want a developer and a user message", m["input"])
+	}
+	dev, user := in[0].(map[string]any), in[1].(map[string]any)
+	if dev["role"] != "developer" || dev["content"] != "be brief" {
+		t.Errorf("input[0] = %v, want the developer message", dev)
+	}
+	if user["role"] != "user" || user["content"] != "hi" {
+		t.Errorf("input[1] = %v, want the user message", user)
+	}
+	if m["prompt_cache_key"] != cacheKey("Bearer sk-a") {
+		t.Errorf("prompt_cache_key = %v", m["prompt_cache_key"])
+	}
+}
+
+func TestRewriteRequestInstructionsKept(t *testing.T) {
+	rr := NewRewriter(DefaultOptions())
+	for _, body := range []string{
+		`{"instructions":"be brief","input":"hi","previous_response_id":"resp_1"}`,
+		`{"instructions":"be brief","input":"hi","conversation":"conv_1"}`,
+	} {
+		_, out := rewrite(t, rr, "/v1/responses", bearer("sk-a"), []byte(body))
+		if m := decodeBody(t, out); m["instructions"] != "be brief" || m["input"] != "hi" {
+			t.Errorf("%s was migrated to %s", body, out)
+		}
+	}
+}
+
+func TestRewriteRequestMalformed(t *testing.T) {
+	rr := NewRewriter(DefaultOptions())
+	for _, body := range []string{`not json`, `[1,2,3]`, ``} {
+		_, out := rewrite(t, rr, "/v1/responses", bearer("sk-a"), []byte(body))
+		if string(out) != body {
+			t.Errorf("%q forwarded as %q, want it byte for byte", body, out)
+		}
+	}
+	// a broken object only gets the key spliced in after its '{'
+	key := `{"prompt_cache_key":"` + cacheKey("Bearer sk-a") + `",`
+	for _, body := range []string{`{"input":"hi"`, `{"input":"hi",}`} {
+		_, out := rewrite(t, rr, "/v1/responses", bearer("sk-a"), []byte(body))
+		if want := key + body[1:]; string(out) != want {
+			t.Errorf("%s forwarded as %s, want %s", body, out, want)
+		}
+	}
+}
+
+func TestRewriteRequestGzip(t *testing.T) {
+	rr := NewRewriter(DefaultOptions())
+	var zb bytes.Buffer
+	zw := gzip.NewWriter(&zb)
+	zw.Write([]byte(`{"input":"hi"}`))
+	zw.Close()
+
+	req := httptest.NewRequest("POST", "/v1/responses", &zb)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Authorization", "Bearer sk-a")
+	if _, err := rr.RewriteRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if ce := req.Header.Get("Content-Encoding"); ce != "" {
+		t.Errorf("Content-Encoding = %q, want the body forwarded decoded", ce)
+	}
+	out, _ := io.ReadAll(req.Body)
+	if m := decodeBody(t, out); m["prompt_cache_key"] != cacheKey("Bearer sk-a") {
+		t.Errorf("rewritten gzip body = %s", out)
+	}
+	if req.ContentLength != int64(len(out)) {
+		t.Errorf("ContentLength = %d, body is %d bytes", req.ContentLength, len(out))
+	}
+}
+
+func TestRewriteRequestHooks(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Hooks = append(DefaultHooks(), Hook{
+		Name: "tag",
+		Request: RequestHookFunc(func(r *Request) error {
+			root, err := r.JSON()
+			if root == nil {
+				return err
+			}
+			_, err = root.SetAny("metadata", map[string]any{"via": "test"})
+			return err
+		}),
+	})
+	rr := NewRewriter(opts)
+	res, out := rewrite(t, rr, "/v1/responses", bearer("sk-a"), []byte(`{"input":"hi"}`))
+	if got := strings.Join(res.Applied, ","); !strings.HasSuffix(got, "tag") {
+		t.Errorf("Applied = %v, want it to end with tag", res.Applied)
+	}
+	m := decodeBody(t, out)
+	if md, _ := m["metadata"].(map[string]any); md["via"] != "test" {
+		t.Errorf("metadata = %v", m["metadata"])
+	}
+	if m["prompt_cache_key"] != cacheKey("Bearer sk-a") {
+		t.Errorf("prompt_cache_key = %v", m["prompt_cache_key"])
+	}
+}
+
+func TestRewriteRequestHookAbort(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Hooks = []Hook{{
+		Name:    "deny",
+		Request: RequestHookFunc(func(*Request) error { return Abort(http.StatusForbidden, "denied", "no") }),
+		OnError: SkipHook,
+	}}
+	rr := NewRewriter(opts)
+	req := httptest.NewRequest("POST", "/v1/responses", strings.NewReader(`{"input":"hi"}`))
+	req.Header.Set("Content-Type", "application/json")
+	_, err := rr.RewriteRequest(req)
+	w := httptest.NewRecorder()
+	if !WriteError(w, err) {
+		t.Fatalf("RewriteRequest error = %v, want an Abort", err)
+	}
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), `"denied"`) {
+		t.Errorf("answered %d %s", w.Code, w.Body)
+	}
+}
+
+func TestRewriteRequestBOM(t *testing.T) {
+	rr := NewRewriter(DefaultOptions())
+	const bom = "\xef\xbb\xbf"
+	for _, body := range []string{
+		bom + `{"input":"hi"}`,
+		bom + " \r\n\t" + `{"input":"hi"}`,
+		bom + `{"instructions":"be brief","input":"hi"}`,
+	} {
+		_, out := rewrite(t, rr, "/v1/responses", bearer("sk-a"), []byte(body))
+		if bytes.HasPrefix(out, []byte(bom)) {
+			t.Errorf("%q forwarded with its BOM: %q", body, out)
+		}
+		if m := decodeBody(t, out); m["prompt_cache_key"] != cacheKey("Bearer sk-a") {
+			t.Errorf("%q was not rewritten: %s", body, out)
+		}
+	}
+	for _, body := range []string{
+		`[{"input":"hi"}]`, `"hi"`, `42`, `null`, "\xef\xbb" + `{"input":"hi"}`, `x{"input":"hi"}`,
+	} {
+		if _, out := rewrite(t, rr, "/v1/responses", bearer("sk-a"), []byte(body)); string(out) != body {
+			t.Errorf("%q forwarded as %q, want it untouched", body, out)
+		}
+	}
+}
+
+func TestRewriteFallbacks(t *testing.T) {
+	var zb bytes.Buffer
+	zw := gzip.NewWriter(&zb)
+	zw.Write([]byte(`{"input":"` + strings.Repeat("hi", 1000) + `"}`))
+	zw.Close()
+	gz := zb.Bytes()
+
+	// set runs f on the parsed body, as the only hook
+	set := func(f func(root *ast.Node)) []Hook {
+		return []Hook{{Name: "set", Request: RequestHookFunc(func(r *Request) error {
+			if root, _ := r.JSON(); root != nil {
+				f(root)
+			}
+			return nil
+		})}}
+	}
+	for _, tc := range []struct {
+		name  string
+		hooks []Hook // nil for DefaultHooks
+		ce    string
+		body  string
+		lax   bool // only a strict parser takes the branch
+	}{
+		{name: "not gzip", ce: "gzip", body: `{"input":"hi"}`},
+		{name: "truncated gzip", ce: "gzip", body: string(gz[:len(gz)/2])},
+		{name: "gzip trailer", ce: "gzip", body: string(gz[:len(gz)-4])},
+		{
+			name:  "parse error",
+			hooks: set(func(root *ast.Node) { root.Set("x", ast.NewString("y")) }),
+			body:  `{"input":"hi", "x": tru}`,
+			lax:   true,
+		},
+		{
+			name:  "encode error",
+			hooks: set(func(root *ast.Node) { root.SetAny("x", make(chan int)) }),
+			body:  `{"input":"hi"}`,
+		},
+		{
+			name:  "hook panic",
+			hooks: set(func(*ast.Node) { panic("boom") }),
+			body:  `{"input":"hi"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.lax {
+				if p := ast.NewParserObj(tc.body); parseOK(&p) {
+					t.Skip("this sonic build parses the body leniently")
+				}
+			}
+			opts := DefaultOptions()
+			if tc.hooks != nil {
+				opts.Hooks = tc.hooks
+			}
+			u := newTestUpstream(t, nil)
+			p := newTestProxy(t, opts, u)
+			var hdr http.Header
+			if tc.ce != "" {
+				hdr = http.Header{"Content-Encoding": {tc.ce}}
+			}
+			if w := send(p, "POST", "/v1/responses", hdr, tc.body); w.Code != http.StatusOK {
+				t.Fatalf("answered %d %s", w.Code, w.Body)
+			}
+			got := u.requests()
+			if len(got) != 1 {
+				t.Fatalf("upstream got %d requests, want 1", len(got))
+			}
+			if !bytes.Equal(got[0].body, []byte(tc.body)) {
+				t.Errorf("upstream got %q, want the original %q", got[0].body, tc.body)
+			}
+			if ce := got[0].header.Get("Content-Encoding"); ce != tc.ce {
+				t.Errorf("Content-Encoding = %q, want %q", ce, tc.ce)
+			}
+		})
+	}
+}
+
+func parseOK(p *ast.Parser) bool {
+	_, perr := p.Parse()
+	return perr == 0
+}
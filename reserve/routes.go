@@ -0,0 +1,199 @@
+package reserve
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// route is one entry of the route table. Paths are matched relative to a
+// mount prefix (see Options.Mounts), exactly unless prefix is set.
+type route struct {
+	name   string
+	method string // "" matches any method
+	path   string
+	prefix bool // path ends in '/' and matches everything below it
+	// allow are the methods the path takes at all, whichever route they
+	// match; others are refused with a 405 (see methodRefusal)
+	allow []string
+
+	rewrite  bool // run the request body rewrite
+	identify bool // resolve the client identity (see resolveClient)
+	usage    bool // log the usage object of JSON responses
+	chat     bool // translate chat.completions to and from Responses, see chat.go
+	batch    bool // rewrite the Responses lines of batch input uploads, see batch.go
+	ndjson   bool // rewrite each line of an NDJSON body, see ndjson.go
+	// track background responses and attribute their usage, see background.go
+	background bool
+}
+
+// routes is checked in order; the first match wins. Anything unmatched is
+// proxied untouched, but for a method the matched path doesn't allow.
+// Routes without rewrite never buffer the request body, so multipart
+// uploads to /v1/files stream straight through (batch input is re-encoded
+// line by line on the way).
+var routes = []route{
+	{name: "responses", method: http.MethodPost, path: "/v1/responses", allow: allowPost, rewrite: true, identify: true, background: true},
+	// /v1/responses/{id}, /{id}/cancel, /{id}/input_items: proxied as-is,
+	// polls of background responses are watched for their usage
+	{name: "responses_item", path: "/v1/responses/", prefix: true, allow: allowItem, identify: true, background: true},
+	// GET lists stored completions, proxied as-is
+	{name: "chat_completions", method: http.MethodPost, path: chatPath, allow: allowCollection, rewrite: true, identify: true, chat: true},
+	{name: "embeddings", method: http.MethodPost, path: "/v1/embeddings", allow: allowPost, identify: true, usage: true},
+	{name: "models", path: "/v1/models", allow: allowGet, identify: true},
+	{name: "models_item", path: "/v1/models/", prefix: true, allow: allowGetDelete, identify: true},
+	{name: "files_upload", method: http.MethodPost, path: "/v1/files", allow: allowCollection, identify: true, batch: true},
+	{name: "files", path: "/v1/files", allow: allowCollection, identify: true},
+	{name: "files_item", path: "/v1/files/", prefix: true, allow: allowGetDelete, identify: true},
+}
+
+var (
+	allowPost       = []string{http.MethodPost}
+	allowGet        = []string{http.MethodGet}
+	allowCollection = []string{http.MethodGet, http.MethodPost}
+	allowGetDelete  = []string{http.MethodGet, http.MethodDelete}
+	allowItem       = []string{http.MethodGet, http.MethodPost, http.MethodDelete}
+)
+
+// features names what the proxy does on rt, for logs and stats.
+func (rt *route) features() []string {
+	var fs []string
+	if rt.rewrite {
+		fs = append(fs, "rewrite")
+	}
+	if rt.identify {
+		fs = append(fs, "identify")
+	}
+	if rt.usage {
+		fs = append(fs, "usage")
+	}
+	if rt.chat {
+		fs = append(fs, "chat_translate")
+	}
+	if rt.batch {
+		fs = append(fs, "batch_rewrite")
+	}
+	if rt.ndjson {
+		fs = append(fs, "ndjson_rewrite")
+	}
+	if rt.background {
+		fs = append(fs, "background")
+	}
+	return fs
+}
+
+// routeNamed returns the route called name; it must exist.
+func routeNamed(name string) *route {
+	for i := range routes {
+		if routes[i].name == name {
+			return &routes[i]
+		}
+	}
+	panic("reserve: no route " + name)
+}
+
+// normalizeNDJSONPaths cleans up NDJSON route paths: each gets a leading
+// slash, blanks and duplicates go.
+func normalizeNDJSONPaths(ps []string) []string {
+	var out []string
+	for _, p := range ps {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if p[0] != '/' {
+			p = "/" + p
+		}
+		if !slices.Contains(out, p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// normalizeMounts cleans up mount prefixes and sorts them longest first.
+func normalizeMounts(ms []string) []string {
+	var mounts []string
+	for _, m := range ms {
+		m = strings.TrimRight(strings.TrimSpace(m), "/")
+		if m != "" && m[0] != '/' {
+			m = "/" + m
+		}
+		if !slices.Contains(mounts, m) {
+			mounts = append(mounts, m)
+		}
+	}
+	slices.SortFunc(mounts, func(a, b string) int { return len(b) - len(a) })
+	return mounts
+}
+
+// matchRoute returns the route for method and the client-visible path p,
+// or nil. Only p == mount+path (or mount+prefix...) counts, so lookalikes
+// such as /evil/v1/responses don't match.
+func (rr *Rewriter) matchRoute(method, p string) *route {
+	for _, m := range rr.mounts {
+		if !strings.HasPrefix(p, m) {
+			continue
+		}
+		rest := p[len(m):]
+		if rest == "" || rest[0] != '/' {
+			continue
+		}
+		if method == http.MethodPost && slices.Contains(rr.ndjsonPaths, rest) {
+			return &ndjsonRoute
+		}
+		for i := range routes {
+			rt := &routes[i]
+			if rt.method != "" && rt.method != method || !rt.allows(method) {
+				continue
+			}
+			if rest == rt.path || (rt.prefix && strings.HasPrefix(rest, rt.path)) {
+				return rt
+			}
+		}
+	}
+	return nil
+}
+
+// allows reports whether rt's path takes method; HEAD goes where GET
+// does.
+func (rt *route) allows(method string) bool {
+	return rt.allow == nil || slices.Contains(rt.allow, method) ||
+		method == http.MethodHead && slices.Contains(rt.allow, http.MethodGet)
+}
+
+// methodRefusal is the 405 answering method on the client-visible path p,
+// with the route it names, when p is a route path that doesn't take
+// method; nil otherwise. OPTIONS is left to whatever answers preflights
+// (the upstream, today). NDJSON paths are the operator's and take
+// anything.
+func (rr *Rewriter) methodRefusal(method, p string) (*route, *httpError) {
+	if method == http.MethodOptions {
+		return nil, nil
+	}
+	for _, m := range rr.mounts {
+		if !strings.HasPrefix(p, m) {
+			continue
+		}
+		rest := p[len(m):]
+		if rest == "" || rest[0] != '/' || slices.Contains(rr.ndjsonPaths, rest) {
+			continue
+		}
+		for i := range routes {
+			rt := &routes[i]
+			if rest != rt.path && !(rt.prefix && strings.HasPrefix(rest, rt.path)) {
+				continue
+			}
+			if rt.allows(method) {
+				return nil, nil
+			}
+			return rt, &httpError{
+				status: http.StatusMethodNotAllowed,
+				code:   "method_not_allowed",
+				msg:    method + " is not allowed on " + p,
+				allow:  strings.Join(rt.allow, ", "),
+			}
+		}
+	}
+	return nil, nil
+}
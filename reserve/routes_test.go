@@ -0,0 +1,117 @@
+package reserve
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMatchRoute(t *testing.T) {
+	rr := NewRewriter(DefaultOptions())
+	for _, tc := range []struct {
+		method, path, want string
+	}{
+		{"POST", "/v1/responses", "responses"},
+		{"POST", "/codex/v1/responses", "responses"},
+		{"GET", "/v1/responses/resp_1", "responses_item"},
+		{"POST", "/v1/responses/resp_1/cancel", "responses_item"},
+		{"GET", "/codex/v1/responses/resp_1/input_items", "responses_item"},
+		{"POST", "/v1/chat/completions", "chat_completions"},
+		{"POST", "/v1/embeddings", "embeddings"},
+		{"GET", "/v1/models", "models"},
+		{"HEAD", "/v1/models", "models"},
+		{"GET", "/v1/models/gpt-5", "models_item"},
+		{"POST", "/v1/files", "files_upload"},
+		{"GET", "/v1/files", "files"},
+		{"DELETE", "/v1/files/file_1", "files_item"},
+
+		// lookalikes
+		{"POST", "/evil/v1/responses", ""},
+		{"POST", "/v1/responses/v1/responses", "responses_item"}, // a subpath: not rewritten
+		{"POST", "/v1/responsesx", ""},
+		{"POST", "/v1/responses/", "responses_item"},
+		{"POST", "/codexv1/responses", ""},
+		{"POST", "/codex/codex/v1/responses", ""},
+		{"POST", "//v1/responses", ""},
+		{"POST", "/V1/responses", ""},
+		{"POST", "v1/responses", ""},
+		{"POST", "/v1/embeddings/x", ""},
+		{"POST", "/v1", ""},
+		{"POST", "/", ""},
+		{"POST", "", ""},
+
+		// methods the path doesn't take
+		{"GET", "/v1/responses", ""},
+		{"PUT", "/v1/responses", ""},
+		{"POST", "/v1/models", ""},
+	} {
+		got := ""
+		if rt := rr.matchRoute(tc.method, tc.path); rt != nil {
+			got = rt.name
+		}
+		if got != tc.want {
+			t.Errorf("matchRoute(%s %q) = %q, want %q", tc.method, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestMatchRouteMounts(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Mounts = []string{"api/", "/api/openai", ""}
+	rr := NewRewriter(opts)
+	for _, tc := range []struct{ path, want string }{
+		{"/api/v1/responses", "responses"},
+		{"/api/openai/v1/responses", "responses"},
+		{"/v1/responses", "responses"},
+		{"/apiv1/responses", ""},
+		{"/api/openai/x/v1/responses", ""},
+	} {
+		got := ""
+		if rt := rr.matchRoute("POST", tc.path); rt != nil {
+			got = rt.name
+		}
+		if got != tc.want {
+			t.Errorf("matchRoute(POST %q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+	if got := normalizeMounts(opts.Mounts); len(got) != 3 || got[0] != "/api/openai" || got[2] != "" {
+		t.Errorf("normalizeMounts = %q, want longest first", got)
+	}
+}
+
+func TestMatchRouteNDJSON(t *testing.T) {
+	opts := DefaultOptions()
+	opts.NDJSONPaths = []string{"v1/bulk", " /v1/bulk "}
+	rr := NewRewriter(opts)
+	if rt := rr.matchRoute("POST", "/codex/v1/bulk"); rt == nil || rt.name != "ndjson" {
+		t.Errorf("POST /codex/v1/bulk matched %v, want the ndjson route", rt)
+	}
+	if rt := rr.matchRoute("GET", "/v1/bulk"); rt != nil {
+		t.Errorf("GET /v1/bulk matched %s", rt.name)
+	}
+	if len(rr.ndjsonPaths) != 1 {
+		t.Errorf("ndjsonPaths = %q, want one", rr.ndjsonPaths)
+	}
+}
+
+func TestMethodRefusal(t *testing.T) {
+	rr := NewRewriter(DefaultOptions())
+	for _, tc := range []struct {
+		method, path, allow string
+	}{
+		{"GET", "/v1/responses", "POST"},
+		{"PUT", "/codex/v1/responses", "POST"},
+		{"POST", "/v1/models", "GET"},
+		{"PATCH", "/v1/files/file_1", "GET, DELETE"},
+		{"OPTIONS", "/v1/responses", ""},
+		{"POST", "/v1/responses", ""},
+		{"GET", "/evil/v1/responses", ""},
+	} {
+		_, he := rr.methodRefusal(tc.method, tc.path)
+		switch {
+		case tc.allow == "" && he != nil:
+			t.Errorf("%s %s refused: %v", tc.method, tc.path, he)
+		case tc.allow != "" && (he == nil || he.status != http.StatusMethodNotAllowed || he.allow != tc.allow):
+			t.Errorf("%s %s: %+v, want a 405 allowing %s", tc.method, tc.path, he, tc.allow)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package reserve
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+)
+
+// Runtime is the part of the configuration that can change while serving.
+// It is swapped atomically as a whole; each request reads one snapshot when
+// it starts, so a change never affects requests already in flight.
+type Runtime struct {
+	// InstructionsRewrite enables the built-in instructions migration.
+	InstructionsRewrite bool `json:"instructions_rewrite"`
+	// Maintenance answers every proxied request with 503.
+	Maintenance bool `json:"maintenance"`
+	// LogLevel is the level of Options.LogLevel ("" when not adjustable).
+	LogLevel string `json:"log_level"`
+	// ResponseHeaders is the upstream response headers passed to the
+	// clients, Options.ResponseHeaders to begin with (see respheaders.go).
+	ResponseHeaders *ResponseHeaderPolicy `json:"response_headers,omitempty"`
+}
+
+// RuntimePatch is a partial Runtime, nil fields are left unchanged. A
+// ResponseHeaders policy replaces the current one as a whole.
+type RuntimePatch struct {
+	InstructionsRewrite *bool                 `json:"instructions_rewrite,omitempty"`
+	Maintenance         *bool                 `json:"maintenance,omitempty"`
+	LogLevel            *string               `json:"log_level,omitempty"`
+	ResponseHeaders     *ResponseHeaderPolicy `json:"response_headers,omitempty"`
+}
+
+var errMaintenance = &httpError{
+	status:     http.StatusServiceUnavailable,
+	code:       "maintenance",
+	msg:        "proxy is in maintenance mode, retry later",
+	retryAfter: 30,
+}
+
+type runtimeConfig struct {
+	p     atomic.Pointer[Runtime]
+	level *slog.LevelVar
+}
+
+func (c *runtimeConfig) load() *Runtime { return c.p.Load() }
+
+// apply merges patch into the current Runtime and swaps it in. Concurrent
+// applies don't lose each other's fields.
+func (c *runtimeConfig) apply(patch RuntimePatch) (*Runtime, error) {
+	var lvl slog.Level
+	if patch.LogLevel != nil {
+		if c.level == nil {
+			return nil, errLogLevelFixed
+		}
+		if err := lvl.UnmarshalText([]byte(*patch.LogLevel)); err != nil {
+			return nil, err
+		}
+	}
+	if patch.ResponseHeaders != nil {
+		if err := patch.ResponseHeaders.Validate(); err != nil {
+			return nil, fmt.Errorf("response_headers: %w", err)
+		}
+	}
+	for {
+		old := c.p.Load()
+		rt := *old
+		if patch.InstructionsRewrite != nil {
+			rt.InstructionsRewrite = *patch.InstructionsRewrite
+		}
+		if patch.Maintenance != nil {
+			rt.Maintenance = *patch.Maintenance
+		}
+		if patch.LogLevel != nil {
+			rt.LogLevel = lvl.String()
+		}
+		if patch.ResponseHeaders != nil {
+			rt.ResponseHeaders = patch.ResponseHeaders
+		}
+		if c.p.CompareAndSwap(old, &rt) {
+			if patch.LogLevel != nil {
+				c.level.Set(lvl)
+			}
+			return &rt, nil
+		}
+	}
+}
+
+var errLogLevelFixed = &httpError{
+	status: http.StatusBadRequest,
+	code:   "log_level_fixed",
+	msg:    "log level is not adjustable (no Options.LogLevel)",
+}
+
+// Runtime returns the current runtime settings.
+func (rr *Rewriter) Runtime() Runtime { return *rr.runtime.load() }
+
+// UpdateRuntime applies patch atomically and returns the new settings.
+func (rr *Rewriter) UpdateRuntime(patch RuntimePatch) (Runtime, error) {
+	rt, err := rr.runtime.apply(patch)
+	if err != nil {
+		return Runtime{}, err
+	}
+	return *rt, nil
+}
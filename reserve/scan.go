@@ -0,0 +1,177 @@
+package reserve
+
+import (
+	"errors"
+)
+
+var errScan = errors.New("malformed json")
+
+// jsonMember is one top-level member of a JSON object as byte offsets into
+// the body: the key including its quotes, and the raw value.
+type jsonMember struct {
+	KeyStart, KeyEnd int
+	ValStart, ValEnd int
+	// Depth is the value's max nesting depth: 0 for scalars, 1 for a
+	// container holding only scalars, and so on.
+	Depth int
+}
+
+// key returns the raw key bytes without quotes (escapes are not decoded).
+func (m jsonMember) key(bs []byte) []byte { return bs[m.KeyStart+1 : m.KeyEnd-1] }
+
+func skipWS(bs []byte, i int) int {
+	for i < len(bs) && isWS(bs[i]) {
+		i++
+	}
+	return i
+}
+
+// skipString returns the offset just past the string starting at bs[i] == '"'.
+func skipString(bs []byte, i int) (int, error) {
+	for i++; i < len(bs); i++ {
+		switch bs[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		}
+	}
+	return 0, errScan
+}
+
+// skipValue returns the offset just past the value starting at bs[i] and
+// its max nesting depth. Containers are skipped by bracket counting, not
+// validated; sonic does the real parse, this only needs boundaries (and
+// the depth, to refuse adversarial bodies before sonic sees them).
+func skipValue(bs []byte, i int) (end, maxDepth int, err error) {
+	if i >= len(bs) {
+		return 0, 0, errScan
+	}
+	switch bs[i] {
+	case '"':
+		end, err = skipString(bs, i)
+		return end, 0, err
+	case '{', '[':
+		depth := 0
+		for ; i < len(bs); i++ {
+			switch bs[i] {
+			case '"':
+				end, err := skipString(bs, i)
+				if err != nil {
+					return 0, 0, err
+				}
+				i = end - 1
+			case '{', '[':
+				depth++
+				maxDepth = max(maxDepth, depth)
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1, maxDepth, nil
+				}
+			}
+		}
+		return 0, 0, errScan
+	default:
+		start := i
+		for i < len(bs) {
+			switch c := bs[i]; {
+			case c == ',' || c == '}' || c == ']' || isWS(c):
+				if i == start {
+					return 0, 0, errScan
+				}
+				return i, 0, nil
+			}
+			i++
+		}
+		if i == start {
+			return 0, 0, errScan
+		}
+		return i, 0, nil
+	}
+}
+
+// nestingWithin reports whether no container in bs nests deeper than
+// limit, counting brackets outside strings in one pass over the whole
+// body, whatever its top level. Like skipValue it doesn't validate: an
+// unbalanced or truncated body is left for sonic to reject.
+func nestingWithin(bs []byte, limit int) bool {
+	depth := 0
+	for i := 0; i < len(bs); i++ {
+		switch bs[i] {
+		case '"':
+			end, err := skipString(bs, i)
+			if err != nil {
+				return true
+			}
+			i = end - 1
+		case '{', '[':
+			if depth++; depth > limit {
+				return false
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return true
+}
+
+// scanObject walks the top-level members of the JSON object in bs, calling
+// fn for each until it returns false. It returns the offsets of the
+// object's '{' and of the byte just past its '}' (just past the last visited
+// value when fn stopped early).
+func scanObject(bs []byte, fn func(m jsonMember) bool) (start, end int, err error) {
+	i := skipWS(bs, 0)
+	if i >= len(bs) || bs[i] != '{' {
+		return 0, 0, errScan
+	}
+	start = i
+	i = skipWS(bs, i+1)
+	if i < len(bs) && bs[i] == '}' {
+		return start, i + 1, nil
+	}
+	for {
+		if i >= len(bs) || bs[i] != '"' {
+			return 0, 0, errScan
+		}
+		var m jsonMember
+		m.KeyStart = i
+		if m.KeyEnd, err = skipString(bs, i); err != nil {
+			return 0, 0, err
+		}
+		i = skipWS(bs, m.KeyEnd)
+		if i >= len(bs) || bs[i] != ':' {
+			return 0, 0, errScan
+		}
+		m.ValStart = skipWS(bs, i+1)
+		if m.ValEnd, m.Depth, err = skipValue(bs, m.ValStart); err != nil {
+			return 0, 0, err
+		}
+		if fn != nil && !fn(m) {
+			return start, m.ValEnd, nil
+		}
+		i = skipWS(bs, m.ValEnd)
+		if i >= len(bs) {
+			return 0, 0, errScan
+		}
+		switch bs[i] {
+		case ',':
+			i = skipWS(bs, i+1)
+		case '}':
+			return start, i + 1, nil
+		default:
+			return 0, 0, errScan
+		}
+	}
+}
+
+// topLevelKeys lists up to max top-level keys of bs, for diagnostics that
+// must describe a body's shape without logging its content.
+func topLevelKeys(bs []byte, max int) []string {
+	var keys []string
+	_, _, _ = scanObject(bs, func(m jsonMember) bool {
+		keys = append(keys, string(m.key(bs)))
+		return len(keys) < max
+	})
+	return keys
+}
@@ -0,0 +1,68 @@
+package reserve
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestScanObject(t *testing.T) {
+	bs := []byte(` {"a": 1, "b":{"c":[1,2]} ,"d\"":"x}"}  `)
+	var keys, vals []string
+	var depths []int
+	start, end, err := scanObject(bs, func(m jsonMember) bool {
+		keys = append(keys, string(m.key(bs)))
+		vals = append(vals, string(bs[m.ValStart:m.ValEnd]))
+		depths = append(depths, m.Depth)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 1 || end != len(bs)-2 {
+		t.Errorf("object at [%d,%d), want [1,%d)", start, end, len(bs)-2)
+	}
+	if want := []string{"a", "b", `d\"`}; !slices.Equal(keys, want) {
+		t.Errorf("keys = %q, want %q", keys, want)
+	}
+	if want := []string{"1", `{"c":[1,2]}`, `"x}"`}; !slices.Equal(vals, want) {
+		t.Errorf("values = %q, want %q", vals, want)
+	}
+	if want := []int{0, 2, 0}; !slices.Equal(depths, want) {
+		t.Errorf("depths = %v, want %v", depths, want)
+	}
+}
+
+func TestScanObjectStop(t *testing.T) {
+	bs := []byte(`{"a":1,"b":2,"c":3}`)
+	n := 0
+	_, end, err := scanObject(bs, func(jsonMember) bool { n++; return n < 2 })
+	if err != nil || n != 2 || string(bs[:end]) != `{"a":1,"b":2` {
+		t.Errorf("stopped after %d members at %q, err %v", n, bs[:end], err)
+	}
+}
+
+func TestScanObjectMalformed(t *testing.T) {
+	for _, s := range []string{
+		``, `[]`, `"x"`, `{`, `{"a"}`, `{"a":}`, `{"a":1`, `{"a":1,}`, `{"a":1 "b":2}`,
+		`{"a":"x}`, `{a:1}`, `{"a":[1,2}`,
+	} {
+		if _, _, err := scanObject([]byte(s), nil); err == nil {
+			t.Errorf("scanObject(%q) succeeded", s)
+		}
+	}
+	for _, s := range []string{`{}`, ` { } `, `{"a":null}`, `{"a":-1.5e3,"b":true}`} {
+		if _, _, err := scanObject([]byte(s), nil); err != nil {
+			t.Errorf("scanObject(%q): %v", s, err)
+		}
+	}
+}
+
+func TestTopLevelKeys(t *testing.T) {
+	bs := []byte(`{"model":"m","input":{"nested":1},"stream":true,"tools":[]}`)
+	if got := topLevelKeys(bs, 3); !slices.Equal(got, []string{"model", "input", "stream"}) {
+		t.Errorf("topLevelKeys = %q", got)
+	}
+	if got := topLevelKeys([]byte(`[1]`), 3); got != nil {
+		t.Errorf("topLevelKeys of an array = %q", got)
+	}
+}
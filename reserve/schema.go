@@ -0,0 +1,215 @@
+package reserve
+
+import (
+	_ "embed"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bytedance/sonic/ast"
+)
+
+// A malformed request (a number for model, an object for input) costs an
+// upstream round trip to learn it is malformed, and the upstream's answer
+// rarely says where. The routes in Options.ValidateRoutes check bodies
+// against responses.schema.json, embedded in the binary, before the
+// request hooks run: the types of the fields it knows are checked, on the
+// AST the hooks go on to use, and fields it doesn't know pass. A body that
+// doesn't match is answered with a 400 naming the JSON pointers of the
+// first problems. The schema's version is part of the build info.
+
+// most problems named in a 400
+const maxSchemaProblems = 3
+
+//go:embed responses.schema.json
+var responsesSchemaJSON []byte
+
+// schemaNode is the subset of JSON Schema the proxy checks: type,
+// properties and items. Other keywords are documentation.
+type schemaNode struct {
+	Type       schemaTypes            `json:"type"`
+	Properties map[string]*schemaNode `json:"properties"`
+	Items      *schemaNode            `json:"items"`
+}
+
+// schemaTypes is a schema's type, a name or a list of them.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := sonicAPI.Unmarshal(b, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	return sonicAPI.Unmarshal(b, (*[]string)(t))
+}
+
+var responsesSchema, responsesSchemaVersion = func() (*schemaNode, string) {
+	var s struct {
+		schemaNode
+		Version string `json:"version"`
+	}
+	if err := sonicAPI.Unmarshal(responsesSchemaJSON, &s); err != nil {
+		panic("reserve: responses.schema.json: " + err.Error())
+	}
+	return &s.schemaNode, s.Version
+}()
+
+type schemaCounts struct {
+	valid     atomic.Int64
+	rejected  atomic.Int64
+	unchecked atomic.Int64 // bodies the proxy doesn't parse: malformed, over the JSON limits
+}
+
+// checkValidateRoutes rejects names in Options.ValidateRoutes that are no
+// route with a Responses body.
+func checkValidateRoutes(names []string) error {
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		i := slices.IndexFunc(routes, func(rt route) bool { return rt.name == name })
+		if i < 0 {
+			return fmt.Errorf("reserve: ValidateRoutes: no route %q", name)
+		}
+		if !routes[i].rewrite || routes[i].chat {
+			return fmt.Errorf("reserve: ValidateRoutes: route %q has no Responses body", name)
+		}
+	}
+	return nil
+}
+
+// validateRouteSet is the set of route names in names.
+func validateRouteSet(names []string) map[string]bool {
+	set := map[string]bool{}
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			set[name] = true
+		}
+	}
+	return set
+}
+
+// validateRoutes lists the validated routes, sorted.
+func (rr *Rewriter) validateRoutes() []string {
+	names := make([]string, 0, len(rr.validate))
+	for name := range rr.validate {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (rr *Rewriter) schemaStats() any {
+	names := rr.validateRoutes()
+	return map[string]any{
+		"enabled":   len(names) > 0,
+		"routes":    names,
+		"version":   responsesSchemaVersion,
+		"valid":     rr.schema.valid.Load(),
+		"rejected":  rr.schema.rejected.Load(),
+		"unchecked": rr.schema.unchecked.Load(),
+	}
+}
+
+// validateRequest checks r's body against the schema when its route is
+// one of Options.ValidateRoutes; see above.
+func (rr *Rewriter) validateRequest(r *Request) error {
+	if !rr.validate[r.Route] {
+		return nil
+	}
+	root, err := r.load()
+	if root == nil {
+		if err == nil {
+			rr.schema.unchecked.Add(1)
+		}
+		return err
+	}
+	var problems []string
+	responsesSchema.check(root, "", &problems)
+	traceOf(r.HTTP.Context()).log("schema", "ok", len(problems) == 0, "version", responsesSchemaVersion,
+		"problems", problems)
+	if len(problems) == 0 {
+		rr.schema.valid.Add(1)
+		return nil
+	}
+	rr.schema.rejected.Add(1)
+	r.Logger().Info("request body does not match the schema", "route", r.Route, "problems", problems)
+	msg := "request body does not match the Responses schema (" + responsesSchemaVersion + "): " + strings.Join(problems, "; ")
+	if len(problems) == maxSchemaProblems {
+		msg += "; further problems not checked"
+	}
+	return &httpError{status: http.StatusBadRequest, code: "invalid_request_body", msg: msg}
+}
+
+// check appends the problems of n, at JSON pointer ptr, up to
+// maxSchemaProblems in all.
+func (s *schemaNode) check(n *ast.Node, ptr string, problems *[]string) {
+	got := jsonTypeOf(n)
+	if len(s.Type) > 0 && !s.allows(n, got) {
+		*problems = append(*problems, fmt.Sprintf("%s: want %s, got %s",
+			strconv.Quote(ptr), strings.Join(s.Type, " or "), got))
+		return
+	}
+	switch {
+	case got == "object" && len(s.Properties) > 0:
+		_ = n.ForEach(func(seq ast.Sequence, v *ast.Node) bool {
+			if sub := s.Properties[*seq.Key]; sub != nil {
+				sub.check(v, ptr+"/"+escapePointer(*seq.Key), problems)
+			}
+			return len(*problems) < maxSchemaProblems
+		})
+	case got == "array" && s.Items != nil:
+		_ = n.ForEach(func(seq ast.Sequence, v *ast.Node) bool {
+			s.Items.check(v, ptr+"/"+strconv.Itoa(seq.Index), problems)
+			return len(*problems) < maxSchemaProblems
+		})
+	}
+}
+
+// allows reports whether n, of JSON type got, is of one of s's types; an
+// integer is a number without a fraction.
+func (s *schemaNode) allows(n *ast.Node, got string) bool {
+	for _, t := range s.Type {
+		if t == got {
+			return true
+		}
+		if t == "integer" && got == "number" {
+			if f, err := n.Float64(); err == nil && f == math.Trunc(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func jsonTypeOf(n *ast.Node) string {
+	switch nodeType(n) {
+	case ast.V_NULL:
+		return "null"
+	case ast.V_TRUE, ast.V_FALSE:
+		return "boolean"
+	case ast.V_NUMBER:
+		return "number"
+	case ast.V_STRING:
+		return "string"
+	case ast.V_ARRAY:
+		return "array"
+	case ast.V_OBJECT:
+		return "object"
+	}
+	return "invalid"
+}
+
+// escapePointer escapes a key as a JSON pointer token (RFC 6901).
+func escapePointer(k string) string {
+	if !strings.ContainsAny(k, "~/") {
+		return k
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(k, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,102 @@
+package reserve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Secret is a credential-bearing config value. It renders as a fingerprint
+// everywhere it is printed or marshalled, so a new Secret field can't leak
+// through the config endpoint or logs; convert to string to use the value.
+type Secret string
+
+// Fingerprint identifies s without revealing it: the first 4 characters
+// (for values long enough that this gives little away) and a sha256 prefix.
+func (s Secret) Fingerprint() string {
+	if s == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(s))
+	fp := "sha256:" + hex.EncodeToString(sum[:4])
+	if len(s) >= 12 {
+		fp = string(s[:4]) + "…" + fp
+	}
+	return fp
+}
+
+func (s Secret) String() string { return s.Fingerprint() }
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return strconv.AppendQuote(nil, s.Fingerprint()), nil
+}
+
+// Set makes *Secret a flag.Value, taking v in any form ResolveSecret
+// does.
+func (s *Secret) Set(v string) error {
+	r, err := ResolveSecret(v)
+	if err != nil {
+		return err
+	}
+	*s = r
+	return nil
+}
+
+// ResolveSecret is the secret v stands for, so credentials need not be
+// written out on a command line or in a unit file: each ${NAME} in v is
+// replaced by the environment variable NAME, then a v of the form
+// file:<path> is replaced by the contents of that file, less trailing
+// line breaks. Anything else is taken as is. The errors name the
+// variable or file, never a value.
+func ResolveSecret(v string) (Secret, error) {
+	var b strings.Builder
+	for rest := v; ; {
+		i := strings.Index(rest, "${")
+		if i < 0 {
+			b.WriteString(rest)
+			break
+		}
+		j := strings.IndexByte(rest[i:], '}')
+		if j < 0 || !isEnvName(rest[i+2:i+j]) {
+			// not a reference: keep the "${" and carry on after it
+			b.WriteString(rest[:i+2])
+			rest = rest[i+2:]
+			continue
+		}
+		name := rest[i+2 : i+j]
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		b.WriteString(rest[:i])
+		b.WriteString(val)
+		rest = rest[i+j+1:]
+	}
+	s := b.String()
+	if path, ok := strings.CutPrefix(s, "file:"); ok {
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("secret file: %w", err)
+		}
+		s = strings.TrimRight(string(bs), "\r\n")
+		if s == "" {
+			return "", fmt.Errorf("secret file %s is empty", path)
+		}
+	}
+	return Secret(s), nil
+}
+
+func isEnvName(s string) bool {
+	if s == "" || s[0] >= '0' && s[0] <= '9' {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if c != '_' && (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,229 @@
+package reserve
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// The upstream sometimes answers 200 with an event stream whose first
+// event is an error (or response.failed). The stream_errors response hook
+// reads a 200 stream up to the end of its first event, for at most
+// Options.StreamSniffWait: an error there turns the whole response into a
+// plain JSON error with a matching status; anything else is relayed as
+// is, the sniffed bytes first. A first event that takes longer, or is
+// larger than sniffMaxBytes, is relayed unchecked.
+
+// sniffMaxBytes bounds the first event; response.created echoes the
+// request's instructions and tools, so it can be sizeable.
+const sniffMaxBytes = 256 << 10
+
+var sniffCounts struct {
+	streams   atomic.Int64
+	errors    atomic.Int64 // streams turned into error responses
+	timeouts  atomic.Int64 // first event not complete in time
+	oversized atomic.Int64
+}
+
+func streamSniffStats() any {
+	return map[string]any{
+		"streams":   sniffCounts.streams.Load(),
+		"errors":    sniffCounts.errors.Load(),
+		"timeouts":  sniffCounts.timeouts.Load(),
+		"oversized": sniffCounts.oversized.Load(),
+	}
+}
+
+func streamErrorsHook(r *Response) error {
+	resp := r.HTTP
+	wait := r.proxy.opts.StreamSniffWait
+	if wait <= 0 || resp.StatusCode != http.StatusOK || !isEventStream(resp) {
+		return nil
+	}
+	sniffCounts.streams.Add(1)
+	s := &streamSniff{src: resp.Body, done: make(chan struct{})}
+	go s.run()
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-s.done:
+	case <-t.C:
+		sniffCounts.timeouts.Add(1)
+		s.stop.Store(true)
+		resp.Body = &sniffedBody{s: s}
+		return nil
+	case <-resp.Request.Context().Done():
+		s.stop.Store(true)
+		resp.Body = &sniffedBody{s: s}
+		return nil
+	}
+	end := sseEventEnd(s.buf)
+	if end < 0 {
+		if s.err == nil {
+			sniffCounts.oversized.Add(1)
+		}
+		resp.Body = &sniffedBody{s: s}
+		return nil
+	}
+	e, ok := sseErrorEvent(s.buf[:end])
+	if !ok {
+		resp.Body = &sniffedBody{s: s}
+		return nil
+	}
+	sniffCounts.errors.Add(1)
+	status := upstreamErrorStatus(e)
+	if st := stateOf(resp.Request.Context()); st != nil {
+		st.wide.fail(e.Code, e.Message)
+		st.trace.log("stream_sniff", "error_event", true, "status", status, "code", e.Code)
+	}
+	r.Logger().Warn("upstream stream opened with an error, answering with it", "route", r.Route,
+		"status", status, "code", e.Code, "message", e.Message)
+	if e.Type == "" {
+		e.Type = "upstream_error"
+	}
+	bs, _ := sonicAPI.Marshal(errorBody{Error: e})
+	resp.StatusCode = status
+	resp.Status = http.StatusText(status)
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Del("Cache-Control")
+	r.SetBody(bs)
+	return nil
+}
+
+// streamSniff reads the start of a stream in a goroutine of its own, so
+// the wait for it can be cut short. buf and err belong to the goroutine
+// until done is closed.
+type streamSniff struct {
+	src  io.ReadCloser
+	buf  []byte
+	err  error
+	stop atomic.Bool // stop after the read in progress
+	done chan struct{}
+}
+
+func (s *streamSniff) run() {
+	defer close(s.done)
+	chunk := make([]byte, 4096)
+	for !s.stop.Load() {
+		n, err := s.src.Read(chunk)
+		s.buf = append(s.buf, chunk[:n]...)
+		if err != nil {
+			s.err = err
+			return
+		}
+		if sseEventEnd(s.buf) >= 0 || len(s.buf) >= sniffMaxBytes {
+			return
+		}
+	}
+}
+
+// sniffedBody is the stream again: the sniffed bytes, then the rest.
+type sniffedBody struct {
+	s    *streamSniff
+	head []byte
+	rest bool // head taken over from s
+}
+
+func (b *sniffedBody) Read(p []byte) (int, error) {
+	if !b.rest {
+		<-b.s.done
+		b.head, b.rest = b.s.buf, true
+	}
+	if len(b.head) > 0 {
+		n := copy(p, b.head)
+		b.head = b.head[n:]
+		return n, nil
+	}
+	if b.s.err != nil {
+		return 0, b.s.err
+	}
+	return b.s.src.Read(p)
+}
+
+func (b *sniffedBody) Close() error { return b.s.src.Close() }
+
+// sseEventEnd returns the length of the first event in b, blank line
+// included, or -1 when it isn't complete yet.
+func sseEventEnd(b []byte) int {
+	end := -1
+	for _, sep := range [][]byte{[]byte("\n\n"), []byte("\r\n\r\n")} {
+		if i := bytes.Index(b, sep); i >= 0 && (end < 0 || i+len(sep) < end) {
+			end = i + len(sep)
+		}
+	}
+	return end
+}
+
+// sseErrorEvent reports whether event ev (an error, or response.failed)
+// is a failure, and returns it.
+func sseErrorEvent(ev []byte) (errorDetail, bool) {
+	var name string
+	var data []byte
+	for _, line := range bytes.Split(ev, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if v, ok := bytes.CutPrefix(line, []byte("event:")); ok {
+			name = string(bytes.TrimSpace(v))
+		} else if v, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			if data != nil {
+				data = append(data, '\n')
+			}
+			data = append(data, bytes.TrimPrefix(v, []byte(" "))...)
+		}
+	}
+	var e struct {
+		Type     string       `json:"type"`
+		Code     string       `json:"code"`
+		Message  string       `json:"message"`
+		Error    *errorDetail `json:"error"`
+		Response *respObject  `json:"response"`
+	}
+	if data == nil || sonic.Unmarshal(data, &e) != nil {
+		return errorDetail{}, name == "error"
+	}
+	switch {
+	case e.Type == "response.failed" || name == "response.failed":
+		d := errorDetail{Code: "upstream_failed", Message: "upstream response failed"}
+		if e.Response != nil && e.Response.Error != nil {
+			d.Code, d.Message = e.Response.Error.Code, e.Response.Error.Message
+		}
+		return d, true
+	case e.Type == "error" || name == "error":
+		if e.Error != nil {
+			return *e.Error, true
+		}
+		return errorDetail{Code: e.Code, Message: e.Message}, true
+	}
+	return errorDetail{}, false
+}
+
+// upstreamErrorStatus is the status an error with e's code and type gets
+// as a plain response.
+func upstreamErrorStatus(e errorDetail) int {
+	switch e.Code {
+	case "rate_limit_exceeded", "insufficient_quota":
+		return http.StatusTooManyRequests
+	case "model_not_found":
+		return http.StatusNotFound
+	case "context_length_exceeded", "invalid_prompt", "invalid_request_error":
+		return http.StatusBadRequest
+	case "server_is_overloaded", "overloaded", "slow_down":
+		return http.StatusServiceUnavailable
+	case "server_error", "internal_error":
+		return http.StatusInternalServerError
+	}
+	switch e.Type {
+	case "invalid_request_error":
+		return http.StatusBadRequest
+	case "authentication_error":
+		return http.StatusUnauthorized
+	case "permission_error":
+		return http.StatusForbidden
+	case "rate_limit_error", "insufficient_quota":
+		return http.StatusTooManyRequests
+	}
+	return http.StatusBadGateway
+}
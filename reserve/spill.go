@@ -0,0 +1,273 @@
+package reserve
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// With Options.SpillThreshold, a request body larger than the threshold
+// keeps only its first SpillThreshold bytes in a pooled buffer; the rest
+// goes to an unlinked temp file and the body is forwarded from both. The
+// hooks need the whole body, so a spilled one gets only the byte-level
+// prompt_cache_key injection, and only when neither prompt_cache_key nor
+// conversation appears anywhere in it (a plain byte match, which errs on
+// the side of leaving the body alone). Gzip and chat.completions bodies
+// are buffered whole as before. MaxBody still caps the total size.
+
+var errSpill = &httpError{
+	status: http.StatusInternalServerError,
+	code:   "body_spill_failed",
+	msg:    "proxy could not buffer the request body",
+}
+
+// spillScanKeys are the keys that rule out the injection when present
+var spillScanKeys = [][]byte{kPromptCacheKey, kConversation}
+
+type spillCounts struct {
+	bodies  atomic.Int64
+	bytes   atomic.Int64 // total written to spill files
+	current atomic.Int64 // bytes in spill files now open
+	failed  atomic.Int64
+}
+
+func (rr *Rewriter) spillStats() any {
+	if rr.opts.SpillThreshold <= 0 {
+		return map[string]any{"enabled": false}
+	}
+	dir := rr.opts.SpillDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return map[string]any{
+		"enabled":       true,
+		"threshold":     rr.opts.SpillThreshold,
+		"dir":           dir,
+		"bodies":        rr.spill.bodies.Load(),
+		"bytes_total":   rr.spill.bytes.Load(),
+		"bytes_current": rr.spill.current.Load(),
+		"failed":        rr.spill.failed.Load(),
+	}
+}
+
+// canSpill reports whether rw's body is read with readSpill.
+func (rw *bodyRewrite) canSpill() bool {
+	return rw.rr.opts.SpillThreshold > 0 && (rw.route == nil || !rw.route.chat) &&
+		rw.req.Header.Get("Content-Encoding") == ""
+}
+
+// spillFile is the part of a body past the threshold. Its file is already
+// unlinked (or is removed on close where that isn't possible), so closing
+// it is all the cleanup there is.
+type spillFile struct {
+	f     *os.File
+	path  string // to remove on close, "" when unlinked already
+	n     int64
+	found bool // one of spillScanKeys occurs in the body
+	c     *spillCounts
+}
+
+func (s *spillFile) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	if s.path != "" {
+		_ = os.Remove(s.path)
+	}
+	s.c.current.Add(-s.n)
+	s.f = nil
+	return err
+}
+
+// readSpill reads req's body into raw, as read does, until it passes
+// SpillThreshold; then the rest goes to a spill file and raw keeps the
+// first SpillThreshold bytes. spill is nil when the body fit.
+func (rw *bodyRewrite) readSpill(ctx context.Context, raw *bytes.Buffer) (*spillFile, error) {
+	rr := rw.rr
+	limit := rr.opts.SpillThreshold
+	src := io.Reader(ctxReader{ctx: ctx, r: rw.req.Body})
+	if _, err := raw.ReadFrom(io.LimitReader(src, limit+1)); err != nil {
+		return nil, err
+	}
+	if int64(raw.Len()) <= limit {
+		if max := rr.opts.MaxBody; max > 0 && int64(raw.Len()) > max {
+			rr.bodyTooLarge.Add(1)
+			return nil, errBodyTooLarge
+		}
+		return nil, nil
+	}
+
+	f, path, err := openSpillFile(rr.opts.SpillDir)
+	if err != nil {
+		rr.spill.failed.Add(1)
+		logOf(ctx).Error("spill: temp file not created", "dir", rr.opts.SpillDir, "error", err)
+		return nil, errSpill
+	}
+	spill := &spillFile{f: f, path: path, c: &rr.spill}
+	ok := false
+	defer func() {
+		if !ok {
+			spill.Close()
+		}
+	}()
+
+	scan := &keyScan{keys: spillScanKeys}
+	scan.write(raw.Bytes()[:limit])
+	rest := io.MultiReader(bytes.NewReader(raw.Bytes()[limit:]), src)
+	if max := rr.opts.MaxBody; max > 0 {
+		rest = io.LimitReader(rest, max-limit+1)
+	}
+	w := &spillWriter{f: f, scan: scan, s: spill}
+	n, err := io.Copy(w, rest)
+	raw.Truncate(int(limit))
+	if w.err != nil {
+		rr.spill.failed.Add(1)
+		logOf(ctx).Error("spill: temp file write failed", "error", w.err)
+		return nil, errSpill
+	}
+	if err != nil {
+		return nil, err
+	}
+	if max := rr.opts.MaxBody; max > 0 && limit+n > max {
+		rr.bodyTooLarge.Add(1)
+		return nil, errBodyTooLarge
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		rr.spill.failed.Add(1)
+		return nil, errSpill
+	}
+	spill.found, ok = scan.found, true
+	rr.spill.bodies.Add(1)
+	rr.spill.bytes.Add(n)
+	return spill, nil
+}
+
+// createUnlinked creates a temp file in dir and removes its name right
+// away. Where an open file can't be removed (Windows) the path is
+// returned, for Close to remove.
+func createUnlinked(dir string) (*os.File, string, error) {
+	f, err := os.CreateTemp(dir, "rc-proxy-spill-*")
+	if err != nil {
+		return nil, "", err
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		return f, f.Name(), nil
+	}
+	return f, "", nil
+}
+
+// spillWriter writes to the spill file, scanning what passes and keeping
+// the current gauge up to date as it goes.
+type spillWriter struct {
+	f    *os.File
+	scan *keyScan
+	s    *spillFile
+	err  error // the file's own write error
+}
+
+func (w *spillWriter) Write(b []byte) (int, error) {
+	w.scan.write(b)
+	n, err := w.f.Write(b)
+	w.s.n += int64(n)
+	w.s.c.current.Add(int64(n))
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// keyScan notes whether any of keys occurs in the bytes written to it,
+// across write boundaries.
+type keyScan struct {
+	keys  [][]byte
+	buf   []byte
+	found bool
+}
+
+func (s *keyScan) write(b []byte) {
+	if s.found {
+		return
+	}
+	s.buf = append(s.buf, b...)
+	keep := 0
+	for _, k := range s.keys {
+		if bytes.Contains(s.buf, k) {
+			s.found, s.buf = true, nil
+			return
+		}
+		keep = max(keep, len(k)-1)
+	}
+	if len(s.buf) > keep {
+		s.buf = append(s.buf[:0], s.buf[len(s.buf)-keep:]...)
+	}
+}
+
+// rewriteSpilled ends a spilled body's rewrite: just the prompt_cache_key
+// injection into the head, then the body goes out as head + file.
+func rewriteSpilled(rw *bodyRewrite) error {
+	sizeHist.observe(rw.orig.Len() + int(rw.spill.n))
+	rw.rr.paths.fast.Add(1)
+	rw.path = "spill"
+	traceOf(rw.req.Context()).log("rewrite", "path", "spill", "head", rw.orig.Len(), "spilled", rw.spill.n,
+		"has_prompt_cache_key", rw.spill.found)
+	if !rw.spill.found && rw.rr.hasHook("prompt_cache_key") {
+		key := rw.rr.derivePromptCacheKey(rw.req, "")
+		if out, ok := injectPromptCacheKeyFast(rw.orig.Bytes(), key); ok {
+			putBuf(rw.orig)
+			rw.orig = out
+			rw.rewritten, rw.applied = true, []string{"prompt_cache_key"}
+		}
+	}
+	return rw.keep()
+}
+
+func (rr *Rewriter) hasHook(name string) bool {
+	for _, h := range rr.hooks {
+		if h.Name == name && h.Request != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// spillBody is a forwarded spilled body: the head from the pool, then the
+// spill file. Close returns both.
+type spillBody struct {
+	r     io.Reader
+	head  *bytes.Buffer
+	spill *spillFile
+	lease budgetLease
+}
+
+func (b *spillBody) Read(p []byte) (int, error) { return b.r.Read(p) }
+
+func (b *spillBody) Close() error {
+	if b.head == nil {
+		return nil
+	}
+	putBuf(b.head)
+	b.head = nil
+	b.lease.release()
+	return b.spill.Close()
+}
+
+func setSpillBody(req *http.Request, head *bytes.Buffer, spill *spillFile, lease *budgetLease) {
+	lease.resize(head.Len())
+	n := int64(head.Len()) + spill.n
+	req.Body = &spillBody{
+		r:     io.MultiReader(bytes.NewReader(head.Bytes()), spill.f),
+		head:  head,
+		spill: spill,
+		lease: lease.detach(),
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+	req.Header.Del("Transfer-Encoding")
+	req.TransferEncoding = nil
+	req.Header.Del("Expect")
+}
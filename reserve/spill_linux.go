@@ -0,0 +1,23 @@
+//go:build linux
+
+package reserve
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openSpillFile opens an anonymous O_TMPFILE file in dir, which never has
+// a name to leave behind; filesystems without O_TMPFILE get a named temp
+// file, unlinked at once.
+func openSpillFile(dir string) (*os.File, string, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	fd, err := unix.Open(dir, unix.O_TMPFILE|unix.O_RDWR|unix.O_CLOEXEC, 0o600)
+	if err == nil {
+		return os.NewFile(uintptr(fd), dir+"/(spill)"), "", nil
+	}
+	return createUnlinked(dir)
+}
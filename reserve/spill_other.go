@@ -0,0 +1,11 @@
+//go:build !linux
+
+package reserve
+
+import "os"
+
+// openSpillFile creates a temp file in dir and unlinks it at once, where
+// the OS allows removing an open file.
+func openSpillFile(dir string) (*os.File, string, error) {
+	return createUnlinked(dir)
+}
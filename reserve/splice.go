@@ -0,0 +1,145 @@
+package reserve
+
+import (
+	"bytes"
+	"slices"
+)
+
+// splice replaces bs[start:end] with repl; start == end is an insertion.
+type splice struct {
+	start, end int
+	repl       []byte
+}
+
+// applySplices writes bs with the (non-overlapping) splices applied into a
+// pooled buffer. Insertions sort before a replacement starting at the same
+// offset.
+func applySplices(bs []byte, sp []splice) *bytes.Buffer {
+	slices.SortStableFunc(sp, func(a, b splice) int {
+		if a.start != b.start {
+			return a.start - b.start
+		}
+		return (a.end - a.start) - (b.end - b.start)
+	})
+	grow := len(bs)
+	for _, s := range sp {
+		grow += len(s.repl)
+	}
+	out := getBuf(grow)
+	off := 0
+	for _, s := range sp {
+		out.Write(bs[off:s.start])
+		out.Write(s.repl)
+		off = s.end
+	}
+	out.Write(bs[off:])
+	return out
+}
+
+// spliceRewrite is the minimal-diff alternative to the AST path: it makes
+// the same edits (prompt_cache_key injection when key != "", instructions
+// migration when migrate) as byte splices, leaving every other byte of the
+// client's body untouched. out is nil when nothing needed changing. ok is
+// false when bs isn't a JSON object the scanner can walk; the caller then
+// falls back to the AST path.
+func spliceRewrite(bs []byte, key string, migrate bool) (out *bytes.Buffer, ok bool) {
+	var members []jsonMember
+	start, end, err := scanObject(bs, func(m jsonMember) bool {
+		members = append(members, m)
+		return true
+	})
+	if err != nil {
+		return nil, false
+	}
+
+	var sp []splice
+	instr, input := -1, -1
+	for i, m := range members {
+		switch string(m.key(bs)) {
+		case "instructions":
+			if instr < 0 {
+				instr = i
+			}
+		case "input":
+			if input < 0 {
+				input = i
+			}
+		}
+	}
+
+	remaining := len(members)
+	appendInput := false
+	if migrate && instr >= 0 && bs[members[instr].ValStart] == '"' {
+		im := members[instr]
+		ins := bs[im.ValStart:im.ValEnd]
+
+		// drop the member together with one adjacent comma
+		switch {
+		case len(members) == 1:
+			sp = append(sp, splice{start: im.KeyStart, end: im.ValEnd})
+		case instr < len(members)-1:
+			sp = append(sp, splice{start: im.KeyStart, end: members[instr+1].KeyStart})
+		default:
+			sp = append(sp, splice{start: members[instr-1].ValEnd, end: im.ValEnd})
+		}
+		remaining--
+
+		dev := make([]byte, 0, len(ins)+40)
+		dev = append(dev, `{"role":"developer","content":`...)
+		dev = append(dev, ins...)
+		dev = append(dev, '}')
+
+		if input < 0 {
+			appendInput = true
+			pre := []byte(`"input":[`)
+			if remaining > 0 {
+				pre = []byte(`,"input":[`)
+			}
+			repl := append(append(pre, dev...), ']')
+			// before the closing '}' (and any whitespace preceding it)
+			at := end - 1
+			for at > start+1 && isWS(bs[at-1]) {
+				at--
+			}
+			sp = append(sp, splice{start: at, end: at, repl: repl})
+		} else {
+			in := members[input]
+			v := bs[in.ValStart:in.ValEnd]
+			var repl []byte
+			switch v[0] {
+			case '[':
+				// insert right after '[', adding a comma unless the array is empty
+				j := skipWS(bs, in.ValStart+1)
+				repl = dev
+				if bs[j] != ']' {
+					repl = append(dev, ',')
+				}
+				sp = append(sp, splice{start: in.ValStart + 1, end: in.ValStart + 1, repl: repl})
+			case '"':
+				repl = append(append([]byte{'['}, dev...), `,{"role":"user","content":`...)
+				repl = append(append(repl, v...), '}', ']')
+				sp = append(sp, splice{start: in.ValStart, end: in.ValEnd, repl: repl})
+			default:
+				// null or an unexpected type: replaced, as the AST path does
+				repl = append(append([]byte{'['}, dev...), ']')
+				sp = append(sp, splice{start: in.ValStart, end: in.ValEnd, repl: repl})
+			}
+		}
+	}
+
+	if key != "" {
+		repl := make([]byte, 0, len(key)+24)
+		repl = append(repl, `"prompt_cache_key":"`...)
+		repl = append(repl, key...)
+		repl = append(repl, '"')
+		if remaining > 0 || appendInput {
+			repl = append(repl, ',')
+		}
+		sp = append(sp, splice{start: start + 1, end: start + 1, repl: repl})
+	}
+
+	if len(sp) == 0 {
+		return nil, true
+	}
+	return applySplices(bs, sp), true
+}
@@ -0,0 +1,143 @@
+package reserve
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSpliceRewrite(t *testing.T) {
+	const dev = `{"role":"developer","content":"be brief"}`
+	for _, tc := range []struct {
+		name string
+		in   string
+		key  string
+		want string
+	}{
+		{
+			name: "string input",
+			in:   `{"model":"gpt-5", "temperature":1.50,  "instructions":"be brief","input":"hi"}`,
+			want: `{"model":"gpt-5", "temperature":1.50,  "input":[` + dev + `,{"role":"user","content":"hi"}]}`,
+		},
+		{
+			name: "array input, instructions last",
+			in:   "{\"input\": [ {\"role\":\"user\",\"content\":\"x\"} ],\n \"n\":1e3 , \"instructions\":\"be brief\"\n}",
+			want: "{\"input\": [" + dev + ", {\"role\":\"user\",\"content\":\"x\"} ],\n \"n\":1e3\n}",
+		},
+		{
+			name: "empty array input",
+			in:   `{"instructions":"be brief","input":[ ]}`,
+			want: `{"input":[` + dev + ` ]}`,
+		},
+		{
+			name: "null input",
+			in:   `{"input":null,"instructions":"be brief"}`,
+			want: `{"input":[` + dev + `]}`,
+		},
+		{
+			name: "no input",
+			in:   `{"model":"m","instructions":"be brief" }`,
+			want: `{"model":"m","input":[` + dev + `] }`,
+		},
+		{
+			name: "instructions only",
+			in:   `{"instructions":"be brief"}`,
+			want: `{"input":[` + dev + `]}`,
+		},
+		{
+			name: "escapes kept",
+			in:   `{"instructions":"be brief","input":"café \/ \"x\""}`,
+			want: `{"input":[` + dev + `,{"role":"user","content":"café \/ \"x\""}]}`,
+		},
+		{
+			name: "key only",
+			in:   `{ "input" : "hi" }`,
+			key:  "k1",
+			want: `{"prompt_cache_key":"k1", "input" : "hi" }`,
+		},
+		{
+			name: "key and migration",
+			in:   `{"instructions":"be brief"}`,
+			key:  "k1",
+			want: `{"prompt_cache_key":"k1","input":[` + dev + `]}`,
+		},
+		{
+			name: "key into empty object",
+			in:   `{}`,
+			key:  "k1",
+			want: `{"prompt_cache_key":"k1"}`,
+		},
+		{
+			name: "instructions not a string",
+			in:   `{"instructions":["x"],"input":"hi"}`,
+			want: `{"instructions":["x"],"input":"hi"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, ok := spliceRewrite([]byte(tc.in), tc.key, true)
+			if !ok {
+				t.Fatal("spliceRewrite refused the body")
+			}
+			got := tc.in
+			if out != nil {
+				got = out.String()
+			}
+			if got != tc.want {
+				t.Errorf("got  %s\nwant %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSpliceRewriteRefuses(t *testing.T) {
+	for _, s := range []string{`[]`, `{"a":1`, `not json`} {
+		if _, ok := spliceRewrite([]byte(s), "k", true); ok {
+			t.Errorf("spliceRewrite accepted %q", s)
+		}
+	}
+}
+
+// TestMinimalDiffMatchesAST checks that the minimal-diff rewrite and the
+// AST rewrite forward semantically equal bodies.
+func TestMinimalDiffMatchesAST(t *testing.T) {
+	minimal := DefaultOptions()
+	minimal.MinimalDiff = true
+	ast, splice := NewRewriter(DefaultOptions()), NewRewriter(minimal)
+	for _, body := range []string{
+		`{"model":"gpt-5","temperature":1.50,"instructions":"be brief","input":"hi"}`,
+		`{"input":[{"role":"user","content":[{"type":"input_text","text":"x"}]}],"instructions":"be brief","n":1e3}`,
+		`{"instructions":"be brief","input":[]}`,
+		`{"instructions":"be brief","input":null,"stream":true}`,
+		`{"instructions":"be brief","tools":[{"type":"function","name":"f","parameters":{}}]}`,
+		`{"instructions":"café","input":"😀"}`,
+		`{"instructions":"be brief","input":"hi","prompt_cache_key":"mine"}`,
+		`{"input":"hi"}`,
+	} {
+		_, a := rewrite(t, ast, "/v1/responses", bearer("sk-a"), []byte(body))
+		_, s := rewrite(t, splice, "/v1/responses", bearer("sk-a"), []byte(body))
+		var av, sv any
+		if err := json.Unmarshal(a, &av); err != nil {
+			t.Fatalf("AST output %s: %v", a, err)
+		}
+		if err := json.Unmarshal(s, &sv); err != nil {
+			t.Fatalf("minimal-diff output %s: %v", s, err)
+		}
+		if !reflect.DeepEqual(av, sv) {
+			t.Errorf("%s\n AST:          %s\n minimal diff: %s", body, a, s)
+		}
+	}
+}
+
+func TestMinimalDiffKeepsBytes(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MinimalDiff = true
+	rr := NewRewriter(opts)
+	body := "{\"z\":1.50, \"a\" :\t\"\\u00e9\",\n\"instructions\":\"be brief\",\"input\":\"hi\"}"
+	_, out := rewrite(t, rr, "/v1/responses", bearer("sk-a"), []byte(body))
+	want := `{"prompt_cache_key":"` + cacheKey("Bearer sk-a") + `",` +
+		"\"z\":1.50, \"a\" :\t\"\\u00e9\",\n" +
+		`"input":[{"role":"developer","content":"be brief"},{"role":"user","content":"hi"}]}`
+	if string(out) != want {
+		t.Errorf("got  %s\nwant %s", out, want)
+	}
+}
@@ -0,0 +1,191 @@
+package reserve
+
+import (
+	"net/http"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+const (
+	reservePrefix = "/_reserve/"
+	statsPath     = reservePrefix + "stats"
+)
+
+// stats output is read by humans, keep keys sorted
+var statsAPI = sonic.Config{SortMapKeys: true, NoEncoderNewline: true}.Froze()
+
+// statsRegistry holds the sections rendered at statsPath, keyed by feature
+// name. The admin config endpoint is built from one too.
+type statsRegistry struct {
+	mu       sync.RWMutex
+	sections map[string]func() any
+}
+
+func (s *statsRegistry) register(name string, fn func() any) {
+	s.mu.Lock()
+	if s.sections == nil {
+		s.sections = map[string]func() any{}
+	}
+	s.sections[name] = fn
+	s.mu.Unlock()
+}
+
+func (s *statsRegistry) snapshot() map[string]any {
+	s.mu.RLock()
+	out := make(map[string]any, len(s.sections))
+	for name, fn := range s.sections {
+		out[name] = fn()
+	}
+	s.mu.RUnlock()
+	return out
+}
+
+func (s *statsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bs, err := statsAPI.Marshal(s.snapshot())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(bs)
+}
+
+// registerStats adds the Rewriter's sections to s.
+func (rr *Rewriter) registerStats(s *statsRegistry) {
+	s.register("batch", rr.batchStats)
+	s.register("body_limit", rr.bodyLimitStats)
+	s.register("body_budget", rr.bodyBudgetStats)
+	s.register("canonical_json", rr.canonicalStats)
+	s.register("client_cache", rr.clientCacheStats)
+	s.register("client_ip", rr.clientIPStats)
+	s.register("client_disconnects", rr.disconnectStats)
+	s.register("content_types", rr.contentTypeStats)
+	s.register("input_window", rr.inputWindowStats)
+	s.register("json_limits", rr.jsonLimitStats)
+	s.register("ndjson", rr.ndjsonStats)
+	s.register("policy", rr.policyStats)
+	s.register("rewrite", rr.rewriteStats)
+	s.register("schema", rr.schemaStats)
+	s.register("spill", rr.spillStats)
+	s.register("stale_reasoning", rr.staleReasoningStats)
+	s.register("system_role", rr.systemRoleStats)
+	s.register("tolerant_json", rr.tolerantStats)
+	s.register("unwrap", rr.unwrapStats)
+}
+
+// Stats returns the Rewriter's counters, as served under /_reserve/stats
+// by a Proxy. Buffer pools are shared by every Rewriter in the process, so
+// the "bufpool", "copypool" and "gzip_readers" sections are process-wide.
+func (rr *Rewriter) Stats() map[string]any {
+	var s statsRegistry
+	rr.registerStats(&s)
+	s.register("bufpool", bufPoolStats)
+	s.register("copypool", copyPoolStats)
+	s.register("gzip_readers", gzipPoolStats)
+	return s.snapshot()
+}
+
+// memStats is the "memory" section: process-wide allocator and GC
+// counters, for allocation-per-request measurements such as rc-proxy bench.
+func memStats() any {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return map[string]any{
+		"mallocs":           m.Mallocs,
+		"frees":             m.Frees,
+		"total_alloc_bytes": m.TotalAlloc,
+		"heap_alloc_bytes":  m.HeapAlloc,
+		"num_gc":            m.NumGC,
+		"gc_pause_total_ns": m.PauseTotalNs,
+	}
+}
+
+// memSampleEvery is how often the "gc" section's MemStats are sampled;
+// ReadMemStats stops the world briefly, so stats requests don't call it.
+const memSampleEvery = 10 * time.Second
+
+// memSampler keeps the latest process-wide MemStats sample.
+var memSampler struct {
+	once sync.Once
+	mu   sync.Mutex
+	last map[string]any
+
+	peakInuse uint64
+	prevGC    uint32
+	prevAt    time.Time
+}
+
+// startMemSampler starts the process's sampler on first use.
+func startMemSampler() {
+	memSampler.once.Do(func() {
+		sampleMem()
+		go func() {
+			for range time.Tick(memSampleEvery) {
+				sampleMem()
+			}
+		}()
+	})
+}
+
+func sampleMem() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	now := time.Now()
+
+	// PauseNs is a ring of the last 256 pauses, the latest at (NumGC+255)%256
+	n := min(int(m.NumGC), len(m.PauseNs))
+	pauses := make([]uint64, 0, n)
+	for i := range n {
+		pauses = append(pauses, m.PauseNs[(int(m.NumGC)-1-i+len(m.PauseNs))%len(m.PauseNs)])
+	}
+	slices.Sort(pauses)
+	pct := func(p int) float64 {
+		if len(pauses) == 0 {
+			return 0
+		}
+		return float64(pauses[(len(pauses)-1)*p/100]) / 1e6
+	}
+	var maxPause float64
+	if len(pauses) > 0 {
+		maxPause = float64(pauses[len(pauses)-1]) / 1e6
+	}
+
+	s := &memSampler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peakInuse = max(s.peakInuse, m.HeapInuse)
+	rate := 0.0
+	if !s.prevAt.IsZero() {
+		rate = float64(m.NumGC-s.prevGC) / now.Sub(s.prevAt).Seconds()
+	}
+	s.prevGC, s.prevAt = m.NumGC, now
+	s.last = map[string]any{
+		"sampled_at":          now.UTC().Format(time.RFC3339),
+		"interval":            memSampleEvery.String(),
+		"heap_inuse_bytes":    m.HeapInuse,
+		"heap_inuse_peak":     s.peakInuse,
+		"heap_idle_bytes":     m.HeapIdle,
+		"heap_released_bytes": m.HeapReleased,
+		"heap_objects":        m.HeapObjects,
+		"next_gc_bytes":       m.NextGC,
+		"num_gc":              m.NumGC,
+		"gc_per_second":       rate,
+		"gc_cpu_fraction":     m.GCCPUFraction,
+		"pause_recent_count":  len(pauses),
+		"pause_recent_p50_ms": pct(50),
+		"pause_recent_p99_ms": pct(99),
+		"pause_recent_max_ms": maxPause,
+	}
+}
+
+// gcStats is the "gc" section: the latest MemStats sample, with the gc
+// rate since the one before and pause percentiles over the last 256 GCs.
+func gcStats() any {
+	memSampler.mu.Lock()
+	defer memSampler.mu.Unlock()
+	return memSampler.last
+}
@@ -0,0 +1,312 @@
+package reserve
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A Store attached with AttachStore keeps proxy state across restarts:
+// the usage aggregates (route request and token counts, background usage,
+// the spend with a price table, the quota counts of the current periods)
+// are saved every Options.StoreFlush and
+// when the store is detached, and loaded back on attach; the background
+// response owners are written through as they change and expire in the
+// store like they do in memory.
+//
+// Nothing on the request path waits for the store. Writes are queued and
+// applied in batches by one goroutine; when the queue is full they are
+// dropped (and counted), the in-memory state being authoritative.
+//
+// Conversation prompt_cache_keys are derived from the conversation id
+// alone (see conversationKey), so they come out the same after a restart
+// without being stored.
+
+// Store is a persistent key-value store with per-entry expiry.
+type Store interface {
+	// LoadCounters returns the saved usage aggregates, SaveCounters
+	// replaces them.
+	LoadCounters() (map[string]int64, error)
+	SaveCounters(map[string]int64) error
+	// Load calls fn for every entry of bucket that has not expired by now.
+	Load(bucket string, now time.Time, fn func(key string, val []byte, exp time.Time)) error
+	// Write applies ops in order, in one transaction where the store has
+	// them.
+	Write(ops []StoreOp) error
+	// Sweep deletes the entries expired by now and returns how many.
+	Sweep(now time.Time) (int, error)
+	Close() error
+}
+
+// StoreOp is one write to a Store bucket: a put of Value until Expires,
+// or a delete.
+type StoreOp struct {
+	Bucket  string
+	Key     string
+	Value   []byte
+	Expires time.Time
+	Delete  bool
+}
+
+const (
+	storeBackgroundOwners = "background_owners"
+
+	storeQueueSize  = 4096
+	storeBatchMax   = 256
+	storeBatchDelay = 100 * time.Millisecond
+)
+
+var errStoreAttached = errors.New("reserve: a store is attached already")
+
+// persister is an attached Store and the goroutine writing to it.
+type persister struct {
+	s     Store
+	ops   chan StoreOp
+	stop  chan struct{}
+	done  chan struct{}
+	flush time.Duration
+
+	writes   atomic.Int64
+	dropped  atomic.Int64 // queue full
+	saves    atomic.Int64
+	swept    atomic.Int64
+	errs     atomic.Int64
+	lastSave atomic.Int64 // unix seconds
+}
+
+// AttachStore loads the state saved in s and keeps it saved from now on,
+// until DetachStore. Aggregates are loaded only on the first attach of the
+// process: after that the counters in memory already include them.
+func (p *Proxy) AttachStore(s Store) error {
+	if p.store.Load() != nil {
+		return errStoreAttached
+	}
+	if !p.storeLoaded.Load() {
+		m, err := s.LoadCounters()
+		if err != nil {
+			return err
+		}
+		p.restoreCounters(m)
+		p.storeLoaded.Store(true)
+	}
+	n := 0
+	err := s.Load(storeBackgroundOwners, time.Now(), func(k string, v []byte, exp time.Time) {
+		src, key, ok := strings.Cut(string(v), "\x00")
+		if !ok {
+			return
+		}
+		p.background.owners.addExp(k, &clientIdentity{CacheKey: key, Source: src}, exp)
+		n++
+	})
+	if err != nil {
+		return err
+	}
+	flush := p.opts.StoreFlush
+	if flush <= 0 {
+		flush = time.Minute
+	}
+	ps := &persister{
+		s:     s,
+		ops:   make(chan StoreOp, storeQueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		flush: flush,
+	}
+	if !p.store.CompareAndSwap(nil, ps) {
+		return errStoreAttached
+	}
+	go ps.run(p)
+	slog.Info("store attached", "background_owners", n, "flush", flush)
+	return nil
+}
+
+// DetachStore writes what is queued, saves the aggregates and closes the
+// store. Without an attached store it does nothing.
+func (p *Proxy) DetachStore() error {
+	ps := p.store.Swap(nil)
+	if ps == nil {
+		return nil
+	}
+	close(ps.stop)
+	<-ps.done
+	return ps.s.Close()
+}
+
+// persist queues op for the attached store, if any.
+func (p *Proxy) persist(op StoreOp) {
+	ps := p.store.Load()
+	if ps == nil {
+		return
+	}
+	select {
+	case ps.ops <- op:
+	default:
+		ps.dropped.Add(1)
+	}
+}
+
+func (ps *persister) run(p *Proxy) {
+	defer close(ps.done)
+	tick := time.NewTicker(ps.flush)
+	defer tick.Stop()
+	var (
+		batch []StoreOp
+		timer <-chan time.Time
+	)
+	write := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := ps.s.Write(batch); err != nil {
+			ps.errs.Add(1)
+			slog.Warn("store: write failed", "ops", len(batch), "error", err)
+		} else {
+			ps.writes.Add(int64(len(batch)))
+		}
+		batch, timer = batch[:0], nil
+	}
+	for {
+		select {
+		case op := <-ps.ops:
+			batch = append(batch, op)
+			if len(batch) >= storeBatchMax {
+				write()
+			} else if timer == nil {
+				timer = time.After(storeBatchDelay)
+			}
+		case <-timer:
+			write()
+		case <-tick.C:
+			write()
+			ps.save(p)
+			if n, err := ps.s.Sweep(time.Now()); err != nil {
+				ps.errs.Add(1)
+				slog.Warn("store: sweep failed", "error", err)
+			} else {
+				ps.swept.Add(int64(n))
+			}
+		case <-ps.stop:
+			for len(ps.ops) > 0 {
+				batch = append(batch, <-ps.ops)
+			}
+			write()
+			ps.save(p)
+			return
+		}
+	}
+}
+
+func (ps *persister) save(p *Proxy) {
+	if err := ps.s.SaveCounters(p.counters()); err != nil {
+		ps.errs.Add(1)
+		slog.Warn("store: saving counters failed", "error", err)
+		return
+	}
+	ps.saves.Add(1)
+	ps.lastSave.Store(time.Now().Unix())
+}
+
+func (p *Proxy) storeStats() any {
+	ps := p.store.Load()
+	if ps == nil {
+		return map[string]any{"enabled": false}
+	}
+	s := map[string]any{
+		"enabled": true,
+		"flush":   ps.flush.String(),
+		"queued":  len(ps.ops),
+		"writes":  ps.writes.Load(),
+		"dropped": ps.dropped.Load(),
+		"saves":   ps.saves.Load(),
+		"swept":   ps.swept.Load(),
+		"errors":  ps.errs.Load(),
+	}
+	if t := ps.lastSave.Load(); t > 0 {
+		s["last_save"] = time.Unix(t, 0).UTC().Format(time.RFC3339)
+	}
+	return s
+}
+
+// counters returns the usage aggregates by name, for the store.
+func (p *Proxy) counters() map[string]int64 {
+	m := make(map[string]int64, 2*len(p.routes.m)+3)
+	for name, rc := range p.routes.m {
+		m["route."+name+".requests"] = rc.requests.Load()
+		if rc.rt.usage {
+			m["route."+name+".tokens"] = rc.tokens.Load()
+		}
+	}
+	b := p.background
+	m["background.created"] = b.created.Load()
+	m["background.attributed"] = b.attributed.Load()
+	m["background.tokens"] = b.tokens.Load()
+	if p.costs != nil {
+		p.costs.counters(m)
+	}
+	if p.quotas != nil {
+		p.quotas.counters(m)
+	}
+	return m
+}
+
+// restoreCounters adds the saved aggregates m to the counters; names it
+// doesn't know (a route since removed) are ignored.
+func (p *Proxy) restoreCounters(m map[string]int64) {
+	for k, v := range m {
+		if rest, ok := strings.CutPrefix(k, "route."); ok {
+			name, field, _ := strings.Cut(rest, ".")
+			rc := p.routes.m[name]
+			switch {
+			case rc == nil:
+			case field == "requests":
+				rc.requests.Add(v)
+			case field == "tokens":
+				rc.tokens.Add(v)
+			}
+			continue
+		}
+		if strings.HasPrefix(k, "cost.") {
+			if p.costs != nil {
+				p.costs.restore(k, v)
+			}
+			continue
+		}
+		if strings.HasPrefix(k, "quota.") {
+			if p.quotas != nil {
+				p.quotas.restore(k, v)
+			}
+			continue
+		}
+		b := p.background
+		switch k {
+		case "background.created":
+			b.created.Add(v)
+		case "background.attributed":
+			b.attributed.Add(v)
+		case "background.tokens":
+			b.tokens.Add(v)
+		}
+	}
+}
+
+// store values are the expiry (unix nanoseconds, 0 = none) then the value
+func encodeStoreValue(v []byte, exp time.Time) []byte {
+	out := make([]byte, 8, 8+len(v))
+	if !exp.IsZero() {
+		binary.BigEndian.PutUint64(out, uint64(exp.UnixNano()))
+	}
+	return append(out, v...)
+}
+
+func decodeStoreValue(b []byte) (v []byte, exp time.Time, ok bool) {
+	if len(b) < 8 {
+		return nil, time.Time{}, false
+	}
+	if n := binary.BigEndian.Uint64(b); n != 0 {
+		exp = time.Unix(0, int64(n))
+	}
+	return b[8:], exp, true
+}
@@ -0,0 +1,206 @@
+package reserve
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+)
+
+// boltStore is a Store in a bbolt file, one bucket per Store bucket plus
+// one for the counters.
+type boltStore struct {
+	db *bolt.DB
+}
+
+var (
+	boltCounters = []byte("_counters")
+
+	errBoltDamaged = errors.New("store damaged")
+)
+
+// boltLockWait bounds the wait for the file lock, held by another process
+// using the same store.
+const boltLockWait = 5 * time.Second
+
+// OpenBoltStore opens the bbolt store at path, creating it when missing.
+// A file that can't be read as one is moved aside to path.corrupt-<time>
+// and a fresh store started in its place, so a damaged file costs the saved
+// state but never the startup. A file locked by another process is an
+// error.
+func OpenBoltStore(path string) (Store, error) {
+	db, err := openBolt(path)
+	if err == nil {
+		if err = checkBolt(db); err != nil {
+			db.Close()
+		}
+	}
+	if err == nil {
+		return &boltStore{db: db}, nil
+	}
+	if errors.Is(err, berrors.ErrTimeout) {
+		return nil, fmt.Errorf("store %s is locked by another process", path)
+	}
+	if !errors.Is(err, errBoltDamaged) && !errors.Is(err, berrors.ErrInvalid) &&
+		!errors.Is(err, berrors.ErrChecksum) && !errors.Is(err, berrors.ErrVersionMismatch) {
+		// permissions, a missing directory: not the file's fault
+		return nil, err
+	}
+	aside := path + ".corrupt-" + time.Now().UTC().Format("20060102T150405")
+	slog.Error("store unreadable, moved aside and starting fresh", "path", path, "moved_to", aside, "error", err)
+	if err := os.Rename(path, aside); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	db, err = openBolt(path)
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// openBolt opens path; bbolt panics on some kinds of damage, which become
+// errors here.
+func openBolt(path string) (db *bolt.DB, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			db, err = nil, fmt.Errorf("%w: panic opening: %v", errBoltDamaged, v)
+		}
+	}()
+	return bolt.Open(path, 0o600, &bolt.Options{Timeout: boltLockWait})
+}
+
+// checkBolt reads every entry of db, which is small, so damage shows at
+// startup rather than halfway through a write. (tx.Check reads in a
+// goroutine of its own, where a panic on a damaged page can't be caught.)
+func checkBolt(db *bolt.DB) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("%w: panic reading: %v", errBoltDamaged, v)
+		}
+	}()
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(_ []byte, b *bolt.Bucket) error {
+			return b.ForEach(func(_, _ []byte) error { return nil })
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", errBoltDamaged, err)
+	}
+	return nil
+}
+
+func (s *boltStore) LoadCounters() (map[string]int64, error) {
+	m := map[string]int64{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltCounters)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if len(v) == 8 {
+				m[string(k)] = int64(binary.BigEndian.Uint64(v))
+			}
+			return nil
+		})
+	})
+	return m, err
+}
+
+func (s *boltStore) SaveCounters(m map[string]int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltCounters) != nil {
+			if err := tx.DeleteBucket(boltCounters); err != nil {
+				return err
+			}
+		}
+		b, err := tx.CreateBucket(boltCounters)
+		if err != nil {
+			return err
+		}
+		for k, n := range m {
+			// bbolt keeps the value until the commit, so one each
+			v := binary.BigEndian.AppendUint64(nil, uint64(n))
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Load(bucket string, now time.Time, fn func(key string, val []byte, exp time.Time)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, raw []byte) error {
+			v, exp, ok := decodeStoreValue(raw)
+			if !ok || !exp.IsZero() && now.After(exp) {
+				return nil
+			}
+			// bbolt's slices are only valid in the transaction
+			fn(string(k), append([]byte(nil), v...), exp)
+			return nil
+		})
+	})
+}
+
+func (s *boltStore) Write(ops []StoreOp) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, op := range ops {
+			if op.Delete {
+				if b := tx.Bucket([]byte(op.Bucket)); b != nil {
+					if err := b.Delete([]byte(op.Key)); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			b, err := tx.CreateBucketIfNotExists([]byte(op.Bucket))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(op.Key), encodeStoreValue(op.Value, op.Expires)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Sweep(now time.Time) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if string(name) == string(boltCounters) {
+				return nil
+			}
+			var expired [][]byte
+			err := b.ForEach(func(k, raw []byte) error {
+				if _, exp, ok := decodeStoreValue(raw); !ok || !exp.IsZero() && now.After(exp) {
+					expired = append(expired, append([]byte(nil), k...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			n += len(expired)
+			return nil
+		})
+	})
+	return n, err
+}
+
+func (s *boltStore) Close() error { return s.db.Close() }
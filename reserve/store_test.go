@@ -0,0 +1,79 @@
+package reserve
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// BenchmarkServeHTTPStore serves background requests in parallel, each
+// answered with a new queued response whose owner is written through to an
+// attached store; what the bolt case adds over memory is what the store
+// costs the request path.
+func BenchmarkServeHTTPStore(b *testing.B) {
+	b.Run("memory", func(b *testing.B) { benchmarkServeHTTPStore(b, false) })
+	b.Run("bolt", func(b *testing.B) { benchmarkServeHTTPStore(b, true) })
+}
+
+func benchmarkServeHTTPStore(b *testing.B, attach bool) {
+	var n atomic.Int64
+	opts := DefaultOptions()
+	opts.Target = "http://upstream.test"
+	opts.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		io.Copy(io.Discard, r.Body)
+		r.Body.Close()
+		body := `{"id":"resp_` + strconv.FormatInt(n.Add(1), 10) + `","status":"queued"}`
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"application/json"}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       r,
+		}, nil
+	})
+	p, err := NewProxy(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if attach {
+		s, err := OpenBoltStore(filepath.Join(b.TempDir(), "state.db"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := p.AttachStore(s); err != nil {
+			b.Fatal(err)
+		}
+		defer p.DetachStore()
+	}
+	hdr := bearer("sk-a")
+	body := `{"model":"gpt-5","input":"hi","background":true}`
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if w := send(p, http.MethodPost, "/v1/responses", hdr, body); w.Code != http.StatusOK {
+				b.Errorf("status %d: %s", w.Code, w.Body)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	if ps := p.store.Load(); ps != nil {
+		// once the queue is written out; dropped writes are the queue
+		// falling behind, not the request waiting on it
+		p.DetachStore()
+		b.ReportMetric(float64(ps.writes.Load())/float64(b.N), "writes/op")
+		b.ReportMetric(float64(ps.dropped.Load())/float64(b.N), "dropped/op")
+	}
+}
@@ -0,0 +1,264 @@
+package reserve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// Every event stream of a matched route is watched to the end and its
+// termination classified: a terminal event (completed, or failed: a
+// response.failed or error event), the client leaving, the upstream
+// ending the stream without a terminal event, a proxy timeout, or the
+// stream outgrowing Options.MaxStreamBytes (see respsize.go). The
+// class is logged with the response id and the elapsed time, and counted
+// in the streams stats section.
+
+const (
+	streamCompleted = "completed"
+	streamFailed    = "failed"
+	streamClient    = "client_disconnect"
+	streamUpstream  = "upstream_eof"
+	streamTimeout   = "proxy_timeout"
+	streamTooLarge  = "size_limit"
+)
+
+var streamClasses = [...]string{streamCompleted, streamFailed, streamClient, streamUpstream, streamTimeout, streamTooLarge}
+
+// errStreamTooLarge ends a stream cut at Options.MaxStreamBytes.
+var errStreamTooLarge = errors.New("reserve: stream exceeds MaxStreamBytes")
+
+// streamEndCounts counts ended streams by class, in streamClasses order.
+type streamEndCounts [len(streamClasses)]atomic.Int64
+
+func (c *streamEndCounts) add(class string) {
+	for i, k := range streamClasses {
+		if k == class {
+			c[i].Add(1)
+			return
+		}
+	}
+}
+
+func (p *Proxy) streamStats() any {
+	out := make(map[string]any, len(streamClasses))
+	for i, k := range streamClasses {
+		out[k] = p.streamEnds[i].Load()
+	}
+	return out
+}
+
+// watchStream wraps the body of streaming response resp to classify how
+// it ends.
+func (p *Proxy) watchStream(resp *http.Response, st *reqState) {
+	resp.Body = &streamWatch{
+		rc:    resp.Body,
+		p:     p,
+		st:    st,
+		ctx:   resp.Request.Context(),
+		lines: sseLines{limit: p.opts.MaxBody},
+	}
+}
+
+// streamWatch passes a stream through, noting its response id and
+// terminal event, and classifies the end on the first read error or on
+// Close, whichever comes first.
+type streamWatch struct {
+	rc    io.ReadCloser
+	p     *Proxy
+	st    *reqState
+	ctx   context.Context
+	lines sseLines
+
+	id       string
+	terminal string // class of the terminal event seen, if any
+	status   string // the terminal event's type
+	bytes    int64
+	ended    bool
+	last     [2]byte // the stream's last two bytes
+	tail     []byte  // the error event ending a broken stream, then EOF
+}
+
+func (w *streamWatch) Read(b []byte) (int, error) {
+	if w.tail != nil {
+		if len(w.tail) == 0 {
+			return 0, io.EOF
+		}
+		n := copy(b, w.tail)
+		w.tail = w.tail[n:]
+		return n, nil
+	}
+	n, err := w.rc.Read(b)
+	n, over := w.capStream(n)
+	w.bytes += int64(n)
+	if n > 0 && w.terminal == "" {
+		w.lines.write(b[:n], w.event)
+	}
+	switch {
+	case n > 1:
+		w.last = [2]byte{b[n-2], b[n-1]}
+	case n == 1:
+		w.last = [2]byte{w.last[1], b[0]}
+	}
+	if over {
+		w.rc.Close()
+		w.end(errStreamTooLarge)
+		w.tail = w.endWith(sseStreamTooLargeEvent)
+		return n, nil
+	}
+	if err != nil {
+		w.end(err)
+		if err != io.EOF && w.terminal == "" && w.ctx.Err() == nil {
+			// broken off by the upstream: end it with an error event
+			w.p.midstream.streams.Add(1)
+			w.st.trace.log("upstream_stream_broken", "error", err, "bytes", w.bytes)
+			w.tail = w.endWith(sseUpstreamBrokenEvent)
+			return n, nil
+		}
+	}
+	return n, err
+}
+
+// endWith is the tail ending the stream with event, after a blank line
+// closing an event cut short.
+func (w *streamWatch) endWith(event []byte) []byte {
+	if w.bytes > 0 && w.last != [2]byte{'\n', '\n'} {
+		return append([]byte("\n\n"), event...)
+	}
+	return event
+}
+
+func (w *streamWatch) Close() error {
+	// the proxy stops reading early only when writing to the client failed
+	w.end(nil)
+	return w.rc.Close()
+}
+
+func (w *streamWatch) event(line []byte) {
+	if w.terminal != "" {
+		return
+	}
+	d, ok := bytes.CutPrefix(line, []byte("data:"))
+	if !ok {
+		return
+	}
+	d = bytes.TrimPrefix(d, []byte(" "))
+	if bytes.Equal(d, []byte("[DONE]")) {
+		w.terminal = streamCompleted
+		return
+	}
+	tn, err := sonic.Get(d, "type")
+	if err != nil {
+		return
+	}
+	typ, _ := tn.String()
+	switch typ {
+	case "response.created":
+		if n, err := sonic.Get(d, "response", "id"); err == nil {
+			w.id, _ = n.String()
+		}
+		return
+	case "response.completed", "response.incomplete":
+		w.terminal = streamCompleted
+	case "response.failed", "error":
+		w.terminal = streamFailed
+	default:
+		return
+	}
+	w.status = typ
+	if w.id == "" {
+		if n, err := sonic.Get(d, "response", "id"); err == nil {
+			w.id, _ = n.String()
+		}
+	}
+	w.lines.reset()
+}
+
+// end classifies the stream: by its terminal event when there was one,
+// else by why it stopped. err is the read error, nil from Close.
+func (w *streamWatch) end(err error) {
+	if w.ended {
+		return
+	}
+	w.ended = true
+	class := w.terminal
+	if class == "" {
+		switch cause := context.Cause(w.ctx); {
+		case err == errStreamTooLarge:
+			class = streamTooLarge
+		case cause == errStreamIdle || cause == errRequestTimeout:
+			class = streamTimeout
+		case w.ctx.Err() != nil || err == nil:
+			class = streamClient
+		default:
+			class = streamUpstream
+		}
+	}
+	if class == streamClient {
+		w.p.rewriter.countLeft(w.ctx, leftResponse)
+	}
+	w.p.streamEnds.add(class)
+	w.st.wide.streamEnd(class, w.status, w.id)
+	w.st.trace.log("stream_end", "class", class, "event", w.status, "response_id", w.id, "bytes", w.bytes)
+	attrs := []any{"class", class, "route", w.st.route.name, "response_id", w.id,
+		"elapsed", time.Since(w.st.start).Round(time.Millisecond), "bytes", w.bytes}
+	if w.status != "" {
+		attrs = append(attrs, "event", w.status)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		attrs = append(attrs, "error", err)
+	}
+	switch class {
+	case streamCompleted, streamFailed:
+		w.st.log.Info("stream ended", attrs...)
+	default:
+		w.st.log.Warn("stream ended without a terminal event", attrs...)
+	}
+}
+
+// sseLines splits a stream into lines as it passes, for fn, with the line
+// ending (and a trailing \r) removed. Lines over limit (MaxBody, or
+// defaultLineCap when that is unlimited) are skipped.
+type sseLines struct {
+	limit int64
+	line  []byte
+	skip  bool // in a line over limit
+}
+
+func (s *sseLines) write(b []byte, fn func(line []byte)) {
+	limit := s.limit
+	if limit <= 0 {
+		limit = defaultLineCap
+	}
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		part := b
+		if i >= 0 {
+			part = b[:i]
+		}
+		if !s.skip {
+			if int64(len(s.line)+len(part)) > limit {
+				s.skip, s.line = true, s.line[:0]
+			} else {
+				s.line = append(s.line, part...)
+			}
+		}
+		if i < 0 {
+			return
+		}
+		if !s.skip {
+			fn(bytes.TrimRight(s.line, "\r"))
+		}
+		s.line, s.skip = s.line[:0], false
+		b = b[i+1:]
+	}
+}
+
+// reset drops the buffered line, for a reader done with the stream.
+func (s *sseLines) reset() { s.line, s.skip = nil, false }
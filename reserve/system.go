@@ -0,0 +1,168 @@
+package reserve
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sync/atomic"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/ast"
+)
+
+// Some clients still send {"role": "system"} items in input, which newer
+// Responses backends treat inconsistently. With Options.SystemToDeveloper
+// the system_role hook turns the system messages at the top level of
+// input into developer messages. It runs after the instructions migration:
+// a system item whose content is the same as that of a developer message
+// already there (the migrated instructions, or an earlier system item) is
+// dropped rather than sent twice. Items nested deeper, as in function
+// outputs, are left alone.
+
+var kSystem = []byte(`"system"`)
+
+type systemRoleCounts struct {
+	converted  atomic.Int64 // items turned into developer messages
+	duplicates atomic.Int64 // items dropped as duplicates
+}
+
+func (rr *Rewriter) systemRoleStats() any {
+	return map[string]any{
+		"enabled":    rr.opts.SystemToDeveloper,
+		"converted":  rr.systemRole.converted.Load(),
+		"duplicates": rr.systemRole.duplicates.Load(),
+	}
+}
+
+func systemRoleHook(r *Request) error {
+	rr := r.rw.rr
+	if !rr.opts.SystemToDeveloper {
+		return nil
+	}
+	if r.parsed {
+		if !hasSystemItem(r.root.Get("input")) {
+			return nil
+		}
+	} else {
+		// look before taking the AST
+		bs := r.Body()
+		if !bytes.Contains(bs, kSystem) {
+			return nil
+		}
+		if ok, err := r.walkable(); !ok {
+			return err
+		}
+		in, err := sonic.Get(bs, "input")
+		if err != nil || !hasSystemItem(&in) {
+			return nil
+		}
+	}
+	root, err := r.JSON()
+	if root == nil {
+		return err
+	}
+	in := root.Get("input")
+	if nodeType(in) != ast.V_ARRAY {
+		return nil
+	}
+	items, err := in.ArrayUseNode()
+	if err != nil {
+		return err
+	}
+	seen := map[[sha256.Size]byte]bool{}
+	for i := range items {
+		if isMessage(&items[i]) && nodeString(items[i].Get("role")) == "developer" {
+			seen[contentHash(items[i].Get("content"))] = true
+		}
+	}
+	kept := make([]ast.Node, 0, len(items))
+	converted, dropped := 0, 0
+	for i := range items {
+		it := &items[i]
+		if !isMessage(it) || nodeString(it.Get("role")) != "system" {
+			kept = append(kept, *it)
+			continue
+		}
+		h := contentHash(it.Get("content"))
+		if seen[h] {
+			dropped++
+			continue
+		}
+		seen[h] = true
+		if _, err := it.Set("role", ast.NewString("developer")); err != nil {
+			return err
+		}
+		converted++
+		kept = append(kept, *it)
+	}
+	if converted == 0 && dropped == 0 {
+		return nil
+	}
+	// set input even when nothing was dropped: items are copies, and the
+	// new roles may not reach the array they came from
+	if _, err := root.Set("input", ast.NewArray(kept)); err != nil {
+		return err
+	}
+	rr.systemRole.converted.Add(int64(converted))
+	rr.systemRole.duplicates.Add(int64(dropped))
+	r.Logger().Debug("system role: input items turned into developer messages", "route", r.Route,
+		"converted", converted, "duplicates", dropped)
+	traceOf(r.HTTP.Context()).log("system_role", "converted", converted, "duplicates", dropped)
+	return nil
+}
+
+func hasSystemItem(in *ast.Node) bool {
+	if nodeType(in) != ast.V_ARRAY {
+		return false
+	}
+	items, err := in.ArrayUseNode()
+	if err != nil {
+		return false
+	}
+	for i := range items {
+		if isMessage(&items[i]) && nodeString(items[i].Get("role")) == "system" {
+			return true
+		}
+	}
+	return false
+}
+
+// isMessage reports whether the input item n is a message; the type may be
+// left out.
+func isMessage(n *ast.Node) bool {
+	if nodeType(n) != ast.V_OBJECT {
+		return false
+	}
+	t := nodeString(n.Get("type"))
+	return t == "" || t == "message"
+}
+
+// contentHash hashes a message's content so that a string and the same
+// text as an array of text parts hash alike.
+func contentHash(n *ast.Node) [sha256.Size]byte {
+	h := sha256.New()
+	switch nodeType(n) {
+	case ast.V_STRING:
+		s, _ := n.String()
+		h.Write([]byte(s))
+	case ast.V_ARRAY:
+		parts, _ := n.ArrayUseNode()
+		for i := range parts {
+			if i > 0 {
+				h.Write([]byte{0})
+			}
+			if t := parts[i].Get("text"); nodeType(t) == ast.V_STRING {
+				s, _ := t.String()
+				h.Write([]byte(s))
+			} else {
+				raw, _ := parts[i].Raw()
+				h.Write([]byte(raw))
+			}
+		}
+	default:
+		raw, _ := n.Raw()
+		h.Write([]byte(raw))
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
@@ -0,0 +1,86 @@
+package reserve
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSystemRole(t *testing.T) {
+	opts := DefaultOptions()
+	opts.SystemToDeveloper = true
+	rr := NewRewriter(opts)
+	for _, tc := range []struct {
+		name, body, want string
+	}{
+		{
+			"one system item",
+			`{"input":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"}]}`,
+			`[{"role":"developer","content":"be brief"},{"role":"user","content":"hi"}]`,
+		},
+		{
+			"several system items",
+			`{"input":[{"type":"message","role":"system","content":"be brief"},{"role":"user","content":"hi"},{"role":"system","content":"use metric"}]}`,
+			`[{"type":"message","role":"developer","content":"be brief"},{"role":"user","content":"hi"},{"role":"developer","content":"use metric"}]`,
+		},
+		{
+			"repeated system item",
+			`{"input":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"},{"role":"system","content":"be brief"}]}`,
+			`[{"role":"developer","content":"be brief"},{"role":"user","content":"hi"}]`,
+		},
+		{
+			"same as a developer message",
+			`{"input":[{"role":"developer","content":"be brief"},{"role":"system","content":"be brief"},{"role":"user","content":"hi"}]}`,
+			`[{"role":"developer","content":"be brief"},{"role":"user","content":"hi"}]`,
+		},
+		{
+			"same as the migrated instructions",
+			`{"instructions":"be brief","input":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"}]}`,
+			`[{"role":"developer","content":"be brief"},{"role":"user","content":"hi"}]`,
+		},
+		{
+			"content parts same as a string",
+			`{"instructions":"be brief","input":[{"role":"system","content":[{"type":"input_text","text":"be brief"}]},{"role":"user","content":"hi"}]}`,
+			`[{"role":"developer","content":"be brief"},{"role":"user","content":"hi"}]`,
+		},
+		{
+			"content parts differing",
+			`{"input":[{"role":"system","content":[{"type":"input_text","text":"be"},{"type":"input_text","text":"brief"}]},{"role":"system","content":"be brief"},{"role":"system","content":[{"type":"input_text","text":"be brief"}]}]}`,
+			`[{"role":"developer","content":[{"type":"input_text","text":"be"},{"type":"input_text","text":"brief"}]},{"role":"developer","content":"be brief"}]`,
+		},
+		{
+			"nested in a function output",
+			`{"input":[{"type":"function_call_output","call_id":"a","output":[{"role":"system","content":"x"}]},{"type":"function_call","call_id":"b","role":"system","name":"f","arguments":"{}"}]}`,
+			`[{"type":"function_call_output","call_id":"a","output":[{"role":"system","content":"x"}]},{"type":"function_call","call_id":"b","role":"system","name":"f","arguments":"{}"}]`,
+		},
+		{
+			"no system item",
+			`{"input":[{"role":"user","content":"the system role"}]}`,
+			`[{"role":"user","content":"the system role"}]`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, out := rewrite(t, rr, "/v1/responses", nil, []byte(tc.body))
+			var want any
+			if err := json.Unmarshal([]byte(tc.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if got := decodeBody(t, out)["input"]; !reflect.DeepEqual(got, want) {
+				t.Errorf("input = %s\nwant %s", out, tc.want)
+			}
+		})
+	}
+	st := rr.systemRoleStats().(map[string]any)
+	if st["converted"] != int64(6) || st["duplicates"] != int64(5) {
+		t.Errorf("system_role stats = %v", st)
+	}
+}
+
+func TestSystemRoleDisabled(t *testing.T) {
+	body := `{"input":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"}]}`
+	_, out := rewrite(t, NewRewriter(DefaultOptions()), "/v1/responses", nil, []byte(body))
+	in, _ := decodeBody(t, out)["input"].([]any)
+	if len(in) != 2 || in[0].(map[string]any)["role"] != "system" {
+		t.Errorf("forwarded %s, want the system item left as it is", out)
+	}
+}
@@ -0,0 +1,48 @@
+package reserve
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The target may carry a base path the upstream mounts its API under,
+// https://gateway.internal/openai. The Director joins it with the path
+// the client sent: exactly one slash between the two whatever the
+// target's trailing slashes, escaped segments (a %2F inside a file id)
+// kept escaped, and the raw query of both forwarded as sent. Routes,
+// background polls and everything else keyed on a path see the
+// client's, from before the join.
+
+// direct points the outgoing request r at the target, or the upstream the
+// balancer picked; run first in the Director, in place of httputil's.
+func (p *Proxy) direct(r *http.Request) {
+	tu := p.targetOf(stateOf(r.Context()))
+	r.URL.Scheme, r.URL.Host = tu.Scheme, tu.Host
+	r.URL.Path, r.URL.RawPath = joinTargetPath(tu, r.URL)
+	switch {
+	case tu.RawQuery == "":
+	case r.URL.RawQuery == "":
+		r.URL.RawQuery = tu.RawQuery
+	default:
+		r.URL.RawQuery = tu.RawQuery + "&" + r.URL.RawQuery
+	}
+	if _, ok := r.Header["User-Agent"]; !ok {
+		r.Header.Set("User-Agent", "") // no Go default, as httputil's Director
+	}
+	r.Host = tu.Host
+}
+
+// joinTargetPath returns the path (and raw path, "" when the plain one
+// encodes to it) of the client URL u under the base path of target.
+func joinTargetPath(target, u *url.URL) (path, rawPath string) {
+	path, escaped := u.Path, u.EscapedPath()
+	if !strings.HasPrefix(path, "/") {
+		path, escaped = "/"+path, "/"+escaped
+	}
+	base := strings.TrimRight(target.Path, "/")
+	if target.RawPath == "" && u.RawPath == "" {
+		return base + path, ""
+	}
+	return base + path, strings.TrimRight(target.EscapedPath(), "/") + escaped
+}
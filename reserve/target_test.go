@@ -0,0 +1,107 @@
+package reserve
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestJoinTargetPath(t *testing.T) {
+	for _, tc := range []struct {
+		target, client string
+		path, raw      string
+	}{
+		{"https://gw", "/v1/responses", "/v1/responses", ""},
+		{"https://gw/", "/v1/responses", "/v1/responses", ""},
+		{"https://gw/openai", "/v1/responses", "/openai/v1/responses", ""},
+		{"https://gw/openai/", "/v1/responses", "/openai/v1/responses", ""},
+		{"https://gw/openai//", "/v1/responses", "/openai/v1/responses", ""},
+		{"https://gw/openai", "/v1/responses/", "/openai/v1/responses/", ""},
+		{"https://gw/openai", "/", "/openai/", ""},
+		{"https://gw/a/b", "/v1/models", "/a/b/v1/models", ""},
+		{"https://gw/openai", "/v1/files/file%2Fabc", "/openai/v1/files/file/abc", "/openai/v1/files/file%2Fabc"},
+		{"https://gw/open%2Fai", "/v1/responses", "/open/ai/v1/responses", "/open%2Fai/v1/responses"},
+		{"https://gw/open%2Fai/", "/v1/files/a%2Fb", "/open/ai/v1/files/a/b", "/open%2Fai/v1/files/a%2Fb"},
+		{"https://gw/open%20ai", "/v1/responses", "/open ai/v1/responses", ""},
+	} {
+		target, err := url.Parse(tc.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(tc.client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path, raw := joinTargetPath(target, u)
+		if path != tc.path || raw != tc.raw {
+			t.Errorf("joinTargetPath(%s, %s) = %q, %q, want %q, %q", tc.target, tc.client, path, raw, tc.path, tc.raw)
+		}
+	}
+}
+
+func TestProxyTargetBasePath(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		uris []string
+	)
+	u := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		uris = append(uris, r.RequestURI)
+		mu.Unlock()
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, `{"id":"resp_1"}`)
+	})
+	for _, tc := range []struct {
+		method, base, client, want string
+	}{
+		{"POST", "/openai", "/v1/responses", "/openai/v1/responses"},
+		{"POST", "/openai/", "/v1/responses", "/openai/v1/responses"},
+		{"POST", "/openai", "/codex/v1/responses", "/openai/codex/v1/responses"},
+		{"GET", "/openai", "/v1/files/file%2Fabc", "/openai/v1/files/file%2Fabc"},
+		{"POST", "/openai?api-version=2", "/v1/responses", "/openai/v1/responses?api-version=2"},
+		{"POST", "/openai?api-version=2", "/v1/responses?x=a%26b", "/openai/v1/responses?api-version=2&x=a%26b"},
+	} {
+		t.Run(tc.base+tc.client, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Target = u.URL + tc.base
+			p, err := NewProxy(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			uris = nil
+			mu.Unlock()
+			body := `{"input":"hi"}`
+			if tc.method == "GET" {
+				body = ""
+			}
+			send(p, tc.method, tc.client, nil, body)
+			mu.Lock()
+			defer mu.Unlock()
+			if len(uris) != 1 || uris[0] != tc.want {
+				t.Errorf("upstream got %q, want %s", uris, tc.want)
+			}
+		})
+	}
+
+	// routes match the client's path: the body is rewritten under the
+	// base path, and a client path that only looks right once joined is
+	// not
+	opts := DefaultOptions()
+	opts.Target = u.URL + "/v1"
+	p, err := NewProxy(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(p, "POST", "/v1/responses", bearer("sk-a"), `{"input":"hi"}`)
+	send(p, "POST", "/responses", bearer("sk-a"), `{"input":"hi"}`)
+	got := u.requests()
+	if m := decodeBody(t, got[len(got)-2].body); m["prompt_cache_key"] != cacheKey("Bearer sk-a") {
+		t.Errorf("/v1/responses under /v1 forwarded %s, want it rewritten", got[len(got)-2].body)
+	}
+	if last := got[len(got)-1]; last.path != "/v1/responses" || string(last.body) != `{"input":"hi"}` {
+		t.Errorf("/responses went to %s with %s, want /v1/responses untouched", last.path, last.body)
+	}
+}
@@ -0,0 +1,139 @@
+package reserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/ast"
+)
+
+// Clients that expect JSON but forget to ask for it get prose back now and
+// then. The text_format hook gives a request without text.format the one
+// Options.Policy names for its client, else its route, else every
+// request: json_object, or a named json_schema read from a file when the
+// policy is loaded. Other keys under text (verbosity, say) are kept. A
+// request that sets a format of its own, any type, keeps it, and requests
+// for the models listed as lacking structured output are left alone.
+
+const textFormatSchema = "json_schema:"
+
+func (p *RequestPolicy) textFormat(route, client string) string {
+	if f, ok := p.ClientTextFormats[client]; ok {
+		return f
+	}
+	if f, ok := p.RouteTextFormats[route]; ok {
+		return f
+	}
+	return p.TextFormat
+}
+
+// checkTextFormat validates a policy text format ("" = none set).
+func (p *RequestPolicy) checkTextFormat(f string) error {
+	if f == "" || f == "json_object" {
+		return nil
+	}
+	name, ok := strings.CutPrefix(f, textFormatSchema)
+	if !ok || name == "" {
+		return fmt.Errorf("%q: want json_object or json_schema:<name>", f)
+	}
+	if _, ok := p.schemas[name]; !ok {
+		return fmt.Errorf("%q: no json_schemas entry %q", f, name)
+	}
+	return nil
+}
+
+// loadSchemas reads the JSONSchemas files not read yet, relative to dir.
+func (p *RequestPolicy) loadSchemas(dir string) error {
+	for name, path := range p.JSONSchemas {
+		if _, ok := p.schemas[name]; ok {
+			continue
+		}
+		if !filepath.IsAbs(path) && dir != "" {
+			path = filepath.Join(dir, path)
+		}
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("json_schemas[%q]: %w", name, err)
+		}
+		bs = bytes.TrimSpace(bs)
+		if len(bs) == 0 || bs[0] != '{' || !json.Valid(bs) {
+			return fmt.Errorf("json_schemas[%q] %s: not a JSON object", name, path)
+		}
+		if p.schemas == nil {
+			p.schemas = map[string][]byte{}
+		}
+		p.schemas[name] = bs
+	}
+	return nil
+}
+
+// formatNode is the text.format object of the policy format f.
+func (p *RequestPolicy) formatNode(f string) ast.Node {
+	name, ok := strings.CutPrefix(f, textFormatSchema)
+	if !ok {
+		return ast.NewObject([]ast.Pair{{Key: "type", Value: ast.NewString(f)}})
+	}
+	return ast.NewObject([]ast.Pair{
+		{Key: "type", Value: ast.NewString("json_schema")},
+		{Key: "name", Value: ast.NewString(name)},
+		{Key: "schema", Value: ast.NewRaw(string(p.schemas[name]))},
+	})
+}
+
+func textFormatHook(r *Request) error {
+	rr := r.rw.rr
+	p := rr.opts.Policy
+	if p == nil {
+		return nil
+	}
+	want := p.textFormat(r.Route, rr.derivePromptCacheKey(r.HTTP, ""))
+	if want == "" {
+		return nil
+	}
+	var model, text *ast.Node
+	if r.parsed {
+		model, text = r.root.Get("model"), r.root.Get("text")
+	} else {
+		bs := r.Body()
+		m, _ := sonic.Get(bs, "model")
+		t, _ := sonic.Get(bs, "text")
+		model, text = &m, &t
+	}
+	if m := nodeString(model); slices.Contains(p.NoStructuredOutputModels, m) {
+		rr.policy.unstructured.Add(1)
+		traceOf(r.HTTP.Context()).log("text_format", "model", m, "unstructured", true)
+		return nil
+	}
+	switch nodeType(text) {
+	case ast.V_NONE, ast.V_NULL:
+	case ast.V_OBJECT:
+		if t := nodeType(text.Get("format")); t != ast.V_NONE && t != ast.V_NULL {
+			return nil // the client's own
+		}
+	default:
+		return nil // not ours to fix
+	}
+	root, err := r.JSON()
+	if root == nil {
+		return err
+	}
+	format := p.formatNode(want)
+	if t := root.Get("text"); nodeType(t) == ast.V_OBJECT {
+		_, err = t.Set("format", format)
+	} else {
+		_, err = root.Set("text", ast.NewObject([]ast.Pair{{Key: "format", Value: format}}))
+	}
+	if err != nil {
+		return err
+	}
+	rr.policy.textFormats.Add(1)
+	r.Logger().Debug("policy: text.format set", "route", r.Route, "format", want)
+	traceOf(r.HTTP.Context()).log("text_format", "format", want)
+	return nil
+}
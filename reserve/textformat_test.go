@@ -0,0 +1,138 @@
+package reserve
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSchema = `{"type":"object","properties":{"answer":{"type":"string"}},"required":["answer"]}`
+
+// writePolicy writes the policy file p, with schema.json and two broken
+// schemas next to it, and loads it.
+func writePolicy(t *testing.T, p string) (*RequestPolicy, error) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, bs := range map[string]string{
+		"schema.json": testSchema,
+		"broken.json": `{"type":"object",}`,
+		"array.json":  `[{"type":"object"}]`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(bs), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "policy.json")
+	if err := os.WriteFile(path, []byte(p), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadRequestPolicy(path)
+}
+
+func TestTextFormatMerge(t *testing.T) {
+	p := &RequestPolicy{TextFormat: "json_object", NoStructuredOutputModels: []string{"gpt-4-legacy"}}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.Policy = p
+	rr := NewRewriter(opts)
+	for _, tc := range []struct {
+		name, body, want string // want is the forwarded text, "" for none
+	}{
+		{"no text", `{"model":"gpt-5","input":"hi"}`, `{"format":{"type":"json_object"}}`},
+		{"text null", `{"model":"gpt-5","input":"hi","text":null}`, `{"format":{"type":"json_object"}}`},
+		{"other text keys", `{"model":"gpt-5","input":"hi","text":{"verbosity":"low"}}`, `{"verbosity":"low","format":{"type":"json_object"}}`},
+		{"format null", `{"model":"gpt-5","input":"hi","text":{"format":null,"verbosity":"high"}}`, `{"format":{"type":"json_object"},"verbosity":"high"}`},
+		{"the client's format", `{"model":"gpt-5","input":"hi","text":{"format":{"type":"text"}}}`, `{"format":{"type":"text"}}`},
+		{
+			"the client's schema",
+			`{"model":"gpt-5","input":"hi","text":{"format":{"type":"json_schema","name":"x","schema":{}},"verbosity":"low"}}`,
+			`{"format":{"type":"json_schema","name":"x","schema":{}},"verbosity":"low"}`,
+		},
+		{"text not an object", `{"model":"gpt-5","input":"hi","text":"json"}`, `"json"`},
+		{"model without structured output", `{"model":"gpt-4-legacy","input":"hi"}`, ``},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, out := rewrite(t, rr, "/v1/responses", nil, []byte(tc.body))
+			got, ok := decodeBody(t, out)["text"]
+			if tc.want == "" {
+				if ok {
+					t.Errorf("text = %v, want none", got)
+				}
+				return
+			}
+			var want any
+			if err := json.Unmarshal([]byte(tc.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("forwarded %s, want text %s", out, tc.want)
+			}
+		})
+	}
+	st := rr.policyStats().(map[string]any)
+	if st["text_formats"] != int64(4) || st["unstructured"] != int64(1) {
+		t.Errorf("policy stats = %v, want 4 text_formats and 1 unstructured", st)
+	}
+}
+
+func TestTextFormatPrecedence(t *testing.T) {
+	client := cacheKey("Bearer sk-a")
+	p, err := writePolicy(t, `{
+		"text_format": "json_object",
+		"route_text_formats": {"responses": "json_schema:answer"},
+		"client_text_formats": {"`+client+`": "json_object"},
+		"json_schemas": {"answer": "schema.json"}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.Policy = p
+	rr := NewRewriter(opts)
+	format := func(hdr map[string][]string) map[string]any {
+		_, out := rewrite(t, rr, "/v1/responses", hdr, []byte(`{"model":"gpt-5","input":"hi"}`))
+		text, _ := decodeBody(t, out)["text"].(map[string]any)
+		f, _ := text["format"].(map[string]any)
+		return f
+	}
+
+	// the route's named schema, read from the file next to the policy
+	f := format(bearer("sk-b"))
+	var schema any
+	_ = json.Unmarshal([]byte(testSchema), &schema)
+	if f["type"] != "json_schema" || f["name"] != "answer" || !reflect.DeepEqual(f["schema"], schema) {
+		t.Errorf("route format = %v, want the answer schema", f)
+	}
+	// the client's over the route's
+	if f := format(bearer("sk-a")); !reflect.DeepEqual(f, map[string]any{"type": "json_object"}) {
+		t.Errorf("client format = %v, want json_object", f)
+	}
+}
+
+func TestTextFormatPolicyErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, policy, want string
+	}{
+		{"unknown format", `{"text_format":"yaml"}`, "want json_object or json_schema"},
+		{"unknown schema", `{"text_format":"json_schema:missing"}`, `no json_schemas entry "missing"`},
+		{"missing file", `{"text_format":"json_schema:a","json_schemas":{"a":"nope.json"}}`, "nope.json"},
+		{"schema not JSON", `{"text_format":"json_schema:a","json_schemas":{"a":"broken.json"}}`, "not a JSON object"},
+		{"schema not an object", `{"text_format":"json_schema:a","json_schemas":{"a":"array.json"}}`, "not a JSON object"},
+		{"route format", `{"route_text_formats":{"responses":"json_schema:"}}`, "route_text_formats"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := writePolicy(t, tc.policy)
+			if err == nil {
+				t.Fatal("policy loaded")
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("error = %v, want it to mention %q", err, tc.want)
+			}
+		})
+	}
+}
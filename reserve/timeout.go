@@ -0,0 +1,423 @@
+package reserve
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each phase of an upstream request has a timeout, and an error class, of
+// its own: the dial (upstream_dial_timeout, a 502), the TLS handshake
+// (upstream_tls_timeout, a 502), the wait for the response headers once
+// the request is written (upstream_header_timeout, a 504) and, on an event
+// stream, the silence between events (stream_idle, a terminal error
+// event). The Options' values go to the built-in transport as ever. A
+// route of Options.RouteTimeouts may have its own: the transport then
+// gets the longest of them all, and a request held to less is cut by a
+// timer on its httptrace hooks.
+
+var (
+	errRequestTimeout = errors.New("request timeout")
+	errStreamIdle     = errors.New("upstream stream idle timeout")
+	errDialTimeout    = errors.New("upstream dial timeout")
+	errTLSTimeout     = errors.New("upstream TLS handshake timeout")
+	errHeaderTimeout  = errors.New("upstream response header timeout")
+
+	errGatewayTimeout = &httpError{
+		status: http.StatusGatewayTimeout,
+		code:   "upstream_timeout",
+		msg:    "upstream did not complete the request in time",
+	}
+	errUpstreamDialTimeout = &httpError{
+		status: http.StatusBadGateway,
+		code:   "upstream_connect_timeout",
+		msg:    "could not connect to the upstream in time",
+	}
+	errUpstreamTLSTimeout = &httpError{
+		status: http.StatusBadGateway,
+		code:   "upstream_tls_timeout",
+		msg:    "the TLS handshake with the upstream did not complete in time",
+	}
+	errUpstreamHeaderTimeout = &httpError{
+		status: http.StatusGatewayTimeout,
+		code:   "upstream_timeout",
+		msg:    "upstream did not send response headers in time",
+	}
+
+	// terminal event appended to a stream cut by the idle timeout, in the
+	// Responses API error event shape
+	sseIdleTimeoutEvent = []byte("event: error\ndata: " +
+		`{"type":"error","code":"stream_idle_timeout","message":"upstream stream idle timeout","param":null}` +
+		"\n\n")
+)
+
+func isEventStream(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
+
+// applyStreamTimeout switches a streaming response from the hard request
+// cap to an idle timeout: the stream may run as long as upstream keeps
+// sending bytes, but is cut after StreamIdleTimeout of silence.
+func (p *Proxy) applyStreamTimeout(resp *http.Response) {
+	st := stateOf(resp.Request.Context())
+	if st == nil || !isEventStream(resp) {
+		return
+	}
+	if st.hardCap != nil {
+		st.hardCap.Stop()
+	}
+	d := p.phases.of(st.route).StreamIdle
+	if d <= 0 {
+		return
+	}
+	b := &idleTimeoutBody{rc: resp.Body, ctx: resp.Request.Context(), d: d}
+	b.t = time.AfterFunc(d, func() {
+		p.timeouts.streamIdle.Add(1)
+		st.cancel(errStreamIdle)
+	})
+	resp.Body = b
+}
+
+// idleTimeoutBody resets the idle timer on every read. When the timer
+// cancels the upstream request, the resulting read error is replaced with a
+// terminal SSE error event and a clean EOF, so the client sees a definite
+// end of stream instead of a dropped connection.
+type idleTimeoutBody struct {
+	rc  io.ReadCloser
+	ctx context.Context
+	t   *time.Timer
+	d   time.Duration
+
+	tail []byte
+	eof  bool
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	if b.eof {
+		if len(b.tail) == 0 {
+			return 0, io.EOF
+		}
+		n := copy(p, b.tail)
+		b.tail = b.tail[n:]
+		return n, nil
+	}
+	n, err := b.rc.Read(p)
+	if n > 0 {
+		b.t.Reset(b.d)
+	}
+	if err != nil && err != io.EOF && context.Cause(b.ctx) == errStreamIdle {
+		b.eof = true
+		b.tail = sseIdleTimeoutEvent
+		return n, nil
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.t.Stop()
+	return b.rc.Close()
+}
+
+// PhaseTimeouts are a route's own timeouts of the phases of an upstream
+// request; zero keeps the Options' value, a negative one is no bound.
+type PhaseTimeouts struct {
+	Dial           time.Duration
+	TLSHandshake   time.Duration
+	ResponseHeader time.Duration
+	StreamIdle     time.Duration
+}
+
+// the built-in transport's bounds for a zero Options value
+const (
+	defaultDialTimeout           = 30 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 60 * time.Second
+)
+
+// phaseTimeouts are the resolved PhaseTimeouts, 0 being no bound.
+type phaseTimeouts struct {
+	global PhaseTimeouts
+	routes map[string]PhaseTimeouts
+	// transport are the bounds the transport enforces itself, the longest
+	// of all; none are known of a custom one
+	transport PhaseTimeouts
+	custom    bool
+}
+
+func newPhaseTimeouts(opts Options) (*phaseTimeouts, error) {
+	t := &phaseTimeouts{routes: map[string]PhaseTimeouts{}, custom: opts.Transport != nil}
+	t.global.StreamIdle = max(opts.StreamIdleTimeout, 0)
+	if !t.custom {
+		t.global.Dial = resolveTimeout(opts.DialTimeout, defaultDialTimeout)
+		t.global.TLSHandshake = resolveTimeout(opts.TLSHandshakeTimeout, defaultTLSHandshakeTimeout)
+		t.global.ResponseHeader = resolveTimeout(opts.ResponseHeaderTimeout, defaultResponseHeaderTimeout)
+		t.transport = t.global
+	}
+	for name, o := range opts.RouteTimeouts {
+		if !slices.ContainsFunc(routes, func(rt route) bool { return rt.name == name }) {
+			return nil, fmt.Errorf("reserve: RouteTimeouts: no route %q", name)
+		}
+		e := PhaseTimeouts{
+			Dial:           resolveTimeout(o.Dial, t.global.Dial),
+			TLSHandshake:   resolveTimeout(o.TLSHandshake, t.global.TLSHandshake),
+			ResponseHeader: resolveTimeout(o.ResponseHeader, t.global.ResponseHeader),
+			StreamIdle:     resolveTimeout(o.StreamIdle, t.global.StreamIdle),
+		}
+		t.routes[name] = e
+		if !t.custom {
+			t.transport.Dial = longestTimeout(t.transport.Dial, e.Dial)
+			t.transport.TLSHandshake = longestTimeout(t.transport.TLSHandshake, e.TLSHandshake)
+			t.transport.ResponseHeader = longestTimeout(t.transport.ResponseHeader, e.ResponseHeader)
+		}
+	}
+	return t, nil
+}
+
+// resolveTimeout is d, def for zero and 0 (none) for negative.
+func resolveTimeout(d, def time.Duration) time.Duration {
+	switch {
+	case d < 0:
+		return 0
+	case d == 0:
+		return def
+	}
+	return d
+}
+
+// longestTimeout is the longer bound of a and b, 0 being none.
+func longestTimeout(a, b time.Duration) time.Duration {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return max(a, b)
+}
+
+// of is the timeouts of the requests of rt.
+func (t *phaseTimeouts) of(rt *route) PhaseTimeouts {
+	if rt != nil {
+		if e, ok := t.routes[rt.name]; ok {
+			return e
+		}
+	}
+	return t.global
+}
+
+// timers are the dial, TLS and header bounds the requests of rt are held to
+// beyond the transport's, 0 for none.
+func (t *phaseTimeouts) timers(rt *route) [3]time.Duration {
+	var b [3]time.Duration
+	if len(t.routes) == 0 {
+		return b
+	}
+	e := t.of(rt)
+	for i, d := range [3][2]time.Duration{
+		{e.Dial, t.transport.Dial},
+		{e.TLSHandshake, t.transport.TLSHandshake},
+		{e.ResponseHeader, t.transport.ResponseHeader},
+	} {
+		if d[0] > 0 && (d[1] == 0 || d[0] < d[1]) {
+			b[i] = d[0]
+		}
+	}
+	return b
+}
+
+// phases of phaseWatch
+const (
+	phaseDial = iota
+	phaseTLS
+	phaseHeader
+)
+
+var phaseCauses = [3]error{errDialTimeout, errTLSTimeout, errHeaderTimeout}
+
+// phaseTransport holds the requests of routes with phase timeouts shorter
+// than the transport's to them.
+type phaseTransport struct {
+	next   http.RoundTripper
+	phases *phaseTimeouts
+}
+
+func (t *phaseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	st := stateOf(req.Context())
+	if st == nil {
+		return t.next.RoundTrip(req)
+	}
+	b := t.phases.timers(st.route)
+	if b == ([3]time.Duration{}) {
+		return t.next.RoundTrip(req)
+	}
+	w := &phaseWatch{cancel: st.cancel, bounds: b}
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		DNSStart:     func(httptrace.DNSStartInfo) { w.start(phaseDial) },
+		ConnectStart: func(string, string) { w.start(phaseDial) },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				w.stop(phaseDial)
+			}
+		},
+		TLSHandshakeStart: func() { w.start(phaseTLS) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { w.stop(phaseTLS) },
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			// afresh for each attempt of an h2 retry
+			w.stop(phaseHeader)
+			w.start(phaseHeader)
+		},
+	})))
+	w.finish()
+	return resp, err
+}
+
+// phaseWatch times the phases of one request, canceling it with the
+// phase's cause when one runs over.
+type phaseWatch struct {
+	cancel context.CancelCauseFunc
+	bounds [3]time.Duration
+
+	mu     sync.Mutex
+	timers [3]*time.Timer
+	done   bool
+}
+
+// start times phase, unless it is timed already: a dial tries addresses
+// in turn, and they share the bound.
+func (w *phaseWatch) start(phase int) {
+	d := w.bounds[phase]
+	if d == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done || w.timers[phase] != nil {
+		return
+	}
+	w.timers[phase] = time.AfterFunc(d, func() {
+		w.mu.Lock()
+		done := w.done
+		w.mu.Unlock()
+		if !done {
+			w.cancel(phaseCauses[phase])
+		}
+	})
+}
+
+func (w *phaseWatch) stop(phase int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t := w.timers[phase]; t != nil {
+		t.Stop()
+		w.timers[phase] = nil
+	}
+}
+
+// finish stops the timers once the round trip is over; a dial the
+// transport carries on with is its own.
+func (w *phaseWatch) finish() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.done = true
+	for _, t := range w.timers {
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
+
+// phaseTimeout is the phase of the upstream request of ctx that failed
+// with err by running out of time, "" for none: a timer's cause, or the
+// transport's own timeout error.
+func phaseTimeout(ctx context.Context, err error) string {
+	switch context.Cause(ctx) {
+	case errDialTimeout:
+		return "dial"
+	case errTLSTimeout:
+		return "tls_handshake"
+	case errHeaderTimeout:
+		return "response_header"
+	}
+	var oe *net.OpError
+	switch msg := err.Error(); {
+	case errors.As(err, &oe) && oe.Op == "dial" && oe.Timeout():
+		return "dial"
+	case strings.Contains(msg, "TLS handshake timeout"):
+		return "tls_handshake"
+	case strings.Contains(msg, "timeout awaiting response headers"):
+		return "response_header"
+	}
+	return ""
+}
+
+// failPhaseTimeout answers a request whose upstream request ran out of
+// time in phase.
+func (p *Proxy) failPhaseTimeout(w http.ResponseWriter, r *http.Request, phase string, err error) {
+	st := stateOf(r.Context())
+	e := p.phases.of(nil)
+	if st != nil {
+		e = p.phases.of(st.route)
+	}
+	var (
+		d          time.Duration
+		class, msg string
+		he         *httpError
+	)
+	switch phase {
+	case "dial":
+		p.timeouts.dial.Add(1)
+		d, class, msg, he = e.Dial, "upstream_dial_timeout", "upstream dial timeout", errUpstreamDialTimeout
+	case "tls_handshake":
+		p.timeouts.tls.Add(1)
+		d, class, msg, he = e.TLSHandshake, "upstream_tls_timeout", "upstream TLS handshake timeout", errUpstreamTLSTimeout
+	default:
+		p.timeouts.responseHeader.Add(1)
+		d, class, msg, he = e.ResponseHeader, "upstream_header_timeout", "upstream response header timeout", errUpstreamHeaderTimeout
+	}
+	logOf(r.Context()).Warn(msg, "timeout", d, "error", err)
+	if st != nil {
+		st.wide.fail(class, err.Error())
+		st.trace.log(class, "timeout", d, "error", err)
+	}
+	p.upstreamResult(st, true)
+	writeHTTPError(w, he)
+}
+
+func (p *Proxy) timeoutStats() any {
+	g := p.phases.global
+	out := map[string]any{
+		"request_timeout":     p.opts.RequestTimeout.String(),
+		"stream_idle_timeout": g.StreamIdle.String(),
+		"request":             p.timeouts.request.Load(),
+		"stream_idle":         p.timeouts.streamIdle.Load(),
+		"dial":                p.timeouts.dial.Load(),
+		"tls_handshake":       p.timeouts.tls.Load(),
+		"response_header":     p.timeouts.responseHeader.Load(),
+	}
+	if p.phases.custom {
+		out["custom_transport"] = true
+	} else {
+		out["dial_timeout"] = g.Dial.String()
+		out["tls_handshake_timeout"] = g.TLSHandshake.String()
+		out["response_header_timeout"] = g.ResponseHeader.String()
+	}
+	if len(p.phases.routes) > 0 {
+		rs := make(map[string]any, len(p.phases.routes))
+		for name, e := range p.phases.routes {
+			rs[name] = map[string]string{
+				"dial":            e.Dial.String(),
+				"tls_handshake":   e.TLSHandshake.String(),
+				"response_header": e.ResponseHeader.String(),
+				"stream_idle":     e.StreamIdle.String(),
+			}
+		}
+		out["routes"] = rs
+	}
+	return out
+}
@@ -0,0 +1,207 @@
+package reserve
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An upstream certificate the proxy can't verify (a CA missing from the
+// bundle after a rotation, an expired certificate, a name mismatch) fails
+// every request the same way, and deserves better than a generic 502 and
+// "proxy error". The ErrorHandler tells TLS failures apart: they are
+// answered with a 502 of code upstream_tls_error, counted by class, and
+// logged with the certificate's subject, issuer, validity and the
+// verification error, once per certificate and class rather than once
+// per request. The chain of the latest handshake, verified or rejected,
+// is kept for the admin API's GET /_reserve/upstream/tls.
+
+const upstreamTLSPath = reservePrefix + "upstream/tls"
+
+// most distinct certificate failures remembered for the log's dedup
+const maxTLSFailuresLogged = 256
+
+var errUpstreamTLS = &httpError{
+	status: http.StatusBadGateway,
+	code:   "upstream_tls_error",
+	msg:    "the upstream's TLS certificate could not be verified",
+}
+
+var tlsErrorClasses = []string{"unknown_authority", "expired", "invalid", "hostname_mismatch", "verification", "handshake"}
+
+type upstreamTLS struct {
+	errors map[string]*atomic.Int64 // by class, fixed at construction
+
+	mu       sync.Mutex
+	logged   map[string]bool // certificate fingerprint and class
+	verified *tlsChainView   // latest successful handshake
+	rejected *tlsChainView   // latest failed one
+}
+
+// tlsChainView is a handshake's certificate chain, leaf first.
+type tlsChainView struct {
+	At    time.Time  `json:"at"`
+	Class string     `json:"class,omitempty"`
+	Error string     `json:"error,omitempty"`
+	Certs []certView `json:"certs"`
+}
+
+type certView struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	SHA256    string    `json:"sha256"`
+}
+
+func newUpstreamTLS() *upstreamTLS {
+	t := &upstreamTLS{errors: map[string]*atomic.Int64{}, logged: map[string]bool{}}
+	for _, c := range tlsErrorClasses {
+		t.errors[c] = new(atomic.Int64)
+	}
+	return t
+}
+
+func newCertViews(certs []*x509.Certificate) []certView {
+	out := make([]certView, 0, len(certs))
+	for _, c := range certs {
+		sum := sha256.Sum256(c.Raw)
+		out = append(out, certView{
+			Subject:   c.Subject.String(),
+			Issuer:    c.Issuer.String(),
+			DNSNames:  c.DNSNames,
+			Serial:    c.SerialNumber.String(),
+			NotBefore: c.NotBefore,
+			NotAfter:  c.NotAfter,
+			SHA256:    hex.EncodeToString(sum[:]),
+		})
+	}
+	return out
+}
+
+// tlsErrorClass is the class of a TLS failure and the certificates the
+// upstream presented, if any; "" for an error of another kind.
+func tlsErrorClass(err error) (class string, certs []*x509.Certificate) {
+	var cve *tls.CertificateVerificationError
+	if errors.As(err, &cve) {
+		certs = cve.UnverifiedCertificates
+	}
+	var (
+		ua x509.UnknownAuthorityError
+		hn x509.HostnameError
+		ci x509.CertificateInvalidError
+		ae tls.AlertError
+		rh tls.RecordHeaderError
+	)
+	switch {
+	case errors.As(err, &ua):
+		return "unknown_authority", certs
+	case errors.As(err, &hn):
+		return "hostname_mismatch", certs
+	case errors.As(err, &ci) && ci.Reason == x509.Expired:
+		return "expired", certs
+	case errors.As(err, &ci):
+		return "invalid", certs
+	case cve != nil:
+		return "verification", certs
+	case errors.As(err, &ae), errors.As(err, &rh), strings.Contains(err.Error(), "tls: "):
+		return "handshake", certs
+	}
+	return "", nil
+}
+
+// handshake notes the chain of a successful upstream handshake; run from
+// the connection trace.
+func (t *upstreamTLS) handshake(cs tls.ConnectionState, err error) {
+	if err != nil || len(cs.PeerCertificates) == 0 {
+		return // a failure is noted by failed, with its class
+	}
+	v := &tlsChainView{At: time.Now(), Certs: newCertViews(cs.PeerCertificates)}
+	t.mu.Lock()
+	t.verified = v
+	t.mu.Unlock()
+}
+
+// failed handles err when it is a TLS failure, and reports whether it
+// was; see above.
+func (t *upstreamTLS) failed(ctx context.Context, err error) bool {
+	class, certs := tlsErrorClass(err)
+	if class == "" {
+		return false
+	}
+	t.errors[class].Add(1)
+	v := &tlsChainView{At: time.Now(), Class: class, Error: err.Error(), Certs: newCertViews(certs)}
+	key := class + "\x00" + err.Error()
+	if len(v.Certs) > 0 {
+		key = class + "\x00" + v.Certs[0].SHA256
+	}
+	t.mu.Lock()
+	t.rejected = v
+	first := !t.logged[key]
+	if first {
+		if len(t.logged) >= maxTLSFailuresLogged {
+			clear(t.logged)
+		}
+		t.logged[key] = true
+	}
+	t.mu.Unlock()
+	log := logOf(ctx)
+	if !first {
+		log.Debug("upstream TLS failure", "class", class, "error", err)
+		return true
+	}
+	attrs := []any{"class", class, "error", err}
+	if len(v.Certs) > 0 {
+		leaf := v.Certs[0]
+		attrs = append(attrs, "subject", leaf.Subject, "issuer", leaf.Issuer,
+			"not_before", leaf.NotBefore, "not_after", leaf.NotAfter, "sha256", leaf.SHA256)
+	}
+	log.Error("upstream TLS certificate rejected, logged once per certificate", attrs...)
+	return true
+}
+
+func (p *Proxy) upstreamTLSStats() any {
+	t := p.upstreamTLS
+	errs := make(map[string]int64, len(t.errors))
+	for class, n := range t.errors {
+		errs[class] = n.Load()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := map[string]any{"errors": errs, "distinct_failures": len(t.logged)}
+	if t.verified != nil && len(t.verified.Certs) > 0 {
+		out["leaf_not_after"] = t.verified.Certs[0].NotAfter
+	}
+	if t.rejected != nil {
+		out["last_failure"] = t.rejected.At
+	}
+	return out
+}
+
+// serveUpstreamTLS shows the upstream's certificate chains: that of the
+// latest verified handshake and that of the latest rejected one.
+func (p *Proxy) serveUpstreamTLS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, errMethod)
+		return
+	}
+	t := p.upstreamTLS
+	t.mu.Lock()
+	verified, rejected := t.verified, t.rejected
+	t.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"target":   p.target.Host,
+		"verified": verified,
+		"rejected": rejected,
+	})
+}
@@ -0,0 +1,386 @@
+package reserve
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bytedance/sonic/ast"
+)
+
+// The input window, quotas and cost estimates want the token count of a
+// request before the upstream reports it. Options.TokenEstimate counts
+// the tokens of a JSON value; the built-in EstimateTokens is a cheap
+// heuristic, and a BPE loaded from a tiktoken vocabulary with
+// Options.TokenizerVocab (or LoadBPE) counts the way the model does, at
+// the price of the vocabulary in memory (tens of MB for o200k_base).
+//
+// With Options.EstimateInputTokens each rewritten request's input tokens
+// are estimated, on the body as forwarded, for the wide log and the
+// request trace; with TokenEstimateHeader they go back to the client in
+// X-Reserve-Estimated-Input-Tokens. Once the upstream reports the usage
+// the estimate is compared with its input_tokens, and the "token_estimate"
+// stats show how far off the estimator is.
+
+const estimatedTokensHeader = "X-Reserve-Estimated-Input-Tokens"
+
+// imageTokens is what the default estimate charges for an inline image
+// (a data: URL) instead of a quarter of its base64 length.
+const imageTokens = 1024
+
+// longest piece merged by a BPE; longer ones (base64, hex) are rare in
+// text and quadratic to merge, so they get the heuristic instead
+const maxBPEPiece = 128
+
+var kDataURL = []byte(`"data:`)
+
+// EstimateTokens is the default Options.TokenEstimate: a quarter of a
+// token per ASCII byte, adjusted by script for the rest (about one token
+// per CJK character, three quarters per Cyrillic or Greek one), inline
+// images charged a flat amount.
+func EstimateTokens(b []byte) int {
+	q, images := 0, 0 // quarter tokens
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case c == '"' && bytes.HasPrefix(b[i:], kDataURL):
+			end := bytes.IndexByte(b[i+1:], '"')
+			if end < 0 {
+				return (q+len(b)-i)/4 + images*imageTokens
+			}
+			q++
+			images++
+			i += 1 + end
+		case c < utf8.RuneSelf:
+			q++
+			i++
+		case c >= 0xf0: // emoji and the rarer scripts
+			q += 6
+			i += 4
+		case c >= 0xe0: // CJK, kana, Hangul, Thai, Devanagari
+			q += 4
+			i += 3
+		case c >= 0xc0: // Latin accents, Cyrillic, Greek, Hebrew, Arabic
+			q += 3
+			i += 2
+		default: // a stray continuation byte
+			q++
+			i++
+		}
+	}
+	return q/4 + images*imageTokens
+}
+
+func (rr *Rewriter) estimateTokens(b []byte) int {
+	if rr.opts.TokenEstimate != nil {
+		return rr.opts.TokenEstimate(b)
+	}
+	return EstimateTokens(b)
+}
+
+// BPE counts tokens with a byte-pair encoding vocabulary in tiktoken's
+// format. Text is split into pieces much like tiktoken's
+// cl100k and o200k patterns do (words with their leading space, runs of
+// up to three digits, punctuation, whitespace), so counts come close to
+// the model's without being exact. It is safe for concurrent use.
+type BPE struct {
+	ranks map[string]int32
+}
+
+// LoadBPE reads a tiktoken vocabulary: one "<base64 token> <rank>" line
+// per token, such as o200k_base.tiktoken.
+func LoadBPE(path string) (*BPE, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := &BPE{ranks: map[string]int32{}}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		tok, rank, ok := bytes.Cut(line, []byte(" "))
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: want \"<base64 token> <rank>\"", path, n)
+		}
+		raw, err := base64.StdEncoding.DecodeString(string(tok))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		r, err := strconv.ParseInt(string(rank), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		t.ranks[string(raw)] = int32(r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(t.ranks) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", path)
+	}
+	return t, nil
+}
+
+// Len is the vocabulary's size.
+func (t *BPE) Len() int { return len(t.ranks) }
+
+// Count is the number of tokens of b, inline images charged like
+// EstimateTokens does. It can be an Options.TokenEstimate.
+func (t *BPE) Count(b []byte) int {
+	n := 0
+	for {
+		i := bytes.Index(b, kDataURL)
+		if i < 0 {
+			break
+		}
+		end := bytes.IndexByte(b[i+1:], '"')
+		if end < 0 {
+			break
+		}
+		n += t.countText(b[:i+1]) + imageTokens
+		b = b[i+1+end:]
+	}
+	return n + t.countText(b)
+}
+
+func (t *BPE) countText(b []byte) int {
+	n := 0
+	for len(b) > 0 {
+		k := nextPiece(b)
+		n += t.pieceTokens(b[:k])
+		b = b[k:]
+	}
+	return n
+}
+
+// pieceTokens merges piece p the way BPE does, lowest rank first, and
+// returns the number of tokens left.
+func (t *BPE) pieceTokens(p []byte) int {
+	if _, ok := t.ranks[string(p)]; ok {
+		return 1
+	}
+	if len(p) > maxBPEPiece {
+		return max(EstimateTokens(p), 1)
+	}
+	var buf [maxBPEPiece + 1]int
+	bounds := buf[:0]
+	for i := range len(p) + 1 {
+		bounds = append(bounds, i)
+	}
+	for len(bounds) > 2 {
+		best, bestRank := -1, int32(math.MaxInt32)
+		for i := 0; i+2 < len(bounds); i++ {
+			if r, ok := t.ranks[string(p[bounds[i]:bounds[i+2]])]; ok && r < bestRank {
+				best, bestRank = i, r
+			}
+		}
+		if best < 0 {
+			break
+		}
+		bounds = append(bounds[:best+1], bounds[best+2:]...)
+	}
+	return len(bounds) - 1
+}
+
+// nextPiece is the length of the pre-tokenizer piece b starts with: a
+// letter run with up to one leading non-letter, a run of up to three
+// digits, a punctuation run with an optional leading space and trailing
+// newlines, or whitespace (its last space left to a following word).
+func nextPiece(b []byte) int {
+	r, n := utf8.DecodeRune(b)
+	switch {
+	case unicode.IsLetter(r):
+		return n + letterRun(b[n:])
+	case unicode.IsNumber(r):
+		k := n
+		for d := 1; d < 3 && k < len(b); d++ {
+			r, m := utf8.DecodeRune(b[k:])
+			if !unicode.IsNumber(r) {
+				break
+			}
+			k += m
+		}
+		return k
+	case r != '\r' && r != '\n':
+		if l := letterRun(b[n:]); l > 0 {
+			return n + l
+		}
+	}
+	if !unicode.IsSpace(r) || r == ' ' && n < len(b) && isPunct(b[n:]) {
+		k := 0
+		if r == ' ' {
+			k = n
+		}
+		for k < len(b) {
+			r, m := utf8.DecodeRune(b[k:])
+			if !isPunctRune(r) {
+				break
+			}
+			k += m
+		}
+		for k < len(b) && (b[k] == '\r' || b[k] == '\n') {
+			k++
+		}
+		return max(k, n)
+	}
+	k, last := 0, 0
+	for k < len(b) {
+		r, m := utf8.DecodeRune(b[k:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		last = k
+		k += m
+	}
+	if k < len(b) && last > 0 && b[last] == ' ' {
+		return last
+	}
+	return k
+}
+
+func letterRun(b []byte) int {
+	k := 0
+	for k < len(b) {
+		r, m := utf8.DecodeRune(b[k:])
+		if !unicode.IsLetter(r) {
+			break
+		}
+		k += m
+	}
+	return k
+}
+
+func isPunct(b []byte) bool {
+	r, _ := utf8.DecodeRune(b)
+	return isPunctRune(r)
+}
+
+func isPunctRune(r rune) bool {
+	return !unicode.IsSpace(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+// tokenEstimates compares the estimates of Options.EstimateInputTokens
+// with the usage the upstream reports.
+type tokenEstimates struct {
+	enabled   bool
+	tokenizer string // "heuristic", "bpe" or "custom"
+	vocab     string
+	bpe       *BPE
+
+	compared  atomic.Int64
+	estimated atomic.Int64 // tokens, of the compared requests
+	actual    atomic.Int64
+	absErrPPM atomic.Int64 // sum of |estimate - actual| / actual, in millionths
+	errPPM    atomic.Int64 // signed, for the bias
+	within10  atomic.Int64
+	within25  atomic.Int64
+}
+
+func newTokenEstimates(opts Options) (*tokenEstimates, error) {
+	t := &tokenEstimates{
+		enabled:   opts.EstimateInputTokens || opts.TokenEstimateHeader,
+		tokenizer: "heuristic",
+	}
+	switch {
+	case opts.TokenEstimate != nil:
+		t.tokenizer = "custom"
+	case opts.TokenizerVocab != "":
+		bpe, err := LoadBPE(opts.TokenizerVocab)
+		if err != nil {
+			return nil, fmt.Errorf("reserve: TokenizerVocab: %w", err)
+		}
+		t.tokenizer, t.vocab, t.bpe = "bpe", opts.TokenizerVocab, bpe
+	}
+	return t, nil
+}
+
+// observe compares the estimate of a request with the input tokens the
+// upstream charged for it.
+func (t *tokenEstimates) observe(estimate, actual int64) {
+	if actual <= 0 {
+		return
+	}
+	ppm := (estimate - actual) * 1_000_000 / actual
+	abs := max(ppm, -ppm)
+	t.compared.Add(1)
+	t.estimated.Add(estimate)
+	t.actual.Add(actual)
+	t.absErrPPM.Add(abs)
+	t.errPPM.Add(ppm)
+	if abs <= 100_000 {
+		t.within10.Add(1)
+	}
+	if abs <= 250_000 {
+		t.within25.Add(1)
+	}
+}
+
+func (p *Proxy) tokenEstimateStats() any {
+	t := p.tokens
+	out := map[string]any{"enabled": t.enabled, "tokenizer": t.tokenizer}
+	if t.bpe != nil {
+		out["vocab"], out["vocab_tokens"] = t.vocab, t.bpe.Len()
+	}
+	if !t.enabled {
+		return out
+	}
+	n := t.compared.Load()
+	out["compared"] = n
+	out["estimated_tokens"] = t.estimated.Load()
+	out["actual_tokens"] = t.actual.Load()
+	if n > 0 {
+		pct := func(ppm int64) float64 { return math.Round(float64(ppm)/float64(n)/100) / 100 }
+		out["mean_abs_error_pct"] = pct(t.absErrPPM.Load())
+		out["bias_pct"] = pct(t.errPPM.Load())
+		out["within_10pct"] = math.Round(float64(t.within10.Load())/float64(n)*1000) / 1000
+		out["within_25pct"] = math.Round(float64(t.within25.Load())/float64(n)*1000) / 1000
+	}
+	return out
+}
+
+// noteEstimate estimates the input tokens of body bs, as forwarded, into
+// st; see above.
+func (rr *Rewriter) noteEstimate(st *reqState, bs []byte) {
+	if !rr.opts.EstimateInputTokens && !rr.opts.TokenEstimateHeader {
+		return
+	}
+	n := rr.estimateTokens(bs)
+	st.inputTokens = n
+	st.wide.estimated(n)
+	st.trace.log("token_estimate", "tokens", n, "bytes", len(bs))
+}
+
+// compareEstimate compares st's estimate with usage object u, of Responses
+// (input_tokens) or chat completions (prompt_tokens) shape.
+func (p *Proxy) compareEstimate(st *reqState, u *ast.Node) {
+	if st == nil || st.inputTokens <= 0 || !p.tokens.enabled {
+		return
+	}
+	n, err := u.Get("input_tokens").Int64()
+	if err != nil {
+		n, err = u.Get("prompt_tokens").Int64()
+	}
+	if err == nil {
+		p.tokens.observe(int64(st.inputTokens), n)
+	}
+}
+
+// setEstimateHeader returns st's estimate to the client, with
+// Options.TokenEstimateHeader.
+func (p *Proxy) setEstimateHeader(h http.Header, st *reqState) {
+	if p.opts.TokenEstimateHeader && st.inputTokens > 0 {
+		h.Set(estimatedTokensHeader, strconv.Itoa(st.inputTokens))
+	}
+}
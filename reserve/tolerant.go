@@ -0,0 +1,118 @@
+package reserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync/atomic"
+)
+
+// Hand-written payloads and some SDK templates send almost-JSON: // or
+// /* */ comments and trailing commas, which nothing downstream parses.
+// With Options.TolerantJSON a body that is not valid JSON has both
+// stripped, outside string values only, before anything else looks at
+// it; when that makes it valid it goes on in that form and the client is
+// named in a warning, otherwise it is left exactly as it came.
+
+type tolerantCounts struct {
+	repaired   atomic.Int64
+	unrepaired atomic.Int64 // not valid JSON even without comments and commas
+}
+
+func (rr *Rewriter) tolerantStats() any {
+	return map[string]any{
+		"enabled":    rr.opts.TolerantJSON,
+		"repaired":   rr.tolerant.repaired.Load(),
+		"unrepaired": rr.tolerant.unrepaired.Load(),
+	}
+}
+
+// repairBody replaces orig with its comment- and trailing-comma-free form
+// when orig is not JSON and that form is.
+func (rw *bodyRewrite) repairBody() {
+	bs := rw.orig.Bytes()
+	if json.Valid(bs) {
+		return
+	}
+	out := stripTrailingCommas(stripComments(bs))
+	if len(out) == len(bs) {
+		return // nothing to strip, some other breakage
+	}
+	if !json.Valid(out) {
+		rw.rr.tolerant.unrepaired.Add(1)
+		return
+	}
+	rw.rr.tolerant.repaired.Add(1)
+	logOf(rw.req.Context()).Warn("request body had comments or trailing commas, stripped them",
+		"client", rw.rr.derivePromptCacheKey(rw.req, ""), "bytes", len(bs), "stripped", len(bs)-len(out))
+	traceOf(rw.req.Context()).log("tolerant_json", "bytes", len(bs), "stripped", len(bs)-len(out))
+	b := getBuf(len(out))
+	b.Write(out)
+	putBuf(rw.orig)
+	rw.orig = b
+	rw.rewritten = true
+}
+
+// stripComments drops the // and /* */ comments outside JSON strings; a
+// line comment keeps its newline.
+func stripComments(bs []byte) []byte {
+	out := make([]byte, 0, len(bs))
+	for i := 0; i < len(bs); i++ {
+		c := bs[i]
+		switch {
+		case c == '"':
+			end := stringEnd(bs, i)
+			out = append(out, bs[i:end]...)
+			i = end - 1
+		case c == '/' && i+1 < len(bs) && bs[i+1] == '/':
+			for i < len(bs) && bs[i] != '\n' {
+				i++
+			}
+			if i < len(bs) {
+				out = append(out, '\n')
+			}
+		case c == '/' && i+1 < len(bs) && bs[i+1] == '*':
+			end := bytes.Index(bs[i+2:], []byte("*/"))
+			if end < 0 {
+				return append(out, bs[i:]...) // unterminated: not ours to fix
+			}
+			i += 2 + end + 1
+			out = append(out, ' ')
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// stripTrailingCommas drops the commas, outside JSON strings, that only
+// whitespace separates from a closing } or ].
+func stripTrailingCommas(bs []byte) []byte {
+	out := make([]byte, 0, len(bs))
+	for i := 0; i < len(bs); i++ {
+		c := bs[i]
+		switch c {
+		case '"':
+			end := stringEnd(bs, i)
+			out = append(out, bs[i:end]...)
+			i = end - 1
+		case ',':
+			j := skipWS(bs, i+1)
+			if j < len(bs) && (bs[j] == '}' || bs[j] == ']') {
+				continue
+			}
+			out = append(out, c)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// stringEnd is skipString, len(bs) for a string that is not closed.
+func stringEnd(bs []byte, i int) int {
+	end, err := skipString(bs, i)
+	if err != nil {
+		return len(bs)
+	}
+	return end
+}
@@ -0,0 +1,89 @@
+package reserve
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStripTolerant(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"trailing comma in object", `{"a":1,}`, `{"a":1}`},
+		{"trailing comma in array", `[1,2,]`, `[1,2]`},
+		{"nested trailing commas", `{"a":[1,{"b":2,},],}`, `{"a":[1,{"b":2}]}`},
+		{"comma before whitespace", "{\"a\":1 ,\n\t}", "{\"a\":1 \n\t}"},
+		{"line comment", "{\"a\":1 // note\n}", "{\"a\":1 \n}"},
+		{"line comment at the end", `{"a":1}// end`, `{"a":1}`},
+		{"block comment", `{"a":/* x */1}`, `{"a": 1}`},
+		{"block comment over lines", "{/* one\ntwo */\"a\":1}", `{ "a":1}`},
+		{"comment then closing", "{\"a\":1, // last\n}", "{\"a\":1 \n}"},
+		{"quote in a comment", "{\"a\":1, // it's \"quoted\n\"b\":2}", "{\"a\":1, \n\"b\":2}"},
+		{"brace in a comment", `{/* "{" */"a":1}`, `{ "a":1}`},
+		{"slashes in a string", `{"url":"http://x//y/*z*/"}`, `{"url":"http://x//y/*z*/"}`},
+		{"comma and brace in a string", `{"s":",}","t":",]"}`, `{"s":",}","t":",]"}`},
+		{"escaped quote in a string", `{"s":"a\"//b,]",}`, `{"s":"a\"//b,]"}`},
+		{"escaped backslash ending a string", `{"s":"x\\",}`, `{"s":"x\\"}`},
+		{"comment after a string with slashes", "{\"s\":\"//\" // c\n}", "{\"s\":\"//\" \n}"},
+		{"unterminated block comment", `{"a":1 /* x`, `{"a":1 /* x`},
+		{"unterminated string", `{"a":"x//,}`, `{"a":"x//,}`},
+		{"lone slash", `{"a":1/2}`, `{"a":1/2}`},
+		{"double comma", `[1,,]`, `[1,]`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := string(stripTrailingCommas(stripComments([]byte(tc.in)))); got != tc.want {
+				t.Errorf("stripped %q to %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+// FuzzStripTolerant checks that valid JSON, which has neither comments
+// nor trailing commas outside its strings, comes out of the strippers as
+// it went in.
+func FuzzStripTolerant(f *testing.F) {
+	for _, s := range []string{
+		`{"a":1}`, `{"s":"//,}"}`, `{"s":"/*","t":"*/"}`, `["\"//",",]"]`, `{"s":"\\\\","u":"//"}`,
+		`{"model":"gpt-5","input":[{"role":"user","content":"see http://example.com/a//b, ok}"}]}`,
+	} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		if !json.Valid(bs) {
+			return
+		}
+		if got := stripTrailingCommas(stripComments(bs)); string(got) != string(bs) {
+			t.Fatalf("valid %q stripped to %q", bs, got)
+		}
+	})
+}
+
+func TestTolerantRewrite(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TolerantJSON = true
+	rr := NewRewriter(opts)
+
+	body := "{\n  // the model\n  \"model\": \"gpt-5\",\n  \"input\": \"see http://x//y, ok}\", /* trailing */\n}"
+	_, out := rewrite(t, rr, "/v1/responses", nil, []byte(body))
+	m := decodeBody(t, out)
+	if m["model"] != "gpt-5" || m["input"] != "see http://x//y, ok}" || m["prompt_cache_key"] == nil {
+		t.Errorf("forwarded %s, want the repaired body rewritten", out)
+	}
+
+	// valid JSON is left to the normal pipeline, and a body broken some
+	// other way is not counted as repaired
+	rewrite(t, rr, "/v1/responses", nil, []byte(`{"input":"// not a comment,}"}`))
+	rewrite(t, rr, "/v1/responses", nil, []byte(`{"input":"hi",, // x`+"\n}"))
+	st := rr.tolerantStats().(map[string]any)
+	if st["repaired"] != int64(1) || st["unrepaired"] != int64(1) {
+		t.Errorf("tolerant stats = %v", st)
+	}
+}
+
+func TestTolerantOff(t *testing.T) {
+	rr := NewRewriter(DefaultOptions())
+	rewrite(t, rr, "/v1/responses", nil, []byte(`{"input":"hi",}`))
+	if st := rr.tolerantStats().(map[string]any); st["repaired"] != int64(0) {
+		t.Errorf("tolerant stats = %v with TolerantJSON off", st)
+	}
+}
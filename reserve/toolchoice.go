@@ -0,0 +1,131 @@
+package reserve
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/ast"
+)
+
+// The tool_choice hook sets tool_choice as Options.Policy says for the
+// request's client, else its route, else every request. A request without
+// tools is left alone unless the choice is none. A named function must be
+// among the request's function tools; when it is not, the request gets
+// auto instead and a warning names the function, so a pipeline renaming
+// its tools degrades rather than fails upstream.
+
+const toolChoiceFunction = "function:"
+
+// checkToolChoice validates a policy tool_choice ("" = none set).
+func checkToolChoice(c string) error {
+	switch c {
+	case "", "none", "auto", "required":
+		return nil
+	}
+	if fn, ok := strings.CutPrefix(c, toolChoiceFunction); ok && fn != "" {
+		return nil
+	}
+	return fmt.Errorf("%q: want none, auto, required or function:<name>", c)
+}
+
+func (p *RequestPolicy) toolChoice(route, client string) string {
+	if c, ok := p.ClientToolChoices[client]; ok {
+		return c
+	}
+	if c, ok := p.RouteToolChoices[route]; ok {
+		return c
+	}
+	return p.ToolChoice
+}
+
+func toolChoiceHook(r *Request) error {
+	rr := r.rw.rr
+	p := rr.opts.Policy
+	if p == nil {
+		return nil
+	}
+	client := rr.derivePromptCacheKey(r.HTTP, "")
+	want := p.toolChoice(r.Route, client)
+	if want == "" {
+		return nil
+	}
+	var tools, cur *ast.Node
+	if r.parsed {
+		tools, cur = r.root.Get("tools"), r.root.Get("tool_choice")
+	} else {
+		bs := r.Body()
+		t, _ := sonic.Get(bs, "tools")
+		c, _ := sonic.Get(bs, "tool_choice")
+		tools, cur = &t, &c
+	}
+	if !hasTools(tools) && want != "none" {
+		return nil
+	}
+	fn, named := strings.CutPrefix(want, toolChoiceFunction)
+	fallback := named && !hasFunctionTool(tools, fn)
+	if fallback {
+		rr.policy.toolFallbacks.Add(1)
+		r.Logger().Warn("policy: tool_choice function not among the request's tools, using auto",
+			"route", r.Route, "client", client, "function", fn)
+		want, named = "auto", false
+	}
+	if isToolChoice(cur, want, fn, named) {
+		if fallback {
+			traceOf(r.HTTP.Context()).log("tool_choice", "tool_choice", want, "fallback", true, "set", false)
+		}
+		return nil
+	}
+	root, err := r.JSON()
+	if root == nil {
+		return err
+	}
+	v := ast.NewString(want)
+	if named {
+		v = ast.NewObject([]ast.Pair{
+			{Key: "type", Value: ast.NewString("function")},
+			{Key: "name", Value: ast.NewString(fn)},
+		})
+	}
+	if _, err := root.Set("tool_choice", v); err != nil {
+		return err
+	}
+	rr.policy.toolChoices.Add(1)
+	r.Logger().Debug("policy: tool_choice set", "route", r.Route, "tool_choice", want, "fallback", fallback)
+	traceOf(r.HTTP.Context()).log("tool_choice", "tool_choice", want, "fallback", fallback, "set", true)
+	return nil
+}
+
+func hasTools(tools *ast.Node) bool {
+	if nodeType(tools) != ast.V_ARRAY {
+		return false
+	}
+	vs, err := tools.ArrayUseNode()
+	return err == nil && len(vs) > 0
+}
+
+// hasFunctionTool reports whether tools holds the function tool name.
+func hasFunctionTool(tools *ast.Node, name string) bool {
+	vs, err := tools.ArrayUseNode()
+	if err != nil {
+		return false
+	}
+	for i := range vs {
+		if nodeString(vs[i].Get("type")) == "function" && nodeString(vs[i].Get("name")) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isToolChoice reports whether the request's tool_choice cur already is
+// want (the function fn when named).
+func isToolChoice(cur *ast.Node, want, fn string, named bool) bool {
+	switch nodeType(cur) {
+	case ast.V_STRING:
+		return !named && nodeString(cur) == want
+	case ast.V_OBJECT:
+		return named && nodeString(cur.Get("type")) == "function" && nodeString(cur.Get("name")) == fn
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package reserve
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// A request carrying "X-Reserve-Trace: <Options.TraceSecret>" is traced:
+// every stage it goes through (routing, the body read and scan, each
+// hook, the rewrite path and sizes, the upstream decisions, the response
+// parses, how it ended) logs a "trace" line at info level, whatever the
+// log level, all with the same trace_id. With TraceEchoID the id goes
+// back in X-Reserve-Trace-Id for the caller to quote. The header never
+// reaches the upstream, secret or not.
+
+const (
+	traceHeader   = "X-Reserve-Trace"
+	traceIDHeader = "X-Reserve-Trace-Id"
+)
+
+type traceCounts struct {
+	traced, refused atomic.Int64
+}
+
+func (p *Proxy) traceStats() any {
+	return map[string]any{
+		"enabled": p.opts.TraceSecret != "",
+		"traced":  p.traces.traced.Load(),
+		"refused": p.traces.refused.Load(),
+	}
+}
+
+// reqTrace is a traced request's log. Its methods are no-ops on nil, a
+// reqState's trace for requests that aren't traced.
+type reqTrace struct {
+	id    string
+	start time.Time
+	lg    *slog.Logger // with the request_id
+}
+
+// startTrace strips the trace header off r and returns the request's
+// trace when the header holds the secret.
+func (p *Proxy) startTrace(w http.ResponseWriter, r *http.Request, st *reqState) *reqTrace {
+	v := r.Header.Get(traceHeader)
+	if v == "" {
+		return nil
+	}
+	r.Header.Del(traceHeader)
+	secret := p.opts.TraceSecret
+	if secret == "" || subtle.ConstantTimeCompare([]byte(v), []byte(secret)) != 1 {
+		p.traces.refused.Add(1)
+		return nil
+	}
+	p.traces.traced.Add(1)
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	t := &reqTrace{id: hex.EncodeToString(b[:]), start: st.start, lg: st.log}
+	if p.opts.TraceEchoID {
+		w.Header().Set(traceIDHeader, t.id)
+	}
+	t.log("request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr,
+		"content_length", r.ContentLength, "content_encoding", r.Header.Get("Content-Encoding"),
+		"content_type", r.Header.Get("Content-Type"))
+	return t
+}
+
+// log writes one stage of the trace.
+func (t *reqTrace) log(stage string, attrs ...any) {
+	if t == nil {
+		return
+	}
+	attrs = append([]any{"trace_id", t.id, "stage", stage,
+		"at", time.Since(t.start).Round(time.Microsecond)}, attrs...)
+	t.lg.Info("trace", attrs...)
+}
+
+// traceOf is the trace of the request ctx belongs to, nil if untraced.
+func traceOf(ctx context.Context) *reqTrace {
+	if st := stateOf(ctx); st != nil {
+		return st.trace
+	}
+	return nil
+}
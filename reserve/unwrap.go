@@ -0,0 +1,73 @@
+package reserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/bytedance/sonic"
+)
+
+// A client that serializes its request twice sends a JSON string holding
+// the JSON body ("{\"model\":...}"), or the body as the only element of an
+// array; the hooks find no keys to work on and the upstream refuses it
+// without saying why. With Options.UnwrapBodies such a body is replaced
+// by the object it wraps before anything else looks at it, and the
+// client is named in a warning. Only an outer string or array that is
+// valid JSON as a whole, wrapping an object with a model, is unwrapped.
+
+type unwrapCounts struct {
+	strings atomic.Int64 // double-encoded bodies
+	arrays  atomic.Int64 // bodies wrapped in a one-element array
+}
+
+func (rr *Rewriter) unwrapStats() any {
+	return map[string]any{
+		"enabled": rr.opts.UnwrapBodies,
+		"strings": rr.unwrap.strings.Load(),
+		"arrays":  rr.unwrap.arrays.Load(),
+	}
+}
+
+// unwrapBody replaces orig with the object it wraps, if it wraps one.
+func (rw *bodyRewrite) unwrapBody() {
+	bs := bytes.TrimSpace(rw.orig.Bytes())
+	if len(bs) == 0 || bs[0] != '"' && bs[0] != '[' {
+		return
+	}
+	var inner []byte
+	how := "string"
+	if bs[0] == '"' {
+		var s string
+		if sonic.Unmarshal(bs, &s) != nil {
+			return
+		}
+		inner = []byte(s)
+	} else {
+		var elems []json.RawMessage
+		if sonic.Unmarshal(bs, &elems) != nil || len(elems) != 1 {
+			return
+		}
+		inner, how = elems[0], "array"
+	}
+	inner = bytes.TrimSpace(inner)
+	if len(inner) == 0 || inner[0] != '{' || !json.Valid(inner) {
+		return
+	}
+	if m, err := sonic.Get(inner, "model"); err != nil || !m.Exists() {
+		return
+	}
+	if how == "string" {
+		rw.rr.unwrap.strings.Add(1)
+	} else {
+		rw.rr.unwrap.arrays.Add(1)
+	}
+	logOf(rw.req.Context()).Warn("request body was wrapped, unwrapped it", "wrapped_in", how,
+		"client", rw.rr.derivePromptCacheKey(rw.req, ""), "bytes", rw.orig.Len(), "unwrapped", len(inner))
+	traceOf(rw.req.Context()).log("unwrap", "wrapped_in", how, "bytes", rw.orig.Len(), "unwrapped", len(inner))
+	b := getBuf(len(inner))
+	b.Write(inner)
+	putBuf(rw.orig)
+	rw.orig = b
+	rw.rewritten = true
+}
@@ -0,0 +1,172 @@
+package reserve
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/ast"
+)
+
+// routeCounts counts proxied requests per route, those refused for their
+// method, and the tokens reported by the responses of usage routes.
+type routeCounts struct {
+	m map[string]*routeCount // fixed at construction, read-only after
+}
+
+type routeCount struct {
+	rt       *route
+	requests atomic.Int64
+	refused  atomic.Int64 // method not allowed, see methodRefusal
+	tokens   atomic.Int64
+}
+
+func newRouteCounts() *routeCounts {
+	c := &routeCounts{m: make(map[string]*routeCount, len(routes)+1)}
+	for i := range routes {
+		c.m[routes[i].name] = &routeCount{rt: &routes[i]}
+	}
+	c.m[ndjsonRoute.name] = &routeCount{rt: &ndjsonRoute}
+	return c
+}
+
+func (c *routeCounts) request(rt *route) { c.m[rt.name].requests.Add(1) }
+
+func (c *routeCounts) stats() any {
+	out := make(map[string]any, len(c.m))
+	for name, rc := range c.m {
+		s := map[string]any{
+			"requests": rc.requests.Load(),
+			"features": rc.rt.features(),
+		}
+		if rc.rt.allow != nil {
+			s["allow"] = rc.rt.allow
+			s["method_refused"] = rc.refused.Load()
+		}
+		if rc.rt.usage {
+			s["usage_total_tokens"] = rc.tokens.Load()
+		}
+		out[name] = s
+	}
+	return out
+}
+
+// logUsage logs the usage object of a successful JSON response on a usage
+// route (embeddings report it in the body), with the client it belongs to,
+// and with Options.Prices (or WideLog, UsageExport) also that of rewritten
+// routes, priced. The body is buffered, bounded by MaxBody; a priced
+// stream is watched for its final event instead.
+func (p *Proxy) logUsage(resp *http.Response, st *reqState) {
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+	if isEventStream(resp) {
+		if (p.costs != nil || p.quotas != nil || st.wide != nil || p.export != nil || p.tokens.enabled) && st.route.rewrite {
+			resp.Body = &usageStream{rc: resp.Body, p: p, st: st, lines: sseLines{limit: p.opts.MaxBody}}
+		}
+		return
+	}
+	r := &Response{HTTP: resp, Route: st.route.name, State: &st.vars, maxBody: p.opts.MaxBody}
+	bs, err := r.Body()
+	if err != nil {
+		st.log.Warn("usage: response not buffered", "route", st.route.name, "error", err)
+		return
+	}
+	u, err := sonic.Get(bs, "usage")
+	if err != nil {
+		st.trace.log("usage", "found", false, "bytes", len(bs))
+		return
+	}
+	if n, err := u.Get("total_tokens").Int64(); err == nil && st.route.usage {
+		p.routes.m[st.route.name].tokens.Add(n)
+	}
+	model, _ := sonic.Get(bs, "model")
+	modelStr, _ := model.String()
+	_, status := responseStatus(bs)
+	st.trace.log("usage", "found", true, "bytes", len(bs), "model", modelStr)
+	if rc, ok := p.recordUsage(st.route.name, st.client, st, modelStr, status, &u); ok && p.opts.CostHeader {
+		resp.Header.Set("X-Reserve-Estimated-Cost", rc.header())
+	}
+}
+
+// recordUsage counts and logs usage object u of a response on route, and
+// prices it when there is a price table (ok); st is the request's state,
+// nil for a background response, status the response's status, if it has
+// one.
+func (p *Proxy) recordUsage(route string, client *clientIdentity, st *reqState, model, status string, u *ast.Node, extra ...any) (rc responseCost, ok bool) {
+	var e *wideEvent
+	if st != nil {
+		e = st.wide
+	}
+	raw, _ := u.Raw()
+	id := ""
+	if client != nil {
+		id = client.CacheKey
+	}
+	attrs := append([]any{"route", route}, extra...)
+	attrs = append(attrs, "client", id, "model", model, "usage", raw)
+	if p.costs != nil {
+		if rc, ok = p.costs.charge(client, model, raw); ok {
+			attrs = append(attrs, rc.logAttrs()...)
+		}
+	}
+	if p.quotas != nil {
+		p.quotas.charge(client, raw)
+	}
+	st.logger().Info("usage", attrs...)
+	e.usageOf(raw, rc, ok)
+	p.compareEstimate(st, u)
+	if p.export != nil {
+		p.export.record(newUsageRow(route, client, st, model, status, raw, rc, ok))
+	}
+	return rc, ok
+}
+
+// usageStream passes a priced stream through unchanged, recording the
+// usage of its terminal response event.
+type usageStream struct {
+	rc    io.ReadCloser
+	p     *Proxy
+	st    *reqState
+	lines sseLines
+	done  bool // usage recorded
+}
+
+func (s *usageStream) Read(b []byte) (int, error) {
+	n, err := s.rc.Read(b)
+	if !s.done && n > 0 {
+		s.lines.write(b[:n], s.event)
+	}
+	return n, err
+}
+
+func (s *usageStream) Close() error { return s.rc.Close() }
+
+func (s *usageStream) event(line []byte) {
+	if s.done {
+		return
+	}
+	d, ok := bytes.CutPrefix(line, []byte("data:"))
+	if !ok || !bytes.Contains(d, []byte(`"usage"`)) {
+		return
+	}
+	var ev respEvent
+	if sonic.Unmarshal(d, &ev) != nil || ev.Response == nil {
+		return
+	}
+	switch ev.Type {
+	case "response.completed", "response.incomplete", "response.failed":
+	default:
+		return
+	}
+	u, err := sonic.Get(d, "response", "usage")
+	if err != nil || u.TypeSafe() != ast.V_OBJECT {
+		return
+	}
+	s.done = true
+	s.lines.reset()
+	s.st.trace.log("usage", "found", true, "event", ev.Type, "model", ev.Response.Model)
+	s.p.recordUsage(s.st.route.name, s.st.client, s.st, ev.Response.Model, ev.Response.Status, &u)
+}
@@ -0,0 +1,82 @@
+package reserve
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+const modulePath = "github.com/ycvk/rightcode-reserve"
+
+// Version, Commit and BuildDate are stamped at link time, e.g.
+//
+//	-ldflags "-X github.com/ycvk/rightcode-reserve/reserve.Version=v1.4.0"
+//
+// Unset ones fall back to the module and VCS info the Go toolchain embeds.
+var (
+	Version   string
+	Commit    string
+	BuildDate string
+)
+
+// BuildInfo identifies the running build.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	Sonic     string `json:"sonic"`
+	// Schema is the version of the embedded Responses request schema.
+	Schema string `json:"schema"`
+}
+
+func (b BuildInfo) String() string {
+	return fmt.Sprintf("rc-proxy %s (commit %s, built %s, %s, sonic %s, schema %s)",
+		b.Version, b.Commit, b.BuildDate, b.GoVersion, b.Sonic, b.Schema)
+}
+
+var buildInfo = sync.OnceValue(func() BuildInfo {
+	b := BuildInfo{Version: Version, Commit: Commit, BuildDate: BuildDate, Schema: responsesSchemaVersion}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		b.GoVersion = bi.GoVersion
+		mod := &bi.Main
+		for _, d := range bi.Deps {
+			switch d.Path {
+			case "github.com/bytedance/sonic":
+				b.Sonic = d.Version
+			case modulePath:
+				// embedded as a library
+				mod = d
+			}
+		}
+		if b.Version == "" {
+			b.Version = mod.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if b.Commit == "" {
+					b.Commit = s.Value
+				}
+			case "vcs.time":
+				if b.BuildDate == "" {
+					b.BuildDate = s.Value
+				}
+			case "vcs.modified":
+				if s.Value == "true" && b.Commit != "" && !strings.HasSuffix(b.Commit, "-dirty") {
+					b.Commit += "-dirty"
+				}
+			}
+		}
+	}
+	for _, f := range []*string{&b.Version, &b.Commit, &b.BuildDate, &b.GoVersion, &b.Sonic} {
+		if *f == "" {
+			*f = "unknown"
+		}
+	}
+	return b
+})
+
+// Build returns the running build's version info.
+func Build() BuildInfo { return buildInfo() }
@@ -0,0 +1,121 @@
+package reserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/ast"
+)
+
+// synthetic bodies covering the fast path (cache key injection only) and
+// the AST path (instructions migration). No "model" so nothing gets logged.
+var warmupBodies = []string{
+	`{"input":"warmup"}`,
+	`{"instructions":"warmup","input":"warmup"}`,
+	`{"instructions":"warmup","input":[{"role":"user","content":"warmup"}]}`,
+}
+
+// Warmup exercises the rewrite paths and opens up to conns upstream
+// connections. Run it before accepting traffic so the first real burst
+// doesn't pay for sonic's lazy JIT or the upstream TLS handshake.
+func (p *Proxy) Warmup(conns int) {
+	start := time.Now()
+
+	for _, t := range []reflect.Type{
+		reflect.TypeOf(ast.Node{}),
+		reflect.TypeOf(errorBody{}),
+	} {
+		if err := sonic.Pretouch(t); err != nil {
+			slog.Warn("sonic pretouch failed", "type", t.String(), "error", err)
+		}
+	}
+
+	for _, body := range warmupBodies {
+		p.warmupRewrite([]byte(body), false)
+		p.warmupRewrite([]byte(body), true)
+	}
+	rewrite := time.Since(start)
+
+	warmed := warmupConns(p.transport, p.target, conns)
+
+	slog.Info("warmup done",
+		"duration", time.Since(start),
+		"rewrite", rewrite,
+		"upstream_conns", warmed,
+	)
+}
+
+func (p *Proxy) warmupRewrite(body []byte, gz bool) {
+	req := &http.Request{
+		Method:        http.MethodPost,
+		URL:           &url.URL{Path: responsesPath},
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		RemoteAddr:    "127.0.0.1:0",
+		ContentLength: int64(len(body)),
+	}
+	if gz {
+		var zb bytes.Buffer
+		zw := gzip.NewWriter(&zb)
+		_, _ = zw.Write(body)
+		_ = zw.Close()
+		req.Header.Set("Content-Encoding", "gzip")
+		req.ContentLength = int64(zb.Len())
+		body = zb.Bytes()
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	if _, err := p.rewriter.tweakBodySonic(req, routeNamed("responses")); err != nil {
+		slog.Warn("warmup rewrite failed", "error", err)
+		return
+	}
+	_, _ = io.Copy(io.Discard, req.Body)
+	_ = req.Body.Close()
+}
+
+// warmupConns opens up to n upstream connections in parallel with HEAD
+// requests; the transport keeps them idle for the first real requests.
+// Over HTTP/2 these collapse onto a single connection, which is fine.
+func warmupConns(rt http.RoundTripper, target *url.URL, n int) int {
+	if n <= 0 {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+		ok int
+	)
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, target.String(), nil)
+			if err != nil {
+				return
+			}
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				slog.Warn("warmup upstream connection failed", "error", err)
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			mu.Lock()
+			ok++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return ok
+}
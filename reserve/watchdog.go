@@ -0,0 +1,279 @@
+package reserve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With Options.ProfileDir, a watchdog samples the heap in use and the
+// goroutine count every WatchInterval. When the heap reaches WatchHeap,
+// the goroutines reach WatchGoroutines, or the heap has grown WatchGrowth
+// samples in a row, it writes a heap and a goroutine profile into the
+// directory, logs an error and sends a "watchdog" notification. Automatic
+// captures are at most one per ProfileCooldown; the admin API captures on
+// demand. The oldest profiles are removed to keep the directory's
+// profiles under ProfileMaxBytes.
+
+const profilePath = reservePrefix + "profile"
+
+var errProfileDisabled = &httpError{
+	status: http.StatusNotFound,
+	code:   "profile_disabled",
+	msg:    "no profile directory is configured",
+}
+
+type watchdog struct {
+	p    *Proxy
+	opts Options
+
+	mu          sync.Mutex // serializes captures
+	lastCapture time.Time
+	lastReason  string
+	lastFiles   []string
+	warned      bool // of a capture the cooldown suppressed
+
+	heap, goroutines atomic.Int64 // the latest sample
+	streak           atomic.Int64 // consecutive heap increases
+	prevHeap         uint64
+
+	captures, suppressed, failures atomic.Int64
+	removed                        atomic.Int64
+}
+
+func newWatchdog(p *Proxy, opts Options) *watchdog {
+	if opts.ProfileDir == "" {
+		return nil
+	}
+	if opts.WatchInterval <= 0 {
+		opts.WatchInterval = time.Minute
+	}
+	w := &watchdog{p: p, opts: opts}
+	if opts.WatchHeap > 0 || opts.WatchGoroutines > 0 || opts.WatchGrowth > 0 {
+		go w.run()
+	}
+	return w
+}
+
+func (p *Proxy) watchdogStats() any {
+	w := p.watchdog
+	if w == nil {
+		return map[string]any{"enabled": false}
+	}
+	w.mu.Lock()
+	last, reason, files := w.lastCapture, w.lastReason, w.lastFiles
+	w.mu.Unlock()
+	out := map[string]any{
+		"enabled":          true,
+		"dir":              w.opts.ProfileDir,
+		"interval":         w.opts.WatchInterval.String(),
+		"heap_threshold":   w.opts.WatchHeap,
+		"goroutine_limit":  w.opts.WatchGoroutines,
+		"growth_samples":   w.opts.WatchGrowth,
+		"cooldown":         w.opts.ProfileCooldown.String(),
+		"max_bytes":        w.opts.ProfileMaxBytes,
+		"heap_inuse_bytes": w.heap.Load(),
+		"goroutines":       w.goroutines.Load(),
+		"growth_streak":    w.streak.Load(),
+		"captures":         w.captures.Load(),
+		"suppressed":       w.suppressed.Load(),
+		"failures":         w.failures.Load(),
+		"removed_captures": w.removed.Load(),
+	}
+	if !last.IsZero() {
+		out["last_capture"] = map[string]any{
+			"time":   last.UTC().Format(time.RFC3339),
+			"reason": reason,
+			"files":  files,
+		}
+	}
+	return out
+}
+
+func (w *watchdog) run() {
+	t := time.NewTicker(w.opts.WatchInterval)
+	defer t.Stop()
+	for range t.C {
+		if reason := w.sample(); reason != "" {
+			w.trigger(reason)
+		}
+	}
+}
+
+// sample takes one sample and returns why it calls for a capture, if it
+// does.
+func (w *watchdog) sample() string {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	g := runtime.NumGoroutine()
+	w.heap.Store(int64(m.HeapInuse))
+	w.goroutines.Store(int64(g))
+
+	streak := int64(0)
+	if w.prevHeap != 0 && m.HeapInuse > w.prevHeap {
+		streak = w.streak.Load() + 1
+	}
+	w.prevHeap = m.HeapInuse
+	w.streak.Store(streak)
+
+	switch {
+	case w.opts.WatchHeap > 0 && int64(m.HeapInuse) >= w.opts.WatchHeap:
+		return fmt.Sprintf("heap in use %d bytes, threshold %d", m.HeapInuse, w.opts.WatchHeap)
+	case w.opts.WatchGoroutines > 0 && g >= w.opts.WatchGoroutines:
+		return fmt.Sprintf("%d goroutines, threshold %d", g, w.opts.WatchGoroutines)
+	case w.opts.WatchGrowth > 0 && streak >= int64(w.opts.WatchGrowth):
+		// start over, so steady growth captures again after the cooldown
+		// rather than on every sample
+		w.streak.Store(0)
+		return fmt.Sprintf("heap in use grew %d samples in a row, to %d bytes", streak, m.HeapInuse)
+	}
+	return ""
+}
+
+// trigger captures for reason unless a capture was made within the
+// cooldown.
+func (w *watchdog) trigger(reason string) {
+	w.mu.Lock()
+	if !w.lastCapture.IsZero() && time.Since(w.lastCapture) < w.opts.ProfileCooldown {
+		last, warned := w.lastCapture, w.warned
+		w.warned = true
+		w.mu.Unlock()
+		w.suppressed.Add(1)
+		// once per capture, not on every sample until the cooldown ends
+		level := slog.LevelWarn
+		if warned {
+			level = slog.LevelDebug
+		}
+		slog.Log(context.Background(), level, "watchdog: threshold crossed, capture suppressed by cooldown",
+			"reason", reason, "last_capture", last.UTC().Format(time.RFC3339))
+		return
+	}
+	files, err := w.captureLocked(reason)
+	w.mu.Unlock()
+	if err != nil {
+		slog.Error("watchdog: threshold crossed, profile capture failed", "reason", reason, "error", err)
+		return
+	}
+	slog.Error("watchdog: threshold crossed, profiles captured", "reason", reason, "files", files)
+	w.p.Notify("watchdog", "rc-proxy watchdog: "+reason+", profiles written to "+w.opts.ProfileDir,
+		map[string]any{"reason": reason, "files": files})
+}
+
+// captureLocked writes the heap and goroutine profiles and rotates the
+// directory. Called with mu held.
+func (w *watchdog) captureLocked(reason string) ([]string, error) {
+	if err := os.MkdirAll(w.opts.ProfileDir, 0o755); err != nil {
+		w.failures.Add(1)
+		return nil, err
+	}
+	stamp := time.Now().UTC().Format("20060102T150405.000Z")
+	var files []string
+	for _, name := range []string{"heap", "goroutine"} {
+		path := filepath.Join(w.opts.ProfileDir, name+"-"+stamp+".pb.gz")
+		if err := writeProfile(name, path); err != nil {
+			w.failures.Add(1)
+			return files, err
+		}
+		files = append(files, path)
+	}
+	w.captures.Add(1)
+	w.lastCapture, w.lastReason, w.lastFiles = time.Now(), reason, files
+	w.warned = false
+	w.rotate(stamp)
+	return files, nil
+}
+
+func writeProfile(name, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	err = pprof.Lookup(name).WriteTo(f, 0)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// rotate removes the oldest captures, both their files, until those left
+// fit in ProfileMaxBytes; keep, the capture just made, always stays.
+func (w *watchdog) rotate(keep string) {
+	if w.opts.ProfileMaxBytes <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(w.opts.ProfileDir)
+	if err != nil {
+		return
+	}
+	captures := map[string][]string{} // stamp -> files
+	sizes := map[string]int64{}
+	var total int64
+	for _, e := range entries {
+		name := e.Name()
+		kind, stamp, ok := strings.Cut(strings.TrimSuffix(name, ".pb.gz"), "-")
+		if !ok || !strings.HasSuffix(name, ".pb.gz") || (kind != "heap" && kind != "goroutine") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		captures[stamp] = append(captures[stamp], filepath.Join(w.opts.ProfileDir, name))
+		sizes[stamp] += info.Size()
+		total += info.Size()
+	}
+	// the stamps sort by time
+	for _, stamp := range slices.Sorted(maps.Keys(captures)) {
+		if total <= w.opts.ProfileMaxBytes {
+			return
+		}
+		if stamp == keep {
+			continue
+		}
+		for _, path := range captures[stamp] {
+			if err := os.Remove(path); err != nil {
+				slog.Warn("watchdog: old profile not removed", "file", path, "error", err)
+			}
+		}
+		w.removed.Add(1)
+		total -= sizes[stamp]
+	}
+}
+
+// serveProfile captures profiles now, whatever the cooldown.
+func (p *Proxy) serveProfile(w http.ResponseWriter, r *http.Request, caller string) {
+	if r.Method != http.MethodPost {
+		writeHTTPError(w, errMethod)
+		return
+	}
+	wd := p.watchdog
+	if wd == nil {
+		writeHTTPError(w, errProfileDisabled)
+		return
+	}
+	reason := "requested by " + caller
+	wd.mu.Lock()
+	files, err := wd.captureLocked(reason)
+	wd.mu.Unlock()
+	slog.Info("admin profile capture", "caller", caller, "remote", r.RemoteAddr, "files", files, "error", err)
+	if err != nil {
+		writeHTTPError(w, &httpError{status: http.StatusInternalServerError, code: "profile_failed", msg: errors.Join(errors.New("profile capture failed"), err).Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"files": files})
+}
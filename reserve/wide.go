@@ -0,0 +1,393 @@
+package reserve
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With Options.WideLog, every proxied request ends in one "request" record
+// on that logger holding everything known about it at completion: route,
+// client, model and effort, what the rewrite did, how it was served, the
+// status, the latency breakdown and upstream connection, token usage and
+// cost, how its stream ended and the error, if any. The record is built
+// up in the request's reqState as the request goes and written once when
+// ServeHTTP returns. A WideSample fraction of successful requests is kept,
+// failed ones always; the WideRedact fields (dotted paths, "client.id")
+// are replaced by a hash of their value, so records still group by them.
+//
+// The field names and meanings are versioned by wideSchemaVersion, the
+// record's "v": bump it whenever a field is renamed, removed or changes
+// meaning (adding one doesn't need it).
+
+const wideSchemaVersion = 1
+
+type wideCounts struct {
+	written, sampledOut atomic.Int64
+}
+
+func (p *Proxy) wideStats() any {
+	if p.opts.WideLog == nil {
+		return map[string]any{"enabled": false}
+	}
+	return map[string]any{
+		"enabled":     true,
+		"schema":      wideSchemaVersion,
+		"sample":      p.opts.WideSample,
+		"redact":      p.opts.WideRedact,
+		"written":     p.wide.written.Load(),
+		"sampled_out": p.wide.sampledOut.Load(),
+	}
+}
+
+// wideEvent is one request's record in the making. Its methods are no-ops
+// on nil, a reqState's wide when Options.WideLog is unset.
+type wideEvent struct {
+	mu sync.Mutex
+
+	model, effort  string
+	stream         bool
+	bodyBytes      int
+	inputTokens    int // estimated, see tokenizer.go
+	rewritten      bool
+	hooks          []string
+	rewrite, queue time.Duration
+	served         string // "upstream", "dedup", "replay" or "cache"; "" answered locally
+	upstreamStatus int
+	upstreamAt     time.Time // upstream response headers in
+	upstreamSent   time.Time
+	responseID     string
+	usage          []byte // the response's usage object
+	cost           *responseCost
+	streamClass    string
+	streamEvent    string
+	errCode        string
+	errMsg         string
+	headers        map[string]string // request headers normalized, their client values
+	fault          string            // injected, see fault.go
+
+	// the response as written to the client, see wideWriter
+	status int
+	bytes  int64
+}
+
+func (e *wideEvent) request(model, effort string, stream bool, size int) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.model, e.effort, e.stream, e.bodyBytes = model, effort, stream, size
+	e.mu.Unlock()
+}
+
+func (e *wideEvent) estimated(tokens int) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.inputTokens = tokens
+	e.mu.Unlock()
+}
+
+func (e *wideEvent) rewrote(rewritten bool, hooks []string, took time.Duration) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.rewritten, e.hooks, e.rewrite = rewritten, hooks, took
+	e.mu.Unlock()
+}
+
+func (e *wideEvent) queued(took time.Duration) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.queue = took
+	e.mu.Unlock()
+}
+
+// serve notes how the response was come by, and when it went upstream.
+func (e *wideEvent) serve(how string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.served = how
+	if how == "upstream" {
+		e.upstreamSent = time.Now()
+	}
+	e.mu.Unlock()
+}
+
+func (e *wideEvent) upstreamResponse(status int) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.upstreamStatus, e.upstreamAt = status, time.Now()
+	e.mu.Unlock()
+}
+
+func (e *wideEvent) usageOf(raw string, rc responseCost, priced bool) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.usage = []byte(raw)
+	if priced {
+		e.cost = &rc
+	}
+	e.mu.Unlock()
+}
+
+func (e *wideEvent) streamEnd(class, event, id string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.streamClass, e.streamEvent = class, event
+	if id != "" {
+		e.responseID = id
+	}
+	e.mu.Unlock()
+}
+
+func (e *wideEvent) headersReplaced(orig map[string]string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.headers = orig
+	e.mu.Unlock()
+}
+
+func (e *wideEvent) faulted(fault string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.fault = fault
+	e.mu.Unlock()
+}
+
+func (e *wideEvent) fail(code, msg string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	// the first error is the cause, later ones its consequences
+	if e.errCode == "" && e.errMsg == "" {
+		e.errCode, e.errMsg = code, msg
+	}
+	e.mu.Unlock()
+}
+
+// failed reports whether the request is kept regardless of WideSample.
+func (e *wideEvent) failed() bool {
+	return e.status >= 400 || e.errCode != "" || e.errMsg != "" || e.fault != "" ||
+		(e.streamClass != "" && e.streamClass != streamCompleted)
+}
+
+// writeWide serializes st's record, the request now answered.
+func (p *Proxy) writeWide(r *http.Request, st *reqState) {
+	e := st.wide
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.failed() && p.opts.WideSample < 1 && rand.Float64() >= p.opts.WideSample {
+		p.wide.sampledOut.Add(1)
+		return
+	}
+	remote, _ := p.rewriter.remoteAddr(r)
+	if a, ok := parseHop(remote); ok {
+		remote = a.String() // the port is noise, and would defeat redaction
+	}
+	rec := map[string]any{
+		"request_id": st.id,
+		"method":     r.Method,
+		"path":       r.URL.Path,
+		"remote":     remote,
+		"status":     e.status,
+		"bytes":      e.bytes,
+	}
+	if st.route != nil {
+		rec["route"] = st.route.name
+	}
+	if c := st.client; c != nil {
+		rec["client"] = map[string]any{"id": c.CacheKey, "source": c.Source}
+	}
+	if e.model != "" {
+		rec["model"] = e.model
+	}
+	if e.effort != "" {
+		rec["effort"] = e.effort
+	}
+	if e.bodyBytes > 0 {
+		rec["request_bytes"] = e.bodyBytes
+		rec["stream"] = e.stream
+		rec["rewrite"] = map[string]any{"rewritten": e.rewritten, "hooks": e.hooks}
+	}
+	if e.headers != nil {
+		rec["replaced_headers"] = e.headers
+	}
+	if e.served != "" {
+		rec["served"] = e.served
+	}
+	if e.served == "upstream" {
+		rec["upstream"] = p.targetOf(st).Host
+		if e.upstreamStatus != 0 {
+			rec["upstream_status"] = e.upstreamStatus
+		}
+	}
+	if e.responseID != "" {
+		rec["response_id"] = e.responseID
+	}
+	if st.trace != nil {
+		rec["trace_id"] = st.trace.id
+	}
+
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	lat := map[string]any{"total_ms": ms(time.Since(st.start))}
+	if e.rewrite > 0 {
+		lat["rewrite_ms"] = ms(e.rewrite)
+	}
+	if e.queue > 0 {
+		lat["queue_ms"] = ms(e.queue)
+	}
+	if !e.upstreamAt.IsZero() && !e.upstreamSent.IsZero() {
+		lat["upstream_headers_ms"] = ms(e.upstreamAt.Sub(e.upstreamSent))
+	}
+	if t := st.conn; t != nil && e.served == "upstream" {
+		t.mu.Lock()
+		if t.proto != "" {
+			rec["conn"] = map[string]any{"reused": t.reused, "proto": t.proto}
+			lat["get_conn_ms"] = ms(t.getConn)
+			lat["dns_ms"] = ms(t.dns)
+			lat["connect_ms"] = ms(t.connect)
+			lat["tls_ms"] = ms(t.tls)
+			lat["server_ms"] = ms(t.server)
+		}
+		t.mu.Unlock()
+	}
+	rec["latency"] = lat
+
+	if e.inputTokens > 0 {
+		rec["estimated_input_tokens"] = e.inputTokens
+	}
+	if e.usage != nil {
+		rec["usage"] = rawJSON(e.usage)
+	}
+	if e.cost != nil {
+		src := "model"
+		if e.cost.fallback {
+			src = "default"
+		}
+		rec["cost"] = map[string]any{"usd": nanoUSD(e.cost.nano), "price": src}
+	}
+	if e.streamClass != "" {
+		s := map[string]any{"class": e.streamClass}
+		if e.streamEvent != "" {
+			s["event"] = e.streamEvent
+		}
+		rec["stream_end"] = s
+	}
+	if e.fault != "" {
+		rec["injected_fault"] = e.fault
+	}
+	if e.errCode != "" || e.errMsg != "" {
+		rec["error"] = map[string]any{"code": e.errCode, "message": e.errMsg}
+	}
+	for _, path := range p.opts.WideRedact {
+		redact(rec, strings.Split(path, "."))
+	}
+
+	// "v" first, the rest sorted, so records of a schema line up
+	attrs := make([]slog.Attr, 0, len(rec)+1)
+	attrs = append(attrs, slog.Int("v", wideSchemaVersion))
+	for _, k := range slices.Sorted(maps.Keys(rec)) {
+		attrs = append(attrs, slog.Any(k, rec[k]))
+	}
+	p.opts.WideLog.LogAttrs(context.Background(), slog.LevelInfo, "request", attrs...)
+	p.wide.written.Add(1)
+}
+
+// rawJSON is JSON embedded as is by a JSON slog handler.
+type rawJSON []byte
+
+func (j rawJSON) MarshalJSON() ([]byte, error) { return j, nil }
+
+// redact replaces the value at path in rec by a hash of it.
+func redact(rec map[string]any, path []string) {
+	v, ok := rec[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) > 1 {
+		if sub, ok := v.(map[string]any); ok {
+			redact(sub, path[1:])
+		}
+		return
+	}
+	bs, err := statsAPI.Marshal(v)
+	if err != nil {
+		delete(rec, path[0])
+		return
+	}
+	sum := sha256.Sum256(bs)
+	rec[path[0]] = "redacted:" + hex.EncodeToString(sum[:6])
+}
+
+// wideWriter notes the status and size of the response to the client.
+type wideWriter struct {
+	http.ResponseWriter
+	e *wideEvent
+}
+
+func (w *wideWriter) WriteHeader(code int) {
+	if code >= 200 {
+		w.e.mu.Lock()
+		if w.e.status == 0 {
+			w.e.status = code
+		}
+		w.e.mu.Unlock()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *wideWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.e.mu.Lock()
+	if w.e.status == 0 {
+		w.e.status = http.StatusOK
+	}
+	w.e.bytes += int64(n)
+	w.e.mu.Unlock()
+	return n, err
+}
+
+func (w *wideWriter) Flush() { _ = http.NewResponseController(w.ResponseWriter).Flush() }
+
+func (w *wideWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// wideOf finds the record of the response w writes, under any wrappers.
+func wideOf(w http.ResponseWriter) *wideEvent {
+	for {
+		switch x := w.(type) {
+		case *wideWriter:
+			return x.e
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = x.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
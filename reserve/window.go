@@ -0,0 +1,193 @@
+package reserve
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/ast"
+)
+
+// Clients that resend the whole history eventually outgrow the model's
+// context window. With Options.InputTokenBudget the input_window hook
+// estimates a request's tokens and, over the budget, drops the oldest
+// input items until it fits: never the leading developer (or system)
+// messages, nor anything from the InputKeepTurns-th last user message on.
+// A tool call goes together with its output, and a reasoning item with
+// the item following it, so what is left is still a valid transcript.
+// How many items went is logged and returned in X-Reserve-Input-Dropped.
+// A request that still does not fit is forwarded as it is, for the
+// upstream to refuse.
+
+const inputDroppedHeader = "X-Reserve-Input-Dropped"
+
+var (
+	kInput = []byte(`"input"`)
+
+	// the number of input items dropped
+	inputDroppedKey = NewKey[int]("input_window")
+)
+
+type windowCounts struct {
+	truncated atomic.Int64 // requests that had items dropped
+	dropped   atomic.Int64 // items
+	unfit     atomic.Int64 // requests still over the budget afterwards
+}
+
+func (rr *Rewriter) inputWindowStats() any {
+	return map[string]any{
+		"enabled":    rr.opts.InputTokenBudget > 0,
+		"budget":     rr.opts.InputTokenBudget,
+		"keep_turns": rr.opts.InputKeepTurns,
+		"truncated":  rr.window.truncated.Load(),
+		"dropped":    rr.window.dropped.Load(),
+		"unfit":      rr.window.unfit.Load(),
+	}
+}
+
+// inputWindowHook drops the oldest input items of a request over
+// Options.InputTokenBudget.
+func inputWindowHook(r *Request) error {
+	rr := r.rw.rr
+	budget := rr.opts.InputTokenBudget
+	if budget <= 0 {
+		return nil
+	}
+	bs := r.Body()
+	total := rr.estimateTokens(bs)
+	if total <= budget || !hasJSONKey(bs, kInput) {
+		return nil
+	}
+	if ok, err := r.walkable(); !ok {
+		return err
+	}
+	// plan on a node of its own: r's AST is only taken when items go
+	in, err := sonic.Get(bs, "input")
+	if err != nil || in.TypeSafe() != ast.V_ARRAY {
+		return nil
+	}
+	items, err := in.ArrayUseNode()
+	if err != nil {
+		return nil
+	}
+	w := newInputWindow(items, rr.opts.InputKeepTurns)
+	drop := make([]bool, len(items))
+	over := total - budget
+	n := 0
+	for i := w.lead; i < w.keep && over > 0; i++ {
+		if drop[i] {
+			continue
+		}
+		g, ok := w.group(i)
+		if !ok {
+			continue
+		}
+		for _, j := range g {
+			if !drop[j] {
+				drop[j] = true
+				n++
+				raw, _ := items[j].Raw()
+				over -= rr.estimateTokens([]byte(raw))
+			}
+		}
+	}
+	if over > 0 {
+		rr.window.unfit.Add(1)
+		r.Logger().Warn("input window: request over the token budget even without its oldest items",
+			"route", r.Route, "estimated_tokens", total, "budget", budget, "droppable", n)
+		traceOf(r.HTTP.Context()).log("input_window", "estimated_tokens", total, "unfit", true)
+		return nil
+	}
+	root, err := r.JSON()
+	if root == nil {
+		return err
+	}
+	rin := root.Get("input")
+	kept := make([]ast.Node, 0, len(items)-n)
+	for i := range items {
+		if !drop[i] {
+			kept = append(kept, *rin.Index(i))
+		}
+	}
+	if _, err := root.Set("input", ast.NewArray(kept)); err != nil {
+		return err
+	}
+	rr.window.truncated.Add(1)
+	rr.window.dropped.Add(int64(n))
+	inputDroppedKey.Set(r.State, n)
+	r.Logger().Info("input window: dropped the oldest input items", "route", r.Route, "dropped", n,
+		"items", len(items), "estimated_tokens", total, "after", budget+over, "budget", budget)
+	traceOf(r.HTTP.Context()).log("input_window", "estimated_tokens", total, "dropped", n, "items", len(items))
+	return nil
+}
+
+// inputWindowResponse reports the dropped items to the client.
+func inputWindowResponse(r *Response) error {
+	if n, ok := inputDroppedKey.Get(r.State); ok {
+		r.HTTP.Header.Set(inputDroppedHeader, strconv.Itoa(n))
+	}
+	return nil
+}
+
+// inputWindow is the shape of an input array: items[:lead] are the leading
+// developer messages and items[keep:] the kept turns, both off limits.
+type inputWindow struct {
+	items      []ast.Node
+	lead, keep int
+	calls      map[string][]int // item indexes by call_id
+}
+
+func newInputWindow(items []ast.Node, turns int) *inputWindow {
+	w := &inputWindow{items: items, keep: len(items), calls: map[string][]int{}}
+	for w.lead < len(items) {
+		if role := nodeString(items[w.lead].Get("role")); role != "developer" && role != "system" {
+			break
+		}
+		w.lead++
+	}
+	seen := 0
+	for i := len(items) - 1; i >= w.lead && seen < turns; i-- {
+		if nodeString(items[i].Get("role")) == "user" {
+			seen++
+			w.keep = i
+		}
+	}
+	for i := range items {
+		if id := nodeString(items[i].Get("call_id")); id != "" {
+			w.calls[id] = append(w.calls[id], i)
+		}
+	}
+	return w
+}
+
+// group returns the items that go with item i, i included, or false when
+// one of them is off limits.
+func (w *inputWindow) group(i int) ([]int, bool) {
+	g := []int{i}
+	if nodeString(w.items[i].Get("type")) == "reasoning" {
+		// the item it preceded
+		if i+1 >= w.keep {
+			return nil, false
+		}
+		g = append(g, i+1)
+	}
+	for _, j := range g {
+		if id := nodeString(w.items[j].Get("call_id")); id != "" {
+			g = append(g, w.calls[id]...)
+		}
+	}
+	for _, j := range g {
+		if j < w.lead || j >= w.keep {
+			return nil, false
+		}
+	}
+	return g, true
+}
+
+func nodeString(n *ast.Node) string {
+	if n == nil || !n.Exists() {
+		return ""
+	}
+	s, _ := n.String()
+	return s
+}
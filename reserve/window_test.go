@@ -0,0 +1,171 @@
+package reserve
+
+import (
+	"strings"
+	"testing"
+)
+
+// pad is the text of every transcript item, large enough that the items'
+// own size drives the estimate.
+var pad = strings.Repeat("x", 1000)
+
+func msg(id, role string) string {
+	return `{"id":"` + id + `","type":"message","role":"` + role + `","content":[{"type":"input_text","text":"` + pad + `"}]}`
+}
+
+func imageMsg(id string) string {
+	return `{"id":"` + id + `","type":"message","role":"user","content":[{"type":"input_text","text":"what is this"},` +
+		`{"type":"input_image","image_url":"data:image/png;base64,` + strings.Repeat("iVBO", 25000) + `"}]}`
+}
+
+func call(id, callID string) string {
+	return `{"id":"` + id + `","type":"function_call","call_id":"` + callID + `","name":"shell","arguments":"` + pad + `"}`
+}
+
+func callOutput(id, callID string) string {
+	return `{"id":"` + id + `","type":"function_call_output","call_id":"` + callID + `","output":"` + pad + `"}`
+}
+
+func reasoningItem(id string) string {
+	return `{"id":"` + id + `","type":"reasoning","summary":[{"type":"summary_text","text":"` + pad + `"}]}`
+}
+
+func transcript(items ...string) []byte {
+	return []byte(`{"model":"gpt-5","input":[` + strings.Join(items, ",") + `]}`)
+}
+
+// inputIDs returns the ids of a forwarded body's input items, in order.
+func inputIDs(t *testing.T, bs []byte) string {
+	t.Helper()
+	in, _ := decodeBody(t, bs)["input"].([]any)
+	ids := make([]string, len(in))
+	for i, it := range in {
+		ids[i], _ = it.(map[string]any)["id"].(string)
+	}
+	return strings.Join(ids, ",")
+}
+
+// windowRewriter counts a token per byte, so a budget of the body size
+// less n has to lose at least n bytes of items.
+func windowRewriter(budget, turns int) *Rewriter {
+	opts := DefaultOptions()
+	opts.InputTokenBudget, opts.InputKeepTurns = budget, turns
+	opts.TokenEstimate = func(b []byte) int { return len(b) }
+	return NewRewriter(opts)
+}
+
+func TestInputWindow(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		body  []byte
+		over  int // bytes over the budget
+		turns int
+		want  string
+	}{
+		{
+			name: "under budget",
+			body: transcript(msg("d", "developer"), msg("u1", "user"), msg("a1", "assistant"), msg("u2", "user")),
+			over: -1, turns: 1,
+			want: "d,u1,a1,u2",
+		},
+		{
+			name: "mixed roles",
+			body: transcript(msg("d", "developer"), msg("s", "system"), msg("u1", "user"), msg("a1", "assistant"),
+				msg("u2", "user"), msg("a2", "assistant"), msg("u3", "user")),
+			over: 1500, turns: 1,
+			want: "d,s,u2,a2,u3",
+		},
+		{
+			name: "kept turns",
+			body: transcript(msg("d", "developer"), msg("u1", "user"), msg("a1", "assistant"),
+				msg("u2", "user"), msg("a2", "assistant"), msg("u3", "user")),
+			over: 1500, turns: 2,
+			want: "d,u2,a2,u3",
+		},
+		{
+			name: "tool call goes with its output",
+			body: transcript(msg("d", "developer"), msg("u1", "user"), call("c1", "a"), callOutput("o1", "a"),
+				msg("u2", "user"), call("c2", "b"), callOutput("o2", "b"), msg("u3", "user")),
+			over: 1500, turns: 1,
+			want: "d,u2,c2,o2,u3",
+		},
+		{
+			name: "tool output out of order",
+			body: transcript(msg("d", "developer"), call("c1", "a"), msg("u1", "user"), callOutput("o1", "a"),
+				msg("u2", "user")),
+			over: 10, turns: 1,
+			want: "d,u1,u2",
+		},
+		{
+			name: "reasoning goes with the next item",
+			body: transcript(msg("d", "developer"), msg("u1", "user"), reasoningItem("r1"), call("c1", "a"),
+				callOutput("o1", "a"), msg("u2", "user")),
+			over: 1500, turns: 1,
+			want: "d,u2",
+		},
+		{
+			name: "tool call split by the kept turns",
+			body: transcript(msg("d", "developer"), msg("u1", "user"), call("c1", "a"), msg("u2", "user"),
+				callOutput("o1", "a"), msg("u3", "user")),
+			over: 1500, turns: 2,
+			want: "d,u1,c1,u2,o1,u3",
+		},
+		{
+			name: "nothing droppable",
+			body: transcript(msg("d", "developer"), msg("u1", "user"), msg("u2", "user")),
+			over: 10, turns: 2,
+			want: "d,u1,u2",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := windowRewriter(len(tc.body)-tc.over, tc.turns)
+			_, out := rewrite(t, rr, "/v1/responses", nil, tc.body)
+			if got := inputIDs(t, out); got != tc.want {
+				t.Errorf("input = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInputWindowImages(t *testing.T) {
+	// an image counts as a fixed number of tokens however large its data
+	// URL, so the estimate is far below the body size
+	body := transcript(msg("d", "developer"), imageMsg("u1"), msg("a1", "assistant"), imageMsg("u2"),
+		msg("a2", "assistant"), msg("u3", "user"))
+	total := EstimateTokens(body)
+	if total > len(body)/10 {
+		t.Fatalf("estimated %d tokens for a %d byte body, the images count by size", total, len(body))
+	}
+	opts := DefaultOptions()
+	opts.InputTokenBudget, opts.InputKeepTurns = total-imageTokens, 1
+	_, out := rewrite(t, NewRewriter(opts), "/v1/responses", nil, body)
+	if got, want := inputIDs(t, out), "d,a1,u2,a2,u3"; got != want {
+		t.Errorf("input = %s, want %s", got, want)
+	}
+}
+
+func TestInputWindowThroughProxy(t *testing.T) {
+	body := transcript(msg("d", "developer"), msg("u1", "user"), msg("a1", "assistant"), msg("u2", "user"))
+	u := newTestUpstream(t, nil)
+	opts := DefaultOptions()
+	opts.InputTokenBudget, opts.InputKeepTurns = len(body)-1500, 1
+	opts.TokenEstimate = func(b []byte) int { return len(b) }
+	p := newTestProxy(t, opts, u)
+
+	w := send(p, "POST", "/v1/responses", nil, string(body))
+	if got := w.Header().Get(inputDroppedHeader); got != "2" {
+		t.Errorf("%s = %q, want 2", inputDroppedHeader, got)
+	}
+	if got := inputIDs(t, u.requests()[0].body); got != "d,u2" {
+		t.Errorf("upstream input = %s, want d,u2", got)
+	}
+	st := p.Stats()["input_window"].(map[string]any)
+	if st["truncated"] != int64(1) || st["dropped"] != int64(2) {
+		t.Errorf("input_window stats = %v", st)
+	}
+
+	w = send(p, "POST", "/v1/responses", nil, string(transcript(msg("d", "developer"), msg("u1", "user"))))
+	if got := w.Header().Get(inputDroppedHeader); got != "" {
+		t.Errorf("%s = %q on a request under the budget", inputDroppedHeader, got)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import "syscall"
+
+// no SO_REUSEPORT: openListeners falls back to a single listener
+var reusePortControl func(network, address string, c syscall.RawConn) error
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/ycvk/rightcode-reserve/reserve"
+)
+
+// selftestCaseHeader tags each synthetic request so the capturing mock can
+// tell them apart.
+const selftestCaseHeader = "X-Selftest-Case"
+
+// selftestCase is one synthetic request. status checks the client-side
+// status; upstream, when set, checks what the mock upstream received (nil
+// got means it received nothing). Neither upstream check runs against a
+// real upstream.
+type selftestCase struct {
+	name        string
+	path        string // "" is /v1/responses
+	contentType string // "" is application/json
+	body        []byte
+	skip        string // why body is nil, when it is
+	gzip        bool
+	status      func(code int) bool
+	response    func(h http.Header, body []byte) error
+	upstream    func(got *capturedRequest) error
+}
+
+type capturedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// selftestCapture records what reaches the upstream before handing the
+// request to the mock.
+type selftestCapture struct {
+	next http.Handler
+	mu   sync.Mutex
+	got  map[string]*capturedRequest
+}
+
+func (c *selftestCapture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bs, _ := io.ReadAll(r.Body)
+	c.mu.Lock()
+	c.got[r.Header.Get(selftestCaseHeader)] = &capturedRequest{header: r.Header.Clone(), body: bs}
+	c.mu.Unlock()
+	r.Body = io.NopCloser(bytes.NewReader(bs))
+	c.next.ServeHTTP(w, r)
+}
+
+func (c *selftestCapture) take(name string) *capturedRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.got[name]
+}
+
+// runSelftest is `rc-proxy selftest`: it starts the proxy on an ephemeral
+// port, sends a battery of synthetic requests through it to the built-in
+// mock (or a real upstream) and prints a pass/fail table. It exits 1 on
+// any failure, for use as a deployment gate.
+func runSelftest(args []string) int {
+	fs := flag.NewFlagSet("rc-proxy selftest", flag.ContinueOnError)
+	upstream := fs.String("upstream", "mock", `"mock" for the built-in mock upstream, or the base URL of a real one`)
+	auth := fs.String("auth", "Bearer rc-selftest", "Authorization header sent with every request; a real upstream needs a valid key")
+	model := fs.String("model", "gpt-5", "model named in the synthetic bodies")
+	timeout := fs.Duration("timeout", 2*time.Minute, "per-request timeout")
+	rewriteFlags(fs)
+	if err := fs.Parse(args); err != nil || checkRewriteFlags(fs) != nil {
+		return 2
+	}
+
+	opts := cfg.Options
+	var capture *selftestCapture
+	if *upstream == "mock" {
+		opts.NDJSONPaths = append(slices.Clone(opts.NDJSONPaths), selftestNDJSONPath)
+		mo := reserve.DefaultMockOptions()
+		mo.Delay = 0
+		h, err := reserve.NewMockUpstream(mo)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "selftest:", err)
+			return 1
+		}
+		capture = &selftestCapture{next: h, got: map[string]*capturedRequest{}}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "selftest: mock listen:", err)
+			return 1
+		}
+		go func() { _ = http.Serve(ln, capture) }()
+		opts.Target = "http://" + ln.Addr().String()
+	} else {
+		opts.Target = *upstream
+	}
+
+	p, err := reserve.NewProxy(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "selftest:", err)
+		return 1
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "selftest: listen:", err)
+		return 1
+	}
+	go func() { _ = http.Serve(ln, p) }()
+	base := "http://" + ln.Addr().String()
+	fmt.Fprintf(os.Stderr, "selftest: proxy %s -> %s\n", base, opts.Target)
+
+	client := &http.Client{Timeout: *timeout}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CASE\tRESULT\tDETAIL")
+	failed := 0
+	for _, c := range selftestCases(*model, opts, capture != nil) {
+		res, detail := "PASS", ""
+		if err := runSelftestCase(client, base, *auth, c, capture); err != nil {
+			res, detail = "FAIL", err.Error()
+			if errors.Is(err, errSelftestSkip) {
+				res, detail = "SKIP", strings.TrimPrefix(detail, errSelftestSkip.Error()+": ")
+			} else {
+				failed++
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.name, res, detail)
+	}
+	_ = tw.Flush()
+	if failed > 0 {
+		fmt.Printf("%d case(s) failed\n", failed)
+		return 1
+	}
+	return 0
+}
+
+var errSelftestSkip = errors.New("skip")
+
+func runSelftestCase(client *http.Client, base, auth string, c selftestCase, capture *selftestCapture) error {
+	if c.body == nil {
+		skip := c.skip
+		if skip == "" {
+			skip = "disabled by the current limits"
+		}
+		return fmt.Errorf("%w: %s", errSelftestSkip, skip)
+	}
+	body := c.body
+	if c.gzip {
+		var zb bytes.Buffer
+		zw := gzip.NewWriter(&zb)
+		_, _ = zw.Write(body)
+		_ = zw.Close()
+		body = zb.Bytes()
+	}
+	path := c.path
+	if path == "" {
+		path = "/v1/responses"
+	}
+	req, err := http.NewRequest(http.MethodPost, base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ct := c.contentType
+	if ct == "" {
+		ct = "application/json"
+	}
+	req.Header.Set("Content-Type", ct)
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("User-Agent", "rc-proxy-selftest/"+reserve.Build().Version)
+	req.Header.Set(selftestCaseHeader, c.name)
+	if c.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	rb, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	if !c.status(resp.StatusCode) {
+		return fmt.Errorf("unexpected status %d: %.120s", resp.StatusCode, rb)
+	}
+	if c.response != nil {
+		if err := c.response(resp.Header, rb); err != nil {
+			return err
+		}
+	}
+	if c.upstream != nil && capture != nil {
+		return c.upstream(capture.take(c.name))
+	}
+	return nil
+}
+
+func selftestCases(model string, opts reserve.Options, mock bool) []selftestCase {
+	is := func(want int) func(int) bool { return func(code int) bool { return code == want } }
+	// a real upstream may refuse the made-up previous_response_id; the
+	// proxy must still pass its answer through
+	passedThrough := func(code int) bool { return code < 500 }
+	if mock {
+		passedThrough = is(http.StatusOK)
+	}
+	q := func(s string) string { return fmt.Sprintf("%q", s) }
+	var oversized []byte
+	if opts.MaxBody > 0 {
+		pad := strings.Repeat("x", int(opts.MaxBody))
+		oversized = []byte(`{"model":` + q(model) + `,"input":"` + pad + `"}`)
+	}
+	// a real upstream would keep the uploaded file
+	var batch []byte
+	var batchType string
+	// the conversation cases run in order and must share a key
+	var convKey string
+	var ndjson []byte
+	// only the mock can be told to fail
+	var streamErr []byte
+	if mock {
+		streamErr = []byte(`{"model":` + q(model) + `,"stream":true,"input":"Reply with OK."}`)
+		batch, batchType = selftestBatchUpload(model)
+		line := `{"model":` + q(model) + `,"input":"Reply with OK."}`
+		ndjson = []byte(line + "\n\n" + `{"model":` + "\r\n" + line + "\n\n")
+	}
+
+	return []selftestCase{
+		{
+			name:     "plain",
+			body:     []byte(`{"model":` + q(model) + `,"input":"Reply with OK."}`),
+			status:   is(http.StatusOK),
+			upstream: forwardedJSON(hasCacheKey),
+		},
+		{
+			name:   "gzip",
+			body:   []byte(`{"model":` + q(model) + `,"input":"Reply with OK."}`),
+			gzip:   true,
+			status: is(http.StatusOK),
+			upstream: func(got *capturedRequest) error {
+				if got != nil && got.header.Get("Content-Encoding") != "" {
+					return fmt.Errorf("upstream got Content-Encoding %q", got.header.Get("Content-Encoding"))
+				}
+				return forwardedJSON(hasCacheKey)(got)
+			},
+		},
+		{
+			name:   "instructions",
+			body:   []byte(`{"model":` + q(model) + `,"instructions":"Answer briefly.","input":[{"role":"user","content":"Reply with OK."}]}`),
+			status: is(http.StatusOK),
+			upstream: forwardedJSON(hasCacheKey, func(m map[string]any) error {
+				if !opts.InstructionsRewrite {
+					if m["instructions"] != "Answer briefly." {
+						return errors.New("instructions changed with -instructions-rewrite=false")
+					}
+					return nil
+				}
+				if _, ok := m["instructions"]; ok {
+					return errors.New("instructions not migrated")
+				}
+				in, _ := m["input"].([]any)
+				first, _ := firstItem(in).(map[string]any)
+				if first["role"] != "developer" || first["content"] != "Answer briefly." {
+					return errors.New("input[0] is not the developer message")
+				}
+				return nil
+			}),
+		},
+		{
+			name:   "previous_response_id",
+			body:   []byte(`{"model":` + q(model) + `,"instructions":"Answer briefly.","previous_response_id":"resp_selftest","input":"Reply with OK."}`),
+			status: passedThrough,
+			upstream: forwardedJSON(hasCacheKey, func(m map[string]any) error {
+				if m["previous_response_id"] != "resp_selftest" {
+					return errors.New("previous_response_id not forwarded")
+				}
+				if m["instructions"] != "Answer briefly." {
+					return errors.New("instructions migrated on a continued conversation")
+				}
+				return nil
+			}),
+		},
+		{
+			name:   "conversation",
+			body:   []byte(`{"model":` + q(model) + `,"instructions":"Answer briefly.","conversation":"conv_selftest","input":"Reply with OK."}`),
+			status: passedThrough,
+			upstream: forwardedJSON(hasCacheKey, func(m map[string]any) error {
+				if m["instructions"] != "Answer briefly." {
+					return errors.New("instructions migrated on a conversation turn")
+				}
+				convKey, _ = m["prompt_cache_key"].(string)
+				return nil
+			}),
+		},
+		{
+			name:   "conversation_object",
+			body:   []byte(`{"model":` + q(model) + `,"conversation":{"id":"conv_selftest"},"input":"Reply with OK."}`),
+			status: passedThrough,
+			upstream: forwardedJSON(hasCacheKey, func(m map[string]any) error {
+				if k, _ := m["prompt_cache_key"].(string); k != convKey {
+					return fmt.Errorf("prompt_cache_key %q, want %q as for the string form", k, convKey)
+				}
+				return nil
+			}),
+		},
+		{
+			name:   "stream",
+			body:   []byte(`{"model":` + q(model) + `,"stream":true,"input":"Reply with OK."}`),
+			status: is(http.StatusOK),
+			response: func(h http.Header, body []byte) error {
+				if ct := h.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+					return fmt.Errorf("Content-Type %q, want text/event-stream", ct)
+				}
+				if !bytes.Contains(body, []byte("event: response.completed")) {
+					return errors.New("stream ended without response.completed")
+				}
+				return nil
+			},
+			upstream: forwardedJSON(hasCacheKey),
+		},
+		{
+			name:   "oversized",
+			body:   oversized,
+			status: is(http.StatusRequestEntityTooLarge),
+			upstream: func(got *capturedRequest) error {
+				if got != nil {
+					return errors.New("oversized body reached the upstream")
+				}
+				return nil
+			},
+		},
+		{
+			name:   "chat_completions",
+			path:   "/v1/chat/completions",
+			body:   []byte(`{"model":` + q(model) + `,"messages":[{"role":"system","content":"Answer briefly."},{"role":"user","content":"Reply with OK."}]}`),
+			status: is(http.StatusOK),
+			response: func(h http.Header, body []byte) error {
+				var m map[string]any
+				if err := sonic.Unmarshal(body, &m); err != nil {
+					return fmt.Errorf("response is not JSON: %v", err)
+				}
+				choices, _ := m["choices"].([]any)
+				first, _ := firstItem(choices).(map[string]any)
+				msg, _ := first["message"].(map[string]any)
+				if m["object"] != "chat.completion" || msg["role"] != "assistant" || first["finish_reason"] != "stop" {
+					return fmt.Errorf("not a finished chat.completion: %.120s", body)
+				}
+				return nil
+			},
+			upstream: forwardedJSON(hasCacheKey, func(m map[string]any) error {
+				if _, ok := m["messages"]; ok {
+					return errors.New("upstream got chat messages, not input")
+				}
+				if opts.InstructionsRewrite {
+					if _, ok := m["instructions"]; ok {
+						return errors.New("system message not migrated")
+					}
+				}
+				return nil
+			}),
+		},
+		{
+			name:   "chat_completions_stream",
+			path:   "/v1/chat/completions",
+			body:   []byte(`{"model":` + q(model) + `,"stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"Reply with OK."}]}`),
+			status: is(http.StatusOK),
+			response: func(h http.Header, body []byte) error {
+				for _, want := range []string{`"object":"chat.completion.chunk"`, `"finish_reason":"stop"`, `"usage":{`, "data: [DONE]"} {
+					if !bytes.Contains(body, []byte(want)) {
+						return fmt.Errorf("stream has no %s", want)
+					}
+				}
+				if bytes.Contains(body, []byte("event: response.")) {
+					return errors.New("stream still carries Responses events")
+				}
+				return nil
+			},
+			upstream: forwardedJSON(hasCacheKey),
+		},
+		{
+			name:   "chat_completions_unsupported",
+			path:   "/v1/chat/completions",
+			body:   []byte(`{"model":` + q(model) + `,"n":2,"logit_bias":{"1":1},"messages":[{"role":"user","content":"x"}]}`),
+			status: is(http.StatusBadRequest),
+			response: func(h http.Header, body []byte) error {
+				if !bytes.Contains(body, []byte("logit_bias, n")) {
+					return fmt.Errorf("400 does not list the parameters: %.120s", body)
+				}
+				return nil
+			},
+			upstream: func(got *capturedRequest) error {
+				if got != nil {
+					return errors.New("untranslatable request reached the upstream")
+				}
+				return nil
+			},
+		},
+		{
+			name:   "stream_error",
+			path:   "/v1/responses?mock_fail=stream_error",
+			body:   streamErr,
+			skip:   "mock upstream only",
+			status: is(http.StatusTooManyRequests),
+			response: func(h http.Header, body []byte) error {
+				if ct := h.Get("Content-Type"); ct != "application/json" {
+					return fmt.Errorf("Content-Type %q, want application/json", ct)
+				}
+				if !bytes.Contains(body, []byte(`"rate_limit_exceeded"`)) {
+					return fmt.Errorf("error code missing: %.120s", body)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "batch_upload",
+			path:        "/v1/files",
+			contentType: batchType,
+			body:        batch,
+			skip:        "mock upstream only",
+			// the mock has no files endpoint
+			status:   is(http.StatusNotFound),
+			upstream: checkBatchUpload,
+		},
+		{
+			name:        "ndjson",
+			path:        selftestNDJSONPath,
+			contentType: "application/x-ndjson",
+			body:        ndjson,
+			skip:        "mock upstream only",
+			// the mock has no such endpoint
+			status:   is(http.StatusNotFound),
+			upstream: checkNDJSON,
+		},
+		{
+			name:   "malformed_json",
+			body:   []byte(`{"model":` + q(model) + `,"input":`),
+			status: func(code int) bool { return code >= 400 && code < 500 },
+		},
+	}
+}
+
+// selftestNDJSONPath is the NDJSON route the ndjson case is sent to.
+const selftestNDJSONPath = "/_selftest/ndjson"
+
+// checkNDJSON checks both objects of the ndjson case got a
+// prompt_cache_key and every other byte came through as sent.
+func checkNDJSON(got *capturedRequest) error {
+	if got == nil {
+		return errors.New("request never reached the upstream")
+	}
+	lines := strings.Split(string(got.body), "\n")
+	if len(lines) != 6 || lines[1] != "" || lines[2] != `{"model":`+"\r" || lines[4] != "" || lines[5] != "" {
+		return fmt.Errorf("line structure not preserved: %q", got.body)
+	}
+	for _, i := range []int{0, 3} {
+		if err := forwardedJSON(hasCacheKey)(&capturedRequest{body: []byte(lines[i])}); err != nil {
+			return fmt.Errorf("line %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// selftestBatchLines is the size of the batch_upload case: a few MB of
+// JSONL, enough to show the upload is streamed rather than buffered.
+const selftestBatchLines = 4000
+
+// selftestBatchUpload builds a multipart batch input upload: Responses
+// lines, plus one chat line and one broken line that must come through
+// untouched.
+func selftestBatchUpload(model string) (body []byte, contentType string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	_ = mw.WriteField("purpose", "batch")
+	fw, _ := mw.CreateFormFile("file", "batch.jsonl")
+	pad := strings.Repeat("lorem ipsum ", 80)
+	for i := range selftestBatchLines {
+		fmt.Fprintf(fw, `{"custom_id":"r%d","method":"POST","url":"/v1/responses","body":{"model":%q,"input":%q}}`+"\n", i, model, pad)
+	}
+	fmt.Fprintf(fw, `{"custom_id":"chat","method":"POST","url":"/v1/chat/completions","body":{"model":%q,"messages":[]}}`+"\n", model)
+	fmt.Fprint(fw, `{"custom_id":"broken","method":"POST","url":`+"\n")
+	_ = mw.Close()
+	return buf.Bytes(), mw.FormDataContentType()
+}
+
+// checkBatchUpload checks every Responses line of the upload got a
+// prompt_cache_key and the other lines are as sent.
+func checkBatchUpload(got *capturedRequest) error {
+	if got == nil {
+		return errors.New("upload never reached the upstream")
+	}
+	_, params, err := mime.ParseMediaType(got.header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("upstream Content-Type: %v", err)
+	}
+	mr := multipart.NewReader(bytes.NewReader(got.body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return fmt.Errorf("upstream multipart: %v", err)
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return fmt.Errorf("upstream file part: %v", err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		if len(lines) != selftestBatchLines+2 {
+			return fmt.Errorf("upstream file has %d lines, want %d", len(lines), selftestBatchLines+2)
+		}
+		for i, line := range lines[:selftestBatchLines] {
+			var m struct {
+				Body map[string]any `json:"body"`
+			}
+			if err := sonic.UnmarshalString(line, &m); err != nil {
+				return fmt.Errorf("line %d: %v", i+1, err)
+			}
+			if err := hasCacheKey(m.Body); err != nil {
+				return fmt.Errorf("line %d: %v", i+1, err)
+			}
+		}
+		if strings.Contains(lines[selftestBatchLines], "prompt_cache_key") {
+			return errors.New("chat line was rewritten")
+		}
+		if lines[selftestBatchLines+1] != `{"custom_id":"broken","method":"POST","url":` {
+			return errors.New("broken line not passed through")
+		}
+		return nil
+	}
+}
+
+func firstItem(xs []any) any {
+	if len(xs) == 0 {
+		return nil
+	}
+	return xs[0]
+}
+
+func hasCacheKey(m map[string]any) error {
+	if k, _ := m["prompt_cache_key"].(string); k == "" {
+		return errors.New("upstream body has no prompt_cache_key")
+	}
+	return nil
+}
+
+// forwardedJSON checks the upstream got a JSON object passing every check.
+func forwardedJSON(checks ...func(map[string]any) error) func(*capturedRequest) error {
+	return func(got *capturedRequest) error {
+		if got == nil {
+			return errors.New("request never reached the upstream")
+		}
+		var m map[string]any
+		if err := sonic.Unmarshal(got.body, &m); err != nil {
+			return fmt.Errorf("upstream body is not JSON: %v", err)
+		}
+		for _, check := range checks {
+			if err := check(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
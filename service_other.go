@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import "log/slog"
+
+// not a Windows service: there is no service manager to report to
+
+var serviceStop <-chan struct{}
+
+func startService() {}
+
+func serviceRunning() {}
+
+func serviceStopped() {}
+
+func serviceLogHandler(h slog.Handler) slog.Handler { return h }
@@ -0,0 +1,276 @@
+//go:build windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	defaultServiceName = "rc-proxy"
+	// event IDs in the Application log
+	eventStart = 1
+	eventStop  = 2
+	eventLog   = 3
+)
+
+func init() { subcommands["service"] = runService }
+
+// winService is the running service: Execute talks to the service control
+// manager, main reports through serviceRunning and serviceStopped.
+type winService struct {
+	name    chan string   // the service name, sent once Execute starts
+	stop    chan struct{} // closed on Stop or Shutdown
+	running chan struct{} // closed by serviceRunning
+	done    chan struct{} // closed by serviceStopped
+	exited  chan struct{} // closed when svc.Run returns
+
+	elog     *eventlog.Log
+	stopOnce sync.Once
+}
+
+var (
+	service *winService
+	// serviceStop is closed when the service manager asks to stop; it is
+	// nil (blocks forever) outside a service.
+	serviceStop <-chan struct{}
+)
+
+// startService hands the process to the service control manager when it
+// was started as a Windows service, and opens its event log.
+func startService() {
+	if ok, err := svc.IsWindowsService(); err != nil || !ok {
+		return
+	}
+	s := &winService{
+		name:    make(chan string, 1),
+		stop:    make(chan struct{}),
+		running: make(chan struct{}),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	go func() {
+		defer close(s.exited)
+		if err := svc.Run(defaultServiceName, s); err != nil {
+			fmt.Fprintln(os.Stderr, "service:", err)
+			os.Exit(1)
+		}
+	}()
+	name := <-s.name
+	if l, err := eventlog.Open(name); err == nil {
+		s.elog = l
+	}
+	service, serviceStop = s, s.stop
+}
+
+func (s *winService) Execute(args []string, r <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.StartPending}
+	name := defaultServiceName
+	if len(args) > 0 {
+		name = args[0]
+	}
+	s.name <- name
+
+	running := s.running
+	for {
+		select {
+		case <-running:
+			running = nil
+			status <- svc.Status{State: svc.Running, Accepts: accepts}
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				// the drain may take up to -shutdown-timeout
+				hint := uint32((cfg.ShutdownTimeout + 5*time.Second).Milliseconds())
+				status <- svc.Status{State: svc.StopPending, WaitHint: hint}
+				s.stopOnce.Do(func() {
+					if s.elog != nil {
+						_ = s.elog.Info(eventStop, "rc-proxy stopping, draining in-flight requests")
+					}
+					close(s.stop)
+				})
+			}
+		case <-s.done:
+			return false, 0
+		}
+	}
+}
+
+// serviceRunning reports the service as started once the proxy listens.
+func serviceRunning() {
+	if service == nil {
+		return
+	}
+	close(service.running)
+	if service.elog != nil {
+		_ = service.elog.Info(eventStart, fmt.Sprintf("rc-proxy listening on %s, forwarding to %s", cfg.Listen, cfg.Target))
+	}
+}
+
+// serviceStopped reports the drain as finished and waits for the service
+// manager to take note before the process exits.
+func serviceStopped() {
+	if service == nil {
+		return
+	}
+	if service.elog != nil {
+		_ = service.elog.Info(eventStop, "rc-proxy stopped")
+	}
+	close(service.done)
+	<-service.exited
+}
+
+// serviceLogHandler copies warnings and errors to the event log when
+// running as a service; stderr goes nowhere there.
+func serviceLogHandler(h slog.Handler) slog.Handler {
+	if service == nil || service.elog == nil {
+		return h
+	}
+	return &eventLogHandler{Handler: h, elog: service.elog}
+}
+
+type eventLogHandler struct {
+	slog.Handler
+	elog *eventlog.Log
+}
+
+func (h *eventLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		var b bytes.Buffer
+		_ = slog.NewTextHandler(&b, nil).Handle(ctx, r)
+		if r.Level >= slog.LevelError {
+			_ = h.elog.Error(eventLog, b.String())
+		} else {
+			_ = h.elog.Warning(eventLog, b.String())
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *eventLogHandler) WithAttrs(as []slog.Attr) slog.Handler {
+	return &eventLogHandler{Handler: h.Handler.WithAttrs(as), elog: h.elog}
+}
+
+func (h *eventLogHandler) WithGroup(name string) slog.Handler {
+	return &eventLogHandler{Handler: h.Handler.WithGroup(name), elog: h.elog}
+}
+
+// runService is `rc-proxy service`: install, uninstall, start or stop the
+// Windows service. Arguments after install's flags become the server
+// flags the service is started with.
+func runService(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: rc-proxy service install|uninstall|start|stop [-name rc-proxy] [server flags...]")
+		return 2
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("rc-proxy service "+action, flag.ContinueOnError)
+	name := fs.String("name", defaultServiceName, "service name")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "service: connect to service manager:", err)
+		return 1
+	}
+	defer m.Disconnect()
+
+	switch action {
+	case "install":
+		err = installService(m, *name, fs.Args())
+	case "uninstall":
+		err = uninstallService(m, *name)
+	case "start":
+		err = withService(m, *name, func(s *mgr.Service) error { return s.Start() })
+	case "stop":
+		err = withService(m, *name, stopService)
+	default:
+		fmt.Fprintln(os.Stderr, "service: unknown action", action)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "service %s: %v\n", action, err)
+		return 1
+	}
+	fmt.Printf("service %s: %s done\n", *name, action)
+	return 0
+}
+
+func installService(m *mgr.Mgr, name string, serverArgs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return errors.New("already installed")
+	}
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "rc-proxy (right.codes reverse proxy)",
+		Description: "Rewrites OpenAI Responses API requests and forwards them to right.codes.",
+		StartType:   mgr.StartAutomatic,
+	}, serverArgs...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		_ = s.Delete()
+		return fmt.Errorf("event log source: %w", err)
+	}
+	return nil
+}
+
+func uninstallService(m *mgr.Mgr, name string) error {
+	err := withService(m, name, func(s *mgr.Service) error { return s.Delete() })
+	if err != nil {
+		return err
+	}
+	_ = eventlog.Remove(name)
+	return nil
+}
+
+func withService(m *mgr.Mgr, name string, fn func(*mgr.Service) error) error {
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("not installed: %w", err)
+	}
+	defer s.Close()
+	return fn(s)
+}
+
+// stopService asks the service to stop and waits for its drain to end.
+func stopService(s *mgr.Service) error {
+	st, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(cfg.ShutdownTimeout + 10*time.Second)
+	for st.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for the service to stop")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if st, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
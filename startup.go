@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/ycvk/rightcode-reserve/reserve"
+)
+
+// Exit codes of the server, for supervisors telling a bad configuration
+// (don't restart until it is fixed) from an address that could not be
+// bound (retry later, or free the port) and a failure while serving.
+const (
+	exitRuntime = 1
+	exitConfig  = 2
+	exitBind    = 3
+)
+
+// bindFailed logs why the listener what could not be bound to addr, and
+// which process holds the port where that can be told, then exits with
+// exitBind.
+func bindFailed(what, addr string, err error) {
+	attrs := []any{"listener", what, "addr", addr, "reason", bindReason(err)}
+	if errors.Is(err, syscall.EADDRINUSE) {
+		if _, port, perr := net.SplitHostPort(addr); perr == nil {
+			if pid, name := portOwner(port); pid > 0 {
+				attrs = append(attrs, "held_by_pid", pid, "held_by", name)
+			}
+		}
+	}
+	slog.Error("cannot listen", append(attrs, "error", err)...)
+	os.Exit(exitBind)
+}
+
+// bindListeners opens (or takes over from the old process of an upgrade)
+// the proxy listeners and the admin one, exiting with exitBind when one
+// can't be had. tn is set for a ts:// -listen and aln with -admin-listen.
+func bindListeners() (inh inherited, lns []*countingListener, tn *tailnet, aln net.Listener) {
+	inh, err := inheritListeners()
+	if err != nil {
+		bindFailed("inherited", cfg.Listen, err)
+	}
+	lns = countingListeners(inh.proxy)
+	if strings.HasPrefix(cfg.Listen, tailnetScheme) {
+		if tn, err = listenTailnet(cfg.Listen); err != nil {
+			bindFailed("tailnet", cfg.Listen, err)
+		}
+		lns = countingListeners([]net.Listener{tn.ln})
+	} else if len(lns) == 0 {
+		if lns, err = openListeners(cfg.Listen, cfg.Listeners); err != nil {
+			bindFailed("proxy", cfg.Listen, err)
+		}
+	}
+	listeners = lns
+	aln = inh.admin
+	if cfg.AdminListen != "" && aln == nil {
+		if aln, err = net.Listen("tcp", cfg.AdminListen); err != nil {
+			bindFailed("admin", cfg.AdminListen, err)
+		}
+	}
+	return inh, lns, tn, aln
+}
+
+// bindReason explains a listen error in terms of what to do about it.
+func bindReason(err error) string {
+	var ae *net.AddrError
+	var de *net.DNSError
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return "address already in use: another process listens on this port; stop it or pick another port"
+	case errors.Is(err, syscall.EACCES):
+		return "permission denied: ports below 1024 need root or CAP_NET_BIND_SERVICE"
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return "address not available: no local interface has this IP; use 0.0.0.0 or an address of this host"
+	case errors.As(err, &ae), errors.As(err, &de):
+		return "invalid address: want host:port or :port, e.g. :18080"
+	}
+	return "listen failed"
+}
+
+// logBanner logs what the server is about to serve, once it is bound.
+func logBanner(lns []*countingListener, inherited bool) {
+	addrs := make([]string, len(lns))
+	for i, ln := range lns {
+		addrs[i] = ln.Addr().String()
+	}
+	tls := "off"
+	if cfg.TSHTTPS {
+		tls = "tailnet"
+	}
+	upstreamTLS := false
+	if tu, err := url.Parse(cfg.Target); err == nil {
+		upstreamTLS = tu.Scheme == "https"
+	}
+	admin := "off"
+	if cfg.AdminListen != "" {
+		admin = cfg.AdminListen
+	}
+	bi := reserve.Build()
+	slog.Info("proxy server starting",
+		slog.String("version", bi.Version), slog.String("commit", bi.Commit),
+		slog.Group("listen", "config", cfg.Listen, "addrs", addrs, "inherited", inherited, "tls", tls),
+		slog.Group("upstream", "target", cfg.Target, "tls", upstreamTLS),
+		slog.Any("rewrites", enabledRewrites()),
+		slog.Group("endpoints", "stats", "/_reserve/stats", "admin", admin))
+}
+
+// enabledRewrites names the rewrite flags in effect.
+func enabledRewrites() []string {
+	var on []string
+	add := func(name string, set bool) {
+		if set {
+			on = append(on, name)
+		}
+	}
+	add("instructions-rewrite", cfg.InstructionsRewrite)
+	add("system-to-developer", cfg.SystemToDeveloper)
+	add("strip-reasoning", cfg.StripReasoning)
+	add("input-token-budget", cfg.InputTokenBudget > 0)
+	add("reasoning-include", cfg.ReasoningInclude)
+	add("policy", cfg.Policy != "")
+	add("tolerant-json", cfg.TolerantJSON)
+	add("unwrap-bodies", cfg.UnwrapBodies)
+	add("minimal-diff", cfg.MinimalDiff)
+	add("canonical-json", cfg.CanonicalJSON)
+	add("spill-threshold", cfg.SpillThreshold > 0)
+	return on
+}
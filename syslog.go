@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// -log-output syslog sends the log to syslog instead of stderr: RFC 5424
+// messages to the local daemon's socket or, with -syslog-addr, to a
+// remote udp:// or tcp:// one (TCP framed by octet counting, RFC 6587),
+// the attributes following the message as key=value pairs. Records are
+// queued and written by one goroutine, so a slow or lost syslog never
+// holds up a request: a full queue drops the record and counts it, and
+// the writer redials with backoff whenever a write fails. The drops are
+// reported in the log once it is back.
+
+const syslogQueue = 1024
+
+var syslogLocal = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+var syslogFacilities = map[string]int{
+	"user": 1, "daemon": 3,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+type syslogWriter struct {
+	network, addr string // network "" is the local socket
+	facility      int
+	hostname, tag string
+	pid           int
+
+	queue chan []byte
+
+	written, dropped, writeErrors, reconnects atomic.Int64
+	connected                                 atomic.Bool
+}
+
+// newSyslogWriter starts writing to addr ("" for the local socket,
+// "udp://host:port", "tcp://host:port" or "host:port" for UDP). The first
+// connection is tried now; if it fails the writer keeps trying in the
+// background.
+func newSyslogWriter(addr, facility, tag string) (*syslogWriter, error) {
+	fac, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	w := &syslogWriter{facility: fac, tag: tag, pid: os.Getpid(), queue: make(chan []byte, syslogQueue)}
+	if addr != "" {
+		w.network, w.addr = "udp", addr
+		if n, a, ok := strings.Cut(addr, "://"); ok {
+			w.network, w.addr = n, a
+		}
+		if w.network != "udp" && w.network != "tcp" {
+			return nil, fmt.Errorf("syslog address %q: network must be udp or tcp", addr)
+		}
+		if _, _, err := net.SplitHostPort(w.addr); err != nil {
+			return nil, fmt.Errorf("syslog address %q: %w", addr, err)
+		}
+	}
+	if w.hostname, _ = os.Hostname(); w.hostname == "" {
+		w.hostname = "-"
+	}
+	conn, err := w.dial()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "syslog: %v, retrying in the background\n", err)
+	} else {
+		w.connected.Store(true)
+	}
+	go w.run(conn)
+	return w, nil
+}
+
+func (w *syslogWriter) dial() (net.Conn, error) {
+	if w.network == "tcp" {
+		conn, err := net.DialTimeout(w.network, w.addr, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		c := &syslogTCPConn{Conn: conn, closed: make(chan struct{})}
+		go c.watch()
+		return c, nil
+	}
+	if w.network != "" {
+		return net.DialTimeout(w.network, w.addr, 5*time.Second)
+	}
+	for _, path := range syslogLocal {
+		for _, network := range []string{"unixgram", "unix"} {
+			if c, err := net.Dial(network, path); err == nil {
+				return c, nil
+			}
+		}
+	}
+	return nil, errors.New("no local syslog socket (" + strings.Join(syslogLocal, ", ") + ")")
+}
+
+// syslogTCPConn notices the server closing the connection: a write after
+// that still succeeds, and the record would be lost.
+type syslogTCPConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (c *syslogTCPConn) watch() {
+	// syslog servers never send; the read ends when the connection does
+	_, _ = io.Copy(io.Discard, c.Conn)
+	close(c.closed)
+}
+
+// enqueue hands msg to the writer, dropping it when the queue is full.
+func (w *syslogWriter) enqueue(msg []byte) {
+	select {
+	case w.queue <- msg:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+func (w *syslogWriter) run(conn net.Conn) {
+	backoff := time.Second
+	var reported int64 // drops already logged
+	for msg := range w.queue {
+		for {
+			if conn == nil {
+				var err error
+				if conn, err = w.dial(); err != nil {
+					// the record waits, the queue behind it fills and drops
+					time.Sleep(backoff)
+					backoff = min(2*backoff, 30*time.Second)
+					continue
+				}
+				w.reconnects.Add(1)
+			}
+			if !w.connected.Swap(true) {
+				backoff = time.Second
+				if w.reconnects.Load() > 0 {
+					fmt.Fprintln(os.Stderr, "syslog: reconnected")
+				}
+			}
+			if d := w.dropped.Load(); d > reported {
+				notice := w.format(nil, slog.LevelWarn, time.Now(), "syslog: log records dropped while the syslog was unreachable or slow")
+				notice = fmt.Appendf(notice, " dropped=%d total=%d", d-reported, d)
+				if w.send(conn, notice) == nil {
+					reported = d
+				}
+			}
+			if err := w.send(conn, msg); err != nil {
+				w.writeErrors.Add(1)
+				if w.connected.Swap(false) {
+					fmt.Fprintf(os.Stderr, "syslog: %v, reconnecting\n", err)
+				}
+				conn.Close()
+				conn = nil
+				continue
+			}
+			w.written.Add(1)
+			break
+		}
+	}
+}
+
+func (w *syslogWriter) send(conn net.Conn, msg []byte) error {
+	_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	switch conn.LocalAddr().Network() {
+	case "tcp":
+		if c, ok := conn.(*syslogTCPConn); ok {
+			select {
+			case <-c.closed:
+				return errors.New("syslog server closed the connection")
+			default:
+			}
+		}
+		msg = fmt.Appendf(nil, "%d %s", len(msg), msg)
+	case "unix":
+		// a stream socket of a local daemon: one record per line
+		msg = append(slices.Clip(msg), '\n')
+	}
+	_, err := conn.Write(msg)
+	return err
+}
+
+// flush waits, at most timeout, for the queue to empty.
+func (w *syslogWriter) flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for len(w.queue) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (w *syslogWriter) stats() any {
+	addr := "local"
+	if w.network != "" {
+		addr = w.network + "://" + w.addr
+	}
+	return map[string]any{
+		"addr":         addr,
+		"connected":    w.connected.Load(),
+		"queued":       len(w.queue),
+		"written":      w.written.Load(),
+		"dropped":      w.dropped.Load(),
+		"write_errors": w.writeErrors.Load(),
+		"reconnects":   w.reconnects.Load(),
+	}
+}
+
+// format appends the RFC 5424 header of a record and its message to b.
+func (w *syslogWriter) format(b []byte, level slog.Level, t time.Time, msg string) []byte {
+	b = fmt.Appendf(b, "<%d>1 ", w.facility*8+syslogSeverity(level))
+	if t.IsZero() {
+		b = append(b, '-')
+	} else {
+		b = t.AppendFormat(b, "2006-01-02T15:04:05.000000Z07:00")
+	}
+	b = fmt.Appendf(b, " %s %s %d - - %s", w.hostname, w.tag, w.pid, msg)
+	return b
+}
+
+func syslogSeverity(l slog.Level) int {
+	switch {
+	case l < slog.LevelInfo:
+		return 7 // debug
+	case l < slog.LevelWarn:
+		return 6 // informational
+	case l < slog.LevelError:
+		return 4 // warning
+	default:
+		return 3 // error
+	}
+}
+
+// syslogHandler is the slog.Handler of -log-output syslog.
+type syslogHandler struct {
+	w     *syslogWriter
+	level slog.Leveler
+	attrs []byte // of WithAttrs, rendered
+	group string // of WithGroup, the keys' "a.b." prefix
+}
+
+func (h *syslogHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *syslogHandler) Handle(_ context.Context, r slog.Record) error {
+	b := h.w.format(make([]byte, 0, 256), r.Level, r.Time, r.Message)
+	b = append(b, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		b = appendSyslogAttr(b, h.group, a)
+		return true
+	})
+	h.w.enqueue(b)
+	return nil
+}
+
+func (h *syslogHandler) WithAttrs(as []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = slices.Clip(c.attrs)
+	for _, a := range as {
+		c.attrs = appendSyslogAttr(c.attrs, h.group, a)
+	}
+	return &c
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.group += name + "."
+	return &c
+}
+
+func appendSyslogAttr(b []byte, prefix string, a slog.Attr) []byte {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return b
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			b = appendSyslogAttr(b, prefix, ga)
+		}
+		return b
+	}
+	var v string
+	if a.Value.Kind() == slog.KindTime {
+		v = a.Value.Time().Format(time.RFC3339Nano)
+	} else {
+		v = a.Value.String()
+	}
+	b = append(b, ' ')
+	b = append(b, prefix...)
+	b = append(b, a.Key...)
+	b = append(b, '=')
+	if v == "" || strings.ContainsFunc(v, func(r rune) bool {
+		return r == '=' || r == '"' || unicode.IsSpace(r) || !unicode.IsPrint(r)
+	}) {
+		return strconv.AppendQuote(b, v)
+	}
+	return append(b, v...)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syslogServer accepts TCP syslog connections and yields the records they
+// carry, octet-counting framed. conns gets each accepted connection.
+type syslogServer struct {
+	ln    net.Listener
+	recs  chan string
+	conns chan net.Conn
+}
+
+func newSyslogServer(t *testing.T, addr string) *syslogServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &syslogServer{ln: ln, recs: make(chan string, 4096), conns: make(chan net.Conn, 8)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns <- c
+			go func() {
+				br := bufio.NewReader(c)
+				for {
+					n, err := br.ReadString(' ')
+					if err != nil {
+						return
+					}
+					size, _ := strconv.Atoi(strings.TrimSuffix(n, " "))
+					msg := make([]byte, size)
+					if _, err := io.ReadFull(br, msg); err != nil {
+						return
+					}
+					s.recs <- string(msg)
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+// next returns the next record, failing after timeout.
+func (s *syslogServer) next(t *testing.T, timeout time.Duration) string {
+	t.Helper()
+	select {
+	case r := <-s.recs:
+		return r
+	case <-time.After(timeout):
+		t.Fatal("no syslog record")
+		return ""
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func syslogLogger(t *testing.T, addr string) (*slog.Logger, *syslogWriter) {
+	t.Helper()
+	w, err := newSyslogWriter("tcp://"+addr, "local3", "rc-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return slog.New(&syslogHandler{w: w, level: slog.LevelDebug}), w
+}
+
+func TestSyslogFormat(t *testing.T) {
+	srv := newSyslogServer(t, "127.0.0.1:0")
+	log, _ := syslogLogger(t, srv.ln.Addr().String())
+	log.With("request_id", "r1").WithGroup("up").Warn("upstream slow",
+		"ms", 1500, "note", `says "hi" here`, slog.Group("tls", "v", "1.3"), "empty", "")
+
+	rec := srv.next(t, 5*time.Second)
+	// local3 (19) * 8 + warning (4)
+	if !strings.HasPrefix(rec, "<156>1 ") {
+		t.Errorf("record %q, want PRI 156 and version 1", rec)
+	}
+	if f := strings.Fields(rec); len(f) < 8 || f[3] != "rc-proxy" || f[5] != "-" || f[6] != "-" {
+		t.Errorf("record %q, want the tag, no msgid and no structured data", rec)
+	}
+	for _, want := range []string{
+		" - - upstream slow request_id=r1 up.ms=1500 ",
+		` up.note="says \"hi\" here"`, " up.tls.v=1.3", ` up.empty=""`,
+	} {
+		if !strings.Contains(rec, want) {
+			t.Errorf("record %q lacks %q", rec, want)
+		}
+	}
+}
+
+func TestSyslogReconnect(t *testing.T) {
+	srv := newSyslogServer(t, "127.0.0.1:0")
+	log, w := syslogLogger(t, srv.ln.Addr().String())
+	log.Info("first")
+	if rec := srv.next(t, 5*time.Second); !strings.HasSuffix(rec, " first") {
+		t.Fatalf("record %q", rec)
+	}
+
+	// the server drops the connection; the writer notices and redials
+	(<-srv.conns).Close()
+	time.Sleep(50 * time.Millisecond)
+	log.Info("second")
+	if rec := srv.next(t, 5*time.Second); !strings.HasSuffix(rec, " second") {
+		t.Fatalf("record %q after the reconnect", rec)
+	}
+	st := w.stats().(map[string]any)
+	if st["reconnects"] != int64(1) || st["write_errors"] != int64(1) || st["connected"] != true || st["written"] != int64(2) {
+		t.Errorf("stats %v", st)
+	}
+}
+
+// TestSyslogUnreachable logs faster than a syslog that isn't there takes
+// records: logging must not block, the overflow is dropped and counted,
+// and once the server is up it gets a drop notice, then the queue.
+func TestSyslogUnreachable(t *testing.T) {
+	addr := freeAddr(t)
+	log, w := syslogLogger(t, addr)
+	const n = syslogQueue + 500
+	start := time.Now()
+	for i := range n {
+		log.InfoContext(context.Background(), "record", "i", i)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("logging %d records took %v with syslog down", n, d)
+	}
+	st := w.stats().(map[string]any)
+	dropped := st["dropped"].(int64)
+	if st["connected"] != false || dropped < n-syslogQueue-1 {
+		t.Fatalf("stats %v, want about %d dropped", st, n-syslogQueue)
+	}
+
+	srv := newSyslogServer(t, addr)
+	// a notice of what was dropped goes first, then the queue, from the
+	// record the writer held while redialing on
+	notice := srv.next(t, 10*time.Second)
+	if !strings.Contains(notice, "records dropped") || !strings.Contains(notice, "dropped="+strconv.FormatInt(dropped, 10)) {
+		t.Errorf("first record %q, want the drop notice", notice)
+	}
+	if rec := srv.next(t, 5*time.Second); !strings.HasSuffix(rec, " record i=0") {
+		t.Errorf("second record %q, want the first one logged", rec)
+	}
+	for i := 1; i < syslogQueue; i++ {
+		if rec := srv.next(t, 5*time.Second); !strings.HasSuffix(rec, " record i="+strconv.Itoa(i)) {
+			t.Fatalf("record %q, want i=%d", rec, i)
+		}
+	}
+}
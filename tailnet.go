@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// tailnetScheme prefixes a -listen address served on the tailnet instead:
+// ts://<hostname>[:port]. Only builds with -tags tsnet support it (see
+// tailnet_tsnet.go), so no other build links tailscale.com.
+const tailnetScheme = "ts://"
+
+// tailnet is the proxy listener on a tailnet node of its own.
+type tailnet struct {
+	ln net.Listener
+	// wrap resolves each caller's tailnet identity (WhoIs) and hands it
+	// to the proxy as the client identity.
+	wrap  func(http.Handler) http.Handler
+	close func() error
+}
+
+// tailnetAddr splits a ts:// address into the node's hostname and port,
+// 443 with -ts-https and 80 otherwise by default.
+func tailnetAddr(addr string) (host, port string) {
+	host = strings.TrimPrefix(addr, tailnetScheme)
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		return h, p
+	}
+	if cfg.TSHTTPS {
+		return host, "443"
+	}
+	return host, "80"
+}
@@ -0,0 +1,9 @@
+//go:build !tsnet
+
+package main
+
+import "errors"
+
+func listenTailnet(string) (*tailnet, error) {
+	return nil, errors.New("this build has no tailnet support, rebuild with -tags tsnet")
+}
@@ -0,0 +1,67 @@
+//go:build tsnet
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/ycvk/rightcode-reserve/reserve"
+	"tailscale.com/tsnet"
+)
+
+// listenTailnet brings up a tsnet node named after addr, its state in
+// -ts-dir and authorized with TS_AUTHKEY on first start, and listens on
+// it, with the tailnet's HTTPS certificate when -ts-https is set.
+func listenTailnet(addr string) (*tailnet, error) {
+	host, port := tailnetAddr(addr)
+	s := &tsnet.Server{
+		Hostname: host,
+		Dir:      cfg.TSDir,
+		AuthKey:  os.Getenv("TS_AUTHKEY"),
+		Logf: func(format string, args ...any) {
+			slog.Debug("tsnet: " + fmt.Sprintf(format, args...))
+		},
+	}
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	var ln net.Listener
+	var err error
+	if cfg.TSHTTPS {
+		ln, err = s.ListenTLS("tcp", ":"+port)
+	} else {
+		ln, err = s.Listen("tcp", ":"+port)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	lc, err := s.LocalClient()
+	if err != nil {
+		ln.Close()
+		s.Close()
+		return nil, err
+	}
+	wrap := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			who, err := lc.WhoIs(r.Context(), r.RemoteAddr)
+			switch {
+			case err != nil:
+				// the request falls back to its credential headers
+				slog.Debug("tailnet: WhoIs failed", "remote", r.RemoteAddr, "error", err)
+			case who.Node != nil && who.Node.IsTagged():
+				// tagged devices have no user; they are who they are
+				r = r.WithContext(reserve.WithClientID(r.Context(), "tailscale", "node:"+who.Node.Name))
+			case who.UserProfile != nil:
+				r = r.WithContext(reserve.WithClientID(r.Context(), "tailscale", "user:"+who.UserProfile.LoginName))
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	slog.Info("tailnet node up", "hostname", host, "port", port, "https", cfg.TSHTTPS, "dir", cfg.TSDir)
+	return &tailnet{ln: ln, wrap: wrap, close: s.Close}, nil
+}
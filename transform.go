@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bytedance/sonic"
+	"github.com/ycvk/rightcode-reserve/reserve"
+)
+
+// runTransform is `rc-proxy transform`: it runs one request body from stdin
+// through the same Rewriter the server uses and prints the forwarded body
+// to stdout, with a summary on stderr. It exits 1 when the body is
+// rejected or isn't valid JSON.
+func runTransform(args []string) int {
+	fs := flag.NewFlagSet("rc-proxy transform", flag.ContinueOnError)
+	auth := fs.String("auth", "", "Authorization header value the cache key is derived from")
+	apiKey := fs.String("api-key", "", "x-api-key header value (when -auth is empty)")
+	remote := fs.String("remote", "127.0.0.1:0", "client address for the RemoteAddr+User-Agent fallback key")
+	ua := fs.String("user-agent", "", "User-Agent header value")
+	path := fs.String("path", "/v1/responses", "request path, matched against the route table")
+	gz := fs.Bool("gzip", false, "gzip the input before rewriting, as a Content-Encoding: gzip client would")
+	mounts := fs.String("mounts", ",/codex", "comma-separated mount prefixes")
+	rewriteFlags(fs)
+	if err := fs.Parse(args); err != nil || checkRewriteFlags(fs) != nil {
+		return 2
+	}
+	cfg.Options.Mounts = strings.Split(*mounts, ",")
+
+	in, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "read stdin:", err)
+		return 1
+	}
+	body := in
+	if *gz {
+		var zb bytes.Buffer
+		zw := gzip.NewWriter(&zb)
+		_, _ = zw.Write(in)
+		_ = zw.Close()
+		body = zb.Bytes()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, *path, bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bad -path:", err)
+		return 2
+	}
+	req.RemoteAddr = *remote
+	req.Header.Set("Content-Type", "application/json")
+	if *gz {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if *auth != "" {
+		req.Header.Set("Authorization", *auth)
+	}
+	if *apiKey != "" {
+		req.Header.Set("x-api-key", *apiKey)
+	}
+	if *ua != "" {
+		req.Header.Set("User-Agent", *ua)
+	}
+
+	res, err := reserve.NewRewriter(cfg.Options).RewriteRequest(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "rejected:", err)
+		return 1
+	}
+	out, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "read rewritten body:", err)
+		return 1
+	}
+	os.Stdout.Write(out)
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		os.Stdout.Write([]byte{'\n'})
+	}
+
+	route := res.Route
+	if route == "" {
+		route = "(none, proxied untouched)"
+	}
+	fmt.Fprintf(os.Stderr, "route: %s\nrewritten: %v\napplied: %s\nbytes: %d -> %d\n",
+		route, res.Rewritten, strings.Join(res.Applied, ", "), len(in), len(out))
+	if ce := req.Header.Get("Content-Encoding"); ce != "" {
+		fmt.Fprintf(os.Stderr, "content-encoding: %s (not decompressed, forwarded as-is)\n", ce)
+		return 1
+	}
+	if !sonic.Valid(out) {
+		fmt.Fprintln(os.Stderr, "forwarded body is not valid JSON")
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ycvk/rightcode-reserve/reserve"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// transformCases are run through `rc-proxy transform` and the proxy; the
+// body is testdata/transform/<name>.json, the CLI output goes in
+// <name>.golden.
+var transformCases = []struct {
+	name string
+	args []string
+	path string // defaults to /v1/responses
+	hdr  http.Header
+	gzip bool // the client sends the body gzipped
+}{
+	{name: "plain", args: []string{"-auth", "Bearer sk-a"}, hdr: http.Header{"Authorization": {"Bearer sk-a"}}},
+	{name: "instructions", args: []string{"-api-key", "sk-b"}, hdr: http.Header{"X-Api-Key": {"sk-b"}}},
+	{name: "continued", args: []string{"-auth", "Bearer sk-a"}, hdr: http.Header{"Authorization": {"Bearer sk-a"}}},
+	{name: "minimal", args: []string{"-minimal-diff", "-remote", "192.0.2.1:1234"}},
+	{name: "chat", args: []string{"-auth", "Bearer sk-a", "-path", "/codex/v1/chat/completions"},
+		path: "/codex/v1/chat/completions", hdr: http.Header{"Authorization": {"Bearer sk-a"}}},
+	{name: "gzip", args: []string{"-gzip", "-auth", "Bearer sk-a"}, hdr: http.Header{"Authorization": {"Bearer sk-a"}}, gzip: true},
+	{name: "other", args: []string{"-path", "/v2/other"}, path: "/v2/other"},
+}
+
+// transform runs runTransform on body with args and returns its exit
+// code, stdout and stderr.
+func transform(t *testing.T, args []string, body []byte) (int, []byte, []byte) {
+	t.Helper()
+	saved := cfg
+	defer func() { cfg = saved }()
+	dir := t.TempDir()
+	files := make([]*os.File, 3)
+	for i, name := range []string{"stdin", "stdout", "stderr"} {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files[i] = f
+	}
+	files[0].Write(body)
+	files[0].Seek(0, io.SeekStart)
+	stdin, stdout, stderr := os.Stdin, os.Stdout, os.Stderr
+	os.Stdin, os.Stdout, os.Stderr = files[0], files[1], files[2]
+	code := runTransform(args)
+	os.Stdin, os.Stdout, os.Stderr = stdin, stdout, stderr
+
+	out, _ := os.ReadFile(files[1].Name())
+	errOut, _ := os.ReadFile(files[2].Name())
+	return code, out, errOut
+}
+
+func TestTransformGolden(t *testing.T) {
+	for _, tc := range transformCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := os.ReadFile(filepath.Join("testdata", "transform", tc.name+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, out, summary := transform(t, tc.args, body)
+			if code != 0 {
+				t.Fatalf("exit %d: %s", code, summary)
+			}
+			got := append(append(out, "--- stderr\n"...), summary...)
+			golden := filepath.Join("testdata", "transform", tc.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("transform output\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+// TestTransformMatchesServer checks that the proxy forwards what the CLI
+// prints, for the same body, headers and flags.
+func TestTransformMatchesServer(t *testing.T) {
+	for _, tc := range transformCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := os.ReadFile(filepath.Join("testdata", "transform", tc.name+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, out, _ := transform(t, tc.args, body)
+
+			var forwarded []byte
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwarded, _ = io.ReadAll(r.Body)
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, `{"id":"resp_1","object":"response"}`)
+			}))
+			defer upstream.Close()
+			opts := reserve.DefaultOptions()
+			opts.Target = upstream.URL
+			opts.Mounts = []string{"", "/codex"}
+			opts.MinimalDiff = strings.Contains(strings.Join(tc.args, " "), "-minimal-diff")
+			p, err := reserve.NewProxy(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := tc.path
+			if path == "" {
+				path = "/v1/responses"
+			}
+			if tc.gzip {
+				var zb bytes.Buffer
+				zw := gzip.NewWriter(&zb)
+				zw.Write(body)
+				zw.Close()
+				body = zb.Bytes()
+			}
+			req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if tc.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			for k, vs := range tc.hdr {
+				req.Header[k] = vs
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("proxy answered %d %s", w.Code, w.Body)
+			}
+			// the CLI ends its output with a newline the body may not have
+			if !bytes.Equal(forwarded, out) && !bytes.Equal(append(forwarded, '\n'), out) {
+				t.Errorf("proxy forwarded\n%s\nthe CLI printed\n%s", forwarded, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// no fd inheritance: SIGUSR2 upgrades are unavailable and every start
+// opens its own listeners
+
+func notifyUpgrade(chan<- os.Signal) {}
+
+func inheritListeners() (inherited, error) { return inherited{}, nil }
+
+func signalReady() {}
+
+func upgradeBinary([]*countingListener, net.Listener, time.Duration) error {
+	return errors.New("binary upgrade is not supported on this platform")
+}
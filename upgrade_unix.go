@@ -0,0 +1,144 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// An upgraded child finds its listeners at fd 3 onwards, one per entry of
+// envListeners ("proxy" or "admin"), and writes a byte to envReadyFD once
+// it serves on them.
+const (
+	envListeners = "RC_PROXY_LISTENERS"
+	envReadyFD   = "RC_PROXY_READY_FD"
+)
+
+// notifyUpgrade relays SIGUSR2, the upgrade request, to c.
+func notifyUpgrade(c chan<- os.Signal) { signal.Notify(c, syscall.SIGUSR2) }
+
+// inheritListeners returns the listeners handed over by the parent of an
+// upgrade, or an empty set when the process was started normally.
+func inheritListeners() (inherited, error) {
+	var inh inherited
+	roles := os.Getenv(envListeners)
+	if roles == "" {
+		return inh, nil
+	}
+	os.Unsetenv(envListeners)
+	for i, role := range strings.Split(roles, ",") {
+		f := os.NewFile(uintptr(3+i), role)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return inh, fmt.Errorf("inherited %s listener (fd %d): %w", role, 3+i, err)
+		}
+		switch role {
+		case "admin":
+			inh.admin = ln
+		default:
+			inh.proxy = append(inh.proxy, ln)
+		}
+	}
+	return inh, nil
+}
+
+// signalReady tells the parent of an upgrade that this process is serving,
+// so it can stop accepting and drain. It does nothing otherwise.
+func signalReady() {
+	s := os.Getenv(envReadyFD)
+	if s == "" {
+		return
+	}
+	os.Unsetenv(envReadyFD)
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	_, _ = f.Write([]byte{1})
+	f.Close()
+}
+
+// upgradeBinary re-executes the binary (possibly replaced on disk) with the
+// same arguments, handing it lns and admin, and waits up to timeout for it
+// to signal readiness. On error the child, if any, is killed and this
+// process carries on serving.
+func upgradeBinary(lns []*countingListener, admin net.Listener, timeout time.Duration) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	var roles []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	add := func(ln net.Listener, role string) error {
+		tl, ok := ln.(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("%s listener is %T, not TCP", role, ln)
+		}
+		f, err := tl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		roles = append(roles, role)
+		return nil
+	}
+	for _, l := range lns {
+		if err := add(l.Listener, "proxy"); err != nil {
+			return err
+		}
+	}
+	if admin != nil {
+		if err := add(admin, "admin"); err != nil {
+			return err
+		}
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer pr.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, pw)
+	cmd.Env = append(os.Environ(),
+		envListeners+"="+strings.Join(roles, ","),
+		envReadyFD+"="+strconv.Itoa(3+len(files)),
+	)
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		return err
+	}
+
+	// a child that exits before signalling closes the pipe: EOF
+	_ = pr.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := pr.Read(make([]byte, 1)); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("new process not ready after %s", timeout)
+		}
+		return errors.New("new process exited before becoming ready")
+	}
+	// the child outlives us; reaping it is init's job
+	_ = cmd.Process.Release()
+	return nil
+}
@@ -0,0 +1,175 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ycvk/rightcode-reserve/reserve"
+)
+
+// TestUpgradeUnderLoad runs the server as a process of its own, upgrades
+// it with SIGUSR2 while clients keep opening connections, and checks that
+// none of them is refused and a stream in flight finishes.
+func TestUpgradeUnderLoad(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts server processes")
+	}
+	mopts := reserve.DefaultMockOptions()
+	mopts.Delay = 0
+	h, err := reserve.NewMockUpstream(mopts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := httptest.NewServer(h)
+	defer mock.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	logf, err := os.Create(filepath.Join(t.TempDir(), "server.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logf.Close()
+	// a file, not a pipe: the new process inherits it and outlives the old
+	cmd := exec.Command(os.Args[0], "-listen", addr, "-target", mock.URL, "-warmup=false",
+		"-shutdown-timeout", "10s", "-upgrade-timeout", "10s")
+	cmd.Env = append(os.Environ(), envTestMain+"=1")
+	cmd.Stdout, cmd.Stderr = logf, logf
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// the new process stays in the group
+	defer syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	defer func() {
+		if t.Failed() {
+			bs, _ := os.ReadFile(logf.Name())
+			t.Logf("server log:\n%s", bs)
+		}
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+		Timeout:   10 * time.Second,
+	}
+	post := func(query, body string) (*http.Response, error) {
+		return client.Post("http://"+addr+"/v1/responses"+query, "application/json", strings.NewReader(body))
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		resp, err := post("", `{"input":"hi"}`)
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server not up: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	var (
+		stop     atomic.Bool
+		ok, errs atomic.Int64
+		wg       sync.WaitGroup
+		firstErr atomic.Value
+	)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				resp, err := post("", `{"input":"hi"}`)
+				if err == nil {
+					_, err = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					if err == nil && resp.StatusCode != http.StatusOK {
+						err = &statusError{resp.StatusCode}
+					}
+				}
+				if err != nil {
+					errs.Add(1)
+					firstErr.CompareAndSwap(nil, err)
+				} else {
+					ok.Add(1)
+				}
+			}
+		}()
+	}
+
+	// a stream the old process has to drain: 8 deltas, 100ms apart
+	stream := make(chan string, 1)
+	go func() {
+		resp, err := post("?mock_delay=100ms", `{"input":"hi","stream":true}`)
+		if err != nil {
+			stream <- err.Error()
+			return
+		}
+		bs, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		stream <- string(bs)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	if err := cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("old process: %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("old process still running 30s after SIGUSR2")
+	}
+	// keep the load on the new process for a while
+	time.Sleep(300 * time.Millisecond)
+	stop.Store(true)
+	wg.Wait()
+
+	t.Logf("%d requests during the upgrade", ok.Load()+errs.Load())
+	if n := errs.Load(); n > 0 {
+		t.Errorf("%d of %d requests failed during the upgrade, first: %v", n, n+ok.Load(), firstErr.Load())
+	}
+	if ok.Load() == 0 {
+		t.Error("no request went through")
+	}
+	if s := <-stream; !strings.Contains(s, "response.completed") {
+		t.Errorf("stream in flight during the upgrade ended with %q", s)
+	}
+	if !strings.Contains(readFile(t, logf.Name()), "new process ready, handing over") {
+		t.Error("no handover in the server log")
+	}
+}
+
+type statusError struct{ code int }
+
+func (e *statusError) Error() string { return http.StatusText(e.code) }
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	bs, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}